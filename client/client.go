@@ -0,0 +1,203 @@
+// client/client.go
+
+// Package client is a typed client for the admin API of a runtime started
+// with -admin, so that services and tools watching a runtime don't decode
+// its JSON by hand:
+//
+//	c := client.New("http://rex-runtime:8080", client.Options{Retries: 3})
+//	health, err := c.Health(ctx)
+//
+// The admin API reports the runtime's statistics, rules, facts and health,
+// and switches its rules on and off. The runtime has no API to push facts,
+// evaluate or replace the bytecode remotely; facts reach it through Redis or
+// NATS. The rules service started with rex serve does, and the pkg/rexclient
+// package calls it.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"rgehrsitz/rex/internal/admin"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+	"time"
+)
+
+// Types returned by the admin API.
+type (
+	Snapshot      = admin.Snapshot
+	RuleStats     = admin.RuleStats
+	RuleDetail    = admin.RuleDetail
+	Firing        = admin.Firing
+	Health        = admin.Health
+	BreakerStatus = runtime.BreakerStatus
+)
+
+// DefaultTimeout bounds each request of a client without an HTTP client of
+// its own.
+const DefaultTimeout = 5 * time.Second
+
+// Options configures a Client.
+type Options struct {
+	HTTPClient *http.Client  // Client sending the requests; one with DefaultTimeout if nil
+	Token      string        // Sent as a bearer token, for runtimes behind a proxy authenticating requests
+	Retries    int           // Attempts after the first for requests failing with a network error or a 5xx status
+	RetryDelay time.Duration // Delay before the first retry, doubled for each one after it; 100ms if zero
+}
+
+// Client calls the admin API of a runtime. It is safe for concurrent use.
+type Client struct {
+	base    string
+	options Options
+}
+
+// StatusError is returned when the admin API answers with a status other
+// than 200 OK, such as 404 Not Found from a runtime too old to serve an
+// endpoint.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("admin API returned %s", e.Status)
+}
+
+// New returns a client for the admin API served at addr, such as
+// http://localhost:8080.
+func New(addr string, options Options) *Client {
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	if options.RetryDelay == 0 {
+		options.RetryDelay = 100 * time.Millisecond
+	}
+	return &Client{base: strings.TrimSuffix(addr, "/"), options: options}
+}
+
+// Snapshot returns all the statistics of the runtime.
+func (c *Client) Snapshot(ctx context.Context) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := c.get(ctx, "/api/snapshot", &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// Rules returns the statistics of the rules evaluated so far.
+func (c *Client) Rules(ctx context.Context) ([]RuleStats, error) {
+	var rules []RuleStats
+	return rules, c.get(ctx, "/api/rules", &rules)
+}
+
+// RuleDetails returns the loaded rules with their metadata, state, facts and
+// statistics.
+func (c *Client) RuleDetails(ctx context.Context) ([]RuleDetail, error) {
+	var details []RuleDetail
+	return details, c.get(ctx, "/api/rules/details", &details)
+}
+
+// Facts returns the current fact values. Numbers are returned as float64.
+func (c *Client) Facts(ctx context.Context) (map[string]interface{}, error) {
+	var facts map[string]interface{}
+	return facts, c.get(ctx, "/api/facts", &facts)
+}
+
+// Firings returns the recent rule firings, oldest first.
+func (c *Client) Firings(ctx context.Context) ([]Firing, error) {
+	var firings []Firing
+	return firings, c.get(ctx, "/api/firings", &firings)
+}
+
+// Breakers returns the circuit breakers of the action handlers.
+func (c *Client) Breakers(ctx context.Context) ([]BreakerStatus, error) {
+	var breakers []BreakerStatus
+	return breakers, c.get(ctx, "/api/breakers", &breakers)
+}
+
+// Health returns the overall health of the runtime.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var health Health
+	if err := c.get(ctx, "/api/health", &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// EnableRule enables the named rule of the runtime from its next cycle on
+// and returns the rule's details. ruleset names the rule's ruleset in a
+// composition whose rulesets share the name, and is empty otherwise.
+func (c *Client) EnableRule(ctx context.Context, ruleset, name string) (*RuleDetail, error) {
+	return c.switchRule(ctx, ruleset, name, "enable")
+}
+
+// DisableRule disables the named rule of the runtime from its next cycle on
+// and returns the rule's details. A runtime without the rule answers with a
+// StatusError for 404 Not Found.
+func (c *Client) DisableRule(ctx context.Context, ruleset, name string) (*RuleDetail, error) {
+	return c.switchRule(ctx, ruleset, name, "disable")
+}
+
+func (c *Client) switchRule(ctx context.Context, ruleset, name, operation string) (*RuleDetail, error) {
+	path := "/api/rules/" + url.PathEscape(name) + "/" + operation
+	if ruleset != "" {
+		path += "?ruleset=" + url.QueryEscape(ruleset)
+	}
+	var detail RuleDetail
+	if err := c.do(ctx, http.MethodPost, path, &detail); err != nil {
+		return nil, err
+	}
+	return &detail, nil
+}
+
+// get fetches an endpoint and decodes its JSON into result, retrying
+// failures that may be transient.
+func (c *Client) get(ctx context.Context, path string, result interface{}) error {
+	return c.do(ctx, http.MethodGet, path, result)
+}
+
+// do sends a request to an endpoint and decodes the JSON it answers with into
+// result, retrying failures that may be transient. Only idempotent requests
+// are sent.
+func (c *Client) do(ctx context.Context, method, path string, result interface{}) error {
+	delay := c.options.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := c.doOnce(ctx, method, path, result)
+		if err == nil || !retry || attempt >= c.options.Retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// doOnce sends a request once, reporting whether a failure may be transient:
+// the runtime couldn't be reached or failed to answer.
+func (c *Client) doOnce(ctx context.Context, method, path string, result interface{}) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, nil)
+	if err != nil {
+		return false, err
+	}
+	if c.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.options.Token)
+	}
+	resp, err := c.options.HTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return false, fmt.Errorf("invalid admin API response from %s: %w", path, err)
+	}
+	return false, nil
+}
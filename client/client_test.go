@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"rgehrsitz/rex/internal/admin"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// monitoredServer serves the admin API of a VM running a rule that sets
+// fan_status from fan_on, after a cycle with fan_on set.
+func monitoredServer(t *testing.T) *httptest.Server {
+	code := make([]byte, 12) // Header skipped by the VM
+	code = append(code, byte(bytecode.RULE_START), 0, 0, 0, 0)
+	code = append(code, byte(bytecode.LOAD_FACT))
+	code = append(code, "fan_on\x00"...)
+	code = append(code, byte(bytecode.UPDATE_FACT))
+	code = append(code, "fan_status\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	section, err := bytecode.NewRulesSection([]bytecode.RuleSymbol{{Name: "fan"}})
+	require.NoError(t, err)
+
+	vm := runtime.NewVM(bytecode.AppendSections(code, section))
+	monitor := admin.NewMonitor(vm)
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run())
+
+	server := httptest.NewServer(admin.NewHandler(monitor))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient(t *testing.T) {
+	c := New(monitoredServer(t).URL+"/", Options{})
+	ctx := context.Background()
+
+	snapshot, err := c.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, snapshot.Cycles)
+
+	rules, err := c.Rules(ctx)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, "fan", rules[0].Label)
+	assert.Equal(t, 1, rules[0].Firings)
+
+	details, err := c.RuleDetails(ctx)
+	require.NoError(t, err)
+	require.Len(t, details, 1)
+	assert.Equal(t, "fan", details[0].Name)
+	assert.True(t, details[0].Enabled)
+	assert.Equal(t, []string{"fan_status"}, details[0].Writes)
+
+	facts, err := c.Facts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, true, facts["fan_status"])
+
+	firings, err := c.Firings(ctx)
+	require.NoError(t, err)
+	require.Len(t, firings, 1)
+	assert.Equal(t, "fan", firings[0].Label)
+
+	breakers, err := c.Breakers(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, breakers)
+
+	health, err := c.Health(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", health.Status)
+}
+
+func TestClient_DisableRule(t *testing.T) {
+	c := New(monitoredServer(t).URL, Options{})
+	ctx := context.Background()
+
+	detail, err := c.DisableRule(ctx, "", "fan")
+	require.NoError(t, err)
+	assert.Equal(t, "fan", detail.Name)
+	assert.False(t, detail.Enabled)
+
+	detail, err = c.EnableRule(ctx, "", "fan")
+	require.NoError(t, err)
+	assert.True(t, detail.Enabled)
+
+	_, err = c.DisableRule(ctx, "", "heater")
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+}
+
+func TestClient_Retries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		if requests.Add(1) < 3 {
+			http.Error(w, "starting up", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status": "ok", "openBreakers": []}`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL, Options{Token: "secret", Retries: 2, RetryDelay: time.Millisecond})
+	health, err := c.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ok", health.Status)
+	assert.Equal(t, int32(3), requests.Load())
+
+	requests.Store(0)
+	_, err = New(server.URL, Options{Token: "secret", Retries: 1, RetryDelay: time.Millisecond}).Health(context.Background())
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestClient_NoRetryOnClientErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, Options{Retries: 3, RetryDelay: time.Millisecond}).RuleDetails(context.Background())
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	assert.Equal(t, int32(1), requests.Load())
+}
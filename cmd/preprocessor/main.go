@@ -1,11 +1,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"math"
 	"os"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/extension"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/config"
 	"rgehrsitz/rex/internal/preprocessor"
 	"rgehrsitz/rex/internal/preprocessor/bytecode"
-	"rgehrsitz/rex/internal/rules" // Make sure to import the package where RuleEngineContext is defined
+	"strings"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -17,6 +25,30 @@ func main() {
 	logLevel := flag.String("loglevel", "info", "Set log level: panic, fatal, error, warn, info, debug, trace")
 	logOutput := flag.String("logoutput", "console", "Set log output: console or file")
 	inputFile := flag.String("input", "", "Path to the input JSON file")
+	env := flag.String("env", "", "Apply the overlay for this environment, e.g. prod reads rules.prod.json next to the input file")
+	inventoryFile := flag.String("inventory", "", "Path to an inventory of devices to expand the rules templated with forEachDevice for")
+	strictFields := flag.Bool("strictfields", false, "Reject rules containing unknown fields instead of keeping them as metadata")
+	schemaCheck := flag.Bool("schemacheck", false, "Check the ruleset against the ruleset JSON Schema before parsing it, reporting the path of every violation")
+	strictNumeric := flag.Bool("strictnumeric", false, "Reject rules that mix int and float comparisons instead of promoting to float")
+	jsonOutput := flag.Bool("json", false, "Write a machine-readable compile summary to stdout")
+	embedSource := flag.Bool("embedsource", false, "Embed the source ruleset JSON in the bytecode")
+	compressSource := flag.Bool("compresssource", false, "Gzip the source embedded with -embedsource")
+	plugins := flag.String("plugins", "", "Comma-separated Go plugins to load, contributing optimizer passes and operators")
+	conditionMode := flag.String("conditionmode", "jump", "Set condition compilation: jump (short-circuit jumps) or boolean (AND/OR/NOT expressions)")
+	configFile := flag.String("config", "", "Path to the project configuration declaring budgets; defaults to rex.yaml next to the input file, if any")
+	floatEpsilon := flag.Float64("floatepsilon", 0, "Treat floats compared by equal and notEqual as equal when at most this far apart, unless a condition sets its own epsilon")
+	maxStackDepth := flag.Int("maxstackdepth", bytecode.DefaultMaxStackDepth, "Reject rules whose code could grow the stack deeper than this")
+	strictness := flag.String("strictness", "standard", "Set validation checks: basic, standard or paranoid (adds nested condition checks, -strictfields, -strictnumeric and required budgets)")
+	scripts := flag.Bool("scripts", false, "Allow script conditions and actions, which run Lua code in the runtime")
+	plan := flag.Bool("plan", false, "Compile without writing the bytecode, printing the rules merged, the conditions dropped, the bytecode size and the diagnostics")
+	intWidth := flag.Int("intwidth", 64, "Widest integer of the target in bits: 16 or 32 emit narrower integer constants and reject those the target can't hold")
+	float32Consts := flag.Bool("float32", false, "Emit float constants as float32 for targets without float64, rejecting those outside the float32 range")
+	align := flag.Int("align", 0, "Pad the code between rules with NOPs so every rule starts at a multiple of this many bytes, a power of two up to 256")
+	markers := flag.String("markers", "rules", "Set structural markers: rules (RULE_START/RULE_END), none (strip all, smallest bytecode) or all (also COND_START/COND_END)")
+	dependencyOrder := flag.Bool("dependencyorder", false, "Run rules writing facts before the rules of equal priority reading them, instead of in declared order")
+	eliminateDead := flag.Bool("eliminatedead", false, "Remove the rules that can never fire, such as those comparing facts no rule writes and -inputs doesn't list, and the conditions that always or never hold, reporting each")
+	inputs := flag.String("inputs", "", "Comma-separated list of facts provided by the host application, which -eliminatedead keeps the rules reading")
+	rejectCycles := flag.Bool("rejectcycles", false, "Reject rules depending on each other through the facts they write, instead of warning about them")
 	flag.Parse()
 
 	// Configure zerolog based on the flags
@@ -42,55 +74,333 @@ func main() {
 		log.Fatal().Msg("Invalid log output option")
 	}
 
+	if err := extension.LoadPlugins(extension.SplitPaths(*plugins)...); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load plugins")
+	}
+
 	// Check for input file argument
 	if *inputFile == "" {
 		log.Fatal().Msg("No input file specified")
 	}
 
-	// Process the input file
-	ruleJSON, err := os.ReadFile(*inputFile)
+	mode, err := bytecode.ParseConditionMode(*conditionMode)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid condition mode")
+	}
+
+	markerMode, err := bytecode.ParseMarkerMode(*markers)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to read input file")
+		log.Fatal().Err(err).Msg("Invalid marker mode")
+	}
+
+	if *floatEpsilon < 0 || math.IsNaN(*floatEpsilon) || math.IsInf(*floatEpsilon, 0) {
+		log.Fatal().Float64("FloatEpsilon", *floatEpsilon).Msg("Invalid float epsilon")
+	}
+
+	if err := (bytecode.Options{IntWidth: *intWidth, Align: *align}).Validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid target options")
 	}
 
-	context := rules.NewRuleEngineContext()
-	validatedRules, err := preprocessor.ParseAndValidateRules(ruleJSON, context)
+	strictnessLevel, err := preprocessor.ParseStrictness(*strictness)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to parse and validate rules")
-		return
+		log.Fatal().Err(err).Msg("Invalid strictness")
 	}
 
-	for _, rule := range validatedRules {
-		for _, fact := range rule.ConsumedFacts {
-			if _, exists := context.FactIndex[fact]; !exists {
-				context.FactIndex[fact] = len(context.FactIndex)
-				log.Debug().Msg("Context updated with facts from validated rules")
+	options := compileOptions{
+		inputFile:       *inputFile,
+		env:             *env,
+		inventoryFile:   *inventoryFile,
+		strictFields:    *strictFields,
+		schemaCheck:     *schemaCheck,
+		strictNumeric:   *strictNumeric || strictnessLevel == preprocessor.StrictnessParanoid,
+		strictness:      strictnessLevel,
+		scripts:         *scripts,
+		embedSource:     *embedSource || *compressSource,
+		compress:        *compressSource,
+		conditionMode:   mode,
+		markers:         markerMode,
+		maxStackDepth:   *maxStackDepth,
+		floatEpsilon:    *floatEpsilon,
+		intWidth:        *intWidth,
+		float32:         *float32Consts,
+		align:           *align,
+		configFile:      *configFile,
+		plan:            *plan,
+		dependencyOrder: *dependencyOrder,
+		rejectCycles:    *rejectCycles,
+		eliminateDead:   *eliminateDead,
+		inputs:          splitList(*inputs),
+		output:          "bytecode.bin",
+	}
+	summary := cli.CompileSummary{SchemaVersion: cli.SchemaVersion, Diagnostics: []cli.Diagnostic{}}
+	code, err := compile(options, &summary)
+	if err != nil {
+		var budgetErr *config.BudgetError
+		if errors.As(err, &budgetErr) {
+			for _, violation := range budgetErr.Violations {
+				summary.Diagnostics = append(summary.Diagnostics, cli.Diagnostic{
+					Severity: cli.SeverityError, Code: code, Message: violation.Message, Rule: violation.Rule,
+				})
 			}
+		} else {
+			summary.Diagnostics = append(summary.Diagnostics, cli.ErrorDiagnostics(code, err)...)
 		}
-		for _, fact := range rule.ProducedFacts {
-			if _, exists := context.FactIndex[fact]; !exists {
-				context.FactIndex[fact] = len(context.FactIndex)
-				log.Debug().Msg("Context updated with facts from validated rules")
-			}
+		if !*jsonOutput {
+			log.Error().Err(err).Msg("Preprocessing failed")
 		}
 	}
+	summary.Success = err == nil
 
-	optimizedRules, err := preprocessor.OptimizeRules(validatedRules, context)
+	if *jsonOutput {
+		if err := cli.WriteJSON(os.Stdout, summary); err != nil {
+			log.Error().Err(err).Msg("Failed to write compile summary")
+		}
+	} else if *plan {
+		printPlan(os.Stdout, summary)
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to optimize rules")
-		return
+		os.Exit(1)
 	}
+}
+
+// compileOptions holds the settings of a preprocessor run.
+type compileOptions struct {
+	inputFile       string
+	env             string
+	inventoryFile   string
+	strictFields    bool
+	schemaCheck     bool
+	strictNumeric   bool
+	strictness      preprocessor.Strictness
+	scripts         bool
+	embedSource     bool
+	compress        bool
+	conditionMode   bytecode.ConditionMode
+	markers         bytecode.MarkerMode
+	maxStackDepth   int
+	floatEpsilon    float64
+	intWidth        int  // Widest integer of the target, in bits
+	float32         bool // Emit float constants as float32
+	align           int  // Alignment of rules, in bytes
+	configFile      string
+	plan            bool // Stop short of writing the bytecode
+	dependencyOrder bool
+	rejectCycles    bool
+	eliminateDead   bool
+	inputs          []string // Facts the host provides
+	output          string
+}
 
-	compiler := bytecode.NewCompiler(context)
-	bytecodeBytes, err := compiler.Compile(optimizedRules)
+// compile parses, optimizes and compiles the input ruleset and writes the
+// bytecode, filling in summary as it goes. On failure it returns the
+// diagnostic code of the stage that failed along with the error.
+func compile(options compileOptions, summary *cli.CompileSummary) (string, error) {
+	// Process the input file
+	ruleJSON, err := os.ReadFile(options.inputFile)
 	if err != nil {
-		log.Error().Err(err).Msg("Error compiling rules to bytecode")
-		return
+		return "read-failed", fmt.Errorf("failed to read input file: %w", err)
 	}
 
-	err = os.WriteFile("bytecode.bin", bytecodeBytes, 0644)
+	var projectConfig config.Config
+	if options.configFile != "" {
+		projectConfig, err = config.Load(options.configFile)
+	} else {
+		projectConfig, err = config.LoadForRuleset(options.inputFile)
+	}
 	if err != nil {
-		log.Error().Err(err).Msg("Error writing bytecode to file")
-		return
+		return "invalid-config", fmt.Errorf("failed to read configuration: %w", err)
+	}
+	if options.strictness == preprocessor.StrictnessParanoid && projectConfig.Budget == (config.Budget{}) {
+		return "invalid-config", fmt.Errorf("strictness paranoid requires budgets to be declared in %s", config.FileName)
+	}
+
+	if options.env != "" {
+		overlayPath := preprocessor.OverlayPath(options.inputFile, options.env)
+		overlayJSON, err := os.ReadFile(overlayPath)
+		if err != nil {
+			return "read-failed", fmt.Errorf("failed to read overlay file: %w", err)
+		}
+		ruleJSON, err = preprocessor.ApplyOverlays(ruleJSON, preprocessor.Overlay{Name: overlayPath, JSON: overlayJSON})
+		if err != nil {
+			return "overlay-failed", fmt.Errorf("failed to apply overlay: %w", err)
+		}
+	}
+
+	// Templates are expanded after the overlays, which may patch them
+	if options.inventoryFile != "" {
+		inventoryJSON, err := os.ReadFile(options.inventoryFile)
+		if err != nil {
+			return "read-failed", fmt.Errorf("failed to read inventory file: %w", err)
+		}
+		inventory, err := preprocessor.ParseInventory(inventoryJSON)
+		if err != nil {
+			return "invalid-inventory", err
+		}
+		if ruleJSON, err = preprocessor.ExpandInventory(ruleJSON, inventory); err != nil {
+			return "expand-failed", fmt.Errorf("failed to expand templates: %w", err)
+		}
+	}
+
+	if options.schemaCheck {
+		if err := preprocessor.ValidateAgainstSchema(ruleJSON); err != nil {
+			return "schema-violation", err
+		}
+	}
+
+	compileOptions := compiler.Options{
+		Strictness:   options.strictness,
+		StrictFields: options.strictFields,
+		Scripts:      options.scripts,
+		Codegen: compiler.CodegenOptions{
+			StrictNumeric: options.strictNumeric,
+			ConditionMode: options.conditionMode,
+			Markers:       options.markers,
+			MaxStackDepth: options.maxStackDepth,
+			FloatEpsilon:  options.floatEpsilon,
+			IntWidth:      options.intWidth,
+			Float32:       options.float32,
+			Align:         options.align,
+		},
+		EmbedSource:     options.embedSource,
+		CompressSource:  options.compress,
+		DependencyOrder: options.dependencyOrder,
+		RejectCycles:    options.rejectCycles,
+
+		EliminateDeadCode: options.eliminateDead,
+		Inputs:            options.inputs,
+	}
+	ruleset, err := compiler.ParseRules(ruleJSON, compileOptions)
+	if err != nil {
+		return "invalid-ruleset", fmt.Errorf("failed to parse and validate rules: %w", err)
+	}
+	summary.Rules = len(ruleset.Rules)
+
+	// Vacuous conditions are compiled as written, but are almost always a
+	// mistake
+	for _, vacuous := range preprocessor.FindVacuousConditions(ruleset.Rules) {
+		log.Warn().Str("Rule", vacuous.Rule).Str("Path", vacuous.Path).Msg(vacuous.String())
+		summary.Diagnostics = append(summary.Diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning,
+			Code:     "vacuous-condition",
+			Message:  vacuous.String(),
+			Rule:     vacuous.Rule,
+			Fact:     vacuous.Fact,
+		})
+	}
+
+	// Cycles are fine as long as forward chaining settles them, which the
+	// compiler can't tell
+	if !options.rejectCycles {
+		for _, cycle := range preprocessor.FindDependencyCycles(ruleset.Rules) {
+			log.Warn().Strs("Rules", cycle.Rules).Msg(cycle.String())
+			summary.Diagnostics = append(summary.Diagnostics, cli.Diagnostic{
+				Severity: cli.SeverityWarning,
+				Code:     "dependency-cycle",
+				Message:  cycle.String(),
+				Rule:     cycle.Rules[0],
+			})
+		}
+	}
+
+	optimized, err := compiler.Optimize(ruleset)
+	if err != nil {
+		return "optimize-failed", err
+	}
+	optimizedRules := optimized.Rules
+	summary.OptimizedRules = len(optimizedRules)
+	removed := make(map[string]bool)
+	for _, elimination := range optimized.Eliminated {
+		log.Warn().Str("Rule", elimination.Rule).Str("Path", elimination.Path).Msg(elimination.String())
+		summary.Diagnostics = append(summary.Diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning,
+			Code:     "dead-code",
+			Message:  elimination.String(),
+			Rule:     elimination.Rule,
+			Path:     elimination.Path,
+			Fact:     elimination.Fact,
+		})
+		if elimination.Path == "" {
+			removed[elimination.Rule] = true
+		}
+	}
+	if options.plan {
+		// Rules removed as dead weren't merged into others
+		var kept []*compiler.Rule
+		for _, rule := range ruleset.Rules {
+			if !removed[rule.Name] {
+				kept = append(kept, rule)
+			}
+		}
+		merged, dropped := preprocessor.CompareOptimized(kept, optimizedRules)
+		summary.Plan = &cli.CompilePlan{MergedRules: cli.NonNil(merged), DroppedConditions: cli.NonNil(dropped)}
+	}
+
+	compiled, err := compiler.Compile(optimized, compileOptions)
+	var stackErr *bytecode.StackError
+	var cycleErr *compiler.DependencyCycleError
+	if errors.As(err, &stackErr) {
+		return "invalid-stack", err
+	}
+	if errors.As(err, &cycleErr) {
+		return "dependency-cycle", err
+	}
+	if err != nil {
+		return "compile-failed", err
+	}
+	bytecodeBytes, cost := compiled.Image, compiled.Cost
+	summary.Cost = &cost
+	summary.Provenance = &compiled.Provenance
+	summary.BytecodeSize = len(bytecodeBytes)
+
+	ruleNames := make([]string, len(optimizedRules))
+	for i, rule := range optimizedRules {
+		ruleNames[i] = rule.Name
+	}
+	if err := projectConfig.Budget.Check(len(bytecodeBytes), ruleNames, cost); err != nil {
+		return "budget-exceeded", err
+	}
+	if options.plan {
+		return "", nil
+	}
+
+	err = os.WriteFile(options.output, bytecodeBytes, 0644)
+	if err != nil {
+		return "write-failed", fmt.Errorf("error writing bytecode to file: %w", err)
+	}
+	summary.Output = options.output
+
+	return "", nil
+}
+
+// printPlan writes the outcome of a plan mode run as text.
+func printPlan(w io.Writer, summary cli.CompileSummary) {
+	fmt.Fprintf(w, "Rules:          %d (%d after optimization)\n", summary.Rules, summary.OptimizedRules)
+	if summary.Plan != nil {
+		for _, merged := range summary.Plan.MergedRules {
+			fmt.Fprintf(w, "  merged %s into %s\n", merged.Rule, merged.Into)
+		}
+		fmt.Fprintf(w, "Dropped conditions: %d\n", len(summary.Plan.DroppedConditions))
+		for _, dropped := range summary.Plan.DroppedConditions {
+			fmt.Fprintf(w, "  %s %s: %s\n", dropped.Rule, dropped.Path, dropped.Condition)
+		}
+	}
+	if summary.BytecodeSize > 0 {
+		fmt.Fprintf(w, "Bytecode size:  %d bytes\n", summary.BytecodeSize)
+	}
+	fmt.Fprintf(w, "Diagnostics:    %d\n", len(summary.Diagnostics))
+	for _, diagnostic := range summary.Diagnostics {
+		fmt.Fprintf(w, "  %s %s: %s\n", diagnostic.Severity, diagnostic.Code, diagnostic.Message)
+	}
+	fmt.Fprintln(w, "No bytecode written")
+}
+
+// splitList splits a comma-separated flag value, ignoring empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
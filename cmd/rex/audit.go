@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rgehrsitz/rex/internal/audit"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runAudit implements `rex audit query`, which lists the rule firings and
+// action outcomes recorded in a runtime's audit database.
+func runAudit(args []string) int {
+	if len(args) == 0 || args[0] != "query" {
+		fmt.Fprintln(os.Stderr, "Usage: rex audit query [-db file] [-rule n] [-correlation id] [-ruleset hash] [-since duration] [-limit n] [-json]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("audit query", flag.ExitOnError)
+	dbPath := fs.String("db", "audit.db", "Path to the audit database written by the runtime's -audit flag")
+	rule := fs.Int("rule", -1, "Only show records of the rule at this position in the bytecode")
+	correlationID := fs.String("correlation", "", "Only show records of the evaluation cycle with this correlation ID")
+	rulesetHash := fs.String("ruleset", "", "Only show records of the ruleset revision with this hash, or hash prefix")
+	since := fs.Duration("since", 0, "Only show records from this long ago onwards, e.g. 1h")
+	limit := fs.Int("limit", 100, "Maximum number of firings and of action outcomes to show; 0 means no limit")
+	jsonOutput := fs.Bool("json", false, "Write machine-readable JSON output to stdout")
+	fs.Parse(args[1:])
+
+	query := audit.Query{Limit: *limit, CorrelationID: *correlationID, RulesetHash: *rulesetHash}
+	if *rule >= 0 {
+		query.Rule = rule
+	}
+	if *since > 0 {
+		query.Since = time.Now().Add(-*since)
+	}
+
+	result := cli.AuditQueryResult{
+		SchemaVersion: cli.SchemaVersion,
+		Firings:       []audit.Firing{},
+		Actions:       []audit.ActionOutcome{},
+		Diagnostics:   []cli.Diagnostic{},
+	}
+	err := queryAudit(*dbPath, query, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostic("audit-query-failed", err))
+	}
+
+	if *jsonOutput {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to query the audit database")
+	} else {
+		printAudit(os.Stdout, result)
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// queryAudit fills in result from the audit database.
+func queryAudit(dbPath string, query audit.Query, result *cli.AuditQueryResult) error {
+	if _, err := os.Stat(dbPath); err != nil {
+		return fmt.Errorf("failed to open audit database: %w", err)
+	}
+	store, err := audit.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if result.Firings, err = store.Firings(query); err != nil {
+		return err
+	}
+	result.Actions, err = store.Actions(query)
+	return err
+}
+
+// printAudit writes the result of a query as text.
+func printAudit(w io.Writer, result cli.AuditQueryResult) {
+	const timeFormat = "2006-01-02 15:04:05.000"
+
+	fmt.Fprintf(w, "Firings (%d):\n", len(result.Firings))
+	for _, firing := range result.Firings {
+		fmt.Fprintf(w, "  %s  rule %d", firing.Time.Format(timeFormat), firing.Rule)
+		if firing.Variant != "" {
+			fmt.Fprintf(w, "  variant %s", firing.Variant)
+		}
+		if firing.RulesetHash != "" {
+			fmt.Fprintf(w, "  ruleset %s", bytecode.Provenance{RulesetHash: firing.RulesetHash}.ShortHash())
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Actions (%d):\n", len(result.Actions))
+	for _, action := range result.Actions {
+		fmt.Fprintf(w, "  %s  rule %d", action.Time.Format(timeFormat), action.Rule)
+		if action.Type != "" {
+			fmt.Fprintf(w, "  %s %s", action.Type, action.Target)
+		}
+		if action.CorrelationID != "" {
+			fmt.Fprintf(w, "  correlation %s", action.CorrelationID)
+		}
+		if action.Provenance != nil {
+			fmt.Fprintf(w, "  ruleset %s", action.Provenance.ShortHash())
+		}
+		if action.Error != "" {
+			fmt.Fprintf(w, "  failed: %s", action.Error)
+		} else if action.Suppressed != "" {
+			fmt.Fprintf(w, "  withheld by %s", action.Suppressed)
+		} else {
+			fmt.Fprint(w, "  ok")
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/factgen"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+	"rgehrsitz/rex/internal/runtime"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// runBench implements `rex bench`, which measures how fast a bytecode file
+// evaluates random fact sets generated from its fact schema.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	inputFile := fs.String("input", "bytecode.bin", "Path to the bytecode file")
+	cycles := fs.Int("cycles", 1000, "Number of evaluation cycles to run, each with a new fact set")
+	seed := fs.Int64("seed", 1, "Seed of the generated facts; the same seed generates the same fact sets")
+	entities := fs.Int("entities", 3, "Number of facts generated for each fact pattern, such as sensor.*.temperature")
+	samplesFile := fs.String("samples", "", "Path to sample facts, as a JSON array of objects or one object per line, whose values widen the generated ranges")
+	logLevel := fs.String("loglevel", "warn", "Set log level: panic, fatal, error, warn, info, debug, trace")
+	jsonOutput := fs.Bool("json", false, "Write machine-readable JSON output to stdout")
+	fs.Parse(args)
+
+	result := cli.BenchResult{SchemaVersion: cli.SchemaVersion, Diagnostics: []cli.Diagnostic{}}
+	err := bench(benchOptions{
+		inputFile:   *inputFile,
+		cycles:      *cycles,
+		samplesFile: *samplesFile,
+		logLevel:    *logLevel,
+		config:      factgen.Config{Seed: *seed, Entities: *entities},
+	}, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostic("bench-failed", err))
+	}
+
+	if *jsonOutput {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to run benchmark")
+	} else {
+		printBench(os.Stdout, result)
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// benchOptions holds the settings of a benchmark.
+type benchOptions struct {
+	inputFile   string
+	cycles      int
+	samplesFile string
+	logLevel    string
+	config      factgen.Config
+}
+
+// bench runs the benchmark and fills in result.
+func bench(options benchOptions, result *cli.BenchResult) error {
+	level, err := zerolog.ParseLevel(options.logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+	zerolog.SetGlobalLevel(level)
+	if options.cycles <= 0 {
+		return errors.New("cycles must be positive")
+	}
+
+	image, err := os.ReadFile(options.inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to read bytecode file: %w", err)
+	}
+	vm := runtime.NewVM(image)
+	schema, ok := vm.Schema()
+	if !ok {
+		return fmt.Errorf("%s has no fact schema; compile it with a current preprocessor", options.inputFile)
+	}
+	generator, err := factgen.New(schema, options.config)
+	if err != nil {
+		return err
+	}
+
+	// The thresholds of the rules, when their source is embedded, and the
+	// samples give the ranges of the generated values
+	if source, ok, err := vm.Source(); err != nil {
+		return fmt.Errorf("failed to read embedded rule source: %w", err)
+	} else if ok {
+		parseOptions := preprocessor.ParseOptions{Mode: preprocessor.ParseModePermissive, Scripts: true}
+		ruleSet, err := preprocessor.ParseAndValidateRulesWithOptions(source, rules.NewRuleEngineContext(), parseOptions)
+		if err != nil {
+			return fmt.Errorf("failed to parse embedded rule source: %w", err)
+		}
+		generator.ObserveRules(ruleSet)
+	}
+	if options.samplesFile != "" {
+		samples, err := readSamples(options.samplesFile)
+		if err != nil {
+			return err
+		}
+		for _, sample := range samples {
+			generator.Observe(sample)
+		}
+	}
+
+	vm.OnAfterRule(func(rule int, fired bool) {
+		if fired {
+			result.Firings++
+		}
+	})
+	durations := make([]time.Duration, 0, options.cycles)
+	for i := 0; i < options.cycles; i++ {
+		vm.SetFacts(generator.Generate())
+		start := time.Now()
+		if err := vm.Run(); err != nil {
+			result.Errors++
+			log.Debug().Err(err).Int("Cycle", i).Msg("Cycle failed")
+		}
+		durations = append(durations, time.Since(start))
+	}
+
+	var total time.Duration
+	for _, duration := range durations {
+		total += duration
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	percentile := func(p int) float64 {
+		return durations[(len(durations)-1)*p/100].Seconds()
+	}
+
+	result.Cycles = options.cycles
+	result.Facts = len(generator.Facts())
+	result.TotalSeconds = total.Seconds()
+	if total > 0 {
+		result.CyclesPerSecond = float64(options.cycles) / total.Seconds()
+	}
+	result.Latency = cli.BenchLatency{P50: percentile(50), P90: percentile(90), P99: percentile(99), Max: percentile(100)}
+	return nil
+}
+
+// readSamples reads sample facts, either a JSON array of objects or one
+// object per line.
+func readSamples(path string) ([]map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read samples file: %w", err)
+	}
+	var samples []map[string]interface{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &samples); err != nil {
+			return nil, fmt.Errorf("failed to parse samples file: %w", err)
+		}
+		return samples, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var sample map[string]interface{}
+		err := decoder.Decode(&sample)
+		if errors.Is(err, io.EOF) {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse samples file: %w", err)
+		}
+		samples = append(samples, sample)
+	}
+}
+
+// printBench writes the result of a benchmark as text.
+func printBench(w io.Writer, result cli.BenchResult) {
+	fmt.Fprintf(w, "Cycles:          %d (%d failed)\n", result.Cycles, result.Errors)
+	fmt.Fprintf(w, "Facts per cycle: %d\n", result.Facts)
+	fmt.Fprintf(w, "Rule firings:    %d\n", result.Firings)
+	fmt.Fprintf(w, "Throughput:      %.0f cycles/s\n", result.CyclesPerSecond)
+	fmt.Fprintf(w, "Latency:         p50 %s  p90 %s  p99 %s  max %s\n",
+		seconds(result.Latency.P50), seconds(result.Latency.P90), seconds(result.Latency.P99), seconds(result.Latency.Max))
+}
+
+// seconds converts a number of seconds to a Duration, for printing.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rgehrsitz/rex/internal/bundle"
+	"rgehrsitz/rex/internal/cli"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runBundle implements `rex bundle keygen`, `rex bundle create` and
+// `rex bundle verify`, which package bytecode and its runtime configuration
+// into a signed bundle and check one.
+func runBundle(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "keygen":
+			return runBundleKeygen(args[1:])
+		case "create":
+			return runBundleCreate(args[1:])
+		case "verify":
+			return runBundleVerify(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: rex bundle keygen [-output name]")
+	fmt.Fprintln(os.Stderr, "       rex bundle create -key file [-bytecode file] [-config file] [-output file] [-json]")
+	fmt.Fprintln(os.Stderr, "       rex bundle verify -key file -input file [-json]")
+	return 2
+}
+
+// runBundleKeygen writes a new signing key pair, refusing to overwrite an
+// existing key.
+func runBundleKeygen(args []string) int {
+	fs := flag.NewFlagSet("bundle keygen", flag.ExitOnError)
+	output := fs.String("output", "bundle", "Write the private key to <output>.key and the public key to <output>.pub")
+	fs.Parse(args)
+
+	publicPEM, privatePEM, err := bundle.GenerateKey()
+	if err == nil {
+		err = writeNewFile(*output+".key", privatePEM, 0600)
+	}
+	if err == nil {
+		err = writeNewFile(*output+".pub", publicPEM, 0644)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate signing key")
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s.key, keep it secret, and %s.pub, to pass to the runtime with -bundlekey\n", *output, *output)
+	return 0
+}
+
+// writeNewFile writes a file that must not exist yet.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func runBundleCreate(args []string) int {
+	fs := flag.NewFlagSet("bundle create", flag.ExitOnError)
+	bytecodeFile := fs.String("bytecode", "bytecode.bin", "Path to the bytecode to bundle")
+	configFile := fs.String("config", "", "Path to the runtime configuration to bundle, a JSON object of runtime flags and suppression windows")
+	keyFile := fs.String("key", "", "Path to the private key signing the bundle, as written by rex bundle keygen")
+	output := fs.String("output", "bundle.tgz", "Path to write the bundle to")
+	jsonOutput := fs.Bool("json", false, "Write machine-readable JSON output to stdout")
+	fs.Parse(args)
+
+	result := cli.BundleResult{SchemaVersion: cli.SchemaVersion, Diagnostics: []cli.Diagnostic{}}
+	code, err := createBundle(*bytecodeFile, *configFile, *keyFile, *output, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostic(code, err))
+	}
+	result.Success = err == nil
+
+	if *jsonOutput {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to create bundle")
+	} else {
+		fmt.Fprintf(os.Stderr, "wrote %s\n", *output)
+		printManifest(os.Stderr, result.Manifest)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// createBundle bundles the bytecode with the runtime configuration and
+// writes the bundle signed with the private key. On failure it returns the
+// diagnostic code of the problem.
+func createBundle(bytecodeFile, configFile, keyFile, output string, result *cli.BundleResult) (string, error) {
+	if keyFile == "" {
+		return "invalid-arguments", fmt.Errorf("no signing key specified with -key")
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "read-failed", err
+	}
+	key, err := bundle.ParsePrivateKey(keyPEM)
+	if err != nil {
+		return "invalid-key", fmt.Errorf("invalid signing key: %w", err)
+	}
+	image, err := os.ReadFile(bytecodeFile)
+	if err != nil {
+		return "read-failed", err
+	}
+	var config *bundle.Config
+	if configFile != "" {
+		configJSON, err := os.ReadFile(configFile)
+		if err != nil {
+			return "read-failed", err
+		}
+		config = &bundle.Config{}
+		decoder := json.NewDecoder(bytes.NewReader(configJSON))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(config); err != nil {
+			return "invalid-config", fmt.Errorf("failed to parse runtime configuration: %w", err)
+		}
+	}
+
+	b, err := bundle.New(image, config)
+	if err != nil {
+		return "invalid-config", err
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf, key); err != nil {
+		return "bundle-failed", err
+	}
+	if err := os.WriteFile(output, buf.Bytes(), 0644); err != nil {
+		return "write-failed", err
+	}
+	result.Manifest = &b.Manifest
+	return "", nil
+}
+
+func runBundleVerify(args []string) int {
+	fs := flag.NewFlagSet("bundle verify", flag.ExitOnError)
+	inputFile := fs.String("input", "", "Path to the bundle to verify")
+	keyFile := fs.String("key", "", "Path to the public key the bundle must be signed with")
+	jsonOutput := fs.Bool("json", false, "Write machine-readable JSON output to stdout")
+	fs.Parse(args)
+
+	result := cli.BundleResult{SchemaVersion: cli.SchemaVersion, Diagnostics: []cli.Diagnostic{}}
+	code, err := verifyBundle(*inputFile, *keyFile, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostic(code, err))
+	}
+	result.Success = err == nil
+
+	if *jsonOutput {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Bundle verification failed")
+	} else {
+		fmt.Printf("%s is signed by %s and intact\n", *inputFile, *keyFile)
+		printManifest(os.Stdout, result.Manifest)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// verifyBundle checks the bundle's signature and contents. On failure it
+// returns the diagnostic code of the problem.
+func verifyBundle(inputFile, keyFile string, result *cli.BundleResult) (string, error) {
+	if inputFile == "" || keyFile == "" {
+		return "invalid-arguments", fmt.Errorf("-input and -key are required")
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "read-failed", err
+	}
+	key, err := bundle.ParsePublicKey(keyPEM)
+	if err != nil {
+		return "invalid-key", fmt.Errorf("invalid public key: %w", err)
+	}
+	data, err := os.ReadFile(inputFile)
+	if err != nil {
+		return "read-failed", err
+	}
+	b, err := bundle.Read(data, key)
+	if err != nil {
+		return "invalid-bundle", err
+	}
+	result.Manifest = &b.Manifest
+	return "", nil
+}
+
+// printManifest writes the contents of a bundle as text.
+func printManifest(w io.Writer, manifest *bundle.Manifest) {
+	fmt.Fprintf(w, "Created:  %s\n", manifest.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	if manifest.Provenance != nil {
+		fmt.Fprintf(w, "Ruleset:  %s, compiled by %s\n", manifest.Provenance.ShortHash(), manifest.Provenance.CompilerVersion)
+	}
+	for _, file := range manifest.Files {
+		fmt.Fprintf(w, "  %-16s %8d bytes  sha256 %s\n", file.Name, file.Size, file.SHA256)
+	}
+}
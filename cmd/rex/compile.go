@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/config"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runCompile implements `rex compile`, which compiles a ruleset to a bytecode
+// file as the preprocessor does. With -plan it stops short of writing the
+// file and prints what the optimizer changed and the size the bytecode would
+// have, for a quick check before committing. It exits with status 1 if the
+// ruleset doesn't compile.
+func runCompile(args []string) int {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	codegenFlags := addCodegenFlags(fs)
+	output := fs.String("output", "bytecode.bin", "Path to write the bytecode to")
+	eliminateDead := fs.Bool("eliminatedead", false, "Remove the rules that can never fire, such as those comparing facts no rule writes and -inputs doesn't list, and the conditions that always or never hold, reporting each")
+	plan := fs.Bool("plan", false, "Compile without writing the bytecode, printing the rules merged, the conditions dropped, the bytecode size and the diagnostics")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: rex compile [flags] [rules.json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *ruleFlags.inputFile == "" {
+		*ruleFlags.inputFile = fs.Arg(0)
+	}
+	if *plan {
+		*output = ""
+	}
+
+	summary := cli.CompileSummary{SchemaVersion: cli.SchemaVersion, Diagnostics: []cli.Diagnostic{}}
+	code, err := compileRuleset(ruleFlags, codegenFlags, *eliminateDead, *output, &summary)
+	if err != nil {
+		summary.Diagnostics = append(summary.Diagnostics, cli.ErrorDiagnostics(code, err)...)
+	}
+	summary.Success = err == nil
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, summary)
+	} else {
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to compile ruleset")
+		}
+		if *plan {
+			printPlan(os.Stdout, summary)
+		}
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// compileRuleset compiles the input ruleset and writes the bytecode to
+// output, filling in summary as it goes. With no output, it reports the plan
+// instead. On failure it returns the diagnostic code of the stage that
+// failed along with the error.
+func compileRuleset(ruleFlags *ruleFlags, codegenFlags *codegenFlags, eliminateDead bool, output string, summary *cli.CompileSummary) (string, error) {
+	ruleJSON, err := ruleFlags.readRules()
+	if err != nil {
+		return "read-failed", err
+	}
+	projectConfig, err := config.LoadForRuleset(*ruleFlags.inputFile)
+	if err != nil {
+		return "invalid-config", fmt.Errorf("failed to read configuration: %w", err)
+	}
+	strictness, err := preprocessor.ParseStrictness(*ruleFlags.strictness)
+	if err != nil {
+		return "invalid-arguments", err
+	}
+	if strictness == preprocessor.StrictnessParanoid && projectConfig.Budget == (config.Budget{}) {
+		return "invalid-config", fmt.Errorf("strictness paranoid requires budgets to be declared in %s", config.FileName)
+	}
+	codegen, err := codegenFlags.options()
+	if err != nil {
+		return "invalid-arguments", err
+	}
+	options := compiler.Options{
+		Strictness:   strictness,
+		StrictFields: *ruleFlags.strictFields,
+		Scripts:      *ruleFlags.scripts,
+		Codegen:      codegen,
+
+		EliminateDeadCode: eliminateDead,
+		Inputs:            ruleFlags.externalInputs(),
+	}
+
+	ruleset, err := compiler.ParseRules(ruleJSON, options)
+	if err != nil {
+		return "invalid-ruleset", fmt.Errorf("failed to parse and validate rules: %w", err)
+	}
+	summary.Rules = len(ruleset.Rules)
+	for _, vacuous := range preprocessor.FindVacuousConditions(ruleset.Rules) {
+		summary.Diagnostics = append(summary.Diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning, Code: "vacuous-condition", Message: vacuous.String(), Rule: vacuous.Rule, Fact: vacuous.Fact,
+		})
+	}
+	for _, cycle := range preprocessor.FindDependencyCycles(ruleset.Rules) {
+		summary.Diagnostics = append(summary.Diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning, Code: "dependency-cycle", Message: cycle.String(), Rule: cycle.Rules[0],
+		})
+	}
+
+	optimized, err := compiler.Optimize(ruleset)
+	if err != nil {
+		return "optimize-failed", err
+	}
+	summary.OptimizedRules = len(optimized.Rules)
+	removed := make(map[string]bool)
+	for _, elimination := range optimized.Eliminated {
+		summary.Diagnostics = append(summary.Diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning, Code: "dead-code", Message: elimination.String(), Rule: elimination.Rule, Path: elimination.Path, Fact: elimination.Fact,
+		})
+		if elimination.Path == "" {
+			removed[elimination.Rule] = true
+		}
+	}
+	if output == "" {
+		// Rules removed as dead weren't merged into others
+		var kept []*compiler.Rule
+		for _, rule := range ruleset.Rules {
+			if !removed[rule.Name] {
+				kept = append(kept, rule)
+			}
+		}
+		merged, dropped := preprocessor.CompareOptimized(kept, optimized.Rules)
+		summary.Plan = &cli.CompilePlan{MergedRules: cli.NonNil(merged), DroppedConditions: cli.NonNil(dropped)}
+	}
+
+	compiled, err := compiler.Compile(optimized, options)
+	var stackErr *bytecode.StackError
+	var cycleErr *compiler.DependencyCycleError
+	if errors.As(err, &stackErr) {
+		return "invalid-stack", err
+	}
+	if errors.As(err, &cycleErr) {
+		return "dependency-cycle", err
+	}
+	if err != nil {
+		return "compile-failed", err
+	}
+	summary.Cost = &compiled.Cost
+	summary.Provenance = &compiled.Provenance
+	summary.BytecodeSize = len(compiled.Image)
+
+	ruleNames := make([]string, len(optimized.Rules))
+	for i, rule := range optimized.Rules {
+		ruleNames[i] = rule.Name
+	}
+	if err := projectConfig.Budget.Check(len(compiled.Image), ruleNames, compiled.Cost); err != nil {
+		return "budget-exceeded", err
+	}
+	if output == "" {
+		return "", nil
+	}
+
+	if err := os.WriteFile(output, compiled.Image, 0644); err != nil {
+		return "write-failed", fmt.Errorf("error writing bytecode to file: %w", err)
+	}
+	summary.Output = output
+	return "", nil
+}
+
+// printPlan writes the outcome of a plan mode compile as text.
+func printPlan(w io.Writer, summary cli.CompileSummary) {
+	fmt.Fprintf(w, "Rules:          %d (%d after optimization)\n", summary.Rules, summary.OptimizedRules)
+	if summary.Plan != nil {
+		for _, merged := range summary.Plan.MergedRules {
+			fmt.Fprintf(w, "  merged %s into %s\n", merged.Rule, merged.Into)
+		}
+		fmt.Fprintf(w, "Dropped conditions: %d\n", len(summary.Plan.DroppedConditions))
+		for _, dropped := range summary.Plan.DroppedConditions {
+			fmt.Fprintf(w, "  %s %s: %s\n", dropped.Rule, dropped.Path, dropped.Condition)
+		}
+	}
+	if summary.BytecodeSize > 0 {
+		fmt.Fprintf(w, "Bytecode size:  %d bytes\n", summary.BytecodeSize)
+	}
+	fmt.Fprintf(w, "Diagnostics:    %d\n", len(summary.Diagnostics))
+	for _, diagnostic := range summary.Diagnostics {
+		fmt.Fprintf(w, "  %s %s: %s\n", diagnostic.Severity, diagnostic.Code, diagnostic.Message)
+	}
+	fmt.Fprintln(w, "No bytecode written")
+}
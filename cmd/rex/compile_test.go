@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"rgehrsitz/rex/internal/cli"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fanRules = `[
+    {
+        "name": "fan",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    },
+    {
+        "name": "alarm",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["alarm"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "alarm", "value": true}]}
+    }
+]`
+
+// writeRules writes a ruleset to a temporary directory and returns its path.
+func writeRules(t *testing.T, ruleJSON string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(ruleJSON), 0644))
+	return path
+}
+
+// parseCompileFlags parses args with the flags of rex compile.
+func parseCompileFlags(t *testing.T, args ...string) (*ruleFlags, *codegenFlags) {
+	t.Helper()
+	fs := flag.NewFlagSet("compile", flag.ContinueOnError)
+	ruleFlags := addRuleFlags(fs)
+	codegenFlags := addCodegenFlags(fs)
+	require.NoError(t, fs.Parse(args))
+	return ruleFlags, codegenFlags
+}
+
+func TestCompileRuleset(t *testing.T) {
+	input := writeRules(t, fanRules)
+	output := filepath.Join(filepath.Dir(input), "rules.bin")
+	ruleFlags, codegenFlags := parseCompileFlags(t, "-input", input)
+
+	var summary cli.CompileSummary
+	code, err := compileRuleset(ruleFlags, codegenFlags, false, output, &summary)
+	require.NoError(t, err, code)
+	assert.Equal(t, 2, summary.Rules)
+	assert.Equal(t, 1, summary.OptimizedRules)
+	assert.Nil(t, summary.Plan)
+	assert.Equal(t, output, summary.Output)
+
+	image, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Len(t, image, summary.BytecodeSize)
+}
+
+func TestCompileRuleset_Plan(t *testing.T) {
+	input := writeRules(t, fanRules)
+	ruleFlags, codegenFlags := parseCompileFlags(t, "-input", input)
+
+	var summary cli.CompileSummary
+	code, err := compileRuleset(ruleFlags, codegenFlags, false, "", &summary)
+	require.NoError(t, err, code)
+	require.NotNil(t, summary.Plan)
+	require.Len(t, summary.Plan.MergedRules, 1)
+	assert.Equal(t, "alarm", summary.Plan.MergedRules[0].Rule)
+	assert.Equal(t, "fan", summary.Plan.MergedRules[0].Into)
+	assert.Positive(t, summary.BytecodeSize)
+	assert.Empty(t, summary.Output)
+
+	entries, err := os.ReadDir(filepath.Dir(input))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "plan mode writes no bytecode")
+
+	var buf bytes.Buffer
+	printPlan(&buf, summary)
+	assert.Contains(t, buf.String(), "Rules:          2 (1 after optimization)\n  merged alarm into fan\n")
+	assert.Contains(t, buf.String(), "No bytecode written\n")
+}
+
+func TestCompileRuleset_Errors(t *testing.T) {
+	input := writeRules(t, fanRules)
+
+	ruleFlags, codegenFlags := parseCompileFlags(t, "-input", input, "-conditionmode", "bogus")
+	code, err := compileRuleset(ruleFlags, codegenFlags, false, "", &cli.CompileSummary{})
+	assert.Equal(t, "invalid-arguments", code)
+	assert.ErrorContains(t, err, "unknown condition mode")
+
+	ruleFlags, codegenFlags = parseCompileFlags(t, "-input", filepath.Join(t.TempDir(), "missing.json"))
+	code, _ = compileRuleset(ruleFlags, codegenFlags, false, "", &cli.CompileSummary{})
+	assert.Equal(t, "read-failed", code)
+
+	ruleFlags, codegenFlags = parseCompileFlags(t, "-input", writeRules(t, `[{"name": "a", "conditions": {}}]`))
+	code, _ = compileRuleset(ruleFlags, codegenFlags, false, "", &cli.CompileSummary{})
+	assert.Equal(t, "invalid-ruleset", code)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runDisasm implements `rex disasm`, which lists the instructions of a
+// compiled bytecode file, where its rules start, and optionally the rule
+// source embedded in it.
+func runDisasm(args []string) int {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	inputFile := fs.String("input", "bytecode.bin", "Path to the bytecode file")
+	showSource := fs.Bool("source", false, "Also print the rule source embedded with the preprocessor's -embedsource flag")
+	jsonOutput := fs.Bool("json", false, "Write machine-readable JSON output to stdout")
+	fs.Parse(args)
+
+	result := cli.Disassembly{SchemaVersion: cli.SchemaVersion, Instructions: []string{}, Diagnostics: []cli.Diagnostic{}}
+	err := disassemble(*inputFile, *showSource, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostic("disasm-failed", err))
+	}
+
+	if *jsonOutput {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to disassemble bytecode")
+	} else {
+		for _, line := range result.Instructions {
+			fmt.Println(line)
+		}
+		if len(result.Rules) > 0 {
+			fmt.Println()
+			for _, rule := range result.Rules {
+				fmt.Printf("rule %s: offset %d, length %d, priority %d, reads %s\n", rule.Name, rule.Offset, rule.Length, rule.Priority, strings.Join(rule.Facts, ", "))
+			}
+		}
+		if *showSource {
+			fmt.Println()
+			fmt.Println(result.Source)
+		}
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// disassemble fills in result from the bytecode file.
+func disassemble(inputFile string, showSource bool, result *cli.Disassembly) error {
+	image, err := os.ReadFile(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to read bytecode file: %w", err)
+	}
+	code, sections, err := bytecode.SplitSections(image)
+	if err != nil {
+		return err
+	}
+
+	// Bytecode compiled before fact tables were embedded lists facts by
+	// index only
+	facts, _, err := bytecode.ReadFactTable(sections)
+	if err != nil {
+		return err
+	}
+	listing, err := bytecode.DisassembleWithFacts(code, facts)
+	if err != nil {
+		return err
+	}
+	result.Instructions = strings.Split(strings.TrimSuffix(listing, "\n"), "\n")
+
+	directory, _, err := bytecode.ReadRuleDirectory(sections)
+	if err != nil {
+		return err
+	}
+	for _, entry := range directory {
+		rule := cli.DisassembledRule{Name: entry.Name, Priority: entry.Priority, Offset: entry.Offset, Length: entry.Length, Facts: []string{}}
+		for _, index := range entry.Facts {
+			rule.Facts = append(rule.Facts, facts.Name(index))
+		}
+		result.Rules = append(result.Rules, rule)
+	}
+
+	if showSource {
+		section, ok := bytecode.FindSection(sections, bytecode.SectionSource)
+		if !ok {
+			return fmt.Errorf("%s has no embedded rule source; compile with -embedsource", inputFile)
+		}
+		source, err := section.Contents()
+		if err != nil {
+			return fmt.Errorf("failed to read embedded rule source: %w", err)
+		}
+		result.Source = string(source)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/ruledoc"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runDoc implements `rex doc`, which renders a ruleset as documentation that
+// can be regenerated whenever the rules change.
+func runDoc(args []string) int {
+	fs := flag.NewFlagSet("doc", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	format := fs.String("format", "markdown", "Documentation format: markdown or html")
+	title := fs.String("title", "Rules", "Title of the documentation")
+	output := fs.String("output", "", "Write the documentation to this file instead of stdout; required with -json")
+	fs.Parse(args)
+
+	result := cli.DocResult{SchemaVersion: cli.SchemaVersion, Output: *output, Diagnostics: []cli.Diagnostic{}}
+	code, err := generateDoc(ruleFlags, *format, *title, *output, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostics(code, err)...)
+	}
+	result.Success = err == nil
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to generate documentation")
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// generateDoc loads the ruleset and writes its documentation to output, or
+// to stdout if output is empty. On failure it returns the diagnostic code of
+// the problem.
+func generateDoc(ruleFlags *ruleFlags, formatName, title, output string, result *cli.DocResult) (string, error) {
+	format, err := ruledoc.ParseFormat(formatName)
+	if err != nil {
+		return "invalid-arguments", err
+	}
+	if *ruleFlags.json && output == "" {
+		return "invalid-arguments", fmt.Errorf("-json needs -output, since the documentation can't share stdout with the result")
+	}
+	ruleSet, err := ruleFlags.loadRules()
+	if err != nil {
+		return "invalid-ruleset", err
+	}
+
+	var doc bytes.Buffer
+	if err := ruledoc.Write(&doc, ruleSet, format, title); err != nil {
+		return "doc-failed", err
+	}
+	if output == "" {
+		_, err = os.Stdout.Write(doc.Bytes())
+	} else {
+		err = os.WriteFile(output, doc.Bytes(), 0644)
+	}
+	if err != nil {
+		return "write-failed", err
+	}
+
+	result.Rules = len(ruleSet)
+	result.Facts = len(preprocessor.AnalyzeDependencyGraph(ruleSet).Facts)
+	return "", nil
+}
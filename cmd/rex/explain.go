@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/ruletest"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runExplain implements `rex explain`, which tells why a rule doesn't fire
+// for the facts in a file. It exits with status 1 if the rule can't be
+// evaluated, whether it fires or not.
+func runExplain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	ruleName := fs.String("rule", "", "Name of the rule to explain")
+	factsFile := fs.String("facts", "", "Path to a JSON object of fact values")
+	fs.Parse(args)
+
+	result := cli.ExplainResult{SchemaVersion: cli.SchemaVersion, Diagnostics: []cli.Diagnostic{}}
+	code, err := explainRule(ruleFlags, *ruleName, *factsFile, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostics(code, err)...)
+	}
+	result.Failures = cli.NonNil(result.Failures)
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to explain rule")
+	} else if result.Fires {
+		fmt.Printf("Rule %s fires\n", result.Rule)
+	} else {
+		fmt.Printf("Rule %s doesn't fire\n", result.Rule)
+		if result.Score != nil {
+			fmt.Printf("Score %v is below the threshold %v\n", *result.Score, *result.Threshold)
+		}
+		for _, failure := range result.Failures {
+			fmt.Printf("  %s\n", describeFailure(failure))
+		}
+		if result.Closest != nil {
+			fmt.Printf("Closest: %s\n", describeFailure(*result.Closest))
+		}
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// explainRule loads the ruleset and the facts and fills in result with the
+// explanation of the named rule. On failure it returns the diagnostic code
+// of the problem.
+func explainRule(ruleFlags *ruleFlags, ruleName, factsFile string, result *cli.ExplainResult) (string, error) {
+	if ruleName == "" {
+		return "invalid-arguments", fmt.Errorf("no rule specified with -rule")
+	}
+	facts := map[string]interface{}{}
+	if factsFile != "" {
+		var err error
+		if facts, err = cli.ReadFacts(factsFile); err != nil {
+			return cli.FactsErrorCode(err), err
+		}
+	}
+	ruleSet, err := ruleFlags.loadRules()
+	if err != nil {
+		return "invalid-ruleset", err
+	}
+	for _, rule := range ruleSet {
+		if rule.Name == ruleName {
+			result.Explanation = ruletest.WhyNot(rule, facts)
+			return "", nil
+		}
+	}
+	return "unknown-rule", fmt.Errorf("no rule named '%s'", ruleName)
+}
+
+// describeFailure formats a failing condition for display.
+func describeFailure(failure ruletest.Failure) string {
+	description := failure.Reason
+	if failure.Operator != "" {
+		description = fmt.Sprintf("%s %s %v: %s", failure.Fact, failure.Operator, failure.Expected, failure.Reason)
+	}
+	if failure.Condition != "" {
+		description = failure.Condition + " " + description
+	}
+	if failure.Delta != nil {
+		description += fmt.Sprintf(", %+g away", *failure.Delta)
+	}
+	return description
+}
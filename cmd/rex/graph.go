@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runGraph implements `rex graph`, which exports the dependencies between the
+// rules of a ruleset in the DOT language, or as JSON with -json, and warns
+// about the cycles they form.
+func runGraph(args []string) int {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	output := fs.String("output", "", "Write the DOT graph to this file instead of stdout")
+	fs.Parse(args)
+
+	result := cli.GraphResult{SchemaVersion: cli.SchemaVersion, Diagnostics: []cli.Diagnostic{}}
+	code, err := exportGraph(ruleFlags, *output, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostics(code, err)...)
+	}
+	result.Rules = cli.NonNil(result.Rules)
+	result.Facts = cli.NonNil(result.Facts)
+	result.Cycles = cli.NonNil(result.Cycles)
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to export dependency graph")
+	} else {
+		for _, cycle := range result.Cycles {
+			log.Warn().Msg(cycle.String())
+		}
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// exportGraph loads the ruleset and fills in result with its dependency
+// graph, which it writes as DOT to output, or to stdout if output is empty,
+// unless -json is given. On failure it returns the diagnostic code of the
+// problem.
+func exportGraph(ruleFlags *ruleFlags, output string, result *cli.GraphResult) (string, error) {
+	ruleSet, err := ruleFlags.loadRules()
+	if err != nil {
+		return "invalid-ruleset", err
+	}
+	result.DependencyGraph = preprocessor.AnalyzeDependencyGraph(ruleSet)
+	for _, cycle := range result.Cycles {
+		result.Diagnostics = append(result.Diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning,
+			Code:     "dependency-cycle",
+			Message:  cycle.String(),
+			Rule:     cycle.Rules[0],
+		})
+	}
+	if *ruleFlags.json {
+		return "", nil
+	}
+
+	var dot bytes.Buffer
+	result.WriteDOT(&dot)
+	if output == "" {
+		_, err = os.Stdout.Write(dot.Bytes())
+	} else {
+		err = os.WriteFile(output, dot.Bytes(), 0644)
+	}
+	if err != nil {
+		return "write-failed", err
+	}
+	return "", nil
+}
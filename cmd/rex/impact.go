@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runImpact implements `rex impact`, which reports how a rule is connected to
+// the rest of the ruleset, for reviewing changes to it.
+func runImpact(args []string) int {
+	fs := flag.NewFlagSet("impact", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	ruleName := fs.String("rule", "", "Name of the rule to analyze")
+	fs.Parse(args)
+
+	result := cli.ImpactResult{SchemaVersion: cli.SchemaVersion, Diagnostics: []cli.Diagnostic{}}
+	code, err := analyzeImpact(ruleFlags, *ruleName, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostics(code, err)...)
+	}
+	result.Reads = cli.NonNil(result.Reads)
+	result.Writes = cli.NonNil(result.Writes)
+	result.Upstream = cli.NonNil(result.Upstream)
+	result.Downstream = cli.NonNil(result.Downstream)
+	result.Actions = cli.NonNil(result.Actions)
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to analyze rule impact")
+	} else {
+		fmt.Printf("Rule:        %s\n", result.Rule)
+		fmt.Printf("Reads:       %s\n", nameList(result.Reads))
+		fmt.Printf("Writes:      %s\n", nameList(result.Writes))
+		fmt.Printf("Upstream:    %s\n", nameList(result.Upstream))
+		fmt.Printf("Downstream:  %s\n", nameList(result.Downstream))
+		fmt.Printf("Actions:     %d\n", len(result.Actions))
+		for _, action := range result.Actions {
+			fmt.Printf("  %s: %s %s\n", action.Rule, action.Type, action.Target)
+		}
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// analyzeImpact loads the ruleset and fills in result with the impact of the
+// named rule. On failure it returns the diagnostic code of the problem.
+func analyzeImpact(ruleFlags *ruleFlags, ruleName string, result *cli.ImpactResult) (string, error) {
+	if ruleName == "" {
+		return "invalid-arguments", fmt.Errorf("no rule specified with -rule")
+	}
+	ruleSet, err := ruleFlags.loadRules()
+	if err != nil {
+		return "invalid-ruleset", err
+	}
+	impact, err := preprocessor.AnalyzeImpact(ruleSet, ruleName)
+	if err != nil {
+		return "unknown-rule", err
+	}
+	result.RuleImpact = impact
+	return "", nil
+}
+
+// nameList formats names for display, or "-" if there are none.
+func nameList(names []string) string {
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, ", ")
+}
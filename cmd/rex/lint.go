@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/config"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+)
+
+// runLint implements `rex lint`, which reports suspicious but legal patterns
+// in a ruleset. The checks are configured in the lint section of rex.yaml and
+// with flags. It exits with status 1 if any problem is found.
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	configFile := fs.String("config", "", "Path to the project configuration configuring the checks; defaults to rex.yaml next to the input file, if any")
+	disable := fs.String("disable", "", "Comma-separated checks to skip, in addition to those disabled in the configuration: "+strings.Join(preprocessor.LintChecks, ", "))
+	maxAnyConditions := fs.Int("maxanyconditions", 0, "Report any blocks with more conditions than this; 0 keeps the configured value, or the default of 8")
+	fs.Parse(args)
+
+	diagnostics := lint(ruleFlags, *configFile, *disable, *maxAnyConditions)
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, cli.LintResult{SchemaVersion: cli.SchemaVersion, Diagnostics: cli.NonNil(diagnostics)})
+	} else {
+		for _, diagnostic := range diagnostics {
+			fmt.Printf("%s: %s\n", diagnostic.Severity, diagnostic.Message)
+		}
+	}
+
+	if len(diagnostics) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// lint loads the ruleset and the configuration of the checks and returns the
+// problems found in the ruleset.
+func lint(ruleFlags *ruleFlags, configFile, disable string, maxAnyConditions int) []cli.Diagnostic {
+	ruleSet, err := ruleFlags.loadRules()
+	if err != nil {
+		return cli.ErrorDiagnostics("invalid-ruleset", err)
+	}
+
+	var projectConfig config.Config
+	if configFile != "" {
+		projectConfig, err = config.Load(configFile)
+	} else {
+		projectConfig, err = config.LoadForRuleset(*ruleFlags.inputFile)
+	}
+	if err != nil {
+		return cli.ErrorDiagnostics("invalid-config", err)
+	}
+	options := preprocessor.LintOptions{
+		Inputs:           ruleFlags.externalInputs(),
+		Disabled:         projectConfig.Lint.Disable,
+		MaxAnyConditions: projectConfig.Lint.MaxAnyConditions,
+	}
+	for _, check := range strings.Split(disable, ",") {
+		if check = strings.TrimSpace(check); check != "" {
+			options.Disabled = append(options.Disabled, check)
+		}
+	}
+	if maxAnyConditions > 0 {
+		options.MaxAnyConditions = maxAnyConditions
+	}
+
+	warnings, err := preprocessor.Lint(ruleSet, options)
+	if err != nil {
+		return cli.ErrorDiagnostics("invalid-config", err)
+	}
+	var diagnostics []cli.Diagnostic
+	for _, warning := range warnings {
+		diagnostics = append(diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning,
+			Code:     warning.Check,
+			Message:  warning.Message,
+			Rule:     warning.Rule,
+			Fact:     warning.Fact,
+			Path:     warning.Path,
+		})
+	}
+	return diagnostics
+}
+
+// compileWarnings returns the warnings the preprocessor gives about a valid
+// ruleset: vacuous conditions and dependency cycles.
+func compileWarnings(ruleSet []*rules.Rule) []cli.Diagnostic {
+	var diagnostics []cli.Diagnostic
+	for _, vacuous := range preprocessor.FindVacuousConditions(ruleSet) {
+		diagnostics = append(diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning,
+			Code:     "vacuous-condition",
+			Message:  vacuous.String(),
+			Rule:     vacuous.Rule,
+			Fact:     vacuous.Fact,
+		})
+	}
+	for _, cycle := range preprocessor.FindDependencyCycles(ruleSet) {
+		diagnostics = append(diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning,
+			Code:     "dependency-cycle",
+			Message:  cycle.String(),
+			Rule:     cycle.Rules[0],
+		})
+	}
+	return diagnostics
+}
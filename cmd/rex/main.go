@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/extension"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// command is a rex subcommand. run receives the arguments following the
+// subcommand name and returns the process exit code.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{name: "stats", summary: "Print statistics about a ruleset", run: runStats},
+	{name: "validate", summary: "Check a ruleset for errors without compiling it", run: runValidate},
+	{name: "lint", summary: "Report problems in a ruleset", run: runLint},
+	{name: "impact", summary: "Report the facts, rules and actions a rule affects", run: runImpact},
+	{name: "graph", summary: "Export the dependencies between the rules of a ruleset as a DOT graph", run: runGraph},
+	{name: "doc", summary: "Generate Markdown or HTML documentation for a ruleset", run: runDoc},
+	{name: "explain", summary: "Explain why a rule doesn't fire for given facts", run: runExplain},
+	{name: "test", summary: "Run the tests embedded in the rules of a ruleset", run: runTest},
+	{name: "mutate", summary: "Measure how well rule tests catch mutated rules", run: runMutate},
+	{name: "bench", summary: "Measure evaluation speed on random facts generated from the fact schema", run: runBench},
+	{name: "schema", summary: "Print the JSON Schema of the ruleset format", run: runSchema},
+	{name: "migrate", summary: "Rewrite a ruleset written for an earlier engine version in the current format", run: runMigrate},
+	{name: "compile", summary: "Compile a ruleset to a bytecode file, or preview the outcome with -plan", run: runCompile},
+	{name: "run", summary: "Compile a ruleset in memory and run one evaluation cycle against given facts", run: runRun},
+	{name: "disasm", summary: "List the instructions of a bytecode file", run: runDisasm},
+	{name: "bundle", summary: "Package bytecode and its runtime configuration into a signed bundle", run: runBundle},
+	{name: "top", summary: "Monitor a running runtime through its admin API", run: runTop},
+	{name: "audit", summary: "Query the audit history recorded by a runtime", run: runAudit},
+	{name: "serve", summary: "Serve the gRPC service compiling rulesets and evaluating them", run: runServe},
+}
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "3:04PM"})
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "rex: unknown command %q\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: rex <command> [flags]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+// ruleFlags holds the flags shared by subcommands that load a ruleset.
+type ruleFlags struct {
+	logLevel     *string
+	inputFile    *string
+	env          *string
+	inventory    *string
+	strictFields *bool
+	strictness   *string
+	inputs       *string
+	plugins      *string
+	scripts      *bool
+	json         *bool
+}
+
+// addRuleFlags registers the shared ruleset flags on fs.
+func addRuleFlags(fs *flag.FlagSet) *ruleFlags {
+	return &ruleFlags{
+		logLevel:     fs.String("loglevel", "warn", "Set log level: panic, fatal, error, warn, info, debug, trace"),
+		inputFile:    fs.String("input", "", "Path to the input JSON file"),
+		env:          fs.String("env", "", "Apply the overlay for this environment, e.g. prod reads rules.prod.json next to the input file"),
+		inventory:    fs.String("inventory", "", "Path to an inventory of devices to expand the rules templated with forEachDevice for"),
+		strictFields: fs.Bool("strictfields", false, "Reject rules containing unknown fields instead of keeping them as metadata"),
+		strictness:   fs.String("strictness", "standard", "Set validation checks: basic, standard or paranoid"),
+		inputs:       fs.String("inputs", "", "Comma-separated list of facts provided by the host application"),
+		plugins:      fs.String("plugins", "", "Comma-separated Go plugins to load, contributing optimizer passes and operators"),
+		scripts:      fs.Bool("scripts", false, "Allow script conditions and actions, which run Lua code in the runtime"),
+		json:         fs.Bool("json", false, "Write machine-readable JSON output to stdout"),
+	}
+}
+
+// codegenFlags holds the code generation flags of subcommands compiling a
+// ruleset, as the preprocessor's.
+type codegenFlags struct {
+	conditionMode *string
+	markers       *string
+	strictNumeric *bool
+	floatEpsilon  *float64
+	maxStackDepth *int
+}
+
+// addCodegenFlags registers the code generation flags on fs.
+func addCodegenFlags(fs *flag.FlagSet) *codegenFlags {
+	return &codegenFlags{
+		conditionMode: fs.String("conditionmode", "jump", "Set condition compilation: jump (short-circuit jumps) or boolean (AND/OR/NOT expressions)"),
+		markers:       fs.String("markers", "rules", "Set structural markers: rules (RULE_START/RULE_END), none (strip all, smallest bytecode) or all (also COND_START/COND_END)"),
+		strictNumeric: fs.Bool("strictnumeric", false, "Reject rules that mix int and float comparisons instead of promoting to float"),
+		floatEpsilon:  fs.Float64("floatepsilon", 0, "Treat floats compared by equal and notEqual as equal when at most this far apart, unless a condition sets its own epsilon"),
+		maxStackDepth: fs.Int("maxstackdepth", bytecode.DefaultMaxStackDepth, "Reject rules whose code could grow the stack deeper than this"),
+	}
+}
+
+// options returns the code generation options the flags select.
+func (f *codegenFlags) options() (compiler.CodegenOptions, error) {
+	conditionMode, err := bytecode.ParseConditionMode(*f.conditionMode)
+	if err != nil {
+		return compiler.CodegenOptions{}, err
+	}
+	markers, err := bytecode.ParseMarkerMode(*f.markers)
+	if err != nil {
+		return compiler.CodegenOptions{}, err
+	}
+	if *f.floatEpsilon < 0 || math.IsNaN(*f.floatEpsilon) || math.IsInf(*f.floatEpsilon, 0) {
+		return compiler.CodegenOptions{}, fmt.Errorf("invalid float epsilon %v", *f.floatEpsilon)
+	}
+	return compiler.CodegenOptions{
+		StrictNumeric: *f.strictNumeric,
+		ConditionMode: conditionMode,
+		Markers:       markers,
+		MaxStackDepth: *f.maxStackDepth,
+		FloatEpsilon:  *f.floatEpsilon,
+	}, nil
+}
+
+// externalInputs returns the facts declared with -inputs.
+func (f *ruleFlags) externalInputs() []string {
+	var inputs []string
+	for _, fact := range strings.Split(*f.inputs, ",") {
+		if fact = strings.TrimSpace(fact); fact != "" {
+			inputs = append(inputs, fact)
+		}
+	}
+	return inputs
+}
+
+// loadRules configures logging and parses and validates the input ruleset.
+func (f *ruleFlags) loadRules() ([]*rules.Rule, error) {
+	ruleJSON, err := f.readRules()
+	if err != nil {
+		return nil, err
+	}
+	return f.parseRules(ruleJSON)
+}
+
+// parseRules parses and validates a ruleset read with readRules.
+func (f *ruleFlags) parseRules(ruleJSON []byte) ([]*rules.Rule, error) {
+	strictness, err := preprocessor.ParseStrictness(*f.strictness)
+	if err != nil {
+		return nil, err
+	}
+	options := preprocessor.ParseOptions{Mode: preprocessor.ParseModePermissive, Strictness: strictness, Scripts: *f.scripts}
+	if *f.strictFields {
+		options.Mode = preprocessor.ParseModeStrict
+	}
+	return preprocessor.ParseAndValidateRulesWithOptions(ruleJSON, rules.NewRuleEngineContext(), options)
+}
+
+// readRules configures logging, loads the plugins and reads the input
+// ruleset, with the environment's overlay applied and the inventory's
+// devices expanded.
+func (f *ruleFlags) readRules() ([]byte, error) {
+	level, err := zerolog.ParseLevel(*f.logLevel)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level: %w", err)
+	}
+	zerolog.SetGlobalLevel(level)
+
+	if err := extension.LoadPlugins(extension.SplitPaths(*f.plugins)...); err != nil {
+		return nil, err
+	}
+
+	if *f.inputFile == "" {
+		return nil, fmt.Errorf("no input file specified")
+	}
+	ruleJSON, err := os.ReadFile(*f.inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input file: %w", err)
+	}
+
+	if *f.env != "" {
+		overlayPath := preprocessor.OverlayPath(*f.inputFile, *f.env)
+		overlayJSON, err := os.ReadFile(overlayPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read overlay file: %w", err)
+		}
+		ruleJSON, err = preprocessor.ApplyOverlays(ruleJSON, preprocessor.Overlay{Name: overlayPath, JSON: overlayJSON})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *f.inventory != "" {
+		inventoryJSON, err := os.ReadFile(*f.inventory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read inventory file: %w", err)
+		}
+		inventory, err := preprocessor.ParseInventory(inventoryJSON)
+		if err != nil {
+			return nil, err
+		}
+		if ruleJSON, err = preprocessor.ExpandInventory(ruleJSON, inventory); err != nil {
+			return nil, err
+		}
+	}
+	return ruleJSON, nil
+}
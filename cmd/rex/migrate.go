@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+
+	"github.com/rs/zerolog"
+)
+
+// runMigrate implements `rex migrate`, which brings a ruleset written for an
+// earlier version of the engine up to date. It exits with status 1 if the
+// ruleset couldn't be migrated, or if constructs need manual attention.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	inputFile := fs.String("input", "", "Path to the input JSON file")
+	output := fs.String("output", "", "Write the migrated ruleset to this file, which may be the input file, instead of stdout; required with -json")
+	jsonOutput := fs.Bool("json", false, "Write machine-readable JSON output to stdout")
+	fs.Parse(args)
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	result := cli.MigrateResult{SchemaVersion: cli.SchemaVersion, Output: *output, Changes: []preprocessor.MigrationChange{}, Diagnostics: []cli.Diagnostic{}}
+	code, err := migrate(*inputFile, *output, *jsonOutput, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostic(code, err))
+	}
+	result.Success = err == nil
+
+	manual := 0
+	for _, change := range result.Changes {
+		if change.Manual {
+			manual++
+		}
+	}
+	if *jsonOutput {
+		cli.WriteJSON(os.Stdout, result)
+	} else {
+		for _, change := range result.Changes {
+			if change.Manual {
+				fmt.Fprintf(os.Stderr, "needs attention: %s\n", change)
+			} else {
+				fmt.Fprintf(os.Stderr, "migrated: %s\n", change)
+			}
+		}
+		for _, diagnostic := range result.Diagnostics {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", diagnostic.Severity, diagnostic.Message)
+		}
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "%d changes, %d constructs need manual attention\n", len(result.Changes)-manual, manual)
+		}
+	}
+
+	if err != nil || manual > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrate migrates the ruleset in inputFile and writes it to output, or to
+// stdout if output is empty. The migrated ruleset is then validated, and the
+// problems left are reported as warnings. On failure it returns the
+// diagnostic code of the problem.
+func migrate(inputFile, output string, jsonOutput bool, result *cli.MigrateResult) (string, error) {
+	if inputFile == "" {
+		return "invalid-arguments", fmt.Errorf("no input file specified")
+	}
+	if jsonOutput && output == "" {
+		return "invalid-arguments", fmt.Errorf("-json needs -output, since the migrated ruleset can't share stdout with the result")
+	}
+	ruleJSON, err := os.ReadFile(inputFile)
+	if err != nil {
+		return "invalid-arguments", fmt.Errorf("failed to read input file: %w", err)
+	}
+
+	migrated, changes, err := preprocessor.MigrateRuleset(ruleJSON)
+	if err != nil {
+		return "invalid-ruleset", err
+	}
+	result.Changes = append(result.Changes, changes...)
+	if output == "" {
+		_, err = os.Stdout.Write(migrated)
+	} else {
+		err = os.WriteFile(output, migrated, 0644)
+	}
+	if err != nil {
+		return "write-failed", err
+	}
+
+	options := preprocessor.ParseOptions{Mode: preprocessor.ParseModePermissive}
+	if _, err := preprocessor.ParseAndValidateRulesWithOptions(migrated, rules.NewRuleEngineContext(), options); err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.Diagnostic{
+			Severity: cli.SeverityWarning,
+			Code:     "invalid-ruleset",
+			Message:  fmt.Sprintf("the migrated ruleset doesn't validate yet: %v", err),
+		})
+	}
+	return "", nil
+}
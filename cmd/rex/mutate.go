@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/ruletest"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runMutate implements `rex mutate`, which measures how well the tests of a
+// ruleset constrain its rules by checking that they fail on mutated copies.
+// Rules whose tests already fail aren't mutated. It exits with status 1 if
+// the score is below -minscore.
+func runMutate(args []string) int {
+	fs := flag.NewFlagSet("mutate", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	minScore := fs.Float64("minscore", 0, "Fail if fewer than this percentage of mutants are killed")
+	fs.Parse(args)
+
+	result := cli.MutationResult{
+		SchemaVersion: cli.SchemaVersion,
+		Mutants:       []ruletest.Mutant{},
+		UntestedRules: []string{},
+		FailingRules:  []string{},
+		Diagnostics:   []cli.Diagnostic{},
+	}
+	ruleSet, err := ruleFlags.loadRules()
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostics("invalid-ruleset", err)...)
+	} else {
+		report := ruletest.Mutate(ruleSet)
+		result.Mutants = report.Mutants
+		result.UntestedRules = report.UntestedRules
+		result.FailingRules = report.FailingRules
+		result.Score = report.Score()
+		result.Killed = report.Killed()
+		result.Survived = len(report.Mutants) - result.Killed
+	}
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to load rules")
+	} else {
+		for _, mutant := range result.Mutants {
+			if !mutant.Killed {
+				fmt.Printf("survived %s %s: %s\n", mutant.Rule, mutant.Condition, mutant.Description)
+			}
+		}
+		for _, rule := range result.UntestedRules {
+			fmt.Printf("untested %s\n", rule)
+		}
+		for _, rule := range result.FailingRules {
+			fmt.Printf("failing  %s (run rex test)\n", rule)
+		}
+		fmt.Printf("%d mutants, %d killed, %d survived, score %.1f%%\n", len(result.Mutants), result.Killed, result.Survived, result.Score)
+	}
+
+	if err != nil || result.Score < *minScore {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/runtime"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runRun implements `rex run`, which compiles a ruleset in memory, as the
+// preprocessor would without writing bytecode.bin, and runs one evaluation
+// cycle of it against the facts in a file, for trying out rules locally. It
+// exits with status 1 if the ruleset doesn't compile or the cycle fails.
+func runRun(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	codegenFlags := addCodegenFlags(fs)
+	factsFile := fs.String("facts", "", "Path to a JSON object of fact values to evaluate the rules against")
+	maxChainDepth := fs.Int("maxchaindepth", 0, "Evaluate the rules consuming a fact again in the same cycle when a rule changes it, up to this many re-evaluations deep; 0 disables forward chaining")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: rex run [flags] [rules.json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *ruleFlags.inputFile == "" {
+		*ruleFlags.inputFile = fs.Arg(0)
+	}
+
+	result := cli.RunResult{SchemaVersion: cli.SchemaVersion, FiredRules: []int{}, Facts: map[string]interface{}{}, Diagnostics: []cli.Diagnostic{}}
+	vm, code, err := compileAndRun(ruleFlags, codegenFlags, *factsFile, *maxChainDepth, &result)
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostics(code, err)...)
+	}
+	result.Success = len(result.Diagnostics) == 0
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, result)
+	} else if vm == nil {
+		log.Error().Err(err).Msg("Failed to run ruleset")
+	} else {
+		if err != nil {
+			log.Error().Err(err).Msg("Evaluation cycle failed")
+		}
+		printRun(os.Stdout, vm, result)
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// compileAndRun compiles the input ruleset, runs a cycle of it against the
+// facts and fills in result. It returns the VM once the ruleset compiles,
+// and on failure the diagnostic code of the problem. If the cycle fails, no
+// rule is reported fired, as none of its updates were committed.
+func compileAndRun(ruleFlags *ruleFlags, codegenFlags *codegenFlags, factsFile string, maxChainDepth int, result *cli.RunResult) (*runtime.VM, string, error) {
+	facts := map[string]interface{}{}
+	if factsFile != "" {
+		var err error
+		if facts, err = cli.ReadFacts(factsFile); err != nil {
+			return nil, cli.FactsErrorCode(err), err
+		}
+	}
+
+	ruleJSON, err := ruleFlags.readRules()
+	if err != nil {
+		return nil, "read-failed", err
+	}
+	strictness, err := preprocessor.ParseStrictness(*ruleFlags.strictness)
+	if err != nil {
+		return nil, "invalid-arguments", err
+	}
+	codegen, err := codegenFlags.options()
+	if err != nil {
+		return nil, "invalid-arguments", err
+	}
+	options := compiler.Options{
+		Strictness:   strictness,
+		StrictFields: *ruleFlags.strictFields,
+		Scripts:      *ruleFlags.scripts,
+		Codegen:      codegen,
+		Inputs:       ruleFlags.externalInputs(),
+	}
+	ruleset, err := compiler.ParseRules(ruleJSON, options)
+	if err != nil {
+		return nil, "invalid-ruleset", err
+	}
+	if ruleset, err = compiler.Optimize(ruleset); err != nil {
+		return nil, "compile-failed", err
+	}
+	compiled, err := compiler.Compile(ruleset, options)
+	if err != nil {
+		return nil, "compile-failed", err
+	}
+	vm := runtime.NewVM(compiled.Image)
+	if err := vm.DecodeError(); err != nil {
+		return nil, "compile-failed", err
+	}
+	vm.SetMaxChainDepth(maxChainDepth)
+	vm.SetFacts(facts)
+	vm.OnAfterRule(func(rule int, fired bool) {
+		if fired {
+			result.FiredRules = append(result.FiredRules, rule)
+		}
+	})
+	err = vm.Run()
+	result.Facts = vm.Facts()
+	if err != nil {
+		result.FiredRules = []int{}
+		return vm, "run-failed", err
+	}
+	return vm, "", nil
+}
+
+// printRun writes the rules a cycle fired, by name, and the facts after it
+// as text.
+func printRun(w io.Writer, vm *runtime.VM, result cli.RunResult) {
+	rules := vm.Rules()
+	if len(result.FiredRules) == 0 {
+		fmt.Fprintln(w, "No rules fired")
+	} else {
+		fmt.Fprintln(w, "Fired rules:")
+		for _, rule := range result.FiredRules {
+			fmt.Fprintf(w, "  %s\n", rules[rule].Name)
+		}
+	}
+
+	names := make([]string, 0, len(result.Facts))
+	for name := range result.Facts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "Facts:")
+	for _, name := range names {
+		value, _ := json.Marshal(result.Facts[name])
+		fmt.Fprintf(w, "  %s = %s\n", name, value)
+	}
+}
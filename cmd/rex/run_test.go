@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"rgehrsitz/rex/internal/cli"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseRunFlags parses args with the rule and code generation flags of rex
+// run.
+func parseRunFlags(t *testing.T, args ...string) (*ruleFlags, *codegenFlags) {
+	t.Helper()
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	ruleFlags := addRuleFlags(fs)
+	codegenFlags := addCodegenFlags(fs)
+	require.NoError(t, fs.Parse(args))
+	return ruleFlags, codegenFlags
+}
+
+// writeFacts writes fact values next to the rules at rulesPath and returns
+// the path of the file.
+func writeFacts(t *testing.T, rulesPath, factsJSON string) string {
+	t.Helper()
+	path := filepath.Join(filepath.Dir(rulesPath), "facts.json")
+	require.NoError(t, os.WriteFile(path, []byte(factsJSON), 0644))
+	return path
+}
+
+// captureStdout returns what run writes to stdout.
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	run()
+	w.Close()
+	return <-output
+}
+
+func newRunResult() cli.RunResult {
+	return cli.RunResult{FiredRules: []int{}, Facts: map[string]interface{}{}}
+}
+
+func TestCompileAndRun(t *testing.T) {
+	input := writeRules(t, fanRules)
+	facts := writeFacts(t, input, `{"temperature": 35}`)
+
+	for _, args := range [][]string{
+		{"-input", input},
+		{"-input", input, "-conditionmode", "boolean", "-markers", "all"},
+	} {
+		ruleFlags, codegenFlags := parseRunFlags(t, args...)
+		result := newRunResult()
+		vm, code, err := compileAndRun(ruleFlags, codegenFlags, facts, 0, &result)
+		require.NoError(t, err, code)
+		require.NotNil(t, vm)
+		assert.Equal(t, []int{0}, result.FiredRules, args)
+		assert.Equal(t, true, result.Facts["fan_status"], args)
+		assert.Equal(t, true, result.Facts["alarm"], args)
+	}
+}
+
+func TestCompileAndRun_EnvAndInventory(t *testing.T) {
+	input := writeRules(t, `[
+    {
+        "name": "overheating",
+        "forEachDevice": {},
+        "consumedFacts": ["${device.id}:temperature"],
+        "producedFacts": ["${device.id}:alarm"],
+        "conditions": {"all": [{"fact": "${device.id}:temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "${device.id}:alarm", "value": true}]}
+    }
+]`)
+	dir := filepath.Dir(input)
+	inventory := filepath.Join(dir, "inventory.json")
+	require.NoError(t, os.WriteFile(inventory, []byte(`[{"id": "ahu-1"}, {"id": "ahu-2"}]`), 0644))
+	overlay := `[{"name": "overheating", "conditions": {"all": [{"value": 40}]}}]`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "rules.prod.json"), []byte(overlay), 0644))
+	facts := writeFacts(t, input, `{"ahu-1:temperature": 35, "ahu-2:temperature": 45}`)
+
+	// The rule is expanded for both devices
+	ruleFlags, codegenFlags := parseRunFlags(t, "-input", input, "-inventory", inventory)
+	result := newRunResult()
+	_, code, err := compileAndRun(ruleFlags, codegenFlags, facts, 0, &result)
+	require.NoError(t, err, code)
+	assert.Equal(t, true, result.Facts["ahu-1:alarm"])
+	assert.Equal(t, true, result.Facts["ahu-2:alarm"])
+
+	// The prod overlay raises the threshold above the first device's temperature
+	ruleFlags, codegenFlags = parseRunFlags(t, "-input", input, "-inventory", inventory, "-env", "prod")
+	result = newRunResult()
+	_, code, err = compileAndRun(ruleFlags, codegenFlags, facts, 0, &result)
+	require.NoError(t, err, code)
+	assert.NotContains(t, result.Facts, "ahu-1:alarm")
+	assert.Equal(t, true, result.Facts["ahu-2:alarm"])
+
+	ruleFlags, codegenFlags = parseRunFlags(t, "-input", input, "-inventory", inventory, "-env", "staging")
+	_, code, err = compileAndRun(ruleFlags, codegenFlags, facts, 0, &result)
+	assert.Equal(t, "read-failed", code)
+	assert.ErrorContains(t, err, "failed to read overlay file")
+}
+
+func TestCompileAndRun_Errors(t *testing.T) {
+	input := writeRules(t, fanRules)
+
+	ruleFlags, codegenFlags := parseRunFlags(t, "-input", input, "-markers", "bogus")
+	vm, code, err := compileAndRun(ruleFlags, codegenFlags, "", 0, &cli.RunResult{})
+	assert.Nil(t, vm)
+	assert.Equal(t, "invalid-arguments", code)
+	assert.ErrorContains(t, err, "unknown marker mode")
+
+	ruleFlags, codegenFlags = parseRunFlags(t, "-input", input)
+	_, code, _ = compileAndRun(ruleFlags, codegenFlags, filepath.Join(t.TempDir(), "missing.json"), 0, &cli.RunResult{})
+	assert.Equal(t, "read-failed", code)
+
+	ruleFlags, codegenFlags = parseRunFlags(t, "-input", writeRules(t, `[{"name": "a", "conditions": {}}]`))
+	_, code, _ = compileAndRun(ruleFlags, codegenFlags, "", 0, &cli.RunResult{})
+	assert.Equal(t, "invalid-ruleset", code)
+}
+
+func TestCompileAndRun_CycleFails(t *testing.T) {
+	// The fan rule fires before the humidity rule finds its fact undefined
+	input := writeRules(t, `[
+    {
+        "name": "fan",
+        "priority": 10,
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    },
+    {
+        "name": "dehumidifier",
+        "consumedFacts": ["humidity"],
+        "producedFacts": ["dehumidifier"],
+        "conditions": {"all": [{"fact": "humidity", "operator": "greaterThan", "value": 80}]},
+        "event": {"actions": [{"type": "updateFact", "target": "dehumidifier", "value": true}]}
+    }
+]`)
+	facts := writeFacts(t, input, `{"temperature": 35}`)
+	ruleFlags, codegenFlags := parseRunFlags(t, "-input", input)
+
+	result := newRunResult()
+	vm, code, err := compileAndRun(ruleFlags, codegenFlags, facts, 0, &result)
+	require.NotNil(t, vm)
+	assert.Equal(t, "run-failed", code)
+	assert.ErrorContains(t, err, "undefined fact: humidity")
+	assert.Empty(t, result.FiredRules, "nothing the failed cycle did was committed")
+	assert.NotContains(t, result.Facts, "fan_status")
+}
+
+func TestRunRun(t *testing.T) {
+	input := writeRules(t, fanRules)
+	facts := writeFacts(t, input, `{"temperature": 35}`)
+
+	var status int
+	output := captureStdout(t, func() {
+		status = runRun([]string{"-json", "-facts", facts, "-conditionmode", "boolean", input})
+	})
+	assert.Equal(t, 0, status)
+	var result cli.RunResult
+	require.NoError(t, json.Unmarshal([]byte(output), &result))
+	assert.True(t, result.Success)
+	assert.Equal(t, []int{0}, result.FiredRules)
+	assert.Equal(t, true, result.Facts["fan_status"])
+	assert.Empty(t, result.Diagnostics)
+
+	output = captureStdout(t, func() {
+		status = runRun([]string{"-facts", facts, input})
+	})
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "Fired rules:\n  fan\nFacts:\n  alarm = true\n  fan_status = true\n  temperature = 35\n", output)
+
+	output = captureStdout(t, func() {
+		status = runRun([]string{"-json", "-markers", "bogus", input})
+	})
+	assert.Equal(t, 1, status)
+	result = cli.RunResult{}
+	require.NoError(t, json.Unmarshal([]byte(output), &result))
+	assert.False(t, result.Success)
+	require.NotEmpty(t, result.Diagnostics)
+	assert.Equal(t, "invalid-arguments", result.Diagnostics[0].Code)
+}
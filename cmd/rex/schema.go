@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"rgehrsitz/rex/extension"
+	"rgehrsitz/rex/internal/preprocessor"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runSchema implements `rex schema`, which writes the JSON Schema of the
+// ruleset format, allowing the custom operators of the plugins loaded.
+func runSchema(args []string) int {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	plugins := fs.String("plugins", "", "Comma-separated Go plugins to load, contributing operators")
+	output := fs.String("output", "", "Write the schema to this file instead of stdout")
+	fs.Parse(args)
+
+	if err := extension.LoadPlugins(extension.SplitPaths(*plugins)...); err != nil {
+		log.Error().Err(err).Msg("Failed to load plugins")
+		return 1
+	}
+	schema, err := preprocessor.RulesetSchema()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to generate schema")
+		return 1
+	}
+	schema = append(schema, '\n')
+	if *output == "" {
+		os.Stdout.Write(schema)
+	} else if err := os.WriteFile(*output, schema, 0644); err != nil {
+		log.Error().Err(err).Msg("Failed to write schema")
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"rgehrsitz/rex/extension"
+	"rgehrsitz/rex/internal/rpcserver"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+// runServe implements `rex serve`, which runs rex as a central rules service
+// answering the gRPC Rex service defined in rexpb/rex.proto.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("grpc", ":50051", "Address to serve the gRPC Rex service on")
+	bytecodeFile := fs.String("bytecode", "", "Bytecode file to evaluate until a client loads another")
+	logLevel := fs.String("loglevel", "info", "Set log level: panic, fatal, error, warn, info, debug, trace")
+	plugins := fs.String("plugins", "", "Comma-separated Go plugins to load, contributing operators and action handlers")
+	fs.Parse(args)
+
+	level, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid log level")
+		return 2
+	}
+	zerolog.SetGlobalLevel(level)
+	if err := extension.LoadPlugins(extension.SplitPaths(*plugins)...); err != nil {
+		log.Error().Err(err).Msg("Error loading plugins")
+		return 1
+	}
+
+	server := rpcserver.New(nil)
+	defer server.Close()
+	if *bytecodeFile != "" {
+		image, err := os.ReadFile(*bytecodeFile)
+		if err != nil {
+			log.Error().Err(err).Msg("Error reading bytecode file")
+			return 1
+		}
+		if _, err := server.Load(image); err != nil {
+			log.Error().Err(err).Msg("Error loading bytecode")
+			return 1
+		}
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Error().Err(err).Msg("Error listening")
+		return 1
+	}
+	grpcServer := grpc.NewServer()
+	server.Register(grpcServer)
+	log.Info().Str("Address", listener.Addr().String()).Msg("Serving the Rex gRPC service")
+	if err := grpcServer.Serve(listener); err != nil {
+		log.Error().Err(err).Msg("gRPC server failed")
+		return 1
+	}
+	return 0
+}
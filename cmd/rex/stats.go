@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runStats implements `rex stats`.
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	fs.Parse(args)
+
+	ruleSet, err := ruleFlags.loadRules()
+	if err != nil {
+		if *ruleFlags.json {
+			cli.WriteJSON(os.Stdout, cli.Stats{
+				SchemaVersion: cli.SchemaVersion,
+				Diagnostics:   cli.ErrorDiagnostics("invalid-ruleset", err),
+			})
+			return 1
+		}
+		log.Error().Err(err).Msg("Failed to load rules")
+		return 1
+	}
+
+	conditions, actions := 0, 0
+	for _, rule := range ruleSet {
+		conditions += countConditions(rule.Conditions.All) + countConditions(rule.Conditions.Any) + countConditions(rule.Conditions.Not)
+		actions += len(rule.Event.Actions)
+		for _, variant := range rule.Variants {
+			actions += len(variant.Actions)
+		}
+	}
+	usage := preprocessor.AnalyzeFactUsage(ruleSet, ruleFlags.externalInputs())
+
+	cost, err := estimateCost(ruleSet)
+	if err != nil {
+		if *ruleFlags.json {
+			cli.WriteJSON(os.Stdout, cli.Stats{
+				SchemaVersion: cli.SchemaVersion,
+				Diagnostics:   []cli.Diagnostic{cli.ErrorDiagnostic("compile-failed", err)},
+			})
+			return 1
+		}
+		log.Error().Err(err).Msg("Failed to compile rules")
+		return 1
+	}
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, cli.Stats{
+			SchemaVersion:     cli.SchemaVersion,
+			Rules:             len(ruleSet),
+			Conditions:        conditions,
+			Actions:           actions,
+			ConsumedFacts:     cli.NonNil(usage.Consumed),
+			ProducedFacts:     cli.NonNil(usage.Produced),
+			UnusedProductions: cli.NonNil(usage.UnusedProductions),
+			UndefinedInputs:   cli.NonNil(usage.UndefinedInputs),
+			Cost:              &cost,
+			Diagnostics:       []cli.Diagnostic{},
+		})
+		return 0
+	}
+
+	fmt.Printf("Rules:              %d\n", len(ruleSet))
+	fmt.Printf("Conditions:         %d\n", conditions)
+	fmt.Printf("Actions:            %d\n", actions)
+	fmt.Printf("Consumed facts:     %d\n", len(usage.Consumed))
+	fmt.Printf("Produced facts:     %d\n", len(usage.Produced))
+	fmt.Printf("Unused productions: %d %s\n", len(usage.UnusedProductions), factList(usage.UnusedProductions))
+	fmt.Printf("Undefined inputs:   %d %s\n", len(usage.UndefinedInputs), factList(usage.UndefinedInputs))
+	fmt.Printf("Max instructions:   %d (worst case per cycle)\n", cost.Instructions)
+	fmt.Printf("Max stack depth:    %d\n", cost.MaxStackDepth)
+	return 0
+}
+
+// estimateCost compiles the rules with the default options, as the
+// preprocessor would, and returns the worst-case cost of the bytecode.
+func estimateCost(ruleSet []*rules.Rule) (bytecode.Cost, error) {
+	context := rules.NewRuleEngineContext()
+	preprocessor.IndexFacts(ruleSet, context)
+	optimizedRules, err := preprocessor.OptimizeRules(ruleSet, context)
+	if err != nil {
+		return bytecode.Cost{}, fmt.Errorf("failed to optimize rules: %w", err)
+	}
+	code, err := bytecode.NewCompiler(context).Compile(optimizedRules)
+	if err != nil {
+		return bytecode.Cost{}, fmt.Errorf("failed to compile rules: %w", err)
+	}
+	return bytecode.EstimateCost(code)
+}
+
+// countConditions returns the number of fact comparisons and script
+// conditions in conditions, including nested ones.
+func countConditions(conditions []rules.Condition) int {
+	count := 0
+	for _, cond := range conditions {
+		if cond.Fact != "" || cond.Script != "" {
+			count++
+		}
+		count += countConditions(cond.All) + countConditions(cond.Any) + countConditions(cond.Not)
+	}
+	return count
+}
+
+// factList formats a list of facts for display after a count.
+func factList(facts []string) string {
+	if len(facts) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(facts, ", ") + ")"
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/ruletest"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runTest implements `rex test`, which runs the tests embedded in the rules
+// of a ruleset. It exits with status 1 if any test fails.
+func runTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	fs.Parse(args)
+
+	result := cli.TestResult{SchemaVersion: cli.SchemaVersion, Results: []ruletest.Result{}, Diagnostics: []cli.Diagnostic{}}
+	ruleSet, err := ruleFlags.loadRules()
+	if err != nil {
+		result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostics("invalid-ruleset", err)...)
+	} else {
+		result.Results = ruletest.Run(ruleSet)
+	}
+	for _, test := range result.Results {
+		if test.Passed {
+			result.Passed++
+		} else {
+			result.Failed++
+		}
+	}
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, result)
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to load rules")
+	} else {
+		for _, test := range result.Results {
+			if test.Passed {
+				fmt.Printf("ok   %s %s\n", test.Rule, test.Test)
+			} else {
+				fmt.Printf("FAIL %s %s: %s\n", test.Rule, test.Test, test.Failure)
+			}
+		}
+		fmt.Printf("%d passed, %d failed\n", result.Passed, result.Failed)
+	}
+
+	if err != nil || result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rgehrsitz/rex/client"
+	"rgehrsitz/rex/internal/admin"
+	"rgehrsitz/rex/internal/runtime"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runTop implements `rex top`, a live view of a runtime's statistics fetched
+// from its admin API. A failed fetch doesn't stop it: the error is shown
+// with the last statistics fetched, and the next refresh tries again.
+func runTop(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	addr := fs.String("addr", "http://localhost:8080", "Base URL of the runtime admin API")
+	interval := fs.Duration("interval", 2*time.Second, "Refresh interval")
+	limit := fs.Int("n", 10, "Number of rules and facts to show")
+	jsonOutput := fs.Bool("json", false, "Write each snapshot as a line of JSON instead of drawing a table")
+	fs.Parse(args)
+
+	c := client.New(*addr, client.Options{})
+	var previous, current *admin.Snapshot
+	for {
+		snapshot, err := c.Snapshot(context.Background())
+		if err == nil {
+			previous, current = current, snapshot
+		}
+
+		if *jsonOutput {
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to fetch runtime statistics")
+			} else {
+				json.NewEncoder(os.Stdout).Encode(current)
+			}
+		} else {
+			// Clear the screen and redraw
+			fmt.Print("\033[H\033[2J")
+			renderTop(os.Stdout, *addr, previous, current, err, *limit)
+		}
+
+		time.Sleep(*interval)
+	}
+}
+
+// topRule is a row of the rules table.
+type topRule struct {
+	label           string
+	firingsPerSec   float64
+	firings         int
+	actionErrorRate float64
+}
+
+// topFact is a row of the fact churn table.
+type topFact struct {
+	name    string
+	changes int
+}
+
+// renderTop writes one screen of `rex top`. Rates are computed over the time
+// since the previous snapshot, or since the runtime started for the first one.
+// fetchErr is the error the last fetch failed with, shown above the last
+// snapshot fetched; current is nil if none has been.
+func renderTop(w io.Writer, addr string, previous, current *admin.Snapshot, fetchErr error, limit int) {
+	if current == nil {
+		fmt.Fprintf(w, "rex top - %s\n", addr)
+		if fetchErr != nil {
+			fmt.Fprintf(w, "Failed to fetch runtime statistics: %v\n", fetchErr)
+		}
+		return
+	}
+	if previous == nil {
+		previous = &admin.Snapshot{}
+	}
+	elapsed := current.UptimeSeconds - previous.UptimeSeconds
+	perSecond := func(delta int) float64 {
+		if elapsed <= 0 {
+			return 0
+		}
+		return float64(delta) / elapsed
+	}
+
+	type ruleKey struct {
+		ruleset string
+		rule    int
+	}
+	previousRules := make(map[ruleKey]admin.RuleStats)
+	for _, stats := range previous.Rules {
+		previousRules[ruleKey{stats.Ruleset, stats.Rule}] = stats
+	}
+
+	var rows []topRule
+	for _, stats := range current.Rules {
+		before := previousRules[ruleKey{stats.Ruleset, stats.Rule}]
+		label := stats.Label
+		if stats.Ruleset != "" {
+			label = stats.Ruleset + ": " + label
+		}
+		row := topRule{
+			label:         label,
+			firingsPerSec: perSecond(stats.Firings - before.Firings),
+			firings:       stats.Firings,
+		}
+		if evaluations := stats.Evaluations - before.Evaluations; evaluations > 0 {
+			row.actionErrorRate = float64(stats.ActionErrors-before.ActionErrors) / float64(evaluations)
+		}
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].firingsPerSec != rows[j].firingsPerSec {
+			return rows[i].firingsPerSec > rows[j].firingsPerSec
+		}
+		return rows[i].firings > rows[j].firings
+	})
+
+	var facts []topFact
+	for name, changes := range current.FactChanges {
+		if delta := changes - previous.FactChanges[name]; delta > 0 {
+			facts = append(facts, topFact{name: name, changes: delta})
+		}
+	}
+	sort.Slice(facts, func(i, j int) bool {
+		if facts[i].changes != facts[j].changes {
+			return facts[i].changes > facts[j].changes
+		}
+		return facts[i].name < facts[j].name
+	})
+
+	fmt.Fprintf(w, "rex top - %s - up %s\n", addr, time.Duration(current.UptimeSeconds*float64(time.Second)).Round(time.Second))
+	if fetchErr != nil {
+		fmt.Fprintf(w, "Failed to fetch runtime statistics: %v; showing the last ones fetched\n", fetchErr)
+	}
+	fmt.Fprintf(w, "Evaluations/sec: %.1f   Cycles: %d   Cycle errors: %d\n\n",
+		perSecond(current.Evaluations-previous.Evaluations), current.Cycles, current.CycleErrors)
+
+	tripped := false
+	for _, breaker := range current.Breakers {
+		if breaker.State != runtime.BreakerClosed {
+			fmt.Fprintf(w, "Circuit breaker %s: %s (%d trips, %d timeouts)\n", breaker.HandlerType, breaker.State, breaker.Trips, breaker.Timeouts)
+			tripped = true
+		}
+	}
+	if tripped {
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "%-30s %12s %10s %12s\n", "RULE", "FIRINGS/SEC", "FIRINGS", "ERROR RATE")
+	for i, row := range rows {
+		if i == limit {
+			break
+		}
+		fmt.Fprintf(w, "%-30s %12.1f %10d %11.1f%%\n", row.label, row.firingsPerSec, row.firings, row.actionErrorRate*100)
+	}
+
+	fmt.Fprintf(w, "\n%-30s %12s\n", "FACT", "CHANGES")
+	for i, fact := range facts {
+		if i == limit {
+			break
+		}
+		fmt.Fprintf(w, "%-30s %12d\n", fact.name, fact.changes)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"rgehrsitz/rex/internal/admin"
+	"rgehrsitz/rex/internal/runtime"
+	"rgehrsitz/rex/rextest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertGolden checks that got matches the golden file testdata/name. With
+// REXTEST_UPDATE set, it writes got to the file instead.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if os.Getenv(rextest.UpdateEnv) != "" {
+		require.NoError(t, os.MkdirAll("testdata", 0755))
+		require.NoError(t, os.WriteFile(path, got, 0644))
+		return
+	}
+	golden, err := os.ReadFile(path)
+	require.NoError(t, err, "run with %s=1 to create it", rextest.UpdateEnv)
+	assert.Equal(t, string(golden), string(got), "output differs from %s; run with %s=1 to update it", path, rextest.UpdateEnv)
+}
+
+func topSnapshots() (*admin.Snapshot, *admin.Snapshot) {
+	previous := &admin.Snapshot{
+		UptimeSeconds: 60,
+		Cycles:        100,
+		Evaluations:   200,
+		Rules: []admin.RuleStats{
+			{Rule: 0, Label: "cooling", Evaluations: 100, Firings: 40},
+			{Rule: 1, Label: "heating", Evaluations: 100, Firings: 5, ActionErrors: 1},
+		},
+		FactChanges: map[string]int{"fan_status": 10, "heater_status": 2},
+	}
+	current := &admin.Snapshot{
+		UptimeSeconds: 70,
+		Cycles:        120,
+		CycleErrors:   1,
+		Evaluations:   240,
+		Rules: []admin.RuleStats{
+			{Rule: 0, Label: "cooling", Evaluations: 120, Firings: 45},
+			{Rule: 1, Label: "heating", Evaluations: 120, Firings: 15, ActionErrors: 3},
+		},
+		FactChanges: map[string]int{"fan_status": 14, "heater_status": 2, "temperature": 20},
+		Breakers:    []runtime.BreakerStatus{{HandlerType: "webhook", State: runtime.BreakerOpen, Trips: 2, Timeouts: 3}},
+	}
+	return previous, current
+}
+
+func TestRenderTop(t *testing.T) {
+	previous, current := topSnapshots()
+	var buf bytes.Buffer
+	renderTop(&buf, "http://localhost:8080", previous, current, nil, 10)
+	assertGolden(t, "top.golden", buf.Bytes())
+}
+
+func TestRenderTop_FetchFailed(t *testing.T) {
+	fetchErr := errors.New("connection refused")
+
+	// The last statistics fetched stay on screen under the error
+	previous, current := topSnapshots()
+	var buf bytes.Buffer
+	renderTop(&buf, "http://localhost:8080", previous, current, fetchErr, 1)
+	assertGolden(t, "top_fetch_failed.golden", buf.Bytes())
+
+	buf.Reset()
+	renderTop(&buf, "http://localhost:8080", nil, nil, fetchErr, 10)
+	assert.Equal(t, "rex top - http://localhost:8080\nFailed to fetch runtime statistics: connection refused\n", buf.String())
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/preprocessor"
+)
+
+// runValidate implements `rex validate`, which checks a ruleset against the
+// ruleset schema and parses and validates it, without compiling it, so that
+// CI pipelines can gate rule changes. It exits with status 1 if an error is
+// found, or with -failonwarnings any problem.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	ruleFlags := addRuleFlags(fs)
+	schemaCheck := fs.Bool("schemacheck", true, "Check the ruleset against the ruleset JSON Schema before parsing it, reporting the path of every violation")
+	failOnWarnings := fs.Bool("failonwarnings", false, "Fail validation on warnings, such as vacuous conditions and dependency cycles, as well as on errors")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: rex validate [flags] [rules.json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *ruleFlags.inputFile == "" {
+		*ruleFlags.inputFile = fs.Arg(0)
+	}
+
+	ruleNames, diagnostics := validate(ruleFlags, *schemaCheck)
+	result := cli.NewValidateResult(ruleNames, diagnostics)
+	if *failOnWarnings && len(result.Diagnostics) > 0 {
+		result.Success = false
+	}
+
+	if *ruleFlags.json {
+		cli.WriteJSON(os.Stdout, result)
+	} else {
+		printValidate(os.Stdout, result)
+	}
+
+	if !result.Success {
+		return 1
+	}
+	return 0
+}
+
+// validate reads and validates the input ruleset, returning the names of its
+// rules, by position, and the problems found in it.
+func validate(ruleFlags *ruleFlags, schemaCheck bool) ([]string, []cli.Diagnostic) {
+	ruleJSON, err := ruleFlags.readRules()
+	if err != nil {
+		return nil, cli.ErrorDiagnostics("read-failed", err)
+	}
+	ruleNames := preprocessor.RuleNames(ruleJSON)
+	if schemaCheck {
+		if err := preprocessor.ValidateAgainstSchema(ruleJSON); err != nil {
+			return ruleNames, cli.ErrorDiagnostics("schema-violation", err)
+		}
+	}
+	ruleSet, err := ruleFlags.parseRules(ruleJSON)
+	if err != nil {
+		return ruleNames, cli.ErrorDiagnostics("invalid-ruleset", err)
+	}
+
+	// Rules lowered from state machines and escalations follow the others
+	for i := len(ruleNames); i < len(ruleSet); i++ {
+		ruleNames = append(ruleNames, ruleSet[i].Name)
+	}
+	return ruleNames, compileWarnings(ruleSet)
+}
+
+// printValidate writes the problems found by rex validate as text, followed
+// by a summary.
+func printValidate(w io.Writer, result cli.ValidateResult) {
+	errors, warnings := 0, 0
+	for _, diagnostic := range result.Diagnostics {
+		if diagnostic.Severity == cli.SeverityError {
+			errors++
+		} else {
+			warnings++
+		}
+		fmt.Fprintf(w, "%s: %s\n", diagnostic.Severity, diagnostic.Message)
+	}
+	valid := 0
+	for _, rule := range result.Rules {
+		if rule.Valid {
+			valid++
+		}
+	}
+	if errors == 0 && warnings == 0 {
+		fmt.Fprintf(w, "%d rules valid\n", valid)
+		return
+	}
+	fmt.Fprintf(w, "%d of %d rules valid, %d errors, %d warnings\n", valid, len(result.Rules), errors, warnings)
+}
@@ -1,35 +1,873 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"rgehrsitz/rex/extension"
+	"rgehrsitz/rex/internal/admin"
+	"rgehrsitz/rex/internal/audit"
+	"rgehrsitz/rex/internal/bundle"
+	"rgehrsitz/rex/internal/chaos"
+	"rgehrsitz/rex/internal/cli"
+	"rgehrsitz/rex/internal/factsource"
+	"rgehrsitz/rex/internal/rules"
 	"rgehrsitz/rex/internal/runtime"
+	"rgehrsitz/rex/internal/script"
+	"rgehrsitz/rex/internal/transport"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
+	adminAddr := flag.String("admin", "", "Serve the admin API and web dashboard on this address (e.g. :8080) and keep evaluating")
+	interval := flag.Duration("interval", time.Second, "Time between evaluation cycles when serving the admin API or reading from Redis or NATS")
+	factsFile := flag.String("facts", "", "Path to a JSON object of initial fact values")
+	jsonOutput := flag.Bool("json", false, "Write the result of the evaluation cycle to stdout as JSON")
+	actionTimeout := flag.Duration("actiontimeout", 0, "Maximum time an action handler may run; 0 means no limit")
+	breakerThreshold := flag.Int("breakerthreshold", 0, "Consecutive failures of an action handler type that trip its circuit breaker; 0 disables breakers")
+	breakerCooldown := flag.Duration("breakercooldown", 30*time.Second, "Time a tripped circuit breaker rejects actions before retrying")
+	auditPath := flag.String("audit", "", "Record evaluation cycles, rule firings and action outcomes in this SQLite database")
+	auditRetention := flag.Duration("auditretention", 7*24*time.Hour, "Delete audit records older than this; 0 keeps them forever")
+	metricsURL := flag.String("metricsurl", "", "Push metrics to this endpoint, e.g. an InfluxDB or Grafana Cloud write URL, and keep evaluating")
+	metricsFormat := flag.String("metricsformat", "influx", "Format of pushed metrics: influx (line protocol) or json")
+	metricsInterval := flag.Duration("metricsinterval", 10*time.Second, "Time between metrics pushes")
+	maxInstructions := flag.Int("maxinstructions", 0, "Refuse bytecode whose estimated worst-case instructions per cycle exceed this; 0 means no limit")
+	maxStackDepth := flag.Int("maxstackdepth", 0, "Refuse bytecode whose estimated maximum stack depth exceeds this; 0 means no limit")
+	plugins := flag.String("plugins", "", "Comma-separated Go plugins to load, contributing operators and action handlers")
+	redisAddr := flag.String("redis", "", "Read fact changes from the Redis server at this address and keep evaluating")
+	redisMode := flag.String("redismode", "stream", "How to read fact changes from Redis: stream or keyspace")
+	redisStreams := flag.String("redisstreams", "facts", "Comma-separated streams to read in stream mode")
+	redisGroup := flag.String("redisgroup", "", "Consumer group to read the streams through")
+	redisConsumer := flag.String("redisconsumer", "", "Consumer name within -redisgroup")
+	redisKeys := flag.String("rediskeys", "*", "Pattern of the keys to watch in keyspace mode")
+	redisCorrelation := flag.String("rediscorrelation", "", "Field of stream entries holding a correlation ID, which labels the log lines, audit records and actions of the cycle the entry triggers; by default every cycle gets a random ID")
+	redisPrefix := flag.String("redisprefix", "", "Prefix stripped from stream fields or keys to get fact names; others are ignored")
+	redisStore := flag.Bool("redisstore", false, "Keep the facts in Redis at -redis, in string keys named after them with -redisprefix, reading them every cycle and writing back the facts the rules change, so runtimes share them and they survive restarts; needs a single bytecode file")
+	natsAddr := flag.String("nats", "", "Read fact changes from, and publish actions to, the NATS server at this address, e.g. nats://localhost:4222, and keep evaluating")
+	natsSubjects := flag.String("natssubjects", "facts.>", "Comma-separated subjects to read fact changes from; a message sets the fact named after its subject to its payload, or deletes it if the payload is empty; empty reads none")
+	natsPrefix := flag.String("natsprefix", "facts.", "Prefix stripped from subjects to get fact names; others are ignored")
+	natsCA := flag.String("natsca", "", "Connect to NATS over TLS, trusting the CA certificates in this PEM file; tls:// addresses and servers requiring TLS use the system's roots otherwise")
+	natsCert := flag.String("natscert", "", "Connect to NATS over TLS, presenting the client certificate in this PEM file; needs -natskey")
+	natsKey := flag.String("natskey", "", "Path to the PEM private key of -natscert")
+	natsActions := flag.String("natsactions", "", "Comma-separated action types to publish to NATS as JSON instead of performing them")
+	messagesFile := flag.String("messages", "", "Path to a JSON file routing the messages of sendMessage actions to stdout, webhook or MQTT sinks by target; without it they are logged")
+	mqttCA := flag.String("mqttca", "", "Trust the CA certificates in this PEM file instead of the system's for MQTT sinks connecting to mqtts://, ssl:// or tls:// brokers")
+	mqttCert := flag.String("mqttcert", "", "Present the client certificate in this PEM file to the brokers of MQTT sinks connecting over TLS; needs -mqttkey")
+	mqttKey := flag.String("mqttkey", "", "Path to the PEM private key of -mqttcert")
+	natsActionSubject := flag.String("natsactionsubject", transport.DefaultNATSActionSubject, "Subject actions are published to; {type} and {target} stand for the type and target of the action")
+	stream := flag.Bool("stream", false, "Evaluate the rules reading the fact changes from Redis or NATS as soon as they arrive, instead of every rule every -interval; needs -redis or -nats and a single bytecode file")
+	partitionKey := flag.String("partitionkey", "", "Evaluate the rules separately for every entity identified by this fact, e.g. deviceId, as its updates arrive; needs -redis in stream mode")
+	collationLocale := flag.String("collation", "", "Compare strings with the Unicode collation rules of this locale, e.g. fr or und for the root collation, instead of byte by byte")
+	collationStrength := flag.String("collationstrength", "tertiary", "Differences -collation takes into account: tertiary (all), secondary (ignore case and width) or primary (also ignore diacritics)")
+	scriptTimeout := flag.Duration("scripttimeout", script.DefaultLimits.Timeout, "Time a script condition or action may run before it fails")
+	scriptStack := flag.Int("scriptstack", script.DefaultLimits.StackSize, "Number of values the stack of a script holds")
+	scriptDepth := flag.Int("scriptdepth", script.DefaultLimits.CallDepth, "How deeply the function calls of a script may nest")
+	chaosSeed := flag.Int64("chaosseed", 1, "Seed of the disturbances injected by the -chaos flags; the same seed repeats the same disturbances")
+	chaosDelay := flag.Float64("chaosdelay", 0, "Testing: share of fact updates to apply in a later cycle, between 0 and 1")
+	chaosDuplicate := flag.Float64("chaosduplicate", 0, "Testing: share of fact updates to apply again in a later cycle, between 0 and 1")
+	chaosReorder := flag.Float64("chaosreorder", 0, "Testing: share of cycles whose fact updates are applied in random order, between 0 and 1")
+	chaosMaxDelay := flag.Int("chaosmaxdelay", 3, "Testing: maximum number of cycles -chaosdelay and -chaosduplicate hold an update back")
+	chaosActionFailure := flag.Float64("chaosactionfailure", 0, "Testing: share of action handler invocations to fail, between 0 and 1")
+	factSchema := flag.String("factschema", "off", "What to do with fact updates whose type doesn't match the fact schema compiled into the bytecode: off (accept them), reject or coerce (convert them where possible, e.g. \"30\" for an int fact)")
+	degrade := flag.Bool("degrade", false, "Keep evaluating while Redis is down: use the last-known facts for up to -maxstaleness, then pause the rules reading them until Redis is back")
+	maxStaleness := flag.Duration("maxstaleness", 5*time.Minute, "How long -degrade keeps using the last-known facts of a fact source that is down")
+	queueActions := flag.Int("queueactions", 0, "Actions to queue per handler type while its circuit breaker is open, performed once it admits actions again; 0 fails them")
+	suppressionsFile := flag.String("suppressions", "", "Path to a JSON file of maintenance suppression windows, during which rules are evaluated and audited but the actions on the targets they cover are withheld")
+	bundlePath := flag.String("bundle", "", "Load the bytecode and runtime configuration from this signed bundle, written by rex bundle create, instead of bytecode files; flags given on the command line override the bundle's")
+	bundleKey := flag.String("bundlekey", "", "Path to the public key -bundle must be signed with")
+	maxChainDepth := flag.Int("maxchaindepth", 0, "Evaluate the rules consuming a fact again in the same cycle when a rule changes it, up to this many re-evaluations deep; 0 disables forward chaining")
+	maxChainIterations := flag.Int("maxchainiterations", 1000, "Maximum rule re-evaluations forward chaining may run in a cycle; 0 only limits their depth")
+	skipFailingRules := flag.Bool("skipfailingrules", false, "Log rules that fail and go on with the next rule instead of aborting the cycle; needs rule markers")
+	watch := flag.Bool("watch", false, "Keep evaluating and reload the bytecode file when it changes, checking every -interval; the facts are kept, and so is the previous bytecode if the new one is invalid. Sending the runtime SIGHUP reloads it too. Needs a single bytecode file")
+	flag.Parse()
+
+	// fail reports an error starting the runtime and exits with status 1,
+	// writing a failed run result with -json, as a failed cycle does
+	fail := func(code, message string, err error) {
+		log.Error().Err(err).Msg(message)
+		if *jsonOutput {
+			if err != nil {
+				err = fmt.Errorf("%s: %w", message, err)
+			} else {
+				err = errors.New(message)
+			}
+			result := cli.RunResult{SchemaVersion: cli.SchemaVersion, FiredRules: []int{}, Diagnostics: []cli.Diagnostic{cli.ErrorDiagnostic(code, err)}}
+			if err := cli.WriteJSON(os.Stdout, result); err != nil {
+				log.Error().Err(err).Msg("Failed to write run result")
+			}
+		}
+		os.Exit(1)
+	}
+
+	// The bundle's flags apply before any flag is used
+	var loadedBundle *bundle.Bundle
+	if *bundlePath != "" {
+		var err error
+		if loadedBundle, err = loadBundle(*bundlePath, *bundleKey); err != nil {
+			fail("invalid-bundle", "Error loading bundle", err)
+		}
+	}
+
+	if err := extension.LoadPlugins(extension.SplitPaths(*plugins)...); err != nil {
+		fail("invalid-config", "Error loading plugins", err)
+	}
+
+	// Connect to NATS before any cycle, so that the actions of the first are
+	// published too
+	var natsConn *transport.NATSConn
+	if *natsAddr != "" {
+		var tlsConfig *tls.Config
+		if *natsCA != "" || *natsCert != "" || *natsKey != "" {
+			var err error
+			if tlsConfig, err = transport.LoadTLSConfig(*natsCA, *natsCert, *natsKey); err != nil {
+				fail("invalid-config", "Invalid NATS TLS settings", err)
+			}
+		}
+		var err error
+		natsConn, err = transport.DialNATS(*natsAddr, transport.NATSOptions{
+			Name: "rex runtime",
+			// Credentials come from the environment to keep them out of
+			// process listings
+			Username: os.Getenv("REX_NATS_USERNAME"),
+			Password: os.Getenv("REX_NATS_PASSWORD"),
+			Token:    os.Getenv("REX_NATS_TOKEN"),
+			TLS:      tlsConfig,
+			// Fact changes and actions are lost while NATS is unreachable,
+			// and the rules go on with the last-known facts
+			MaxReconnects: -1,
+			Disconnected: func(err error) {
+				log.Warn().Err(err).Msg("NATS connection lost, reconnecting")
+			},
+			Reconnected: func() {
+				log.Info().Str("Address", *natsAddr).Msg("Reconnected to NATS")
+			},
+		})
+		if err != nil {
+			fail("connect-failed", "Error connecting to NATS", err)
+		}
+		defer natsConn.Close()
+		if err := registerNATSPublisher(natsConn, *natsActionSubject, *natsActions); err != nil {
+			fail("invalid-config", "Invalid NATS action publishing", err)
+		}
+	} else if *natsActions != "" {
+		fail("invalid-config", "-natsactions needs -nats", nil)
+	}
+	if *messagesFile != "" {
+		var tlsConfig *tls.Config
+		if *mqttCA != "" || *mqttCert != "" || *mqttKey != "" {
+			var err error
+			if tlsConfig, err = transport.LoadTLSConfig(*mqttCA, *mqttCert, *mqttKey); err != nil {
+				fail("invalid-config", "Invalid MQTT TLS settings", err)
+			}
+		}
+		sinks, err := registerMessageSinks(*messagesFile, tlsConfig)
+		if err != nil {
+			fail("invalid-config", "Invalid message sinks", err)
+		}
+		defer sinks.Close()
+	}
+	if types := runtime.ActionHandlerTypes(); len(types) > 0 {
+		log.Info().Strs("Types", types).Msg("Registered action handlers")
+	}
+
+	strength, err := runtime.ParseCollationStrength(*collationStrength)
+	if err != nil {
+		fail("invalid-config", "Invalid collation", err)
+	}
+	collation := runtime.Collation{Locale: *collationLocale, Strength: strength}
+	if err := collation.Validate(); err != nil {
+		fail("invalid-config", "Invalid collation", err)
+	}
+
+	scriptLimits := script.Limits{Timeout: *scriptTimeout, StackSize: *scriptStack, CallDepth: *scriptDepth}
+	if err := scriptLimits.Validate(); err != nil {
+		fail("invalid-config", "Invalid script limits", err)
+	}
+
+	schemaMode, err := runtime.ParseSchemaMode(*factSchema)
+	if err != nil {
+		fail("invalid-config", "Invalid fact schema mode", err)
+	}
+
+	var sources map[string][]string
+	if *degrade {
+		if *redisAddr == "" || *partitionKey != "" {
+			fail("invalid-config", "-degrade needs -redis and can't be combined with -partitionkey", nil)
+		}
+		sources = map[string][]string{redisSourceName: nil} // Redis provides every fact
+	}
+	degradation := runtime.DegradationPolicy{Sources: sources, MaxStaleness: *maxStaleness, QueueSize: *queueActions}
+	if err := degradation.Validate(); err != nil {
+		fail("invalid-config", "Invalid degradation policy", err)
+	}
+
+	var suppressions runtime.SuppressionConfig
+	if loadedBundle != nil && loadedBundle.Config != nil && loadedBundle.Config.Suppressions != nil && *suppressionsFile == "" {
+		suppressions = *loadedBundle.Config.Suppressions // Validated by bundle.Read
+	} else if *suppressionsFile != "" {
+		suppressionsJSON, err := os.ReadFile(*suppressionsFile)
+		if err != nil {
+			fail("read-failed", "Error reading suppressions file", err)
+		}
+		if err := json.Unmarshal(suppressionsJSON, &suppressions); err != nil {
+			fail("invalid-config", "Error parsing suppressions file", err)
+		}
+		if err := suppressions.Validate(); err != nil {
+			fail("invalid-config", "Invalid suppression windows", err)
+		}
+	}
+
+	var monkey *chaos.Monkey
+	if *chaosDelay > 0 || *chaosDuplicate > 0 || *chaosReorder > 0 || *chaosActionFailure > 0 {
+		monkey, err = chaos.New(chaos.Config{
+			Seed:              *chaosSeed,
+			DelayRate:         *chaosDelay,
+			DuplicateRate:     *chaosDuplicate,
+			ReorderRate:       *chaosReorder,
+			MaxDelay:          *chaosMaxDelay,
+			ActionFailureRate: *chaosActionFailure,
+		})
+		if err != nil {
+			fail("invalid-config", "Invalid chaos testing settings", err)
+		}
+		log.Warn().Int64("Seed", *chaosSeed).Msg("Chaos testing: injecting disturbances into fact updates and actions")
+	}
+
 	// Check if a file path is provided as an argument
-	if len(os.Args) < 2 {
-		log.Error().Msg("Usage: runtime <bytecode_file>")
-		return
+	if loadedBundle != nil && flag.NArg() > 0 {
+		fail("invalid-config", "-bundle can't be combined with bytecode files", nil)
+	}
+	if loadedBundle == nil && flag.NArg() < 1 {
+		fail("invalid-config", "Usage: runtime [-admin addr] [-redis addr] [-nats addr] [-metricsurl url] [-interval duration] [-facts file] [-json] [options] <bytecode_file>... | -bundle file -bundlekey file", nil)
+	}
+	if flag.NArg() > 1 && (*partitionKey != "" || *auditPath != "") {
+		fail("invalid-config", "-partitionkey and -audit take a single bytecode file", nil)
 	}
 
 	// Read the bytecode file
-	bytecodeFilePath := os.Args[1]
-	bytecodeBytes, err := os.ReadFile(bytecodeFilePath)
+	bytecodeFilePath := flag.Arg(0)
+	var bytecodeBytes []byte
+	if loadedBundle != nil {
+		bytecodeFilePath, bytecodeBytes = *bundlePath, loadedBundle.Bytecode
+	} else if bytecodeBytes, err = os.ReadFile(bytecodeFilePath); err != nil {
+		fail("read-failed", "Error reading bytecode file", err)
+	}
+
+	// Create a new VM instance, or with several bytecode files a composition
+	// running them in the order given against a shared fact store
+	limits := runtime.Limits{MaxInstructions: *maxInstructions, MaxStackDepth: *maxStackDepth}
+	var vm *runtime.VM
+	var composition *runtime.Composition
+	if flag.NArg() <= 1 {
+		vm = runtime.NewVM(bytecodeBytes)
+		if err := vm.DecodeError(); err != nil {
+			fail("invalid-bytecode", "Error loading bytecode", fmt.Errorf("%s: %w", bytecodeFilePath, err))
+		}
+		if err := vm.CheckLimits(limits); err != nil {
+			fail("invalid-bytecode", "Refusing to load bytecode", err)
+		}
+		if _, ok := vm.Schema(); !ok && schemaMode != runtime.SchemaOff {
+			log.Warn().Msg("Bytecode has no fact schema, accepting every fact value")
+		}
+		logProvenance(vm, bytecodeFilePath)
+	} else {
+		composition = runtime.NewComposition()
+		for _, path := range flag.Args() {
+			image, err := os.ReadFile(path)
+			if err != nil {
+				fail("read-failed", "Error reading bytecode file", err)
+			}
+			rulesetVM, err := composition.Add(rulesetName(path), image)
+			if err != nil {
+				fail("invalid-bytecode", "Error loading ruleset", fmt.Errorf("%s: %w", path, err))
+			}
+			if err := rulesetVM.CheckLimits(limits); err != nil {
+				fail("invalid-bytecode", "Refusing to load bytecode", fmt.Errorf("%s: %w", path, err))
+			}
+			if _, ok := rulesetVM.Schema(); !ok && schemaMode != runtime.SchemaOff {
+				log.Warn().Str("File", path).Msg("Bytecode has no fact schema, accepting every fact value")
+			}
+			logProvenance(rulesetVM, path)
+		}
+		log.Info().Strs("Rulesets", composition.Rulesets()).Msg("Running rulesets in order")
+	}
+
+	var facts map[string]interface{}
+	if *factsFile != "" {
+		if facts, err = cli.ReadFacts(*factsFile); err != nil {
+			fail(cli.FactsErrorCode(err), "Error reading facts file", err)
+		}
+	}
+	configure := func(vm *runtime.VM) {
+		vm.SetActionPolicy(runtime.ActionPolicy{
+			Timeout:          *actionTimeout,
+			FailureThreshold: *breakerThreshold,
+			Cooldown:         *breakerCooldown,
+		})
+		vm.SetCollation(collation)           // Validated above
+		vm.SetScriptLimits(scriptLimits)     // Validated above
+		vm.SetSchemaMode(schemaMode)         // Parsed above
+		vm.SetDegradationPolicy(degradation) // Validated above
+		vm.SetSuppressions(suppressions)     // Validated above
+		vm.SetMaxChainDepth(*maxChainDepth)
+		vm.SetMaxChainIterations(*maxChainIterations)
+		if monkey != nil {
+			monkey.Attach(vm)
+		}
+		if *skipFailingRules {
+			vm.OnRuleError(func(rule int, err error) error {
+				log.Warn().Err(err).Int("Rule", rule).Msg("Rule failed, skipping it")
+				return nil
+			})
+		}
+	}
+	var engine evaluator = vm
+	if composition != nil {
+		for _, name := range composition.Rulesets() {
+			configure(composition.VM(name))
+		}
+		engine = composition
+	} else {
+		configure(vm)
+	}
+	if *redisStore {
+		if *redisAddr == "" || composition != nil || *partitionKey != "" {
+			fail("invalid-config", "-redisstore needs -redis and a single bytecode file, and can't be combined with -partitionkey", nil)
+		}
+		client := redis.NewClient(&redis.Options{Addr: *redisAddr})
+		if err := vm.SetFactStore(runtime.NewRedisFactStore(client, *redisPrefix)); err != nil {
+			fail("connect-failed", "Error loading facts from Redis", err)
+		}
+	}
+	ingestFacts(engine, facts)
+
+	if *partitionKey != "" && (*redisAddr == "" || *natsAddr != "" || *adminAddr != "" || *metricsURL != "" || *auditPath != "" || *jsonOutput) {
+		fail("invalid-config", "-partitionkey needs -redis and can't be combined with -nats, -admin, -metricsurl, -audit or -json", nil)
+	}
+
+	if *stream && ((*redisAddr == "" && *natsAddr == "") || composition != nil || *partitionKey != "" || *jsonOutput || monkey != nil) {
+		fail("invalid-config", "-stream needs -redis or -nats and a single bytecode file, and can't be combined with -partitionkey, -json or the -chaos flags", nil)
+	}
+
+	if *watch && (composition != nil || loadedBundle != nil || *partitionKey != "" || *stream) {
+		fail("invalid-config", "-watch needs a single bytecode file, and can't be combined with -bundle, -partitionkey or -stream", nil)
+	}
+
+	if *auditPath != "" {
+		store, err := audit.Open(*auditPath)
+		if err != nil {
+			fail("audit-failed", "Error opening audit database", err)
+		}
+		defer store.Close()
+		audit.NewRecorder(vm, store, *auditRetention)
+	}
+
+	if format := admin.ExportFormat(*metricsFormat); format != admin.ExportInflux && format != admin.ExportJSON {
+		fail("invalid-config", "Invalid metrics format", fmt.Errorf("unknown format %q", *metricsFormat))
+	}
+
+	longRunning := *adminAddr != "" || *redisAddr != "" || *natsAddr != "" || *metricsURL != "" || *watch
+	if !longRunning && *jsonOutput {
+		result := cli.RunResult{SchemaVersion: cli.SchemaVersion, FiredRules: []int{}, Diagnostics: []cli.Diagnostic{}}
+		if composition != nil {
+			// The rules of each ruleset are numbered from 0, so the fired
+			// rules are listed per ruleset
+			result.Rulesets = make([]cli.RulesetResult, len(composition.Rulesets()))
+			for i, name := range composition.Rulesets() {
+				ruleset := &result.Rulesets[i]
+				*ruleset = cli.RulesetResult{Name: name, FiredRules: []int{}}
+				composition.VM(name).OnAfterRule(func(rule int, fired bool) {
+					if fired {
+						ruleset.FiredRules = append(ruleset.FiredRules, rule)
+					}
+				})
+			}
+		} else {
+			vm.OnAfterRule(func(rule int, fired bool) {
+				if fired {
+					result.FiredRules = append(result.FiredRules, rule)
+				}
+			})
+		}
+		if err := engine.Run(); err != nil {
+			result.Diagnostics = append(result.Diagnostics, cli.ErrorDiagnostic("run-failed", err))
+		}
+		result.Success = len(result.Diagnostics) == 0
+		result.Facts = engine.Facts()
+		if err := cli.WriteJSON(os.Stdout, result); err != nil {
+			log.Error().Err(err).Msg("Failed to write run result")
+		}
+		if !result.Success {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !longRunning {
+		err = engine.Run()
+		if err != nil {
+			log.Error().Err(err).Msg("Error running bytecode")
+			os.Exit(1)
+		}
+
+		log.Info().Msg("Bytecode execution completed successfully.")
+		return
+	}
+
+	// Keep evaluating, applying the fact changes read from Redis and NATS
+	// before each cycle and serving the statistics collected along the way
+	var updates chan factsource.Update
+	if *redisAddr != "" || *natsAddr != "" {
+		updates = make(chan factsource.Update, 1000)
+	}
+	if *redisAddr != "" {
+		client := redis.NewClient(&redis.Options{Addr: *redisAddr})
+		source, err := factsource.NewRedisSource(client, factsource.RedisConfig{
+			Mode:             factsource.RedisMode(*redisMode),
+			Streams:          strings.Split(*redisStreams, ","),
+			Group:            *redisGroup,
+			Consumer:         *redisConsumer,
+			KeyPattern:       *redisKeys,
+			Mapping:          factsource.Mapping{Prefix: *redisPrefix},
+			PartitionKey:     *partitionKey,
+			CorrelationField: *redisCorrelation,
+		})
+		if err != nil {
+			fail("invalid-config", "Invalid Redis fact source", err)
+		}
+		go func() {
+			log.Info().Str("Address", *redisAddr).Str("Mode", *redisMode).Msg("Reading fact changes from Redis")
+			for {
+				err := source.Run(context.Background(), updates)
+				if !*degrade {
+					log.Fatal().Err(err).Msg("Redis fact source failed")
+				}
+				// Updates made while Redis is down are lost; the rules go on
+				// with the last-known facts until it answers again
+				for _, vm := range engineVMs(vm, composition) {
+					vm.SourceDown(redisSourceName, err)
+				}
+				waitForRedis(client)
+				for _, vm := range engineVMs(vm, composition) {
+					vm.SourceUp(redisSourceName)
+				}
+			}
+		}()
+	}
+	if *natsAddr != "" && *natsSubjects != "" {
+		source, err := transport.NewNATSSource(natsConn, transport.NATSSourceConfig{
+			Subjects: strings.Split(*natsSubjects, ","),
+			Mapping:  factsource.Mapping{Prefix: *natsPrefix},
+		})
+		if err != nil {
+			fail("invalid-config", "Invalid NATS fact source", err)
+		}
+		go func() {
+			log.Info().Str("Address", *natsAddr).Str("Subjects", *natsSubjects).Msg("Reading fact changes from NATS")
+			// The connection reconnects until it is closed, so the source
+			// only stops with the runtime
+			if err := source.Run(context.Background(), updates); err != nil {
+				log.Error().Err(err).Msg("NATS fact source stopped")
+			}
+		}()
+	}
+
+	if *adminAddr != "" || *metricsURL != "" {
+		var monitor *admin.Monitor
+		if composition != nil {
+			monitor = admin.NewCompositionMonitor(composition)
+		} else {
+			monitor = admin.NewMonitor(vm)
+		}
+		if *adminAddr != "" {
+			go func() {
+				log.Info().Str("Address", *adminAddr).Msg("Serving admin API and dashboard")
+				if err := http.ListenAndServe(*adminAddr, admin.NewHandler(monitor)); err != nil {
+					log.Fatal().Err(err).Msg("Admin server failed")
+				}
+			}()
+		}
+		if *metricsURL != "" {
+			// Credentials come from the environment to keep them out of
+			// process listings
+			exporter := &admin.Exporter{
+				URL:      *metricsURL,
+				Format:   admin.ExportFormat(*metricsFormat),
+				Interval: *metricsInterval,
+				Username: os.Getenv("REX_METRICS_USERNAME"),
+				Password: os.Getenv("REX_METRICS_PASSWORD"),
+			}
+			log.Info().Str("URL", *metricsURL).Str("Format", *metricsFormat).Msg("Pushing metrics")
+			go exporter.Run(context.Background(), monitor)
+		}
+	}
+
+	if *partitionKey != "" {
+		// Every entity gets its own VM, set up like the one above, and is
+		// evaluated in the cycles after its facts change
+		partitions := runtime.NewPartitions(bytecodeBytes, *partitionKey, func(entity string, vm *runtime.VM) {
+			configure(vm)
+			ingestFacts(vm, facts)
+			log.Info().Str("Entity", entity).Msg("Evaluating rules for new entity")
+		})
+		for range time.Tick(*interval) {
+			if err := partitions.Run(applyPartitionedUpdates(partitions, receiveUpdates(updates, monkey))...); err != nil {
+				log.Error().Err(err).Msg("Error running bytecode")
+			}
+		}
+	}
+
+	if *stream {
+		// Every batch of fact changes is evaluated as it arrives, by the
+		// rules reading the facts changed
+		log.Info().Msg("Evaluating fact changes as they arrive")
+		if err := vm.Stream(context.Background(), streamUpdates(updates), nil); err != nil {
+			log.Error().Err(err).Msg("Fact stream ended")
+		}
+		return
+	}
+
+	// A single bytecode file is reloaded on SIGHUP and, with -watch, when it
+	// changes, between cycles
+	var reloads chan os.Signal
+	var watcher *fileWatcher
+	if composition == nil && loadedBundle == nil {
+		reloads = make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+		if *watch {
+			watcher = newFileWatcher(bytecodeFilePath)
+			log.Info().Str("File", bytecodeFilePath).Msg("Reloading the bytecode file when it changes")
+		}
+	}
+	ticks := time.Tick(*interval)
+	for {
+		select {
+		case <-reloads:
+			reloadBytecode(vm, bytecodeFilePath, limits)
+			continue
+		case <-ticks:
+		}
+		if watcher != nil && watcher.changed() {
+			reloadBytecode(vm, bytecodeFilePath, limits)
+		}
+		applyUpdates(engine, receiveUpdates(updates, monkey))
+		if err := engine.Run(); err != nil {
+			log.Error().Err(err).Str("CorrelationID", engine.CorrelationID()).Msg("Error running bytecode")
+		}
+	}
+}
+
+// reloadBytecode replaces the program of the VM with the bytecode file at
+// path, keeping the previous one if the file can't be read or the bytecode
+// is invalid or over the limits.
+func reloadBytecode(vm *runtime.VM, path string, limits runtime.Limits) {
+	image, err := os.ReadFile(path)
 	if err != nil {
-		log.Error().Err(err).Msg("Error reading bytecode file")
+		log.Error().Err(err).Str("File", path).Msg("Error reading bytecode file, keeping the previous bytecode")
 		return
 	}
+	if err := vm.Reload(image, func(next *runtime.VM) error { return next.CheckLimits(limits) }); err != nil {
+		log.Error().Err(err).Str("File", path).Msg("Refusing to reload bytecode, keeping the previous bytecode")
+		return
+	}
+	log.Info().Str("File", path).Int("Rules", len(vm.Rules())).Msg("Reloaded bytecode")
+	logProvenance(vm, path)
+}
+
+// fileWatcher notices changes to a file by its size and modification time.
+type fileWatcher struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func newFileWatcher(path string) *fileWatcher {
+	w := &fileWatcher{path: path}
+	w.changed()
+	return w
+}
+
+// changed reports whether the file changed since the last call. A file that
+// can't be read is left for the next call.
+func (w *fileWatcher) changed() bool {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		log.Warn().Err(err).Str("File", w.path).Msg("Can't check the bytecode file for changes")
+		return false
+	}
+	if info.Size() == w.size && info.ModTime().Equal(w.modTime) {
+		return false
+	}
+	w.size, w.modTime = info.Size(), info.ModTime()
+	return true
+}
+
+// evaluator runs evaluation cycles against a fact store: a single VM, or a
+// composition of rulesets.
+type evaluator interface {
+	Run() error
+	SetCorrelationID(id string)
+	CorrelationID() string
+	IngestFact(name string, value interface{}) error
+	DeleteFact(name string)
+	Facts() map[string]interface{}
+}
+
+// redisSourceName names the Redis fact source in the degradation policy.
+const redisSourceName = "redis"
+
+// engineVMs returns the VM evaluating the rules, or the VMs of the rulesets of
+// a composition.
+func engineVMs(vm *runtime.VM, composition *runtime.Composition) []*runtime.VM {
+	if composition == nil {
+		return []*runtime.VM{vm}
+	}
+	var vms []*runtime.VM
+	for _, name := range composition.Rulesets() {
+		vms = append(vms, composition.VM(name))
+	}
+	return vms
+}
 
-	// Create a new VM instance and run the bytecode
-	vm := runtime.NewVM(bytecodeBytes)
-	err = vm.Run()
+// waitForRedis pings Redis until it answers, backing off from one second to
+// half a minute between attempts.
+func waitForRedis(client *redis.Client) {
+	backoff := time.Second
+	for {
+		time.Sleep(backoff)
+		err := client.Ping(context.Background()).Err()
+		if err == nil {
+			return
+		}
+		log.Debug().Err(err).Dur("Backoff", backoff).Msg("Redis still unreachable")
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// registerNATSPublisher registers a handler publishing actions to NATS for
+// each of the comma-separated action types.
+func registerNATSPublisher(conn *transport.NATSConn, subject, actionTypes string) error {
+	if actionTypes == "" {
+		return nil
+	}
+	publisher, err := transport.NewNATSPublisher(conn, subject)
 	if err != nil {
-		log.Error().Err(err).Msg("Error running bytecode")
+		return err
+	}
+	for _, actionType := range strings.Split(actionTypes, ",") {
+		if _, ok := runtime.LookupActionHandler(actionType); ok {
+			return fmt.Errorf("action type %s already has a handler", actionType)
+		}
+		runtime.RegisterActionHandler(actionType, publisher.Handle)
+	}
+	log.Info().Str("Types", actionTypes).Str("Subject", subject).Msg("Publishing actions to NATS")
+	return nil
+}
+
+// registerMessageSinks registers a handler delivering the messages of
+// sendMessage actions to the sinks configured in a file. The MQTT sinks
+// connecting over TLS use tlsConfig.
+func registerMessageSinks(path string, tlsConfig *tls.Config) (*transport.MessageSinks, error) {
+	configJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config transport.MessageConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if _, ok := runtime.LookupActionHandler(rules.ActionSendMessage); ok {
+		return nil, fmt.Errorf("action type %s already has a handler", rules.ActionSendMessage)
+	}
+	sinks := transport.NewMessageSinks(config, transport.MQTTOptions{
+		ClientID: "rex-runtime",
+		// Credentials come from the environment to keep them out of process
+		// listings
+		Username: os.Getenv("REX_MQTT_USERNAME"),
+		Password: os.Getenv("REX_MQTT_PASSWORD"),
+		TLS:      tlsConfig,
+	})
+	runtime.RegisterActionHandler(rules.ActionSendMessage, sinks.Router.Handle)
+	log.Info().Int("Targets", len(config.Targets)).Bool("Default", config.Default != nil).Msg("Delivering messages to sinks")
+	return sinks, nil
+}
+
+// rulesetName names the ruleset of a bytecode file after the file, without
+// its extension.
+func rulesetName(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// receiveUpdates returns the fact updates received since the previous cycle,
+// disturbed by monkey when chaos testing.
+func receiveUpdates(updates <-chan factsource.Update, monkey *chaos.Monkey) []factsource.Update {
+	var received []factsource.Update
+	for {
+		select {
+		case update := <-updates:
+			received = append(received, update)
+		default:
+			if monkey != nil {
+				return monkey.Updates(received)
+			}
+			return received
+		}
+	}
+}
+
+// applyPartitionedUpdates applies fact updates to the VMs of their entities,
+// returning the entities updated. The cycle of an entity takes the first
+// correlation ID among its updates.
+func applyPartitionedUpdates(partitions *runtime.Partitions, updates []factsource.Update) []string {
+	var entities []string
+	updated := make(map[string]bool)
+	correlated := make(map[string]bool)
+	for _, update := range updates {
+		vm := partitions.VM(update.Entity)
+		if update.CorrelationID != "" && !correlated[update.Entity] {
+			correlated[update.Entity] = true
+			vm.SetCorrelationID(update.CorrelationID)
+		}
+		if update.Deleted {
+			vm.DeleteFact(update.Fact)
+		} else {
+			ingestFact(vm, update.Fact, update.Value)
+		}
+		if !updated[update.Entity] {
+			updated[update.Entity] = true
+			entities = append(entities, update.Entity)
+		}
+	}
+	return entities
+}
+
+// streamUpdates forwards the fact updates read from a fact source to a VM
+// streaming them.
+func streamUpdates(updates <-chan factsource.Update) <-chan runtime.FactUpdate {
+	streamed := make(chan runtime.FactUpdate, cap(updates))
+	go func() {
+		defer close(streamed)
+		for update := range updates {
+			streamed <- runtime.FactUpdate{
+				Fact:          update.Fact,
+				Value:         update.Value,
+				Deleted:       update.Deleted,
+				CorrelationID: update.CorrelationID,
+			}
+		}
+	}()
+	return streamed
+}
+
+// applyUpdates applies fact updates to the VM or composition. The next cycle
+// takes the first correlation ID among them.
+func applyUpdates(engine evaluator, updates []factsource.Update) {
+	correlated := false
+	for _, update := range updates {
+		if update.CorrelationID != "" && !correlated {
+			correlated = true
+			engine.SetCorrelationID(update.CorrelationID)
+		}
+		if update.Deleted {
+			engine.DeleteFact(update.Fact)
+		} else {
+			ingestFact(engine, update.Fact, update.Value)
+		}
+	}
+}
+
+// ingestFacts sets the initial facts.
+func ingestFacts(engine evaluator, facts map[string]interface{}) {
+	for name, value := range facts {
+		ingestFact(engine, name, value)
+	}
+}
+
+// ingestFact sets a fact, logging values refused by the fact schema.
+func ingestFact(engine evaluator, name string, value interface{}) {
+	if err := engine.IngestFact(name, value); err != nil {
+		log.Warn().Err(err).Str("Fact", name).Msg("Ignoring fact update")
+	}
+}
+
+// logProvenance logs the ruleset revision a bytecode file was compiled from.
+func logProvenance(vm *runtime.VM, path string) {
+	provenance, ok := vm.Provenance()
+	if !ok {
+		log.Info().Str("File", path).Msg("Bytecode doesn't name its ruleset revision")
 		return
 	}
+	log.Info().
+		Str("File", path).
+		Str("RulesetHash", provenance.ShortHash()).
+		Str("CompilerVersion", provenance.CompilerVersion).
+		Time("CompiledAt", provenance.CompiledAt).
+		Msg("Loaded ruleset")
+}
 
-	log.Info().Msg("Bytecode execution completed successfully.")
+// loadBundle reads a bundle, checking it is signed with the public key in
+// keyFile, and sets the runtime flags it configures, except those given on
+// the command line. The bundle's bytecode and configuration are only used
+// once its signature and hashes are verified.
+func loadBundle(path, keyFile string) (*bundle.Bundle, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("-bundle needs -bundlekey")
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := bundle.ParsePublicKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle key: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := bundle.Read(data, key)
+	if err != nil {
+		return nil, err
+	}
+	if b.Config == nil {
+		return b, nil
+	}
 
+	values := b.Config.FlagValues()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("bundle sets unknown flag -%s", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, name := range names {
+		if explicit[name] {
+			log.Info().Str("Flag", name).Msg("Command line overrides bundle flag")
+			continue
+		}
+		if err := flag.Set(name, values[name]); err != nil {
+			return nil, fmt.Errorf("bundle sets invalid -%s: %w", name, err)
+		}
+	}
+	return b, nil
 }
@@ -0,0 +1,322 @@
+// compiler/compiler.go
+
+// Package compiler embeds the rule compiler in other programs, so that they
+// can validate and compile rulesets without running the preprocessor:
+//
+//	ruleset, err := compiler.ParseRules(ruleJSON, compiler.Options{})
+//	if err != nil {
+//		return err // A *compiler.RulesetError listing every problem
+//	}
+//	if ruleset, err = compiler.Optimize(ruleset); err != nil {
+//		return err
+//	}
+//	compiled, err := compiler.Compile(ruleset, compiler.Options{})
+//
+// The preprocessor is built on this package, so bytecode compiled with the
+// same options is the same, sections included.
+package compiler
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"time"
+)
+
+// Types of parsed rules and of the problems found in them.
+type (
+	Rule                 = rules.Rule
+	RulesetError         = preprocessor.RulesetError
+	RuleError            = preprocessor.RuleError
+	SchemaError          = preprocessor.SchemaError
+	SchemaViolation      = preprocessor.SchemaViolation
+	DependencyCycle      = preprocessor.DependencyCycle
+	DependencyCycleError = preprocessor.DependencyCycleError
+	Elimination          = preprocessor.Elimination
+	LintOptions          = preprocessor.LintOptions
+	LintWarning          = preprocessor.LintWarning
+	Strictness           = preprocessor.Strictness
+	CodegenOptions       = bytecode.Options
+	Cost                 = bytecode.Cost
+	Provenance           = bytecode.Provenance
+)
+
+// Strictness levels; see the preprocessor's -strictness flag.
+const (
+	StrictnessStandard = preprocessor.StrictnessStandard
+	StrictnessBasic    = preprocessor.StrictnessBasic
+	StrictnessParanoid = preprocessor.StrictnessParanoid
+)
+
+// Code generation strategies and markers; see CodegenOptions.
+const (
+	ConditionModeJump    = bytecode.ConditionModeJump
+	ConditionModeBoolean = bytecode.ConditionModeBoolean
+	MarkerModeRules      = bytecode.MarkerModeRules
+	MarkerModeNone       = bytecode.MarkerModeNone
+	MarkerModeAll        = bytecode.MarkerModeAll
+)
+
+// Options are the options of the preprocessor's flags, with the same
+// defaults.
+type Options struct {
+	Strictness   Strictness
+	StrictFields bool // Reject unknown fields rather than keeping them as metadata, as -strictfields does
+	Scripts      bool // Allow script conditions and actions, as -scripts does
+
+	// Codegen are the options of the bytecode compiler. StrictNumeric is
+	// implied by StrictnessParanoid.
+	Codegen CodegenOptions
+
+	EmbedSource    bool // Embed the ruleset in the bytecode, as -embedsource does
+	CompressSource bool // Compress the embedded ruleset, as -compresssource does; implies EmbedSource
+
+	DependencyOrder bool // Run rules writing facts before the rules of equal priority reading them, as -dependencyorder does
+	RejectCycles    bool // Fail with a *DependencyCycleError on rules depending on each other, as -rejectcycles does
+
+	// EliminateDeadCode makes Optimize remove the rules that can never fire
+	// and the conditions that always or never hold, as -eliminatedead does.
+	// Inputs are the facts the host provides, as given with -inputs.
+	EliminateDeadCode bool
+	Inputs            []string
+}
+
+// parseOptions returns the options of the parser.
+func (o Options) parseOptions() preprocessor.ParseOptions {
+	options := preprocessor.ParseOptions{Mode: preprocessor.ParseModePermissive, Strictness: o.Strictness, Scripts: o.Scripts}
+	if o.StrictFields {
+		options.Mode = preprocessor.ParseModeStrict
+	}
+	return options
+}
+
+// Ruleset is a parsed and validated ruleset.
+type Ruleset struct {
+	Rules      []*Rule       // In the order they are written, or as optimized
+	Eliminated []Elimination // What Optimize removed with Options.EliminateDeadCode
+
+	options   Options
+	source    []byte
+	written   []*Rule // The rules as written, which the optimized ones stand for
+	optimized bool
+	context   *rules.RuleEngineContext
+}
+
+// Optimized reports whether the rules of the ruleset have been optimized.
+func (r *Ruleset) Optimized() bool {
+	return r.optimized
+}
+
+// ParseRules parses and validates a ruleset, written either as an array of
+// rules or as an object with rules, state machines, escalations and
+// read-only facts. Every rule is validated even if others are invalid; the
+// error is then a *RulesetError listing each problem with the rule, JSON
+// path, line and column it was found at.
+func ParseRules(rulesJSON []byte, options Options) (*Ruleset, error) {
+	context := rules.NewRuleEngineContext()
+	parsed, err := preprocessor.ParseAndValidateRulesWithOptions(rulesJSON, context, options.parseOptions())
+	if err != nil {
+		return nil, err
+	}
+	preprocessor.IndexFacts(parsed, context)
+	return &Ruleset{Rules: parsed, options: options, source: rulesJSON, written: parsed, context: context}, nil
+}
+
+// Validate checks a ruleset against the ruleset schema and then parses it,
+// without compiling it. A ruleset violating the schema is reported with a
+// *SchemaError listing every violation, including misspelled fields the
+// parser would keep as metadata.
+func Validate(rulesJSON []byte, options Options) error {
+	if err := preprocessor.ValidateAgainstSchema(rulesJSON); err != nil {
+		return err
+	}
+	_, err := ParseRules(rulesJSON, options)
+	return err
+}
+
+// Lint reports the suspicious but legal patterns of a ruleset, such as
+// redundant conditions, rules whose writes are always overwritten and rules
+// of equal priority writing different values to a fact, as rex lint does.
+// The rules are linted as written, even if the ruleset has been optimized.
+// LintOptions.Disabled takes the names of LintChecks.
+func Lint(ruleset *Ruleset, options LintOptions) ([]LintWarning, error) {
+	return preprocessor.Lint(ruleset.written, options)
+}
+
+// LintChecks lists the checks of Lint, by the names LintWarning.Check reports.
+var LintChecks = preprocessor.LintChecks
+
+// Optimize returns the ruleset with its rules optimized: conditions are
+// simplified and deduplicated and rules with the same conditions merged.
+// With Options.EliminateDeadCode, the rules that can never fire and the
+// conditions that always or never hold are removed first, and listed in
+// Eliminated. The ruleset passed is left as is.
+func Optimize(ruleset *Ruleset) (*Ruleset, error) {
+	if ruleset.optimized {
+		return ruleset, nil
+	}
+	live := preprocessor.CloneRules(ruleset.Rules)
+	var eliminated []Elimination
+	if ruleset.options.EliminateDeadCode {
+		live, eliminated = preprocessor.EliminateDeadCode(live, ruleset.context, ruleset.options.Inputs)
+	}
+	optimized, err := preprocessor.OptimizeRules(live, ruleset.context)
+	if err != nil {
+		return nil, fmt.Errorf("failed to optimize rules: %w", err)
+	}
+	return &Ruleset{
+		Rules:      optimized,
+		Eliminated: eliminated,
+		options:    ruleset.options,
+		source:     ruleset.source,
+		written:    ruleset.written,
+		optimized:  true,
+		context:    ruleset.context,
+	}, nil
+}
+
+// Bytecode is a compiled ruleset.
+type Bytecode struct {
+	Image      []byte // The bytecode, with its sections, as the preprocessor writes it
+	Cost       Cost   // Worst-case evaluation cost
+	Provenance Provenance
+}
+
+// Compile compiles a ruleset, optimized or not, to bytecode. The sections
+// the runtime and tools read, such as the fact table, fact schema and rule
+// names, are appended to the code. Rules the code generator can't handle
+// are reported as an error rather than a panic.
+func Compile(ruleset *Ruleset, options Options) (compiled *Bytecode, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			compiled, err = nil, fmt.Errorf("error compiling rules to bytecode: %v", r)
+		}
+	}()
+	codegen := options.Codegen
+	if options.Strictness == StrictnessParanoid {
+		codegen.StrictNumeric = true
+	}
+	if options.RejectCycles {
+		if cycles := preprocessor.FindDependencyCycles(ruleset.Rules); len(cycles) > 0 {
+			return nil, &DependencyCycleError{Cycles: cycles}
+		}
+	}
+	compiledRules := ruleset.Rules
+	if options.DependencyOrder {
+		compiledRules = preprocessor.OrderByDependencies(compiledRules)
+	}
+
+	context := ruleset.context
+	compiler := bytecode.NewCompilerWithOptions(context, codegen)
+	code, err := compiler.Compile(compiledRules)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling rules to bytecode: %w", err)
+	}
+
+	cost, err := bytecode.EstimateCost(code)
+	if err != nil {
+		return nil, fmt.Errorf("error estimating evaluation cost: %w", err)
+	}
+	costSection, err := bytecode.NewCostSection(cost)
+	if err != nil {
+		return nil, fmt.Errorf("error embedding evaluation cost: %w", err)
+	}
+	schemaSection, err := bytecode.NewSchemaSection(preprocessor.FactSchema(compiledRules))
+	if err != nil {
+		return nil, fmt.Errorf("error embedding fact schema: %w", err)
+	}
+	rulesetHash, err := bytecode.HashRuleset(ruleset.source)
+	if err != nil {
+		return nil, err
+	}
+	provenance := bytecode.Provenance{RulesetHash: rulesetHash, CompilerVersion: bytecode.CompilerVersion(), CompiledAt: time.Now().UTC()}
+	provenanceSection, err := bytecode.NewProvenanceSection(provenance)
+	if err != nil {
+		return nil, fmt.Errorf("error embedding provenance: %w", err)
+	}
+	factsSection, err := bytecode.NewFactTableSection(bytecode.NewFactTable(context.FactIndex))
+	if err != nil {
+		return nil, fmt.Errorf("error embedding fact table: %w", err)
+	}
+	sections := []bytecode.Section{bytecode.NewCompiledCodeSection(), costSection, schemaSection, provenanceSection, factsSection}
+
+	// Seed the state facts of state machines
+	if len(context.InitialFacts) > 0 {
+		section, err := bytecode.NewInitialFactsSection(context.InitialFacts)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding initial facts: %w", err)
+		}
+		sections = append(sections, section)
+	}
+
+	// Let the runtime refuse rule writes to read-only facts
+	if len(context.ReadOnlyFacts) > 0 {
+		section, err := bytecode.NewReadOnlyFactsSection(context.ReadOnlyFacts)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding read-only facts: %w", err)
+		}
+		sections = append(sections, section)
+	}
+
+	// Give the ERROR instructions their messages
+	if messages := compiler.Messages(); len(messages) > 0 {
+		section, err := bytecode.NewMessagesSection(messages)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding error messages: %w", err)
+		}
+		sections = append(sections, section)
+	}
+
+	// Give the webhook actions their requests
+	if webhooks := compiler.Webhooks(); len(webhooks) > 0 {
+		section, err := bytecode.NewWebhooksSection(webhooks)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding webhook requests: %w", err)
+		}
+		sections = append(sections, section)
+	}
+
+	// Give the delayed actions their delays
+	if delays := compiler.ActionDelays(); len(delays) > 0 {
+		section, err := bytecode.NewActionDelaysSection(delays)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding action delays: %w", err)
+		}
+		sections = append(sections, section)
+	}
+
+	// Index the rules by the facts they read, so that the runtime only
+	// evaluates the rules a changed fact affects
+	if readers := compiler.FactReaders(); len(readers) > 0 {
+		section, err := bytecode.NewFactReadersSection(readers)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding fact readers: %w", err)
+		}
+		sections = append(sections, section)
+	}
+
+	// Name the rules, so that the runtime can tell them apart
+	rulesSection, err := bytecode.NewRulesSection(preprocessor.RuleSymbols(ruleset.written, compiledRules))
+	if err != nil {
+		return nil, fmt.Errorf("error embedding rule names: %w", err)
+	}
+	sections = append(sections, rulesSection)
+
+	// Locate the rules, so that the runtime can run them one by one
+	directorySection, err := bytecode.NewRuleDirectorySection(compiler.RuleDirectory())
+	if err != nil {
+		return nil, fmt.Errorf("error embedding rule directory: %w", err)
+	}
+	sections = append(sections, directorySection)
+
+	// Embed the ruleset the bytecode was compiled from
+	if options.EmbedSource || options.CompressSource {
+		section, err := bytecode.NewSourceSection(ruleset.source, options.CompressSource)
+		if err != nil {
+			return nil, fmt.Errorf("error embedding rule source: %w", err)
+		}
+		sections = append(sections, section)
+	}
+	return &Bytecode{Image: bytecode.AppendSections(code, sections...), Cost: cost, Provenance: provenance}, nil
+}
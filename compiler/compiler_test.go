@@ -0,0 +1,329 @@
+package compiler
+
+import (
+	"context"
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fanRules = `[
+    {
+        "name": "fan",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    },
+    {
+        "name": "alarm",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["alarm"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "alarm", "value": true}]}
+    }
+]`
+
+func TestCompile(t *testing.T) {
+	ruleset, err := ParseRules([]byte(fanRules), Options{})
+	require.NoError(t, err)
+	assert.Len(t, ruleset.Rules, 2)
+	assert.False(t, ruleset.Optimized())
+
+	optimized, err := Optimize(ruleset)
+	require.NoError(t, err)
+	assert.True(t, optimized.Optimized())
+	assert.Len(t, optimized.Rules, 1, "the rules have the same conditions")
+	assert.Len(t, ruleset.Rules, 2, "the ruleset optimized is left as is")
+
+	compiled, err := Compile(optimized, Options{EmbedSource: true})
+	require.NoError(t, err)
+	assert.NotEmpty(t, compiled.Provenance.RulesetHash)
+	_, sections, err := bytecode.SplitSections(compiled.Image)
+	require.NoError(t, err)
+	schema, ok, err := bytecode.ReadSchema(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "int", schema["temperature"])
+	symbols, ok, err := bytecode.ReadRules(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, symbols, 1)
+	assert.Equal(t, []string{"alarm"}, symbols[0].Merged)
+	section, ok := bytecode.FindSection(sections, bytecode.SectionSource)
+	require.True(t, ok)
+	assert.Equal(t, fanRules, string(section.Data))
+
+	// A ruleset can be compiled without optimizing it
+	compiled, err = Compile(ruleset, Options{})
+	require.NoError(t, err)
+	_, sections, err = bytecode.SplitSections(compiled.Image)
+	require.NoError(t, err)
+	symbols, _, err = bytecode.ReadRules(sections)
+	require.NoError(t, err)
+	assert.Len(t, symbols, 2)
+}
+
+func TestParseRules_Errors(t *testing.T) {
+	_, err := ParseRules([]byte(`[
+    {"name": "a", "conditions": {}},
+    {"name": "b", "conditions": {"all": [{"fact": "t", "operator": "bogus", "value": 1}]}}
+]`), Options{})
+	var rulesetErr *RulesetError
+	require.ErrorAs(t, err, &rulesetErr)
+	require.Len(t, rulesetErr.Errors, 2)
+	assert.Equal(t, "rules[0].conditions", rulesetErr.Errors[0].Path)
+	assert.Equal(t, "rules[1].conditions.all[0]", rulesetErr.Errors[1].Path)
+
+	_, err = ParseRules([]byte(`[{"name": "a", "conditions": {"all": [{"fact": "t", "operator": "equal", "value": 1, "unit": "C"}]}}]`), Options{StrictFields: true})
+	assert.ErrorContains(t, err, `unknown field "unit"`)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate([]byte(fanRules), Options{}))
+
+	err := Validate([]byte(`[{"name": "a", "conditions": {"al": [{"fact": "t", "operator": "equal", "value": 1}]}}]`), Options{})
+	var schemaErr *SchemaError
+	require.ErrorAs(t, err, &schemaErr)
+	assert.Equal(t, "rules[0].conditions.al", schemaErr.Violations[0].Path)
+}
+
+func TestCompile_StringTooLong(t *testing.T) {
+	rulesJSON := fmt.Sprintf(`[{
+        "name": "greeting",
+        "consumedFacts": ["message"],
+        "producedFacts": ["greeted"],
+        "conditions": {"all": [{"fact": "message", "operator": "equal", "value": %q}]},
+        "event": {"actions": [{"type": "updateFact", "target": "greeted", "value": true}]}
+    }]`, strings.Repeat("x", 256))
+	ruleset, err := ParseRules([]byte(rulesJSON), Options{})
+	require.NoError(t, err)
+	_, err = Compile(ruleset, Options{})
+	assert.EqualError(t, err, "error compiling rules to bytecode: rule 'greeting': string constant of 256 bytes is longer than the 255 bytes LOAD_CONST_STRING holds")
+}
+
+func TestCompile_DelayedActions(t *testing.T) {
+	ruleset, err := ParseRules([]byte(`[{
+        "name": "lightsOff",
+        "consumedFacts": ["motion"],
+        "conditions": {"all": [{"fact": "motion", "operator": "equal", "value": false}]},
+        "event": {"actions": [
+            {"type": "logEvent", "target": "system", "value": "no motion"},
+            {"type": "switchLights", "target": "hall", "value": "off", "delay": "10m"}
+        ]}
+    }]`), Options{})
+	require.NoError(t, err)
+	compiled, err := Compile(ruleset, Options{})
+	require.NoError(t, err)
+	vm := runtime.NewVM(compiled.Image)
+	clock := runtime.NewTestClock(time.Unix(0, 0))
+	vm.SetClock(clock)
+	var switched []interface{}
+	vm.RegisterAction("switchLights", func(ctx context.Context, action runtime.Action) error {
+		switched = append(switched, action.Value)
+		return nil
+	})
+
+	vm.SetFact("motion", false)
+	require.NoError(t, vm.Run())
+	assert.Empty(t, switched)
+	clock.Advance(10 * time.Minute)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []interface{}{"off"}, switched)
+}
+
+func TestCompile_FactReaders(t *testing.T) {
+	ruleset, err := ParseRules([]byte(`[{
+        "name": "fan",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }, {
+        "name": "dehumidifier",
+        "consumedFacts": ["humidity", "temperature"],
+        "producedFacts": ["dehumidifier_status"],
+        "conditions": {"all": [
+            {"fact": "humidity", "operator": "greaterThan", "value": 60},
+            {"fact": "temperature", "operator": "greaterThan", "value": 15}
+        ]},
+        "event": {"actions": [{"type": "updateFact", "target": "dehumidifier_status", "value": true}]}
+    }]`), Options{})
+	require.NoError(t, err)
+	compiled, err := Compile(ruleset, Options{})
+	require.NoError(t, err)
+	_, sections, err := bytecode.SplitSections(compiled.Image)
+	require.NoError(t, err)
+	readers, ok, err := bytecode.ReadFactReaders(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, bytecode.FactReaders{"temperature": {0, 1}, "humidity": {1}}, readers)
+
+	vm := runtime.NewVM(compiled.Image)
+	vm.SetFacts(map[string]interface{}{"temperature": 35, "humidity": 70})
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) { evaluated = append(evaluated, rule) })
+	require.NoError(t, vm.RunAffected([]string{"humidity"}))
+	assert.Equal(t, []int{1}, evaluated)
+}
+
+func TestCompile_RuleDirectory(t *testing.T) {
+	ruleset, err := ParseRules([]byte(`[{
+        "name": "fan",
+        "priority": 5,
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }, {
+        "name": "dehumidifier",
+        "consumedFacts": ["humidity"],
+        "producedFacts": ["dehumidifier_status"],
+        "conditions": {"all": [{"fact": "humidity", "operator": "greaterThan", "value": 60}]},
+        "event": {"actions": [{"type": "updateFact", "target": "dehumidifier_status", "value": true}]}
+    }]`), Options{})
+	require.NoError(t, err)
+	compiled, err := Compile(ruleset, Options{})
+	require.NoError(t, err)
+	code, sections, err := bytecode.SplitSections(compiled.Image)
+	require.NoError(t, err)
+	directory, ok, err := bytecode.ReadRuleDirectory(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, directory, 2)
+	facts, _, err := bytecode.ReadFactTable(sections)
+	require.NoError(t, err)
+
+	assert.Equal(t, "fan", directory[0].Name)
+	assert.Equal(t, 5, directory[0].Priority)
+	assert.Equal(t, 0, directory[0].Offset)
+	assert.Equal(t, directory[0].Length, directory[1].Offset)
+	assert.Equal(t, bytecode.RULE_START, bytecode.Opcode(code[directory[1].Offset]))
+	assert.Equal(t, bytecode.RULE_END, bytecode.Opcode(code[directory[1].Offset+directory[1].Length-1]))
+	require.Len(t, directory[1].Facts, 1)
+	assert.Equal(t, "humidity", facts.Name(directory[1].Facts[0]))
+
+	// Converting the code relocates the directory, which the VM accepts
+	image, err := runtime.ConvertCompiledImage(compiled.Image)
+	require.NoError(t, err)
+	_, sections, err = bytecode.SplitSections(image)
+	require.NoError(t, err)
+	relocated, _, err := bytecode.ReadRuleDirectory(sections)
+	require.NoError(t, err)
+	assert.NotEqual(t, directory[1].Offset, relocated[1].Offset)
+	vm := runtime.NewVM(image)
+	vm.SetFacts(map[string]interface{}{"temperature": 20, "humidity": 70})
+	require.NoError(t, vm.RunRules([]int{1}))
+	status, _ := vm.GetFact("dehumidifier_status")
+	assert.Equal(t, true, status)
+}
+
+func TestCompile_Dependencies(t *testing.T) {
+	// The fan rule reads what the cooling rule declared after it writes
+	ruleset, err := ParseRules([]byte(`[{
+        "name": "fan",
+        "consumedFacts": ["ac_status"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "ac_status", "operator": "equal", "value": true}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }, {
+        "name": "cooling",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["ac_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "ac_status", "value": true}]}
+    }]`), Options{})
+	require.NoError(t, err)
+	run := func(options Options) *runtime.VM {
+		compiled, err := Compile(ruleset, options)
+		require.NoError(t, err)
+		vm := runtime.NewVM(compiled.Image)
+		vm.SetFacts(map[string]interface{}{"temperature": 35, "ac_status": false})
+		require.NoError(t, vm.Run())
+		return vm
+	}
+
+	fan, _ := run(Options{}).GetFact("fan_status")
+	assert.Nil(t, fan, "The fan rule sees the write in the next cycle")
+	fan, _ = run(Options{DependencyOrder: true}).GetFact("fan_status")
+	assert.Equal(t, true, fan)
+
+	_, err = Compile(ruleset, Options{RejectCycles: true})
+	require.NoError(t, err)
+	ruleset, err = ParseRules([]byte(`[{
+        "name": "fan",
+        "consumedFacts": ["ac_status"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "ac_status", "operator": "equal", "value": true}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }, {
+        "name": "cooling",
+        "consumedFacts": ["fan_status"],
+        "producedFacts": ["ac_status"],
+        "conditions": {"all": [{"fact": "fan_status", "operator": "equal", "value": false}]},
+        "event": {"actions": [{"type": "updateFact", "target": "ac_status", "value": true}]}
+    }]`), Options{})
+	require.NoError(t, err)
+	_, err = Compile(ruleset, Options{RejectCycles: true})
+	var cycleErr *DependencyCycleError
+	require.ErrorAs(t, err, &cycleErr)
+	assert.EqualError(t, err, "rules fan, cooling form a dependency cycle: fan -> fan_status -> cooling -> ac_status -> fan")
+}
+
+func TestOptimize_EliminateDeadCode(t *testing.T) {
+	ruleset, err := ParseRules([]byte(`[{
+        "name": "fan",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"any": [
+            {"fact": "temperature", "operator": "greaterThan", "value": 30},
+            {"fact": "temperature", "operator": "lessThanOrEqual", "value": 30}
+        ]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }, {
+        "name": "heater",
+        "consumedFacts": ["temprature"],
+        "producedFacts": ["heater_status"],
+        "conditions": {"all": [{"fact": "temprature", "operator": "lessThan", "value": 15}]},
+        "event": {"actions": [{"type": "updateFact", "target": "heater_status", "value": true}]}
+    }]`), Options{Strictness: StrictnessBasic, EliminateDeadCode: true, Inputs: []string{"temperature"}})
+	require.NoError(t, err)
+	optimized, err := Optimize(ruleset)
+	require.NoError(t, err)
+	require.Len(t, optimized.Rules, 1)
+	assert.Equal(t, []Elimination{
+		{Rule: "fan", Path: "conditions.any", Fact: "temperature", Reason: "it always holds: its conditions on 'temperature' cover every value"},
+		{Rule: "heater", Fact: "temprature", Reason: "it compares 'temprature', which no rule writes and the host doesn't provide"},
+	}, optimized.Eliminated)
+
+	// The fan rule fires unconditionally
+	compiled, err := Compile(optimized, Options{})
+	require.NoError(t, err)
+	vm := runtime.NewVM(compiled.Image)
+	require.NoError(t, vm.Run())
+	fan, _ := vm.GetFact("fan_status")
+	assert.Equal(t, true, fan)
+}
+
+func TestLint(t *testing.T) {
+	ruleset, err := ParseRules([]byte(fanRules), Options{})
+	require.NoError(t, err)
+	optimized, err := Optimize(ruleset)
+	require.NoError(t, err)
+
+	// The rules are linted as written, before the optimizer merges them
+	warnings, err := Lint(optimized, LintOptions{Inputs: []string{"temperature"}})
+	require.NoError(t, err)
+	require.Len(t, warnings, 2)
+	assert.Equal(t, LintWarning{Check: "unused-production", Fact: "alarm", Message: "fact 'alarm' is produced but not consumed by any rule"}, warnings[0])
+
+	warnings, err = Lint(optimized, LintOptions{Inputs: []string{"temperature"}, Disabled: []string{"unused-production"}})
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
@@ -0,0 +1,194 @@
+// engine.go
+
+// Package rex embeds the rule engine in Go services, hiding the split
+// between the preprocessor, the bytecode and the runtime:
+//
+//	engine, err := rex.New(rulesJSON, rex.CompileOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	unsubscribe := engine.Subscribe("fan_status", func(old, new interface{}) {
+//		log.Printf("fan_status is now %v", new)
+//	})
+//	defer unsubscribe()
+//	engine.SetFact("temperature", 35)
+//	err = engine.Evaluate()
+//
+// The actions rules trigger, other than fact updates, are performed by the
+// handlers registered with Engine.RegisterAction or
+// extension.RegisterActionHandler, or else by the runtime's default handlers
+// of the built-in types: webhook actions are sent and the others logged.
+// Rules may use action types of their own, e.g. notifySlack, as long as a
+// handler is registered for them.
+package rex
+
+import (
+	"fmt"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/runtime"
+	"sync"
+)
+
+// Types used with an engine.
+type (
+	CompileOptions = compiler.Options
+	FactSubscriber = runtime.FactSubscriber
+	Action         = runtime.Action
+	ActionHandler  = runtime.ActionHandler
+)
+
+// Engine evaluates a ruleset against the facts set on it. It is safe for
+// concurrent use.
+type Engine struct {
+	mu sync.Mutex // Serializes the VM's cycles and fact store accesses
+	vm *runtime.VM
+}
+
+// New returns an engine evaluating a ruleset, compiled with the given
+// options. A ruleset with problems is reported with a
+// *compiler.RulesetError listing every one.
+func New(rulesJSON []byte, options CompileOptions) (*Engine, error) {
+	image, err := compile(rulesJSON, options)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromBytecode(image)
+}
+
+// compile compiles a ruleset into bytecode, as the preprocessor writes it.
+func compile(rulesJSON []byte, options CompileOptions) ([]byte, error) {
+	ruleset, err := compiler.ParseRules(rulesJSON, options)
+	if err != nil {
+		return nil, err
+	}
+	if ruleset, err = compiler.Optimize(ruleset); err != nil {
+		return nil, err
+	}
+	compiled, err := compiler.Compile(ruleset, options)
+	if err != nil {
+		return nil, err
+	}
+	return compiled.Image, nil
+}
+
+// NewFromBytecode returns an engine evaluating precompiled bytecode, as the
+// runtime loads it.
+func NewFromBytecode(image []byte) (*Engine, error) {
+	vm := runtime.NewVM(image)
+	if err := vm.DecodeError(); err != nil {
+		return nil, fmt.Errorf("invalid bytecode: %w", err)
+	}
+	return &Engine{vm: vm}, nil
+}
+
+// SetFact sets the value of a fact, for the next evaluation.
+func (e *Engine) SetFact(name string, value interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vm.SetFact(name, value)
+}
+
+// SetFacts sets the values of several facts, leaving the others unchanged.
+func (e *Engine) SetFacts(facts map[string]interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vm.SetFacts(facts)
+}
+
+// Fact returns the value of a fact, and whether it is set.
+func (e *Engine) Fact(name string) (interface{}, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.vm.GetFact(name)
+}
+
+// Facts returns a copy of every fact.
+func (e *Engine) Facts() map[string]interface{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.vm.Facts()
+}
+
+// Evaluate runs an evaluation cycle: the rules are evaluated against the
+// facts, the facts they update are written and the subscribers of the
+// changed facts called, and their other actions performed.
+func (e *Engine) Evaluate() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.vm.Run()
+}
+
+// Subscribe registers fn to be called whenever an evaluation changes the
+// value of the named fact; facts set with SetFact aren't reported. fn runs
+// during Evaluate, so it must not call the engine's other methods, but it
+// may subscribe and unsubscribe. Subscribe returns a function cancelling the
+// subscription.
+func (e *Engine) Subscribe(fact string, fn FactSubscriber) (unsubscribe func()) {
+	return e.vm.Subscribe(fact, fn)
+}
+
+// RegisterAction registers the handler performing the engine's actions of a
+// type, in place of one registered with extension.RegisterActionHandler or
+// the default handler of a built-in type. Registering a type again replaces
+// its handler, and a nil handler removes it. The handler runs during
+// Evaluate, so it must not call the engine's other methods.
+func (e *Engine) RegisterAction(actionType string, handler ActionHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vm.RegisterAction(actionType, handler)
+}
+
+// SetChaining enables forward chaining: when an evaluation changes a fact,
+// the rules consuming it are evaluated again in the same evaluation, up to
+// maxDepth re-evaluations deep and maxIterations re-evaluations in all, or
+// without a limit on their number if it is 0. A chain going over either
+// limit fails the evaluation. A maxDepth of 0 disables chaining.
+func (e *Engine) SetChaining(maxDepth, maxIterations int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vm.SetMaxChainDepth(maxDepth)
+	e.vm.SetMaxChainIterations(maxIterations)
+}
+
+// Reload replaces the ruleset the engine evaluates with a new one, compiled
+// with the given options, keeping the facts, subscriptions and action
+// handlers. If the new ruleset doesn't compile, the engine goes on with the
+// current one and the error is returned. Rules disabled in the current
+// ruleset stay disabled if the new one has a rule of the same name.
+func (e *Engine) Reload(rulesJSON []byte, options CompileOptions) error {
+	image, err := compile(rulesJSON, options)
+	if err != nil {
+		return err
+	}
+	return e.ReloadBytecode(image)
+}
+
+// ReloadBytecode replaces the ruleset the engine evaluates with precompiled
+// bytecode, like Reload.
+func (e *Engine) ReloadBytecode(image []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.vm.Reload(image)
+}
+
+// EnableRule enables the named rule, from the next evaluation on.
+func (e *Engine) EnableRule(name string) error {
+	return e.vm.EnableRule(name)
+}
+
+// DisableRule disables the named rule, from the next evaluation on, until it
+// is enabled again. A rule the optimizer merged into another can't be
+// disabled on its own.
+func (e *Engine) DisableRule(name string) error {
+	return e.vm.DisableRule(name)
+}
+
+// Rules returns the names of the rules the engine evaluates, including those
+// the optimizer merged into others, in bytecode order.
+func (e *Engine) Rules() []string {
+	var names []string
+	for _, info := range e.vm.Rules() {
+		names = append(append(names, info.Name), info.Merged...)
+	}
+	return names
+}
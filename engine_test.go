@@ -0,0 +1,251 @@
+package rex
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const coolingRules = `[
+    {
+        "name": "cooling",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    },
+    {
+        "name": "heating",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["heater_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "lessThan", "value": 10}]},
+        "event": {"actions": [{"type": "updateFact", "target": "heater_status", "value": true}]}
+    }
+]`
+
+func TestEngine(t *testing.T) {
+	engine, err := New([]byte(coolingRules), CompileOptions{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"cooling", "heating"}, engine.Rules())
+
+	var changes []interface{}
+	unsubscribe := engine.Subscribe("fan_status", func(old, new interface{}) {
+		changes = append(changes, new)
+	})
+	engine.SetFact("temperature", 35)
+	require.NoError(t, engine.Evaluate())
+	fan, ok := engine.Fact("fan_status")
+	assert.True(t, ok)
+	assert.Equal(t, true, fan)
+	_, ok = engine.Fact("heater_status")
+	assert.False(t, ok)
+	assert.Equal(t, []interface{}{true}, changes)
+
+	// Unchanged values and unsubscribed facts aren't reported
+	require.NoError(t, engine.Evaluate())
+	unsubscribe()
+	engine.SetFacts(map[string]interface{}{"temperature": 5, "fan_status": false})
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []interface{}{true}, changes)
+	assert.Equal(t, map[string]interface{}{"temperature": 5, "fan_status": false, "heater_status": true}, engine.Facts())
+}
+
+func TestEngine_Webhook(t *testing.T) {
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	engine, err := New([]byte(`[{
+        "name": "overheat",
+        "consumedFacts": ["temperature"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "webhook", "target": "`+server.URL+`",
+            "webhook": {"body": "{\"temperature\": {{facts.temperature}}}", "timeout": "5s", "retries": 1}}]}
+    }]`), CompileOptions{})
+	require.NoError(t, err)
+	engine.SetFact("temperature", 35)
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, `{"temperature": 35}`, <-bodies)
+}
+
+func TestEngine_RegisterAction(t *testing.T) {
+	engine, err := New([]byte(`[{
+        "name": "overheat",
+        "consumedFacts": ["temperature"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "notifySlack", "target": "#ops", "value": "Too hot"}]}
+    }]`), CompileOptions{})
+	require.NoError(t, err)
+
+	var notified []Action
+	engine.RegisterAction("notifySlack", func(ctx context.Context, action Action) error {
+		notified = append(notified, action)
+		return nil
+	})
+	engine.SetFact("temperature", 35)
+	require.NoError(t, engine.Evaluate())
+	require.Len(t, notified, 1)
+	assert.Equal(t, "#ops", notified[0].Target)
+	assert.Equal(t, "Too hot", notified[0].Value)
+}
+
+func TestEngine_OrderedGuardedActions(t *testing.T) {
+	engine, err := New([]byte(`[{
+        "name": "overheat",
+        "consumedFacts": ["temperature", "quiet_hours"],
+        "producedFacts": ["fan"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [
+            {"type": "notify", "target": "ops", "value": "Too hot", "order": 2,
+             "when": {"all": [{"fact": "quiet_hours", "operator": "equal", "value": false}]}},
+            {"type": "logEvent", "target": "fan", "value": "on", "order": 2,
+             "when": {"all": [{"fact": "fan", "operator": "equal", "value": true}]}},
+            {"type": "updateFact", "target": "fan", "value": true, "order": 1}
+        ]}
+    }]`), CompileOptions{})
+	require.NoError(t, err)
+
+	var performed []string
+	record := func(ctx context.Context, action Action) error {
+		performed = append(performed, action.Type)
+		return nil
+	}
+	engine.RegisterAction("notify", record)
+	engine.RegisterAction("logEvent", record)
+
+	engine.SetFacts(map[string]interface{}{"temperature": 35, "quiet_hours": false})
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []string{"notify", "logEvent"}, performed, "the guard of logEvent sees the fan the rule turned on")
+
+	performed = nil
+	engine.SetFact("quiet_hours", true)
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, []string{"logEvent"}, performed)
+}
+
+func TestEngine_SetChaining(t *testing.T) {
+	// The fan rule runs first, before the cooling rule concludes its input
+	engine, err := New([]byte(`[{
+        "name": "fan",
+        "priority": 10,
+        "consumedFacts": ["ac_status"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "ac_status", "operator": "equal", "value": true}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }, {
+        "name": "cooling",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["ac_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "ac_status", "value": true}]}
+    }]`), CompileOptions{})
+	require.NoError(t, err)
+
+	engine.SetFacts(map[string]interface{}{"temperature": 35, "ac_status": false})
+	require.NoError(t, engine.Evaluate())
+	_, ok := engine.Fact("fan_status")
+	assert.False(t, ok, "The fan rule waits for the next evaluation without chaining")
+
+	engine.SetFacts(map[string]interface{}{"temperature": 35, "ac_status": false})
+	engine.SetChaining(5, 100)
+	require.NoError(t, engine.Evaluate())
+	fan, _ := engine.Fact("fan_status")
+	assert.Equal(t, true, fan)
+}
+
+func TestEngine_SetChaining_AlertsOnce(t *testing.T) {
+	// The alert rule runs after the cooling rule and sees its conclusion in
+	// the same pass, so chaining doesn't evaluate it again
+	engine, err := New([]byte(`[{
+        "name": "cooling",
+        "priority": 10,
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["ac_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "ac_status", "value": true}]}
+    }, {
+        "name": "alert",
+        "consumedFacts": ["ac_status"],
+        "conditions": {"all": [{"fact": "ac_status", "operator": "equal", "value": true}]},
+        "event": {"actions": [{"type": "sendAlert", "target": "ops", "value": "cooling on"}]}
+    }]`), CompileOptions{})
+	require.NoError(t, err)
+	alerts := 0
+	engine.RegisterAction("sendAlert", func(ctx context.Context, action Action) error {
+		alerts++
+		return nil
+	})
+
+	engine.SetChaining(3, 0)
+	engine.SetFacts(map[string]interface{}{"temperature": 35, "ac_status": false})
+	require.NoError(t, engine.Evaluate())
+	assert.Equal(t, 1, alerts)
+}
+
+func TestEngine_DisableRule(t *testing.T) {
+	engine, err := New([]byte(coolingRules), CompileOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, engine.DisableRule("cooling"))
+	engine.SetFact("temperature", 35)
+	require.NoError(t, engine.Evaluate())
+	_, ok := engine.Fact("fan_status")
+	assert.False(t, ok)
+
+	require.NoError(t, engine.EnableRule("cooling"))
+	require.NoError(t, engine.Evaluate())
+	fan, _ := engine.Fact("fan_status")
+	assert.Equal(t, true, fan)
+
+	assert.ErrorIs(t, engine.DisableRule("venting"), runtime.ErrUnknownRule)
+}
+
+func TestEngine_Reload(t *testing.T) {
+	engine, err := New([]byte(coolingRules), CompileOptions{})
+	require.NoError(t, err)
+	engine.SetFact("temperature", 25)
+	require.NoError(t, engine.DisableRule("heating"))
+
+	warmer := strings.Replace(coolingRules, `"value": 30`, `"value": 20`, 1)
+	require.NoError(t, engine.Reload([]byte(warmer), CompileOptions{}))
+	require.NoError(t, engine.Evaluate())
+	fan, _ := engine.Fact("fan_status")
+	assert.Equal(t, true, fan, "the new ruleset runs against the facts set before")
+
+	engine.SetFact("temperature", 5)
+	require.NoError(t, engine.Evaluate())
+	_, ok := engine.Fact("heater_status")
+	assert.False(t, ok, "the heating rule stays disabled")
+
+	assert.Error(t, engine.Reload([]byte(`[{"name": "a", "conditions": {}}]`), CompileOptions{}))
+	assert.Equal(t, []string{"cooling", "heating"}, engine.Rules(), "the engine keeps its ruleset")
+}
+
+func TestNew_InvalidRuleset(t *testing.T) {
+	_, err := New([]byte(`[{"name": "a", "conditions": {}}]`), CompileOptions{})
+	assert.EqualError(t, err, "rules[0].conditions (rule 'a', line 1, column 30): a rule must have at least one condition")
+}
+
+func TestNew_StringTooLong(t *testing.T) {
+	rulesJSON := `[{"name": "a", "consumedFacts": ["message"], "producedFacts": ["b"], "conditions": {"all": [{"fact": "message", "operator": "equal", "value": "` +
+		strings.Repeat("x", 300) + `"}]}, "event": {"actions": [{"type": "updateFact", "target": "b", "value": true}]}}]`
+	_, err := New([]byte(rulesJSON), CompileOptions{})
+	assert.ErrorContains(t, err, "rule 'a': string constant of 300 bytes")
+}
+
+func TestNewFromBytecode(t *testing.T) {
+	truncated := append(make([]byte, 12), byte(bytecode.LOAD_CONST_INT64))
+	_, err := NewFromBytecode(truncated)
+	assert.ErrorContains(t, err, "invalid bytecode")
+}
@@ -0,0 +1,97 @@
+// extension/extension.go
+
+// Package extension lets code outside this module extend the engine with
+// optimizer passes, custom condition operators and action handlers.
+//
+// Extensions register themselves from an init function. They can be linked
+// into a custom build of the rex commands with a blank import, or built as Go
+// plugins (go build -buildmode=plugin) and loaded at startup with the
+// -plugins flag of the preprocessor, the runtime and rex, which calls
+// LoadPlugins. A plugin must be built with the same Go version and module
+// versions as the binary loading it.
+package extension
+
+import (
+	"fmt"
+	"plugin"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+)
+
+// Types used by extensions.
+type (
+	Rule              = rules.Rule
+	Condition         = rules.Condition
+	RuleEngineContext = rules.RuleEngineContext
+	Action            = runtime.Action
+	ActionHandler     = runtime.ActionHandler
+	OptimizerPass     = preprocessor.OptimizerPass
+	OperatorFunc      = runtime.OperatorFunc
+
+	// Delivery of sendMessage actions; register a MessageRouter's Handle
+	// method as the handler of the sendMessage action type
+	Message       = runtime.Message
+	MessageSink   = runtime.MessageSink
+	MessageRouter = runtime.MessageRouter
+	WriterSink    = runtime.WriterSink
+	WebhookSink   = runtime.WebhookSink
+	ChannelSink   = runtime.ChannelSink
+
+	// Value of webhook actions, with the body rendered from the facts
+	WebhookRequest = runtime.WebhookRequest
+)
+
+// Operator is a custom condition operator, usable in rules like the built-in
+// ones, e.g. {"fact": "host", "operator": "matchesGlob", "value": "web-*"}.
+type Operator struct {
+	Name       string
+	ValueTypes []string     // Value types the operator accepts: int, float, string or bool
+	Eval       OperatorFunc // Compares the fact's value with the rule's value
+}
+
+// RegisterOperator makes an operator known to the parser, the compiler and
+// the runtime. It panics if the name is taken.
+func RegisterOperator(op Operator) {
+	if op.Name == "" || len(op.ValueTypes) == 0 || op.Eval == nil {
+		panic(fmt.Sprintf("extension: operator %q needs a name, value types and an implementation", op.Name))
+	}
+	rules.RegisterOperator(op.Name, op.ValueTypes...)
+	runtime.RegisterOperator(op.Name, op.Eval)
+}
+
+// RegisterOptimizerPass adds a pass run after the built-in optimizations. It
+// panics if the name is taken.
+func RegisterOptimizerPass(name string, pass OptimizerPass) {
+	preprocessor.RegisterOptimizerPass(name, pass)
+}
+
+// RegisterActionHandler registers the handler for an action type. It panics
+// if the type is taken.
+func RegisterActionHandler(actionType string, handler ActionHandler) {
+	runtime.RegisterActionHandler(actionType, handler)
+}
+
+// LoadPlugins opens the Go plugins at the given paths, running their init
+// functions and so their registrations.
+func LoadPlugins(paths ...string) error {
+	for _, path := range paths {
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("failed to load plugin %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// SplitPaths splits a comma-separated -plugins flag value, ignoring empty
+// entries.
+func SplitPaths(list string) []string {
+	var paths []string
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
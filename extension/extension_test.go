@@ -0,0 +1,64 @@
+package extension
+
+import (
+	"path/filepath"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterOperator_CompilesRules(t *testing.T) {
+	RegisterOperator(Operator{
+		Name:       "hasSuffix",
+		ValueTypes: []string{"string"},
+		Eval: func(fact, value interface{}) (bool, error) {
+			s, _ := fact.(string)
+			return strings.HasSuffix(s, value.(string)), nil
+		},
+	})
+
+	ruleJSON := []byte(`[{
+		"name": "internalHost",
+		"conditions": {"all": [{"fact": "host", "operator": "hasSuffix", "value": ".internal", "valueType": "string"}]},
+		"event": {"actions": [{"type": "updateFact", "target": "trusted", "value": true}]},
+		"consumedFacts": ["host"],
+		"producedFacts": ["trusted"]
+	}]`)
+	context := rules.NewRuleEngineContext()
+	ruleSet, err := preprocessor.ParseAndValidateRules(ruleJSON, context)
+	require.NoError(t, err)
+	preprocessor.IndexFacts(ruleSet, context)
+	code, err := bytecode.NewCompiler(context).Compile(ruleSet)
+	require.NoError(t, err)
+
+	listing, err := bytecode.Disassemble(code)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "CALL_OPERATOR")
+	assert.Contains(t, listing, "hasSuffix")
+
+	// The operator only applies to the value types it was registered for
+	_, err = preprocessor.ParseAndValidateRules([]byte(strings.Replace(string(ruleJSON), `".internal", "valueType": "string"`, `3, "valueType": "int"`, 1)), rules.NewRuleEngineContext())
+	assert.Error(t, err)
+}
+
+func TestRegisterOperator_Invalid(t *testing.T) {
+	assert.Panics(t, func() { RegisterOperator(Operator{Name: "incomplete"}) })
+	assert.Panics(t, func() {
+		RegisterOperator(Operator{Name: "equal", ValueTypes: []string{"int"}, Eval: func(fact, value interface{}) (bool, error) { return false, nil }})
+	})
+}
+
+func TestLoadPlugins(t *testing.T) {
+	assert.NoError(t, LoadPlugins())
+	assert.Error(t, LoadPlugins(filepath.Join(t.TempDir(), "missing.so")))
+}
+
+func TestSplitPaths(t *testing.T) {
+	assert.Equal(t, []string{"a.so", "b.so"}, SplitPaths(" a.so, ,b.so "))
+	assert.Empty(t, SplitPaths(""))
+}
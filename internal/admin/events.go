@@ -0,0 +1,149 @@
+// admin/events.go
+
+package admin
+
+import (
+	"net/http"
+	"net/url"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+)
+
+// Types of the events a Monitor streams.
+const (
+	EventRuleFired   = "ruleFired"
+	EventFactChanged = "factChanged"
+	EventAction      = "action"
+)
+
+// eventBuffer is the number of events a subscriber may fall behind by before
+// events are dropped for it.
+const eventBuffer = 256
+
+// Event is something that happened in an evaluation cycle, as streamed live to
+// dashboards: a rule fired, a fact changed, or an action was performed.
+type Event struct {
+	Type          string    `json:"type"` // EventRuleFired, EventFactChanged or EventAction
+	Time          time.Time `json:"time"`
+	CorrelationID string    `json:"correlationId,omitempty"` // Correlation ID of the cycle
+	Ruleset       string    `json:"ruleset,omitempty"`       // Ruleset of the rule in a composition
+
+	// The rule that fired or triggered the action
+	Rule    *int   `json:"rule,omitempty"`
+	Label   string `json:"label,omitempty"`
+	Variant string `json:"variant,omitempty"`
+
+	// The fact that changed, with its values before and after the cycle
+	Fact    string      `json:"fact,omitempty"`
+	Old     interface{} `json:"old,omitempty"`
+	New     interface{} `json:"new,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+
+	// The action performed, with the error its handler failed with
+	Action *runtime.Action `json:"action,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Events returns a channel receiving the events of the cycles run from now on,
+// and a function ending the subscription. Events are dropped for subscribers
+// that fall behind rather than holding up the cycles.
+func (m *Monitor) Events() (<-chan Event, func()) {
+	events := make(chan Event, eventBuffer)
+	m.mu.Lock()
+	m.subscribers[events] = true
+	m.mu.Unlock()
+	return events, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, events)
+	}
+}
+
+// publish sends an event to the subscribers. The caller must hold m.mu.
+func (m *Monitor) publish(event Event) {
+	for events := range m.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Debug().Str("Type", event.Type).Msg("Dropping event for subscriber falling behind")
+		}
+	}
+}
+
+// actionPerformed publishes the event of a performed action.
+func (m *Monitor) actionPerformed(index int, ruleset string, action runtime.Action, err error) {
+	event := Event{Type: EventAction, Time: time.Now(), CorrelationID: action.CorrelationID, Ruleset: ruleset, Action: &action}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.subscribers) == 0 {
+		return
+	}
+	event.Rule, event.Label = &action.Rule, m.ruleLabel(ruleKey{index, action.Rule})
+	m.publish(event)
+}
+
+// eventsHandler streams the monitor's events over a WebSocket, one JSON
+// message per event. The types query parameter selects the types of events
+// sent, e.g. ?types=ruleFired,action; every event is sent without it.
+// Browsers may only connect from the page's own host, which keeps other web
+// sites from reading the events.
+func eventsHandler(m *Monitor) http.Handler {
+	return websocket.Server{
+		Handshake: checkOrigin,
+		Handler: func(ws *websocket.Conn) {
+			types := make(map[string]bool)
+			for _, t := range strings.Split(ws.Request().URL.Query().Get("types"), ",") {
+				if t != "" {
+					types[t] = true
+				}
+			}
+			events, unsubscribe := m.Events()
+			defer unsubscribe()
+
+			// Clients don't send anything; reading only detects that they left
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var message string
+				for websocket.Message.Receive(ws, &message) == nil {
+				}
+			}()
+			for {
+				select {
+				case <-closed:
+					return
+				case event := <-events:
+					if len(types) > 0 && !types[event.Type] {
+						continue
+					}
+					if err := websocket.JSON.Send(ws, event); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+}
+
+// checkOrigin accepts WebSocket connections from clients that aren't
+// browsers, which send no Origin, and from pages served by the same host.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return websocket.ErrBadWebSocketOrigin
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func init() {
+	runtime.RegisterActionHandler("adminEventsTest", func(ctx context.Context, action runtime.Action) error {
+		if action.Target == "broken" {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	})
+}
+
+// eventsProgram builds bytecode for a rule that sets fan_status from the
+// fan_on fact and triggers an action with it.
+func eventsProgram() []byte {
+	code := make([]byte, 12) // Header skipped by the VM
+	code = append(code, byte(bytecode.LOAD_FACT))
+	code = append(code, "fan_on\x00"...)
+	code = append(code, byte(bytecode.UPDATE_FACT))
+	code = append(code, "fan_status\x00"...)
+	code = append(code, byte(bytecode.LOAD_FACT))
+	code = append(code, "fan_on\x00"...)
+	code = append(code, byte(bytecode.TRIGGER_ACTION))
+	code = append(code, "adminEventsTest\x00broken\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	return code
+}
+
+func TestMonitor_Events(t *testing.T) {
+	vm := runtime.NewVM(eventsProgram())
+	monitor := NewMonitor(vm)
+	vm.OnActionError(func(rule int, err error) error { return nil })
+	vm.SetFact("fan_on", true)
+	vm.SetFact("mode", "eco")
+	require.NoError(t, vm.Run())
+
+	events, unsubscribe := monitor.Events()
+	vm.SetFact("fan_on", false)
+	vm.SetCorrelationID("c1")
+	require.NoError(t, vm.Run())
+	vm.DeleteFact("mode")
+	require.NoError(t, vm.Run())
+	unsubscribe()
+	require.NoError(t, vm.Run())
+
+	var received []Event
+	for len(events) > 0 {
+		received = append(received, <-events)
+	}
+	var types []string
+	for _, event := range received {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{EventRuleFired, EventAction, EventFactChanged, EventFactChanged, EventRuleFired, EventAction}, types[:6])
+
+	action := received[1]
+	assert.Equal(t, "c1", action.CorrelationID)
+	assert.Equal(t, 0, *action.Rule)
+	assert.Equal(t, "rule 0", action.Label)
+	assert.Equal(t, runtime.Action{Rule: 0, Type: "adminEventsTest", Target: "broken", Value: false, CorrelationID: "c1"}, *action.Action)
+	assert.Equal(t, "downstream unavailable", action.Error)
+
+	changes := map[string]Event{}
+	for _, event := range received[2:4] {
+		changes[event.Fact] = event
+	}
+	assert.Equal(t, true, changes["fan_on"].Old)
+	assert.Equal(t, false, changes["fan_on"].New)
+	assert.Equal(t, "c1", changes["fan_status"].CorrelationID)
+
+	require.Len(t, received, 7, "no events are received once unsubscribed")
+	deleted := received[6]
+	assert.Equal(t, EventFactChanged, deleted.Type)
+	assert.Equal(t, "mode", deleted.Fact)
+	assert.Equal(t, "eco", deleted.Old)
+	assert.True(t, deleted.Deleted)
+}
+
+func TestHandler_Events(t *testing.T) {
+	vm := runtime.NewVM(eventsProgram())
+	monitor := NewMonitor(vm)
+	vm.OnActionError(func(rule int, err error) error { return nil })
+
+	server := httptest.NewServer(NewHandler(monitor))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/events?types=ruleFired,factChanged"
+
+	_, err := websocket.Dial(url, "", "http://elsewhere.example")
+	assert.Error(t, err, "pages of other hosts can't connect")
+
+	ws, err := websocket.Dial(url, "", server.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+	require.Eventually(t, func() bool {
+		monitor.mu.Lock()
+		defer monitor.mu.Unlock()
+		return len(monitor.subscribers) == 1
+	}, time.Second, time.Millisecond)
+
+	vm.SetFact("fan_on", true)
+	vm.SetCorrelationID("c1")
+	require.NoError(t, vm.Run())
+
+	var event Event
+	require.NoError(t, websocket.JSON.Receive(ws, &event))
+	assert.Equal(t, EventRuleFired, event.Type)
+	assert.Equal(t, "c1", event.CorrelationID)
+	require.NoError(t, websocket.JSON.Receive(ws, &event))
+	assert.Equal(t, EventFactChanged, event.Type)
+
+	ws.Close()
+	require.Eventually(t, func() bool {
+		monitor.mu.Lock()
+		defer monitor.mu.Unlock()
+		return len(monitor.subscribers) == 0
+	}, time.Second, time.Millisecond, "closing the connection ends the subscription")
+}
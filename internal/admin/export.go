@@ -0,0 +1,213 @@
+// admin/export.go
+
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ExportFormat is the encoding used to push metrics.
+type ExportFormat string
+
+const (
+	// ExportInflux is the InfluxDB line protocol, also accepted by Grafana
+	// Cloud's Influx endpoint.
+	ExportInflux ExportFormat = "influx"
+	// ExportJSON is a JSON array of metric points.
+	ExportJSON ExportFormat = "json"
+)
+
+// MetricPoint is a single value in the JSON export format.
+type MetricPoint struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp"` // Unix milliseconds
+}
+
+// Exporter periodically pushes the statistics of a Monitor to a metrics
+// endpoint, for fleets without a local scraper.
+type Exporter struct {
+	URL      string
+	Format   ExportFormat
+	Interval time.Duration
+	Username string // Basic authentication credentials, if the endpoint requires them
+	Password string
+	Client   *http.Client // Defaults to a client with a 10 second timeout
+}
+
+// Run pushes the monitor's statistics every Interval until ctx is done.
+// Failed pushes are logged and retried at the next interval.
+func (e *Exporter) Run(ctx context.Context, m *Monitor) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := e.Push(ctx, m.Snapshot(), now); err != nil {
+				log.Error().Err(err).Str("URL", e.URL).Msg("Failed to push metrics")
+			}
+		}
+	}
+}
+
+// Push sends a snapshot, timestamped at, to the endpoint.
+func (e *Exporter) Push(ctx context.Context, snapshot Snapshot, at time.Time) error {
+	var body []byte
+	contentType := "text/plain; charset=utf-8"
+	switch e.Format {
+	case ExportInflux:
+		body = FormatInflux(snapshot, at)
+	case ExportJSON:
+		var err error
+		if body, err = json.Marshal(MetricPoints(snapshot, at)); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	default:
+		return fmt.Errorf("unknown metrics format %q", e.Format)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.Username != "" || e.Password != "" {
+		req.SetBasicAuth(e.Username, e.Password)
+	}
+
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("metrics endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// FormatInflux encodes a snapshot in the InfluxDB line protocol: one rex_runtime
+// line with the cycle counters, one rex_ruleset line per ruleset of a
+// composition, one rex_rule line per rule, and one rex_fact line per fact
+// that received values not matching the fact schema.
+func FormatInflux(snapshot Snapshot, at time.Time) []byte {
+	var buf bytes.Buffer
+	timestamp := at.UnixNano()
+
+	fmt.Fprintf(&buf, "rex_runtime cycles=%di,cycle_errors=%di,evaluations=%di,evaluations_per_second=%s %d\n",
+		snapshot.Cycles, snapshot.CycleErrors, snapshot.Evaluations, formatFloat(snapshot.EvaluationsPerSecond), timestamp)
+
+	for _, ruleset := range snapshot.Rulesets {
+		fmt.Fprintf(&buf, "rex_ruleset,ruleset=%s rules=%di,cycles=%di,cycle_errors=%di,evaluations=%di,firings=%di,total_seconds=%s %d\n",
+			escapeTag(ruleset.Name), ruleset.Rules, ruleset.Cycles, ruleset.CycleErrors, ruleset.Evaluations, ruleset.Firings,
+			formatFloat(ruleset.TotalSeconds), timestamp)
+	}
+
+	for _, rule := range snapshot.Rules {
+		tags := ""
+		if rule.Ruleset != "" {
+			tags = ",ruleset=" + escapeTag(rule.Ruleset)
+		}
+		fmt.Fprintf(&buf, "rex_rule%s,rule=%d,label=%s evaluations=%di,firings=%di,action_errors=%di,latency_avg_seconds=%s,latency_max_seconds=%s %d\n",
+			tags, rule.Rule, escapeTag(rule.Label), rule.Evaluations, rule.Firings, rule.ActionErrors,
+			formatFloat(averageLatency(rule)), formatFloat(rule.MaxLatencySeconds), timestamp)
+	}
+
+	for _, fact := range sortedKeys(snapshot.IngestErrors) {
+		stats := snapshot.IngestErrors[fact]
+		fmt.Fprintf(&buf, "rex_fact,fact=%s rejected=%di,coerced=%di %d\n", escapeTag(fact), stats.Rejected, stats.Coerced, timestamp)
+	}
+	return buf.Bytes()
+}
+
+// MetricPoints returns the metric points of a snapshot for the JSON export
+// format.
+func MetricPoints(snapshot Snapshot, at time.Time) []MetricPoint {
+	timestamp := at.UnixMilli()
+	points := []MetricPoint{
+		{Name: "rex_cycles", Value: float64(snapshot.Cycles), Timestamp: timestamp},
+		{Name: "rex_cycle_errors", Value: float64(snapshot.CycleErrors), Timestamp: timestamp},
+		{Name: "rex_evaluations", Value: float64(snapshot.Evaluations), Timestamp: timestamp},
+		{Name: "rex_evaluations_per_second", Value: snapshot.EvaluationsPerSecond, Timestamp: timestamp},
+	}
+	for _, ruleset := range snapshot.Rulesets {
+		labels := map[string]string{"ruleset": ruleset.Name}
+		points = append(points,
+			MetricPoint{Name: "rex_ruleset_rules", Labels: labels, Value: float64(ruleset.Rules), Timestamp: timestamp},
+			MetricPoint{Name: "rex_ruleset_cycles", Labels: labels, Value: float64(ruleset.Cycles), Timestamp: timestamp},
+			MetricPoint{Name: "rex_ruleset_cycle_errors", Labels: labels, Value: float64(ruleset.CycleErrors), Timestamp: timestamp},
+			MetricPoint{Name: "rex_ruleset_evaluations", Labels: labels, Value: float64(ruleset.Evaluations), Timestamp: timestamp},
+			MetricPoint{Name: "rex_ruleset_firings", Labels: labels, Value: float64(ruleset.Firings), Timestamp: timestamp},
+			MetricPoint{Name: "rex_ruleset_total_seconds", Labels: labels, Value: ruleset.TotalSeconds, Timestamp: timestamp},
+		)
+	}
+	for _, rule := range snapshot.Rules {
+		labels := map[string]string{"rule": strconv.Itoa(rule.Rule), "label": rule.Label}
+		if rule.Ruleset != "" {
+			labels["ruleset"] = rule.Ruleset
+		}
+		points = append(points,
+			MetricPoint{Name: "rex_rule_evaluations", Labels: labels, Value: float64(rule.Evaluations), Timestamp: timestamp},
+			MetricPoint{Name: "rex_rule_firings", Labels: labels, Value: float64(rule.Firings), Timestamp: timestamp},
+			MetricPoint{Name: "rex_rule_action_errors", Labels: labels, Value: float64(rule.ActionErrors), Timestamp: timestamp},
+			MetricPoint{Name: "rex_rule_latency_avg_seconds", Labels: labels, Value: averageLatency(rule), Timestamp: timestamp},
+			MetricPoint{Name: "rex_rule_latency_max_seconds", Labels: labels, Value: rule.MaxLatencySeconds, Timestamp: timestamp},
+		)
+	}
+	for _, fact := range sortedKeys(snapshot.IngestErrors) {
+		stats := snapshot.IngestErrors[fact]
+		labels := map[string]string{"fact": fact}
+		points = append(points,
+			MetricPoint{Name: "rex_fact_rejected", Labels: labels, Value: float64(stats.Rejected), Timestamp: timestamp},
+			MetricPoint{Name: "rex_fact_coerced", Labels: labels, Value: float64(stats.Coerced), Timestamp: timestamp},
+		)
+	}
+	return points
+}
+
+// sortedKeys returns the keys of a map in sorted order, so that metrics are
+// written in a stable order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// averageLatency returns the mean evaluation time of a rule.
+func averageLatency(rule RuleStats) float64 {
+	if rule.Evaluations == 0 {
+		return 0
+	}
+	return rule.TotalLatencySeconds / float64(rule.Evaluations)
+}
+
+// formatFloat formats a float field value of the line protocol.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapeTag escapes a tag value of the line protocol.
+func escapeTag(value string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(value)
+}
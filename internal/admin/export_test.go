@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSnapshot() Snapshot {
+	return Snapshot{
+		Cycles:               4,
+		CycleErrors:          1,
+		Evaluations:          8,
+		EvaluationsPerSecond: 2.5,
+		Rules: []RuleStats{
+			{Rule: 0, Label: "rule 0", Evaluations: 4, Firings: 3, TotalLatencySeconds: 0.002, MaxLatencySeconds: 0.001},
+		},
+	}
+}
+
+func TestFormatInflux(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	assert.Equal(t,
+		"rex_runtime cycles=4i,cycle_errors=1i,evaluations=8i,evaluations_per_second=2.5 1700000000000000000\n"+
+			`rex_rule,rule=0,label=rule\ 0 evaluations=4i,firings=3i,action_errors=0i,latency_avg_seconds=0.0005,latency_max_seconds=0.001 1700000000000000000`+"\n",
+		string(FormatInflux(testSnapshot(), at)))
+}
+
+func TestFormatInflux_Rulesets(t *testing.T) {
+	snapshot := testSnapshot()
+	snapshot.Rules[0].Ruleset = "site 7"
+	snapshot.Rulesets = []runtime.RulesetStats{{Name: "site 7", Rules: 1, Cycles: 4, CycleErrors: 1, Evaluations: 4, Firings: 3, TotalSeconds: 0.25}}
+	lines := strings.Split(string(FormatInflux(snapshot, time.Unix(1700000000, 0))), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, `rex_ruleset,ruleset=site\ 7 rules=1i,cycles=4i,cycle_errors=1i,evaluations=4i,firings=3i,total_seconds=0.25 1700000000000000000`, lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], `rex_rule,ruleset=site\ 7,rule=0,label=rule\ 0 `), lines[2])
+
+	points := MetricPoints(snapshot, time.Unix(1700000000, 0))
+	assert.Contains(t, points, MetricPoint{Name: "rex_ruleset_cycle_errors", Labels: map[string]string{"ruleset": "site 7"}, Value: 1, Timestamp: 1700000000000})
+	assert.Contains(t, points, MetricPoint{Name: "rex_rule_firings", Labels: map[string]string{"ruleset": "site 7", "rule": "0", "label": "rule 0"}, Value: 3, Timestamp: 1700000000000})
+}
+
+func TestFormatInflux_IngestErrors(t *testing.T) {
+	snapshot := testSnapshot()
+	snapshot.IngestErrors = map[string]runtime.FactIngestStats{"temperature": {Rejected: 2, Coerced: 5}}
+	at := time.Unix(1700000000, 0)
+	assert.True(t, strings.HasSuffix(string(FormatInflux(snapshot, at)), "rex_fact,fact=temperature rejected=2i,coerced=5i 1700000000000000000\n"))
+	assert.Contains(t, MetricPoints(snapshot, at), MetricPoint{Name: "rex_fact_rejected", Labels: map[string]string{"fact": "temperature"}, Value: 2, Timestamp: 1700000000000})
+}
+
+func TestExporter_Push(t *testing.T) {
+	var contentType, body, user, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		user, password, _ = r.BasicAuth()
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	exporter := &Exporter{URL: server.URL, Format: ExportJSON, Username: "12345", Password: "token"}
+	require.NoError(t, exporter.Push(context.Background(), testSnapshot(), time.UnixMilli(1700000000000)))
+
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, "12345", user)
+	assert.Equal(t, "token", password)
+	var points []MetricPoint
+	require.NoError(t, json.Unmarshal([]byte(body), &points))
+	assert.Contains(t, points, MetricPoint{
+		Name:      "rex_rule_firings",
+		Labels:    map[string]string{"rule": "0", "label": "rule 0"},
+		Value:     3,
+		Timestamp: 1700000000000,
+	})
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer failing.Close()
+	exporter = &Exporter{URL: failing.URL, Format: ExportInflux}
+	assert.ErrorContains(t, exporter.Push(context.Background(), testSnapshot(), time.Now()), "401")
+}
+
+func TestMonitor_Latency(t *testing.T) {
+	vm, monitor := newMonitoredVM()
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run())
+
+	for _, rule := range monitor.Snapshot().Rules {
+		assert.Greater(t, rule.TotalLatencySeconds, 0.0)
+		assert.Equal(t, rule.TotalLatencySeconds, rule.MaxLatencySeconds)
+	}
+}
@@ -0,0 +1,524 @@
+// admin/monitor.go
+
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRecentFirings is the number of firings kept for the recent firings list.
+const maxRecentFirings = 50
+
+// RuleStats holds the counters collected for a single rule.
+type RuleStats struct {
+	Ruleset      string    `json:"ruleset,omitempty"` // Ruleset of the rule in a composition
+	Rule         int       `json:"rule"`
+	Label        string    `json:"label"`
+	Evaluations  int       `json:"evaluations"`
+	Firings      int       `json:"firings"`
+	ActionErrors int       `json:"actionErrors"`
+	LastFired    time.Time `json:"lastFired,omitempty"`
+	Paused       bool      `json:"paused,omitempty"` // Skipped because a fact source is down
+
+	// Time spent evaluating the rule, in total and for the slowest evaluation
+	TotalLatencySeconds float64 `json:"totalLatencySeconds"`
+	MaxLatencySeconds   float64 `json:"maxLatencySeconds"`
+}
+
+// Firing records a rule firing.
+type Firing struct {
+	Time    time.Time `json:"time"`
+	Ruleset string    `json:"ruleset,omitempty"`
+	Rule    int       `json:"rule"`
+	Label   string    `json:"label"`
+	Variant string    `json:"variant,omitempty"`
+}
+
+// RuleDetail describes a loaded rule, with its statistics, for tooling
+// introspecting a runtime without the ruleset it was compiled from.
+type RuleDetail struct {
+	Ruleset string `json:"ruleset,omitempty"` // Ruleset of the rule in a composition
+	runtime.RuleInfo
+	Paused       bool      `json:"paused,omitempty"` // Skipped because a fact source is down
+	Evaluations  int       `json:"evaluations"`
+	Firings      int       `json:"firings"`
+	ActionErrors int       `json:"actionErrors"`
+	LastFired    time.Time `json:"lastFired,omitempty"`
+}
+
+// Snapshot is a consistent view of the statistics collected by a Monitor.
+type Snapshot struct {
+	UptimeSeconds        float64                 `json:"uptimeSeconds"`
+	Cycles               int                     `json:"cycles"`
+	CycleErrors          int                     `json:"cycleErrors"`
+	Evaluations          int                     `json:"evaluations"`
+	EvaluationsPerSecond float64                 `json:"evaluationsPerSecond"`
+	Rules                []RuleStats             `json:"rules"`
+	Facts                map[string]interface{}  `json:"facts"`
+	FactChanges          map[string]int          `json:"factChanges"` // Number of cycles that changed each fact
+	RecentFirings        []Firing                `json:"recentFirings"`
+	Breakers             []runtime.BreakerStatus `json:"breakers"`             // Action handler circuit breakers
+	Rulesets             []runtime.RulesetStats  `json:"rulesets,omitempty"`   // Rulesets of a composition
+	Provenance           *bytecode.Provenance    `json:"provenance,omitempty"` // Ruleset revision of a single VM, if known
+
+	// Values refused or coerced because they didn't match the fact schema
+	IngestErrors map[string]runtime.FactIngestStats `json:"ingestErrors,omitempty"`
+
+	// Fact sources and queued actions under the degradation policy
+	Sources       []runtime.SourceStatus `json:"sources,omitempty"`
+	QueuedActions map[string]int         `json:"queuedActions,omitempty"`
+}
+
+// Health summarizes whether the runtime is fully operational.
+type Health struct {
+	Status        string   `json:"status"`                  // "ok", or "degraded" while any breaker is open, fact source down or action queued
+	OpenBreakers  []string `json:"openBreakers"`            // Handler types whose breaker isn't closed
+	DownSources   []string `json:"downSources,omitempty"`   // Fact sources that are down
+	PausedRules   int      `json:"pausedRules,omitempty"`   // Rules paused because their facts are too stale
+	QueuedActions int      `json:"queuedActions,omitempty"` // Actions held until their handler recovers
+}
+
+// Monitor collects statistics about the evaluation cycles of a VM, or of the
+// VMs of a composition, through their hooks. The VMs run on their own
+// goroutine; a Monitor can be read concurrently from any number of goroutines.
+type Monitor struct {
+	mu          sync.Mutex
+	vms         []*runtime.VM
+	composition *runtime.Composition // nil when monitoring a single VM
+	started     time.Time
+	cycles      int
+	cycleErrors int
+	cycleFailed bool // Whether a ruleset of the current composition cycle failed
+	evaluations int
+	rules       map[ruleKey]*RuleStats
+	facts       map[string]interface{}
+	factChanges map[string]int
+	recent      []Firing
+	lastMark    time.Time  // End of the previous rule evaluation, or start of the cycle
+	labels      [][]string // Names of the rules of each VM, by index
+	subscribers map[chan Event]bool
+}
+
+// ruleKey identifies a rule by the position of its ruleset and its own.
+type ruleKey struct {
+	ruleset int
+	rule    int
+}
+
+// NewMonitor creates a Monitor and registers its hooks on vm.
+func NewMonitor(vm *runtime.VM) *Monitor {
+	m := newMonitor([]*runtime.VM{vm}, nil)
+	m.watch(0, "", true)
+	return m
+}
+
+// NewCompositionMonitor creates a Monitor for the rulesets of c and registers
+// its hooks on their VMs. A cycle of the composition counts as one cycle,
+// which failed if any of its rulesets failed; rule statistics are labeled
+// with their ruleset, and the snapshot includes the counters of each ruleset.
+// Rulesets added to c later aren't monitored.
+func NewCompositionMonitor(c *runtime.Composition) *Monitor {
+	names := c.Rulesets()
+	vms := make([]*runtime.VM, len(names))
+	for i, name := range names {
+		vms[i] = c.VM(name)
+	}
+	m := newMonitor(vms, c)
+	for i, name := range names {
+		m.watch(i, name, i == len(names)-1)
+	}
+	return m
+}
+
+func newMonitor(vms []*runtime.VM, composition *runtime.Composition) *Monitor {
+	m := &Monitor{
+		vms:         vms,
+		composition: composition,
+		started:     time.Now(),
+		rules:       make(map[ruleKey]*RuleStats),
+		factChanges: make(map[string]int),
+		subscribers: make(map[chan Event]bool),
+	}
+	for _, vm := range vms {
+		var labels []string
+		for _, info := range vm.Rules() {
+			labels = append(labels, info.Name)
+		}
+		m.labels = append(m.labels, labels)
+	}
+	if composition != nil {
+		m.facts = composition.Facts()
+	} else {
+		m.facts = vms[0].Facts()
+	}
+	return m
+}
+
+// watch registers the hooks of the monitor on the VM of a ruleset. The cycle
+// is counted when the last ruleset's cycle ends.
+func (m *Monitor) watch(index int, ruleset string, last bool) {
+	vm := m.vms[index]
+	vm.OnBeforeCycle(m.beforeCycle)
+	vm.OnAfterRule(func(rule int, fired bool) {
+		m.afterRule(vm, ruleKey{index, rule}, ruleset, fired)
+	})
+	vm.OnActionError(func(rule int, err error) error {
+		return m.actionError(ruleKey{index, rule}, ruleset, err)
+	})
+	vm.OnActionPerformed(func(action runtime.Action, err error) {
+		m.actionPerformed(index, ruleset, action, err)
+	})
+	vm.OnAfterCycle(func(err error) {
+		m.afterCycle(vm, err, last)
+	})
+}
+
+// Snapshot returns the statistics collected so far.
+func (m *Monitor) Snapshot() Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uptime := time.Since(m.started).Seconds()
+	snapshot := Snapshot{
+		UptimeSeconds: uptime,
+		Cycles:        m.cycles,
+		CycleErrors:   m.cycleErrors,
+		Evaluations:   m.evaluations,
+		Rules:         make([]RuleStats, 0, len(m.rules)),
+		Facts:         make(map[string]interface{}, len(m.facts)),
+		FactChanges:   make(map[string]int, len(m.factChanges)),
+		RecentFirings: append([]Firing{}, m.recent...),
+		Breakers:      m.breakers(),
+	}
+	if m.composition != nil {
+		snapshot.Rulesets = m.composition.Stats()
+	} else if provenance, ok := m.vms[0].Provenance(); ok {
+		snapshot.Provenance = &provenance
+	}
+	for _, vm := range m.vms {
+		for name, stats := range vm.IngestStats() {
+			if snapshot.IngestErrors == nil {
+				snapshot.IngestErrors = make(map[string]runtime.FactIngestStats)
+			}
+			total := snapshot.IngestErrors[name]
+			total.Rejected += stats.Rejected
+			total.Coerced += stats.Coerced
+			snapshot.IngestErrors[name] = total
+		}
+	}
+	sources, paused, queued := m.degradation()
+	if len(sources) > 0 {
+		snapshot.Sources = sources
+	}
+	if len(queued) > 0 {
+		snapshot.QueuedActions = queued
+	}
+	if uptime > 0 {
+		snapshot.EvaluationsPerSecond = float64(m.evaluations) / uptime
+	}
+	keys := make([]ruleKey, 0, len(m.rules))
+	for key := range m.rules {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ruleset < keys[j].ruleset || keys[i].ruleset == keys[j].ruleset && keys[i].rule < keys[j].rule
+	})
+	for _, key := range keys {
+		stats := *m.rules[key]
+		stats.Paused = paused[key]
+		snapshot.Rules = append(snapshot.Rules, stats)
+	}
+	for name, value := range m.facts {
+		snapshot.Facts[name] = value
+	}
+	for name, changes := range m.factChanges {
+		snapshot.FactChanges[name] = changes
+	}
+	return snapshot
+}
+
+// Rules describes the rules of the VMs, in ruleset and bytecode order, with
+// their statistics.
+func (m *Monitor) Rules() []RuleDetail {
+	var names []string
+	if m.composition != nil {
+		names = m.composition.Rulesets()
+	}
+	_, paused, _ := m.degradation()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	details := []RuleDetail{}
+	for index, vm := range m.vms {
+		for _, info := range vm.Rules() {
+			key := ruleKey{index, info.Index}
+			detail := RuleDetail{RuleInfo: info, Paused: paused[key]}
+			if names != nil {
+				detail.Ruleset = names[index]
+			}
+			if stats, ok := m.rules[key]; ok {
+				detail.Evaluations = stats.Evaluations
+				detail.Firings = stats.Firings
+				detail.ActionErrors = stats.ActionErrors
+				detail.LastFired = stats.LastFired
+			}
+			details = append(details, detail)
+		}
+	}
+	return details
+}
+
+// SetRuleEnabled enables or disables the named rule from the next cycle on
+// and returns its description. In a composition the rule is looked up in the
+// named ruleset or, if ruleset is empty, in the only ruleset having it.
+func (m *Monitor) SetRuleEnabled(ruleset, name string, enabled bool) (RuleDetail, error) {
+	var names []string
+	if m.composition != nil {
+		names = m.composition.Rulesets()
+	} else if ruleset != "" {
+		return RuleDetail{}, fmt.Errorf("%w: the runtime doesn't compose rulesets, so there is no ruleset '%s'", runtime.ErrUnknownRule, ruleset)
+	}
+
+	if ruleset != "" && !slices.Contains(names, ruleset) {
+		return RuleDetail{}, fmt.Errorf("%w: no ruleset '%s'", runtime.ErrUnknownRule, ruleset)
+	}
+	var candidates, matches []int
+	for index, vm := range m.vms {
+		if ruleset != "" && names[index] != ruleset {
+			continue
+		}
+		candidates = append(candidates, index)
+		if _, ok := vm.RuleIndex(name); ok {
+			matches = append(matches, index)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		// The VMs explain why, such as for a rule merged into another; with
+		// no such rule, disabling it changes nothing
+		for _, index := range candidates {
+			if err := m.vms[index].DisableRule(name); !errors.Is(err, runtime.ErrUnknownRule) {
+				return RuleDetail{}, err
+			}
+		}
+		return RuleDetail{}, fmt.Errorf("%w: '%s'", runtime.ErrUnknownRule, name)
+	case 1:
+	default:
+		rulesets := make([]string, len(matches))
+		for i, index := range matches {
+			rulesets[i] = names[index]
+		}
+		return RuleDetail{}, fmt.Errorf("rule '%s' is in rulesets %v; name the ruleset", name, rulesets)
+	}
+
+	index := matches[0]
+	vm := m.vms[index]
+	var err error
+	if enabled {
+		err = vm.EnableRule(name)
+	} else {
+		err = vm.DisableRule(name)
+	}
+	if err != nil {
+		return RuleDetail{}, err
+	}
+	rule, _ := vm.RuleIndex(name)
+	for _, detail := range m.Rules() {
+		if detail.Index == rule && (names == nil || detail.Ruleset == names[index]) {
+			return detail, nil
+		}
+	}
+	return RuleDetail{}, fmt.Errorf("%w: '%s'", runtime.ErrUnknownRule, name)
+}
+
+// Health reports the health of the runtime based on its action handler
+// circuit breakers and on its degradation policy.
+func (m *Monitor) Health() Health {
+	health := Health{Status: "ok", OpenBreakers: []string{}}
+	for _, breaker := range m.breakers() {
+		if breaker.State != runtime.BreakerClosed && !slices.Contains(health.OpenBreakers, breaker.HandlerType) {
+			health.Status = "degraded"
+			health.OpenBreakers = append(health.OpenBreakers, breaker.HandlerType)
+		}
+	}
+	sources, paused, queued := m.degradation()
+	for _, source := range sources {
+		if source.State != runtime.SourceUp {
+			health.DownSources = append(health.DownSources, source.Name)
+		}
+	}
+	health.PausedRules = len(paused)
+	for _, count := range queued {
+		health.QueuedActions += count
+	}
+	if len(health.DownSources) > 0 || health.PausedRules > 0 || health.QueuedActions > 0 {
+		health.Status = "degraded"
+	}
+	return health
+}
+
+// degradation returns the fact sources of the VMs' degradation policies, along
+// with the rules they paused and the actions they queued. The rulesets of a
+// composition share their sources, which are reported once, in their least
+// healthy state.
+func (m *Monitor) degradation() ([]runtime.SourceStatus, map[ruleKey]bool, map[string]int) {
+	var sources []runtime.SourceStatus
+	paused := make(map[ruleKey]bool)
+	queued := make(map[string]int)
+	for index, vm := range m.vms {
+		status := vm.Degradation()
+		for _, source := range status.Sources {
+			i := slices.IndexFunc(sources, func(s runtime.SourceStatus) bool { return s.Name == source.Name })
+			switch {
+			case i < 0:
+				sources = append(sources, source)
+			case sourceSeverity[source.State] > sourceSeverity[sources[i].State]:
+				sources[i] = source
+			}
+		}
+		for _, rule := range status.PausedRules {
+			paused[ruleKey{index, rule}] = true
+		}
+		for handlerType, count := range status.QueuedActions {
+			queued[handlerType] += count
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+	return sources, paused, queued
+}
+
+// sourceSeverity orders the states of a fact source from healthy to paused.
+var sourceSeverity = map[runtime.SourceState]int{
+	runtime.SourceUp:     0,
+	runtime.SourceStale:  1,
+	runtime.SourcePaused: 2,
+}
+
+// breakers returns the circuit breakers of the VMs' action guards. The
+// rulesets of a composition may have guards of their own, each with its
+// breakers.
+func (m *Monitor) breakers() []runtime.BreakerStatus {
+	breakers := []runtime.BreakerStatus{}
+	seen := make(map[*runtime.ActionGuard]bool)
+	for _, vm := range m.vms {
+		if guard := vm.ActionGuard(); !seen[guard] {
+			seen[guard] = true
+			breakers = append(breakers, guard.Breakers()...)
+		}
+	}
+	return breakers
+}
+
+// ruleStats returns the counters for a rule, creating them if needed. The
+// caller must hold m.mu.
+func (m *Monitor) ruleStats(key ruleKey, ruleset string) *RuleStats {
+	stats, ok := m.rules[key]
+	if !ok {
+		stats = &RuleStats{Ruleset: ruleset, Rule: key.rule, Label: m.ruleLabel(key)}
+		m.rules[key] = stats
+	}
+	return stats
+}
+
+func (m *Monitor) beforeCycle() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastMark = time.Now()
+	return nil
+}
+
+func (m *Monitor) afterRule(vm *runtime.VM, key ruleKey, ruleset string, fired bool) {
+	variant, correlationID := vm.Variant(), vm.CorrelationID()
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.evaluations++
+	stats := m.ruleStats(key, ruleset)
+	stats.Evaluations++
+
+	// Rules are evaluated one after the other, so a rule's latency is the
+	// time since the previous one finished
+	latency := now.Sub(m.lastMark).Seconds()
+	m.lastMark = now
+	stats.TotalLatencySeconds += latency
+	stats.MaxLatencySeconds = max(stats.MaxLatencySeconds, latency)
+
+	if !fired {
+		return
+	}
+
+	stats.Firings++
+	stats.LastFired = now
+	m.recent = append(m.recent, Firing{Time: now, Ruleset: ruleset, Rule: key.rule, Label: stats.Label, Variant: variant})
+	if len(m.recent) > maxRecentFirings {
+		m.recent = m.recent[len(m.recent)-maxRecentFirings:]
+	}
+	if len(m.subscribers) > 0 {
+		rule := key.rule
+		m.publish(Event{Type: EventRuleFired, Time: now, CorrelationID: correlationID, Ruleset: ruleset, Rule: &rule, Label: stats.Label, Variant: variant})
+	}
+}
+
+// actionError counts the error and leaves its handling to the other hooks.
+func (m *Monitor) actionError(key ruleKey, ruleset string, err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ruleStats(key, ruleset).ActionErrors++
+	return err
+}
+
+func (m *Monitor) afterCycle(vm *runtime.VM, err error, last bool) {
+	facts, correlationID := vm.Facts(), vm.CorrelationID()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cycleFailed = m.cycleFailed || err != nil
+	if !last {
+		return
+	}
+	m.cycles++
+	if m.cycleFailed {
+		m.cycleErrors++
+	}
+	m.cycleFailed = false
+	now := time.Now()
+	for name, value := range facts {
+		if previous, ok := m.facts[name]; !ok || !reflect.DeepEqual(previous, value) {
+			m.factChanges[name]++
+			if len(m.subscribers) > 0 {
+				m.publish(Event{Type: EventFactChanged, Time: now, CorrelationID: correlationID, Fact: name, Old: previous, New: value})
+			}
+		}
+	}
+	if len(m.subscribers) > 0 {
+		for name, previous := range m.facts {
+			if _, ok := facts[name]; !ok {
+				m.publish(Event{Type: EventFactChanged, Time: now, CorrelationID: correlationID, Fact: name, Old: previous, Deleted: true})
+			}
+		}
+	}
+	m.facts = facts
+}
+
+// ruleLabel returns the display name of a rule: its name, if the bytecode
+// names its rules.
+func (m *Monitor) ruleLabel(key ruleKey) string {
+	if key.ruleset < len(m.labels) && key.rule < len(m.labels[key.ruleset]) && m.labels[key.ruleset][key.rule] != "" {
+		return m.labels[key.ruleset][key.rule]
+	}
+	return fmt.Sprintf("rule %d", key.rule)
+}
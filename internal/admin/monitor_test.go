@@ -0,0 +1,295 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counterProgram builds bytecode for a rule that sets fan_status from the
+// fan_on fact, and a rule that fails because its action has no value.
+func counterProgram() []byte {
+	code := make([]byte, 12) // Header skipped by the VM
+	code = append(code, byte(bytecode.LOAD_FACT))
+	code = append(code, "fan_on\x00"...)
+	code = append(code, byte(bytecode.UPDATE_FACT))
+	code = append(code, "fan_status\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	code = append(code, byte(bytecode.UPDATE_FACT))
+	code = append(code, "broken\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	return code
+}
+
+// markedProgram builds counterProgram's rules with rule markers, the first
+// one with priority 5.
+func markedProgram() []byte {
+	code := make([]byte, 12)
+	code = append(code, byte(bytecode.RULE_START), 5, 0, 0, 0)
+	code = append(code, byte(bytecode.LOAD_FACT))
+	code = append(code, "fan_on\x00"...)
+	code = append(code, byte(bytecode.UPDATE_FACT))
+	code = append(code, "fan_status\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	code = append(code, byte(bytecode.RULE_START), 0, 0, 0, 0)
+	code = append(code, byte(bytecode.UPDATE_FACT))
+	code = append(code, "broken\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	return code
+}
+
+func newMonitoredVM() (*runtime.VM, *Monitor) {
+	vm := runtime.NewVM(counterProgram())
+	monitor := NewMonitor(vm)
+	vm.OnActionError(func(rule int, err error) error { return nil })
+	return vm, monitor
+}
+
+func TestMonitor_Snapshot(t *testing.T) {
+	vm, monitor := newMonitoredVM()
+
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run())
+	require.NoError(t, vm.Run())
+	vm.SetFact("fan_on", false)
+	require.NoError(t, vm.Run())
+
+	snapshot := monitor.Snapshot()
+	assert.Equal(t, 3, snapshot.Cycles)
+	assert.Equal(t, 0, snapshot.CycleErrors)
+	assert.Equal(t, 6, snapshot.Evaluations)
+	require.Len(t, snapshot.Rules, 2)
+	assert.Equal(t, 3, snapshot.Rules[0].Firings)
+	assert.Equal(t, 0, snapshot.Rules[0].ActionErrors)
+	assert.Equal(t, 0, snapshot.Rules[1].Firings)
+	assert.Equal(t, 3, snapshot.Rules[1].ActionErrors)
+	assert.Equal(t, false, snapshot.Facts["fan_status"])
+	assert.Equal(t, 2, snapshot.FactChanges["fan_status"], "fan_status was set in the first cycle and changed in the third")
+	assert.Len(t, snapshot.RecentFirings, 3)
+}
+
+func TestCompositionMonitor_Snapshot(t *testing.T) {
+	// The site ruleset copies fan_status, set by the base ruleset, to vent
+	site := make([]byte, 12)
+	site = append(site, byte(bytecode.LOAD_FACT))
+	site = append(site, "fan_status\x00"...)
+	site = append(site, byte(bytecode.UPDATE_FACT))
+	site = append(site, "vent\x00"...)
+	site = append(site, byte(bytecode.RULE_END))
+
+	c := runtime.NewComposition()
+	base, err := c.Add("base", counterProgram())
+	require.NoError(t, err)
+	base.OnActionError(func(rule int, err error) error { return nil })
+	_, err = c.Add("site", site)
+	require.NoError(t, err)
+	monitor := NewCompositionMonitor(c)
+
+	c.SetFact("fan_on", true)
+	require.NoError(t, c.Run())
+	c.DeleteFact("fan_on")
+	assert.Error(t, c.Run())
+
+	snapshot := monitor.Snapshot()
+	assert.Equal(t, 2, snapshot.Cycles, "a composition cycle counts once")
+	assert.Equal(t, 1, snapshot.CycleErrors)
+	require.Len(t, snapshot.Rules, 3)
+	assert.Equal(t, RuleStats{Ruleset: "base", Rule: 0, Label: "rule 0", Evaluations: 1, Firings: 1}, withoutTimes(snapshot.Rules[0]))
+	assert.Equal(t, "base", snapshot.Rules[1].Ruleset)
+	assert.Equal(t, RuleStats{Ruleset: "site", Rule: 0, Label: "rule 0", Evaluations: 2, Firings: 2}, withoutTimes(snapshot.Rules[2]))
+	assert.Equal(t, true, snapshot.Facts["vent"])
+	assert.Equal(t, "site", snapshot.RecentFirings[1].Ruleset)
+
+	require.Len(t, snapshot.Rulesets, 2)
+	assert.Equal(t, "base", snapshot.Rulesets[0].Name)
+	assert.Equal(t, 1, snapshot.Rulesets[0].CycleErrors)
+	assert.Equal(t, 2, snapshot.Rulesets[1].Cycles)
+	assert.Equal(t, 0, snapshot.Rulesets[1].CycleErrors)
+}
+
+// withoutTimes clears the latencies and firing time of rule statistics.
+func withoutTimes(stats RuleStats) RuleStats {
+	stats.LastFired = time.Time{}
+	stats.TotalLatencySeconds, stats.MaxLatencySeconds = 0, 0
+	return stats
+}
+
+func TestMonitor_ActionErrorsStillAbortWithoutHandler(t *testing.T) {
+	vm := runtime.NewVM(counterProgram())
+	monitor := NewMonitor(vm)
+	vm.SetFact("fan_on", true)
+
+	assert.Error(t, vm.Run())
+	assert.Equal(t, 1, monitor.Snapshot().CycleErrors)
+}
+
+func TestHandler(t *testing.T) {
+	vm, monitor := newMonitoredVM()
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run())
+
+	server := httptest.NewServer(NewHandler(monitor))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/facts")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var facts map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&facts))
+	assert.Equal(t, true, facts["fan_status"])
+
+	resp, err = http.Get(server.URL + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+}
+
+func TestMonitor_Health(t *testing.T) {
+	vm, monitor := newMonitoredVM()
+	vm.SetActionPolicy(runtime.ActionPolicy{FailureThreshold: 1, Cooldown: time.Hour})
+	assert.Equal(t, Health{Status: "ok", OpenBreakers: []string{}}, monitor.Health())
+
+	guard := vm.ActionGuard()
+	assert.Error(t, guard.Invoke(0, "webhook", func(ctx context.Context) error { return errors.New("unreachable") }))
+	assert.Equal(t, Health{Status: "degraded", OpenBreakers: []string{"webhook"}}, monitor.Health())
+
+	breakers := monitor.Snapshot().Breakers
+	require.Len(t, breakers, 1)
+	assert.Equal(t, runtime.BreakerOpen, breakers[0].State)
+	assert.Equal(t, 1, breakers[0].Trips)
+}
+
+func TestMonitor_HealthDegradation(t *testing.T) {
+	vm, monitor := newMonitoredVM()
+	require.NoError(t, vm.SetDegradationPolicy(runtime.DegradationPolicy{
+		Sources:      map[string][]string{"redis": nil, "weather": {"outside_temperature"}},
+		MaxStaleness: time.Hour,
+	}))
+	assert.Equal(t, Health{Status: "ok", OpenBreakers: []string{}}, monitor.Health())
+
+	require.NoError(t, vm.SourceDown("weather", errors.New("timeout")))
+	assert.Equal(t, Health{Status: "degraded", OpenBreakers: []string{}, DownSources: []string{"weather"}}, monitor.Health())
+
+	sources := monitor.Snapshot().Sources
+	require.Len(t, sources, 2)
+	assert.Equal(t, runtime.SourceUp, sources[0].State)
+	assert.Equal(t, runtime.SourceStale, sources[1].State)
+	assert.Equal(t, "timeout", sources[1].LastError)
+
+	require.NoError(t, vm.SourceUp("weather"))
+	assert.Equal(t, "ok", monitor.Health().Status)
+}
+
+func TestHandler_SwitchRules(t *testing.T) {
+	section, err := bytecode.NewRulesSection([]bytecode.RuleSymbol{{Name: "fan", Merged: []string{"alsoFan"}}, {Name: "broken"}})
+	require.NoError(t, err)
+	vm := runtime.NewVM(bytecode.AppendSections(markedProgram(), section))
+	monitor := NewMonitor(vm)
+	server := httptest.NewServer(NewHandler(monitor))
+	defer server.Close()
+
+	post := func(path string) (int, map[string]interface{}) {
+		resp, err := http.Post(server.URL+path, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+		}
+		return resp.StatusCode, decoded
+	}
+
+	status, detail := post("/api/rules/broken/disable")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "broken", detail["name"])
+	assert.Equal(t, false, detail["enabled"])
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run(), "the failing rule is switched off")
+
+	status, detail = post("/api/rules/broken/enable")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, detail["enabled"])
+	assert.Error(t, vm.Run())
+
+	status, _ = post("/api/rules/missing/disable")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = post("/api/rules/alsoFan/disable")
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = post("/api/rules/fan/disable?ruleset=base")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestCompositionMonitor_SetRuleEnabled(t *testing.T) {
+	section, err := bytecode.NewRulesSection([]bytecode.RuleSymbol{{Name: "fan"}, {Name: "broken"}})
+	require.NoError(t, err)
+	c := runtime.NewComposition()
+	_, err = c.Add("base", bytecode.AppendSections(markedProgram(), section))
+	require.NoError(t, err)
+	site, err := c.Add("site", bytecode.AppendSections(markedProgram(), section))
+	require.NoError(t, err)
+	monitor := NewCompositionMonitor(c)
+
+	_, err = monitor.SetRuleEnabled("", "fan", false)
+	assert.EqualError(t, err, "rule 'fan' is in rulesets [base site]; name the ruleset")
+	detail, err := monitor.SetRuleEnabled("site", "fan", false)
+	require.NoError(t, err)
+	assert.Equal(t, "site", detail.Ruleset)
+	assert.False(t, detail.Enabled)
+	assert.False(t, site.Rules()[0].Enabled)
+	assert.True(t, c.VM("base").Rules()[0].Enabled)
+
+	_, err = monitor.SetRuleEnabled("plant", "fan", false)
+	assert.ErrorIs(t, err, runtime.ErrUnknownRule)
+}
+
+func TestMonitor_Rules(t *testing.T) {
+	code := markedProgram()
+	section, err := bytecode.NewRulesSection([]bytecode.RuleSymbol{
+		{Name: "fan", Metadata: map[string]interface{}{"owner": "facilities"}},
+		{Name: "broken"},
+	})
+	require.NoError(t, err)
+	vm := runtime.NewVM(bytecode.AppendSections(code, section))
+	monitor := NewMonitor(vm)
+	vm.OnActionError(func(rule int, err error) error { return nil })
+	require.NoError(t, vm.SetRuleEnabled(1, false))
+
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run())
+
+	details := monitor.Rules()
+	require.Len(t, details, 2)
+	assert.Equal(t, "fan", details[0].Name)
+	assert.Equal(t, 5, details[0].Priority)
+	assert.True(t, details[0].Enabled)
+	assert.Equal(t, []string{"fan_on"}, details[0].Reads)
+	assert.Equal(t, []string{"fan_status"}, details[0].Writes)
+	assert.Equal(t, "facilities", details[0].Metadata["owner"])
+	assert.Equal(t, 1, details[0].Firings)
+	assert.False(t, details[1].Enabled)
+	assert.Equal(t, 0, details[1].Evaluations)
+	assert.Equal(t, "fan", monitor.Snapshot().Rules[0].Label, "rules are labeled with their names")
+
+	server := httptest.NewServer(NewHandler(monitor))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/api/rules/details")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var decoded []map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+	require.Len(t, decoded, 2)
+	assert.Equal(t, "broken", decoded[1]["name"])
+	assert.Equal(t, false, decoded[1]["enabled"])
+	assert.Equal(t, []interface{}{"fan_status"}, decoded[0]["writes"])
+}
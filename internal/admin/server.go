@@ -0,0 +1,103 @@
+// admin/server.go
+
+package admin
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"rgehrsitz/rex/internal/runtime"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// NewHandler returns an http.Handler serving the admin API for the monitor,
+// and the web dashboard built on it at /.
+//
+//	GET /api/snapshot       all statistics
+//	GET /api/rules          per-rule statistics
+//	GET /api/rules/details  loaded rules with their metadata, state, facts and statistics
+//	GET /api/facts          current fact values
+//	GET /api/firings        recent rule firings
+//	GET /api/breakers       action handler circuit breakers
+//	GET /api/health         overall health
+//	GET /api/events         live rule firings, fact changes and actions (WebSocket)
+//
+// and switches for the rules, which answer with the rule's details:
+//
+//	POST /api/rules/{name}/enable   enable a rule
+//	POST /api/rules/{name}/disable  disable a rule, as a kill switch
+//
+// In a composition, ?ruleset= names the ruleset of a rule whose name several
+// rulesets use.
+func NewHandler(m *Monitor) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Snapshot())
+	})
+	mux.HandleFunc("GET /api/rules", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Snapshot().Rules)
+	})
+	mux.HandleFunc("GET /api/rules/details", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Rules())
+	})
+	mux.HandleFunc("GET /api/facts", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Snapshot().Facts)
+	})
+	mux.HandleFunc("GET /api/firings", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Snapshot().RecentFirings)
+	})
+	mux.HandleFunc("GET /api/breakers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Snapshot().Breakers)
+	})
+	mux.HandleFunc("GET /api/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Health())
+	})
+	mux.Handle("GET /api/events", eventsHandler(m))
+	mux.HandleFunc("POST /api/rules/{name}/enable", func(w http.ResponseWriter, r *http.Request) {
+		setRuleEnabled(w, r, m, true)
+	})
+	mux.HandleFunc("POST /api/rules/{name}/disable", func(w http.ResponseWriter, r *http.Request) {
+		setRuleEnabled(w, r, m, false)
+	})
+
+	dashboard, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("GET /", http.FileServerFS(dashboard))
+
+	return mux
+}
+
+// setRuleEnabled enables or disables the rule named in the request path,
+// answering 404 Not Found for a rule the runtime doesn't have and 409
+// Conflict for one it can't switch, such as a rule merged into another.
+func setRuleEnabled(w http.ResponseWriter, r *http.Request, m *Monitor, enabled bool) {
+	name, ruleset := r.PathValue("name"), r.URL.Query().Get("ruleset")
+	detail, err := m.SetRuleEnabled(ruleset, name, enabled)
+	switch {
+	case errors.Is(err, runtime.ErrUnknownRule):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Info().Str("Rule", name).Str("Ruleset", ruleset).Bool("Enabled", enabled).Str("RemoteAddr", r.RemoteAddr).Msg("Rule switched through the admin API")
+	writeJSON(w, detail)
+}
+
+// writeJSON writes value as the JSON response body.
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Error().Err(err).Msg("Failed to write admin API response")
+	}
+}
@@ -0,0 +1,138 @@
+// audit/recorder.go
+
+package audit
+
+import (
+	"reflect"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// pruneInterval is the minimum time between two retention passes.
+const pruneInterval = time.Minute
+
+// Recorder records the evaluation cycles of a VM in a Store through the VM's
+// hooks. Each cycle is written in a single transaction once it has finished.
+type Recorder struct {
+	mu        sync.Mutex
+	vm        *runtime.VM
+	store     *Store
+	retention time.Duration // Records older than this are pruned; 0 keeps them forever
+	lastPrune time.Time
+
+	current Evaluation             // The cycle in progress
+	facts   map[string]interface{} // Fact values before the cycle in progress
+}
+
+// NewRecorder creates a Recorder and registers its hooks on vm. Records are
+// timestamped, and pruned, by the VM's clock.
+func NewRecorder(vm *runtime.VM, store *Store, retention time.Duration) *Recorder {
+	r := &Recorder{
+		vm:        vm,
+		store:     store,
+		retention: retention,
+	}
+	vm.OnBeforeCycle(r.beforeCycle)
+	vm.OnAfterRule(r.afterRule)
+	vm.OnActionError(r.actionError)
+	vm.OnActionSuppressed(r.actionSuppressed)
+	vm.OnAfterCycle(r.afterCycle)
+	return r
+}
+
+func (r *Recorder) beforeCycle() error {
+	facts := r.vm.Facts()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current = Evaluation{Time: r.vm.Clock().Now(), CorrelationID: r.vm.CorrelationID(), Provenance: r.provenance()}
+	r.facts = facts
+	return nil
+}
+
+// provenance returns the provenance of the VM's bytecode, nil if unknown.
+func (r *Recorder) provenance() *bytecode.Provenance {
+	if provenance, ok := r.vm.Provenance(); ok {
+		return &provenance
+	}
+	return nil
+}
+
+func (r *Recorder) afterRule(rule int, fired bool) {
+	if !fired {
+		return
+	}
+	variant := r.vm.Variant()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current.Firings = append(r.current.Firings, Firing{Time: r.vm.Clock().Now(), Rule: rule, Variant: variant})
+}
+
+// actionError records the failure and leaves its handling to the other hooks.
+func (r *Recorder) actionError(rule int, err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current.Actions = append(r.current.Actions, ActionOutcome{Time: r.vm.Clock().Now(), Rule: rule, Error: err.Error()})
+	return err
+}
+
+func (r *Recorder) actionSuppressed(action runtime.Action, window string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current.Actions = append(r.current.Actions, ActionOutcome{
+		Time:       r.vm.Clock().Now(),
+		Rule:       action.Rule,
+		Type:       action.Type,
+		Target:     action.Target,
+		Suppressed: window,
+	})
+}
+
+func (r *Recorder) afterCycle(err error) {
+	facts := r.vm.Facts()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	evaluation := r.current
+	r.current = Evaluation{}
+	if evaluation.Time.IsZero() {
+		// An earlier BeforeCycle hook aborted the cycle before it started
+		evaluation.Time = r.vm.Clock().Now()
+		evaluation.CorrelationID = r.vm.CorrelationID()
+		evaluation.Provenance = r.provenance()
+		r.facts = facts
+	}
+	now := r.vm.Clock().Now()
+	evaluation.Duration = now.Sub(evaluation.Time)
+	if err != nil {
+		evaluation.Error = err.Error()
+	}
+	evaluation.Changes = make(map[string]interface{})
+	for name, value := range facts {
+		if previous, ok := r.facts[name]; !ok || !reflect.DeepEqual(previous, value) {
+			evaluation.Changes[name] = value
+		}
+	}
+
+	if err := r.store.RecordEvaluation(&evaluation); err != nil {
+		log.Error().Err(err).Msg("Failed to record evaluation in the audit store")
+	}
+
+	if r.retention > 0 && now.Sub(r.lastPrune) >= pruneInterval {
+		r.lastPrune = now
+		if deleted, err := r.store.Prune(now.Add(-r.retention)); err != nil {
+			log.Error().Err(err).Msg("Failed to prune the audit store")
+		} else if deleted > 0 {
+			log.Debug().Int64("Records", deleted).Msg("Pruned audit records")
+		}
+	}
+}
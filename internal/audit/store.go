@@ -0,0 +1,404 @@
+// audit/store.go
+
+// Package audit keeps a durable local history of evaluation cycles, rule
+// firings and action outcomes in an embedded SQLite database.
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Registers the "sqlite" driver
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS evaluations (
+	id               INTEGER PRIMARY KEY,
+	time             INTEGER NOT NULL,           -- Unix nanoseconds
+	duration         INTEGER NOT NULL,           -- Nanoseconds
+	error            TEXT NOT NULL,
+	changes          TEXT NOT NULL,              -- JSON object of the facts the cycle changed
+	correlation_id   TEXT NOT NULL DEFAULT '',
+	ruleset_hash     TEXT NOT NULL DEFAULT '',   -- Provenance of the bytecode, empty if unknown
+	compiler_version TEXT NOT NULL DEFAULT '',
+	compiled_at      INTEGER NOT NULL DEFAULT 0  -- Unix nanoseconds, 0 if unknown
+);
+CREATE INDEX IF NOT EXISTS evaluations_time ON evaluations(time);
+
+CREATE TABLE IF NOT EXISTS firings (
+	evaluation_id INTEGER NOT NULL,
+	time          INTEGER NOT NULL,
+	rule          INTEGER NOT NULL,
+	variant       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS firings_rule_time ON firings(rule, time);
+CREATE INDEX IF NOT EXISTS firings_time ON firings(time);
+
+CREATE TABLE IF NOT EXISTS actions (
+	evaluation_id    INTEGER NOT NULL, -- 0 for actions recorded outside a cycle
+	time             INTEGER NOT NULL,
+	rule             INTEGER NOT NULL,
+	type             TEXT NOT NULL,
+	target           TEXT NOT NULL,
+	error            TEXT NOT NULL,
+	correlation_id   TEXT NOT NULL DEFAULT '',
+	ruleset_hash     TEXT NOT NULL DEFAULT '',
+	compiler_version TEXT NOT NULL DEFAULT '',
+	compiled_at      INTEGER NOT NULL DEFAULT 0,
+	suppressed       TEXT NOT NULL DEFAULT ''  -- Suppression window that withheld the action, empty if it wasn't
+);
+CREATE INDEX IF NOT EXISTS actions_rule_time ON actions(rule, time);
+CREATE INDEX IF NOT EXISTS actions_time ON actions(time);
+`
+
+// addedColumns lists the columns added to the tables since they were first
+// created, which databases written by earlier versions lack.
+var addedColumns = []struct{ table, column, definition string }{
+	{"evaluations", "correlation_id", "TEXT NOT NULL DEFAULT ''"},
+	{"actions", "correlation_id", "TEXT NOT NULL DEFAULT ''"},
+	{"evaluations", "ruleset_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"evaluations", "compiler_version", "TEXT NOT NULL DEFAULT ''"},
+	{"evaluations", "compiled_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"actions", "ruleset_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"actions", "compiler_version", "TEXT NOT NULL DEFAULT ''"},
+	{"actions", "compiled_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"actions", "suppressed", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// addedIndexes are created once the added columns exist.
+const addedIndexes = `
+CREATE INDEX IF NOT EXISTS evaluations_correlation ON evaluations(correlation_id);
+CREATE INDEX IF NOT EXISTS actions_correlation ON actions(correlation_id);
+CREATE INDEX IF NOT EXISTS evaluations_ruleset ON evaluations(ruleset_hash);
+CREATE INDEX IF NOT EXISTS actions_ruleset ON actions(ruleset_hash);
+`
+
+// Evaluation is the record of an evaluation cycle.
+type Evaluation struct {
+	ID            int64                  `json:"id"`
+	CorrelationID string                 `json:"correlationId,omitempty"`
+	Provenance    *bytecode.Provenance   `json:"provenance,omitempty"` // Ruleset revision evaluated, nil if unknown
+	Time          time.Time              `json:"time"`
+	Duration      time.Duration          `json:"duration"`
+	Error         string                 `json:"error,omitempty"`
+	Changes       map[string]interface{} `json:"changes"` // New values of the facts the cycle changed
+	Firings       []Firing               `json:"-"`       // Recorded along with the evaluation
+	Actions       []ActionOutcome        `json:"-"`       // Recorded along with the evaluation
+}
+
+// Firing is the record of a rule firing.
+type Firing struct {
+	EvaluationID int64     `json:"evaluationId"`
+	Time         time.Time `json:"time"`
+	Rule         int       `json:"rule"`
+	Variant      string    `json:"variant,omitempty"`
+	RulesetHash  string    `json:"rulesetHash,omitempty"` // Hash of the ruleset revision of the evaluation
+}
+
+// ActionOutcome is the record of an action that was performed, failed or was
+// withheld by a suppression window.
+type ActionOutcome struct {
+	EvaluationID  int64                `json:"evaluationId,omitempty"`
+	CorrelationID string               `json:"correlationId,omitempty"` // Correlation ID of the cycle that triggered the action
+	Provenance    *bytecode.Provenance `json:"provenance,omitempty"`    // Ruleset revision whose rule triggered the action
+	Time          time.Time            `json:"time"`
+	Rule          int                  `json:"rule"`
+	Type          string               `json:"type,omitempty"`
+	Target        string               `json:"target,omitempty"`
+	Error         string               `json:"error,omitempty"`      // Empty if the action succeeded
+	Suppressed    string               `json:"suppressed,omitempty"` // Suppression window that withheld the action
+}
+
+// Query selects records. Zero fields don't restrict the selection.
+type Query struct {
+	Rule          *int      // Only records of this rule
+	CorrelationID string    // Only records of the cycle with this correlation ID
+	RulesetHash   string    // Only records of the ruleset revision with this hash or hash prefix
+	Since         time.Time // Only records at or after this time
+	Limit         int       // At most this many records, the most recent ones
+}
+
+// Store is an audit database.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens the audit database at path, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit database: %w", err)
+	}
+	// SQLite allows a single writer; serializing access through one
+	// connection avoids "database is locked" errors
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create audit schema: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade audit schema: %w", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// migrate adds the columns that databases written by earlier versions lack.
+func migrate(db *sql.DB) error {
+	for _, added := range addedColumns {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, added.table, added.column).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE ` + added.table + ` ADD COLUMN ` + added.column + ` ` + added.definition); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(addedIndexes)
+	return err
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// RecordEvaluation stores an evaluation with its firings and actions, and
+// sets its ID.
+func (s *Store) RecordEvaluation(evaluation *Evaluation) error {
+	changes, err := json.Marshal(evaluation.Changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode fact changes: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hash, version, compiledAt := provenanceColumns(evaluation.Provenance)
+	result, err := tx.Exec(`INSERT INTO evaluations (time, duration, error, changes, correlation_id, ruleset_hash, compiler_version, compiled_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		evaluation.Time.UnixNano(), int64(evaluation.Duration), evaluation.Error, string(changes), evaluation.CorrelationID, hash, version, compiledAt)
+	if err != nil {
+		return fmt.Errorf("failed to record evaluation: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, firing := range evaluation.Firings {
+		if _, err := tx.Exec(`INSERT INTO firings (evaluation_id, time, rule, variant) VALUES (?, ?, ?, ?)`,
+			id, firing.Time.UnixNano(), firing.Rule, firing.Variant); err != nil {
+			return fmt.Errorf("failed to record firing: %w", err)
+		}
+	}
+	for _, action := range evaluation.Actions {
+		action.EvaluationID = id
+		if action.CorrelationID == "" {
+			action.CorrelationID = evaluation.CorrelationID
+		}
+		if action.Provenance == nil {
+			action.Provenance = evaluation.Provenance
+		}
+		if err := recordAction(tx, action); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	evaluation.ID = id
+	return nil
+}
+
+// RecordAction stores the outcome of an action performed outside an
+// evaluation cycle, such as one delivered by an ActionPipeline.
+func (s *Store) RecordAction(action ActionOutcome) error {
+	return recordAction(s.db, action)
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func recordAction(db execer, action ActionOutcome) error {
+	hash, version, compiledAt := provenanceColumns(action.Provenance)
+	_, err := db.Exec(`INSERT INTO actions (evaluation_id, time, rule, type, target, error, correlation_id, ruleset_hash, compiler_version, compiled_at, suppressed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		action.EvaluationID, action.Time.UnixNano(), action.Rule, action.Type, action.Target, action.Error, action.CorrelationID, hash, version, compiledAt, action.Suppressed)
+	if err != nil {
+		return fmt.Errorf("failed to record action: %w", err)
+	}
+	return nil
+}
+
+// provenanceColumns returns the column values of a provenance, which are
+// empty if it is unknown.
+func provenanceColumns(provenance *bytecode.Provenance) (string, string, int64) {
+	if provenance == nil {
+		return "", "", 0
+	}
+	var compiledAt int64
+	if !provenance.CompiledAt.IsZero() {
+		compiledAt = provenance.CompiledAt.UnixNano()
+	}
+	return provenance.RulesetHash, provenance.CompilerVersion, compiledAt
+}
+
+// scanProvenance returns the provenance read from its columns, nil if the
+// record has none.
+func scanProvenance(hash, version string, compiledAt int64) *bytecode.Provenance {
+	if hash == "" {
+		return nil
+	}
+	provenance := &bytecode.Provenance{RulesetHash: hash, CompilerVersion: version}
+	if compiledAt != 0 {
+		provenance.CompiledAt = time.Unix(0, compiledAt).UTC()
+	}
+	return provenance
+}
+
+// Prune deletes the records older than before and returns how many were
+// deleted.
+func (s *Store) Prune(before time.Time) (int64, error) {
+	var deleted int64
+	for _, table := range []string{"evaluations", "firings", "actions"} {
+		result, err := s.db.Exec(`DELETE FROM `+table+` WHERE time < ?`, before.UnixNano())
+		if err != nil {
+			return deleted, fmt.Errorf("failed to prune %s: %w", table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// Evaluations returns the evaluations selected by query, most recent first.
+// Query.Rule selects the evaluations in which the rule fired.
+func (s *Store) Evaluations(query Query) ([]Evaluation, error) {
+	where, args := query.where("id IN (SELECT evaluation_id FROM firings WHERE rule = ?)", "correlation_id = ?", "ruleset_hash LIKE ? || '%'")
+	rows, err := s.db.Query(`SELECT id, time, duration, error, changes, correlation_id, ruleset_hash, compiler_version, compiled_at FROM evaluations`+where+` ORDER BY time DESC, id DESC`+query.limit(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query evaluations: %w", err)
+	}
+	defer rows.Close()
+
+	evaluations := []Evaluation{}
+	for rows.Next() {
+		var evaluation Evaluation
+		var nanos, duration, compiledAt int64
+		var changes, hash, version string
+		if err := rows.Scan(&evaluation.ID, &nanos, &duration, &evaluation.Error, &changes, &evaluation.CorrelationID, &hash, &version, &compiledAt); err != nil {
+			return nil, err
+		}
+		evaluation.Provenance = scanProvenance(hash, version, compiledAt)
+		evaluation.Time = time.Unix(0, nanos)
+		evaluation.Duration = time.Duration(duration)
+		if err := json.Unmarshal([]byte(changes), &evaluation.Changes); err != nil {
+			return nil, fmt.Errorf("failed to decode fact changes of evaluation %d: %w", evaluation.ID, err)
+		}
+		evaluations = append(evaluations, evaluation)
+	}
+	return evaluations, rows.Err()
+}
+
+// Firings returns the firings selected by query, most recent first.
+func (s *Store) Firings(query Query) ([]Firing, error) {
+	where, args := query.where("rule = ?",
+		"evaluation_id IN (SELECT id FROM evaluations WHERE correlation_id = ?)",
+		"evaluation_id IN (SELECT id FROM evaluations WHERE ruleset_hash LIKE ? || '%')")
+	rows, err := s.db.Query(`SELECT evaluation_id, time, rule, variant,
+		(SELECT ruleset_hash FROM evaluations WHERE evaluations.id = firings.evaluation_id) FROM firings`+where+` ORDER BY time DESC, rowid DESC`+query.limit(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query firings: %w", err)
+	}
+	defer rows.Close()
+
+	firings := []Firing{}
+	for rows.Next() {
+		var firing Firing
+		var nanos int64
+		var hash sql.NullString
+		if err := rows.Scan(&firing.EvaluationID, &nanos, &firing.Rule, &firing.Variant, &hash); err != nil {
+			return nil, err
+		}
+		firing.Time = time.Unix(0, nanos)
+		firing.RulesetHash = hash.String
+		firings = append(firings, firing)
+	}
+	return firings, rows.Err()
+}
+
+// Actions returns the action outcomes selected by query, most recent first.
+func (s *Store) Actions(query Query) ([]ActionOutcome, error) {
+	where, args := query.where("rule = ?", "correlation_id = ?", "ruleset_hash LIKE ? || '%'")
+	rows, err := s.db.Query(`SELECT evaluation_id, time, rule, type, target, error, correlation_id, ruleset_hash, compiler_version, compiled_at, suppressed FROM actions`+where+` ORDER BY time DESC, rowid DESC`+query.limit(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query actions: %w", err)
+	}
+	defer rows.Close()
+
+	actions := []ActionOutcome{}
+	for rows.Next() {
+		var action ActionOutcome
+		var nanos, compiledAt int64
+		var hash, version string
+		if err := rows.Scan(&action.EvaluationID, &nanos, &action.Rule, &action.Type, &action.Target, &action.Error, &action.CorrelationID, &hash, &version, &compiledAt, &action.Suppressed); err != nil {
+			return nil, err
+		}
+		action.Provenance = scanProvenance(hash, version, compiledAt)
+		action.Time = time.Unix(0, nanos)
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// where returns the WHERE clause selecting the query's records, given the
+// conditions selecting a rule, a correlation ID and a ruleset hash prefix.
+func (q Query) where(ruleCondition, correlationCondition, rulesetCondition string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if q.Rule != nil {
+		conditions = append(conditions, ruleCondition)
+		args = append(args, *q.Rule)
+	}
+	if q.CorrelationID != "" {
+		conditions = append(conditions, correlationCondition)
+		args = append(args, q.CorrelationID)
+	}
+	if q.RulesetHash != "" {
+		conditions = append(conditions, rulesetCondition)
+		args = append(args, q.RulesetHash)
+	}
+	if !q.Since.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// limit returns the LIMIT clause of the query.
+func (q Query) limit() string {
+	if q.Limit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d", q.Limit)
+}
@@ -0,0 +1,251 @@
+package audit
+
+import (
+	"database/sql"
+	"path/filepath"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestStore(t *testing.T) *Store {
+	store, err := Open(filepath.Join(t.TempDir(), "audit.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStore_RecordAndQuery(t *testing.T) {
+	store := openTestStore(t)
+	start := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		at := start.Add(time.Duration(i) * time.Hour)
+		evaluation := &Evaluation{
+			Time:     at,
+			Duration: time.Millisecond,
+			Changes:  map[string]interface{}{"count": float64(i)},
+			Firings:  []Firing{{Time: at, Rule: i % 2, Variant: "A"}},
+			Actions:  []ActionOutcome{{Time: at, Rule: 1, Error: "no value"}},
+		}
+		require.NoError(t, store.RecordEvaluation(evaluation))
+		assert.Equal(t, int64(i+1), evaluation.ID)
+	}
+	require.NoError(t, store.RecordAction(ActionOutcome{Time: start, Rule: 0, Type: "webhook", Target: "ops"}))
+
+	rule := 0
+	firings, err := store.Firings(Query{Rule: &rule})
+	require.NoError(t, err)
+	require.Len(t, firings, 2)
+	assert.Equal(t, Firing{EvaluationID: 3, Time: start.Add(2 * time.Hour), Rule: 0, Variant: "A"}, firings[0])
+
+	firings, err = store.Firings(Query{Since: start.Add(time.Hour), Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, firings, 1)
+	assert.Equal(t, int64(3), firings[0].EvaluationID)
+
+	evaluations, err := store.Evaluations(Query{Rule: &rule})
+	require.NoError(t, err)
+	require.Len(t, evaluations, 2)
+	assert.Equal(t, map[string]interface{}{"count": float64(2)}, evaluations[0].Changes)
+	assert.Equal(t, time.Millisecond, evaluations[0].Duration)
+
+	actions, err := store.Actions(Query{Rule: &rule})
+	require.NoError(t, err)
+	assert.Equal(t, []ActionOutcome{{Time: start, Rule: 0, Type: "webhook", Target: "ops"}}, actions)
+
+	deleted, err := store.Prune(start.Add(90 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), deleted, "two evaluations with their firing and action, and the standalone action")
+	evaluations, err = store.Evaluations(Query{})
+	require.NoError(t, err)
+	assert.Len(t, evaluations, 1)
+}
+
+func TestRecorder_CorrelationID(t *testing.T) {
+	store := openTestStore(t)
+	vm := runtime.NewVM(auditProgram())
+	NewRecorder(vm, store, time.Hour)
+	vm.OnActionError(func(rule int, err error) error { return nil })
+
+	vm.SetFact("fan_on", true)
+	vm.SetCorrelationID("reading-7")
+	require.NoError(t, vm.Run())
+	require.NoError(t, vm.Run())
+
+	// A cycle's evaluation, firings and actions are found by its ID
+	query := Query{CorrelationID: "reading-7"}
+	evaluations, err := store.Evaluations(query)
+	require.NoError(t, err)
+	require.Len(t, evaluations, 1)
+	assert.Equal(t, "reading-7", evaluations[0].CorrelationID)
+	firings, err := store.Firings(query)
+	require.NoError(t, err)
+	require.Len(t, firings, 1)
+	assert.Equal(t, evaluations[0].ID, firings[0].EvaluationID)
+	actions, err := store.Actions(query)
+	require.NoError(t, err)
+	require.Len(t, actions, 1)
+	assert.Equal(t, "reading-7", actions[0].CorrelationID)
+
+	evaluations, err = store.Evaluations(Query{})
+	require.NoError(t, err)
+	assert.NotEqual(t, "reading-7", evaluations[0].CorrelationID)
+	assert.NotEmpty(t, evaluations[0].CorrelationID)
+}
+
+func TestRecorder_Provenance(t *testing.T) {
+	provenance := bytecode.Provenance{RulesetHash: "4c6f0e3b9a2d7f18", CompilerVersion: "v1.4.0", CompiledAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	section, err := bytecode.NewProvenanceSection(provenance)
+	require.NoError(t, err)
+	store := openTestStore(t)
+	vm := runtime.NewVM(bytecode.AppendSections(auditProgram(), section))
+	NewRecorder(vm, store, time.Hour)
+	vm.OnActionError(func(rule int, err error) error { return nil })
+
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run())
+
+	// Every record names the ruleset revision, selected by a hash prefix
+	query := Query{RulesetHash: "4c6f0e"}
+	evaluations, err := store.Evaluations(query)
+	require.NoError(t, err)
+	require.Len(t, evaluations, 1)
+	assert.Equal(t, &provenance, evaluations[0].Provenance)
+	firings, err := store.Firings(query)
+	require.NoError(t, err)
+	require.Len(t, firings, 1)
+	assert.Equal(t, provenance.RulesetHash, firings[0].RulesetHash)
+	actions, err := store.Actions(query)
+	require.NoError(t, err)
+	require.Len(t, actions, 1)
+	assert.Equal(t, &provenance, actions[0].Provenance)
+
+	evaluations, err = store.Evaluations(Query{RulesetHash: "9f86d0"})
+	require.NoError(t, err)
+	assert.Empty(t, evaluations)
+}
+
+func TestOpen_AddsCorrelationColumns(t *testing.T) {
+	// A database written before correlation IDs were recorded
+	path := filepath.Join(t.TempDir(), "audit.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE evaluations (id INTEGER PRIMARY KEY, time INTEGER NOT NULL, duration INTEGER NOT NULL, error TEXT NOT NULL, changes TEXT NOT NULL);
+		CREATE TABLE actions (evaluation_id INTEGER NOT NULL, time INTEGER NOT NULL, rule INTEGER NOT NULL, type TEXT NOT NULL, target TEXT NOT NULL, error TEXT NOT NULL);
+		INSERT INTO evaluations (time, duration, error, changes) VALUES (1, 1, '', '{}');`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	store, err := Open(path)
+	require.NoError(t, err)
+	defer store.Close()
+	require.NoError(t, store.RecordAction(ActionOutcome{Time: time.Unix(2, 0), Type: "webhook", CorrelationID: "reading-7"}))
+
+	evaluations, err := store.Evaluations(Query{})
+	require.NoError(t, err)
+	require.Len(t, evaluations, 1)
+	assert.Empty(t, evaluations[0].CorrelationID)
+	assert.Nil(t, evaluations[0].Provenance)
+	actions, err := store.Actions(Query{CorrelationID: "reading-7"})
+	require.NoError(t, err)
+	assert.Len(t, actions, 1)
+}
+
+// auditProgram builds bytecode for a rule that sets fan_status from the
+// fan_on fact, and a rule whose action fails because it has no value.
+func auditProgram() []byte {
+	code := make([]byte, 12) // Header skipped by the VM
+	code = append(code, byte(bytecode.LOAD_FACT))
+	code = append(code, "fan_on\x00"...)
+	code = append(code, byte(bytecode.UPDATE_FACT))
+	code = append(code, "fan_status\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	code = append(code, byte(bytecode.UPDATE_FACT))
+	code = append(code, "broken\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	return code
+}
+
+func TestRecorder(t *testing.T) {
+	store := openTestStore(t)
+	vm := runtime.NewVM(auditProgram())
+	NewRecorder(vm, store, time.Hour)
+	vm.OnActionError(func(rule int, err error) error { return nil })
+
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run())
+	require.NoError(t, vm.Run())
+
+	evaluations, err := store.Evaluations(Query{})
+	require.NoError(t, err)
+	require.Len(t, evaluations, 2)
+	assert.Empty(t, evaluations[0].Changes, "the second cycle didn't change any fact")
+	assert.Equal(t, map[string]interface{}{"fan_status": true}, evaluations[1].Changes)
+
+	firings, err := store.Firings(Query{})
+	require.NoError(t, err)
+	require.Len(t, firings, 2)
+	assert.Equal(t, 0, firings[0].Rule)
+
+	actions, err := store.Actions(Query{})
+	require.NoError(t, err)
+	require.Len(t, actions, 2)
+	assert.Equal(t, 1, actions[0].Rule)
+	assert.NotEmpty(t, actions[0].Error)
+}
+
+func TestRecorder_UsesVMClock(t *testing.T) {
+	store := openTestStore(t)
+	vm := runtime.NewVM(auditProgram())
+	clock := runtime.NewTestClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	vm.SetClock(clock)
+	NewRecorder(vm, store, time.Hour)
+	vm.OnActionError(func(rule int, err error) error { return nil })
+
+	vm.SetFact("fan_on", true)
+	require.NoError(t, vm.Run())
+	clock.Advance(2 * time.Hour)
+	require.NoError(t, vm.Run())
+
+	// The first cycle is older than the retention once the clock has moved
+	evaluations, err := store.Evaluations(Query{})
+	require.NoError(t, err)
+	require.Len(t, evaluations, 1)
+	assert.True(t, evaluations[0].Time.Equal(clock.Now()), "recorded at %v", evaluations[0].Time)
+	assert.Zero(t, evaluations[0].Duration)
+}
+
+func TestRecorder_SuppressedActions(t *testing.T) {
+	store := openTestStore(t)
+	code := make([]byte, 12) // Header skipped by the VM
+	code = append(code, byte(bytecode.LOAD_CONST_STRING))
+	code = append(code, "on\x00"...)
+	code = append(code, byte(bytecode.TRIGGER_ACTION))
+	code = append(code, "notify\x00hvac.unit3\x00"...)
+	code = append(code, byte(bytecode.RULE_END))
+	vm := runtime.NewVM(code)
+	clock := runtime.NewTestClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	vm.SetClock(clock)
+	NewRecorder(vm, store, time.Hour)
+	require.NoError(t, vm.Suppress(runtime.SuppressionWindow{Name: "hvac service", End: clock.Now().Add(time.Hour), Target: "hvac.*"}))
+
+	require.NoError(t, vm.Run())
+
+	// The firing is recorded along with the action it didn't perform
+	firings, err := store.Firings(Query{})
+	require.NoError(t, err)
+	assert.Len(t, firings, 1)
+	actions, err := store.Actions(Query{})
+	require.NoError(t, err)
+	require.Len(t, actions, 1)
+	assert.Equal(t, "notify", actions[0].Type)
+	assert.Equal(t, "hvac.unit3", actions[0].Target)
+	assert.Equal(t, "hvac service", actions[0].Suppressed)
+	assert.Empty(t, actions[0].Error)
+}
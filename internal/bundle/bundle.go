@@ -0,0 +1,295 @@
+// bundle/bundle.go
+
+// Package bundle packages compiled bytecode with the runtime configuration
+// it is deployed with into a single signed file, so that a fleet is updated,
+// or rolled back, by replacing one file. A bundle is a gzipped tar archive
+// holding:
+//
+//   - manifest.json, listing the other files with their sizes and SHA-256
+//     hashes, and the provenance of the bytecode;
+//   - manifest.sig, the Ed25519 signature of manifest.json;
+//   - bytecode.bin, the bytecode;
+//   - runtime.json, the runtime configuration, if any;
+//   - factschema.json, the fact schema compiled into the bytecode, if any,
+//     for the tools validating the facts sent to the runtime.
+//
+// Read verifies the signature and every hash before returning anything, so
+// that a runtime loads either the whole bundle or none of it.
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"sort"
+	"time"
+)
+
+// Names of the files of a bundle.
+const (
+	ManifestFile   = "manifest.json"
+	SignatureFile  = "manifest.sig"
+	BytecodeFile   = "bytecode.bin"
+	ConfigFile     = "runtime.json"
+	FactSchemaFile = "factschema.json"
+)
+
+// FormatVersion is the version of the bundle format written by Write.
+const FormatVersion = 1
+
+// MaxFileSize bounds the size of each file Read extracts from a bundle.
+const MaxFileSize = 64 << 20
+
+// Manifest describes the contents of a bundle.
+type Manifest struct {
+	FormatVersion int                  `json:"formatVersion"`
+	CreatedAt     time.Time            `json:"createdAt"`
+	Provenance    *bytecode.Provenance `json:"provenance,omitempty"` // Provenance of the bytecode, if it has one
+	Files         []File               `json:"files"`
+}
+
+// File is a file of a bundle listed in its manifest.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // Hex-encoded
+}
+
+// Config is the runtime configuration of a bundle.
+type Config struct {
+	// Flags sets runtime flags by name, e.g. "redis": "redis:6379" or
+	// "maxinstructions": 5000. Flags given on the command line take
+	// precedence.
+	Flags map[string]interface{} `json:"flags,omitempty"`
+
+	// Suppressions replaces the file of -suppressions.
+	Suppressions *runtime.SuppressionConfig `json:"suppressions,omitempty"`
+}
+
+// excludedFlags are the runtime flags a bundle can't set: those locating the
+// bundle itself, the suppressions it embeds instead, and plugins, which must
+// be installed on the target rather than named by the bundle.
+var excludedFlags = map[string]bool{"bundle": true, "bundlekey": true, "suppressions": true, "plugins": true}
+
+// Validate checks the suppression windows and that every flag is one a
+// bundle may set, with a string, number or boolean value. Whether the
+// runtime has a flag of that name is checked when the bundle is loaded.
+func (c *Config) Validate() error {
+	for _, name := range sortedKeys(c.Flags) {
+		if excludedFlags[name] {
+			return fmt.Errorf("a bundle can't set -%s", name)
+		}
+		switch c.Flags[name].(type) {
+		case string, float64, bool:
+		default:
+			return fmt.Errorf("flag %s must be a string, number or boolean", name)
+		}
+	}
+	if c.Suppressions != nil {
+		return c.Suppressions.Validate()
+	}
+	return nil
+}
+
+// FlagValues returns the flags of the configuration formatted as they would
+// be on the command line.
+func (c *Config) FlagValues() map[string]string {
+	values := make(map[string]string, len(c.Flags))
+	for name, value := range c.Flags {
+		values[name] = fmt.Sprint(value)
+	}
+	return values
+}
+
+// Bundle is the contents of a bundle.
+type Bundle struct {
+	Manifest   Manifest
+	Bytecode   []byte
+	Config     *Config             // Nil if the bundle has no runtime configuration
+	FactSchema bytecode.FactSchema // Nil if the bytecode has no fact schema
+}
+
+// New returns a bundle of bytecode and its runtime configuration, which may
+// be nil. The fact schema and provenance are read from the bytecode.
+func New(image []byte, config *Config) (*Bundle, error) {
+	_, sections, err := bytecode.SplitSections(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bytecode: %w", err)
+	}
+	if config != nil {
+		if err := config.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid runtime configuration: %w", err)
+		}
+	}
+	b := &Bundle{Manifest: Manifest{FormatVersion: FormatVersion}, Bytecode: image, Config: config}
+	if b.FactSchema, _, err = bytecode.ReadSchema(sections); err != nil {
+		return nil, err
+	}
+	provenance, ok, err := bytecode.ReadProvenance(sections)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		b.Manifest.Provenance = &provenance
+	}
+	return b, nil
+}
+
+// Write writes the bundle to w, signed with key, filling in its manifest. The
+// creation time is kept if already set.
+func (b *Bundle) Write(w io.Writer, key ed25519.PrivateKey) error {
+	contents := map[string][]byte{BytecodeFile: b.Bytecode}
+	names := []string{BytecodeFile}
+	addJSON := func(name string, value interface{}) error {
+		data, err := json.MarshalIndent(value, "", "  ")
+		contents[name] = data
+		names = append(names, name)
+		return err
+	}
+	if b.Config != nil {
+		if err := addJSON(ConfigFile, b.Config); err != nil {
+			return err
+		}
+	}
+	if b.FactSchema != nil {
+		if err := addJSON(FactSchemaFile, b.FactSchema); err != nil {
+			return err
+		}
+	}
+
+	if b.Manifest.CreatedAt.IsZero() {
+		b.Manifest.CreatedAt = time.Now().UTC()
+	}
+	b.Manifest.FormatVersion = FormatVersion
+	b.Manifest.Files = nil
+	for _, name := range names {
+		hash := sha256.Sum256(contents[name])
+		b.Manifest.Files = append(b.Manifest.Files, File{Name: name, Size: int64(len(contents[name])), SHA256: hex.EncodeToString(hash[:])})
+	}
+	manifest, err := json.MarshalIndent(b.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	contents[ManifestFile] = manifest
+	contents[SignatureFile] = ed25519.Sign(key, manifest)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range append([]string{ManifestFile, SignatureFile}, names...) {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents[name])), ModTime: b.Manifest.CreatedAt}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(contents[name]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Read reads a bundle, checking that its manifest is signed by the key
+// matching publicKey and that its files are exactly those the manifest
+// lists, with the same hashes.
+func Read(data []byte, publicKey ed25519.PublicKey) (*Bundle, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not a bundle: %w", err)
+	}
+	contents := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("invalid bundle: %s isn't a regular file", header.Name)
+		}
+		if _, ok := contents[header.Name]; ok {
+			return nil, fmt.Errorf("invalid bundle: %s appears twice", header.Name)
+		}
+		if header.Size > MaxFileSize {
+			return nil, fmt.Errorf("invalid bundle: %s is larger than %d bytes", header.Name, MaxFileSize)
+		}
+		if contents[header.Name], err = io.ReadAll(io.LimitReader(tr, MaxFileSize)); err != nil {
+			return nil, fmt.Errorf("invalid bundle: %w", err)
+		}
+	}
+
+	manifestJSON, ok := contents[ManifestFile]
+	if !ok {
+		return nil, errors.New("invalid bundle: no manifest")
+	}
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, manifestJSON, contents[SignatureFile]) {
+		return nil, errors.New("bundle signature doesn't match the key")
+	}
+	b := &Bundle{}
+	if err := json.Unmarshal(manifestJSON, &b.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %w", err)
+	}
+	if b.Manifest.FormatVersion != FormatVersion {
+		return nil, fmt.Errorf("unsupported bundle format version %d", b.Manifest.FormatVersion)
+	}
+
+	listed := map[string]bool{ManifestFile: true, SignatureFile: true}
+	for _, file := range b.Manifest.Files {
+		data, ok := contents[file.Name]
+		if !ok {
+			return nil, fmt.Errorf("invalid bundle: %s is missing", file.Name)
+		}
+		hash := sha256.Sum256(data)
+		if int64(len(data)) != file.Size || hex.EncodeToString(hash[:]) != file.SHA256 {
+			return nil, fmt.Errorf("invalid bundle: %s doesn't match the manifest", file.Name)
+		}
+		listed[file.Name] = true
+	}
+	for _, name := range sortedKeys(contents) {
+		if !listed[name] {
+			return nil, fmt.Errorf("invalid bundle: %s isn't listed in the manifest", name)
+		}
+	}
+
+	if b.Bytecode, ok = contents[BytecodeFile]; !ok {
+		return nil, errors.New("invalid bundle: no bytecode")
+	}
+	if data, ok := contents[ConfigFile]; ok {
+		b.Config = &Config{}
+		if err := json.Unmarshal(data, b.Config); err != nil {
+			return nil, fmt.Errorf("invalid bundle runtime configuration: %w", err)
+		}
+		if err := b.Config.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid bundle runtime configuration: %w", err)
+		}
+	}
+	if data, ok := contents[FactSchemaFile]; ok {
+		if err := json.Unmarshal(data, &b.FactSchema); err != nil {
+			return nil, fmt.Errorf("invalid bundle fact schema: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// sortedKeys returns the keys of a map, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,176 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"io"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testImage returns bytecode with a fact schema and provenance.
+func testImage(t *testing.T) []byte {
+	code := make([]byte, 12)
+	schema, err := bytecode.NewSchemaSection(bytecode.FactSchema{"temperature": "float"})
+	require.NoError(t, err)
+	provenance, err := bytecode.NewProvenanceSection(bytecode.Provenance{RulesetHash: "abc123", CompilerVersion: "test"})
+	require.NoError(t, err)
+	return bytecode.AppendSections(code, schema, provenance)
+}
+
+// testKeys returns a new signing key pair.
+func testKeys(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	publicPEM, privatePEM, err := GenerateKey()
+	require.NoError(t, err)
+	publicKey, err := ParsePublicKey(publicPEM)
+	require.NoError(t, err)
+	privateKey, err := ParsePrivateKey(privatePEM)
+	require.NoError(t, err)
+	return publicKey, privateKey
+}
+
+func TestBundle_RoundTrip(t *testing.T) {
+	publicKey, privateKey := testKeys(t)
+	config := &Config{
+		Flags:        map[string]interface{}{"redis": "redis:6379", "maxinstructions": 5000.0, "degrade": true},
+		Suppressions: &runtime.SuppressionConfig{Windows: []runtime.SuppressionWindow{}},
+	}
+	b, err := New(testImage(t), config)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, b.Write(&buf, privateKey))
+
+	read, err := Read(buf.Bytes(), publicKey)
+	require.NoError(t, err)
+	assert.Equal(t, testImage(t), read.Bytecode)
+	assert.Equal(t, bytecode.FactSchema{"temperature": "float"}, read.FactSchema)
+	require.NotNil(t, read.Manifest.Provenance)
+	assert.Equal(t, "abc123", read.Manifest.Provenance.RulesetHash)
+	assert.Len(t, read.Manifest.Files, 3)
+	assert.Equal(t, map[string]string{"redis": "redis:6379", "maxinstructions": "5000", "degrade": "true"}, read.Config.FlagValues())
+	assert.NotNil(t, read.Config.Suppressions)
+
+	otherKey, _ := testKeys(t)
+	_, err = Read(buf.Bytes(), otherKey)
+	assert.EqualError(t, err, "bundle signature doesn't match the key")
+}
+
+func TestBundle_NoConfig(t *testing.T) {
+	publicKey, privateKey := testKeys(t)
+	b, err := New(make([]byte, 12), nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, b.Write(&buf, privateKey))
+
+	read, err := Read(buf.Bytes(), publicKey)
+	require.NoError(t, err)
+	assert.Nil(t, read.Config)
+	assert.Nil(t, read.FactSchema)
+	assert.Nil(t, read.Manifest.Provenance)
+	assert.Len(t, read.Manifest.Files, 1)
+}
+
+func TestBundle_CompiledBytecode(t *testing.T) {
+	ruleset, err := compiler.ParseRules([]byte(`[{
+        "name": "fan",
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }]`), compiler.Options{})
+	require.NoError(t, err)
+	compiled, err := compiler.Compile(ruleset, compiler.Options{})
+	require.NoError(t, err)
+	publicKey, privateKey := testKeys(t)
+	b, err := New(compiled.Image, nil)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, b.Write(&buf, privateKey))
+
+	// The bundled bytecode.bin runs as the runtime loads it
+	read, err := Read(buf.Bytes(), publicKey)
+	require.NoError(t, err)
+	vm := runtime.NewVM(read.Bytecode)
+	require.NoError(t, vm.DecodeError())
+	vm.SetFact("temperature", 35)
+	require.NoError(t, vm.Run())
+	fanStatus, _ := vm.GetFact("fan_status")
+	assert.Equal(t, true, fanStatus)
+}
+
+// rewrite rewrites the files of a bundle with edit, which may change their
+// contents or add files.
+func rewrite(t *testing.T, data []byte, edit func(files map[string][]byte, names []string) []string) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	files := make(map[string][]byte)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		files[header.Name], err = io.ReadAll(tr)
+		require.NoError(t, err)
+		names = append(names, header.Name)
+	}
+	names = edit(files, names)
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: time.Now()}))
+		_, err := tw.Write(files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+	return buf.Bytes()
+}
+
+func TestRead_Tampered(t *testing.T) {
+	publicKey, privateKey := testKeys(t)
+	b, err := New(testImage(t), &Config{Flags: map[string]interface{}{"interval": "1s"}})
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, b.Write(&buf, privateKey))
+
+	_, err = Read(rewrite(t, buf.Bytes(), func(files map[string][]byte, names []string) []string {
+		files[ConfigFile] = []byte(`{"flags": {"interval": "1ms"}}`)
+		return names
+	}), publicKey)
+	assert.EqualError(t, err, "invalid bundle: runtime.json doesn't match the manifest")
+
+	_, err = Read(rewrite(t, buf.Bytes(), func(files map[string][]byte, names []string) []string {
+		files["extra.json"] = []byte(`{}`)
+		return append(names, "extra.json")
+	}), publicKey)
+	assert.EqualError(t, err, "invalid bundle: extra.json isn't listed in the manifest")
+
+	_, err = Read(rewrite(t, buf.Bytes(), func(files map[string][]byte, names []string) []string {
+		return names[:len(names)-1]
+	}), publicKey)
+	assert.ErrorContains(t, err, "is missing")
+
+	_, err = Read([]byte("not gzip"), publicKey)
+	assert.ErrorContains(t, err, "not a bundle")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&Config{Flags: map[string]interface{}{"interval": "1s", "maxstackdepth": 64.0}}).Validate())
+	assert.EqualError(t, (&Config{Flags: map[string]interface{}{"plugins": "x.so"}}).Validate(), "a bundle can't set -plugins")
+	assert.EqualError(t, (&Config{Flags: map[string]interface{}{"redisstreams": []interface{}{"a"}}}).Validate(), "flag redisstreams must be a string, number or boolean")
+	_, err := New(make([]byte, 12), &Config{Flags: map[string]interface{}{"bundle": "x"}})
+	assert.ErrorContains(t, err, "invalid runtime configuration")
+}
@@ -0,0 +1,176 @@
+// chaos/chaos.go
+
+// Package chaos disturbs a runtime the way real deployments do, to check that
+// rules and retry policies cope with messy conditions: fact updates arriving
+// late, twice or out of order, and action handlers failing transiently. All
+// randomness comes from a seeded generator, so a run that uncovers a problem
+// can be repeated with the same seed, as long as the updates received and the
+// actions triggered are the same.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"rgehrsitz/rex/internal/factsource"
+	"rgehrsitz/rex/internal/runtime"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrInjected is wrapped by the action failures injected by a Monkey.
+var ErrInjected = errors.New("failure injected by chaos testing")
+
+// Config sets how often each kind of disturbance happens. Rates are
+// probabilities between 0 and 1; a rate of 0 disables the disturbance.
+type Config struct {
+	Seed int64
+
+	// DelayRate is the share of fact updates held back and applied in a
+	// later cycle, after the updates that followed them.
+	DelayRate float64
+	// DuplicateRate is the share of fact updates applied a second time in a
+	// later cycle, as sources delivering at least once do.
+	DuplicateRate float64
+	// ReorderRate is the share of cycles whose updates are applied in a
+	// random order rather than the order they were received.
+	ReorderRate float64
+	// MaxDelay is the largest number of cycles a delayed or duplicated
+	// update is held back; 0 means 3.
+	MaxDelay int
+
+	// ActionFailureRate is the share of action handler invocations that
+	// fail with ErrInjected instead of calling the handler.
+	ActionFailureRate float64
+}
+
+// Stats counts the disturbances injected by a Monkey.
+type Stats struct {
+	Delayed        int `json:"delayed"`
+	Duplicated     int `json:"duplicated"`
+	Reordered      int `json:"reordered"` // Cycles whose updates were shuffled
+	FailedActions  int `json:"failedActions"`
+	PendingUpdates int `json:"pendingUpdates"` // Delayed and duplicated updates not applied yet
+}
+
+// Monkey injects disturbances according to a Config. It is safe for
+// concurrent use.
+type Monkey struct {
+	config Config
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	cycle   int
+	pending []heldUpdate
+	stats   Stats
+}
+
+// heldUpdate is an update to apply in a later cycle.
+type heldUpdate struct {
+	update factsource.Update
+	due    int
+}
+
+// New creates a Monkey disturbing as configured.
+func New(config Config) (*Monkey, error) {
+	rates := map[string]float64{
+		"delay":          config.DelayRate,
+		"duplicate":      config.DuplicateRate,
+		"reorder":        config.ReorderRate,
+		"action failure": config.ActionFailureRate,
+	}
+	for name, rate := range rates {
+		if !(rate >= 0 && rate <= 1) {
+			return nil, fmt.Errorf("%s rate %v is not between 0 and 1", name, rate)
+		}
+	}
+	if config.MaxDelay < 0 {
+		return nil, fmt.Errorf("negative max delay %d", config.MaxDelay)
+	}
+	if config.MaxDelay == 0 {
+		config.MaxDelay = 3
+	}
+	return &Monkey{config: config, rand: rand.New(rand.NewSource(config.Seed))}, nil
+}
+
+// Updates returns the fact updates to apply in the next cycle in place of
+// the updates received since the previous one: some are held back for later
+// cycles, some are repeated later, earlier updates whose time has come are
+// added after them, and the whole cycle may be shuffled.
+func (m *Monkey) Updates(received []factsource.Update) []factsource.Update {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cycle++
+
+	var updates []factsource.Update
+	for _, update := range received {
+		if m.happens(m.config.DelayRate) {
+			m.hold(update)
+			m.stats.Delayed++
+			log.Debug().Str("Fact", update.Fact).Msg("Chaos delayed fact update")
+			continue
+		}
+		updates = append(updates, update)
+		if m.happens(m.config.DuplicateRate) {
+			m.hold(update)
+			m.stats.Duplicated++
+			log.Debug().Str("Fact", update.Fact).Msg("Chaos duplicated fact update")
+		}
+	}
+
+	var still []heldUpdate
+	for _, held := range m.pending {
+		if held.due <= m.cycle {
+			updates = append(updates, held.update)
+		} else {
+			still = append(still, held)
+		}
+	}
+	m.pending = still
+
+	if len(updates) > 1 && m.happens(m.config.ReorderRate) {
+		m.rand.Shuffle(len(updates), func(i, j int) { updates[i], updates[j] = updates[j], updates[i] })
+		m.stats.Reordered++
+		log.Debug().Int("Updates", len(updates)).Msg("Chaos reordered fact updates")
+	}
+	return updates
+}
+
+// Attach makes the action handlers of a VM fail at the configured rate. The
+// failures go through the VM's ActionGuard like real ones, so they trip
+// circuit breakers and are retried by pipelines.
+func (m *Monkey) Attach(vm *runtime.VM) {
+	vm.ActionGuard().SetFaultInjector(m.injectFailure)
+}
+
+// Stats returns the disturbances injected so far.
+func (m *Monkey) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	stats.PendingUpdates = len(m.pending)
+	return stats
+}
+
+func (m *Monkey) injectFailure(handlerType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.happens(m.config.ActionFailureRate) {
+		return nil
+	}
+	m.stats.FailedActions++
+	log.Debug().Str("HandlerType", handlerType).Msg("Chaos failed action")
+	return fmt.Errorf("%s: %w", handlerType, ErrInjected)
+}
+
+// hold schedules an update for one of the next MaxDelay cycles.
+func (m *Monkey) hold(update factsource.Update) {
+	m.pending = append(m.pending, heldUpdate{update: update, due: m.cycle + 1 + m.rand.Intn(m.config.MaxDelay)})
+}
+
+// happens reports whether an event of the given probability occurs. A rate
+// of 0 draws no random number.
+func (m *Monkey) happens(rate float64) bool {
+	return rate > 0 && m.rand.Float64() < rate
+}
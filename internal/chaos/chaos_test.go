@@ -0,0 +1,110 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"rgehrsitz/rex/internal/factsource"
+	"rgehrsitz/rex/internal/runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func updates(from, to int) []factsource.Update {
+	var batch []factsource.Update
+	for i := from; i < to; i++ {
+		batch = append(batch, factsource.Update{Fact: fmt.Sprintf("f%d", i), Value: i})
+	}
+	return batch
+}
+
+func TestMonkey_Disabled(t *testing.T) {
+	monkey, err := New(Config{Seed: 1})
+	require.NoError(t, err)
+	assert.Equal(t, updates(0, 10), monkey.Updates(updates(0, 10)))
+	assert.Equal(t, Stats{}, monkey.Stats())
+}
+
+func TestMonkey_Delay(t *testing.T) {
+	monkey, err := New(Config{Seed: 1, DelayRate: 1, MaxDelay: 2})
+	require.NoError(t, err)
+
+	assert.Empty(t, monkey.Updates(updates(0, 10)))
+	assert.Equal(t, Stats{Delayed: 10, PendingUpdates: 10}, monkey.Stats())
+
+	// Every update arrives within MaxDelay cycles, after newer ones
+	var applied []factsource.Update
+	applied = append(applied, monkey.Updates(nil)...)
+	applied = append(applied, monkey.Updates(nil)...)
+	assert.ElementsMatch(t, updates(0, 10), applied)
+	assert.Zero(t, monkey.Stats().PendingUpdates)
+}
+
+func TestMonkey_Duplicate(t *testing.T) {
+	monkey, err := New(Config{Seed: 1, DuplicateRate: 1, MaxDelay: 1})
+	require.NoError(t, err)
+
+	assert.Equal(t, updates(0, 3), monkey.Updates(updates(0, 3)))
+	assert.Equal(t, append(updates(3, 4), updates(0, 3)...), monkey.Updates(updates(3, 4)))
+	assert.Equal(t, 4, monkey.Stats().Duplicated)
+}
+
+func TestMonkey_Reorder(t *testing.T) {
+	monkey, err := New(Config{Seed: 1, ReorderRate: 1})
+	require.NoError(t, err)
+
+	reordered := monkey.Updates(updates(0, 20))
+	assert.ElementsMatch(t, updates(0, 20), reordered)
+	assert.NotEqual(t, updates(0, 20), reordered)
+	assert.Equal(t, 1, monkey.Stats().Reordered)
+}
+
+func TestMonkey_Reproducible(t *testing.T) {
+	config := Config{Seed: 42, DelayRate: 0.3, DuplicateRate: 0.2, ReorderRate: 0.5}
+	run := func() [][]factsource.Update {
+		monkey, err := New(config)
+		require.NoError(t, err)
+		var cycles [][]factsource.Update
+		for i := 0; i < 10; i++ {
+			cycles = append(cycles, monkey.Updates(updates(i*5, i*5+5)))
+		}
+		return cycles
+	}
+	assert.Equal(t, run(), run())
+}
+
+func TestMonkey_ActionFailures(t *testing.T) {
+	monkey, err := New(Config{Seed: 1, ActionFailureRate: 1})
+	require.NoError(t, err)
+	vm := runtime.NewVM(nil)
+	vm.SetActionPolicy(runtime.ActionPolicy{FailureThreshold: 2, Cooldown: time.Hour})
+	monkey.Attach(vm)
+
+	called := false
+	handler := func(ctx context.Context) error {
+		called = true
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		assert.ErrorIs(t, vm.ActionGuard().Invoke(0, "webhook", handler), ErrInjected)
+	}
+	assert.False(t, called)
+	assert.Equal(t, 2, monkey.Stats().FailedActions)
+
+	// Injected failures trip breakers like real ones
+	assert.ErrorIs(t, vm.ActionGuard().Invoke(0, "webhook", handler), runtime.ErrCircuitOpen)
+
+	// The injector survives a new action policy
+	vm.SetActionPolicy(runtime.ActionPolicy{})
+	assert.ErrorIs(t, vm.ActionGuard().Invoke(0, "webhook", handler), ErrInjected)
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	_, err := New(Config{DelayRate: 1.5})
+	assert.ErrorContains(t, err, "delay rate 1.5 is not between 0 and 1")
+
+	_, err = New(Config{MaxDelay: -1})
+	assert.ErrorContains(t, err, "negative max delay")
+}
@@ -0,0 +1,52 @@
+// cli/facts.go
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"rgehrsitz/rex/internal/preprocessor"
+)
+
+// ReadFacts reads a file holding a JSON object of fact values, as the
+// runtime's -facts flag and rex run and rex explain take it. Integers are
+// read as int64, or uint64 if too large, so that those beyond 2^53 aren't
+// rounded through float64; other numbers are read as float64. Errors reading
+// the file are returned as they are, and errors decoding it are wrapped in
+// an error starting with "failed to parse facts".
+func ReadFacts(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var facts map[string]interface{}
+	if err := decoder.Decode(&facts); err != nil {
+		return nil, fmt.Errorf("failed to parse facts: %w", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("failed to parse facts: data after the JSON object")
+	}
+	for name, value := range facts {
+		if facts[name], err = preprocessor.NormalizeNumbers(value); err != nil {
+			return nil, fmt.Errorf("failed to parse facts: fact %s: %w", name, err)
+		}
+	}
+	return facts, nil
+}
+
+// FactsErrorCode returns the diagnostic code of an error ReadFacts returned:
+// read-failed if the file couldn't be read, and invalid-facts otherwise.
+func FactsErrorCode(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return "read-failed"
+	}
+	return "invalid-facts"
+}
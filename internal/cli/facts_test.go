@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFacts writes a facts file and returns its path.
+func writeFacts(t *testing.T, factsJSON string) string {
+	path := filepath.Join(t.TempDir(), "facts.json")
+	require.NoError(t, os.WriteFile(path, []byte(factsJSON), 0o644))
+	return path
+}
+
+func TestReadFacts(t *testing.T) {
+	facts, err := ReadFacts(writeFacts(t, `{"temperature": 35, "humidity": 61.5, "mode": "eco", "zones": [1, 2.5]}`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"temperature": int64(35),
+		"humidity":    61.5,
+		"mode":        "eco",
+		"zones":       []interface{}{int64(1), 2.5},
+	}, facts)
+
+	_, err = ReadFacts(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Equal(t, "read-failed", FactsErrorCode(err))
+	for _, factsJSON := range []string{`{"temperature": }`, `{"temperature": 35} {}`, `[35]`} {
+		_, err = ReadFacts(writeFacts(t, factsJSON))
+		assert.ErrorContains(t, err, "failed to parse facts", factsJSON)
+		assert.Equal(t, "invalid-facts", FactsErrorCode(err), factsJSON)
+	}
+}
+
+func TestReadFacts_LargeIntegers(t *testing.T) {
+	// 2^53 + 1 and 2^64 - 1 aren't representable as float64
+	facts, err := ReadFacts(writeFacts(t, `{"devid": 9007199254740993, "serial": 18446744073709551615, "offset": -9007199254740993}`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"devid":  int64(9007199254740993),
+		"serial": uint64(18446744073709551615),
+		"offset": int64(-9007199254740993),
+	}, facts)
+
+	// A rule comparing with 2^53 + 1 fires for that value only, where both
+	// values would be read as 2^53 through float64
+	ruleset, err := compiler.ParseRules([]byte(`[{
+		"name": "device",
+		"consumedFacts": ["devid"],
+		"producedFacts": ["matched"],
+		"conditions": {"all": [{"fact": "devid", "operator": "equal", "value": 9007199254740993}]},
+		"event": {"actions": [{"type": "updateFact", "target": "matched", "value": true}]}
+	}]`), compiler.Options{})
+	require.NoError(t, err)
+	compiled, err := compiler.Compile(ruleset, compiler.Options{})
+	require.NoError(t, err)
+	for factsJSON, fires := range map[string]bool{`{"devid": 9007199254740993}`: true, `{"devid": 9007199254740992}`: false} {
+		facts, err := ReadFacts(writeFacts(t, factsJSON))
+		require.NoError(t, err)
+		vm := runtime.NewVM(compiled.Image)
+		vm.SetFacts(facts)
+		require.NoError(t, vm.Run())
+		_, matched := vm.GetFact("matched")
+		assert.Equal(t, fires, matched, factsJSON)
+	}
+}
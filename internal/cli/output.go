@@ -0,0 +1,353 @@
+// cli/output.go
+
+// Package cli defines the machine-readable output of the rex command line
+// tools. Commands run with -json (or --json) write exactly one of these
+// documents to stdout, and keep their logs on stderr. The schemas are stable:
+// fields may be added, but existing fields keep their names and meaning within
+// a SchemaVersion.
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"rgehrsitz/rex/internal/audit"
+	"rgehrsitz/rex/internal/bundle"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/ruletest"
+	"strconv"
+	"strings"
+)
+
+// SchemaVersion is the version of the output schemas defined in this package.
+const SchemaVersion = 1
+
+// Severity levels of diagnostics.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is a problem found by a command.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"` // Stable identifier of the kind of problem, e.g. "undefined-input"
+	Message  string `json:"message"`
+	Rule     string `json:"rule,omitempty"`
+	Fact     string `json:"fact,omitempty"`
+	Path     string `json:"path,omitempty"`   // JSON path of the offending value, for ruleset errors and schema violations
+	Line     int    `json:"line,omitempty"`   // Line of the offending value in the ruleset, counting from 1
+	Column   int    `json:"column,omitempty"` // Column of the offending value in the ruleset, counting from 1
+}
+
+// ErrorDiagnostic returns an error diagnostic for err.
+func ErrorDiagnostic(code string, err error) Diagnostic {
+	return Diagnostic{Severity: SeverityError, Code: code, Message: err.Error()}
+}
+
+// ErrorDiagnostics returns an error diagnostic for each problem err reports
+// in a ruleset, located in it, or a single diagnostic for any other error.
+func ErrorDiagnostics(code string, err error) []Diagnostic {
+	var rulesetErr *preprocessor.RulesetError
+	var schemaErr *preprocessor.SchemaError
+	var cycleErr *preprocessor.DependencyCycleError
+	var diagnostics []Diagnostic
+	if errors.As(err, &rulesetErr) {
+		for _, ruleErr := range rulesetErr.Errors {
+			diagnostics = append(diagnostics, Diagnostic{
+				Severity: SeverityError, Code: code, Message: ruleErr.Error(),
+				Rule: ruleErr.Rule, Path: ruleErr.Path, Line: ruleErr.Line, Column: ruleErr.Column,
+			})
+		}
+	} else if errors.As(err, &schemaErr) {
+		for _, violation := range schemaErr.Violations {
+			diagnostics = append(diagnostics, Diagnostic{
+				Severity: SeverityError, Code: code, Message: violation.String(), Path: violation.Path,
+			})
+		}
+	} else if errors.As(err, &cycleErr) {
+		for _, cycle := range cycleErr.Cycles {
+			diagnostics = append(diagnostics, Diagnostic{
+				Severity: SeverityError, Code: code, Message: cycle.String(), Rule: cycle.Rules[0],
+			})
+		}
+	} else {
+		diagnostics = append(diagnostics, ErrorDiagnostic(code, err))
+	}
+	return diagnostics
+}
+
+// CompileSummary is the output of the preprocessor.
+type CompileSummary struct {
+	SchemaVersion  int                  `json:"schemaVersion"`
+	Success        bool                 `json:"success"`
+	Rules          int                  `json:"rules"`          // Rules in the input
+	OptimizedRules int                  `json:"optimizedRules"` // Rules left after optimization
+	BytecodeSize   int                  `json:"bytecodeSize"`
+	Cost           *bytecode.Cost       `json:"cost,omitempty"`       // Worst-case evaluation cost of the bytecode
+	Provenance     *bytecode.Provenance `json:"provenance,omitempty"` // Ruleset revision and compiler the bytecode comes from
+	Output         string               `json:"output,omitempty"`     // Path the bytecode was written to
+	Plan           *CompilePlan         `json:"plan,omitempty"`       // What the optimizer changed, in plan mode
+	Diagnostics    []Diagnostic         `json:"diagnostics"`
+}
+
+// CompilePlan describes what the optimizer did to a ruleset, reported by the
+// plan mode of the preprocessor and rex compile instead of writing the
+// bytecode.
+type CompilePlan struct {
+	MergedRules       []preprocessor.MergedRule       `json:"mergedRules"`
+	DroppedConditions []preprocessor.DroppedCondition `json:"droppedConditions"`
+}
+
+// RunResult is the output of a single runtime evaluation cycle.
+type RunResult struct {
+	SchemaVersion int                    `json:"schemaVersion"`
+	Success       bool                   `json:"success"`
+	FiredRules    []int                  `json:"firedRules"`         // Rules that executed an action, by position in the bytecode
+	Facts         map[string]interface{} `json:"facts"`              // Fact values after the cycle
+	Rulesets      []RulesetResult        `json:"rulesets,omitempty"` // Results of each ruleset when running several
+	Diagnostics   []Diagnostic           `json:"diagnostics"`
+}
+
+// RulesetResult is the outcome of one ruleset's cycle when the runtime runs
+// several rulesets.
+type RulesetResult struct {
+	Name       string `json:"name"`
+	FiredRules []int  `json:"firedRules"` // By position in the ruleset's bytecode
+}
+
+// Stats is the output of rex stats.
+type Stats struct {
+	SchemaVersion     int            `json:"schemaVersion"`
+	Rules             int            `json:"rules"`
+	Conditions        int            `json:"conditions"`
+	Actions           int            `json:"actions"`
+	ConsumedFacts     []string       `json:"consumedFacts"`
+	ProducedFacts     []string       `json:"producedFacts"`
+	UnusedProductions []string       `json:"unusedProductions"`
+	UndefinedInputs   []string       `json:"undefinedInputs"`
+	Cost              *bytecode.Cost `json:"cost,omitempty"` // Worst-case evaluation cost of the compiled ruleset
+	Diagnostics       []Diagnostic   `json:"diagnostics"`
+}
+
+// LintResult is the output of rex lint.
+type LintResult struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Diagnostics   []Diagnostic `json:"diagnostics"`
+}
+
+// ValidateResult is the output of rex validate.
+type ValidateResult struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	Success       bool             `json:"success"`     // No errors were found, nor warnings with -failonwarnings
+	Rules         []RuleValidation `json:"rules"`       // Every rule, in ruleset order, with the problems found in it
+	Diagnostics   []Diagnostic     `json:"diagnostics"` // Every problem, including those not in a rule
+}
+
+// RuleValidation is the outcome of validating one rule.
+type RuleValidation struct {
+	Rule     string       `json:"rule"`
+	Valid    bool         `json:"valid"` // No errors were found in the rule
+	Errors   []Diagnostic `json:"errors"`
+	Warnings []Diagnostic `json:"warnings"`
+}
+
+// NewValidateResult returns the result of validating a ruleset whose rules
+// have the given names, by position, and in which the diagnostics were
+// found. Diagnostics at a rules[i] path without a rule, such as schema
+// violations, are attributed to the rule at that position. Rules found only
+// in diagnostics, such as those lowered from state machines, follow the
+// others.
+func NewValidateResult(ruleNames []string, diagnostics []Diagnostic) ValidateResult {
+	result := ValidateResult{SchemaVersion: SchemaVersion, Success: true, Rules: []RuleValidation{}, Diagnostics: append([]Diagnostic{}, diagnostics...)}
+	index := make(map[string]int) // Position of each rule in result.Rules
+	addRule := func(name string) {
+		if _, ok := index[name]; !ok && name != "" {
+			index[name] = len(result.Rules)
+			result.Rules = append(result.Rules, RuleValidation{Rule: name, Valid: true, Errors: []Diagnostic{}, Warnings: []Diagnostic{}})
+		}
+	}
+	for _, name := range ruleNames {
+		addRule(name)
+	}
+	for i := range result.Diagnostics {
+		diagnostic := &result.Diagnostics[i]
+		if diagnostic.Rule == "" {
+			diagnostic.Rule = ruleAtPath(ruleNames, diagnostic.Path)
+		}
+		addRule(diagnostic.Rule)
+	}
+
+	for _, diagnostic := range result.Diagnostics {
+		if diagnostic.Severity == SeverityError {
+			result.Success = false
+		}
+		i, ok := index[diagnostic.Rule]
+		if !ok {
+			continue
+		}
+		if diagnostic.Severity == SeverityError {
+			result.Rules[i].Valid = false
+			result.Rules[i].Errors = append(result.Rules[i].Errors, diagnostic)
+		} else {
+			result.Rules[i].Warnings = append(result.Rules[i].Warnings, diagnostic)
+		}
+	}
+	return result
+}
+
+// ruleAtPath returns the name of the rule a JSON path such as
+// rules[2].conditions is in, or "" if it isn't in a named rule.
+func ruleAtPath(ruleNames []string, path string) string {
+	rest, ok := strings.CutPrefix(path, "rules[")
+	if !ok {
+		return ""
+	}
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return ""
+	}
+	i, err := strconv.Atoi(rest[:end])
+	if err != nil || i < 0 || i >= len(ruleNames) {
+		return ""
+	}
+	return ruleNames[i]
+}
+
+// ImpactResult is the output of rex impact. The lists are empty when the
+// analysis failed.
+type ImpactResult struct {
+	SchemaVersion int `json:"schemaVersion"`
+	preprocessor.RuleImpact
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// GraphResult is the output of rex graph -json. The lists are empty when the
+// analysis failed.
+type GraphResult struct {
+	SchemaVersion int `json:"schemaVersion"`
+	preprocessor.DependencyGraph
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// DocResult is the output of rex doc, which writes the documentation itself
+// to a file.
+type DocResult struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	Success       bool         `json:"success"`
+	Output        string       `json:"output,omitempty"` // Path the documentation was written to
+	Rules         int          `json:"rules"`
+	Facts         int          `json:"facts"`
+	Diagnostics   []Diagnostic `json:"diagnostics"`
+}
+
+// MigrateResult is the output of rex migrate, which writes the migrated
+// ruleset itself to a file.
+type MigrateResult struct {
+	SchemaVersion int                            `json:"schemaVersion"`
+	Success       bool                           `json:"success"`
+	Output        string                         `json:"output,omitempty"` // Path the migrated ruleset was written to
+	Changes       []preprocessor.MigrationChange `json:"changes"`          // Including the constructs needing manual attention
+	Diagnostics   []Diagnostic                   `json:"diagnostics"`
+}
+
+// Disassembly is the output of rex disasm.
+type Disassembly struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	Instructions  []string           `json:"instructions"`
+	Rules         []DisassembledRule `json:"rules,omitempty"`  // Where each rule starts, if the bytecode has a rule directory
+	Source        string             `json:"source,omitempty"` // Embedded ruleset JSON, when requested and present
+	Diagnostics   []Diagnostic       `json:"diagnostics"`
+}
+
+// DisassembledRule locates a rule in disassembled code.
+type DisassembledRule struct {
+	Name     string   `json:"name"`
+	Priority int      `json:"priority"`
+	Offset   int      `json:"offset"`
+	Length   int      `json:"length"`
+	Facts    []string `json:"facts"` // Facts the rule reads
+}
+
+// AuditQueryResult is the output of rex audit query.
+type AuditQueryResult struct {
+	SchemaVersion int                   `json:"schemaVersion"`
+	Firings       []audit.Firing        `json:"firings"`
+	Actions       []audit.ActionOutcome `json:"actions"`
+	Diagnostics   []Diagnostic          `json:"diagnostics"`
+}
+
+// BundleResult is the output of rex bundle create and rex bundle verify.
+type BundleResult struct {
+	SchemaVersion int              `json:"schemaVersion"`
+	Success       bool             `json:"success"`
+	Manifest      *bundle.Manifest `json:"manifest,omitempty"` // Manifest of the bundle written or verified
+	Diagnostics   []Diagnostic     `json:"diagnostics"`
+}
+
+// TestResult is the output of rex test.
+type TestResult struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Passed        int               `json:"passed"`
+	Failed        int               `json:"failed"`
+	Results       []ruletest.Result `json:"results"`
+	Diagnostics   []Diagnostic      `json:"diagnostics"`
+}
+
+// ExplainResult is the output of rex explain.
+type ExplainResult struct {
+	SchemaVersion int `json:"schemaVersion"`
+	ruletest.Explanation
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// MutationResult is the output of rex mutate.
+type MutationResult struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Score         float64           `json:"score"` // Percentage of mutants killed
+	Killed        int               `json:"killed"`
+	Survived      int               `json:"survived"`
+	Mutants       []ruletest.Mutant `json:"mutants"`
+	UntestedRules []string          `json:"untestedRules"`
+	FailingRules  []string          `json:"failingRules"` // Rules whose tests fail without mutation
+	Diagnostics   []Diagnostic      `json:"diagnostics"`
+}
+
+// BenchResult is the output of rex bench.
+type BenchResult struct {
+	SchemaVersion   int          `json:"schemaVersion"`
+	Cycles          int          `json:"cycles"`
+	Errors          int          `json:"errors"`  // Cycles that failed
+	Firings         int          `json:"firings"` // Rule firings across all cycles
+	Facts           int          `json:"facts"`   // Facts generated for each cycle
+	TotalSeconds    float64      `json:"totalSeconds"`
+	CyclesPerSecond float64      `json:"cyclesPerSecond"`
+	Latency         BenchLatency `json:"latency"`
+	Diagnostics     []Diagnostic `json:"diagnostics"`
+}
+
+// BenchLatency summarizes the durations of the cycles of a benchmark, in
+// seconds.
+type BenchLatency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// WriteJSON writes v to w as indented JSON.
+func WriteJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// NonNil returns s, or an empty slice if s is nil, so that lists are encoded
+// as [] rather than null.
+func NonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
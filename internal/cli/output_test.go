@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"rgehrsitz/rex/internal/preprocessor"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteJSON_StableFieldNames(t *testing.T) {
+	var buf bytes.Buffer
+	result := LintResult{
+		SchemaVersion: SchemaVersion,
+		Diagnostics:   []Diagnostic{ErrorDiagnostic("invalid-ruleset", errors.New("bad rule"))},
+	}
+	require.NoError(t, WriteJSON(&buf, result))
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, float64(1), decoded["schemaVersion"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"severity": "error", "code": "invalid-ruleset", "message": "bad rule"},
+	}, decoded["diagnostics"])
+}
+
+func TestNonNil(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteJSON(&buf, Stats{ConsumedFacts: NonNil([]string(nil))}))
+	assert.Contains(t, buf.String(), `"consumedFacts": []`)
+	assert.Contains(t, buf.String(), `"producedFacts": null`)
+}
+
+func TestErrorDiagnostics(t *testing.T) {
+	err := &preprocessor.RulesetError{Errors: []*preprocessor.RuleError{
+		{Rule: "a", Path: "rules[0].conditions", Line: 2, Column: 5, Err: errors.New("a rule must have at least one condition")},
+		{Path: "rules[1].priority", Line: 3, Column: 20, Err: errors.New("bad priority")},
+	}}
+	diagnostics := ErrorDiagnostics("invalid-ruleset", err)
+	require.Len(t, diagnostics, 2)
+	assert.Equal(t, Diagnostic{
+		Severity: SeverityError, Code: "invalid-ruleset", Rule: "a", Path: "rules[0].conditions", Line: 2, Column: 5,
+		Message: "rules[0].conditions (rule 'a', line 2, column 5): a rule must have at least one condition",
+	}, diagnostics[0])
+	assert.Equal(t, 3, diagnostics[1].Line)
+
+	assert.Equal(t, []Diagnostic{ErrorDiagnostic("read-failed", errors.New("no such file"))}, ErrorDiagnostics("read-failed", errors.New("no such file")))
+}
+
+func TestNewValidateResult(t *testing.T) {
+	invalid := Diagnostic{Severity: SeverityError, Code: "schema-violation", Message: "is required", Path: "rules[1].conditions"}
+	cycle := Diagnostic{Severity: SeverityWarning, Code: "dependency-cycle", Message: "cycle", Rule: "a"}
+	lowered := Diagnostic{Severity: SeverityError, Code: "invalid-ruleset", Message: "bad state", Rule: "door_open"}
+	syntax := Diagnostic{Severity: SeverityError, Code: "invalid-ruleset", Message: "unexpected end"}
+	result := NewValidateResult([]string{"a", "b", ""}, []Diagnostic{invalid, cycle, lowered, syntax})
+
+	assert.False(t, result.Success)
+	invalid.Rule = "b"
+	assert.Equal(t, []RuleValidation{
+		{Rule: "a", Valid: true, Errors: []Diagnostic{}, Warnings: []Diagnostic{cycle}},
+		{Rule: "b", Valid: false, Errors: []Diagnostic{invalid}, Warnings: []Diagnostic{}},
+		{Rule: "door_open", Valid: false, Errors: []Diagnostic{lowered}, Warnings: []Diagnostic{}},
+	}, result.Rules)
+	assert.Equal(t, []Diagnostic{invalid, cycle, lowered, syntax}, result.Diagnostics)
+
+	result = NewValidateResult([]string{"a"}, []Diagnostic{cycle})
+	assert.True(t, result.Success, "warnings don't fail validation")
+}
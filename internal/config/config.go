@@ -0,0 +1,124 @@
+// config/config.go
+
+// Package config reads rex.yaml, the project configuration kept next to a
+// ruleset.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the name of the configuration file looked up next to a ruleset.
+const FileName = "rex.yaml"
+
+// Config is the content of rex.yaml.
+type Config struct {
+	Budget Budget `yaml:"budget"`
+	Lint   Lint   `yaml:"lint"`
+}
+
+// Lint configures the checks of rex lint.
+type Lint struct {
+	Disable          []string `yaml:"disable"`          // Checks to skip, e.g. priority-tie
+	MaxAnyConditions int      `yaml:"maxAnyConditions"` // Conditions an any block may have before broad-any reports it; zero keeps the default
+}
+
+// Budget limits the size and complexity of compiled rules, protecting
+// constrained targets from bloated deployments. Zero fields are unlimited.
+type Budget struct {
+	MaxBytecodeSize     int `yaml:"maxBytecodeSize"`     // Bytes, including embedded sections
+	MaxRules            int `yaml:"maxRules"`            // Rules left after optimization
+	MaxRuleInstructions int `yaml:"maxRuleInstructions"` // Worst-case instructions of any single rule
+}
+
+// Load reads a configuration file. Unknown keys are rejected, so that a
+// misspelled budget doesn't silently go unenforced.
+func Load(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// LoadForRuleset reads the rex.yaml next to a ruleset file. A missing file
+// yields the empty configuration.
+func LoadForRuleset(rulesetPath string) (Config, error) {
+	config, err := Load(filepath.Join(filepath.Dir(rulesetPath), FileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Config{}, nil
+	}
+	return config, err
+}
+
+// Violation is a budget exceeded by compiled rules.
+type Violation struct {
+	Rule    string // Rule exceeding a per-rule budget, empty for budgets of the whole ruleset
+	Message string
+}
+
+// BudgetError reports every budget exceeded by compiled rules.
+type BudgetError struct {
+	Violations []Violation
+}
+
+func (e *BudgetError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.Message
+	}
+	return "budget exceeded: " + strings.Join(messages, "; ")
+}
+
+// Check checks compiled rules against the budget. ruleNames lists the rules
+// in bytecode order, and size is the size of the bytecode image. It returns a
+// *BudgetError listing every budget exceeded, or nil.
+func (b Budget) Check(size int, ruleNames []string, cost bytecode.Cost) error {
+	var violations []Violation
+	if b.MaxBytecodeSize > 0 && size > b.MaxBytecodeSize {
+		violations = append(violations, Violation{
+			Message: fmt.Sprintf("bytecode is %d bytes, budget is %d", size, b.MaxBytecodeSize),
+		})
+	}
+	if b.MaxRules > 0 && len(ruleNames) > b.MaxRules {
+		violations = append(violations, Violation{
+			Message: fmt.Sprintf("ruleset has %d rules, budget is %d", len(ruleNames), b.MaxRules),
+		})
+	}
+	if b.MaxRuleInstructions > 0 {
+		for _, rule := range cost.Rules {
+			if rule.Instructions <= b.MaxRuleInstructions {
+				continue
+			}
+			// Without rule markers the whole program counts as a single rule
+			name := fmt.Sprintf("rule %d", rule.Rule)
+			if len(cost.Rules) == len(ruleNames) {
+				name = ruleNames[rule.Rule]
+			}
+			violations = append(violations, Violation{
+				Rule:    name,
+				Message: fmt.Sprintf("%s can execute %d instructions, budget is %d", name, rule.Instructions, b.MaxRuleInstructions),
+			})
+		}
+	}
+	if len(violations) > 0 {
+		return &BudgetError{Violations: violations}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadForRuleset(t *testing.T) {
+	dir := t.TempDir()
+	rulesetPath := filepath.Join(dir, "rules.json")
+
+	// Without rex.yaml there are no budgets
+	config, err := LoadForRuleset(rulesetPath)
+	require.NoError(t, err)
+	assert.Equal(t, Config{}, config)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, FileName), []byte("budget:\n  maxBytecodeSize: 4096\n  maxRules: 50\n"), 0644))
+	config, err = LoadForRuleset(rulesetPath)
+	require.NoError(t, err)
+	assert.Equal(t, Budget{MaxBytecodeSize: 4096, MaxRules: 50}, config.Budget)
+
+	// Misspelled keys are rejected
+	require.NoError(t, os.WriteFile(filepath.Join(dir, FileName), []byte("budget:\n  maxRule: 50\n"), 0644))
+	_, err = LoadForRuleset(rulesetPath)
+	assert.ErrorContains(t, err, "field maxRule not found")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, FileName), []byte("lint:\n  disable: [priority-tie, broad-any]\n  maxAnyConditions: 12\n"), 0644))
+	config, err = LoadForRuleset(rulesetPath)
+	require.NoError(t, err)
+	assert.Equal(t, Lint{Disable: []string{"priority-tie", "broad-any"}, MaxAnyConditions: 12}, config.Lint)
+}
+
+func TestBudgetCheck(t *testing.T) {
+	cost := bytecode.Cost{Rules: []bytecode.RuleCost{{Rule: 0, Instructions: 8}, {Rule: 1, Instructions: 20}}}
+	names := []string{"cool", "alarm"}
+
+	assert.NoError(t, Budget{}.Check(1000, names, cost), "Zero budgets are unlimited")
+	assert.NoError(t, Budget{MaxBytecodeSize: 1000, MaxRules: 2, MaxRuleInstructions: 20}.Check(1000, names, cost))
+
+	err := Budget{MaxBytecodeSize: 512, MaxRules: 1, MaxRuleInstructions: 10}.Check(1000, names, cost)
+	var budgetErr *BudgetError
+	require.ErrorAs(t, err, &budgetErr)
+	assert.Equal(t, []Violation{
+		{Message: "bytecode is 1000 bytes, budget is 512"},
+		{Message: "ruleset has 2 rules, budget is 1"},
+		{Rule: "alarm", Message: "alarm can execute 20 instructions, budget is 10"},
+	}, budgetErr.Violations)
+}
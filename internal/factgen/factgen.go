@@ -0,0 +1,216 @@
+// factgen/factgen.go
+
+// Package factgen produces random fact sets for load testing, so benchmarks
+// don't need hand-built fixtures. Values follow the fact schema compiled into
+// the bytecode and the ranges observed for each fact: in the conditions of the
+// rules, which values must straddle for the rules to fire now and then, and in
+// samples of real facts. All randomness comes from a seeded generator, so the
+// same seed and observations produce the same fact sets.
+package factgen
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Config configures a Generator.
+type Config struct {
+	Seed int64
+
+	// Entities is the number of facts generated for each fact pattern of the
+	// schema, such as sensor.*.temperature; 0 means 3.
+	Entities int
+}
+
+// numberRange is the span of the numbers observed for a fact.
+type numberRange struct {
+	min, max float64
+}
+
+// Generator produces fact sets matching a fact schema. It isn't safe for
+// concurrent use.
+type Generator struct {
+	schema bytecode.FactSchema
+	names  []string // Facts generated, with patterns expanded, in sorted order
+	rand   *rand.Rand
+
+	numbers map[string]*numberRange // Observed numbers, by schema fact or pattern
+	strings map[string][]string     // Observed strings, by schema fact or pattern
+}
+
+// New creates a Generator for the facts of schema.
+func New(schema bytecode.FactSchema, config Config) (*Generator, error) {
+	if len(schema) == 0 {
+		return nil, errors.New("fact schema is empty")
+	}
+	if config.Entities < 0 {
+		return nil, errors.New("entities must not be negative")
+	}
+	if config.Entities == 0 {
+		config.Entities = 3
+	}
+
+	g := &Generator{
+		schema:  schema,
+		rand:    rand.New(rand.NewSource(config.Seed)),
+		numbers: make(map[string]*numberRange),
+		strings: make(map[string][]string),
+	}
+	for name := range schema {
+		if !rules.IsFactPattern(name) {
+			g.names = append(g.names, name)
+			continue
+		}
+		for i := 1; i <= config.Entities; i++ {
+			g.names = append(g.names, strings.ReplaceAll(name, "*", fmt.Sprintf("e%d", i)))
+		}
+	}
+	sort.Strings(g.names)
+	return g, nil
+}
+
+// Facts returns the names of the facts generated, in sorted order.
+func (g *Generator) Facts() []string {
+	return append([]string{}, g.names...)
+}
+
+// ObserveRules records the values the conditions of the rules compare facts
+// with.
+func (g *Generator) ObserveRules(ruleSet []*rules.Rule) {
+	for _, rule := range ruleSet {
+		g.observeConditions(rule.Conditions.All)
+		g.observeConditions(rule.Conditions.Any)
+		g.observeConditions(rule.Conditions.Not)
+	}
+}
+
+func (g *Generator) observeConditions(conditions []rules.Condition) {
+	for _, condition := range conditions {
+		if condition.Fact != "" && condition.Script == "" {
+			g.observe(condition.Fact, condition.Value)
+		}
+		g.observeConditions(condition.All)
+		g.observeConditions(condition.Any)
+		g.observeConditions(condition.Not)
+	}
+}
+
+// Observe records the values of a sample of real facts. Facts outside the
+// schema are ignored.
+func (g *Generator) Observe(facts map[string]interface{}) {
+	for name, value := range facts {
+		g.observe(name, value)
+	}
+}
+
+// observe widens the range of a fact to include a value, or adds it to the
+// strings the fact takes.
+func (g *Generator) observe(name string, value interface{}) {
+	key, ok := g.schemaKey(name)
+	if !ok {
+		return
+	}
+	switch v := value.(type) {
+	case string:
+		if !slices.Contains(g.strings[key], v) {
+			g.strings[key] = append(g.strings[key], v)
+		}
+	case bool:
+	default:
+		number, ok := toFloat(v)
+		if !ok {
+			return
+		}
+		if r, ok := g.numbers[key]; ok {
+			r.min = min(r.min, number)
+			r.max = max(r.max, number)
+		} else {
+			g.numbers[key] = &numberRange{min: number, max: number}
+		}
+	}
+}
+
+// Generate returns a random value for every fact of the schema.
+func (g *Generator) Generate() map[string]interface{} {
+	facts := make(map[string]interface{}, len(g.names))
+	for _, name := range g.names {
+		key, _ := g.schemaKey(name)
+		facts[name] = g.value(key, g.schema[key])
+	}
+	return facts
+}
+
+// value returns a random value of a schema type for a schema fact or pattern.
+func (g *Generator) value(key, valueType string) interface{} {
+	switch valueType {
+	case "bool":
+		return g.rand.Intn(2) == 1
+	case "string":
+		choices := g.strings[key]
+		if len(choices) == 0 {
+			segments := strings.Split(key, ".")
+			return fmt.Sprintf("%s-%d", segments[len(segments)-1], g.rand.Intn(5))
+		}
+		return choices[g.rand.Intn(len(choices))]
+	case "int":
+		low, high := g.bounds(key)
+		lo, hi := int(low), int(high)
+		return lo + g.rand.Intn(hi-lo+1)
+	default:
+		low, high := g.bounds(key)
+		return low + g.rand.Float64()*(high-low)
+	}
+}
+
+// bounds returns the range numbers of a fact are drawn from: the observed
+// range widened by a tenth on either side, so that values fall on both sides
+// of the thresholds rules compare them with, or 0 to 100 if nothing was
+// observed.
+func (g *Generator) bounds(key string) (float64, float64) {
+	r, ok := g.numbers[key]
+	if !ok {
+		return 0, 100
+	}
+	margin := (r.max - r.min) / 10
+	if margin < 1 {
+		margin = 1
+	}
+	return r.min - margin, r.max + margin
+}
+
+// schemaKey returns the fact or pattern of the schema a fact falls under.
+func (g *Generator) schemaKey(name string) (string, bool) {
+	if _, ok := g.schema[name]; ok {
+		return name, true
+	}
+	for pattern := range g.schema {
+		if rules.IsFactPattern(pattern) && rules.MatchFact(pattern, name) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// toFloat converts a numeric value to a float64.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
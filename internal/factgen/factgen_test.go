@@ -0,0 +1,88 @@
+package factgen
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSchema = bytecode.FactSchema{
+	"temperature":          "int",
+	"humidity":             "float",
+	"mode":                 "string",
+	"occupied":             "bool",
+	"sensor.*.temperature": "float",
+}
+
+func TestGenerator_Generate(t *testing.T) {
+	g, err := New(testSchema, Config{Seed: 1, Entities: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"humidity", "mode", "occupied", "sensor.e1.temperature", "sensor.e2.temperature", "temperature"}, g.Facts())
+
+	for i := 0; i < 100; i++ {
+		facts := g.Generate()
+		require.Len(t, facts, 6)
+		assert.IsType(t, 0, facts["temperature"])
+		assert.IsType(t, 0.0, facts["humidity"])
+		assert.IsType(t, "", facts["mode"])
+		assert.IsType(t, false, facts["occupied"])
+		assert.IsType(t, 0.0, facts["sensor.e2.temperature"])
+		assert.GreaterOrEqual(t, facts["temperature"], 0)
+		assert.LessOrEqual(t, facts["temperature"], 100)
+	}
+}
+
+func TestGenerator_Seed(t *testing.T) {
+	a, err := New(testSchema, Config{Seed: 7})
+	require.NoError(t, err)
+	b, err := New(testSchema, Config{Seed: 7})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, a.Generate(), b.Generate())
+	}
+}
+
+func TestGenerator_ObservedRanges(t *testing.T) {
+	g, err := New(testSchema, Config{Seed: 1})
+	require.NoError(t, err)
+	g.ObserveRules([]*rules.Rule{{
+		Conditions: rules.Conditions{Any: []rules.Condition{
+			{Fact: "temperature", Operator: rules.OperatorGreaterThan, Value: 300},
+			{All: []rules.Condition{
+				{Fact: "mode", Operator: rules.OperatorEqual, Value: "eco"},
+				{Fact: "temperature", Operator: rules.OperatorLessThan, Value: 200},
+			}},
+			{Script: "facts.mode == 'boost'", Facts: []string{"mode"}},
+		}},
+	}})
+	g.Observe(map[string]interface{}{"mode": "away", "sensor.kitchen.temperature": 21.5, "sensor.hall.temperature": 19.5, "other": 5})
+
+	var below, above bool
+	for i := 0; i < 200; i++ {
+		facts := g.Generate()
+
+		// The thresholds, widened by a tenth of their span
+		temperature := facts["temperature"].(int)
+		assert.GreaterOrEqual(t, temperature, 190)
+		assert.LessOrEqual(t, temperature, 310)
+		below = below || temperature <= 300
+		above = above || temperature > 300
+
+		assert.Contains(t, []string{"eco", "away"}, facts["mode"])
+		sensor := facts["sensor.e1.temperature"].(float64)
+		assert.GreaterOrEqual(t, sensor, 18.5)
+		assert.LessOrEqual(t, sensor, 22.5)
+		assert.NotContains(t, facts, "other")
+	}
+	assert.True(t, below && above, "values fall on both sides of the threshold")
+}
+
+func TestNew_Errors(t *testing.T) {
+	_, err := New(nil, Config{})
+	assert.ErrorContains(t, err, "fact schema is empty")
+	_, err = New(testSchema, Config{Entities: -1})
+	assert.ErrorContains(t, err, "must not be negative")
+}
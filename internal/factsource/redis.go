@@ -0,0 +1,264 @@
+// factsource/redis.go
+
+package factsource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// RedisMode selects how a RedisSource learns about fact changes.
+type RedisMode string
+
+const (
+	// RedisStreams reads entries from Redis Streams. Every field of an entry
+	// is a fact update.
+	RedisStreams RedisMode = "stream"
+	// RedisKeyspace subscribes to keyspace notifications and reads the string
+	// keys that change. Redis must have keyspace notifications enabled, e.g.
+	// with notify-keyspace-events K$gx.
+	RedisKeyspace RedisMode = "keyspace"
+)
+
+// RedisConfig configures a RedisSource.
+type RedisConfig struct {
+	Mode RedisMode
+
+	// Streams lists the streams read in stream mode.
+	Streams []string
+	// Group and Consumer make the source read through a consumer group,
+	// acknowledging entries once their updates have been delivered, so that
+	// several runtimes can share a stream. Without a group, the source reads
+	// the entries added after it starts.
+	Group    string
+	Consumer string
+
+	// KeyPattern selects the keys watched in keyspace mode; defaults to "*".
+	KeyPattern string
+
+	// Mapping maps stream fields or keys to fact names.
+	Mapping Mapping
+
+	// PartitionKey, in stream mode, names the fact identifying the entity a
+	// stream entry is about, e.g. deviceId. Its value becomes the Entity of
+	// the updates for the other fields of the entry; entries without it are
+	// skipped.
+	PartitionKey string
+
+	// CorrelationField, in stream mode, names the field of a stream entry
+	// holding its correlation ID, which becomes the CorrelationID of the
+	// updates for the other fields of the entry. It is matched before the
+	// mapping is applied and isn't a fact itself.
+	CorrelationField string
+}
+
+// RedisSource is a Source reading fact changes from Redis.
+type RedisSource struct {
+	client *redis.Client
+	config RedisConfig
+}
+
+// NewRedisSource creates a Source reading fact changes from Redis through
+// client.
+func NewRedisSource(client *redis.Client, config RedisConfig) (*RedisSource, error) {
+	switch config.Mode {
+	case RedisStreams:
+		if len(config.Streams) == 0 {
+			return nil, errors.New("stream mode requires at least one stream")
+		}
+		if config.Group != "" && config.Consumer == "" {
+			return nil, errors.New("reading through a consumer group requires a consumer name")
+		}
+	case RedisKeyspace:
+		if config.PartitionKey != "" {
+			return nil, errors.New("partitioning requires stream mode")
+		}
+		if config.CorrelationField != "" {
+			return nil, errors.New("correlation IDs require stream mode")
+		}
+		if config.KeyPattern == "" {
+			config.KeyPattern = "*"
+		}
+	default:
+		return nil, fmt.Errorf("unknown Redis mode %q", config.Mode)
+	}
+	return &RedisSource{client: client, config: config}, nil
+}
+
+// Run implements Source.
+func (s *RedisSource) Run(ctx context.Context, updates chan<- Update) error {
+	if s.config.Mode == RedisKeyspace {
+		return s.runKeyspace(ctx, updates)
+	}
+	return s.runStreams(ctx, updates)
+}
+
+// runStreams reads stream entries until ctx is done.
+func (s *RedisSource) runStreams(ctx context.Context, updates chan<- Update) error {
+	// Read position of each stream, followed by the streams themselves as
+	// XREAD expects
+	ids := make([]string, len(s.config.Streams))
+	for i, stream := range s.config.Streams {
+		ids[i] = "$"
+		if s.config.Group == "" {
+			continue
+		}
+		ids[i] = ">"
+		err := s.client.XGroupCreateMkStream(ctx, stream, s.config.Group, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create consumer group for stream %s: %w", stream, err)
+		}
+	}
+
+	for ctx.Err() == nil {
+		var result []redis.XStream
+		var err error
+		if s.config.Group == "" {
+			result, err = s.client.XRead(ctx, &redis.XReadArgs{
+				Streams: append(append([]string{}, s.config.Streams...), ids...),
+				Block:   time.Second,
+			}).Result()
+		} else {
+			result, err = s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    s.config.Group,
+				Consumer: s.config.Consumer,
+				Streams:  append(append([]string{}, s.config.Streams...), ids...),
+				Block:    time.Second,
+			}).Result()
+		}
+		if errors.Is(err, redis.Nil) {
+			continue // No new entries
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("failed to read streams: %w", err)
+		}
+
+		for _, stream := range result {
+			for _, message := range stream.Messages {
+				if err := s.sendFields(ctx, message.Values, updates); err != nil {
+					return err
+				}
+				if s.config.Group != "" {
+					if err := s.client.XAck(ctx, stream.Stream, s.config.Group, message.ID).Err(); err != nil {
+						return fmt.Errorf("failed to acknowledge entry %s of stream %s: %w", message.ID, stream.Stream, err)
+					}
+				}
+			}
+			if s.config.Group == "" && len(stream.Messages) > 0 {
+				for i, name := range s.config.Streams {
+					if name == stream.Stream {
+						ids[i] = stream.Messages[len(stream.Messages)-1].ID
+					}
+				}
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// sendFields sends an update for every mapped field of a stream entry.
+func (s *RedisSource) sendFields(ctx context.Context, fields map[string]interface{}, updates chan<- Update) error {
+	entity := ""
+	if s.config.PartitionKey != "" {
+		for field, value := range fields {
+			if fact, ok := s.config.Mapping.FactName(field); ok && fact == s.config.PartitionKey {
+				entity = fmt.Sprint(value)
+			}
+		}
+		if entity == "" {
+			log.Warn().Str("PartitionKey", s.config.PartitionKey).Msg("Skipping stream entry without partition key")
+			return nil
+		}
+	}
+
+	correlationID := ""
+	if value, ok := fields[s.config.CorrelationField]; ok && s.config.CorrelationField != "" {
+		correlationID = fmt.Sprint(value)
+	}
+
+	for field, value := range fields {
+		if s.config.CorrelationField != "" && field == s.config.CorrelationField {
+			continue
+		}
+		fact, ok := s.config.Mapping.FactName(field)
+		if !ok || (s.config.PartitionKey != "" && fact == s.config.PartitionKey) {
+			continue
+		}
+		update := Update{Fact: fact, Value: ParseValue(fmt.Sprint(value)), Entity: entity, CorrelationID: correlationID}
+		if err := send(ctx, updates, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runKeyspace follows keyspace notifications until ctx is done.
+func (s *RedisSource) runKeyspace(ctx context.Context, updates chan<- Update) error {
+	channelPrefix := fmt.Sprintf("__keyspace@%d__:", s.client.Options().DB)
+	pubsub := s.client.PSubscribe(ctx, channelPrefix+s.config.KeyPattern)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return fmt.Errorf("failed to subscribe to keyspace notifications: %w", err)
+	}
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message, ok := <-messages:
+			if !ok {
+				return errors.New("keyspace notification subscription closed")
+			}
+			key := strings.TrimPrefix(message.Channel, channelPrefix)
+			if err := s.handleKeyEvent(ctx, key, message.Payload, updates); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleKeyEvent sends the update for a keyspace notification.
+func (s *RedisSource) handleKeyEvent(ctx context.Context, key, event string, updates chan<- Update) error {
+	fact, ok := s.config.Mapping.FactName(key)
+	if !ok {
+		return nil
+	}
+
+	switch event {
+	case "del", "expired", "evicted":
+		return send(ctx, updates, Update{Fact: fact, Deleted: true})
+	case "set", "setrange", "append", "incrby", "incrbyfloat", "decrby":
+		value, err := s.client.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			// Deleted again before we could read it
+			return send(ctx, updates, Update{Fact: fact, Deleted: true})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read key %s: %w", key, err)
+		}
+		return send(ctx, updates, Update{Fact: fact, Value: ParseValue(value)})
+	default:
+		log.Debug().Str("Key", key).Str("Event", event).Msg("Ignoring keyspace event")
+		return nil
+	}
+}
+
+// send delivers an update unless ctx is done first.
+func send(ctx context.Context, updates chan<- Update, update Update) error {
+	select {
+	case updates <- update:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,196 @@
+package factsource
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseValue(t *testing.T) {
+	assert.Equal(t, 42, ParseValue("42"))
+	assert.Equal(t, 21.5, ParseValue("21.5"))
+	assert.Equal(t, true, ParseValue("true"))
+	assert.Equal(t, "TRUE", ParseValue("TRUE"))
+	assert.Equal(t, "eco", ParseValue("eco"))
+}
+
+func TestMapping(t *testing.T) {
+	mapping := Mapping{Prefix: "site1:", Facts: map[string]string{"temp": "temperature"}}
+
+	fact, ok := mapping.FactName("site1:temp")
+	assert.True(t, ok)
+	assert.Equal(t, "temperature", fact)
+
+	fact, ok = mapping.FactName("site1:humidity")
+	assert.True(t, ok)
+	assert.Equal(t, "humidity", fact)
+
+	_, ok = mapping.FactName("site2:temp")
+	assert.False(t, ok)
+
+	mapping.Strict = true
+	_, ok = mapping.FactName("site1:humidity")
+	assert.False(t, ok)
+}
+
+func newTestClient(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+// collect runs source in the background and returns a function receiving the
+// next n updates.
+func collect(t *testing.T, source Source) func(n int) []Update {
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan Update)
+	done := make(chan error, 1)
+	go func() { done <- source.Run(ctx, updates) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+	})
+
+	return func(n int) []Update {
+		var received []Update
+		for len(received) < n {
+			select {
+			case update := <-updates:
+				received = append(received, update)
+			case err := <-done:
+				t.Fatalf("source stopped: %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out after %d of %d updates", len(received), n)
+			}
+		}
+		return received
+	}
+}
+
+func TestRedisSource_Streams(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	source, err := NewRedisSource(client, RedisConfig{
+		Mode:     RedisStreams,
+		Streams:  []string{"sensors"},
+		Group:    "rex",
+		Consumer: "runtime-1",
+		Mapping:  Mapping{Facts: map[string]string{"temp": "temperature"}},
+	})
+	require.NoError(t, err)
+	next := collect(t, source)
+
+	// Wait for the consumer group to exist so the entries are delivered to it
+	require.Eventually(t, func() bool {
+		groups, err := client.XInfoGroups(ctx, "sensors").Result()
+		return err == nil && len(groups) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{Stream: "sensors", Values: []string{"temp", "31"}}).Err())
+	require.NoError(t, client.XAdd(ctx, &redis.XAddArgs{Stream: "sensors", Values: []string{"mode", "eco"}}).Err())
+
+	assert.Equal(t, []Update{
+		{Fact: "temperature", Value: 31},
+		{Fact: "mode", Value: "eco"},
+	}, next(2))
+
+	// Delivered entries are acknowledged
+	require.Eventually(t, func() bool {
+		pending, err := client.XPending(ctx, "sensors", "rex").Result()
+		return err == nil && pending.Count == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRedisSource_KeyEvents(t *testing.T) {
+	server, client := newTestClient(t)
+	ctx := context.Background()
+
+	source, err := NewRedisSource(client, RedisConfig{Mode: RedisKeyspace, Mapping: Mapping{Prefix: "facts:"}})
+	require.NoError(t, err)
+
+	updates := make(chan Update, 10)
+	require.NoError(t, server.Set("facts:humidity", "55.5"))
+	require.NoError(t, source.handleKeyEvent(ctx, "facts:humidity", "set", updates))
+	require.NoError(t, source.handleKeyEvent(ctx, "facts:humidity", "expired", updates))
+	require.NoError(t, source.handleKeyEvent(ctx, "other:humidity", "set", updates))
+	require.NoError(t, source.handleKeyEvent(ctx, "facts:humidity", "expire", updates))
+	close(updates)
+
+	var received []Update
+	for update := range updates {
+		received = append(received, update)
+	}
+	assert.Equal(t, []Update{
+		{Fact: "humidity", Value: 55.5},
+		{Fact: "humidity", Deleted: true},
+	}, received)
+}
+
+func TestNewRedisSource_InvalidConfig(t *testing.T) {
+	_, client := newTestClient(t)
+
+	_, err := NewRedisSource(client, RedisConfig{Mode: RedisStreams})
+	assert.Error(t, err)
+	_, err = NewRedisSource(client, RedisConfig{Mode: RedisStreams, Streams: []string{"s"}, Group: "g"})
+	assert.Error(t, err)
+	_, err = NewRedisSource(client, RedisConfig{Mode: "pubsub"})
+	assert.Error(t, err)
+	_, err = NewRedisSource(client, RedisConfig{Mode: RedisKeyspace, PartitionKey: "deviceId"})
+	assert.Error(t, err)
+	_, err = NewRedisSource(client, RedisConfig{Mode: RedisKeyspace, CorrelationField: "traceId"})
+	assert.Error(t, err)
+}
+
+func TestRedisSource_PartitionKey(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	source, err := NewRedisSource(client, RedisConfig{Mode: RedisStreams, Streams: []string{"sensors"}, PartitionKey: "deviceId"})
+	require.NoError(t, err)
+
+	updates := make(chan Update, 10)
+	require.NoError(t, source.sendFields(ctx, map[string]interface{}{"deviceId": "d1", "temperature": "31"}, updates))
+	require.NoError(t, source.sendFields(ctx, map[string]interface{}{"temperature": "20"}, updates))
+	close(updates)
+
+	var received []Update
+	for update := range updates {
+		received = append(received, update)
+	}
+	assert.Equal(t, []Update{{Fact: "temperature", Value: 31, Entity: "d1"}}, received,
+		"The key itself isn't an update, and entries without it are skipped")
+}
+
+func TestRedisSource_CorrelationField(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	source, err := NewRedisSource(client, RedisConfig{
+		Mode:             RedisStreams,
+		Streams:          []string{"sensors"},
+		Mapping:          Mapping{Prefix: "facts."},
+		CorrelationField: "traceId",
+	})
+	require.NoError(t, err)
+
+	updates := make(chan Update, 10)
+	require.NoError(t, source.sendFields(ctx, map[string]interface{}{"traceId": "reading-7", "facts.temperature": "31"}, updates))
+	require.NoError(t, source.sendFields(ctx, map[string]interface{}{"facts.humidity": "40"}, updates))
+	close(updates)
+
+	var received []Update
+	for update := range updates {
+		received = append(received, update)
+	}
+	assert.Equal(t, []Update{
+		{Fact: "temperature", Value: 31, CorrelationID: "reading-7"},
+		{Fact: "humidity", Value: 40},
+	}, received)
+}
@@ -0,0 +1,68 @@
+// factsource/source.go
+
+// Package factsource feeds fact changes from external systems into the
+// runtime.
+package factsource
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// Update is a change to a fact reported by a Source.
+type Update struct {
+	Fact    string
+	Value   interface{}
+	Deleted bool   // The fact no longer exists; Value is nil
+	Entity  string // Entity the fact belongs to when the source is partitioned, e.g. a device ID
+
+	// CorrelationID identifies the change in the system that reported it,
+	// for the runtime to label the evaluation cycle it triggers with
+	CorrelationID string
+}
+
+// Source produces fact updates. Run sends updates until ctx is done or the
+// source fails, and returns the reason it stopped.
+type Source interface {
+	Run(ctx context.Context, updates chan<- Update) error
+}
+
+// ParseValue converts a textual fact value to the type rules compare it as:
+// an int, a float64, a bool, or otherwise the string itself.
+func ParseValue(text string) interface{} {
+	if value, err := strconv.ParseInt(text, 10, 0); err == nil {
+		return int(value)
+	}
+	if value, err := strconv.ParseFloat(text, 64); err == nil {
+		return value
+	}
+	if text == "true" || text == "false" {
+		return text == "true"
+	}
+	return text
+}
+
+// Mapping translates external names, such as Redis keys or stream fields, to
+// fact names.
+type Mapping struct {
+	Prefix string            // Stripped from external names before looking them up
+	Facts  map[string]string // External name (without Prefix) to fact name
+	Strict bool              // Ignore names missing from Facts instead of using them as fact names
+}
+
+// FactName returns the fact an external name maps to, and false if it should
+// be ignored.
+func (m Mapping) FactName(name string) (string, bool) {
+	if !strings.HasPrefix(name, m.Prefix) {
+		return "", false
+	}
+	name = strings.TrimPrefix(name, m.Prefix)
+	if fact, ok := m.Facts[name]; ok {
+		return fact, true
+	}
+	if m.Strict || name == "" {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,69 @@
+// pkg/preprocessor/actions.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"time"
+)
+
+// ruleConditionBlocks returns the conditions of a rule followed by the
+// guards of its actions, which compare facts like the rule's own conditions.
+func ruleConditionBlocks(rule *rules.Rule) []*rules.Conditions {
+	return append([]*rules.Conditions{&rule.Conditions}, actionGuards(rule)...)
+}
+
+// actionGuards returns the guards of the actions of a rule's event and
+// variants.
+func actionGuards(rule *rules.Rule) []*rules.Conditions {
+	var guards []*rules.Conditions
+	for _, action := range ruleActions(rule) {
+		if action.When != nil {
+			guards = append(guards, action.When)
+		}
+	}
+	return guards
+}
+
+// validateActionGuards checks the guards of a rule's actions like the rule's
+// conditions; a guard must have at least one condition.
+func validateActionGuards(rule *rules.Rule, strictness Strictness) []error {
+	var errs []error
+	check := func(path string, actions []rules.Action) {
+		for i, action := range actions {
+			if action.When == nil {
+				continue
+			}
+			path := fmt.Sprintf("%s[%d].when", path, i)
+			if len(action.When.All) == 0 && len(action.When.Any) == 0 && len(action.When.Not) == 0 {
+				errs = append(errs, atPath(path, fmt.Errorf("the guard of a %s action must have at least one condition", action.Type)))
+				continue
+			}
+			errs = append(errs, validateConditions(path, action.When, strictness)...)
+		}
+	}
+	check("event.actions", rule.Event.Actions)
+	for i, variant := range rule.Variants {
+		check(fmt.Sprintf("variants[%d].actions", i), variant.Actions)
+	}
+	return errs
+}
+
+// validateActionDelays checks the delays of a rule's actions: a delay is a
+// positive duration, and only actions performed after the cycle, not fact
+// writes, can be delayed.
+func validateActionDelays(rule *rules.Rule) error {
+	for _, action := range ruleActions(rule) {
+		if action.Delay == "" {
+			continue
+		}
+		if rules.IsFactUpdate(action) {
+			return fmt.Errorf("%s action of rule '%s' has a delay, but fact writes can't be delayed", action.Type, rule.Name)
+		}
+		if delay, err := time.ParseDuration(action.Delay); err != nil || delay <= 0 {
+			return fmt.Errorf("%s action of rule '%s' has an invalid delay '%s', must be a positive duration such as 10m", action.Type, rule.Name, action.Delay)
+		}
+	}
+	return nil
+}
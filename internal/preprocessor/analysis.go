@@ -0,0 +1,270 @@
+// pkg/preprocessor/analysis.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"sort"
+)
+
+// FactUsage summarizes how the rules of a ruleset produce and consume facts.
+// All lists are sorted.
+type FactUsage struct {
+	Produced []string // Facts written by updateFact actions
+	Consumed []string // Facts compared by conditions
+
+	// UnusedProductions lists facts produced by rules but consumed by none.
+	UnusedProductions []string
+	// UndefinedInputs lists facts consumed by rules that are neither produced
+	// by a rule nor declared as external inputs.
+	UndefinedInputs []string
+}
+
+// AnalyzeFactUsage reports the facts of a ruleset that are produced but never
+// consumed, and consumed but never produced or declared in externalInputs.
+func AnalyzeFactUsage(ruleSet []*rules.Rule, externalInputs []string) FactUsage {
+	context := rules.NewRuleEngineContext()
+	for _, rule := range ruleSet {
+		updateConsumedFacts(rule, context)
+		updateProducedFacts(rule, context)
+	}
+
+	inputs := make(map[string]bool, len(externalInputs))
+	for _, fact := range externalInputs {
+		inputs[fact] = true
+	}
+
+	var usage FactUsage
+	for fact := range context.ProducedFacts {
+		usage.Produced = append(usage.Produced, fact)
+		if !factIn(fact, context.ConsumedFacts) {
+			usage.UnusedProductions = append(usage.UnusedProductions, fact)
+		}
+	}
+	for fact := range context.ConsumedFacts {
+		usage.Consumed = append(usage.Consumed, fact)
+		if !factIn(fact, context.ProducedFacts) && !factIn(fact, inputs) {
+			usage.UndefinedInputs = append(usage.UndefinedInputs, fact)
+		}
+	}
+
+	sort.Strings(usage.Produced)
+	sort.Strings(usage.Consumed)
+	sort.Strings(usage.UnusedProductions)
+	sort.Strings(usage.UndefinedInputs)
+	return usage
+}
+
+// factIn reports whether a fact or fact pattern is in a set of facts and
+// patterns: listed as is, or matching or matched by one of them.
+func factIn(fact string, facts map[string]bool) bool {
+	if facts[fact] {
+		return true
+	}
+	for other := range facts {
+		if rules.MatchFact(other, fact) || rules.MatchFact(fact, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleImpact describes how a rule is connected to the rest of its ruleset
+// through the facts it reads and writes, to review the effects of changing it.
+// All lists are sorted.
+type RuleImpact struct {
+	Rule   string   `json:"rule"`
+	Reads  []string `json:"reads"`  // Facts and fact patterns read by the rule
+	Writes []string `json:"writes"` // Facts written by the rule's updateFact actions
+
+	// Upstream lists the rules whose writes the rule reads, directly or
+	// through other rules.
+	Upstream []string `json:"upstream"`
+	// Downstream lists the rules reading the rule's writes, directly or
+	// through other rules.
+	Downstream []string `json:"downstream"`
+	// Actions lists the actions of the rule and of its downstream rules,
+	// which changing the rule could trigger or suppress.
+	Actions []ImpactedAction `json:"actions"`
+}
+
+// ImpactedAction is an action a change to a rule could affect.
+type ImpactedAction struct {
+	Rule   string `json:"rule"`
+	Type   string `json:"type"`
+	Target string `json:"target"`
+}
+
+// AnalyzeImpact reports the facts the named rule reads and writes, the rules
+// it depends on and that depend on it, and the actions it can affect.
+func AnalyzeImpact(ruleSet []*rules.Rule, ruleName string) (RuleImpact, error) {
+	reads, writes := ruleFacts(ruleSet)
+	index := -1
+	for i, rule := range ruleSet {
+		if rule.Name == ruleName {
+			index = i
+		}
+	}
+	if index < 0 {
+		return RuleImpact{}, fmt.Errorf("no rule named '%s'", ruleName)
+	}
+
+	// feeds reports whether rule i writes a fact rule j reads
+	feeds := func(i, j int) bool { return feedsRule(writes[i], reads[j]) }
+	upstream := reachableRules(len(ruleSet), index, func(i, j int) bool { return feeds(j, i) })
+	downstream := reachableRules(len(ruleSet), index, feeds)
+
+	impact := RuleImpact{Rule: ruleName, Reads: sortedFacts(reads[index]), Writes: sortedFacts(writes[index])}
+	for _, i := range upstream {
+		impact.Upstream = append(impact.Upstream, ruleSet[i].Name)
+	}
+	for _, i := range downstream {
+		impact.Downstream = append(impact.Downstream, ruleSet[i].Name)
+	}
+	for _, i := range append([]int{index}, downstream...) {
+		for _, action := range ruleActions(ruleSet[i]) {
+			impact.Actions = append(impact.Actions, ImpactedAction{Rule: ruleSet[i].Name, Type: action.Type, Target: action.Target})
+		}
+	}
+
+	sort.Strings(impact.Upstream)
+	sort.Strings(impact.Downstream)
+	sort.SliceStable(impact.Actions, func(i, j int) bool {
+		return impact.Actions[i].Rule < impact.Actions[j].Rule
+	})
+	return impact, nil
+}
+
+// DependencyGraph describes how the rules of a ruleset depend on each other
+// through the facts they read and write. All lists are sorted, except that
+// Rules is in ruleset order and Cycles as FindDependencyCycles returns them.
+type DependencyGraph struct {
+	Rules  []RuleDependencies `json:"rules"`
+	Facts  []FactDependencies `json:"facts"`
+	Cycles []DependencyCycle  `json:"cycles"`
+}
+
+// RuleDependencies lists the facts a rule reads and writes and the rules it
+// is directly connected to through them.
+type RuleDependencies struct {
+	Rule      string   `json:"rule"`
+	Reads     []string `json:"reads"`     // Facts and fact patterns read by the rule
+	Writes    []string `json:"writes"`    // Facts written by the rule's updateFact actions
+	DependsOn []string `json:"dependsOn"` // Rules writing facts the rule reads
+	Feeds     []string `json:"feeds"`     // Rules reading facts the rule writes
+}
+
+// FactDependencies lists the rules reading and writing a fact or fact
+// pattern. A pattern is read and written by the rules reading and writing
+// the facts it matches.
+type FactDependencies struct {
+	Fact      string   `json:"fact"`
+	ReadBy    []string `json:"readBy"`
+	WrittenBy []string `json:"writtenBy"`
+}
+
+// AnalyzeDependencyGraph reports the direct dependencies between the rules
+// of a ruleset, the facts they share and the cycles they form.
+func AnalyzeDependencyGraph(ruleSet []*rules.Rule) DependencyGraph {
+	reads, writes := ruleFacts(ruleSet)
+
+	var graph DependencyGraph
+	facts := make(map[string]bool)
+	for i, rule := range ruleSet {
+		dependencies := RuleDependencies{Rule: rule.Name, Reads: sortedFacts(reads[i]), Writes: sortedFacts(writes[i])}
+		for j, other := range ruleSet {
+			if j == i {
+				continue
+			}
+			if feedsRule(writes[j], reads[i]) {
+				dependencies.DependsOn = append(dependencies.DependsOn, other.Name)
+			}
+			if feedsRule(writes[i], reads[j]) {
+				dependencies.Feeds = append(dependencies.Feeds, other.Name)
+			}
+		}
+		sort.Strings(dependencies.DependsOn)
+		sort.Strings(dependencies.Feeds)
+		graph.Rules = append(graph.Rules, dependencies)
+
+		for fact := range reads[i] {
+			facts[fact] = true
+		}
+		for fact := range writes[i] {
+			facts[fact] = true
+		}
+	}
+
+	for _, fact := range sortedFacts(facts) {
+		dependencies := FactDependencies{Fact: fact}
+		for i, rule := range ruleSet {
+			if factIn(fact, reads[i]) {
+				dependencies.ReadBy = append(dependencies.ReadBy, rule.Name)
+			}
+			if factIn(fact, writes[i]) {
+				dependencies.WrittenBy = append(dependencies.WrittenBy, rule.Name)
+			}
+		}
+		sort.Strings(dependencies.ReadBy)
+		sort.Strings(dependencies.WrittenBy)
+		graph.Facts = append(graph.Facts, dependencies)
+	}
+	graph.Cycles = FindDependencyCycles(ruleSet)
+	return graph
+}
+
+// ruleFacts returns the facts read and written by each rule of a ruleset.
+func ruleFacts(ruleSet []*rules.Rule) (reads, writes []map[string]bool) {
+	reads = make([]map[string]bool, len(ruleSet))
+	writes = make([]map[string]bool, len(ruleSet))
+	for i, rule := range ruleSet {
+		context := rules.NewRuleEngineContext()
+		updateConsumedFacts(rule, context)
+		updateProducedFacts(rule, context)
+		reads[i], writes[i] = context.ConsumedFacts, context.ProducedFacts
+	}
+	return reads, writes
+}
+
+// feedsRule reports whether a rule writing writes affects a rule reading
+// reads.
+func feedsRule(writes, reads map[string]bool) bool {
+	for fact := range writes {
+		if factIn(fact, reads) {
+			return true
+		}
+	}
+	return false
+}
+
+// reachableRules returns the rules reachable from rule start by following
+// edge(from, to), in breadth-first order and excluding start itself.
+func reachableRules(count, start int, edge func(from, to int) bool) []int {
+	visited := make([]bool, count)
+	visited[start] = true
+	var reached []int
+	queue := []int{start}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for to := 0; to < count; to++ {
+			if !visited[to] && edge(from, to) {
+				visited[to] = true
+				reached = append(reached, to)
+				queue = append(queue, to)
+			}
+		}
+	}
+	return reached
+}
+
+// sortedFacts returns the facts of a set in order.
+func sortedFacts(facts map[string]bool) []string {
+	var sorted []string
+	for fact := range facts {
+		sorted = append(sorted, fact)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,135 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzeFactUsage(t *testing.T) {
+	ruleSet := []*rules.Rule{
+		{
+			Name: "cool",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30}},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan_status", Value: true}}},
+		},
+		{
+			Name: "alarm",
+			Conditions: rules.Conditions{
+				Any: []rules.Condition{
+					{Fact: "fan_status", Operator: "equal", Value: true},
+					{All: []rules.Condition{{Fact: "smoke", Operator: "equal", Value: true}}},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "alarm", Value: true}}},
+		},
+	}
+
+	usage := AnalyzeFactUsage(ruleSet, []string{"temperature"})
+
+	assert.Equal(t, []string{"alarm", "fan_status"}, usage.Produced)
+	assert.Equal(t, []string{"fan_status", "smoke", "temperature"}, usage.Consumed)
+	assert.Equal(t, []string{"alarm"}, usage.UnusedProductions)
+	assert.Equal(t, []string{"smoke"}, usage.UndefinedInputs)
+}
+
+func TestAnalyzeFactUsage_FactPatterns(t *testing.T) {
+	ruleSet := []*rules.Rule{
+		{
+			Name: "hot",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "sensor.*.temperature", Operator: "greaterThan", Value: 30}},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "zone.kitchen.alarm", Value: true}}},
+		},
+		{
+			Name: "alarm",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "zone.*.alarm", Operator: "equal", Value: true}},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "siren", Value: true}}},
+		},
+	}
+
+	// Patterns are covered by the facts and inputs they match, and cover the
+	// facts matching them
+	usage := AnalyzeFactUsage(ruleSet, []string{"sensor.*.temperature"})
+	assert.Equal(t, []string{"siren"}, usage.UnusedProductions)
+	assert.Empty(t, usage.UndefinedInputs)
+
+	usage = AnalyzeFactUsage(ruleSet, nil)
+	assert.Equal(t, []string{"sensor.*.temperature"}, usage.UndefinedInputs)
+}
+
+func TestAnalyzeImpact(t *testing.T) {
+	condition := func(fact string) rules.Conditions {
+		return rules.Conditions{All: []rules.Condition{{Fact: fact, Operator: "equal", Value: true}}}
+	}
+	update := func(fact string) rules.Event {
+		return rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: fact, Value: true}}}
+	}
+	ruleSet := []*rules.Rule{
+		{Name: "hot", Conditions: condition("sensor.*"), Event: update("hot")},
+		{Name: "cool", Conditions: condition("hot"), Event: update("fan_on")},
+		{Name: "alert", Conditions: condition("fan_on"), Event: rules.Event{Actions: []rules.Action{
+			{Type: "sendAlert", Target: "ops"},
+			{Type: "updateFact", Target: "alerted", Value: true},
+		}}},
+		{Name: "feed", Conditions: condition("door_open"), Event: update("sensor.hall")},
+		{Name: "unrelated", Conditions: condition("door_open"), Event: update("light_on")},
+	}
+
+	impact, err := AnalyzeImpact(ruleSet, "cool")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hot"}, impact.Reads)
+	assert.Equal(t, []string{"fan_on"}, impact.Writes)
+	// feed writes a fact matched by the pattern hot reads
+	assert.Equal(t, []string{"feed", "hot"}, impact.Upstream)
+	assert.Equal(t, []string{"alert"}, impact.Downstream)
+	assert.Equal(t, []ImpactedAction{
+		{Rule: "alert", Type: "sendAlert", Target: "ops"},
+		{Rule: "alert", Type: "updateFact", Target: "alerted"},
+		{Rule: "cool", Type: "updateFact", Target: "fan_on"},
+	}, impact.Actions)
+
+	impact, err = AnalyzeImpact(ruleSet, "unrelated")
+	require.NoError(t, err)
+	assert.Empty(t, impact.Upstream)
+	assert.Empty(t, impact.Downstream)
+
+	_, err = AnalyzeImpact(ruleSet, "missing")
+	assert.EqualError(t, err, "no rule named 'missing'")
+}
+
+func TestAnalyzeDependencyGraph(t *testing.T) {
+	condition := func(fact string) rules.Conditions {
+		return rules.Conditions{All: []rules.Condition{{Fact: fact, Operator: "equal", Value: true}}}
+	}
+	update := func(fact string) rules.Event {
+		return rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: fact, Value: true}}}
+	}
+	ruleSet := []*rules.Rule{
+		{Name: "hot", Conditions: condition("sensor.*"), Event: update("hot")},
+		{Name: "cool", Conditions: condition("hot"), Event: update("fan_on")},
+		{Name: "feed", Conditions: condition("door_open"), Event: update("sensor.hall")},
+	}
+
+	graph := AnalyzeDependencyGraph(ruleSet)
+	assert.Equal(t, []RuleDependencies{
+		{Rule: "hot", Reads: []string{"sensor.*"}, Writes: []string{"hot"}, DependsOn: []string{"feed"}, Feeds: []string{"cool"}},
+		{Rule: "cool", Reads: []string{"hot"}, Writes: []string{"fan_on"}, DependsOn: []string{"hot"}},
+		{Rule: "feed", Reads: []string{"door_open"}, Writes: []string{"sensor.hall"}, Feeds: []string{"hot"}},
+	}, graph.Rules)
+	assert.Equal(t, []FactDependencies{
+		{Fact: "door_open", ReadBy: []string{"feed"}},
+		{Fact: "fan_on", WrittenBy: []string{"cool"}},
+		{Fact: "hot", ReadBy: []string{"cool"}, WrittenBy: []string{"hot"}},
+		// The pattern and the fact it matches share their readers and writers
+		{Fact: "sensor.*", ReadBy: []string{"hot"}, WrittenBy: []string{"feed"}},
+		{Fact: "sensor.hall", ReadBy: []string{"hot"}, WrittenBy: []string{"feed"}},
+	}, graph.Facts)
+}
@@ -19,3 +19,37 @@ func ConvertRulesToBytecode(optimizedRules []*rules.Rule) ([]byte, error) {
 
 	return compiledBytecode, nil
 }
+
+// IndexFacts assigns an index to every fact the rules consume or produce that
+// isn't indexed in context yet, in order of first use.
+func IndexFacts(ruleSet []*rules.Rule, context *rules.RuleEngineContext) {
+	for _, rule := range ruleSet {
+		for _, facts := range [][]string{rule.ConsumedFacts, rule.ProducedFacts} {
+			for _, fact := range facts {
+				if _, exists := context.FactIndex[fact]; !exists {
+					context.FactIndex[fact] = len(context.FactIndex)
+				}
+			}
+		}
+	}
+}
+
+// RuleSymbols returns the symbols of the optimized rules embedded with
+// bytecode.NewRulesSection, given the rules as written, cloned with
+// CloneRules before being passed to OptimizeRules: the name of each rule,
+// those of the rules merged into it and the metadata permissive parsing kept.
+func RuleSymbols(validated, optimized []*rules.Rule) []bytecode.RuleSymbol {
+	symbols := make([]bytecode.RuleSymbol, len(optimized))
+	index := make(map[string]int, len(optimized))
+	for i, rule := range optimized {
+		symbols[i] = bytecode.RuleSymbol{Name: rule.Name, Metadata: rule.Metadata}
+		index[rule.Name] = i
+	}
+	merged, _ := CompareOptimized(validated, optimized)
+	for _, m := range merged {
+		if i, ok := index[m.Into]; ok {
+			symbols[i].Merged = append(symbols[i].Merged, m.Rule)
+		}
+	}
+	return symbols
+}
@@ -3,14 +3,139 @@
 package bytecode
 
 import (
+	"cmp"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"math"
 	"rgehrsitz/rex/internal/rules"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// ConditionMode selects how rule conditions are compiled.
+type ConditionMode int
+
+const (
+	// ConditionModeJump compiles each comparison to a conditional jump, so
+	// evaluation stops as soon as the outcome of the rule is known.
+	ConditionModeJump ConditionMode = iota
+	// ConditionModeBoolean evaluates the whole condition tree to a single
+	// boolean with AND, OR and NOT before a single conditional jump. Every
+	// comparison is evaluated, which suits tracing and coverage.
+	ConditionModeBoolean
+)
+
+// MarkerMode selects which structural markers the compiler emits. Markers
+// perform no computation: RULE_START and RULE_END delimit a rule, letting the
+// VM schedule rules by priority, skip the rest of a rule and resynchronize
+// after an error, and COND_START and COND_END delimit the condition code of a
+// rule for tools reading the bytecode.
+type MarkerMode int
+
+const (
+	// MarkerModeRules emits RULE_START and RULE_END around every rule.
+	MarkerModeRules MarkerMode = iota
+	// MarkerModeNone emits no markers, producing the smallest bytecode. The
+	// VM then runs the rules straight through in bytecode order, without
+	// priorities, per-rule hooks, forward chaining or error recovery. Rules
+	// with rollouts or variants need markers and can't be compiled this way.
+	MarkerModeNone
+	// MarkerModeAll also emits COND_START and COND_END around the condition
+	// code of every rule.
+	MarkerModeAll
+)
+
+// ParseConditionMode returns the condition mode with the given name: jump
+// or boolean.
+func ParseConditionMode(name string) (ConditionMode, error) {
+	switch name {
+	case "jump":
+		return ConditionModeJump, nil
+	case "boolean":
+		return ConditionModeBoolean, nil
+	default:
+		return 0, fmt.Errorf("unknown condition mode %q, must be jump or boolean", name)
+	}
+}
+
+// ParseMarkerMode returns the marker mode with the given name: rules, none
+// or all.
+func ParseMarkerMode(name string) (MarkerMode, error) {
+	switch name {
+	case "rules":
+		return MarkerModeRules, nil
+	case "none":
+		return MarkerModeNone, nil
+	case "all":
+		return MarkerModeAll, nil
+	default:
+		return 0, fmt.Errorf("unknown marker mode %q, must be rules, none or all", name)
+	}
+}
+
+// Options controls optional compiler behaviour.
+type Options struct {
+	// StrictNumeric rejects conditions that mix integer and floating point
+	// numbers, either because an "int" condition has a fractional value or
+	// because the same fact is compared as an int in one place and as a float
+	// in another. When false, such comparisons are promoted to float.
+	StrictNumeric bool
+
+	// ConditionMode selects the compilation strategy for conditions.
+	ConditionMode ConditionMode
+
+	// Markers selects the structural markers emitted.
+	Markers MarkerMode
+
+	// MaxStackDepth is the deepest the stack of a rule may grow; rules whose
+	// code would exceed it are rejected. Zero means DefaultMaxStackDepth.
+	MaxStackDepth int
+
+	// FloatEpsilon is how far apart floats compared by equal and notEqual may
+	// be and still be equal, for conditions without an epsilon of their own.
+	// Zero compares them exactly.
+	FloatEpsilon float64
+
+	// IntWidth is the widest integer, in bits, the target VM holds: 16, 32
+	// or 64. Below 64, integer constants are emitted in the narrowest
+	// encoding holding them, 2 or 4 bytes, and constants too wide for the
+	// target are rejected. Zero means 64.
+	IntWidth int
+
+	// Float32 emits float constants as float32, in 4 bytes instead of 8, for
+	// targets without float64. Constants outside the float32 range are
+	// rejected; the others keep about 7 significant digits.
+	Float32 bool
+
+	// Align pads the code before each rule with NOPs so that every rule
+	// starts at a multiple of Align bytes, letting tools patch a rule in
+	// place without moving the others. It must be a power of two up to
+	// MaxAlign; zero doesn't align.
+	Align int
+}
+
+// MaxAlign is the largest alignment of rules the compiler pads to.
+const MaxAlign = 256
+
+// Validate checks that the options' integer width is one the compiler
+// targets and that rules are aligned to a power of two.
+func (o Options) Validate() error {
+	switch o.IntWidth {
+	case 0, 16, 32, 64:
+	default:
+		return fmt.Errorf("integer width must be 16, 32 or 64 bits, not %d", o.IntWidth)
+	}
+	if o.Align < 0 || o.Align > MaxAlign || o.Align&(o.Align-1) != 0 {
+		return fmt.Errorf("alignment must be a power of two up to %d, not %d", MaxAlign, o.Align)
+	}
+	return nil
+}
+
 // Compiler compiles optimized rules into bytecode.
 type Compiler struct {
 	instructions       []Instruction
@@ -19,6 +144,19 @@ type Compiler struct {
 	labelCounter       int
 	context            *rules.RuleEngineContext
 	jumpsNeedingLabels []jumpLabelPair
+	options            Options
+	numericFactTypes   map[string]string // Numeric type each fact has been compared as
+	ruleOffsets        []int             // Bytecode offset at which each compiled rule starts
+	ruleNames          []string          // Name of each compiled rule
+	rulePriorities     []int             // Priority of each compiled rule
+	ruleEnds           []int             // Bytecode offset at which each compiled rule ends
+	variables          ruleVariables     // Local variables of the rule being compiled
+	constantErr        error             // First constant of the rule being compiled that can't be emitted
+	messages           []string          // Messages of the ERROR instructions, by index
+	webhooks           []Webhook         // Requests of the webhook actions, by index
+	delays             []ActionDelay     // Delays of the delayed actions
+	ruleActions        int               // TRIGGER_ACTION instructions of the rule being compiled so far
+	readers            FactReaders       // Rules reading each fact or fact pattern
 }
 
 type jumpLabelPair struct {
@@ -28,6 +166,11 @@ type jumpLabelPair struct {
 
 // NewCompiler creates a new instance of the bytecode compiler.
 func NewCompiler(context *rules.RuleEngineContext) *Compiler {
+	return NewCompilerWithOptions(context, Options{})
+}
+
+// NewCompilerWithOptions creates a new instance of the bytecode compiler with the given options.
+func NewCompilerWithOptions(context *rules.RuleEngineContext, options Options) *Compiler {
 	return &Compiler{
 		instructions:       []Instruction{},
 		bytecode:           []byte{},
@@ -35,25 +178,56 @@ func NewCompiler(context *rules.RuleEngineContext) *Compiler {
 		labelCounter:       0,
 		context:            context,
 		jumpsNeedingLabels: make([]jumpLabelPair, 0),
+		options:            options,
+		numericFactTypes:   make(map[string]string),
 	}
 }
 
 // Compile compiles a set of rules into bytecode.
 func (c *Compiler) Compile(rules []*rules.Rule) ([]byte, error) {
+	if err := c.options.Validate(); err != nil {
+		return nil, err
+	}
 	for _, rule := range rules {
 		if err := c.compileRule(rule); err != nil {
 			return nil, err
 		}
 	}
+	c.emitInstruction(HALT)
 
 	// After compiling all rules, resolve label offsets to finalize the bytecode
 	if err := c.resolveLabelOffsets(); err != nil {
 		return nil, err
 	}
 
+	if err := c.checkStack(); err != nil {
+		return nil, err
+	}
+
 	return c.bytecode, nil
 }
 
+// checkStack verifies that no rule's code would underflow or overflow the
+// stack, naming the rule at fault.
+func (c *Compiler) checkStack() error {
+	maxDepth := c.options.MaxStackDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxStackDepth
+	}
+
+	err := CheckStack(c.bytecode, maxDepth)
+	var stackErr *StackError
+	if !errors.As(err, &stackErr) {
+		return err
+	}
+	for i := len(c.ruleOffsets) - 1; i >= 0; i-- {
+		if stackErr.Offset >= c.ruleOffsets[i] {
+			return fmt.Errorf("rule '%s': %w", c.ruleNames[i], err)
+		}
+	}
+	return err
+}
+
 // generateUniqueLabel generates a unique label for use in the bytecode.
 func (c *Compiler) generateUniqueLabel(base string) string {
 	label := fmt.Sprintf("%s_%d", base, c.labelCounter)
@@ -107,38 +281,88 @@ func (c *Compiler) compileRule(rule *rules.Rule) error {
 		Str("RuleID", rule.Name).
 		Msg("Starting compilation of rule")
 
+	if align := c.options.Align; align > 0 {
+		for len(c.bytecode)%align != 0 {
+			c.emitInstruction(NOP)
+		}
+	}
+
 	startLabel := c.generateUniqueLabel("rule_start")
 	endLabel := c.generateUniqueLabel("rule_end")
 	c.emitLabel(startLabel)
+	c.ruleOffsets = append(c.ruleOffsets, len(c.bytecode))
+	c.ruleNames = append(c.ruleNames, rule.Name)
+	c.rulePriorities = append(c.rulePriorities, rule.Priority)
+	c.ruleActions = 0
+	c.beginRuleVariables(rule, endLabel)
+
+	if c.options.Markers == MarkerModeNone {
+		if (rule.Rollout != nil && *rule.Rollout < 100) || len(rule.Variants) > 0 {
+			return fmt.Errorf("rule '%s' has a rollout or variants, which need rule markers", rule.Name)
+		}
+		if rule.Held() {
+			return fmt.Errorf("rule '%s' has a duration or runs once, which needs rule markers", rule.Name)
+		}
+		if hasDelayedActions(rule) {
+			return fmt.Errorf("rule '%s' has delayed actions, which need rule markers", rule.Name)
+		}
+	} else {
+		// Record the rule priority so the VM can schedule rules accordingly
+		priority := make([]byte, 4)
+		binary.LittleEndian.PutUint32(priority, uint32(int32(rule.Priority)))
+		c.emitInstruction(RULE_START, priority...)
+	}
+
+	if rule.Rollout != nil && *rule.Rollout < 100 {
+		c.emitRollout(rule)
+	}
 
-	if err := c.compileConditions(rule.Conditions, endLabel); err != nil {
+	if c.options.Markers == MarkerModeAll {
+		c.emitInstruction(COND_START)
+	}
+	if rule.Scored() {
+		if err := c.compileScore(rule, endLabel); err != nil {
+			return err
+		}
+	} else if c.options.ConditionMode == ConditionModeBoolean {
+		if err := c.compileConditionExpression(rule.Conditions, endLabel); err != nil {
+			return err
+		}
+	} else if err := c.compileConditions(rule.Conditions, endLabel); err != nil {
 		return err
 	}
+	if c.options.Markers == MarkerModeAll {
+		c.emitInstruction(COND_END)
+	}
+	if rule.Held() {
+		if err := c.emitHold(rule); err != nil {
+			return err
+		}
+	}
 
 	// Compile the actions
-	for _, action := range rule.Event.Actions {
-		switch action.Type {
-		case "updateFact":
-			factIndex, err := c.getFactIndex(action.Target)
-			if err != nil {
-				return err
-			}
-			c.emitInstruction(UPDATE_FACT, byte(factIndex))
-			c.emitLoadConstantInstruction(action.Value, "bool")
-		// Add cases for other action types as needed
-		default:
-			log.Error().
-				Str("ActionType", action.Type).
-				Msg("Unsupported action type encountered")
-
-			return fmt.Errorf("unsupported action type: %s", action.Type)
+	if err := c.compileActions(rule.Event.Actions); err != nil {
+		return err
+	}
+	if len(rule.Variants) > 0 {
+		if err := c.compileVariants(rule); err != nil {
+			return err
 		}
 	}
 
+	if c.constantErr != nil {
+		err := fmt.Errorf("rule '%s': %w", rule.Name, c.constantErr)
+		c.constantErr = nil
+		return err
+	}
+
 	c.emitLabel(endLabel)
 
 	// After compiling the rule's conditions and actions
-	c.emitInstruction(RULE_END) // Emit RULE_END at the end of each rule
+	if c.options.Markers != MarkerModeNone {
+		c.emitInstruction(RULE_END) // Emit RULE_END at the end of each rule
+	}
+	c.ruleEnds = append(c.ruleEnds, len(c.bytecode))
 
 	log.Info().
 		Int("BytecodeSize", len(c.bytecode)).
@@ -147,99 +371,192 @@ func (c *Compiler) compileRule(rule *rules.Rule) error {
 	return nil
 }
 
-// compileConditions compiles conditions (including nested conditions) into bytecode.
+// compileConditions compiles conditions (including nested conditions) into
+// bytecode that jumps to endLabel as soon as the rule is known not to apply.
 func (c *Compiler) compileConditions(conditions rules.Conditions, endLabel string) error {
-	for i := range conditions.All {
-		// Use the index to obtain a pointer to each condition
-		if err := c.compileCondition(&conditions.All[i], endLabel, false); err != nil {
+	return c.compileBlock(conditions.All, conditions.Any, conditions.Not, endLabel, false)
+}
+
+// compileBlock compiles a block of conditions that holds when every condition
+// in all holds, if any isn't empty, at least one condition in any holds and,
+// if not isn't empty, not every condition in not holds. With jumpIfTrue the
+// emitted code jumps to jumpLabel when the block holds and falls through
+// otherwise; without it, it jumps when the block doesn't hold.
+func (c *Compiler) compileBlock(all, any, not []rules.Condition, jumpLabel string, jumpIfTrue bool) error {
+	// The block is the conjunction of its non-empty parts, each compiled to
+	// jump to a label when its outcome equals the given one
+	var parts []func(label string, onTrue bool) error
+	if len(all) > 0 {
+		parts = append(parts, func(label string, onTrue bool) error { return c.compileAll(all, label, onTrue) })
+	}
+	if len(any) > 0 {
+		parts = append(parts, func(label string, onTrue bool) error { return c.compileAny(any, label, onTrue) })
+	}
+	if len(not) > 0 {
+		// Negating the conjunction swaps the outcomes its jumps are taken on
+		parts = append(parts, func(label string, onTrue bool) error { return c.compileAll(not, label, !onTrue) })
+	}
+
+	switch {
+	case len(parts) == 0:
+		// An empty block always holds
+		if jumpIfTrue {
+			c.emitJump(JUMP, jumpLabel)
+		}
+		return nil
+	case len(parts) == 1:
+		return parts[0](jumpLabel, jumpIfTrue)
+	case !jumpIfTrue:
+		for _, part := range parts {
+			if err := part(jumpLabel, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		failLabel := c.generateUniqueLabel("block_fail")
+		last := len(parts) - 1
+		for _, part := range parts[:last] {
+			if err := part(failLabel, false); err != nil {
+				return err
+			}
+		}
+		if err := parts[last](jumpLabel, true); err != nil {
 			return err
 		}
+		c.emitLabel(failLabel)
+		return nil
 	}
+}
 
-	for i := range conditions.Any {
-		// Use the index to obtain a pointer to each condition
-		if err := c.compileCondition(&conditions.Any[i], endLabel, true); err != nil {
-			return err
+// compileAll compiles a conjunction. When jumping on success, every condition
+// but the last skips past the block on failure and the last one jumps to
+// jumpLabel on success.
+func (c *Compiler) compileAll(conditions []rules.Condition, jumpLabel string, jumpIfTrue bool) error {
+	if !jumpIfTrue {
+		for i := range conditions {
+			if err := c.compileCondition(&conditions[i], jumpLabel, false); err != nil {
+				return err
+			}
 		}
+		return nil
 	}
 
+	failLabel := c.generateUniqueLabel("all_fail")
+	last := len(conditions) - 1
+	for i := range conditions[:last] {
+		if err := c.compileCondition(&conditions[i], failLabel, false); err != nil {
+			return err
+		}
+	}
+	if err := c.compileCondition(&conditions[last], jumpLabel, true); err != nil {
+		return err
+	}
+	c.emitLabel(failLabel)
 	return nil
 }
 
-// compileCondition compiles a single condition or nested block into bytecode.
-func (c *Compiler) compileCondition(condition *rules.Condition, jumpLabel string, jumpIfTrue bool) error {
-	placeholder := []byte{0x00, 0x00} // Using 2 bytes for the placeholder
-
-	// Handle nested `all` conditions
-	if len(condition.All) > 0 {
-		for _, nestedCond := range condition.All {
-			if err := c.compileCondition(&nestedCond, jumpLabel, false); err != nil {
+// compileAny compiles a disjunction. When jumping on failure, every condition
+// but the last skips past the block on success and the last one jumps to
+// jumpLabel on failure.
+func (c *Compiler) compileAny(conditions []rules.Condition, jumpLabel string, jumpIfTrue bool) error {
+	if jumpIfTrue {
+		for i := range conditions {
+			if err := c.compileCondition(&conditions[i], jumpLabel, true); err != nil {
 				return err
 			}
 		}
-		return nil // All `all` conditions processed
+		return nil
 	}
 
-	// Handle nested `any` conditions
-	if len(condition.Any) > 0 {
-		anyEndLabel := c.generateUniqueLabel("any_end")
-		for _, nestedCond := range condition.Any {
-			if err := c.compileCondition(&nestedCond, jumpLabel, true); err != nil {
-				return err
-			}
+	anyEndLabel := c.generateUniqueLabel("any_end")
+	last := len(conditions) - 1
+	for i := range conditions[:last] {
+		if err := c.compileCondition(&conditions[i], anyEndLabel, true); err != nil {
+			return err
 		}
-		c.emitInstruction(JUMP, placeholder...)
-		c.jumpsNeedingLabels = append(c.jumpsNeedingLabels, jumpLabelPair{
-			instructionIndex: len(c.instructions) - 1, // Index of the jump instruction just added
-			label:            jumpLabel,               // The label the jump is associated with
-		})
-		c.emitLabel(anyEndLabel)
-		return nil // All `any` conditions processed
 	}
+	if err := c.compileCondition(&conditions[last], jumpLabel, false); err != nil {
+		return err
+	}
+	c.emitLabel(anyEndLabel)
+	return nil
+}
 
-	// Compile simple condition based on `Fact`, `Operator`, `Value`
-	factIndex, err := c.getFactIndex(condition.Fact) // Check for an error from getFactIndex
-	if err != nil {
-		return err // Return the error if the fact is not found
+// compileCondition compiles a single condition or nested block into bytecode
+// that jumps to jumpLabel when the condition's outcome equals jumpIfTrue.
+func (c *Compiler) compileCondition(condition *rules.Condition, jumpLabel string, jumpIfTrue bool) error {
+	if condition.IsBlock() {
+		return c.compileBlock(condition.All, condition.Any, condition.Not, jumpLabel, jumpIfTrue)
 	}
 
-	log.Debug().
-		Str("Fact", condition.Fact).
-		Int("FactIndex", factIndex).
-		Msg("Compiling condition for fact")
+	if condition.Script != "" {
+		if err := c.emitScript(ScriptCondition, condition.Script, condition.Facts); err != nil {
+			return err
+		}
+	} else if rules.IsFactPattern(condition.Fact) {
+		if err := c.emitMatchFacts(condition); err != nil {
+			return err
+		}
+	} else {
+		// Compile simple condition based on `Fact`, `Operator`, `Value`
+		factIndex, err := c.getFactIndex(condition.Fact) // Check for an error from getFactIndex
+		if err != nil {
+			return err // Return the error if the fact is not found
+		}
 
-	c.emitInstruction(LOAD_FACT, byte(factIndex))
-	c.emitLoadConstantInstruction(condition.Value, condition.ValueType) // Adjust for value type
+		log.Debug().
+			Str("Fact", condition.Fact).
+			Int("FactIndex", factIndex).
+			Msg("Compiling condition for fact")
+
+		if rules.IsExistenceOperator(condition.Operator) {
+			c.emitFactExists(condition, factIndex)
+		} else if isListOperator(condition.Operator) {
+			c.emitLoadFact(condition.Fact, factIndex)
+			if err := c.emitListMembership(condition); err != nil {
+				return err
+			}
+		} else {
+			valueType, err := c.resolveValueType(condition)
+			if err != nil {
+				return err
+			}
 
-	// Emit the comparison instruction based on `Operator`
-	comparisonOpcode := c.getComparisonOpcode(condition.Operator)
-	c.emitInstruction(comparisonOpcode)
+			c.emitLoadFact(condition.Fact, factIndex)
+			c.emitLoadConstantInstruction(condition.Value, valueType) // Adjust for value type
+
+			// Emit the comparison instruction based on `Operator`
+			c.emitConditionComparison(condition, valueType)
+		}
+	}
 
 	// Conditional jump based on the result
 	if jumpIfTrue {
-		c.emitInstruction(JUMP_IF_TRUE, placeholder...)
+		c.emitJump(JUMP_IF_TRUE, jumpLabel)
 	} else {
-		c.emitInstruction(JUMP_IF_FALSE, placeholder...)
+		c.emitJump(JUMP_IF_FALSE, jumpLabel)
 	}
 
-	// After emitting JUMP_IF_FALSE or JUMP_IF_TRUE
-	jumpType := "JUMP_IF_FALSE"
-	if jumpIfTrue {
-		jumpType = "JUMP_IF_TRUE"
-	}
+	return nil
+}
+
+// emitJump emits a jump with a placeholder offset, to be resolved once the
+// position of the label is known.
+func (c *Compiler) emitJump(opcode Opcode, label string) {
+	c.emitInstruction(opcode, 0x00, 0x00)
+	c.noteJump(label)
 
 	log.Debug().
-		Str("JumpType", jumpType).
+		Str("JumpType", opcode.String()).
 		Int("PlaceholderBytecodePosition", len(c.bytecode)-2).
-		Msg("Emitted conditional jump with placeholder")
+		Msg("Emitted jump with placeholder")
 
 	// Append jump needing label resolution
 	c.jumpsNeedingLabels = append(c.jumpsNeedingLabels, jumpLabelPair{
 		instructionIndex: len(c.instructions) - 1, // Index of the jump instruction just added
-		label:            jumpLabel,               // The label the jump is associated with
+		label:            label,                   // The label the jump is associated with
 	})
-
-	return nil
 }
 
 // resolveLabelOffsets replaces label placeholders with actual instruction offsets.
@@ -293,23 +610,27 @@ func (c *Compiler) getFactIndex(factName string) (int, error) {
 func (c *Compiler) emitLoadConstantInstruction(value interface{}, valueType string) {
 	switch valueType {
 	case "int":
-		var intValue int
 		switch v := value.(type) {
 		case float64:
 			// Force convert float64 to int if valueType is 'int'
-			intValue = int(v)
+			c.emitLoadInt(int64(v))
 		case int:
-			intValue = v
+			c.emitLoadInt(int64(v))
+		case int64:
+			c.emitLoadInt(v)
+		case uint64:
+			if v > math.MaxInt64 && c.narrowInts() {
+				c.constantError(fmt.Errorf("integer constant %d doesn't fit the %d-bit target", v, c.options.IntWidth))
+			} else if v > math.MaxInt64 {
+				buf := make([]byte, 8)
+				binary.LittleEndian.PutUint64(buf, v)
+				c.emitInstruction(LOAD_CONST_UINT64, buf...)
+			} else {
+				c.emitLoadInt(int64(v))
+			}
 		default:
-			log.Fatal().
-				Str("ExpectedType", "int").
-				Interface("ActualType", value).
-				Msg("Unsupported conversion")
-
+			c.constantError(fmt.Errorf("constant %v of type %T isn't an int", value, value))
 		}
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, uint32(intValue))
-		c.emitInstruction(LOAD_CONST_INT, buf...)
 
 	case "float":
 		var floatValue float64
@@ -317,30 +638,30 @@ func (c *Compiler) emitLoadConstantInstruction(value interface{}, valueType stri
 		case int:
 			// Force convert int to float64 if valueType is 'float'
 			floatValue = float64(v)
+		case int64:
+			floatValue = float64(v)
+		case uint64:
+			floatValue = float64(v)
 		case float64:
 			floatValue = v
 		default:
-			log.Fatal().
-				Str("Type", fmt.Sprintf("%T", value)).
-				Msg("Unsupported conversion: value type not expected for float")
-
+			c.constantError(fmt.Errorf("constant %v of type %T isn't a float", value, value))
+			return
 		}
-		buf := make([]byte, 8)
-		binary.LittleEndian.PutUint64(buf, math.Float64bits(floatValue))
-		c.emitInstruction(LOAD_CONST_FLOAT, buf...)
+		c.emitLoadFloat(floatValue)
 
 	case "string":
 		strValue, ok := value.(string)
 		if !ok {
-			log.Fatal().
-				Str("ValueType", fmt.Sprintf("%T", value)).
-				Msg("Unsupported conversion: value is not a string as expected")
+			c.constantError(fmt.Errorf("constant %v of type %T isn't a string", value, value))
+			return
 		}
 
 		strBytes := []byte(strValue)
-		// Assuming a single byte to denote length for simplicity, adjust as necessary.
-		if len(strBytes) > 255 {
-			panic("String value too long for LOAD_CONST_STRING instruction")
+		// A single byte holds the length
+		if len(strBytes) > math.MaxUint8 {
+			c.constantError(fmt.Errorf("string constant of %d bytes is longer than the %d bytes LOAD_CONST_STRING holds", len(strBytes), math.MaxUint8))
+			return
 		}
 		// Emit length followed by string bytes
 		c.emitInstruction(LOAD_CONST_STRING, append([]byte{byte(len(strBytes))}, strBytes...)...)
@@ -348,9 +669,8 @@ func (c *Compiler) emitLoadConstantInstruction(value interface{}, valueType stri
 	case "bool":
 		boolValue, ok := value.(bool)
 		if !ok {
-			log.Fatal().
-				Str("ValueType", fmt.Sprintf("%T", value)).
-				Msg("Unsupported conversion: value is not a bool as expected")
+			c.constantError(fmt.Errorf("constant %v of type %T isn't a bool", value, value))
+			return
 		}
 		var buf byte = 0x00
 		if boolValue {
@@ -359,12 +679,170 @@ func (c *Compiler) emitLoadConstantInstruction(value interface{}, valueType stri
 		c.emitInstruction(LOAD_CONST_BOOL, buf)
 
 	default:
-		panic(fmt.Sprintf("Unsupported valueType: '%s'", valueType))
+		c.constantError(fmt.Errorf("unsupported value type '%s'", valueType))
+	}
+}
+
+// emitLoadInt emits an integer constant, using the compact 4-byte encoding
+// when the value fits in an int32 and the 8-byte encoding otherwise. Targets
+// narrower than 64 bits also get the 2-byte encoding, and constants they
+// can't hold are recorded as an error.
+func (c *Compiler) emitLoadInt(value int64) {
+	if width := c.options.IntWidth; c.narrowInts() {
+		if value < -1<<(width-1) || value > 1<<(width-1)-1 {
+			c.constantError(fmt.Errorf("integer constant %d doesn't fit the %d-bit target", value, width))
+			return
+		}
+		if value >= math.MinInt16 && value <= math.MaxInt16 {
+			buf := make([]byte, 2)
+			binary.LittleEndian.PutUint16(buf, uint16(int16(value)))
+			c.emitInstruction(LOAD_CONST_INT16, buf...)
+			return
+		}
+	}
+	if value >= math.MinInt32 && value <= math.MaxInt32 {
+		buf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(buf, uint32(int32(value)))
+		c.emitInstruction(LOAD_CONST_INT, buf...)
+		return
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(value))
+	c.emitInstruction(LOAD_CONST_INT64, buf...)
+}
+
+// narrowInts reports whether the target holds integers narrower than 64 bits.
+func (c *Compiler) narrowInts() bool {
+	return c.options.IntWidth == 16 || c.options.IntWidth == 32
+}
+
+// emitLoadFloat emits a float constant, as a float32 for float32 targets, which
+// can't hold constants beyond the float32 range.
+func (c *Compiler) emitLoadFloat(value float64) {
+	if !c.options.Float32 {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(value))
+		c.emitInstruction(LOAD_CONST_FLOAT, buf...)
+		return
+	}
+	if math.Abs(value) > math.MaxFloat32 {
+		c.constantError(fmt.Errorf("float constant %v doesn't fit the float32 target", value))
+		return
+	}
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, math.Float32bits(float32(value)))
+	c.emitInstruction(LOAD_CONST_FLOAT32, buf...)
+}
+
+// constantError records a constant that can't be emitted, such as one the
+// target can't hold, failing the rule being compiled.
+func (c *Compiler) constantError(err error) {
+	if c.constantErr == nil {
+		c.constantErr = err
+	}
+}
+
+// emitComparison emits the instruction comparing the fact and value on the
+// stack. Custom operators are called by name.
+func (c *Compiler) emitComparison(operator, valueType string) {
+	if _, ok := rules.CustomOperator(operator); ok {
+		c.emitInstruction(CALL_OPERATOR, append([]byte(operator), 0)...)
+		return
+	}
+	opcode := c.getComparisonOpcode(operator, valueType)
+	if opcode == ERROR {
+		// Fail the rule when it runs rather than compare with the wrong opcode
+		c.emitError(fmt.Sprintf("unsupported comparison operator '%s' for type '%s'", operator, valueType))
+		return
+	}
+	c.emitInstruction(opcode)
+}
+
+// Quantifiers of the MATCH_FACTS instruction.
+const (
+	MatchAnyQuantifier byte = 0
+	MatchAllQuantifier byte = 1
+)
+
+// emitMatchFacts emits a condition on a fact pattern: the rule's value
+// followed by MATCH_FACTS, which compares it with every matching fact at
+// runtime and pushes the outcome.
+func (c *Compiler) emitMatchFacts(condition *rules.Condition) error {
+	log.Debug().
+		Str("Pattern", condition.Fact).
+		Str("Match", condition.Match).
+		Msg("Compiling condition for fact pattern")
+
+	if isListOperator(condition.Operator) || rules.IsExistenceOperator(condition.Operator) {
+		return fmt.Errorf("condition on fact pattern '%s' has operator '%s', which fact patterns don't support", condition.Fact, condition.Operator)
+	}
+	valueType, err := c.resolveValueType(condition)
+	if err != nil {
+		return err
+	}
+	c.emitLoadConstantInstruction(condition.Value, valueType)
+
+	quantifier := MatchAnyQuantifier
+	if condition.Match == rules.MatchAll {
+		quantifier = MatchAllQuantifier
+	}
+	operands := append([]byte{quantifier}, condition.Fact...)
+	operands = append(operands, 0)
+	operands = append(operands, condition.Operator...)
+	c.emitInstruction(MATCH_FACTS, append(operands, 0)...)
+	c.recordRead(condition.Fact)
+	return nil
+}
+
+// Kinds of script run by the CALL_SCRIPT instruction.
+const (
+	ScriptCondition byte = 0 // Decides a condition, returning a boolean
+	ScriptValue     byte = 1 // Computes the value a script action writes
+)
+
+// emitScript emits a CALL_SCRIPT instruction running a script that reads the
+// given facts.
+func (c *Compiler) emitScript(kind byte, source string, facts []string) error {
+	if len(facts) > math.MaxUint8 {
+		return fmt.Errorf("script reads %d facts, at most %d are allowed", len(facts), math.MaxUint8)
+	}
+	if strings.IndexByte(source, 0) >= 0 {
+		return errors.New("script contains a NUL character")
+	}
+
+	log.Debug().
+		Strs("Facts", facts).
+		Msg("Compiling script")
+
+	operands := []byte{kind, byte(len(facts))}
+	for _, fact := range facts {
+		operands = append(append(operands, fact...), 0)
 	}
+	operands = append(append(operands, source...), 0)
+	c.emitInstruction(CALL_SCRIPT, operands...)
+	if kind == ScriptCondition {
+		for _, fact := range facts {
+			c.recordRead(fact)
+		}
+	}
+	return nil
 }
 
-// Adjust getComparisonOpcode to match your operators
-func (c *Compiler) getComparisonOpcode(operator string) Opcode {
+// getComparisonOpcode returns the comparison opcode for an operator, using the
+// float or string variant of the instruction when the value type calls for it.
+// It returns ERROR for operators without one.
+func (c *Compiler) getComparisonOpcode(operator, valueType string) Opcode {
+	switch valueType {
+	case "float":
+		operator += "Float"
+	case "string":
+		if operator == "equal" || operator == "notEqual" || operator == "contains" || operator == "notContains" {
+			operator += "String"
+		}
+	case "bool":
+		operator += "Bool"
+	}
+
 	switch operator {
 	case "equal":
 		return EQ_INT
@@ -394,6 +872,14 @@ func (c *Compiler) getComparisonOpcode(operator string) Opcode {
 		return EQ_STRING
 	case "notEqualString":
 		return NEQ_STRING
+	case "equalBool":
+		return EQ_BOOL
+	case "notEqualBool":
+		return NEQ_BOOL
+	case "containsString":
+		return CONTAINS_STRING
+	case "notContainsString":
+		return NOT_CONTAINS_STRING
 	default:
 		log.Error().
 			Str("Operator", operator).
@@ -401,3 +887,235 @@ func (c *Compiler) getComparisonOpcode(operator string) Opcode {
 		return ERROR
 	}
 }
+
+// compileActions compiles the actions of a rule or variant in order: by
+// their Order, and those of equal order as listed. An action with a guard is
+// preceded by its conditions, which jump past the action unless they hold.
+func (c *Compiler) compileActions(actions []rules.Action) error {
+	actions = slices.Clone(actions)
+	slices.SortStableFunc(actions, func(a, b rules.Action) int { return cmp.Compare(a.Order, b.Order) })
+	for _, action := range actions {
+		if action.Delay != "" && rules.IsFactUpdate(action) {
+			return fmt.Errorf("%s action writing '%s' can't be delayed", action.Type, action.Target)
+		}
+		skipLabel := ""
+		if action.When != nil {
+			skipLabel = c.generateUniqueLabel("action_skip")
+			if err := c.compileGuard(*action.When, skipLabel); err != nil {
+				return err
+			}
+		}
+
+		switch rules.CanonicalActionType(action.Type) {
+		case rules.ActionUpdateFact:
+			factIndex, err := c.getFactIndex(action.Target)
+			if err != nil {
+				return err
+			}
+			c.emitInstruction(UPDATE_FACT, byte(factIndex))
+			if err := c.emitActionValue(action); err != nil {
+				return err
+			}
+		case rules.ActionScript:
+			factIndex, err := c.getFactIndex(action.Target)
+			if err != nil {
+				return err
+			}
+			source, ok := action.Value.(string)
+			if !ok {
+				return fmt.Errorf("script action writing '%s' has no script", action.Target)
+			}
+			c.emitInstruction(UPDATE_FACT, byte(factIndex))
+			if err := c.emitScript(ScriptValue, source, action.Facts); err != nil {
+				return err
+			}
+		case rules.ActionNotify, rules.ActionSendAlert, rules.ActionLogEvent, rules.ActionSendMessage:
+			if err := c.emitTriggerAction(action); err != nil {
+				return err
+			}
+		case rules.ActionWebhook:
+			if err := c.emitWebhook(action); err != nil {
+				return err
+			}
+		default:
+			// Other types are performed by the handlers the host registers
+			if err := c.emitTriggerAction(action); err != nil {
+				return err
+			}
+		}
+
+		if skipLabel != "" {
+			c.emitLabel(skipLabel)
+		}
+	}
+	return nil
+}
+
+// compileGuard compiles the guard of an action like the conditions of a
+// rule, jumping to skipLabel unless it holds.
+func (c *Compiler) compileGuard(guard rules.Conditions, skipLabel string) error {
+	if c.options.ConditionMode == ConditionModeBoolean {
+		return c.compileConditionExpression(guard, skipLabel)
+	}
+	return c.compileConditions(guard, skipLabel)
+}
+
+// emitTriggerAction pushes the value of an action performed by a runtime
+// handler and emits a TRIGGER_ACTION naming its type and target.
+func (c *Compiler) emitTriggerAction(action rules.Action) error {
+	if action.Type == "" || strings.ContainsRune(action.Type, 0) || strings.ContainsRune(action.Target, 0) {
+		return fmt.Errorf("invalid action type %q or target %q", action.Type, action.Target)
+	}
+	if err := c.emitActionValue(action); err != nil {
+		return err
+	}
+
+	return c.emitTriggerInstruction(action)
+}
+
+// emitTriggerInstruction emits the TRIGGER_ACTION instruction of an action,
+// whose value has been pushed, recording its delay if it has one.
+func (c *Compiler) emitTriggerInstruction(action rules.Action) error {
+	if action.Delay != "" {
+		delay, err := time.ParseDuration(action.Delay)
+		if err != nil || delay <= 0 {
+			return fmt.Errorf("%s action to '%s': invalid delay '%s'", action.Type, action.Target, action.Delay)
+		}
+		c.delays = append(c.delays, ActionDelay{Rule: len(c.ruleOffsets) - 1, Action: c.ruleActions, DelayMillis: delay.Milliseconds()})
+	}
+	c.ruleActions++
+
+	operands := append([]byte(action.Type), 0)
+	operands = append(append(operands, action.Target...), 0)
+	c.emitInstruction(TRIGGER_ACTION, operands...)
+	return nil
+}
+
+// hasDelayedActions reports whether any action of a rule has a delay.
+func hasDelayedActions(rule *rules.Rule) bool {
+	for _, action := range rule.Event.Actions {
+		if action.Delay != "" {
+			return true
+		}
+	}
+	for _, variant := range rule.Variants {
+		for _, action := range variant.Actions {
+			if action.Delay != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// emitActionValue pushes the value of an action as a constant of its own
+// type; a missing value is pushed as an empty string.
+func (c *Compiler) emitActionValue(action rules.Action) error {
+	switch value := action.Value.(type) {
+	case nil:
+		c.emitLoadConstantInstruction("", "string")
+	case string:
+		if len(value) > math.MaxUint8 {
+			return fmt.Errorf("%s action value is longer than %d bytes", action.Type, math.MaxUint8)
+		}
+		c.emitLoadConstantInstruction(value, "string")
+	case bool:
+		c.emitLoadConstantInstruction(value, "bool")
+	case int, int64, uint64:
+		c.emitLoadConstantInstruction(value, "int")
+	case float64:
+		c.emitLoadConstantInstruction(value, "float")
+	default:
+		return fmt.Errorf("unsupported %s action value: %v", action.Type, action.Value)
+	}
+	return nil
+}
+
+// compileVariants emits a VARIANT instruction followed by the actions of each
+// of the rule's variants, then VARIANT_END. The variants split the 100
+// assignment buckets between them in proportion to their weights.
+func (c *Compiler) compileVariants(rule *rules.Rule) error {
+	totalWeight := 0
+	for _, variant := range rule.Variants {
+		totalWeight += variantWeight(variant)
+	}
+
+	// Use a different salt than the rollout so that variant assignment is
+	// independent of whether the entity is in the rollout
+	hash := fnv.New32a()
+	hash.Write([]byte(rule.Name + "/variants"))
+	salt := hash.Sum32()
+
+	cumulativeWeight, low := 0, 0
+	for _, variant := range rule.Variants {
+		cumulativeWeight += variantWeight(variant)
+		high := cumulativeWeight * 100 / totalWeight
+
+		operands := []byte{byte(low), byte(high)}
+		operands = binary.LittleEndian.AppendUint32(operands, salt)
+		operands = append(append(operands, rule.VariantKey...), 0)
+		operands = append(append(operands, variant.Name...), 0)
+		c.emitInstruction(VARIANT, operands...)
+		c.recordRead(rule.VariantKey)
+
+		if err := c.compileActions(variant.Actions); err != nil {
+			return err
+		}
+		low = high
+	}
+	c.emitInstruction(VARIANT_END)
+	return nil
+}
+
+// variantWeight returns the weight of a variant, treating an unset weight as 1.
+func variantWeight(variant rules.Variant) int {
+	if variant.Weight <= 0 {
+		return 1
+	}
+	return variant.Weight
+}
+
+// Flags of the HOLD instruction.
+const (
+	HoldOnce byte = 1 // Run the actions once each time the conditions start holding
+)
+
+// emitHold emits a HOLD instruction after the conditions of a rule that only
+// runs its actions once its conditions have held for a duration, or once
+// while they hold.
+func (c *Compiler) emitHold(rule *rules.Rule) error {
+	duration, err := rule.HoldDuration()
+	if err != nil {
+		return fmt.Errorf("rule '%s' has an invalid duration: %w", rule.Name, err)
+	}
+	millis := duration.Milliseconds()
+	if millis < 0 || millis > math.MaxUint32 {
+		return fmt.Errorf("rule '%s' has duration %s, must be between 0 and %s", rule.Name, rule.For, MaxHoldDuration)
+	}
+
+	var flags byte
+	if rule.Once {
+		flags |= HoldOnce
+	}
+	operands := binary.LittleEndian.AppendUint32(nil, uint32(millis))
+	c.emitInstruction(HOLD, append(operands, flags)...)
+	return nil
+}
+
+// MaxHoldDuration is the longest duration a HOLD instruction can encode.
+const MaxHoldDuration = math.MaxUint32 * time.Millisecond
+
+// emitRollout emits a ROLLOUT instruction for a rule that only applies to a
+// percentage of entities. The salt is derived from the rule name so that
+// different rules rolled out to the same percentage select different entities.
+func (c *Compiler) emitRollout(rule *rules.Rule) {
+	hash := fnv.New32a()
+	hash.Write([]byte(rule.Name))
+
+	operands := []byte{byte(*rule.Rollout)}
+	operands = binary.LittleEndian.AppendUint32(operands, hash.Sum32())
+	operands = append(operands, rule.RolloutKey...)
+	operands = append(operands, 0)
+	c.emitInstruction(ROLLOUT, operands...)
+	c.recordRead(rule.RolloutKey)
+}
@@ -3,6 +3,7 @@ package bytecode
 import (
 	"encoding/json"
 	"rgehrsitz/rex/internal/rules"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -73,12 +74,15 @@ func TestCompileSimpleRule(t *testing.T) {
 
 	// Detailed bytecode assertion
 	expectedBytecode := []byte{
+		38, 0, 0, 0, 0, // RULE_START priority 0
 		17, 0, // LOAD_FACT "temperature"
 		19, 30, 0, 0, 0, // LOAD_CONST_INT 30
 		4,        // GT_INT
 		26, 5, 0, // JUMP_IF_FALSE 5 bytes ahead (corrected offset)
 		28, 1, // UPDATE_FACT "ac_status"
 		22, 1, // LOAD_CONST_BOOL true
+		37, // RULE_END
+		31, // HALT
 	}
 
 	assert.Equal(t, expectedBytecode, bytecode, "The generated bytecode does not match the expected sequence")
@@ -152,6 +156,7 @@ func TestCompileMultipleConditionsRule(t *testing.T) {
 
 	// Expected bytecode for multiple conditions
 	expectedBytecode := []byte{
+		38, 0, 0, 0, 0, // RULE_START priority 0
 		17, 0, // LOAD_FACT "temperature"
 		19, 25, 0, 0, 0, // LOAD_CONST_INT 25
 		4,         // GT_INT
@@ -162,6 +167,8 @@ func TestCompileMultipleConditionsRule(t *testing.T) {
 		26, 5, 0, // JUMP_IF_FALSE 5 bytes ahead
 		28, 2, // UPDATE_FACT "ac_status"
 		22, 1, // LOAD_CONST_BOOL true
+		37, // RULE_END
+		31, // HALT
 	}
 
 	assert.Equal(t, expectedBytecode, bytecode, "Compiled bytecode does not match the expected sequence")
@@ -234,6 +241,7 @@ func TestCompileAnyConditionsRule(t *testing.T) {
 
 	// Expected bytecode for "any" conditions
 	expectedBytecode := []byte{
+		38, 0, 0, 0, 0, // RULE_START priority 0
 		17, 0, // LOAD_FACT "temperature"
 		19, 28, 0, 0, 0, // LOAD_CONST_INT 28
 		4,         // GT_INT
@@ -244,6 +252,8 @@ func TestCompileAnyConditionsRule(t *testing.T) {
 		26, 5, 0, // JUMP_IF_FALSE 2 bytes ahead to action label
 		28, 2, // UPDATE_FACT "fan_status"
 		22, 1, // LOAD_CONST_BOOL true
+		37, // RULE_END
+		31, // HALT
 	}
 
 	assert.Equal(t, expectedBytecode, bytecode, "Compiled bytecode does not match the expected sequence")
@@ -325,6 +335,7 @@ func TestCompileNestedConditionsRule(t *testing.T) {
 
 	// Expected bytecode for nested conditions
 	expectedBytecode := []byte{
+		38, 0, 0, 0, 0, // RULE_START priority 0
 		17, 0, // LOAD_FACT "temperature"
 		19, 25, 0, 0, 0, // LOAD_CONST_INT 25
 		4,         // GT_INT
@@ -335,10 +346,12 @@ func TestCompileNestedConditionsRule(t *testing.T) {
 		25, 9, 0, // JUMP_IF_TRUE 9 bytes ahead to action
 		17, 2, // LOAD_FACT "room_occupied"
 		22, 1, // LOAD_CONST_BOOL true
-		0,        // EQ_BOOL
+		57,       // EQ_BOOL
 		26, 5, 0, // JUMP_IF_FALSE 5 bytes ahead to end
 		28, 3, // UPDATE_FACT "ac_status"
 		22, 1, // LOAD_CONST_BOOL true
+		37, // RULE_END
+		31, // HALT
 	}
 
 	assert.Equal(t, expectedBytecode, bytecode, "Compiled bytecode does not match the expected sequence")
@@ -435,24 +448,582 @@ func TestCompileMultipleRulesWithMixedConditions(t *testing.T) {
 	// Expected bytecode for multiple rules with mixed conditions
 	expectedBytecode := []byte{
 		// TemperatureRule
+		38, 0, 0, 0, 0, // RULE_START priority 0
 		17, 0, // LOAD_FACT "temperature"
 		19, 30, 0, 0, 0, // LOAD_CONST_INT 30
 		4,        // GT_INT
 		26, 5, 0, // JUMP_IF_FALSE 5 bytes ahead to end
 		28, 1, // UPDATE_FACT "ac_status"
 		22, 1, // LOAD_CONST_BOOL true
+		37, // RULE_END
 		// HumidityRule
+		38, 0, 0, 0, 0, // RULE_START priority 0
 		17, 2, // LOAD_FACT "humidity"
 		19, 40, 0, 0, 0, // LOAD_CONST_INT 40
 		2,        // LT_INT
 		25, 9, 0, // JUMP_IF_TRUE 9 bytes ahead to action
 		17, 3, // LOAD_FACT "room_occupied"
 		22, 1, // LOAD_CONST_BOOL true
-		0,        // EQ_BOOL
-		26, 1, 0, // JUMP_IF_FALSE 5 bytes ahead to end
+		57,       // EQ_BOOL
+		26, 5, 0, // JUMP_IF_FALSE 5 bytes ahead to end
 		28, 4, // UPDATE_FACT "dehumidifier_status"
 		22, 1, // LOAD_CONST_BOOL true
+		37, // RULE_END
+		31, // HALT
 	}
 
 	assert.Equal(t, expectedBytecode, bytecode, "Compiled bytecode does not match the expected sequence")
 }
+
+func TestCompileRulePriority(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name:     "HighPriority",
+			Priority: 300,
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}},
+			},
+		},
+		{
+			Name:     "NegativePriority",
+			Priority: -1,
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "lessThan", Value: 10, ValueType: "int"}},
+			},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	compiler := NewCompiler(context)
+
+	bytecode, err := compiler.Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+
+	// Each rule starts with a RULE_START carrying its priority as a little-endian int32
+	assert.Equal(t, []byte{38, 0x2c, 0x01, 0, 0}, bytecode[:5], "RULE_START should encode priority 300")
+	secondRule := len(bytecode) / 2
+	assert.Equal(t, []byte{38, 0xff, 0xff, 0xff, 0xff}, bytecode[secondRule:secondRule+5], "RULE_START should encode priority -1")
+}
+
+func TestCompileUpdateFactValueTypes(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "DoorOpening",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "contact", Operator: "equal", Value: false, ValueType: "bool"}},
+			},
+			Event: rules.Event{Actions: []rules.Action{
+				{Type: "updateFact", Target: "door.state", Value: "open"},
+				{Type: "updateFact", Target: "openings", Value: int64(3)},
+			}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["contact"] = 0
+	context.FactIndex["door.state"] = 1
+	context.FactIndex["openings"] = 2
+	bytecode, err := NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+
+	// Each value is loaded as a constant of its own type
+	listing, err := Disassemble(bytecode)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "LOAD_CONST_STRING \"open\"\n")
+	assert.Contains(t, listing, "LOAD_CONST_INT 3\n")
+}
+
+func TestCompileContainsConditions(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "FaultReported",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{
+					{Fact: "status", Operator: "contains", Value: "fault", ValueType: "string"},
+					{Fact: "status", Operator: "notContains", Value: "cleared", ValueType: "string"},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "alarm", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["status"] = 0
+	context.FactIndex["alarm"] = 1
+	bytecode, err := NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+
+	listing, err := Disassemble(bytecode)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "LOAD_CONST_STRING \"fault\"\n")
+	assert.Contains(t, listing, "  CONTAINS_STRING\n")
+	assert.Contains(t, listing, "  NOT_CONTAINS_STRING\n")
+	assert.NotContains(t, listing, "ERROR")
+}
+
+func TestCompileListConditions(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "CoastalOffice",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{
+					{Fact: "city", Operator: "in", Value: []interface{}{"NYC", "LA", "SF"}},
+					{Fact: "floor", Operator: "notIn", Value: []interface{}{int64(13), 2.5}},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "coastal", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["city"] = 0
+	context.FactIndex["floor"] = 1
+	context.FactIndex["coastal"] = 2
+	code, err := NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "IN_LIST [\"NYC\", \"LA\", \"SF\"]\n")
+	assert.Contains(t, listing, "NOT_IN_LIST [13, 2.5]\n")
+
+	for _, tc := range []struct {
+		name      string
+		condition rules.Condition
+		err       string
+	}{
+		{"Not a list", rules.Condition{Fact: "city", Operator: "in", Value: "NYC"}, "needs a list value"},
+		{"Empty", rules.Condition{Fact: "city", Operator: "in", Value: []interface{}{}}, "has an empty list"},
+		{"Mixed types", rules.Condition{Fact: "city", Operator: "in", Value: []interface{}{"NYC", 1}}, "unsupported type"},
+		{"Fact pattern", rules.Condition{Fact: "city.*", Operator: "in", Value: []interface{}{"NYC"}}, "fact patterns don't support"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &rules.Rule{Name: "Invalid", Conditions: rules.Conditions{All: []rules.Condition{tc.condition}}}
+			_, err := NewCompiler(context).Compile([]*rules.Rule{rule})
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestCompileUnsupportedComparison(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "DoorOrdering",
+			Conditions: rules.Conditions{
+				Any: []rules.Condition{
+					{Fact: "door_open", Operator: "greaterThan", Value: true, ValueType: "bool"},
+					{Fact: "door_open", Operator: "lessThan", Value: false, ValueType: "bool"},
+					{Fact: "door_locked", Operator: "greaterThan", Value: true, ValueType: "bool"},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "alarm", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["door_open"] = 0
+	context.FactIndex["door_locked"] = 1
+	context.FactIndex["alarm"] = 2
+	compiler := NewCompiler(context)
+	code, err := compiler.Compile(ruleset)
+	require.NoError(t, err, "the rule fails when it runs, not when it compiles")
+
+	// Each message is kept once
+	assert.Equal(t, []string{
+		"unsupported comparison operator 'greaterThan' for type 'bool'",
+		"unsupported comparison operator 'lessThan' for type 'bool'",
+	}, compiler.Messages())
+
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(listing, "ERROR message#0\n"))
+	assert.Equal(t, 1, strings.Count(listing, "ERROR message#1\n"))
+}
+
+func TestCompileAlign(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name:       "Cooling",
+			Conditions: rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}}},
+			Event:      rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan_status", Value: true}}},
+		},
+		{
+			Name:       "Heating",
+			Conditions: rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "lessThan", Value: 15, ValueType: "int"}}},
+			Event:      rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "heater_status", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	context.FactIndex["fan_status"] = 1
+	context.FactIndex["heater_status"] = 2
+	compiler := NewCompilerWithOptions(context, Options{Align: 16})
+	code, err := compiler.Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+
+	require.Len(t, compiler.ruleOffsets, 2)
+	for _, offset := range compiler.ruleOffsets {
+		assert.Zero(t, offset%16, "rule at offset %d isn't aligned", offset)
+		assert.Equal(t, byte(RULE_START), code[offset])
+	}
+	for _, b := range code[compiler.ruleOffsets[1]-3 : compiler.ruleOffsets[1]] {
+		assert.Equal(t, byte(NOP), b, "the gap between rules is padded with NOPs")
+	}
+	require.NoError(t, CheckStack(code, 2))
+
+	assert.ErrorContains(t, Options{Align: 3}.Validate(), "power of two")
+	assert.ErrorContains(t, Options{Align: 512}.Validate(), "power of two")
+	assert.NoError(t, Options{Align: 64}.Validate())
+}
+
+func TestCompileExistenceConditions(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "FirstReading",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{
+					{Fact: "reading", Operator: "exists"},
+					{Fact: "baseline", Operator: "notExists"},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "baseline", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["reading"] = 0
+	context.FactIndex["baseline"] = 1
+	for _, mode := range []ConditionMode{ConditionModeJump, ConditionModeBoolean} {
+		code, err := NewCompilerWithOptions(context, Options{ConditionMode: mode}).Compile(ruleset)
+		require.NoError(t, err, "Compilation failed")
+
+		listing, err := Disassemble(code)
+		require.NoError(t, err)
+		assert.Contains(t, listing, "FACT_EXISTS fact#0\n")
+		assert.Contains(t, listing, "FACT_EXISTS fact#1\n")
+		assert.Equal(t, 1, strings.Count(listing, "NOT\n"), "only notExists is negated")
+		assert.NotContains(t, listing, "LOAD_FACT", "the facts aren't loaded")
+	}
+
+	rule := &rules.Rule{Name: "Invalid", Conditions: rules.Conditions{All: []rules.Condition{{Fact: "sensors.*", Operator: "exists"}}}}
+	_, err := NewCompiler(context).Compile([]*rules.Rule{rule})
+	assert.ErrorContains(t, err, "fact patterns don't support")
+}
+
+func TestCompileActionGuards(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name:       "Overheat",
+			Conditions: rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}}},
+			Event: rules.Event{Actions: []rules.Action{
+				{Type: rules.ActionNotify, Target: "ops", Value: "too hot", Order: 2, When: &rules.Conditions{
+					All: []rules.Condition{{Fact: "quiet_hours", Operator: "equal", Value: false, ValueType: "bool"}},
+				}},
+				{Type: rules.ActionUpdateFact, Target: "fan", Value: true, Order: 1},
+				{Type: rules.ActionLogEvent, Target: "system", Order: 2},
+			}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	for i, fact := range []string{"temperature", "quiet_hours", "fan"} {
+		context.FactIndex[fact] = i
+	}
+	for _, mode := range []ConditionMode{ConditionModeJump, ConditionModeBoolean} {
+		code, err := NewCompilerWithOptions(context, Options{ConditionMode: mode}).Compile(ruleset)
+		require.NoError(t, err, "Compilation failed")
+
+		listing, err := Disassemble(code)
+		require.NoError(t, err)
+		update := strings.Index(listing, "UPDATE_FACT fact#2")
+		guard := strings.Index(listing, "LOAD_FACT fact#1")
+		notify := strings.Index(listing, "TRIGGER_ACTION notify")
+		logEvent := strings.Index(listing, "TRIGGER_ACTION logEvent")
+		assert.True(t, update < guard && guard < notify && notify < logEvent, "actions are ordered, each after its guard:\n%s", listing)
+
+		// The guard skips to the action after notify
+		skip := listing[guard:notify]
+		jump := skip[strings.Index(skip, "JUMP_IF_FALSE -> ")+len("JUMP_IF_FALSE -> "):]
+		assert.Contains(t, listing[notify:], "\n"+jump[:4]+"  LOAD_CONST_STRING \"\"\n", "the guard jumps past the action")
+	}
+}
+
+func TestCompileScoringRule(t *testing.T) {
+	weight := 2.5
+	ruleset := []*rules.Rule{
+		{
+			Name:  "FraudRisk",
+			Score: &rules.Score{Fact: "risk", Threshold: 3},
+			Conditions: rules.Conditions{
+				All: []rules.Condition{
+					{Fact: "amount", Operator: "greaterThan", Value: 1000, ValueType: "int", Weight: &weight},
+					{Any: []rules.Condition{
+						{Fact: "country", Operator: "notEqual", Value: "home", ValueType: "string"},
+						{Fact: "amount", Operator: "greaterThan", Value: 5000, ValueType: "int"},
+					}},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "review", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	for i, fact := range []string{"amount", "country", "risk", "review"} {
+		context.FactIndex[fact] = i
+	}
+	for _, mode := range []ConditionMode{ConditionModeJump, ConditionModeBoolean} {
+		code, err := NewCompilerWithOptions(context, Options{ConditionMode: mode}).Compile(ruleset)
+		require.NoError(t, err, "Compilation failed")
+
+		listing, err := Disassemble(code)
+		require.NoError(t, err)
+		assert.Equal(t, 2, strings.Count(listing, "ADD_FLOAT\n"), "each condition adds its weight")
+		assert.Contains(t, listing, "LOAD_CONST_FLOAT 2.5\n")
+		assert.Contains(t, listing, "STORE_FACT fact#2\n")
+		assert.Contains(t, listing, "GTE_FLOAT\n", "the score is compared with the threshold")
+	}
+}
+
+func TestCompileNotConditions(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "MildWeekday",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "weekend", Operator: "equal", Value: false, ValueType: "bool"}},
+				Not: []rules.Condition{
+					{Fact: "temperature", Operator: "greaterThan", Value: 25, ValueType: "int"},
+					{Fact: "humidity", Operator: "greaterThan", Value: 60, ValueType: "int"},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "windows_open", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	for i, fact := range []string{"weekend", "temperature", "humidity", "windows_open"} {
+		context.FactIndex[fact] = i
+	}
+
+	code, err := NewCompilerWithOptions(context, Options{ConditionMode: ConditionModeBoolean}).Compile(ruleset)
+	require.NoError(t, err)
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Regexp(t, `GT_INT\n.*AND\n.*NOT\n.*AND\n`, strings.ReplaceAll(listing, "\n", "\n "), "the conjunction of the not conditions is negated")
+
+	code, err = NewCompilerWithOptions(context, Options{ConditionMode: ConditionModeJump}).Compile(ruleset)
+	require.NoError(t, err)
+	listing, err = Disassemble(code)
+	require.NoError(t, err)
+	assert.NotContains(t, listing, "NOT\n", "jumps are inverted instead")
+	assert.Contains(t, listing, "JUMP_IF_TRUE", "the rule is skipped when every not condition holds")
+}
+
+func TestCompileRuleRollout(t *testing.T) {
+	rollout := 25
+	ruleset := []*rules.Rule{
+		{
+			Name:       "NewCooling",
+			Rollout:    &rollout,
+			RolloutKey: "deviceId",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}},
+			},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	compiler := NewCompiler(context)
+
+	bytecode, err := compiler.Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+
+	// The ROLLOUT instruction follows RULE_START: percentage, salt, key fact name
+	rolloutInstruction := bytecode[5:]
+	assert.Equal(t, byte(ROLLOUT), rolloutInstruction[0])
+	assert.Equal(t, byte(25), rolloutInstruction[1])
+	assert.Equal(t, append([]byte("deviceId"), 0), rolloutInstruction[6:15])
+
+	// Rules rolled out to everyone don't need the instruction
+	rollout = 100
+	compiler = NewCompiler(context)
+	bytecode, err = compiler.Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+	assert.NotEqual(t, byte(ROLLOUT), bytecode[5])
+}
+
+func TestCompileRuleVariants(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name:       "SetpointTest",
+			VariantKey: "deviceId",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "occupied", Operator: "equal", Value: true, ValueType: "bool"}},
+			},
+			Variants: []rules.Variant{
+				{Name: "A", Weight: 3, Actions: []rules.Action{{Type: "updateFact", Target: "eco", Value: true}}},
+				{Name: "B", Weight: 1, Actions: []rules.Action{{Type: "updateFact", Target: "eco", Value: false}}},
+			},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["occupied"] = 0
+	context.FactIndex["eco"] = 1
+	compiler := NewCompiler(context)
+
+	bytecode, err := compiler.Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+
+	// Variants split the 100 buckets by weight: A gets [0, 75), B gets [75, 100)
+	var ranges [][2]byte
+	var names []string
+	for _, instruction := range compiler.instructions {
+		if instruction.Opcode == VARIANT {
+			ranges = append(ranges, [2]byte{instruction.Operands[0], instruction.Operands[1]})
+			name := instruction.Operands[6+len("deviceId")+1:]
+			names = append(names, string(name[:len(name)-1]))
+		}
+	}
+	assert.Equal(t, [][2]byte{{0, 75}, {75, 100}}, ranges)
+	assert.Equal(t, []string{"A", "B"}, names)
+	assert.Equal(t, byte(HALT), bytecode[len(bytecode)-1])
+	assert.Equal(t, byte(RULE_END), bytecode[len(bytecode)-2])
+	assert.Equal(t, byte(VARIANT_END), bytecode[len(bytecode)-3])
+}
+
+func TestCompileRuleHold(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "Overheating",
+			For:  "5m",
+			Once: true,
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "alarm", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	context.FactIndex["alarm"] = 1
+	compiler := NewCompiler(context)
+
+	_, err := compiler.Compile(ruleset)
+	require.NoError(t, err, "Compilation failed")
+
+	// HOLD follows the conditions and precedes the actions
+	var opcodes []Opcode
+	var hold Instruction
+	for _, instruction := range compiler.instructions {
+		opcodes = append(opcodes, instruction.Opcode)
+		if instruction.Opcode == HOLD {
+			hold = instruction
+		}
+	}
+	assert.Equal(t, []Opcode{RULE_START, LOAD_FACT, LOAD_CONST_INT, GT_INT, JUMP_IF_FALSE, HOLD, UPDATE_FACT, LOAD_CONST_BOOL, RULE_END, HALT}, opcodes)
+	assert.Equal(t, []byte{0xe0, 0x93, 0x04, 0x00, HoldOnce}, hold.Operands, "5 minutes in milliseconds, then the flags")
+
+	// The VM times rules by their markers
+	compiler = NewCompilerWithOptions(context, Options{Markers: MarkerModeNone})
+	_, err = compiler.Compile(ruleset)
+	assert.ErrorContains(t, err, "needs rule markers")
+}
+
+func TestCompileMarkerModes(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "Cooling",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan_status", Value: true}}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	context.FactIndex["fan_status"] = 1
+
+	opcodes := func(markers MarkerMode) []Opcode {
+		compiler := NewCompilerWithOptions(context, Options{Markers: markers})
+		_, err := compiler.Compile(ruleset)
+		require.NoError(t, err, "Compilation failed")
+		var result []Opcode
+		for _, instruction := range compiler.instructions {
+			result = append(result, instruction.Opcode)
+		}
+		return result
+	}
+
+	condition := []Opcode{LOAD_FACT, LOAD_CONST_INT, GT_INT, JUMP_IF_FALSE}
+	action := []Opcode{UPDATE_FACT, LOAD_CONST_BOOL}
+
+	rulesOnly := append(append(append([]Opcode{RULE_START}, condition...), action...), RULE_END, HALT)
+	assert.Equal(t, rulesOnly, opcodes(MarkerModeRules))
+
+	none := append(append(append([]Opcode{}, condition...), action...), HALT)
+	assert.Equal(t, none, opcodes(MarkerModeNone))
+
+	all := append(append(append(append([]Opcode{RULE_START, COND_START}, condition...), COND_END), action...), RULE_END, HALT)
+	assert.Equal(t, all, opcodes(MarkerModeAll))
+}
+
+func TestCompileMarkerModeNoneRejectsRollouts(t *testing.T) {
+	rollout := 25
+	ruleset := []*rules.Rule{
+		{
+			Name:    "NewCooling",
+			Rollout: &rollout,
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}},
+			},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	compiler := NewCompilerWithOptions(context, Options{Markers: MarkerModeNone})
+
+	_, err := compiler.Compile(ruleset)
+	assert.ErrorContains(t, err, "need rule markers")
+}
+
+func TestCompileActionDelays(t *testing.T) {
+	condition := rules.Conditions{All: []rules.Condition{{Fact: "motion", Operator: "equal", Value: false, ValueType: "bool"}}}
+	ruleset := []*rules.Rule{
+		{
+			Name:       "Log",
+			Conditions: condition,
+			Event:      rules.Event{Actions: []rules.Action{{Type: rules.ActionLogEvent, Target: "system"}}},
+		},
+		{
+			Name:       "LightsOff",
+			Conditions: condition,
+			Event: rules.Event{Actions: []rules.Action{
+				{Type: rules.ActionUpdateFact, Target: "idle", Value: true},
+				{Type: rules.ActionNotify, Target: "ops", Value: "idle"},
+				{Type: "switchLights", Target: "hall", Value: "off", Delay: "10m"},
+			}},
+		},
+	}
+
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["motion"] = 0
+	context.FactIndex["idle"] = 1
+	compiler := NewCompiler(context)
+	_, err := compiler.Compile(ruleset)
+	require.NoError(t, err)
+	assert.Equal(t, []ActionDelay{{Rule: 1, Action: 1, DelayMillis: 600000}}, compiler.ActionDelays(),
+		"the delayed action is the second TRIGGER_ACTION of the second rule")
+
+	_, err = NewCompilerWithOptions(context, Options{Markers: MarkerModeNone}).Compile(ruleset)
+	assert.ErrorContains(t, err, "rule 'LightsOff' has delayed actions, which need rule markers")
+
+	ruleset[1].Event.Actions = []rules.Action{{Type: rules.ActionUpdateFact, Target: "idle", Value: true, Delay: "10m"}}
+	_, err = NewCompiler(context).Compile(ruleset)
+	assert.EqualError(t, err, "updateFact action writing 'idle' can't be delayed")
+}
@@ -0,0 +1,140 @@
+// preprocessor/bytecode/cost.go
+
+package bytecode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// RuleCost is the worst-case cost of evaluating a single rule.
+type RuleCost struct {
+	Rule          int `json:"rule"` // Position of the rule in the bytecode
+	Instructions  int `json:"instructions"`
+	MaxStackDepth int `json:"maxStackDepth"`
+}
+
+// Cost is the worst-case cost of an evaluation cycle, not counting rules
+// evaluated again by forward chaining.
+type Cost struct {
+	Instructions  int        `json:"instructions"`  // Total over all rules
+	MaxStackDepth int        `json:"maxStackDepth"` // Maximum over all rules
+	Rules         []RuleCost `json:"rules"`
+}
+
+// EstimateCost computes the worst-case cost of compiled bytecode. Jump offsets
+// are unsigned, so all jumps go forward: every instruction of a rule runs at most once
+// and the instruction count of a rule bounds its evaluation. The stack depth
+// is the maximum over all paths through the rule.
+func EstimateCost(code []byte) (Cost, error) {
+	cost := Cost{Rules: []RuleCost{}}
+	rule := RuleCost{}
+
+	// Stack depth on entry to each instruction reached by a jump
+	jumpDepths := make(map[int]int)
+	depth, reachable := 0, true
+	pendingPops := 0 // UPDATE_FACT pops the value that follows it
+
+	for ip := 0; ip < len(code); {
+		opcode := Opcode(code[ip])
+		_, n, err := disassembleOperands(opcode, code, ip+1, nil)
+		if err != nil {
+			return Cost{}, fmt.Errorf("at offset %d: %w", ip, err)
+		}
+
+		// Padding between rules and the final HALT aren't part of any rule
+		if (opcode == NOP || opcode == HALT) && rule.Instructions == 0 {
+			ip += 1 + n
+			continue
+		}
+
+		// An instruction can be reached by falling through and by jumps
+		if jumpDepth, ok := jumpDepths[ip]; ok {
+			if !reachable || jumpDepth > depth {
+				depth = jumpDepth
+			}
+			reachable = true
+		}
+
+		rule.Instructions++
+		depth += stackEffect(opcode)
+		if depth < 0 {
+			return Cost{}, fmt.Errorf("at offset %d: %s pops from an empty stack", ip, opcode)
+		}
+		rule.MaxStackDepth = max(rule.MaxStackDepth, depth)
+
+		if opcode == UPDATE_FACT {
+			pendingPops++
+		} else if pendingPops > 0 {
+			depth -= pendingPops
+			pendingPops = 0
+		}
+
+		switch opcode {
+		case JUMP, JUMP_IF_TRUE, JUMP_IF_FALSE:
+			target := ip + 2 + int(binary.LittleEndian.Uint16(code[ip+1:]))
+			if target > len(code) {
+				return Cost{}, fmt.Errorf("at offset %d: jump past the end of the code to %d", ip, target)
+			}
+			if jumpDepth, ok := jumpDepths[target]; !ok || depth > jumpDepth {
+				jumpDepths[target] = depth
+			}
+			if opcode == JUMP {
+				reachable = false
+			}
+
+		case HALT, ERROR:
+			reachable = false
+
+		case RULE_END:
+			cost.Rules = append(cost.Rules, rule)
+			cost.Instructions += rule.Instructions
+			cost.MaxStackDepth = max(cost.MaxStackDepth, rule.MaxStackDepth)
+			rule = RuleCost{Rule: len(cost.Rules)}
+			depth, reachable = 0, true
+		}
+		ip += 1 + n
+	}
+
+	// Trailing instructions outside a rule still run
+	if rule.Instructions > 0 {
+		cost.Rules = append(cost.Rules, rule)
+		cost.Instructions += rule.Instructions
+		cost.MaxStackDepth = max(cost.MaxStackDepth, rule.MaxStackDepth)
+	}
+	return cost, nil
+}
+
+// stackEffect returns the net change in stack depth caused by an instruction.
+func stackEffect(opcode Opcode) int {
+	pops, pushes := stackUse(opcode)
+	return pushes - pops
+}
+
+// NewCostSection returns a section embedding the estimated cost of the
+// bytecode.
+func NewCostSection(cost Cost) (Section, error) {
+	data, err := json.Marshal(cost)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionCost, Data: data}, nil
+}
+
+// ReadCost returns the cost embedded in a bytecode image's sections.
+func ReadCost(sections []Section) (Cost, bool, error) {
+	section, ok := FindSection(sections, SectionCost)
+	if !ok {
+		return Cost{}, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return Cost{}, false, err
+	}
+	var cost Cost
+	if err := json.Unmarshal(data, &cost); err != nil {
+		return Cost{}, false, fmt.Errorf("invalid cost section: %w", err)
+	}
+	return cost, true, nil
+}
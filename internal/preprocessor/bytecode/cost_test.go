@@ -0,0 +1,101 @@
+package bytecode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateCost(t *testing.T) {
+	code := []byte{
+		// Rule 0: temperature > 30 => ac_status = true
+		38, 0, 0, 0, 0, // RULE_START
+		17, 0, // LOAD_FACT 0
+		19, 30, 0, 0, 0, // LOAD_CONST_INT 30
+		4,        // GT_INT
+		26, 5, 0, // JUMP_IF_FALSE to RULE_END
+		28, 1, // UPDATE_FACT 1
+		22, 1, // LOAD_CONST_BOOL true
+		37, // RULE_END
+
+		// Rule 1: temperature > 30 && humidity > 50, as a boolean expression
+		38, 0, 0, 0, 0, // RULE_START
+		17, 0, // LOAD_FACT 0
+		19, 30, 0, 0, 0, // LOAD_CONST_INT 30
+		4,     // GT_INT
+		17, 2, // LOAD_FACT 2
+		19, 50, 0, 0, 0, // LOAD_CONST_INT 50
+		4,        // GT_INT
+		14,       // AND
+		26, 5, 0, // JUMP_IF_FALSE to RULE_END
+		28, 1, // UPDATE_FACT 1
+		22, 0, // LOAD_CONST_BOOL false
+		37, // RULE_END
+	}
+
+	cost, err := EstimateCost(code)
+	require.NoError(t, err)
+	assert.Equal(t, Cost{
+		Instructions:  20,
+		MaxStackDepth: 3,
+		Rules: []RuleCost{
+			{Rule: 0, Instructions: 8, MaxStackDepth: 2},
+			{Rule: 1, Instructions: 12, MaxStackDepth: 3},
+		},
+	}, cost)
+}
+
+func TestEstimateCost_Padding(t *testing.T) {
+	code := []byte{
+		38, 0, 0, 0, 0, // RULE_START
+		28, 1, // UPDATE_FACT 1
+		22, 1, // LOAD_CONST_BOOL true
+		37,     // RULE_END
+		30, 30, // NOP padding to the next rule
+		38, 0, 0, 0, 0, // RULE_START
+		28, 1, // UPDATE_FACT 1
+		22, 0, // LOAD_CONST_BOOL false
+		37, // RULE_END
+		31, // HALT
+	}
+
+	cost, err := EstimateCost(code)
+	require.NoError(t, err)
+	assert.Equal(t, Cost{
+		Instructions:  8,
+		MaxStackDepth: 1,
+		Rules: []RuleCost{
+			{Rule: 0, Instructions: 4, MaxStackDepth: 1},
+			{Rule: 1, Instructions: 4, MaxStackDepth: 1},
+		},
+	}, cost)
+}
+
+func TestEstimateCost_Errors(t *testing.T) {
+	_, err := EstimateCost([]byte{38, 0, 0, 0, 0, 24, 0xf0, 0xff, 37})
+	assert.ErrorContains(t, err, "past the end")
+
+	_, err = EstimateCost([]byte{38, 0, 0, 0, 0, 4, 37})
+	assert.ErrorContains(t, err, "empty stack")
+
+	_, err = EstimateCost([]byte{38, 0, 0})
+	assert.Error(t, err)
+}
+
+func TestCostSection_RoundTrip(t *testing.T) {
+	cost := Cost{Instructions: 7, MaxStackDepth: 2, Rules: []RuleCost{{Rule: 0, Instructions: 7, MaxStackDepth: 2}}}
+	section, err := NewCostSection(cost)
+	require.NoError(t, err)
+
+	_, sections, err := SplitSections(AppendSections([]byte{byte(HALT)}, section))
+	require.NoError(t, err)
+	got, ok, err := ReadCost(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, cost, got)
+
+	_, ok, err = ReadCost(nil)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,52 @@
+// preprocessor/bytecode/delays.go
+
+package bytecode
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ActionDelay is the delay of an action a rule schedules for later. The
+// action is identified by its rule's position in the code and the position
+// of its TRIGGER_ACTION among those of the rule, which survive re-encoding
+// the code.
+type ActionDelay struct {
+	Rule        int   `json:"rule"`
+	Action      int   `json:"action"`
+	DelayMillis int64 `json:"delayMillis"`
+}
+
+// ActionDelays returns the delays of the delayed actions of the compiled
+// code. Hosts embed them with NewActionDelaysSection.
+func (c *Compiler) ActionDelays() []ActionDelay {
+	return c.delays
+}
+
+// NewActionDelaysSection returns a section embedding the delays of delayed
+// actions.
+func NewActionDelaysSection(delays []ActionDelay) (Section, error) {
+	data, err := json.Marshal(delays)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionActionDelays, Data: data}, nil
+}
+
+// ReadActionDelays returns the delays of delayed actions embedded in a
+// bytecode image's sections.
+func ReadActionDelays(sections []Section) ([]ActionDelay, bool, error) {
+	section, ok := FindSection(sections, SectionActionDelays)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var delays []ActionDelay
+	if err := json.Unmarshal(data, &delays); err != nil {
+		return nil, false, fmt.Errorf("invalid action delays section: %w", err)
+	}
+	return delays, true, nil
+}
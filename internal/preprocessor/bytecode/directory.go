@@ -0,0 +1,99 @@
+// preprocessor/bytecode/directory.go
+
+package bytecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// RuleDirectoryEntry locates a compiled rule in the code, so that a runtime
+// can run it on its own, without scanning the code for it.
+type RuleDirectoryEntry struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Offset   int    `json:"offset"` // Offset of the rule's first instruction, its RULE_START with rule markers
+	Length   int    `json:"length"` // Bytes of code up to and including the rule's RULE_END
+	Facts    []int  `json:"facts"`  // Indices in the fact table of the facts the rule reads, in ascending order
+}
+
+// RuleDirectory lists the compiled rules by their position in the code.
+type RuleDirectory []RuleDirectoryEntry
+
+// RuleDirectory returns where each rule of the compiled code starts, by its
+// position in the code. Hosts embed it with NewRuleDirectorySection. Offsets
+// are in the compiler's encoding; a runtime converting the code relocates
+// them.
+func (c *Compiler) RuleDirectory() RuleDirectory {
+	directory := make(RuleDirectory, len(c.ruleOffsets))
+	for i, offset := range c.ruleOffsets {
+		directory[i] = RuleDirectoryEntry{
+			Name:     c.ruleNames[i],
+			Priority: c.rulePriorities[i],
+			Offset:   offset,
+			Length:   c.ruleEnds[i] - offset,
+			Facts:    []int{},
+		}
+	}
+	for fact, readers := range c.readers {
+		index, ok := c.context.FactIndex[fact]
+		if !ok {
+			// Fact patterns and facts read by name, such as rollout keys
+			continue
+		}
+		for _, rule := range readers {
+			directory[rule].Facts = append(directory[rule].Facts, index)
+		}
+	}
+	for _, entry := range directory {
+		sort.Ints(entry.Facts)
+	}
+	return directory
+}
+
+// Relocate returns the directory with its offsets and lengths mapped to
+// those of re-encoded code, given where each instruction of the original code
+// starts in the re-encoded code, and where the re-encoded code ends by the
+// original code's length.
+func (d RuleDirectory) Relocate(offsets map[int]int) (RuleDirectory, error) {
+	relocated := make(RuleDirectory, len(d))
+	for i, entry := range d {
+		start, ok := offsets[entry.Offset]
+		end, endOK := offsets[entry.Offset+entry.Length]
+		if !ok || !endOK {
+			return nil, fmt.Errorf("rule '%s' doesn't start and end at instructions of the code", entry.Name)
+		}
+		entry.Offset, entry.Length = start, end-start
+		relocated[i] = entry
+	}
+	return relocated, nil
+}
+
+// NewRuleDirectorySection returns a section embedding the rule directory of
+// the code.
+func NewRuleDirectorySection(directory RuleDirectory) (Section, error) {
+	data, err := json.Marshal(directory)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionRuleDirectory, Data: data}, nil
+}
+
+// ReadRuleDirectory returns the rule directory embedded in a bytecode
+// image's sections.
+func ReadRuleDirectory(sections []Section) (RuleDirectory, bool, error) {
+	section, ok := FindSection(sections, SectionRuleDirectory)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var directory RuleDirectory
+	if err := json.Unmarshal(data, &directory); err != nil {
+		return nil, false, fmt.Errorf("invalid rule directory section: %w", err)
+	}
+	return directory, true, nil
+}
@@ -1,3 +1,264 @@
 // preprocessor/bytecode/dissassembler.go
 
 package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+	"time"
+)
+
+// Disassemble returns a listing of bytecode produced by the compiler, one
+// instruction per line with its offset, opcode and decoded operands.
+func Disassemble(code []byte) (string, error) {
+	return DisassembleWithFacts(code, nil)
+}
+
+// DisassembleWithFacts is like Disassemble, but also names the facts the
+// instructions refer to by index, from the fact table of the bytecode.
+func DisassembleWithFacts(code []byte, facts FactTable) (string, error) {
+	var listing strings.Builder
+	for ip := 0; ip < len(code); {
+		opcode := Opcode(code[ip])
+		operands, n, err := disassembleOperands(opcode, code, ip+1, facts)
+		if err != nil {
+			return "", fmt.Errorf("at offset %d: %w", ip, err)
+		}
+
+		fmt.Fprintf(&listing, "%04d  %s", ip, opcode)
+		if operands != "" {
+			fmt.Fprintf(&listing, " %s", operands)
+		}
+		listing.WriteByte('\n')
+		ip += 1 + n
+	}
+	return listing.String(), nil
+}
+
+// disassembleOperands decodes the operands of an instruction starting at pos
+// and returns them formatted along with their size in bytes.
+func disassembleOperands(opcode Opcode, code []byte, pos int, facts FactTable) (string, int, error) {
+	need := func(n int) error {
+		if pos+n > len(code) {
+			return fmt.Errorf("truncated %s instruction", opcode)
+		}
+		return nil
+	}
+
+	switch opcode {
+	case LOAD_FACT, UPDATE_FACT, FACT_EXISTS, STORE_FACT:
+		if err := need(1); err != nil {
+			return "", 0, err
+		}
+		if name := facts.Name(int(code[pos])); name != "" {
+			return fmt.Sprintf("fact#%d (%s)", code[pos], name), 1, nil
+		}
+		return fmt.Sprintf("fact#%d", code[pos]), 1, nil
+
+	case LOAD_VAR, STORE_VAR:
+		if err := need(1); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("var#%d", code[pos]), 1, nil
+
+	case LOAD_CONST_INT, RULE_START:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprint(int32(binary.LittleEndian.Uint32(code[pos:]))), 4, nil
+
+	case LOAD_CONST_INT64:
+		if err := need(8); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprint(int64(binary.LittleEndian.Uint64(code[pos:]))), 8, nil
+
+	case LOAD_CONST_UINT64:
+		if err := need(8); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprint(binary.LittleEndian.Uint64(code[pos:])), 8, nil
+
+	case LOAD_CONST_FLOAT:
+		if err := need(8); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprint(math.Float64frombits(binary.LittleEndian.Uint64(code[pos:]))), 8, nil
+
+	case LOAD_CONST_INT16:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprint(int16(binary.LittleEndian.Uint16(code[pos:]))), 2, nil
+
+	case LOAD_CONST_FLOAT32:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprint(math.Float32frombits(binary.LittleEndian.Uint32(code[pos:]))), 4, nil
+
+	case EQ_FLOAT_EPSILON, NEQ_FLOAT_EPSILON:
+		if err := need(8); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("epsilon=%v", math.Float64frombits(binary.LittleEndian.Uint64(code[pos:]))), 8, nil
+
+	case LOAD_CONST_STRING:
+		if err := need(1); err != nil {
+			return "", 0, err
+		}
+		length := int(code[pos])
+		if err := need(1 + length); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("%q", code[pos+1:pos+1+length]), 1 + length, nil
+
+	case LOAD_CONST_BOOL:
+		if err := need(1); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprint(code[pos] == 1), 1, nil
+
+	case JUMP, JUMP_IF_TRUE, JUMP_IF_FALSE:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		target := pos + 1 + int(binary.LittleEndian.Uint16(code[pos:]))
+		return fmt.Sprintf("-> %04d", target), 2, nil
+
+	case ROLLOUT:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		key, n, err := cString(code, pos+5)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("%d%% key=%s", code[pos], key), 5 + n, nil
+
+	case ERROR:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("message#%d", binary.LittleEndian.Uint16(code[pos:])), 2, nil
+
+	case HOLD:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		hold := (time.Duration(binary.LittleEndian.Uint32(code[pos:])) * time.Millisecond).String()
+		if code[pos+4]&HoldOnce != 0 {
+			hold += " once"
+		}
+		return hold, 5, nil
+
+	case VARIANT:
+		if err := need(6); err != nil {
+			return "", 0, err
+		}
+		key, n, err := cString(code, pos+6)
+		if err != nil {
+			return "", 0, err
+		}
+		name, m, err := cString(code, pos+6+n)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("%s [%d, %d) key=%s", name, code[pos], code[pos+1], key), 6 + n + m, nil
+
+	case TRIGGER_ACTION:
+		actionType, n, err := cString(code, pos)
+		if err != nil {
+			return "", 0, err
+		}
+		target, m, err := cString(code, pos+n)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("%s target=%s", actionType, target), n + m, nil
+
+	case IN_LIST, NOT_IN_LIST:
+		list, n, err := DecodeList(code[pos:])
+		if err != nil {
+			return "", 0, err
+		}
+		elements := make([]string, len(list))
+		for i, element := range list {
+			if s, ok := element.(string); ok {
+				elements[i] = fmt.Sprintf("%q", s)
+			} else {
+				elements[i] = fmt.Sprint(element)
+			}
+		}
+		return "[" + strings.Join(elements, ", ") + "]", n, nil
+
+	case CALL_OPERATOR:
+		name, n, err := cString(code, pos)
+		if err != nil {
+			return "", 0, err
+		}
+		return name, n, nil
+
+	case MATCH_FACTS:
+		if err := need(1); err != nil {
+			return "", 0, err
+		}
+		pattern, n, err := cString(code, pos+1)
+		if err != nil {
+			return "", 0, err
+		}
+		operator, m, err := cString(code, pos+1+n)
+		if err != nil {
+			return "", 0, err
+		}
+		quantifier := rules.MatchAny
+		if code[pos] == MatchAllQuantifier {
+			quantifier = rules.MatchAll
+		}
+		return fmt.Sprintf("%s %s %s", quantifier, pattern, operator), 1 + n + m, nil
+
+	case CALL_SCRIPT:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		kind := "condition"
+		if code[pos] == ScriptValue {
+			kind = "value"
+		}
+		size := 2
+		facts := make([]string, code[pos+1])
+		for i := range facts {
+			fact, n, err := cString(code, pos+size)
+			if err != nil {
+				return "", 0, err
+			}
+			facts[i] = fact
+			size += n
+		}
+		source, n, err := cString(code, pos+size)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("%s facts=%s %q", kind, strings.Join(facts, ","), source), size + n, nil
+
+	default:
+		return "", 0, nil
+	}
+}
+
+// cString decodes a NUL-terminated string at pos, returning it and its size
+// including the terminator.
+func cString(code []byte, pos int) (string, int, error) {
+	if pos > len(code) {
+		return "", 0, fmt.Errorf("truncated string operand")
+	}
+	end := bytes.IndexByte(code[pos:], 0)
+	if end < 0 {
+		return "", 0, fmt.Errorf("unterminated string operand")
+	}
+	return string(code[pos : pos+end]), end + 1, nil
+}
@@ -0,0 +1,185 @@
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisassemble(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name:     "Cool",
+			Priority: 2,
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan", Value: true}}},
+		},
+	}
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	context.FactIndex["fan"] = 1
+
+	code, err := NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err)
+
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Equal(t, `0000  RULE_START 2
+0005  LOAD_FACT fact#0
+0007  LOAD_CONST_INT 30
+0012  GT_INT
+0013  JUMP_IF_FALSE -> 0020
+0016  UPDATE_FACT fact#1
+0018  LOAD_CONST_BOOL true
+0020  RULE_END
+0021  HALT
+`, listing)
+
+	// The fact table names the facts
+	listing, err = DisassembleWithFacts(code, NewFactTable(context.FactIndex))
+	require.NoError(t, err)
+	assert.Contains(t, listing, "0005  LOAD_FACT fact#0 (temperature)\n")
+	assert.Contains(t, listing, "0016  UPDATE_FACT fact#1 (fan)\n")
+}
+
+func TestDisassemble_Truncated(t *testing.T) {
+	_, err := Disassemble([]byte{byte(LOAD_CONST_INT), 1, 0})
+	assert.Error(t, err)
+}
+
+func TestDisassemble_FactPattern(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "AllHot",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "sensor.*.temperature", Operator: "greaterThan", Value: 30, ValueType: "int", Match: rules.MatchAll}},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan", Value: true}}},
+		},
+	}
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["fan"] = 0
+
+	code, err := NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err)
+
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "0005  LOAD_CONST_INT 30\n0010  MATCH_FACTS all sensor.*.temperature greaterThan\n")
+}
+
+func TestDisassemble_Variables(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "Comfortable",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{
+					{Fact: "temperature", Operator: "greaterThan", Value: 10, ValueType: "int"},
+					{Fact: "temperature", Operator: "lessThan", Value: 30, ValueType: "int"},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan", Value: true}}},
+		},
+	}
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	context.FactIndex["fan"] = 1
+
+	code, err := NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err)
+
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Equal(t, `0000  RULE_START 0
+0005  LOAD_FACT fact#0
+0007  STORE_VAR var#0
+0009  LOAD_CONST_INT 10
+0014  GT_INT
+0015  JUMP_IF_FALSE -> 0033
+0018  LOAD_VAR var#0
+0020  LOAD_CONST_INT 30
+0025  LT_INT
+0026  JUMP_IF_FALSE -> 0033
+0029  UPDATE_FACT fact#1
+0031  LOAD_CONST_BOOL true
+0033  RULE_END
+0034  HALT
+`, listing)
+}
+
+func TestDisassemble_Actions(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "Umbrella",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "rain", Operator: "equal", Value: true, ValueType: "bool"}},
+			},
+			Event: rules.Event{Actions: []rules.Action{
+				{Type: rules.ActionUpdateStore, Target: "fan", Value: true},
+				{Type: rules.ActionSendAlert, Target: "user", Value: "Bring an umbrella!"},
+				{Type: rules.ActionLogEvent, Target: "system"},
+				{Type: rules.ActionSendMessage, Target: "lobby", Value: "Umbrellas by the door"},
+			}},
+		},
+	}
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["rain"] = 0
+	context.FactIndex["fan"] = 1
+
+	code, err := NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err)
+
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "UPDATE_FACT fact#1\n")
+	assert.Contains(t, listing, "LOAD_CONST_STRING \"Bring an umbrella!\"\n")
+	assert.Contains(t, listing, "TRIGGER_ACTION sendAlert target=user\n")
+	assert.Contains(t, listing, "LOAD_CONST_STRING \"\"\n")
+	assert.Contains(t, listing, "TRIGGER_ACTION logEvent target=system\n")
+	assert.Contains(t, listing, "TRIGGER_ACTION sendMessage target=lobby\n")
+
+	// Other action types are left to the handlers the host registers
+	ruleset[0].Event.Actions = []rules.Action{{Type: "notifySlack", Target: "#ops", Value: "Rain"}}
+	code, err = NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err)
+	listing, err = Disassemble(code)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "TRIGGER_ACTION notifySlack target=#ops\n")
+
+	ruleset[0].Event.Actions = []rules.Action{{Type: "notify\x00Slack", Target: "#ops"}}
+	_, err = NewCompiler(context).Compile(ruleset)
+	assert.ErrorContains(t, err, "invalid action type")
+}
+
+func TestDisassemble_Scripts(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "Comfort",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Script: "facts.temperature + facts.humidity / 10 > 30", Facts: []string{"temperature", "humidity"}}},
+			},
+			Event: rules.Event{Actions: []rules.Action{
+				{Type: rules.ActionScript, Target: "fan", Value: "facts.temperature * 2", Facts: []string{"temperature"}},
+			}},
+		},
+	}
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["fan"] = 0
+
+	code, err := NewCompiler(context).Compile(ruleset)
+	require.NoError(t, err)
+
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "CALL_SCRIPT condition facts=temperature,humidity \"facts.temperature + facts.humidity / 10 > 30\"\n")
+	assert.Contains(t, listing, "UPDATE_FACT fact#0\n")
+	assert.Contains(t, listing, "CALL_SCRIPT value facts=temperature \"facts.temperature * 2\"\n")
+
+	ruleset[0].Conditions.All[0].Script = "a\x00b"
+	_, err = NewCompiler(context).Compile(ruleset)
+	assert.ErrorContains(t, err, "NUL")
+}
@@ -0,0 +1,25 @@
+// preprocessor/bytecode/exists.go
+
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+
+	"github.com/rs/zerolog/log"
+)
+
+// emitFactExists pushes the outcome of an exists or notExists condition:
+// FACT_EXISTS on the condition's fact, negated for notExists. The fact isn't
+// loaded, so a fact that was never set doesn't fail the rule.
+func (c *Compiler) emitFactExists(condition *rules.Condition, factIndex int) {
+	log.Debug().
+		Str("Fact", condition.Fact).
+		Str("Operator", condition.Operator).
+		Msg("Compiling existence condition")
+
+	c.emitInstruction(FACT_EXISTS, byte(factIndex))
+	c.recordRead(condition.Fact)
+	if condition.Operator == rules.OperatorNotExists {
+		c.emitInstruction(NOT)
+	}
+}
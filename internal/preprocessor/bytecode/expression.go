@@ -0,0 +1,125 @@
+// preprocessor/bytecode/expression.go
+
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+
+	"github.com/rs/zerolog/log"
+)
+
+// compileConditionExpression compiles a rule's conditions in boolean
+// expression mode: the condition tree is evaluated to a single boolean, true
+// when every condition in All holds, if Any isn't empty, at least one
+// condition in Any holds and, if Not isn't empty, not every condition in Not
+// holds. A single JUMP_IF_FALSE then skips the actions.
+func (c *Compiler) compileConditionExpression(conditions rules.Conditions, endLabel string) error {
+	if err := c.compileBlockExpression(conditions.All, conditions.Any, conditions.Not); err != nil {
+		return err
+	}
+
+	c.emitJump(JUMP_IF_FALSE, endLabel)
+	return nil
+}
+
+// compileBlockExpression pushes the conjunction of the all conditions, the
+// disjunction of the any conditions and the negated conjunction of the not
+// conditions. An empty block is true.
+func (c *Compiler) compileBlockExpression(all, any, not []rules.Condition) error {
+	if len(all) == 0 && len(any) == 0 && len(not) == 0 {
+		c.emitLoadConstantInstruction(true, "bool")
+		return nil
+	}
+
+	if len(all) > 0 {
+		if err := c.compileExpressionList(all, AND); err != nil {
+			return err
+		}
+	}
+	if len(any) > 0 {
+		if err := c.compileExpressionList(any, OR); err != nil {
+			return err
+		}
+		if len(all) > 0 {
+			c.emitInstruction(AND)
+		}
+	}
+	if len(not) > 0 {
+		if err := c.compileExpressionList(not, AND); err != nil {
+			return err
+		}
+		c.emitInstruction(NOT)
+		if len(all) > 0 || len(any) > 0 {
+			c.emitInstruction(AND)
+		}
+	}
+	return nil
+}
+
+// compileExpressionList pushes the conditions combined with the given logical
+// opcode.
+func (c *Compiler) compileExpressionList(conditions []rules.Condition, combine Opcode) error {
+	for i := range conditions {
+		if err := c.compileConditionValue(&conditions[i]); err != nil {
+			return err
+		}
+		if i > 0 {
+			c.emitInstruction(combine)
+		}
+	}
+	return nil
+}
+
+// compileConditionValue pushes the boolean value of a single condition or
+// nested block.
+func (c *Compiler) compileConditionValue(condition *rules.Condition) error {
+	if condition.IsBlock() {
+		return c.compileBlockExpression(condition.All, condition.Any, condition.Not)
+	}
+	if condition.Script != "" {
+		return c.emitScript(ScriptCondition, condition.Script, condition.Facts)
+	}
+	if rules.IsFactPattern(condition.Fact) {
+		return c.emitMatchFacts(condition)
+	}
+
+	factIndex, err := c.getFactIndex(condition.Fact)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().
+		Str("Fact", condition.Fact).
+		Int("FactIndex", factIndex).
+		Msg("Compiling condition expression for fact")
+
+	if rules.IsExistenceOperator(condition.Operator) {
+		c.emitFactExists(condition, factIndex)
+		return nil
+	}
+	if isListOperator(condition.Operator) {
+		c.emitLoadFact(condition.Fact, factIndex)
+		return c.emitListMembership(condition)
+	}
+
+	valueType, err := c.resolveValueType(condition)
+	if err != nil {
+		return err
+	}
+
+	c.emitLoadFact(condition.Fact, factIndex)
+
+	// A boolean fact is its own truth value, negated when compared against
+	// the opposite value
+	isEquality := condition.Operator == "equal" || condition.Operator == "notEqual"
+	if value, ok := condition.Value.(bool); ok && valueType == "bool" && isEquality {
+		if value != (condition.Operator == "equal") {
+			c.emitInstruction(NOT)
+		}
+		return nil
+	}
+
+	c.emitLoadConstantInstruction(condition.Value, valueType)
+	c.emitConditionComparison(condition, valueType)
+	return nil
+}
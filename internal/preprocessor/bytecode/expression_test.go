@@ -0,0 +1,64 @@
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompileBooleanExpressionMode(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "Cooling",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{
+					{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"},
+					{Fact: "window_open", Operator: "equal", Value: false, ValueType: "bool"},
+				},
+				Any: []rules.Condition{
+					{Fact: "occupied", Operator: "equal", Value: true, ValueType: "bool"},
+					{Any: []rules.Condition{
+						{Fact: "mode", Operator: "equal", Value: "eco", ValueType: "string"},
+						{Fact: "humidity", Operator: "greaterThan", Value: 70.5, ValueType: "float"},
+					}},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "ac_status", Value: true}}},
+		},
+	}
+	context := rules.NewRuleEngineContext()
+	for i, fact := range []string{"temperature", "window_open", "occupied", "mode", "humidity", "ac_status"} {
+		context.FactIndex[fact] = i
+	}
+
+	code, err := NewCompilerWithOptions(context, Options{ConditionMode: ConditionModeBoolean}).Compile(ruleset)
+	require.NoError(t, err)
+
+	listing, err := Disassemble(code)
+	require.NoError(t, err)
+	assert.Equal(t, `0000  RULE_START 0
+0005  LOAD_FACT fact#0
+0007  LOAD_CONST_INT 30
+0012  GT_INT
+0013  LOAD_FACT fact#1
+0015  NOT
+0016  AND
+0017  LOAD_FACT fact#2
+0019  LOAD_FACT fact#3
+0021  LOAD_CONST_STRING "eco"
+0026  EQ_STRING
+0027  LOAD_FACT fact#4
+0029  LOAD_CONST_FLOAT 70.5
+0038  GT_FLOAT
+0039  OR
+0040  OR
+0041  AND
+0042  JUMP_IF_FALSE -> 0049
+0045  UPDATE_FACT fact#5
+0047  LOAD_CONST_BOOL true
+0049  RULE_END
+0050  HALT
+`, listing)
+}
@@ -0,0 +1,119 @@
+// preprocessor/bytecode/facts.go
+
+package bytecode
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// FactTable lists the names of the facts by the index compiled code refers
+// to them with.
+type FactTable []string
+
+// NewFactTable returns the fact table of a fact index, such as the FactIndex
+// of a RuleEngineContext.
+func NewFactTable(index map[string]int) FactTable {
+	size := 0
+	for _, i := range index {
+		size = max(size, i+1)
+	}
+	table := make(FactTable, size)
+	for name, i := range index {
+		table[i] = name
+	}
+	return table
+}
+
+// Name returns the name of the fact at index, or "" if the table doesn't
+// have it.
+func (t FactTable) Name(index int) string {
+	if index < 0 || index >= len(t) {
+		return ""
+	}
+	return t[index]
+}
+
+// NewFactTableSection returns a section embedding the fact table of the
+// bytecode.
+func NewFactTableSection(table FactTable) (Section, error) {
+	data, err := json.Marshal(table)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionFacts, Data: data}, nil
+}
+
+// ReadFactTable returns the fact table embedded in a bytecode image's
+// sections.
+func ReadFactTable(sections []Section) (FactTable, bool, error) {
+	section, ok := FindSection(sections, SectionFacts)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var table FactTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, false, fmt.Errorf("invalid fact table section: %w", err)
+	}
+	return table, true, nil
+}
+
+// NewInitialFactsSection returns a section embedding the facts to set before
+// the first cycle.
+func NewInitialFactsSection(facts map[string]interface{}) (Section, error) {
+	data, err := json.Marshal(facts)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionInitialFacts, Data: data}, nil
+}
+
+// ReadInitialFacts returns the facts to set before the first cycle embedded
+// in a bytecode image's sections. Numbers are returned as float64.
+func ReadInitialFacts(sections []Section) (map[string]interface{}, bool, error) {
+	section, ok := FindSection(sections, SectionInitialFacts)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var facts map[string]interface{}
+	if err := json.Unmarshal(data, &facts); err != nil {
+		return nil, false, fmt.Errorf("invalid initial facts section: %w", err)
+	}
+	return facts, true, nil
+}
+
+// NewReadOnlyFactsSection returns a section embedding the facts, or fact
+// patterns, rules may not write.
+func NewReadOnlyFactsSection(facts []string) (Section, error) {
+	data, err := json.Marshal(facts)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionReadOnlyFacts, Data: data}, nil
+}
+
+// ReadReadOnlyFacts returns the facts, or fact patterns, rules may not write
+// embedded in a bytecode image's sections.
+func ReadReadOnlyFacts(sections []Section) ([]string, bool, error) {
+	section, ok := FindSection(sections, SectionReadOnlyFacts)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var facts []string
+	if err := json.Unmarshal(data, &facts); err != nil {
+		return nil, false, fmt.Errorf("invalid read-only facts section: %w", err)
+	}
+	return facts, true, nil
+}
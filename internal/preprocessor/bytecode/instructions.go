@@ -41,14 +41,14 @@ const (
 
 	// Fact instructions
 	LOAD_FACT
-	STORE_FACT
+	STORE_FACT // Stores the value on top of the stack, without popping it, in a fact; unlike UPDATE_FACT, it doesn't make the rule fire; operand is the fact's index (1 byte)
 
 	// Value instructions
 	LOAD_CONST_INT
 	LOAD_CONST_FLOAT
 	LOAD_CONST_STRING
 	LOAD_CONST_BOOL
-	LOAD_VAR
+	LOAD_VAR // Pushes the value of a local variable of the current rule; operand is the variable slot (1 byte)
 
 	// Control flow instructions
 	JUMP
@@ -56,14 +56,14 @@ const (
 	JUMP_IF_FALSE
 
 	// Action instructions
-	TRIGGER_ACTION
+	TRIGGER_ACTION // Pops a value and requests an action performed by a runtime handler; operands are the action type and target (NUL-terminated)
 	UPDATE_FACT
-	SEND_MESSAGE
+	SEND_MESSAGE // Reserved; sendMessage actions compile to TRIGGER_ACTION
 
 	// Miscellaneous instructions
-	NOP
-	HALT
-	ERROR
+	NOP   // Does nothing; pads the code between rules to align them
+	HALT  // Ends the cycle; the compiler emits it at the end of the code
+	ERROR // Fails the rule with a message; operand is the index of the message in the messages section (uint16)
 
 	// Optimization instructions
 	INC
@@ -74,12 +74,57 @@ const (
 	LABEL
 
 	RULE_END // Add this instruction to mark the end of a rule
+
+	RULE_START // Marks the start of a rule; operand is the rule priority (int32)
+
+	LOAD_CONST_INT64  // Loads an int64 constant (8 bytes, little-endian)
+	LOAD_CONST_UINT64 // Loads a uint64 constant (8 bytes, little-endian)
+
+	ROLLOUT // Skips the rest of the rule for entities outside its rollout; operands are the percentage (1 byte), a salt (uint32) and the key fact name (NUL-terminated)
+
+	VARIANT     // Starts the actions of an A/B variant; operands are the bucket range (2 bytes), a salt (uint32), the key fact name and the variant name (NUL-terminated)
+	VARIANT_END // Ends the variants of a rule
+
+	CALL_OPERATOR // Compares the top two stack values with a custom operator registered with the runtime; operand is the operator name (NUL-terminated)
+
+	COND_START // Marks the start of the condition code of a rule; no operation
+	COND_END   // Marks the end of the condition code of a rule; no operation
+
+	MATCH_FACTS // Compares the value on top of the stack with every fact matching a pattern and pushes whether any or all satisfy the operator; operands are a quantifier byte (0 any, 1 all), the pattern and the operator name (NUL-terminated)
+
+	STORE_VAR // Stores the value on top of the stack, without popping it, in a local variable of the current rule; operand is the variable slot (1 byte)
+
+	EQ_FLOAT_EPSILON  // Compares the top two stack values as numbers equal within a tolerance; operand is the tolerance (float64, 8 bytes, little-endian)
+	NEQ_FLOAT_EPSILON // Compares the top two stack values as numbers further apart than a tolerance; operand is the tolerance (float64, 8 bytes, little-endian)
+
+	CALL_SCRIPT // Runs a Lua script and pushes its result; operands are the kind of script (0 condition, 1 value), the number of facts it reads (1 byte), their names and the script (NUL-terminated)
+
+	LOAD_CONST_INT16   // Loads an int16 constant (2 bytes, little-endian), emitted for targets with a narrower integer width
+	LOAD_CONST_FLOAT32 // Loads a float32 constant (4 bytes, little-endian), emitted for float32 targets
+
+	HOLD // Skips the rest of the rule until its conditions have held for a duration; operands are the duration in milliseconds (uint32) and flags (1 byte, 1 once)
+
+	CONTAINS_STRING     // Pushes whether the string below the top of the stack contains the string on top
+	NOT_CONTAINS_STRING // Pushes whether the string below the top of the stack doesn't contain the string on top
+
+	EQ_BOOL  // Compares the top two stack values as booleans for equality
+	NEQ_BOOL // Compares the top two stack values as booleans for inequality
+
+	IN_LIST     // Pops a value and pushes whether it is one of a list of constants; operands are the list's element type (1 byte), its length (uint16) and its elements
+	NOT_IN_LIST // Pops a value and pushes whether it is none of a list of constants; operands as for IN_LIST
+
+	FACT_EXISTS // Pushes whether a fact is set, without failing when it isn't; operand is the fact's index (1 byte)
+
+	ADD_FLOAT // Pops two numbers and pushes their sum as a float
 )
 
 // hasOperands returns true if the opcode requires operands.
 func (op Opcode) HasOperands() bool {
 	switch op {
-	case LOAD_CONST_INT, LOAD_CONST_FLOAT, LOAD_CONST_STRING, LOAD_CONST_BOOL, LOAD_FACT, JUMP, JUMP_IF_TRUE, JUMP_IF_FALSE:
+	case LOAD_CONST_INT, LOAD_CONST_FLOAT, LOAD_CONST_STRING, LOAD_CONST_BOOL, LOAD_FACT, JUMP, JUMP_IF_TRUE, JUMP_IF_FALSE, RULE_START,
+		LOAD_CONST_INT64, LOAD_CONST_UINT64, ROLLOUT, VARIANT, CALL_OPERATOR, MATCH_FACTS,
+		LOAD_VAR, STORE_VAR, TRIGGER_ACTION, EQ_FLOAT_EPSILON, NEQ_FLOAT_EPSILON, CALL_SCRIPT,
+		LOAD_CONST_INT16, LOAD_CONST_FLOAT32, HOLD, IN_LIST, NOT_IN_LIST, ERROR, FACT_EXISTS, STORE_FACT:
 		return true
 	default:
 		return false
@@ -106,6 +151,8 @@ func (op Opcode) String() string {
 		return "LOAD_CONST_BOOL"
 	case LOAD_FACT:
 		return "LOAD_FACT"
+	case STORE_FACT:
+		return "STORE_FACT"
 	case EQ_INT:
 		return "EQ_INT"
 	case NEQ_INT:
@@ -168,6 +215,58 @@ func (op Opcode) String() string {
 		return "LABEL"
 	case RULE_END:
 		return "RULE_END"
+	case RULE_START:
+		return "RULE_START"
+	case LOAD_CONST_INT64:
+		return "LOAD_CONST_INT64"
+	case LOAD_CONST_UINT64:
+		return "LOAD_CONST_UINT64"
+	case ROLLOUT:
+		return "ROLLOUT"
+	case VARIANT:
+		return "VARIANT"
+	case VARIANT_END:
+		return "VARIANT_END"
+	case CALL_OPERATOR:
+		return "CALL_OPERATOR"
+	case COND_START:
+		return "COND_START"
+	case COND_END:
+		return "COND_END"
+	case MATCH_FACTS:
+		return "MATCH_FACTS"
+	case LOAD_VAR:
+		return "LOAD_VAR"
+	case STORE_VAR:
+		return "STORE_VAR"
+	case EQ_FLOAT_EPSILON:
+		return "EQ_FLOAT_EPSILON"
+	case NEQ_FLOAT_EPSILON:
+		return "NEQ_FLOAT_EPSILON"
+	case CALL_SCRIPT:
+		return "CALL_SCRIPT"
+	case LOAD_CONST_INT16:
+		return "LOAD_CONST_INT16"
+	case LOAD_CONST_FLOAT32:
+		return "LOAD_CONST_FLOAT32"
+	case HOLD:
+		return "HOLD"
+	case CONTAINS_STRING:
+		return "CONTAINS_STRING"
+	case NOT_CONTAINS_STRING:
+		return "NOT_CONTAINS_STRING"
+	case EQ_BOOL:
+		return "EQ_BOOL"
+	case NEQ_BOOL:
+		return "NEQ_BOOL"
+	case IN_LIST:
+		return "IN_LIST"
+	case NOT_IN_LIST:
+		return "NOT_IN_LIST"
+	case FACT_EXISTS:
+		return "FACT_EXISTS"
+	case ADD_FLOAT:
+		return "ADD_FLOAT"
 	default:
 		return fmt.Sprintf("UNKNOWN_OPCODE(%d)", byte(op))
 	}
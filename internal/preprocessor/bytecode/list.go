@@ -0,0 +1,201 @@
+// preprocessor/bytecode/list.go
+
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+)
+
+// Element types of the lists of IN_LIST and NOT_IN_LIST. Ints and floats are
+// encoded in 8 bytes, little-endian, strings NUL-terminated and bools in a
+// byte.
+const (
+	ListInt    byte = 0
+	ListFloat  byte = 1
+	ListString byte = 2
+	ListBool   byte = 3
+)
+
+// listElementTypes maps value types to list element types.
+var listElementTypes = map[string]byte{"int": ListInt, "float": ListFloat, "string": ListString, "bool": ListBool}
+
+// MaxListLength is the longest list an in or notIn condition may compare a
+// fact with.
+const MaxListLength = math.MaxUint16
+
+// isListOperator reports whether an operator compares a fact with a list.
+func isListOperator(operator string) bool {
+	return operator == rules.OperatorIn || operator == rules.OperatorNotIn
+}
+
+// emitListMembership emits the test of an in or notIn condition on the fact
+// on top of the stack: IN_LIST or NOT_IN_LIST with the condition's list.
+func (c *Compiler) emitListMembership(condition *rules.Condition) error {
+	list, ok := condition.Value.([]interface{})
+	if !ok {
+		return fmt.Errorf("condition on fact '%s' has operator '%s', which needs a list value", condition.Fact, condition.Operator)
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("condition on fact '%s' has an empty list", condition.Fact)
+	}
+	if len(list) > MaxListLength {
+		return fmt.Errorf("condition on fact '%s' has a list of %d values, at most %d are allowed", condition.Fact, len(list), MaxListLength)
+	}
+	valueType := condition.ValueType
+	if valueType == "" {
+		valueType = listTypeOf(list)
+	}
+
+	elementType, ok := listElementTypes[valueType]
+	if !ok {
+		return fmt.Errorf("condition on fact '%s' has a list of unsupported type '%s'", condition.Fact, valueType)
+	}
+
+	operands := binary.LittleEndian.AppendUint16([]byte{elementType}, uint16(len(list)))
+	for _, element := range list {
+		switch elementType {
+		case ListInt:
+			value, err := c.listInt(element)
+			if err != nil {
+				return fmt.Errorf("condition on fact '%s': %w", condition.Fact, err)
+			}
+			operands = binary.LittleEndian.AppendUint64(operands, uint64(value))
+		case ListFloat:
+			value, ok := numericValue(element)
+			if !ok {
+				return fmt.Errorf("condition on fact '%s' has valueType 'float' but list value %v is not a number", condition.Fact, element)
+			}
+			if c.options.Float32 && math.Abs(value) > math.MaxFloat32 {
+				c.constantError(fmt.Errorf("float constant %v doesn't fit the float32 target", value))
+			}
+			operands = binary.LittleEndian.AppendUint64(operands, math.Float64bits(value))
+		case ListString:
+			value, ok := element.(string)
+			if !ok {
+				return fmt.Errorf("condition on fact '%s' has valueType 'string' but list value %v is not a string", condition.Fact, element)
+			}
+			if strings.IndexByte(value, 0) >= 0 {
+				return fmt.Errorf("condition on fact '%s' has a list value containing a NUL character", condition.Fact)
+			}
+			operands = append(append(operands, value...), 0)
+		case ListBool:
+			value, ok := element.(bool)
+			if !ok {
+				return fmt.Errorf("condition on fact '%s' has valueType 'bool' but list value %v is not a bool", condition.Fact, element)
+			}
+			var b byte
+			if value {
+				b = 1
+			}
+			operands = append(operands, b)
+		}
+	}
+
+	opcode := IN_LIST
+	if condition.Operator == rules.OperatorNotIn {
+		opcode = NOT_IN_LIST
+	}
+	c.emitInstruction(opcode, operands...)
+	return nil
+}
+
+// listInt converts an element of an int list, recording elements the target
+// can't hold like emitLoadInt does.
+func (c *Compiler) listInt(element interface{}) (int64, error) {
+	var value int64
+	switch v := element.(type) {
+	case int:
+		value = int64(v)
+	case int32:
+		value = int64(v)
+	case int64:
+		value = v
+	case uint64:
+		if v > math.MaxInt64 {
+			c.constantError(fmt.Errorf("integer constant %d doesn't fit a list of ints", v))
+			return 0, nil
+		}
+		value = int64(v)
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("list value %v is not an integer", v)
+		}
+		value = int64(v)
+	default:
+		return 0, fmt.Errorf("list value %v is not an integer", element)
+	}
+	if width := c.options.IntWidth; c.narrowInts() && (value < -1<<(width-1) || value > 1<<(width-1)-1) {
+		c.constantError(fmt.Errorf("integer constant %d doesn't fit the %d-bit target", value, width))
+	}
+	return value, nil
+}
+
+// listTypeOf infers the element type of a list: the type of its elements, or
+// float if it mixes whole and fractional numbers. It returns "" for an empty
+// list or one mixing other types.
+func listTypeOf(list []interface{}) string {
+	listType := ""
+	for _, element := range list {
+		elementType := valueTypeOf(element)
+		switch {
+		case elementType == "":
+			return ""
+		case listType == "" || listType == elementType:
+			listType = elementType
+		case listType == "int" && elementType == "float", listType == "float" && elementType == "int":
+			listType = "float"
+		default:
+			return ""
+		}
+	}
+	return listType
+}
+
+// DecodeList decodes the list operand of IN_LIST and NOT_IN_LIST, returning
+// its elements, as int64, float64, string or bool, and its size in bytes.
+func DecodeList(operands []byte) ([]interface{}, int, error) {
+	if len(operands) < 3 {
+		return nil, 0, errors.New("truncated list operand")
+	}
+	elementType := operands[0]
+	if elementType > ListBool {
+		return nil, 0, fmt.Errorf("unknown list element type %d", elementType)
+	}
+	list := make([]interface{}, binary.LittleEndian.Uint16(operands[1:]))
+	pos := 3
+	for i := range list {
+		switch elementType {
+		case ListInt, ListFloat:
+			if pos+8 > len(operands) {
+				return nil, 0, errors.New("truncated list operand")
+			}
+			bits := binary.LittleEndian.Uint64(operands[pos:])
+			if elementType == ListInt {
+				list[i] = int64(bits)
+			} else {
+				list[i] = math.Float64frombits(bits)
+			}
+			pos += 8
+		case ListString:
+			end := bytes.IndexByte(operands[pos:], 0)
+			if end < 0 {
+				return nil, 0, errors.New("unterminated string in list operand")
+			}
+			list[i] = string(operands[pos : pos+end])
+			pos += end + 1
+		case ListBool:
+			if pos >= len(operands) {
+				return nil, 0, errors.New("truncated list operand")
+			}
+			list[i] = operands[pos] == 1
+			pos++
+		}
+	}
+	return list, pos, nil
+}
@@ -0,0 +1,61 @@
+// preprocessor/bytecode/messages.go
+
+package bytecode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// emitError emits an ERROR instruction failing the rule with a message when
+// it runs, for code the compiler deliberately doesn't support. Messages are
+// kept once each, in the order they are first emitted.
+func (c *Compiler) emitError(message string) {
+	index := slices.Index(c.messages, message)
+	if index < 0 {
+		if len(c.messages) > math.MaxUint16 {
+			c.constantError(fmt.Errorf("more than %d error messages", math.MaxUint16+1))
+			return
+		}
+		index = len(c.messages)
+		c.messages = append(c.messages, message)
+	}
+	c.emitInstruction(ERROR, binary.LittleEndian.AppendUint16(nil, uint16(index))...)
+}
+
+// Messages returns the messages the ERROR instructions of the compiled code
+// refer to, by index. Hosts embed them with NewMessagesSection.
+func (c *Compiler) Messages() []string {
+	return c.messages
+}
+
+// NewMessagesSection returns a section embedding the messages ERROR
+// instructions fail with.
+func NewMessagesSection(messages []string) (Section, error) {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionMessages, Data: data}, nil
+}
+
+// ReadMessages returns the messages ERROR instructions fail with embedded in
+// a bytecode image's sections.
+func ReadMessages(sections []Section) ([]string, bool, error) {
+	section, ok := FindSection(sections, SectionMessages)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var messages []string
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, false, fmt.Errorf("invalid messages section: %w", err)
+	}
+	return messages, true, nil
+}
@@ -0,0 +1,129 @@
+// preprocessor/bytecode/numeric.go
+
+package bytecode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/rules"
+)
+
+// Numeric coercion policy
+//
+// Conditions compare a fact against a constant of the condition's value type.
+// Integer and floating point numbers may be mixed: if either side of a
+// comparison is a float, both sides are compared as float64. The compiler
+// applies the same policy to constants, so an "int" condition whose value has
+// a fractional part is compiled as a float comparison rather than truncated.
+//
+// With Options.StrictNumeric the compiler instead rejects such rules, and also
+// rejects rulesets that compare the same fact as an int in one condition and
+// as a float in another.
+//
+// Numbers compared by equal and notEqual are equal when they are at most the
+// condition's epsilon apart. Float conditions without an epsilon use
+// Options.FloatEpsilon, and compare exactly if that is zero too.
+
+// resolveValueType returns the value type a condition's constant should be
+// compiled as, applying the numeric coercion policy.
+func (c *Compiler) resolveValueType(condition *rules.Condition) (string, error) {
+	valueType := condition.ValueType
+	if valueType == "" {
+		valueType = valueTypeOf(condition.Value)
+	}
+	if valueType != "int" && valueType != "float" {
+		return valueType, nil
+	}
+
+	number, ok := numericValue(condition.Value)
+	if !ok {
+		return "", fmt.Errorf("condition on fact '%s' has valueType '%s' but value %v is not a number", condition.Fact, valueType, condition.Value)
+	}
+
+	if valueType == "int" && number != math.Trunc(number) {
+		if c.options.StrictNumeric {
+			return "", fmt.Errorf("condition on fact '%s' has valueType 'int' but value %v is not an integer", condition.Fact, condition.Value)
+		}
+		valueType = "float"
+	}
+
+	if previous, seen := c.numericFactTypes[condition.Fact]; seen && previous != valueType {
+		if c.options.StrictNumeric {
+			return "", fmt.Errorf("fact '%s' is compared as both '%s' and '%s'", condition.Fact, previous, valueType)
+		}
+	} else {
+		c.numericFactTypes[condition.Fact] = valueType
+	}
+
+	return valueType, nil
+}
+
+// valueTypeOf infers the value type of a constant. Whole numbers are treated
+// as ints, matching how the parser infers types.
+func valueTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case int, int32, int64, uint64:
+		return "int"
+	case float64:
+		if v == math.Trunc(v) {
+			return "int"
+		}
+		return "float"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	default:
+		return ""
+	}
+}
+
+// numericValue converts a numeric constant to float64.
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// emitConditionComparison emits the comparison of a condition on a single
+// fact, comparing numbers for equality within the condition's tolerance.
+func (c *Compiler) emitConditionComparison(condition *rules.Condition, valueType string) {
+	epsilon := c.conditionEpsilon(condition, valueType)
+	if epsilon <= 0 {
+		c.emitComparison(condition.Operator, valueType)
+		return
+	}
+
+	opcode := EQ_FLOAT_EPSILON
+	if condition.Operator == rules.OperatorNotEqual {
+		opcode = NEQ_FLOAT_EPSILON
+	}
+	c.emitInstruction(opcode, binary.LittleEndian.AppendUint64(nil, math.Float64bits(epsilon))...)
+}
+
+// conditionEpsilon returns how far apart the numbers a condition compares for
+// equality may be, or 0 if they must be equal.
+func (c *Compiler) conditionEpsilon(condition *rules.Condition, valueType string) float64 {
+	if condition.Operator != rules.OperatorEqual && condition.Operator != rules.OperatorNotEqual {
+		return 0
+	}
+	if condition.Epsilon != nil {
+		return *condition.Epsilon
+	}
+	if valueType == "float" {
+		return c.options.FloatEpsilon
+	}
+	return 0
+}
@@ -0,0 +1,186 @@
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compileTestConditions compiles a single rule with the given conditions.
+func compileTestConditions(options Options, conditions ...rules.Condition) ([]byte, error) {
+	context := rules.NewRuleEngineContext()
+	for _, cond := range conditions {
+		if _, exists := context.FactIndex[cond.Fact]; !exists {
+			context.FactIndex[cond.Fact] = len(context.FactIndex)
+		}
+	}
+	compiler := NewCompilerWithOptions(context, options)
+	return compiler.Compile([]*rules.Rule{{Name: "NumericRule", Conditions: rules.Conditions{All: conditions}}})
+}
+
+func TestNumericCoercion_FractionalIntPromotedToFloat(t *testing.T) {
+	bytecode, err := compileTestConditions(Options{},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 30.5, ValueType: "int"},
+	)
+	require.NoError(t, err)
+
+	// LOAD_FACT, then LOAD_CONST_FLOAT and GT_FLOAT instead of a truncated int
+	assert.Equal(t, byte(LOAD_CONST_FLOAT), bytecode[7])
+	assert.Equal(t, byte(GT_FLOAT), bytecode[16])
+}
+
+func TestNumericCoercion_FloatConditionUsesFloatOpcode(t *testing.T) {
+	bytecode, err := compileTestConditions(Options{},
+		rules.Condition{Fact: "temperature", Operator: "lessThanOrEqual", Value: 21.5, ValueType: "float"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, byte(LTE_FLOAT), bytecode[16])
+}
+
+func TestNumericCoercion_InferredInt64Value(t *testing.T) {
+	// The parser infers whole numbers as int64 without always recording the type
+	bytecode, err := compileTestConditions(Options{},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: int64(30)},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{byte(LOAD_CONST_INT), 30, 0, 0, 0, byte(GT_INT)}, bytecode[7:13])
+}
+
+func TestNumericCoercion_StrictMode(t *testing.T) {
+	_, err := compileTestConditions(Options{StrictNumeric: true},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 30.5, ValueType: "int"},
+	)
+	assert.ErrorContains(t, err, "is not an integer")
+
+	_, err = compileTestConditions(Options{StrictNumeric: true},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"},
+		rules.Condition{Fact: "temperature", Operator: "lessThan", Value: 40.5, ValueType: "float"},
+	)
+	assert.ErrorContains(t, err, "compared as both 'int' and 'float'")
+
+	// The same mix is accepted outside of strict mode
+	_, err = compileTestConditions(Options{},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"},
+		rules.Condition{Fact: "temperature", Operator: "lessThan", Value: 40.5, ValueType: "float"},
+	)
+	assert.NoError(t, err)
+}
+
+func TestNumericCoercion_NonNumericValue(t *testing.T) {
+	_, err := compileTestConditions(Options{},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: "30", ValueType: "int"},
+	)
+	assert.ErrorContains(t, err, "is not a number")
+}
+
+func TestNumericCoercion_WideIntegers(t *testing.T) {
+	bytecode, err := compileTestConditions(Options{},
+		rules.Condition{Fact: "deviceId", Operator: "equal", Value: int64(9007199254740993), ValueType: "int"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		byte(LOAD_CONST_INT64), 0x01, 0, 0, 0, 0, 0, 0x20, 0, // 2^53 + 1
+		byte(EQ_INT),
+	}, bytecode[7:17])
+
+	bytecode, err = compileTestConditions(Options{},
+		rules.Condition{Fact: "counter", Operator: "lessThan", Value: uint64(18446744073709551615), ValueType: "int"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		byte(LOAD_CONST_UINT64), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		byte(LT_INT),
+	}, bytecode[7:17])
+
+	// Values that fit in an int32 keep the compact encoding
+	bytecode, err = compileTestConditions(Options{},
+		rules.Condition{Fact: "offset", Operator: "greaterThan", Value: int64(-5), ValueType: "int"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{byte(LOAD_CONST_INT), 0xfb, 0xff, 0xff, 0xff, byte(GT_INT)}, bytecode[7:13])
+}
+
+func TestNumericCoercion_IntWidth(t *testing.T) {
+	// A 16-bit target gets the 2-byte encoding
+	bytecode, err := compileTestConditions(Options{IntWidth: 16},
+		rules.Condition{Fact: "offset", Operator: "greaterThan", Value: int64(-300), ValueType: "int"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{byte(LOAD_CONST_INT16), 0xd4, 0xfe, byte(GT_INT)}, bytecode[7:11])
+
+	_, err = compileTestConditions(Options{IntWidth: 16},
+		rules.Condition{Fact: "offset", Operator: "greaterThan", Value: int64(40000), ValueType: "int"},
+	)
+	assert.ErrorContains(t, err, "rule 'NumericRule': integer constant 40000 doesn't fit the 16-bit target")
+
+	// A 32-bit target uses the 2-byte encoding where it can and the 4-byte one otherwise
+	bytecode, err = compileTestConditions(Options{IntWidth: 32},
+		rules.Condition{Fact: "offset", Operator: "greaterThan", Value: int64(40000), ValueType: "int"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{byte(LOAD_CONST_INT), 0x40, 0x9c, 0, 0, byte(GT_INT)}, bytecode[7:13])
+
+	for _, value := range []interface{}{int64(1 << 40), uint64(18446744073709551615)} {
+		_, err = compileTestConditions(Options{IntWidth: 32},
+			rules.Condition{Fact: "counter", Operator: "lessThan", Value: value, ValueType: "int"},
+		)
+		assert.ErrorContains(t, err, "doesn't fit the 32-bit target")
+	}
+
+	_, err = compileTestConditions(Options{IntWidth: 8},
+		rules.Condition{Fact: "offset", Operator: "greaterThan", Value: 1, ValueType: "int"},
+	)
+	assert.ErrorContains(t, err, "integer width must be 16, 32 or 64 bits, not 8")
+}
+
+func TestNumericCoercion_Float32(t *testing.T) {
+	bytecode, err := compileTestConditions(Options{Float32: true},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 30.5, ValueType: "float"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{byte(LOAD_CONST_FLOAT32), 0, 0, 0xf4, 0x41, byte(GT_FLOAT)}, bytecode[7:13])
+
+	listing, err := Disassemble(bytecode)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "LOAD_CONST_FLOAT32 30.5\n")
+
+	_, err = compileTestConditions(Options{Float32: true},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 1e39, ValueType: "float"},
+	)
+	assert.ErrorContains(t, err, "float constant 1e+39 doesn't fit the float32 target")
+}
+
+func TestNumericCoercion_Epsilon(t *testing.T) {
+	epsilon := func(value float64) *float64 { return &value }
+	opcodeOf := func(options Options, condition rules.Condition) Opcode {
+		bytecode, err := compileTestConditions(options, condition)
+		require.NoError(t, err)
+		return Opcode(bytecode[16])
+	}
+
+	// A condition's own epsilon applies to ints and floats alike
+	assert.Equal(t, EQ_FLOAT_EPSILON, opcodeOf(Options{},
+		rules.Condition{Fact: "temperature", Operator: "equal", Value: 21.5, ValueType: "float", Epsilon: epsilon(0.1)}))
+	assert.Equal(t, NEQ_FLOAT_EPSILON, opcodeOf(Options{},
+		rules.Condition{Fact: "temperature", Operator: "notEqual", Value: 21.5, ValueType: "float", Epsilon: epsilon(0.1)}))
+
+	// The default only applies to floats, and an epsilon of 0 overrides it
+	assert.Equal(t, EQ_FLOAT_EPSILON, opcodeOf(Options{FloatEpsilon: 0.01},
+		rules.Condition{Fact: "temperature", Operator: "equal", Value: 21.5, ValueType: "float"}))
+	assert.Equal(t, EQ_FLOAT, opcodeOf(Options{FloatEpsilon: 0.01},
+		rules.Condition{Fact: "temperature", Operator: "equal", Value: 21.5, ValueType: "float", Epsilon: epsilon(0)}))
+	assert.Equal(t, GT_FLOAT, opcodeOf(Options{FloatEpsilon: 0.01},
+		rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 21.5, ValueType: "float"}))
+
+	bytecode, err := compileTestConditions(Options{FloatEpsilon: 0.01},
+		rules.Condition{Fact: "temperature", Operator: "equal", Value: 21, ValueType: "int"},
+		rules.Condition{Fact: "humidity", Operator: "equal", Value: 40, ValueType: "int", Epsilon: epsilon(2)},
+	)
+	require.NoError(t, err)
+	listing, err := Disassemble(bytecode)
+	require.NoError(t, err)
+	assert.Contains(t, listing, "EQ_INT\n")
+	assert.Contains(t, listing, "EQ_FLOAT_EPSILON epsilon=2\n")
+}
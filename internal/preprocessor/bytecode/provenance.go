@@ -0,0 +1,104 @@
+// preprocessor/bytecode/provenance.go
+
+package bytecode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Provenance identifies the ruleset revision a bytecode image was compiled
+// from, and by what, so that the actions it produces can be traced back to it.
+type Provenance struct {
+	RulesetHash     string    `json:"rulesetHash"`     // Canonical hash of the source ruleset, see HashRuleset
+	CompilerVersion string    `json:"compilerVersion"` // See CompilerVersion
+	CompiledAt      time.Time `json:"compiledAt"`
+}
+
+// ShortHash returns the first 12 characters of the ruleset hash, enough to
+// tell revisions apart in logs and listings.
+func (p Provenance) ShortHash() string {
+	if len(p.RulesetHash) > 12 {
+		return p.RulesetHash[:12]
+	}
+	return p.RulesetHash
+}
+
+// HashRuleset returns the hex SHA-256 hash of a ruleset's JSON in canonical
+// form: object keys sorted and insignificant whitespace removed, so that
+// reformatting the ruleset keeps its hash.
+func HashRuleset(ruleJSON []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(ruleJSON))
+	decoder.UseNumber()
+	var ruleset interface{}
+	if err := decoder.Decode(&ruleset); err != nil {
+		return "", fmt.Errorf("failed to parse ruleset for hashing: %w", err)
+	}
+	canonical, err := json.Marshal(ruleset)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CompilerVersion returns the version of the running binary's module, or for
+// development builds "devel" followed by the VCS revision it was built from,
+// marked dirty if the tree had local changes.
+func CompilerVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	version := "devel"
+	var dirty bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			version += "-" + setting.Value
+		case "vcs.modified":
+			dirty = setting.Value == "true"
+		}
+	}
+	if dirty {
+		version += "-dirty"
+	}
+	return version
+}
+
+// NewProvenanceSection returns a section embedding the provenance of the
+// bytecode.
+func NewProvenanceSection(provenance Provenance) (Section, error) {
+	data, err := json.Marshal(provenance)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionProvenance, Data: data}, nil
+}
+
+// ReadProvenance returns the provenance embedded in a bytecode image's
+// sections.
+func ReadProvenance(sections []Section) (Provenance, bool, error) {
+	section, ok := FindSection(sections, SectionProvenance)
+	if !ok {
+		return Provenance{}, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return Provenance{}, false, err
+	}
+	var provenance Provenance
+	if err := json.Unmarshal(data, &provenance); err != nil {
+		return Provenance{}, false, fmt.Errorf("invalid provenance section: %w", err)
+	}
+	return provenance, true, nil
+}
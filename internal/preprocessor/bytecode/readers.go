@@ -0,0 +1,94 @@
+// preprocessor/bytecode/readers.go
+
+package bytecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"sort"
+)
+
+// FactReaders indexes the rules by the facts, or fact patterns, their
+// conditions read: each fact maps to the positions in the code of the rules
+// reading it, in ascending order. A runtime looks up the rules a changed fact
+// affects in it instead of evaluating every rule.
+type FactReaders map[string][]int
+
+// Rules returns the positions of the rules reading any of the facts, directly
+// or through a fact pattern matching them, in ascending order.
+func (r FactReaders) Rules(facts []string) []int {
+	selected := make(map[int]bool)
+	for _, fact := range facts {
+		for _, rule := range r[fact] {
+			selected[rule] = true
+		}
+	}
+	for pattern, readers := range r {
+		if !rules.IsFactPattern(pattern) {
+			continue
+		}
+		for _, fact := range facts {
+			if rules.MatchFact(pattern, fact) {
+				for _, rule := range readers {
+					selected[rule] = true
+				}
+				break
+			}
+		}
+	}
+	positions := make([]int, 0, len(selected))
+	for rule := range selected {
+		positions = append(positions, rule)
+	}
+	sort.Ints(positions)
+	return positions
+}
+
+// FactReaders returns the rules of the compiled code reading each fact or
+// fact pattern. Hosts embed them with NewFactReadersSection.
+func (c *Compiler) FactReaders() FactReaders {
+	return c.readers
+}
+
+// recordRead records that the rule being compiled reads a fact or matches a
+// fact pattern.
+func (c *Compiler) recordRead(fact string) {
+	rule := len(c.ruleOffsets) - 1
+	readers := c.readers[fact]
+	if len(readers) > 0 && readers[len(readers)-1] == rule {
+		return
+	}
+	if c.readers == nil {
+		c.readers = make(FactReaders)
+	}
+	c.readers[fact] = append(readers, rule)
+}
+
+// NewFactReadersSection returns a section embedding the rules reading each
+// fact.
+func NewFactReadersSection(readers FactReaders) (Section, error) {
+	data, err := json.Marshal(readers)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionFactReaders, Data: data}, nil
+}
+
+// ReadFactReaders returns the rules reading each fact embedded in a bytecode
+// image's sections.
+func ReadFactReaders(sections []Section) (FactReaders, bool, error) {
+	section, ok := FindSection(sections, SectionFactReaders)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var readers FactReaders
+	if err := json.Unmarshal(data, &readers); err != nil {
+		return nil, false, fmt.Errorf("invalid fact readers section: %w", err)
+	}
+	return readers, true, nil
+}
@@ -0,0 +1,39 @@
+// preprocessor/bytecode/schema.go
+
+package bytecode
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// FactSchema maps facts, or fact patterns, to the type the rules compare or
+// write them as: int, float, string or bool.
+type FactSchema map[string]string
+
+// NewSchemaSection returns a section embedding the fact schema of the
+// bytecode.
+func NewSchemaSection(schema FactSchema) (Section, error) {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionSchema, Data: data}, nil
+}
+
+// ReadSchema returns the fact schema embedded in a bytecode image's sections.
+func ReadSchema(sections []Section) (FactSchema, bool, error) {
+	section, ok := FindSection(sections, SectionSchema)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var schema FactSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, false, fmt.Errorf("invalid schema section: %w", err)
+	}
+	return schema, true, nil
+}
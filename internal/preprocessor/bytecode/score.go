@@ -0,0 +1,50 @@
+// preprocessor/bytecode/score.go
+
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+
+	"github.com/rs/zerolog/log"
+)
+
+// compileScore compiles the conditions of a scoring rule. The weights of the
+// all conditions that hold are added up on the stack, starting from zero,
+// and the sum is stored in the score fact before the rule is skipped unless
+// it reaches the threshold. Each condition jumps past its weight when it
+// doesn't hold; in boolean mode it is evaluated to a boolean first, so every
+// comparison is still evaluated.
+func (c *Compiler) compileScore(rule *rules.Rule, endLabel string) error {
+	factIndex, err := c.getFactIndex(rule.Score.Fact)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().
+		Str("Fact", rule.Score.Fact).
+		Float64("Threshold", rule.Score.Threshold).
+		Msg("Compiling scoring conditions")
+
+	c.emitLoadFloat(0)
+	for i := range rule.Conditions.All {
+		condition := &rule.Conditions.All[i]
+		skipLabel := c.generateUniqueLabel("score_skip")
+		if c.options.ConditionMode == ConditionModeBoolean {
+			if err := c.compileConditionValue(condition); err != nil {
+				return err
+			}
+			c.emitJump(JUMP_IF_FALSE, skipLabel)
+		} else if err := c.compileCondition(condition, skipLabel, false); err != nil {
+			return err
+		}
+		c.emitLoadFloat(condition.ScoreWeight())
+		c.emitInstruction(ADD_FLOAT)
+		c.emitLabel(skipLabel)
+	}
+
+	c.emitInstruction(STORE_FACT, byte(factIndex))
+	c.emitLoadFloat(rule.Score.Threshold)
+	c.emitInstruction(GTE_FLOAT)
+	c.emitJump(JUMP_IF_FALSE, endLabel)
+	return nil
+}
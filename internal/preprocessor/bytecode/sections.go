@@ -0,0 +1,190 @@
+// preprocessor/bytecode/sections.go
+
+package bytecode
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// SectionID identifies the contents of a bytecode section.
+type SectionID byte
+
+const (
+	// SectionSource holds the ruleset JSON the bytecode was compiled from.
+	SectionSource SectionID = iota + 1
+	// SectionCost holds the worst-case evaluation cost estimated by the
+	// compiler, as JSON.
+	SectionCost
+	// SectionSchema holds the type of each fact the rules compare or write,
+	// as JSON.
+	SectionSchema
+	// SectionProvenance holds the hash of the source ruleset, the compiler
+	// version and the compilation time, as JSON.
+	SectionProvenance
+	// SectionFacts holds the names of the facts by the index the code refers
+	// to them with, as JSON.
+	SectionFacts
+	// SectionInitialFacts holds the facts set before the first cycle, such as
+	// the initial states of state machines, as a JSON object.
+	SectionInitialFacts
+	// SectionReadOnlyFacts holds the facts, or fact patterns, rules may not
+	// write, as a JSON array.
+	SectionReadOnlyFacts
+	// SectionMessages holds the messages ERROR instructions fail with, by
+	// the index they refer to them with, as a JSON array.
+	SectionMessages
+	// SectionRules holds the names and metadata of the rules by their
+	// position in the code, as a JSON array.
+	SectionRules
+	// SectionWebhooks holds the requests of the webhook actions, by the index
+	// their TRIGGER_ACTION instructions are given, as a JSON array.
+	SectionWebhooks
+	// SectionActionDelays holds the delays of the actions rules schedule for
+	// later, as a JSON array.
+	SectionActionDelays
+	// SectionFactReaders holds the rules reading each fact or fact pattern,
+	// by their position in the code, as a JSON object.
+	SectionFactReaders
+	// SectionRuleDirectory holds where each rule starts in the code, with
+	// its name, priority, length and the facts it reads, as a JSON array.
+	SectionRuleDirectory
+	// SectionCompiledCode marks an image whose code is in the encoding the
+	// compiler writes, which the runtime converts to the one it executes when
+	// loading the image. It has no data.
+	SectionCompiledCode
+)
+
+// Section flags.
+const (
+	SectionGzip byte = 1 << iota // Data is gzip compressed
+)
+
+// sectionMagic marks the end of a bytecode image that carries sections.
+var sectionMagic = []byte("RXSC")
+
+// Sections are stored after the program code, so that images without
+// sections are plain programs:
+//
+//	code | section... | code length (uint32) | "RXSC"
+//
+// where each section is its ID (1 byte), flags (1 byte), data length (uint32)
+// and data. Integers are little-endian.
+const (
+	sectionHeaderSize = 6
+	sectionFooterSize = 8
+)
+
+// Section is an auxiliary block of data stored in a bytecode image.
+type Section struct {
+	ID    SectionID
+	Flags byte
+	Data  []byte // Stored data, compressed if Flags has SectionGzip
+}
+
+// NewSourceSection returns a section embedding the ruleset source, optionally
+// gzip compressed.
+func NewSourceSection(source []byte, compress bool) (Section, error) {
+	if !compress {
+		return Section{ID: SectionSource, Data: source}, nil
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(source); err != nil {
+		return Section{}, err
+	}
+	if err := writer.Close(); err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionSource, Flags: SectionGzip, Data: buf.Bytes()}, nil
+}
+
+// Contents returns the section data, decompressing it if needed.
+func (s Section) Contents() ([]byte, error) {
+	if s.Flags&SectionGzip == 0 {
+		return s.Data, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(s.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// AppendSections returns the image of code followed by the given sections.
+// code must not already carry sections.
+func AppendSections(code []byte, sections ...Section) []byte {
+	if len(sections) == 0 {
+		return code
+	}
+
+	image := append([]byte{}, code...)
+	for _, section := range sections {
+		image = append(image, byte(section.ID), section.Flags)
+		image = binary.LittleEndian.AppendUint32(image, uint32(len(section.Data)))
+		image = append(image, section.Data...)
+	}
+	image = binary.LittleEndian.AppendUint32(image, uint32(len(code)))
+	return append(image, sectionMagic...)
+}
+
+// SplitSections separates a bytecode image into its program code and sections.
+// Images without sections are returned unchanged.
+func SplitSections(image []byte) ([]byte, []Section, error) {
+	if len(image) < sectionFooterSize || !bytes.Equal(image[len(image)-len(sectionMagic):], sectionMagic) {
+		return image, nil, nil
+	}
+
+	footer := len(image) - sectionFooterSize
+	codeLength := int(binary.LittleEndian.Uint32(image[footer:]))
+	if codeLength > footer {
+		return nil, nil, fmt.Errorf("invalid bytecode sections: code length %d exceeds image size", codeLength)
+	}
+
+	var sections []Section
+	for offset := codeLength; offset < footer; {
+		if offset+sectionHeaderSize > footer {
+			return nil, nil, fmt.Errorf("invalid bytecode sections: truncated section header at offset %d", offset)
+		}
+		length := int(binary.LittleEndian.Uint32(image[offset+2:]))
+		start := offset + sectionHeaderSize
+		if start+length > footer {
+			return nil, nil, fmt.Errorf("invalid bytecode sections: section at offset %d overruns the image", offset)
+		}
+		sections = append(sections, Section{
+			ID:    SectionID(image[offset]),
+			Flags: image[offset+1],
+			Data:  image[start : start+length],
+		})
+		offset = start + length
+	}
+	return image[:codeLength], sections, nil
+}
+
+// NewCompiledCodeSection returns the section marking code in the encoding
+// the compiler writes.
+func NewCompiledCodeSection() Section {
+	return Section{ID: SectionCompiledCode}
+}
+
+// IsCompiledCode reports whether sections mark their code as being in the
+// encoding the compiler writes.
+func IsCompiledCode(sections []Section) bool {
+	_, ok := FindSection(sections, SectionCompiledCode)
+	return ok
+}
+
+// FindSection returns the first section with the given ID.
+func FindSection(sections []Section, id SectionID) (Section, bool) {
+	for _, section := range sections {
+		if section.ID == id {
+			return section, true
+		}
+	}
+	return Section{}, false
+}
@@ -0,0 +1,240 @@
+package bytecode
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSections_RoundTrip(t *testing.T) {
+	code := []byte{byte(RULE_START), 0, 0, 0, 0, byte(RULE_END)}
+	source := []byte(`[{"name": "coolDown"}]`)
+
+	for _, compress := range []bool{false, true} {
+		section, err := NewSourceSection(source, compress)
+		require.NoError(t, err)
+		image := AppendSections(code, section)
+
+		gotCode, sections, err := SplitSections(image)
+		require.NoError(t, err)
+		assert.Equal(t, code, gotCode)
+
+		found, ok := FindSection(sections, SectionSource)
+		require.True(t, ok)
+		assert.Equal(t, compress, found.Flags&SectionGzip != 0)
+		contents, err := found.Contents()
+		require.NoError(t, err)
+		assert.Equal(t, source, contents)
+	}
+}
+
+func TestSections_PlainImage(t *testing.T) {
+	code := []byte{byte(RULE_START), 0, 0, 0, 0, byte(RULE_END)}
+
+	gotCode, sections, err := SplitSections(code)
+	require.NoError(t, err)
+	assert.Equal(t, code, gotCode)
+	assert.Empty(t, sections)
+	assert.Equal(t, code, AppendSections(code))
+}
+
+func TestSections_Corrupt(t *testing.T) {
+	section, err := NewSourceSection([]byte("source"), false)
+	require.NoError(t, err)
+	image := AppendSections([]byte{byte(RULE_END)}, section)
+
+	// Claim a longer section than the image holds
+	image[3] = 200
+	_, _, err = SplitSections(image)
+	assert.Error(t, err)
+}
+
+func TestSections_Schema(t *testing.T) {
+	schema := FactSchema{"temperature": "int", "sensor.*.ok": "bool"}
+	section, err := NewSchemaSection(schema)
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(RULE_END)}, section))
+	require.NoError(t, err)
+
+	read, ok, err := ReadSchema(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, schema, read)
+
+	_, ok, err = ReadSchema(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, _, err = ReadSchema([]Section{{ID: SectionSchema, Data: []byte("[")}})
+	assert.ErrorContains(t, err, "invalid schema section")
+}
+
+func TestSections_Provenance(t *testing.T) {
+	provenance := Provenance{RulesetHash: "9f86d081884c7d65", CompilerVersion: "v1.2.0", CompiledAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	section, err := NewProvenanceSection(provenance)
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(RULE_END)}, section))
+	require.NoError(t, err)
+
+	read, ok, err := ReadProvenance(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, provenance, read)
+	assert.Equal(t, "9f86d081884c", read.ShortHash())
+
+	_, ok, err = ReadProvenance(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestHashRuleset(t *testing.T) {
+	hash, err := HashRuleset([]byte(`{"rules": [{"name": "coolDown", "priority": 1}]}`))
+	require.NoError(t, err)
+	assert.Len(t, hash, 64)
+
+	// Formatting and key order don't change the hash
+	reformatted, err := HashRuleset([]byte("{\n  \"rules\": [\n    {\"priority\": 1, \"name\": \"coolDown\"}\n  ]\n}\n"))
+	require.NoError(t, err)
+	assert.Equal(t, hash, reformatted)
+
+	changed, err := HashRuleset([]byte(`{"rules": [{"name": "coolDown", "priority": 2}]}`))
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, changed)
+
+	_, err = HashRuleset([]byte("{"))
+	assert.Error(t, err)
+	assert.NotEmpty(t, CompilerVersion())
+}
+
+func TestSections_FactTable(t *testing.T) {
+	table := NewFactTable(map[string]int{"temperature": 0, "fan": 2})
+	assert.Equal(t, FactTable{"temperature", "", "fan"}, table)
+	assert.Equal(t, "fan", table.Name(2))
+	assert.Empty(t, table.Name(3))
+
+	section, err := NewFactTableSection(table)
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(RULE_END)}, section))
+	require.NoError(t, err)
+	read, ok, err := ReadFactTable(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, table, read)
+
+	_, ok, err = ReadFactTable(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSections_InitialFacts(t *testing.T) {
+	section, err := NewInitialFactsSection(map[string]interface{}{"door.state": "closed"})
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(RULE_END)}, section))
+	require.NoError(t, err)
+	read, ok, err := ReadInitialFacts(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"door.state": "closed"}, read)
+
+	_, ok, err = ReadInitialFacts(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSections_ReadOnlyFacts(t *testing.T) {
+	section, err := NewReadOnlyFactsSection([]string{"temperature", "sensor.*.humidity"})
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(RULE_END)}, section))
+	require.NoError(t, err)
+	read, ok, err := ReadReadOnlyFacts(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []string{"temperature", "sensor.*.humidity"}, read)
+
+	_, ok, err = ReadReadOnlyFacts(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSections_Messages(t *testing.T) {
+	section, err := NewMessagesSection([]string{"unsupported comparison operator 'greaterThan' for type 'bool'"})
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(HALT)}, section))
+	require.NoError(t, err)
+	read, ok, err := ReadMessages(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []string{"unsupported comparison operator 'greaterThan' for type 'bool'"}, read)
+
+	_, ok, err = ReadMessages(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSections_Rules(t *testing.T) {
+	symbols := []RuleSymbol{
+		{Name: "cooling", Merged: []string{"fan"}, Metadata: map[string]interface{}{"owner": "facilities"}},
+		{Name: "heating"},
+	}
+	section, err := NewRulesSection(symbols)
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(HALT)}, section))
+	require.NoError(t, err)
+	read, ok, err := ReadRules(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, symbols, read)
+
+	_, ok, err = ReadRules(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSections_FactReaders(t *testing.T) {
+	readers := FactReaders{"temperature": {0, 2}, "humidity": {1}, "zone.*.temperature": {3}}
+	section, err := NewFactReadersSection(readers)
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(HALT)}, section))
+	require.NoError(t, err)
+	read, ok, err := ReadFactReaders(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, readers, read)
+
+	assert.Equal(t, []int{0, 1, 2}, read.Rules([]string{"humidity", "temperature"}))
+	assert.Equal(t, []int{3}, read.Rules([]string{"zone.north.temperature"}))
+	assert.Empty(t, read.Rules([]string{"pressure"}))
+
+	_, ok, err = ReadFactReaders(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSections_RuleDirectory(t *testing.T) {
+	directory := RuleDirectory{
+		{Name: "cooling", Priority: 10, Offset: 0, Length: 12, Facts: []int{0, 2}},
+		{Name: "heating", Offset: 12, Length: 8, Facts: []int{}},
+	}
+	section, err := NewRuleDirectorySection(directory)
+	require.NoError(t, err)
+	_, sections, err := SplitSections(AppendSections([]byte{byte(HALT)}, section))
+	require.NoError(t, err)
+	read, ok, err := ReadRuleDirectory(sections)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, directory, read)
+
+	relocated, err := directory.Relocate(map[int]int{0: 4, 12: 20, 20: 30})
+	require.NoError(t, err)
+	assert.Equal(t, RuleDirectory{
+		{Name: "cooling", Priority: 10, Offset: 4, Length: 16, Facts: []int{0, 2}},
+		{Name: "heating", Offset: 20, Length: 10, Facts: []int{}},
+	}, relocated)
+	_, err = directory.Relocate(map[int]int{0: 4, 12: 20})
+	assert.EqualError(t, err, "rule 'heating' doesn't start and end at instructions of the code")
+
+	_, ok, err = ReadRuleDirectory(nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
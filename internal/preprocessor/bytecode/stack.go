@@ -0,0 +1,132 @@
+// preprocessor/bytecode/stack.go
+
+package bytecode
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DefaultMaxStackDepth is the deepest the compiler lets the stack of a rule
+// grow when Options.MaxStackDepth isn't set.
+const DefaultMaxStackDepth = 256
+
+// StackError reports an instruction that would misuse the VM stack.
+type StackError struct {
+	Offset  int // Offset of the instruction in the bytecode
+	Message string
+}
+
+func (e *StackError) Error() string {
+	return fmt.Sprintf("at offset %d: %s", e.Offset, e.Message)
+}
+
+// CheckStack simulates the stack depth along every path through compiled
+// bytecode and returns a *StackError for the first instruction that would pop
+// more values than the stack holds, push it beyond maxDepth, or reach a point
+// where paths disagree on the depth. Every rule must also leave the stack
+// empty. Jumps only go forward, so a single pass visits every instruction
+// after all the jumps leading to it. HALT and ERROR end the path they are on,
+// and each RULE_START begins a path with an empty stack.
+func CheckStack(code []byte, maxDepth int) error {
+	// Stack depth on entry to each instruction reached by a jump
+	jumpDepths := make(map[int]int)
+	depth, reachable := 0, true
+	pendingPops := 0 // UPDATE_FACT pops the value that follows it
+
+	for ip := 0; ip < len(code); {
+		opcode := Opcode(code[ip])
+		_, n, err := disassembleOperands(opcode, code, ip+1, nil)
+		if err != nil {
+			return &StackError{Offset: ip, Message: err.Error()}
+		}
+
+		if opcode == RULE_START {
+			// The VM enters every rule at its start with an empty stack
+			depth, reachable = 0, true
+		}
+		if jumpDepth, ok := jumpDepths[ip]; ok {
+			if reachable && jumpDepth != depth {
+				return &StackError{Offset: ip, Message: fmt.Sprintf("reached with stack depths %d and %d", depth, jumpDepth)}
+			}
+			depth, reachable = jumpDepth, true
+		}
+		if !reachable {
+			ip += 1 + n
+			continue
+		}
+
+		pops, pushes := stackUse(opcode)
+		if depth < pops {
+			return &StackError{Offset: ip, Message: fmt.Sprintf("%s pops %d values from a stack of %d", opcode, pops, depth)}
+		}
+		depth += pushes - pops
+		if depth > maxDepth {
+			return &StackError{Offset: ip, Message: fmt.Sprintf("%s grows the stack to %d, limit is %d", opcode, depth, maxDepth)}
+		}
+
+		if opcode == UPDATE_FACT {
+			pendingPops++
+		} else if pendingPops > 0 {
+			if depth < pendingPops {
+				return &StackError{Offset: ip, Message: fmt.Sprintf("UPDATE_FACT has no value to store after %s", opcode)}
+			}
+			depth -= pendingPops
+			pendingPops = 0
+		}
+
+		switch opcode {
+		case JUMP, JUMP_IF_TRUE, JUMP_IF_FALSE:
+			target := ip + 2 + int(binary.LittleEndian.Uint16(code[ip+1:]))
+			if target > len(code) {
+				return &StackError{Offset: ip, Message: fmt.Sprintf("jump past the end of the code to %d", target)}
+			}
+			if jumpDepth, ok := jumpDepths[target]; ok && jumpDepth != depth {
+				return &StackError{Offset: ip, Message: fmt.Sprintf("jumps to %d with stack depth %d, another path has %d", target, depth, jumpDepth)}
+			}
+			jumpDepths[target] = depth
+			if opcode == JUMP {
+				reachable = false
+			}
+
+		case HALT, ERROR:
+			// Execution doesn't go past them
+			reachable = false
+
+		case RULE_END:
+			if depth != 0 {
+				return &StackError{Offset: ip, Message: fmt.Sprintf("rule ends with %d values left on the stack", depth)}
+			}
+		}
+		ip += 1 + n
+	}
+
+	if jumpDepth, ok := jumpDepths[len(code)]; ok {
+		depth, reachable = jumpDepth, true
+	}
+	if reachable && depth != 0 {
+		return &StackError{Offset: len(code), Message: fmt.Sprintf("code ends with %d values left on the stack", depth)}
+	}
+	return nil
+}
+
+// stackUse returns the number of values an instruction pops from the stack
+// and the number it pushes. UPDATE_FACT pops the value of the instruction
+// that follows it, which CheckStack and EstimateCost account for separately.
+func stackUse(opcode Opcode) (pops, pushes int) {
+	switch opcode {
+	case LOAD_FACT, FACT_EXISTS, LOAD_VAR, LOAD_CONST_INT, LOAD_CONST_INT64, LOAD_CONST_UINT64,
+		LOAD_CONST_FLOAT, LOAD_CONST_STRING, LOAD_CONST_BOOL, CALL_SCRIPT, LOAD_CONST_INT16, LOAD_CONST_FLOAT32:
+		return 0, 1
+	case EQ_INT, NEQ_INT, LT_INT, LTE_INT, GT_INT, GTE_INT,
+		EQ_FLOAT, NEQ_FLOAT, LT_FLOAT, LTE_FLOAT, GT_FLOAT, GTE_FLOAT,
+		EQ_STRING, NEQ_STRING, EQ_BOOL, NEQ_BOOL, CONTAINS_STRING, NOT_CONTAINS_STRING, EQ_FLOAT_EPSILON, NEQ_FLOAT_EPSILON, CALL_OPERATOR, AND, OR, ADD_FLOAT:
+		return 2, 1
+	case NOT, MATCH_FACTS, STORE_VAR, STORE_FACT, IN_LIST, NOT_IN_LIST:
+		return 1, 1
+	case JUMP_IF_TRUE, JUMP_IF_FALSE, TRIGGER_ACTION:
+		return 1, 0
+	default:
+		return 0, 0
+	}
+}
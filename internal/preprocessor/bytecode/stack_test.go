@@ -0,0 +1,105 @@
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckStack(t *testing.T) {
+	ruleStart := []byte{byte(RULE_START), 0, 0, 0, 0}
+	loadTrue := []byte{byte(LOAD_CONST_BOOL), 1}
+	code := func(parts ...[]byte) []byte {
+		var result []byte
+		for _, part := range parts {
+			result = append(result, part...)
+		}
+		return result
+	}
+
+	testCases := []struct {
+		name    string
+		code    []byte
+		wantErr string
+	}{
+		{
+			name: "balanced",
+			code: code(ruleStart, loadTrue, []byte{byte(JUMP_IF_FALSE), 4, 0, byte(UPDATE_FACT), 0}, loadTrue, []byte{byte(RULE_END)}),
+		},
+		{
+			name:    "underflow",
+			code:    code(ruleStart, []byte{byte(LOAD_FACT), 0, byte(GT_INT), byte(RULE_END)}),
+			wantErr: "at offset 7: GT_INT pops 2 values from a stack of 1",
+		},
+		{
+			name:    "overflow",
+			code:    code(ruleStart, loadTrue, loadTrue, loadTrue, []byte{byte(AND), byte(AND), byte(RULE_END)}),
+			wantErr: "at offset 9: LOAD_CONST_BOOL grows the stack to 3, limit is 2",
+		},
+		{
+			name:    "inconsistent join",
+			code:    code(ruleStart, loadTrue, loadTrue, []byte{byte(JUMP_IF_TRUE), 3, 0}, loadTrue, []byte{byte(AND), byte(RULE_END)}),
+			wantErr: "at offset 14: reached with stack depths 2 and 1",
+		},
+		{
+			name:    "values left",
+			code:    code(ruleStart, loadTrue, []byte{byte(RULE_END)}),
+			wantErr: "at offset 7: rule ends with 1 values left on the stack",
+		},
+		{
+			name:    "error ends the path",
+			code:    code(ruleStart, loadTrue, []byte{byte(ERROR), 0, 0, byte(RULE_END)}, ruleStart, loadTrue, []byte{byte(RULE_END)}),
+			wantErr: "at offset 18: rule ends with 1 values left on the stack",
+		},
+		{
+			name:    "update without value",
+			code:    code(ruleStart, []byte{byte(UPDATE_FACT), 0, byte(RULE_END)}),
+			wantErr: "UPDATE_FACT has no value to store after RULE_END",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckStack(tc.code, 2)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var stackErr *StackError
+			require.ErrorAs(t, err, &stackErr)
+			assert.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestCompileRejectsDeepStack(t *testing.T) {
+	ruleset := []*rules.Rule{
+		{
+			Name: "Comfortable",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{
+					{Fact: "temperature", Operator: "greaterThan", Value: 10, ValueType: "int"},
+					{Fact: "humidity", Operator: "lessThan", Value: 60, ValueType: "int"},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan_status", Value: true}}},
+		},
+	}
+	context := rules.NewRuleEngineContext()
+	for _, fact := range []string{"temperature", "humidity", "fan_status"} {
+		context.FactIndex[fact] = len(context.FactIndex)
+	}
+
+	// Boolean mode keeps the first comparison on the stack while evaluating
+	// the second
+	_, err := NewCompilerWithOptions(context, Options{ConditionMode: ConditionModeBoolean, MaxStackDepth: 2}).Compile(ruleset)
+	var stackErr *StackError
+	require.ErrorAs(t, err, &stackErr)
+	assert.ErrorContains(t, err, "rule 'Comfortable': ")
+	assert.ErrorContains(t, err, "grows the stack to 3, limit is 2")
+
+	_, err = NewCompilerWithOptions(context, Options{ConditionMode: ConditionModeJump, MaxStackDepth: 2}).Compile(ruleset)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,44 @@
+// preprocessor/bytecode/symbols.go
+
+package bytecode
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RuleSymbol describes a compiled rule, so that a runtime can tell its rules
+// apart without the ruleset they were compiled from.
+type RuleSymbol struct {
+	Name     string                 `json:"name"`
+	Merged   []string               `json:"merged,omitempty"`   // Rules the optimizer merged into this one
+	Metadata map[string]interface{} `json:"metadata,omitempty"` // Fields of the rule the engine doesn't interpret, such as a description or an owner
+}
+
+// NewRulesSection returns a section embedding the symbols of the compiled
+// rules, by their position in the code.
+func NewRulesSection(symbols []RuleSymbol) (Section, error) {
+	data, err := json.Marshal(symbols)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionRules, Data: data}, nil
+}
+
+// ReadRules returns the symbols of the compiled rules embedded in a bytecode
+// image's sections, by their position in the code.
+func ReadRules(sections []Section) ([]RuleSymbol, bool, error) {
+	section, ok := FindSection(sections, SectionRules)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var symbols []RuleSymbol
+	if err := json.Unmarshal(data, &symbols); err != nil {
+		return nil, false, fmt.Errorf("invalid rules section: %w", err)
+	}
+	return symbols, true, nil
+}
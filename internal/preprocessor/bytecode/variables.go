@@ -0,0 +1,93 @@
+// preprocessor/bytecode/variables.go
+
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MaxVariables is the number of local variable slots a rule can use.
+const MaxVariables = 256
+
+// ruleVariables tracks the local variables of the rule being compiled. A fact
+// the rule's conditions load more than once is stored in a variable the first
+// time it is loaded, and later loads read the variable instead of looking the
+// fact up again.
+type ruleVariables struct {
+	reused   map[string]bool // Facts loaded more than once by the rule
+	slots    map[string]byte // Variable slot holding each stored fact
+	endLabel string          // Label of the end of the rule
+
+	// unconditional is set while every instruction emitted so far in the rule
+	// is executed whenever the rule is evaluated past that point. Only loads
+	// emitted then are stored, since a store that a jump can skip would leave
+	// later loads reading an unset variable.
+	unconditional bool
+}
+
+// beginRuleVariables finds the facts a rule's conditions load more than once.
+func (c *Compiler) beginRuleVariables(rule *rules.Rule, endLabel string) {
+	counts := make(map[string]int)
+	countFactLoads(rule.Conditions.All, counts)
+	countFactLoads(rule.Conditions.Any, counts)
+	countFactLoads(rule.Conditions.Not, counts)
+
+	c.variables = ruleVariables{
+		reused:        make(map[string]bool),
+		slots:         make(map[string]byte),
+		endLabel:      endLabel,
+		unconditional: true,
+	}
+	for fact, count := range counts {
+		if count > 1 {
+			c.variables.reused[fact] = true
+		}
+	}
+}
+
+// countFactLoads counts the conditions that load each fact. Existence
+// conditions don't load their fact.
+func countFactLoads(conditions []rules.Condition, counts map[string]int) {
+	for i := range conditions {
+		condition := &conditions[i]
+		if condition.IsBlock() {
+			countFactLoads(condition.All, counts)
+			countFactLoads(condition.Any, counts)
+			countFactLoads(condition.Not, counts)
+		} else if condition.Script == "" && !rules.IsFactPattern(condition.Fact) && !rules.IsExistenceOperator(condition.Operator) {
+			counts[condition.Fact]++
+		}
+	}
+}
+
+// emitLoadFact pushes the value of a fact, reading it from a local variable
+// if the rule has already stored it in one.
+func (c *Compiler) emitLoadFact(factName string, factIndex int) {
+	if slot, ok := c.variables.slots[factName]; ok {
+		c.emitInstruction(LOAD_VAR, slot)
+		return
+	}
+
+	c.emitInstruction(LOAD_FACT, byte(factIndex))
+	c.recordRead(factName)
+	if c.variables.reused[factName] && c.variables.unconditional && len(c.variables.slots) < MaxVariables {
+		slot := byte(len(c.variables.slots))
+		c.variables.slots[factName] = slot
+		c.emitInstruction(STORE_VAR, slot)
+
+		log.Debug().
+			Str("Fact", factName).
+			Int("Slot", int(slot)).
+			Msg("Stored reused fact in a local variable")
+	}
+}
+
+// noteJump records that a jump was emitted. Jumps out of the rule don't make
+// the instructions that follow them conditional.
+func (c *Compiler) noteJump(label string) {
+	if label != c.variables.endLabel {
+		c.variables.unconditional = false
+	}
+}
@@ -0,0 +1,102 @@
+package bytecode
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compileOpcodes(t *testing.T, ruleset []*rules.Rule, options Options) []Instruction {
+	t.Helper()
+	context := rules.NewRuleEngineContext()
+	for _, fact := range []string{"temperature", "humidity", "mode", "fan_status"} {
+		context.FactIndex[fact] = len(context.FactIndex)
+	}
+	compiler := NewCompilerWithOptions(context, options)
+	_, err := compiler.Compile(ruleset)
+	require.NoError(t, err)
+	return compiler.instructions
+}
+
+func loads(instructions []Instruction) []string {
+	var result []string
+	for _, instruction := range instructions {
+		switch instruction.Opcode {
+		case LOAD_FACT, LOAD_VAR, STORE_VAR:
+			result = append(result, instruction.Opcode.String())
+		}
+	}
+	return result
+}
+
+func TestCompileReusedFactUsesVariable(t *testing.T) {
+	ruleset := []*rules.Rule{{
+		Name: "Comfortable",
+		Conditions: rules.Conditions{
+			All: []rules.Condition{
+				{Fact: "temperature", Operator: "greaterThan", Value: 10, ValueType: "int"},
+				{Fact: "humidity", Operator: "lessThan", Value: 60, ValueType: "int"},
+				{Fact: "temperature", Operator: "lessThan", Value: 30, ValueType: "int"},
+			},
+			Any: []rules.Condition{
+				{Fact: "mode", Operator: "equal", Value: "eco", ValueType: "string"},
+				{Fact: "temperature", Operator: "equal", Value: 20, ValueType: "int"},
+			},
+		},
+		Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan_status", Value: true}}},
+	}}
+
+	for name, mode := range map[string]ConditionMode{"jump": ConditionModeJump, "boolean": ConditionModeBoolean} {
+		instructions := compileOpcodes(t, ruleset, Options{ConditionMode: mode})
+		assert.Equal(t,
+			[]string{"LOAD_FACT", "STORE_VAR", "LOAD_FACT", "LOAD_VAR", "LOAD_FACT", "LOAD_VAR"},
+			loads(instructions), "%s mode", name)
+	}
+}
+
+func TestCompileConditionalLoadIsNotStored(t *testing.T) {
+	// The second and third conditions are skipped when the first holds, so
+	// humidity is loaded from the fact store both times
+	ruleset := []*rules.Rule{{
+		Name: "Ventilate",
+		Conditions: rules.Conditions{
+			Any: []rules.Condition{
+				{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"},
+				{Fact: "humidity", Operator: "greaterThan", Value: 80, ValueType: "int"},
+				{Fact: "humidity", Operator: "lessThan", Value: 10, ValueType: "int"},
+			},
+		},
+		Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan_status", Value: true}}},
+	}}
+
+	instructions := compileOpcodes(t, ruleset, Options{})
+	assert.Equal(t, []string{"LOAD_FACT", "LOAD_FACT", "LOAD_FACT"}, loads(instructions))
+}
+
+func TestCompileVariablesAreAllocatedPerRule(t *testing.T) {
+	rule := func(name string) *rules.Rule {
+		return &rules.Rule{
+			Name: name,
+			Conditions: rules.Conditions{
+				All: []rules.Condition{
+					{Fact: "temperature", Operator: "greaterThan", Value: 10, ValueType: "int"},
+					{Fact: "temperature", Operator: "lessThan", Value: 30, ValueType: "int"},
+				},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan_status", Value: true}}},
+		}
+	}
+
+	instructions := compileOpcodes(t, []*rules.Rule{rule("First"), rule("Second")}, Options{})
+	var slots []byte
+	for _, instruction := range instructions {
+		if instruction.Opcode == STORE_VAR || instruction.Opcode == LOAD_VAR {
+			slots = append(slots, instruction.Operands[0])
+		}
+	}
+	// Each rule stores the fact again rather than reading the other rule's variable
+	assert.Equal(t, []string{"LOAD_FACT", "STORE_VAR", "LOAD_VAR", "LOAD_FACT", "STORE_VAR", "LOAD_VAR"}, loads(instructions))
+	assert.Equal(t, []byte{0, 0, 0, 0}, slots)
+}
@@ -0,0 +1,90 @@
+// preprocessor/bytecode/webhooks.go
+
+package bytecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"rgehrsitz/rex/internal/rules"
+	"time"
+)
+
+// Webhook is the compiled request of a webhook action. The body template is
+// split into its text and the facts it references, which the runtime renders
+// with the facts of the cycle triggering the action.
+type Webhook struct {
+	Method        string               `json:"method"`
+	Headers       map[string]string    `json:"headers,omitempty"`
+	Body          []rules.TemplatePart `json:"body,omitempty"`
+	TimeoutMillis int64                `json:"timeoutMillis,omitempty"` // Time each attempt may take; 0 leaves it to the action guard
+	Retries       int                  `json:"retries,omitempty"`
+}
+
+// emitWebhook records the request of a webhook action and emits a
+// TRIGGER_ACTION naming its target URL, with the index of the request as the
+// action's value.
+func (c *Compiler) emitWebhook(action rules.Action) error {
+	request := action.Webhook
+	if request == nil {
+		request = &rules.WebhookRequest{}
+	}
+	webhook := Webhook{Method: request.Method, Headers: request.Headers, Retries: request.Retries}
+	if webhook.Method == "" {
+		webhook.Method = http.MethodPost
+	}
+	body, err := rules.ParseTemplate(request.Body)
+	if err != nil {
+		return fmt.Errorf("webhook action to '%s': %w", action.Target, err)
+	}
+	webhook.Body = body
+	if request.Timeout != "" {
+		timeout, err := time.ParseDuration(request.Timeout)
+		if err != nil {
+			return fmt.Errorf("webhook action to '%s': invalid timeout: %w", action.Target, err)
+		}
+		webhook.TimeoutMillis = timeout.Milliseconds()
+	}
+	if len(c.webhooks) > math.MaxInt32 {
+		return fmt.Errorf("more than %d webhook actions", math.MaxInt32)
+	}
+
+	c.emitLoadConstantInstruction(len(c.webhooks), "int")
+	c.webhooks = append(c.webhooks, webhook)
+	return c.emitTriggerInstruction(action)
+}
+
+// Webhooks returns the requests of the webhook actions of the compiled code,
+// by index. Hosts embed them with NewWebhooksSection.
+func (c *Compiler) Webhooks() []Webhook {
+	return c.webhooks
+}
+
+// NewWebhooksSection returns a section embedding the requests of webhook
+// actions.
+func NewWebhooksSection(webhooks []Webhook) (Section, error) {
+	data, err := json.Marshal(webhooks)
+	if err != nil {
+		return Section{}, err
+	}
+	return Section{ID: SectionWebhooks, Data: data}, nil
+}
+
+// ReadWebhooks returns the requests of webhook actions embedded in a bytecode
+// image's sections.
+func ReadWebhooks(sections []Section) ([]Webhook, bool, error) {
+	section, ok := FindSection(sections, SectionWebhooks)
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	var webhooks []Webhook
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, false, fmt.Errorf("invalid webhooks section: %w", err)
+	}
+	return webhooks, true, nil
+}
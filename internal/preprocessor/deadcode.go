@@ -0,0 +1,248 @@
+// pkg/preprocessor/deadcode.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+)
+
+// Elimination is a rule, or a block or condition of a rule, that
+// EliminateDeadCode removed.
+type Elimination struct {
+	Rule   string `json:"rule"`
+	Path   string `json:"path,omitempty"` // Block or condition removed, e.g. conditions.any; empty when the whole rule was
+	Fact   string `json:"fact,omitempty"` // Fact whose conditions or absence made it dead
+	Reason string `json:"reason"`
+}
+
+func (e Elimination) String() string {
+	if e.Path == "" {
+		return fmt.Sprintf("removed rule '%s': %s", e.Rule, e.Reason)
+	}
+	return fmt.Sprintf("removed %s of rule '%s': %s", e.Path, e.Rule, e.Reason)
+}
+
+// verdict is what is known about a block of conditions before evaluation.
+type verdict int
+
+const (
+	verdictUnknown verdict = iota
+	verdictAlways
+	verdictNever
+)
+
+// EliminateDeadCode returns a ruleset without the rules that can never fire
+// and without the conditions that don't affect whether a rule fires, along
+// with everything it removed. The blocks of conditions FindVacuousConditions
+// finds go first: an any or not block that always holds is removed, as is an
+// alternative of an any block that never holds, and a rule whose all block
+// never holds is removed. Then rules are removed whose all conditions
+// compare a fact that no other remaining rule writes and that isn't provided
+// by the host, listed in inputs or set initially. Removing a rule can leave
+// others without a fact they need, so this repeats until nothing changes.
+// Scoring rules are left as they are. The rules passed are left as is.
+func EliminateDeadCode(ruleSet []*rules.Rule, context *rules.RuleEngineContext, inputs []string) ([]*rules.Rule, []Elimination) {
+	var eliminations []Elimination
+	var live []*rules.Rule
+	for _, rule := range CloneRules(ruleSet) {
+		if rule.Scored() {
+			live = append(live, rule)
+			continue
+		}
+		p := pruner{rule: rule.Name}
+		conditions := &rule.Conditions
+		if v, fact, reason := p.group("conditions", &conditions.All, &conditions.Any, &conditions.Not); v == verdictNever {
+			eliminations = append(eliminations, Elimination{Rule: rule.Name, Fact: fact, Reason: reason})
+			continue
+		}
+		eliminations = append(eliminations, p.eliminations...)
+		live = append(live, rule)
+	}
+
+	provided := make(map[string]bool)
+	for _, fact := range inputs {
+		provided[fact] = true
+	}
+	for fact := range context.InitialFacts {
+		provided[fact] = true
+	}
+	for _, fact := range context.ReadOnlyFacts {
+		provided[fact] = true
+	}
+	for {
+		available := make(map[string]bool, len(provided))
+		for fact := range provided {
+			available[fact] = true
+		}
+		for _, rule := range live {
+			updateProducedFacts(rule, &rules.RuleEngineContext{ProducedFacts: available})
+		}
+
+		var kept []*rules.Rule
+		for _, rule := range live {
+			if fact, ok := missingFact(rule.Conditions.All, available); ok && !rule.Scored() {
+				eliminations = append(eliminations, Elimination{
+					Rule:   rule.Name,
+					Fact:   fact,
+					Reason: fmt.Sprintf("it compares '%s', which no rule writes and the host doesn't provide", fact),
+				})
+				continue
+			}
+			kept = append(kept, rule)
+		}
+		if len(kept) == len(live) {
+			return kept, eliminations
+		}
+		live = kept
+	}
+}
+
+// missingFact returns a fact that conditions which must all hold compare,
+// directly or in nested all blocks, and that isn't available. Fact patterns
+// and the facts of exists and notExists conditions, which may be unset, are
+// left out.
+func missingFact(all []rules.Condition, available map[string]bool) (string, bool) {
+	for _, condition := range all {
+		if condition.Fact == "" {
+			if fact, ok := missingFact(condition.All, available); ok {
+				return fact, true
+			}
+			continue
+		}
+		if rules.IsFactPattern(condition.Fact) || condition.Operator == rules.OperatorExists || condition.Operator == rules.OperatorNotExists {
+			continue
+		}
+		if !factIn(condition.Fact, available) {
+			return condition.Fact, true
+		}
+	}
+	return "", false
+}
+
+// pruner removes the blocks and conditions of a rule that always or never
+// hold, recording what it removed.
+type pruner struct {
+	rule         string
+	eliminations []Elimination
+}
+
+func (p *pruner) remove(path, fact, reason string) {
+	p.eliminations = append(p.eliminations, Elimination{Rule: p.rule, Path: path, Fact: fact, Reason: reason})
+}
+
+// group prunes the all, any and not blocks of a group of conditions at path,
+// and reports whether the group always or never holds as a result, with the
+// fact and reason when it never does. A group whose blocks were all removed
+// always holds.
+func (p *pruner) group(path string, all, any, not *[]rules.Condition) (verdict, string, string) {
+	if len(*all) == 0 && len(*any) == 0 && len(*not) == 0 {
+		return verdictUnknown, "", ""
+	}
+
+	if len(*all) > 0 {
+		blockPath := path + ".all"
+		if fact, ok := vacuousFact(*all, false); ok {
+			return verdictNever, fact, fmt.Sprintf("%s never holds: no value of '%s' satisfies its conditions", blockPath, fact)
+		}
+		var kept []rules.Condition
+		for i, condition := range *all {
+			if condition.Fact == "" {
+				v, fact, reason := p.nested(fmt.Sprintf("%s[%d]", blockPath, i), &condition)
+				if v == verdictNever {
+					return verdictNever, fact, reason
+				}
+				if v == verdictAlways {
+					continue
+				}
+			}
+			kept = append(kept, condition)
+		}
+		*all = kept
+	}
+
+	if len(*any) > 0 {
+		blockPath := path + ".any"
+		always := false
+		if fact, ok := vacuousFact(*any, true); ok {
+			p.remove(blockPath, fact, fmt.Sprintf("it always holds: its conditions on '%s' cover every value", fact))
+			always = true
+		}
+		var kept []rules.Condition
+		for i, condition := range *any {
+			if always {
+				break
+			}
+			if condition.Fact == "" {
+				conditionPath := fmt.Sprintf("%s[%d]", blockPath, i)
+				v, fact, reason := p.nested(conditionPath, &condition)
+				if v == verdictAlways {
+					p.remove(blockPath, "", fmt.Sprintf("it always holds: %s does", conditionPath))
+					always = true
+					continue
+				}
+				if v == verdictNever {
+					p.remove(conditionPath, fact, reason)
+					continue
+				}
+			}
+			kept = append(kept, condition)
+		}
+		if always {
+			kept = nil
+		} else if len(kept) == 0 {
+			return verdictNever, "", fmt.Sprintf("%s never holds: none of its conditions can", blockPath)
+		}
+		*any = kept
+	}
+
+	if len(*not) > 0 {
+		blockPath := path + ".not"
+		always := false
+		if fact, ok := vacuousFact(*not, false); ok {
+			p.remove(blockPath, fact, fmt.Sprintf("it always holds: its conditions on '%s' can't all hold", fact))
+			always = true
+		}
+		var kept []rules.Condition
+		for i, condition := range *not {
+			if always {
+				break
+			}
+			if condition.Fact == "" {
+				v, fact, reason := p.nested(fmt.Sprintf("%s[%d]", blockPath, i), &condition)
+				if v == verdictNever {
+					p.remove(blockPath, fact, "it always holds: "+reason)
+					always = true
+					continue
+				}
+				if v == verdictAlways {
+					continue
+				}
+			}
+			kept = append(kept, condition)
+		}
+		if always {
+			kept = nil
+		} else if len(kept) == 0 {
+			return verdictNever, "", fmt.Sprintf("%s never holds: its conditions always do", blockPath)
+		}
+		*not = kept
+	}
+
+	if len(*all) == 0 && len(*any) == 0 && len(*not) == 0 {
+		return verdictAlways, "", ""
+	}
+	return verdictUnknown, "", ""
+}
+
+// nested prunes a nested group of conditions. What it removed is only
+// recorded if the group is kept or left empty; a group that never holds is
+// reported as a whole by the caller.
+func (p *pruner) nested(path string, condition *rules.Condition) (verdict, string, string) {
+	inner := pruner{rule: p.rule}
+	v, fact, reason := inner.group(path, &condition.All, &condition.Any, &condition.Not)
+	if v != verdictNever {
+		p.eliminations = append(p.eliminations, inner.eliminations...)
+	}
+	return v, fact, reason
+}
@@ -0,0 +1,94 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEliminateDeadCode(t *testing.T) {
+	compare := func(fact, operator string, value interface{}) rules.Condition {
+		return rules.Condition{Fact: fact, Operator: operator, Value: value}
+	}
+	update := func(fact string) rules.Event {
+		return rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: fact, Value: true}}}
+	}
+	ruleSet := []*rules.Rule{
+		{
+			Name: "impossible",
+			Conditions: rules.Conditions{All: []rules.Condition{
+				compare("temperature", "greaterThan", 30), compare("temperature", "lessThan", 20),
+			}},
+			Event: update("alarm"),
+		},
+		{
+			// Only the impossible rule writes alarm
+			Name:       "siren",
+			Conditions: rules.Conditions{All: []rules.Condition{compare("alarm", "equal", true)}},
+			Event:      update("siren_on"),
+		},
+		{
+			// Only the siren rule writes siren_on
+			Name:       "relay",
+			Conditions: rules.Conditions{All: []rules.Condition{compare("siren_on", "equal", true)}},
+			Event:      update("relay_on"),
+		},
+		{
+			Name:       "typo",
+			Conditions: rules.Conditions{All: []rules.Condition{compare("temprature", "greaterThan", 30)}},
+			Event:      update("fan_on"),
+		},
+		{
+			Name: "cool",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{compare("temperature", "greaterThan", 30), compare("mode", "exists", nil)},
+				Any: []rules.Condition{
+					compare("humidity", "greaterThan", 50),
+					{All: []rules.Condition{compare("humidity", "lessThan", 10), compare("humidity", "greaterThan", 20)}},
+				},
+				Not: []rules.Condition{compare("door", "equal", true), compare("door", "equal", false)},
+			},
+			Event: update("ac_on"),
+		},
+		{
+			Name: "always",
+			Conditions: rules.Conditions{
+				All: []rules.Condition{compare("ac_on", "equal", true)},
+				Any: []rules.Condition{compare("humidity", "greaterThan", 50), compare("humidity", "lessThanOrEqual", 50)},
+			},
+			Event: update("logged"),
+		},
+	}
+	context := rules.NewRuleEngineContext()
+
+	live, eliminations := EliminateDeadCode(ruleSet, context, []string{"temperature", "humidity"})
+	var names []string
+	for _, rule := range live {
+		names = append(names, rule.Name)
+	}
+	assert.Equal(t, []string{"cool", "always"}, names)
+	assert.Equal(t, []rules.Condition{compare("humidity", "greaterThan", 50)}, live[0].Conditions.Any)
+	assert.Empty(t, live[0].Conditions.Not)
+	assert.Empty(t, live[1].Conditions.Any)
+	assert.Len(t, ruleSet[4].Conditions.Any, 2, "The rules passed are left as they are")
+
+	var messages []string
+	for _, elimination := range eliminations {
+		messages = append(messages, elimination.String())
+	}
+	assert.Equal(t, []string{
+		"removed rule 'impossible': conditions.all never holds: no value of 'temperature' satisfies its conditions",
+		"removed conditions.any[1] of rule 'cool': conditions.any[1].all never holds: no value of 'humidity' satisfies its conditions",
+		"removed conditions.not of rule 'cool': it always holds: its conditions on 'door' can't all hold",
+		"removed conditions.any of rule 'always': it always holds: its conditions on 'humidity' cover every value",
+		"removed rule 'siren': it compares 'alarm', which no rule writes and the host doesn't provide",
+		"removed rule 'typo': it compares 'temprature', which no rule writes and the host doesn't provide",
+		"removed rule 'relay': it compares 'siren_on', which no rule writes and the host doesn't provide",
+	}, messages)
+
+	// Facts the host provides keep the rules reading them
+	context.InitialFacts["alarm"] = false
+	live, _ = EliminateDeadCode(ruleSet, context, []string{"temperature", "humidity", "temprature"})
+	assert.Len(t, live, 5)
+}
@@ -0,0 +1,325 @@
+// pkg/preprocessor/dependencies.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"io"
+	"rgehrsitz/rex/internal/rules"
+	"sort"
+	"strings"
+)
+
+// DependencyCycle is a group of rules depending on each other through the
+// facts they write: each rule of the group can reach every other one by
+// following the rules reading its writes. With forward chaining, the rules
+// of a cycle can keep evaluating each other within a cycle.
+type DependencyCycle struct {
+	Rules []string `json:"rules"` // In ruleset order
+	// Path is the shortest loop from the first rule back to itself, with the
+	// rules alternating with the facts linking them, e.g. a -> x -> b -> y -> a.
+	Path []string `json:"path"`
+}
+
+func (c DependencyCycle) String() string {
+	return fmt.Sprintf("rules %s form a dependency cycle: %s", strings.Join(c.Rules, ", "), strings.Join(c.Path, " -> "))
+}
+
+// DependencyCycleError reports the dependency cycles of a ruleset compiled
+// with cycles rejected.
+type DependencyCycleError struct {
+	Cycles []DependencyCycle
+}
+
+func (e *DependencyCycleError) Error() string {
+	cycles := make([]string, len(e.Cycles))
+	for i, cycle := range e.Cycles {
+		cycles[i] = cycle.String()
+	}
+	return strings.Join(cycles, "; ")
+}
+
+// FindDependencyCycles returns the groups of two or more rules of a ruleset
+// that depend on each other, in the order of their first rules. A rule
+// reading a fact it writes itself, such as a rule only switching a fan on
+// while it is off, is not a cycle of its own.
+func FindDependencyCycles(ruleSet []*rules.Rule) []DependencyCycle {
+	reads, writes := ruleFacts(ruleSet)
+	edges := dependencyEdges(reads, writes)
+
+	var cycles []DependencyCycle
+	for _, component := range stronglyConnected(edges) {
+		if len(component) < 2 {
+			continue
+		}
+		cycle := DependencyCycle{}
+		inComponent := make(map[int]bool, len(component))
+		for _, i := range component {
+			cycle.Rules = append(cycle.Rules, ruleSet[i].Name)
+			inComponent[i] = true
+		}
+		loop := shortestLoop(edges, component[0], inComponent)
+		for k, i := range loop[:len(loop)-1] {
+			cycle.Path = append(cycle.Path, ruleSet[i].Name, linkingFact(writes[i], reads[loop[k+1]]))
+		}
+		cycle.Path = append(cycle.Path, ruleSet[loop[0]].Name)
+		cycles = append(cycles, cycle)
+	}
+	sort.SliceStable(cycles, func(i, j int) bool {
+		return ruleIndex(ruleSet, cycles[i].Rules[0]) < ruleIndex(ruleSet, cycles[j].Rules[0])
+	})
+	return cycles
+}
+
+// OrderByDependencies returns the rules of a ruleset reordered so that,
+// among rules of equal priority, the rules writing a fact run before those
+// reading it, and see its new value in the same cycle. Rules of different
+// priorities keep their places. Rules writing the same fact keep their
+// declared order, so the last one still wins, and so do the rules of a
+// dependency cycle and rules that don't depend on each other.
+func OrderByDependencies(ruleSet []*rules.Rule) []*rules.Rule {
+	reads, writes := ruleFacts(ruleSet)
+
+	groups := make(map[int][]int)
+	var priorities []int
+	for i, rule := range ruleSet {
+		priority := getRulePriority(rule)
+		if _, ok := groups[priority]; !ok {
+			priorities = append(priorities, priority)
+		}
+		groups[priority] = append(groups[priority], i)
+	}
+
+	ordered := make([]*rules.Rule, len(ruleSet))
+	for _, priority := range priorities {
+		group := groups[priority]
+		// edges within the group, by position in it
+		edges := make([][]int, len(group))
+		for a, i := range group {
+			for b, j := range group {
+				if a == b {
+					continue
+				}
+				if feedsRule(writes[i], reads[j]) || (a < b && feedsRule(writes[i], writes[j])) {
+					edges[a] = append(edges[a], b)
+				}
+			}
+		}
+		for slot, position := range topologicalOrder(edges) {
+			ordered[group[slot]] = ruleSet[group[position]]
+		}
+	}
+	return ordered
+}
+
+// topologicalOrder orders the nodes of a graph so that edges go forward,
+// except within its strongly connected components, whose nodes stay in
+// ascending order. Of the nodes free to go next, the lowest goes first.
+func topologicalOrder(edges [][]int) []int {
+	components := stronglyConnected(edges)
+	componentOf := make([]int, len(edges))
+	for c, component := range components {
+		for _, node := range component {
+			componentOf[node] = c
+		}
+	}
+	incoming := make([]int, len(components))
+	for from, targets := range edges {
+		for _, to := range targets {
+			if componentOf[from] != componentOf[to] {
+				incoming[componentOf[to]]++
+			}
+		}
+	}
+
+	var order []int
+	done := make([]bool, len(components))
+	for len(order) < len(edges) {
+		next := -1
+		for c, component := range components {
+			if !done[c] && incoming[c] == 0 && (next < 0 || component[0] < components[next][0]) {
+				next = c
+			}
+		}
+		done[next] = true
+		for _, node := range components[next] {
+			order = append(order, node)
+			for _, to := range edges[node] {
+				if componentOf[to] != next {
+					incoming[componentOf[to]]--
+				}
+			}
+		}
+	}
+	return order
+}
+
+// dependencyEdges returns, for each rule, the other rules reading a fact it
+// writes.
+func dependencyEdges(reads, writes []map[string]bool) [][]int {
+	edges := make([][]int, len(reads))
+	for i := range reads {
+		for j := range reads {
+			if i != j && feedsRule(writes[i], reads[j]) {
+				edges[i] = append(edges[i], j)
+			}
+		}
+	}
+	return edges
+}
+
+// stronglyConnected returns the strongly connected components of a graph,
+// each with its nodes in ascending order, using Tarjan's algorithm.
+func stronglyConnected(edges [][]int) [][]int {
+	index := make([]int, len(edges))
+	lowLink := make([]int, len(edges))
+	onStack := make([]bool, len(edges))
+	for i := range index {
+		index[i] = -1
+	}
+	var stack []int
+	var components [][]int
+	next := 0
+
+	var visit func(node int)
+	visit = func(node int) {
+		index[node], lowLink[node] = next, next
+		next++
+		stack = append(stack, node)
+		onStack[node] = true
+		for _, to := range edges[node] {
+			if index[to] < 0 {
+				visit(to)
+				lowLink[node] = min(lowLink[node], lowLink[to])
+			} else if onStack[to] {
+				lowLink[node] = min(lowLink[node], index[to])
+			}
+		}
+		if lowLink[node] != index[node] {
+			return
+		}
+		var component []int
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == node {
+				break
+			}
+		}
+		sort.Ints(component)
+		components = append(components, component)
+	}
+	for node := range edges {
+		if index[node] < 0 {
+			visit(node)
+		}
+	}
+	return components
+}
+
+// shortestLoop returns the shortest path from start back to itself through
+// the given nodes, which must form a strongly connected component.
+func shortestLoop(edges [][]int, start int, nodes map[int]bool) []int {
+	parent := map[int]int{start: -1}
+	queue := []int{start}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for _, to := range edges[from] {
+			if to == start {
+				loop := []int{start}
+				for node := from; node >= 0; node = parent[node] {
+					loop = append(loop, node)
+				}
+				for i, j := 0, len(loop)-1; i < j; i, j = i+1, j-1 {
+					loop[i], loop[j] = loop[j], loop[i]
+				}
+				return loop
+			}
+			if _, seen := parent[to]; !seen && nodes[to] {
+				parent[to] = from
+				queue = append(queue, to)
+			}
+		}
+	}
+	return []int{start, start}
+}
+
+// linkingFact returns the first of the facts a rule writes that another
+// rule reads.
+func linkingFact(writes, reads map[string]bool) string {
+	for _, fact := range sortedFacts(writes) {
+		if factIn(fact, reads) {
+			return fact
+		}
+	}
+	return ""
+}
+
+// ruleIndex returns the position of the named rule in a ruleset.
+func ruleIndex(ruleSet []*rules.Rule, name string) int {
+	for i, rule := range ruleSet {
+		if rule.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// WriteDOT writes the graph in the DOT language of Graphviz: rules as boxes,
+// facts as ellipses, with edges from the facts to the rules reading them and
+// from the rules to the facts they write, and dashed edges from facts to the
+// patterns matching them. The rules of dependency cycles are drawn in red.
+func (g DependencyGraph) WriteDOT(w io.Writer) error {
+	inCycle := make(map[string]bool)
+	for _, cycle := range g.Cycles {
+		for _, rule := range cycle.Rules {
+			inCycle[rule] = true
+		}
+	}
+	ruleIDs := make(map[string]string, len(g.Rules))
+	factIDs := make(map[string]string, len(g.Facts))
+
+	var b strings.Builder
+	b.WriteString("digraph rules {\n\trankdir=LR;\n")
+	for i, rule := range g.Rules {
+		ruleIDs[rule.Rule] = fmt.Sprintf("r%d", i)
+		attributes := ""
+		if inCycle[rule.Rule] {
+			attributes = ", color=red"
+		}
+		fmt.Fprintf(&b, "\tr%d [label=%s, shape=box%s];\n", i, dotString(rule.Rule), attributes)
+	}
+	for i, fact := range g.Facts {
+		factIDs[fact.Fact] = fmt.Sprintf("f%d", i)
+		fmt.Fprintf(&b, "\tf%d [label=%s, shape=ellipse];\n", i, dotString(fact.Fact))
+	}
+	for _, rule := range g.Rules {
+		for _, fact := range rule.Reads {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", factIDs[fact], ruleIDs[rule.Rule])
+		}
+		for _, fact := range rule.Writes {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", ruleIDs[rule.Rule], factIDs[fact])
+		}
+	}
+	for _, pattern := range g.Facts {
+		if !rules.IsFactPattern(pattern.Fact) {
+			continue
+		}
+		for _, fact := range g.Facts {
+			if fact.Fact != pattern.Fact && rules.MatchFact(pattern.Fact, fact.Fact) {
+				fmt.Fprintf(&b, "\t%s -> %s [style=dashed];\n", factIDs[fact.Fact], factIDs[pattern.Fact])
+			}
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotString quotes a name as a DOT string.
+func dotString(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(name) + `"`
+}
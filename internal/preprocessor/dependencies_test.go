@@ -0,0 +1,106 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dependentRule returns a rule reading the facts of reads and writing those
+// of writes.
+func dependentRule(name string, priority int, reads []string, writes ...string) *rules.Rule {
+	rule := &rules.Rule{Name: name, Priority: priority}
+	for _, fact := range reads {
+		rule.Conditions.All = append(rule.Conditions.All, rules.Condition{Fact: fact, Operator: "equal", Value: true})
+	}
+	for _, fact := range writes {
+		rule.Event.Actions = append(rule.Event.Actions, rules.Action{Type: "updateFact", Target: fact, Value: true})
+	}
+	return rule
+}
+
+func TestFindDependencyCycles(t *testing.T) {
+	ruleSet := []*rules.Rule{
+		dependentRule("fan", 0, []string{"cooling"}, "fan_on"),
+		dependentRule("cool", 0, []string{"hot"}, "cooling"),
+		dependentRule("heat", 0, []string{"fan_on"}, "hot"),
+		dependentRule("toggle", 0, []string{"toggle"}, "toggle"), // Reads its own write
+		dependentRule("feed", 0, []string{"door_open"}, "sensor.hall"),
+		dependentRule("watch", 0, []string{"sensor.*"}, "door_open"),
+		dependentRule("alone", 0, []string{"hot"}),
+	}
+
+	cycles := FindDependencyCycles(ruleSet)
+	assert.Equal(t, []DependencyCycle{
+		{Rules: []string{"fan", "cool", "heat"}, Path: []string{"fan", "fan_on", "heat", "hot", "cool", "cooling", "fan"}},
+		{Rules: []string{"feed", "watch"}, Path: []string{"feed", "sensor.hall", "watch", "door_open", "feed"}},
+	}, cycles)
+	assert.Equal(t, "rules feed, watch form a dependency cycle: feed -> sensor.hall -> watch -> door_open -> feed", cycles[1].String())
+
+	assert.Empty(t, FindDependencyCycles(ruleSet[3:4]))
+	assert.Equal(t, cycles, AnalyzeDependencyGraph(ruleSet).Cycles)
+}
+
+func TestOrderByDependencies(t *testing.T) {
+	names := func(ruleSet []*rules.Rule) []string {
+		var names []string
+		for _, rule := range ruleSet {
+			names = append(names, rule.Name)
+		}
+		return names
+	}
+
+	ruleSet := []*rules.Rule{
+		dependentRule("alarm", 10, []string{"fan_on"}),
+		dependentRule("fan", 0, []string{"cooling"}, "fan_on"),
+		dependentRule("cool", 0, []string{"hot"}, "cooling"),
+		dependentRule("heat", 10, []string{"temperature"}, "hot"),
+		dependentRule("log", 0, []string{"door_open"}),
+	}
+	// Writers move ahead of the readers of equal priority, into their slots
+	assert.Equal(t, []string{"alarm", "cool", "fan", "heat", "log"}, names(OrderByDependencies(ruleSet)))
+
+	// Rules writing the same fact keep their order, so the last one still
+	// wins, even when that keeps a reader ahead of a writer
+	ruleSet = []*rules.Rule{
+		dependentRule("reset", 0, nil, "mode"),
+		dependentRule("report", 0, []string{"level"}),
+		dependentRule("auto", 0, []string{"level"}, "mode"),
+		dependentRule("level", 0, []string{"sensor"}, "level"),
+	}
+	assert.Equal(t, []string{"reset", "level", "report", "auto"}, names(OrderByDependencies(ruleSet)))
+
+	// Rules in a cycle keep their declared order
+	ruleSet = []*rules.Rule{
+		dependentRule("b", 0, []string{"x", "z"}, "y"),
+		dependentRule("a", 0, []string{"y"}, "x"),
+		dependentRule("feed", 0, nil, "z"),
+	}
+	assert.Equal(t, []string{"feed", "b", "a"}, names(OrderByDependencies(ruleSet)))
+}
+
+func TestDependencyGraph_WriteDOT(t *testing.T) {
+	ruleSet := []*rules.Rule{
+		dependentRule(`say "hot"`, 0, []string{"sensor.*"}, "hot"),
+		dependentRule("feed", 0, []string{"hot"}, "sensor.hall"),
+	}
+
+	var dot strings.Builder
+	assert.NoError(t, AnalyzeDependencyGraph(ruleSet).WriteDOT(&dot))
+	assert.Equal(t, `digraph rules {
+	rankdir=LR;
+	r0 [label="say \"hot\"", shape=box, color=red];
+	r1 [label="feed", shape=box, color=red];
+	f0 [label="hot", shape=ellipse];
+	f1 [label="sensor.*", shape=ellipse];
+	f2 [label="sensor.hall", shape=ellipse];
+	f1 -> r0;
+	r0 -> f0;
+	f0 -> r1;
+	r1 -> f2;
+	f2 -> f1 [style=dashed];
+}
+`, dot.String())
+}
@@ -0,0 +1,170 @@
+// pkg/preprocessor/errors.go
+
+package preprocessor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// RuleError is a problem found parsing or validating a ruleset, located in
+// its JSON.
+type RuleError struct {
+	Rule   string // Name of the rule the problem is in; empty if it isn't in a rule or the rule has no name
+	Path   string // JSON path of the offending value, e.g. rules[3].conditions.all[1]; empty for the whole ruleset
+	Line   int    // Line of the offending value, counting from 1; 0 if unknown
+	Column int    // Column of the offending value, counting from 1; 0 if unknown
+	Err    error
+}
+
+func (e *RuleError) Error() string {
+	var details []string
+	if e.Rule != "" {
+		details = append(details, fmt.Sprintf("rule '%s'", e.Rule))
+	}
+	if e.Line > 0 {
+		details = append(details, fmt.Sprintf("line %d, column %d", e.Line, e.Column))
+	}
+	location := e.Path
+	if len(details) > 0 {
+		location = strings.TrimSpace(location + " (" + strings.Join(details, ", ") + ")")
+	}
+	if location == "" {
+		return e.Err.Error()
+	}
+	return location + ": " + e.Err.Error()
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// RulesetError reports every problem found parsing or validating a ruleset.
+// Each rule is validated even if others are invalid, so that all of them
+// can be fixed at once; the rules are only checked against each other once
+// they are all valid.
+type RulesetError struct {
+	Errors []*RuleError
+}
+
+func (e *RulesetError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d problems in the ruleset: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+func (e *RulesetError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// pathError locates an error at a path below the value being validated, such
+// as conditions.all[1] within a rule.
+type pathError struct {
+	path string
+	err  error
+}
+
+func (e *pathError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pathError) Unwrap() error {
+	return e.err
+}
+
+// atPath locates an error at a path, below which it may already be located.
+func atPath(path string, err error) error {
+	if inner, ok := err.(*pathError); ok {
+		return &pathError{path: joinPath(path, inner.path), err: inner.err}
+	}
+	return &pathError{path: path, err: err}
+}
+
+// ruleNameError attributes an error found checking rules against each other
+// to the rule at fault.
+type ruleNameError struct {
+	rule string
+	err  error
+}
+
+func (e *ruleNameError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ruleNameError) Unwrap() error {
+	return e.err
+}
+
+// errorLocator turns the errors found in a JSON document into RuleErrors
+// located in it. The document is only indexed once an error needs locating.
+type errorLocator struct {
+	data  []byte
+	root  string // Path of the document's root value, rules for a ruleset written as an array
+	index *jsonIndex
+}
+
+// locate locates an error found in the value at path, such as a rule, named
+// rule. Paths the error carries are taken to be relative to that value,
+// unless the value was generated from the one at path, as the rules lowered
+// from a state machine are, in which case the error is located at path.
+func (l *errorLocator) locate(err error, rule, path string, generated bool) *RuleError {
+	if l.index == nil {
+		if l.index = indexJSON(l.data, l.root); l.index == nil {
+			l.index = &jsonIndex{data: l.data, paths: map[string]jsonSpan{}}
+		}
+	}
+	located := &RuleError{Rule: rule, Path: path, Err: err}
+	var inner *pathError
+	if errors.As(err, &inner) {
+		located.Err = inner.err
+		if !generated {
+			located.Path = joinPath(path, inner.path)
+		}
+	}
+
+	offset := -1
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		offset = int(syntaxErr.Offset)
+	} else if errors.As(err, &typeErr) && !generated {
+		offset = int(typeErr.Offset) - 1 // Offset is past the value
+	}
+	if offset >= 0 {
+		if span, ok := l.index.find(path); ok && path != "" {
+			offset += span.start // The value was decoded on its own
+		}
+		if span, ok := l.index.enclosing(offset); ok {
+			located.Path = span.path
+			if typeErr != nil {
+				offset = span.start
+			}
+		}
+		located.Line, located.Column = lineColumn(l.data, offset)
+		return located
+	}
+
+	// Unknown fields rejected by strict parsing are only reported by name
+	const unknownField = `json: unknown field "`
+	if i := strings.Index(err.Error(), unknownField); i >= 0 && !generated {
+		key, _, _ := strings.Cut(err.Error()[i+len(unknownField):], `"`)
+		if span, ok := l.index.field(path, key); ok {
+			located.Path = span.path
+		}
+	}
+	if span, ok := l.index.find(located.Path); ok {
+		located.Line, located.Column = lineColumn(l.data, span.start)
+	}
+	return located
+}
@@ -0,0 +1,74 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRules_CollectsLocatedErrors(t *testing.T) {
+	_, err := ParseAndValidateRules([]byte(`[
+  {"name": "bad-operator", "conditions": {"all": [
+    {"fact": "temperature", "operator": "equal", "value": 1},
+    {"fact": "temperature", "operator": "bogus", "value": 1}
+  ]}},
+  {"name": "good", "conditions": {"all": [{"fact": "humidity", "operator": "equal", "value": 1}]}},
+  {"name": "bad-priority", "priority": "high", "conditions": {"all": [{"fact": "humidity", "operator": "equal", "value": 2}]}}
+]`), rules.NewRuleEngineContext())
+	var rulesetErr *RulesetError
+	require.ErrorAs(t, err, &rulesetErr)
+	require.Len(t, rulesetErr.Errors, 2)
+
+	assert.Equal(t, "bad-operator", rulesetErr.Errors[0].Rule)
+	assert.Equal(t, "rules[0].conditions.all[1]", rulesetErr.Errors[0].Path)
+	assert.Equal(t, 4, rulesetErr.Errors[0].Line)
+	assert.Equal(t, 5, rulesetErr.Errors[0].Column)
+
+	assert.Equal(t, "rules[2].priority", rulesetErr.Errors[1].Path)
+	assert.Equal(t, 7, rulesetErr.Errors[1].Line)
+	assert.Equal(t, 40, rulesetErr.Errors[1].Column)
+	assert.ErrorContains(t, err, "2 problems in the ruleset: rules[0].conditions.all[1] (rule 'bad-operator', line 4, column 5): ")
+}
+
+func TestParseRules_LocatesSyntaxErrors(t *testing.T) {
+	_, err := ParseAndValidateRules([]byte("[\n  {\"name\": \"a\", \"conditions\": {\"all\": [}}\n]"), rules.NewRuleEngineContext())
+	var rulesetErr *RulesetError
+	require.ErrorAs(t, err, &rulesetErr)
+	require.Len(t, rulesetErr.Errors, 1)
+	assert.Equal(t, 2, rulesetErr.Errors[0].Line)
+	assert.Equal(t, 41, rulesetErr.Errors[0].Column)
+}
+
+func TestParseRules_LocatesUnknownFields(t *testing.T) {
+	_, err := ParseAndValidateRulesWithOptions([]byte(`{"rules": [
+  {"name": "a", "conditions": {"all": [{"fact": "t", "operator": "equal", "value": 1, "unit": "C"}]}}
+]}`), rules.NewRuleEngineContext(), ParseOptions{Mode: ParseModeStrict})
+	var rulesetErr *RulesetError
+	require.ErrorAs(t, err, &rulesetErr)
+	require.Len(t, rulesetErr.Errors, 1)
+	assert.Equal(t, "rules[0].conditions.all[0].unit", rulesetErr.Errors[0].Path)
+	assert.Equal(t, 2, rulesetErr.Errors[0].Line)
+	assert.Equal(t, 95, rulesetErr.Errors[0].Column)
+}
+
+func TestParseRules_LocatesCrossRuleErrors(t *testing.T) {
+	_, err := ParseAndValidateRules([]byte(`{
+  "readOnlyFacts": ["setpoint"],
+  "rules": [
+    {"name": "reader", "conditions": {"all": [{"fact": "setpoint", "operator": "equal", "value": 1}]}},
+    {"name": "writer", "conditions": {"all": [{"fact": "t", "operator": "equal", "value": 1}]},
+     "event": {"actions": [{"type": "updateFact", "target": "setpoint", "value": 2}]}}
+  ]
+}`), rules.NewRuleEngineContext())
+	assert.EqualError(t, err, "rules[1] (rule 'writer', line 5, column 5): rule 'writer' writes read-only fact 'setpoint'")
+}
+
+func TestLineColumn(t *testing.T) {
+	data := []byte("ab\nçd\n")
+	line, column := lineColumn(data, 0)
+	assert.Equal(t, []int{1, 1}, []int{line, column})
+	line, column = lineColumn(data, 5) // d, after a two-byte character
+	assert.Equal(t, []int{2, 2}, []int{line, column})
+}
@@ -0,0 +1,101 @@
+// pkg/preprocessor/escalation.go
+
+package preprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Escalation declares an escalation chain, the alerting pattern of acting
+// again, and more forcefully, for as long as a problem persists: the first
+// step runs when the conditions start holding, and each following step once
+// they have kept holding for its delay after the step before it. The
+// preprocessor lowers each step into a rule with the escalation's conditions
+// that runs its actions once, when the conditions have held for the sum of
+// the delays up to the step. When the conditions stop holding, the chain
+// starts over.
+//
+// A ruleset with escalations is a JSON object with the rules under "rules"
+// and the escalations under "escalations".
+type Escalation struct {
+	Name       string           `json:"name"`
+	Priority   int              `json:"priority,omitempty"`
+	Conditions json.RawMessage  `json:"conditions"` // In the same form as a rule's
+	Steps      []EscalationStep `json:"steps"`
+}
+
+// EscalationStep is a step of an escalation chain.
+type EscalationStep struct {
+	After   string            `json:"after,omitempty"` // Delay after the previous step, e.g. "5m"; none if empty
+	Actions []json.RawMessage `json:"actions"`
+}
+
+// EscalationStepRuleName returns the name of the rule the nth step of an
+// escalation, counting from 1, is lowered into.
+func EscalationStepRuleName(escalation string, n int) string {
+	return fmt.Sprintf("%s: step %d", escalation, n)
+}
+
+// holdDurations checks the escalation and returns how long its conditions
+// must have held before each of its steps runs.
+func (e *Escalation) holdDurations() ([]time.Duration, error) {
+	if e.Name == "" {
+		return nil, fmt.Errorf("an escalation must have a name")
+	}
+	if len(e.Conditions) == 0 {
+		return nil, fmt.Errorf("escalation '%s' has no conditions", e.Name)
+	}
+	if len(e.Steps) == 0 {
+		return nil, fmt.Errorf("escalation '%s' has no steps", e.Name)
+	}
+
+	durations := make([]time.Duration, len(e.Steps))
+	var total time.Duration
+	for i, step := range e.Steps {
+		if step.After != "" {
+			delay, err := time.ParseDuration(step.After)
+			if err != nil {
+				return nil, fmt.Errorf("step %d of escalation '%s' has an invalid delay '%s': %w", i+1, e.Name, step.After, err)
+			}
+			if delay < 0 {
+				return nil, fmt.Errorf("step %d of escalation '%s' has negative delay %s", i+1, e.Name, step.After)
+			}
+			total += delay
+		}
+		if len(step.Actions) == 0 {
+			return nil, fmt.Errorf("step %d of escalation '%s' has no actions", i+1, e.Name)
+		}
+		durations[i] = total
+	}
+	return durations, nil
+}
+
+// LowerEscalation returns the JSON of the rules an escalation is lowered
+// into, one per step in order. Each rule has the escalation's conditions and
+// priority and the step's actions, and runs them once each time the
+// conditions have held for the step's total delay.
+func LowerEscalation(escalation *Escalation) ([]json.RawMessage, error) {
+	durations, err := escalation.holdDurations()
+	if err != nil {
+		return nil, err
+	}
+
+	lowered := make([]json.RawMessage, 0, len(escalation.Steps))
+	for i, step := range escalation.Steps {
+		rule, err := json.Marshal(map[string]interface{}{
+			"name":       EscalationStepRuleName(escalation.Name, i+1),
+			"priority":   escalation.Priority,
+			"conditions": escalation.Conditions,
+			"event":      map[string]interface{}{"actions": step.Actions},
+			"for":        durations[i].String(),
+			"once":       true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		lowered = append(lowered, rule)
+	}
+	return lowered, nil
+}
@@ -0,0 +1,77 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const escalationRuleset = `{
+    "rules": [],
+    "escalations": [
+        {
+            "name": "overheating",
+            "priority": 3,
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+            "steps": [
+                {"actions": [{"type": "notify", "target": "oncall", "value": "overheating"}]},
+                {"after": "5m", "actions": [{"type": "notify", "target": "manager", "value": "still overheating"}]},
+                {"after": "15m", "actions": [{"type": "updateFact", "target": "shutdown", "value": true}]}
+            ]
+        }
+    ]
+}`
+
+func TestParseRuleset_Escalations(t *testing.T) {
+	ruleSet, err := ParseAndValidateRules([]byte(escalationRuleset), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	require.Len(t, ruleSet, 3)
+
+	// Each step runs once, when the conditions have held for the delays up to it
+	var holds []string
+	for i, rule := range ruleSet {
+		assert.Equal(t, EscalationStepRuleName("overheating", i+1), rule.Name)
+		assert.Equal(t, 3, rule.Priority)
+		assert.True(t, rule.Once)
+		assert.Equal(t, []string{"temperature"}, rule.ConsumedFacts)
+		holds = append(holds, rule.For)
+	}
+	assert.Equal(t, []string{"0s", "5m0s", "20m0s"}, holds)
+	assert.Equal(t, "manager", ruleSet[1].Event.Actions[0].Target)
+	assert.Equal(t, []string{"shutdown"}, ruleSet[2].ProducedFacts)
+}
+
+func TestParseRuleset_InvalidEscalations(t *testing.T) {
+	conditions := `"conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]}`
+	action := `"actions": [{"type": "notify", "target": "oncall", "value": "overheating"}]`
+	invalid := map[string]string{
+		"no name":       `{` + conditions + `, "steps": [{` + action + `}]}`,
+		"no conditions": `{"name": "overheating", "steps": [{` + action + `}]}`,
+		"no steps":      `{"name": "overheating", ` + conditions + `}`,
+		"no actions":    `{"name": "overheating", ` + conditions + `, "steps": [{"after": "5m"}]}`,
+		"bad delay":     `{"name": "overheating", ` + conditions + `, "steps": [{"after": "later", ` + action + `}]}`,
+		"negative":      `{"name": "overheating", ` + conditions + `, "steps": [{"after": "-5m", ` + action + `}]}`,
+	}
+	for name, escalation := range invalid {
+		ruleset := `{"escalations": [` + escalation + `]}`
+		_, err := ParseAndValidateRules([]byte(ruleset), rules.NewRuleEngineContext())
+		assert.Error(t, err, name)
+	}
+
+	duplicate := `{"name": "overheating", ` + conditions + `, "steps": [{` + action + `}]}`
+	_, err := ParseAndValidateRules([]byte(`{"escalations": [`+duplicate+`, `+duplicate+`]}`), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "two escalations are named 'overheating'")
+}
+
+func TestOptimizeRules_KeepsEscalationSteps(t *testing.T) {
+	context := rules.NewRuleEngineContext()
+	ruleSet, err := ParseAndValidateRules([]byte(escalationRuleset), context)
+	require.NoError(t, err)
+
+	// The steps share their conditions and priority, but each has its own timer
+	optimized, err := OptimizeRules(ruleSet, context)
+	require.NoError(t, err)
+	assert.Len(t, optimized, 3)
+}
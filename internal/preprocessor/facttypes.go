@@ -0,0 +1,149 @@
+// pkg/preprocessor/facttypes.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+)
+
+// factConsumer records how a rule compares a fact.
+type factConsumer struct {
+	rule      string
+	valueType string
+}
+
+// validateActionValueTypes checks that every updateFact action writes a value
+// whose type matches how the other rules in the set compare the target fact,
+// so that a rule can't write a string into a fact compared numerically
+// elsewhere. The type of a comparison is its declared ValueType, or the type
+// inferred from its value. Ints and floats are compatible with each other.
+// The values of script actions are only known at runtime, and the scores of
+// scoring rules are floats.
+func validateActionValueTypes(ruleSet []*rules.Rule) error {
+	consumers := make(map[string][]factConsumer)
+	for _, rule := range ruleSet {
+		for _, conditions := range ruleConditionBlocks(rule) {
+			collectFactConsumers(rule.Name, conditions.All, consumers)
+			collectFactConsumers(rule.Name, conditions.Any, consumers)
+			collectFactConsumers(rule.Name, conditions.Not, consumers)
+		}
+	}
+
+	for _, rule := range ruleSet {
+		for _, write := range ruleFactWrites(rule) {
+			if write.valueType == "" {
+				continue
+			}
+			for _, consumer := range factConsumers(consumers, write.fact) {
+				if !valueTypesCompatible(write.valueType, consumer.valueType) {
+					return &ruleNameError{rule: rule.Name, err: fmt.Errorf("rule '%s' writes a %s value to fact '%s', which rule '%s' compares as %s",
+						rule.Name, write.valueType, write.fact, consumer.rule, consumer.valueType)}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// factConsumers returns the consumers of a fact, including those comparing a
+// fact pattern it matches.
+func factConsumers(consumers map[string][]factConsumer, fact string) []factConsumer {
+	result := consumers[fact]
+	for pattern, patternConsumers := range consumers {
+		if rules.IsFactPattern(pattern) && rules.MatchFact(pattern, fact) {
+			result = append(result[:len(result):len(result)], patternConsumers...)
+		}
+	}
+	return result
+}
+
+// collectFactConsumers recursively records the type each condition compares
+// its fact as. Existence conditions don't compare their fact.
+func collectFactConsumers(ruleName string, conditions []rules.Condition, consumers map[string][]factConsumer) {
+	for _, cond := range conditions {
+		if cond.Fact != "" && !rules.IsExistenceOperator(cond.Operator) {
+			valueType := cond.ValueType
+			if valueType == "" {
+				valueType = getTypeString(cond.Value)
+			}
+			consumers[cond.Fact] = append(consumers[cond.Fact], factConsumer{rule: ruleName, valueType: valueType})
+		}
+		collectFactConsumers(ruleName, cond.All, consumers)
+		collectFactConsumers(ruleName, cond.Any, consumers)
+		collectFactConsumers(ruleName, cond.Not, consumers)
+	}
+}
+
+// valueTypesCompatible reports whether a value of type written can be compared
+// by a condition of type compared.
+func valueTypesCompatible(written, compared string) bool {
+	if written == compared {
+		return true
+	}
+	return isNumericType(written) && isNumericType(compared)
+}
+
+// isNumericType reports whether valueType is "int" or "float".
+func isNumericType(valueType string) bool {
+	return valueType == "int" || valueType == "float"
+}
+
+// FactSchema returns the type of every fact the rules compare or write, for
+// the runtime to check incoming fact values against. A fact compared or
+// written both as int and float is a float. Facts used as different kinds of
+// values, and those only scripts read or write, are left out.
+func FactSchema(ruleSet []*rules.Rule) bytecode.FactSchema {
+	consumers := make(map[string][]factConsumer)
+	for _, rule := range ruleSet {
+		for _, conditions := range ruleConditionBlocks(rule) {
+			collectFactConsumers(rule.Name, conditions.All, consumers)
+			collectFactConsumers(rule.Name, conditions.Any, consumers)
+			collectFactConsumers(rule.Name, conditions.Not, consumers)
+		}
+		for _, write := range ruleFactWrites(rule) {
+			if write.valueType != "" && write.fact != "" {
+				consumers[write.fact] = append(consumers[write.fact], factConsumer{rule: rule.Name, valueType: write.valueType})
+			}
+		}
+	}
+
+	schema := make(bytecode.FactSchema)
+	for fact, uses := range consumers {
+		valueType := uses[0].valueType
+		for _, use := range uses[1:] {
+			switch {
+			case use.valueType == valueType:
+			case isNumericType(use.valueType) && isNumericType(valueType):
+				valueType = "float"
+			default:
+				valueType = ""
+			}
+		}
+		if valueType == "int" || valueType == "float" || valueType == "string" || valueType == "bool" {
+			schema[fact] = valueType
+		}
+	}
+	return schema
+}
+
+// updateProducedFacts marks the targets of the rule's fact update actions,
+// and its score fact, as produced in the context.
+func updateProducedFacts(rule *rules.Rule, context *rules.RuleEngineContext) {
+	for _, write := range ruleFactWrites(rule) {
+		if write.fact != "" {
+			context.ProducedFacts[write.fact] = true
+		}
+	}
+}
+
+// ruleActions returns the event actions of a rule followed by the actions of
+// all its variants.
+func ruleActions(rule *rules.Rule) []rules.Action {
+	actions := append([]rules.Action(nil), rule.Event.Actions...)
+	for _, variant := range rule.Variants {
+		actions = append(actions, variant.Actions...)
+	}
+	return actions
+}
@@ -0,0 +1,240 @@
+// pkg/preprocessor/fields.go
+
+package preprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ParseMode controls how the parser treats JSON fields that don't correspond
+// to any part of the rule format.
+type ParseMode int
+
+const (
+	// ParseModePermissive keeps unknown fields in the Metadata of the rule,
+	// event, condition or action they appear in and logs a warning for each.
+	ParseModePermissive ParseMode = iota
+	// ParseModeStrict rejects rules containing unknown fields.
+	ParseModeStrict
+)
+
+// ParseOptions controls optional parser behaviour.
+type ParseOptions struct {
+	Mode       ParseMode
+	Strictness Strictness // Validation checks applied; paranoid implies ParseModeStrict
+	Scripts    bool       // Allow script conditions and actions, which run Lua code in the runtime
+}
+
+// rejectUnknownFields reports whether rules with unknown fields are rejected.
+func (o ParseOptions) rejectUnknownFields() bool {
+	return o.Mode == ParseModeStrict || o.Strictness == StrictnessParanoid
+}
+
+var (
+	ruleFields       = jsonFieldNames(reflect.TypeOf(rules.Rule{}))
+	conditionsFields = jsonFieldNames(reflect.TypeOf(rules.Conditions{}))
+	conditionFields  = jsonFieldNames(reflect.TypeOf(rules.Condition{}))
+	eventFields      = jsonFieldNames(reflect.TypeOf(rules.Event{}))
+	actionFields     = jsonFieldNames(reflect.TypeOf(rules.Action{}))
+	variantFields    = jsonFieldNames(reflect.TypeOf(rules.Variant{}))
+)
+
+// jsonFieldNames returns the JSON field names a struct type decodes.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// collectUnknownFields walks the raw JSON of a rule and stores every field that
+// the rule structs don't recognize in the Metadata of the element it belongs to.
+// Unknown fields of the conditions block itself are kept on the rule, prefixed
+// with "conditions.".
+func collectUnknownFields(ruleJSON []byte, rule *rules.Rule) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(ruleJSON, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	if rule.Metadata, err = unknownFields(raw, ruleFields, rule.Name, ""); err != nil {
+		return err
+	}
+
+	if conditionsJSON, ok := raw["conditions"]; ok {
+		var rawConditions map[string]json.RawMessage
+		if err := json.Unmarshal(conditionsJSON, &rawConditions); err != nil {
+			return err
+		}
+		blockFields, err := unknownFields(rawConditions, conditionsFields, rule.Name, "conditions.")
+		if err != nil {
+			return err
+		}
+		for key, value := range blockFields {
+			if rule.Metadata == nil {
+				rule.Metadata = make(map[string]interface{})
+			}
+			rule.Metadata["conditions."+key] = value
+		}
+		if err := collectConditionFields(rawConditions, rule.Conditions.All, rule.Conditions.Any, rule.Conditions.Not, rule.Name, "conditions"); err != nil {
+			return err
+		}
+	}
+
+	if variantsJSON, ok := raw["variants"]; ok {
+		if err := collectVariantFields(variantsJSON, rule); err != nil {
+			return err
+		}
+	}
+
+	if eventJSON, ok := raw["event"]; ok {
+		var rawEvent map[string]json.RawMessage
+		if err := json.Unmarshal(eventJSON, &rawEvent); err != nil {
+			return err
+		}
+		if rule.Event.Metadata, err = unknownFields(rawEvent, eventFields, rule.Name, "event."); err != nil {
+			return err
+		}
+
+		var rawActions []json.RawMessage
+		if actionsJSON, ok := rawEvent["actions"]; ok {
+			if err := json.Unmarshal(actionsJSON, &rawActions); err != nil {
+				return err
+			}
+		}
+		for i := range rule.Event.Actions {
+			var rawAction map[string]json.RawMessage
+			if err := json.Unmarshal(rawActions[i], &rawAction); err != nil {
+				return err
+			}
+			path := fmt.Sprintf("event.actions[%d].", i)
+			if rule.Event.Actions[i].Metadata, err = unknownFields(rawAction, actionFields, rule.Name, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectVariantFields records unknown fields of a rule's variants and their
+// actions. Unknown fields of a variant itself are kept on the rule, prefixed
+// with the variant's path.
+func collectVariantFields(variantsJSON json.RawMessage, rule *rules.Rule) error {
+	var rawVariants []map[string]json.RawMessage
+	if err := json.Unmarshal(variantsJSON, &rawVariants); err != nil {
+		return err
+	}
+
+	for i := range rule.Variants {
+		path := fmt.Sprintf("variants[%d].", i)
+		variantFieldValues, err := unknownFields(rawVariants[i], variantFields, rule.Name, path)
+		if err != nil {
+			return err
+		}
+		for key, value := range variantFieldValues {
+			if rule.Metadata == nil {
+				rule.Metadata = make(map[string]interface{})
+			}
+			rule.Metadata[path+key] = value
+		}
+
+		var rawActions []map[string]json.RawMessage
+		if actionsJSON, ok := rawVariants[i]["actions"]; ok {
+			if err := json.Unmarshal(actionsJSON, &rawActions); err != nil {
+				return err
+			}
+		}
+		actions := rule.Variants[i].Actions
+		for j := range actions {
+			actionPath := fmt.Sprintf("%sactions[%d].", path, j)
+			if actions[j].Metadata, err = unknownFields(rawActions[j], actionFields, rule.Name, actionPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectConditionFields records unknown fields for the conditions of an
+// all/any/not block, recursing into nested blocks.
+func collectConditionFields(rawBlock map[string]json.RawMessage, all, any, not []rules.Condition, ruleName, path string) error {
+	blocks := []struct {
+		key        string
+		conditions []rules.Condition
+	}{
+		{"all", all},
+		{"any", any},
+		{"not", not},
+	}
+
+	for _, block := range blocks {
+		var rawConditions []json.RawMessage
+		if blockJSON, ok := rawBlock[block.key]; ok {
+			if err := json.Unmarshal(blockJSON, &rawConditions); err != nil {
+				return err
+			}
+		}
+		for i := range block.conditions {
+			var rawCondition map[string]json.RawMessage
+			if err := json.Unmarshal(rawConditions[i], &rawCondition); err != nil {
+				return err
+			}
+			conditionPath := fmt.Sprintf("%s.%s[%d]", path, block.key, i)
+			metadata, err := unknownFields(rawCondition, conditionFields, ruleName, conditionPath+".")
+			if err != nil {
+				return err
+			}
+			block.conditions[i].Metadata = metadata
+
+			cond := &block.conditions[i]
+			if err := collectConditionFields(rawCondition, cond.All, cond.Any, cond.Not, ruleName, conditionPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// unknownFields returns the fields of raw that aren't in known, decoded into
+// Go values, logging a warning for each. It returns nil if there are none.
+func unknownFields(raw map[string]json.RawMessage, known map[string]bool, ruleName, path string) (map[string]interface{}, error) {
+	var metadata map[string]interface{}
+	for key, valueJSON := range raw {
+		if known[key] {
+			continue
+		}
+
+		var value interface{}
+		if err := decodeJSON(valueJSON, &value); err != nil {
+			return nil, err
+		}
+		value, err := NormalizeNumbers(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata[key] = value
+
+		log.Warn().
+			Str("rule", ruleName).
+			Str("field", path+key).
+			Msg("Unknown field in rule definition kept as metadata")
+	}
+	return metadata, nil
+}
@@ -0,0 +1,224 @@
+// pkg/preprocessor/inventory.go
+
+package preprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Device is an entry of an inventory: a device and its attributes, such as
+// its model or the zone it serves.
+type Device struct {
+	ID         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// Inventory lists the devices templated rules are expanded for.
+//
+// An inventory file is a JSON array of devices, each with an id and optional
+// attributes:
+//
+//	[{"id": "ahu-1", "attributes": {"zone": "north", "maxTemperature": 28}}]
+type Inventory []Device
+
+// ParseInventory parses an inventory file. Every device must have an id of
+// its own, and no attribute may be named id.
+func ParseInventory(inventoryJSON []byte) (Inventory, error) {
+	var inventory Inventory
+	if err := decodeJSON(inventoryJSON, &inventory); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal inventory: %w", err)
+	}
+
+	ids := make(map[string]bool)
+	for i, device := range inventory {
+		if device.ID == "" {
+			return nil, fmt.Errorf("device %d of the inventory has no id", i+1)
+		}
+		if ids[device.ID] {
+			return nil, fmt.Errorf("inventory lists device '%s' more than once", device.ID)
+		}
+		ids[device.ID] = true
+		if _, ok := device.Attributes["id"]; ok {
+			return nil, fmt.Errorf("device '%s' has an attribute named id, which placeholders use for the device id", device.ID)
+		}
+	}
+	return inventory, nil
+}
+
+// devicePlaceholder matches the placeholders of templated rules, such as
+// ${device.id} or ${device.zone}.
+var devicePlaceholder = regexp.MustCompile(`\$\{device\.([A-Za-z0-9_]+)\}`)
+
+// ExpandInventory replaces every templated rule in the JSON array of rules in
+// rulesJSON with one rule per device of the inventory it selects, and
+// returns the expanded array.
+//
+// A rule is templated when it has "forEachDevice", an object of attributes
+// the devices must have, with their values; an empty object selects every
+// device. In the copy of the rule for a device, ${device.id} stands for the
+// device's id and ${device.name} for its attribute name, in every string of
+// the rule and in the keys of its objects. A string consisting of a single
+// placeholder is replaced by the attribute value itself, so a number stays a
+// number. The copy is named after the template followed by the device id,
+// e.g. "overheating: ahu-1", unless the template's name has a placeholder.
+// In a ruleset written as an object, the templates are among its "rules".
+func ExpandInventory(rulesJSON []byte, inventory Inventory) ([]byte, error) {
+	if isRulesetObject(rulesJSON) {
+		var ruleset map[string]interface{}
+		if err := decodeJSON(rulesJSON, &ruleset); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+		}
+		ruleDefs, err := json.Marshal(ruleset["rules"])
+		if err != nil {
+			return nil, err
+		}
+		expanded, err := ExpandInventory(ruleDefs, inventory)
+		if err != nil {
+			return nil, err
+		}
+		ruleset["rules"] = json.RawMessage(expanded)
+		return json.Marshal(ruleset)
+	}
+
+	var ruleDefs []interface{}
+	if err := decodeJSON(rulesJSON, &ruleDefs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+	}
+
+	expanded := []interface{}{}
+	for _, def := range ruleDefs {
+		rule, ok := def.(map[string]interface{})
+		if !ok || rule["forEachDevice"] == nil {
+			expanded = append(expanded, def)
+			continue
+		}
+
+		name, _ := rule["name"].(string)
+		selector, ok := rule["forEachDevice"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("rule '%s' has forEachDevice %v, must be an object of attributes", name, rule["forEachDevice"])
+		}
+		template := make(map[string]interface{}, len(rule))
+		for key, value := range rule {
+			if key != "forEachDevice" {
+				template[key] = value
+			}
+		}
+		if !devicePlaceholder.MatchString(name) {
+			template["name"] = name + ": ${device.id}"
+		}
+
+		for _, device := range inventory {
+			if !device.selected(selector) {
+				continue
+			}
+			instance, err := device.substitute(template)
+			if err != nil {
+				return nil, fmt.Errorf("rule '%s': %w", name, err)
+			}
+			expanded = append(expanded, instance)
+		}
+	}
+	return json.Marshal(expanded)
+}
+
+// selected reports whether the device has the attributes of a selector.
+func (d Device) selected(selector map[string]interface{}) bool {
+	for key, want := range selector {
+		value, ok := d.attribute(key)
+		if !ok {
+			return false
+		}
+		normalizedValue, err := NormalizeNumbers(value)
+		if err != nil {
+			return false
+		}
+		normalizedWant, err := NormalizeNumbers(want)
+		if err != nil || !reflect.DeepEqual(normalizedValue, normalizedWant) {
+			return false
+		}
+	}
+	return true
+}
+
+// attribute returns the value a placeholder stands for: the device id or one
+// of its attributes.
+func (d Device) attribute(name string) (interface{}, bool) {
+	if name == "id" {
+		return d.ID, true
+	}
+	value, ok := d.Attributes[name]
+	return value, ok
+}
+
+// substitute returns a copy of a JSON value with the placeholders replaced
+// by the device's attributes.
+func (d Device) substitute(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if match := devicePlaceholder.FindStringSubmatch(v); match != nil && match[0] == v {
+			attribute, ok := d.attribute(match[1])
+			if !ok {
+				return nil, d.missingAttribute(match[1])
+			}
+			return attribute, nil
+		}
+		return d.interpolate(v)
+	case []interface{}:
+		substituted := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if substituted[i], err = d.substitute(item); err != nil {
+				return nil, err
+			}
+		}
+		return substituted, nil
+	case map[string]interface{}:
+		substituted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			substitutedKey, err := d.interpolate(key)
+			if err != nil {
+				return nil, err
+			}
+			if substituted[substitutedKey], err = d.substitute(item); err != nil {
+				return nil, err
+			}
+		}
+		return substituted, nil
+	default:
+		return value, nil
+	}
+}
+
+// interpolate replaces the placeholders within a string by the text of the
+// attributes they stand for: strings as they are, other values as JSON.
+func (d Device) interpolate(text string) (string, error) {
+	var missing []string
+	result := devicePlaceholder.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := devicePlaceholder.FindStringSubmatch(placeholder)[1]
+		attribute, ok := d.attribute(name)
+		if !ok {
+			missing = append(missing, name)
+			return placeholder
+		}
+		if s, ok := attribute.(string); ok {
+			return s
+		}
+		formatted, _ := json.Marshal(attribute)
+		return string(formatted)
+	})
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "", d.missingAttribute(strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+func (d Device) missingAttribute(name string) error {
+	return fmt.Errorf("device '%s' has no attribute %s", d.ID, name)
+}
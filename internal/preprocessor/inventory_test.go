@@ -0,0 +1,121 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const inventoryJSON = `[
+    {"id": "ahu-1", "attributes": {"model": "x200", "zone": "north", "maxTemperature": 28}},
+    {"id": "ahu-2", "attributes": {"model": "x200", "zone": "south", "maxTemperature": 31.5}},
+    {"id": "chiller-1", "attributes": {"model": "c10"}}
+]`
+
+const templatedRules = `[
+    {
+        "name": "overheating",
+        "forEachDevice": {"model": "x200"},
+        "conditions": {"all": [{"fact": "${device.id}:temperature", "operator": "greaterThan", "value": "${device.maxTemperature}"}]},
+        "event": {"actions": [{"type": "updateFact", "target": "${device.id}:alarm", "value": "overheating in ${device.zone}"}]},
+        "consumedFacts": ["${device.id}:temperature"],
+        "producedFacts": ["${device.id}:alarm"]
+    },
+    {
+        "name": "coolDown",
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }
+]`
+
+func TestExpandInventory(t *testing.T) {
+	inventory, err := ParseInventory([]byte(inventoryJSON))
+	require.NoError(t, err)
+
+	expanded, err := ExpandInventory([]byte(templatedRules), inventory)
+	require.NoError(t, err)
+
+	ruleSet, err := ParseAndValidateRules(expanded, rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	require.Len(t, ruleSet, 3)
+
+	byName := make(map[string]*rules.Rule)
+	for _, rule := range ruleSet {
+		byName[rule.Name] = rule
+	}
+	require.Contains(t, byName, "overheating: ahu-1")
+	require.Contains(t, byName, "overheating: ahu-2")
+	require.Contains(t, byName, "coolDown")
+
+	north := byName["overheating: ahu-1"]
+	assert.Equal(t, "ahu-1:temperature", north.Conditions.All[0].Fact)
+	assert.Equal(t, int64(28), north.Conditions.All[0].Value)
+	assert.Equal(t, "ahu-1:alarm", north.Event.Actions[0].Target)
+	assert.Equal(t, "overheating in north", north.Event.Actions[0].Value)
+	assert.Nil(t, north.ForEachDevice)
+
+	south := byName["overheating: ahu-2"]
+	assert.Equal(t, 31.5, south.Conditions.All[0].Value)
+	assert.Equal(t, "overheating in south", south.Event.Actions[0].Value)
+}
+
+func TestExpandInventory_NamedTemplate(t *testing.T) {
+	inventory, err := ParseInventory([]byte(inventoryJSON))
+	require.NoError(t, err)
+
+	expanded, err := ExpandInventory([]byte(`{"rules": [{
+        "name": "${device.id} running",
+        "forEachDevice": {},
+        "conditions": {"all": [{"fact": "${device.id}:running", "operator": "equal", "value": true}]},
+        "event": {"actions": [{"type": "updateFact", "target": "${device.id}:seen", "value": true}]}
+    }]}`), inventory)
+	require.NoError(t, err)
+
+	ruleSet, err := ParseAndValidateRules(expanded, rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	require.Len(t, ruleSet, 3)
+	assert.Equal(t, "ahu-1 running", ruleSet[0].Name)
+	assert.Equal(t, "chiller-1 running", ruleSet[2].Name)
+}
+
+func TestExpandInventory_MissingAttribute(t *testing.T) {
+	inventory, err := ParseInventory([]byte(inventoryJSON))
+	require.NoError(t, err)
+
+	_, err = ExpandInventory([]byte(`[{
+        "name": "overheating",
+        "forEachDevice": {},
+        "conditions": {"all": [{"fact": "${device.id}:temperature", "operator": "greaterThan", "value": "${device.maxTemperature}"}]},
+        "event": {"actions": [{"type": "updateFact", "target": "alarm", "value": true}]}
+    }]`), inventory)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "device 'chiller-1' has no attribute maxTemperature")
+
+	_, err = ExpandInventory([]byte(`[{"name": "overheating", "forEachDevice": "x200"}]`), inventory)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "must be an object of attributes")
+}
+
+func TestParseInventory_Errors(t *testing.T) {
+	tests := []struct {
+		inventory string
+		expected  string
+	}{
+		{`[{"attributes": {"zone": "north"}}]`, "device 1 of the inventory has no id"},
+		{`[{"id": "ahu-1"}, {"id": "ahu-1"}]`, "inventory lists device 'ahu-1' more than once"},
+		{`[{"id": "ahu-1", "attributes": {"id": "other"}}]`, "device 'ahu-1' has an attribute named id"},
+	}
+	for _, tt := range tests {
+		_, err := ParseInventory([]byte(tt.inventory))
+		require.Error(t, err, tt.inventory)
+		assert.Contains(t, err.Error(), tt.expected)
+	}
+}
+
+func TestParseRule_UnexpandedTemplate(t *testing.T) {
+	_, err := ParseAndValidateRules([]byte(templatedRules), rules.NewRuleEngineContext())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rule 'overheating' is a template for the devices of an inventory")
+}
@@ -0,0 +1,463 @@
+// pkg/preprocessor/lint.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"reflect"
+	"rgehrsitz/rex/internal/rules"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Checks of Lint, by the names LintWarning.Check reports and
+// LintOptions.Disabled takes.
+const (
+	LintUnusedProduction   = "unused-production"
+	LintUndefinedInput     = "undefined-input"
+	LintVacuousCondition   = "vacuous-condition"
+	LintDependencyCycle    = "dependency-cycle"
+	LintRedundantCondition = "redundant-condition"
+	LintShadowedRule       = "shadowed-rule"
+	LintPriorityTie        = "priority-tie"
+	LintBroadAny           = "broad-any"
+)
+
+// LintChecks lists the checks of Lint in the order it reports them.
+var LintChecks = []string{
+	LintUnusedProduction,
+	LintUndefinedInput,
+	LintVacuousCondition,
+	LintDependencyCycle,
+	LintRedundantCondition,
+	LintShadowedRule,
+	LintPriorityTie,
+	LintBroadAny,
+}
+
+// DefaultMaxAnyConditions is the number of conditions an any block may have
+// before broad-any reports it, unless LintOptions says otherwise.
+const DefaultMaxAnyConditions = 8
+
+// LintOptions configure Lint.
+type LintOptions struct {
+	Inputs           []string // Facts provided by the host, which rules read without any rule writing them
+	Disabled         []string // Checks to skip, by name
+	MaxAnyConditions int      // Conditions an any block may have before broad-any reports it; 0 means DefaultMaxAnyConditions
+}
+
+// LintWarning is a suspicious but legal pattern found in a ruleset.
+type LintWarning struct {
+	Check   string `json:"check"`
+	Rule    string `json:"rule,omitempty"`
+	Fact    string `json:"fact,omitempty"`
+	Path    string `json:"path,omitempty"` // Block or condition of the rule, e.g. conditions.all[1]
+	Message string `json:"message"`
+}
+
+// Lint reports the patterns of a valid ruleset that are legal but likely
+// mistakes, check by check in the order of LintChecks:
+//
+//   - unused-production: a fact written by rules but read by none
+//   - undefined-input: a fact read by rules but neither written by one nor
+//     listed in Inputs
+//   - vacuous-condition: a block that always or never holds, as
+//     FindVacuousConditions finds
+//   - dependency-cycle: rules depending on each other, as
+//     FindDependencyCycles finds
+//   - redundant-condition: a comparison that another comparison of the same
+//     fact in its block makes pointless, such as temperature > 20 next to
+//     temperature > 30 in an all block
+//   - shadowed-rule: a rule that only writes facts, which a rule running
+//     after it in the same cycle always overwrites when it fires
+//   - priority-tie: rules of equal priority that can fire together and write
+//     different values to a fact, leaving the outcome to their declared order
+//   - broad-any: an any block with more than MaxAnyConditions conditions
+//
+// Comparisons are understood as FindVacuousConditions understands them;
+// rules whose conditions can't be worked out are left out of the checks
+// needing them. Lint fails only if Disabled names an unknown check.
+func Lint(ruleSet []*rules.Rule, options LintOptions) ([]LintWarning, error) {
+	disabled := make(map[string]bool, len(options.Disabled))
+	for _, check := range options.Disabled {
+		if !slices.Contains(LintChecks, check) {
+			return nil, fmt.Errorf("unknown lint check '%s'; checks are %s", check, strings.Join(LintChecks, ", "))
+		}
+		disabled[check] = true
+	}
+	maxAny := options.MaxAnyConditions
+	if maxAny <= 0 {
+		maxAny = DefaultMaxAnyConditions
+	}
+
+	var warnings []LintWarning
+	usage := AnalyzeFactUsage(ruleSet, options.Inputs)
+	if !disabled[LintUnusedProduction] {
+		for _, fact := range usage.UnusedProductions {
+			warnings = append(warnings, LintWarning{
+				Check:   LintUnusedProduction,
+				Fact:    fact,
+				Message: fmt.Sprintf("fact '%s' is produced but not consumed by any rule", fact),
+			})
+		}
+	}
+	if !disabled[LintUndefinedInput] {
+		for _, fact := range usage.UndefinedInputs {
+			warnings = append(warnings, LintWarning{
+				Check:   LintUndefinedInput,
+				Fact:    fact,
+				Message: fmt.Sprintf("fact '%s' is consumed but not produced by any rule or declared as an input", fact),
+			})
+		}
+	}
+	if !disabled[LintVacuousCondition] {
+		for _, vacuous := range FindVacuousConditions(ruleSet) {
+			warnings = append(warnings, LintWarning{
+				Check:   LintVacuousCondition,
+				Rule:    vacuous.Rule,
+				Fact:    vacuous.Fact,
+				Path:    vacuous.Path,
+				Message: vacuous.String(),
+			})
+		}
+	}
+	if !disabled[LintDependencyCycle] {
+		for _, cycle := range FindDependencyCycles(ruleSet) {
+			warnings = append(warnings, LintWarning{Check: LintDependencyCycle, Rule: cycle.Rules[0], Message: cycle.String()})
+		}
+	}
+	if !disabled[LintRedundantCondition] {
+		for _, rule := range ruleSet {
+			warnings = append(warnings, redundantConditions(rule)...)
+		}
+	}
+	shadowed, shadowing := shadowedRules(ruleSet)
+	if !disabled[LintShadowedRule] {
+		warnings = append(warnings, shadowed...)
+	}
+	if !disabled[LintPriorityTie] {
+		warnings = append(warnings, priorityTies(ruleSet, shadowing)...)
+	}
+	if !disabled[LintBroadAny] {
+		for _, rule := range ruleSet {
+			walkBlocks(rule, func(path, key string, conditions []rules.Condition) {
+				if key == "any" && len(conditions) > maxAny {
+					warnings = append(warnings, LintWarning{
+						Check:   LintBroadAny,
+						Rule:    rule.Name,
+						Path:    path,
+						Message: fmt.Sprintf("%s of rule '%s' has %d conditions, more than %d, any of which makes it hold", path, rule.Name, len(conditions), maxAny),
+					})
+				}
+			})
+		}
+	}
+	return warnings, nil
+}
+
+// walkBlocks calls visit with every block of conditions of a rule, nested
+// blocks included, along with its path and key. The all block of a scoring
+// rule, whose conditions add to its score rather than all having to hold, is
+// left out, but not the blocks nested in it.
+func walkBlocks(rule *rules.Rule, visit func(path, key string, conditions []rules.Condition)) {
+	if rule.Scored() {
+		for i, condition := range rule.Conditions.All {
+			if condition.Fact == "" {
+				walkGroup(fmt.Sprintf("conditions.all[%d]", i), condition.All, condition.Any, condition.Not, visit)
+			}
+		}
+		return
+	}
+	walkGroup("conditions", rule.Conditions.All, rule.Conditions.Any, rule.Conditions.Not, visit)
+}
+
+func walkGroup(path string, all, any, not []rules.Condition, visit func(path, key string, conditions []rules.Condition)) {
+	for _, block := range []struct {
+		key        string
+		conditions []rules.Condition
+	}{{"all", all}, {"any", any}, {"not", not}} {
+		if len(block.conditions) == 0 {
+			continue
+		}
+		blockPath := path + "." + block.key
+		visit(blockPath, block.key, block.conditions)
+		for i, condition := range block.conditions {
+			if condition.Fact == "" {
+				walkGroup(fmt.Sprintf("%s[%d]", blockPath, i), condition.All, condition.Any, condition.Not, visit)
+			}
+		}
+	}
+}
+
+// redundantConditions reports the comparisons of a rule that don't change
+// whether their block holds because of another comparison of the same fact
+// in it: in an all or not block, one holding whenever the other does, and in
+// an any block, one only holding when the other does. Of two comparisons
+// accepting the same values, the later one is reported.
+func redundantConditions(rule *rules.Rule) []LintWarning {
+	var found []LintWarning
+	walkBlocks(rule, func(path, key string, conditions []rules.Condition) {
+		redundant := make(map[int]bool)
+		for j, condition := range conditions {
+			for i, other := range conditions {
+				if i == j || redundant[i] {
+					continue
+				}
+				values, otherValues, ok := sameFactValues(condition, other)
+				if !ok {
+					continue
+				}
+				implied := subset(otherValues, values)
+				if key == "any" {
+					implied = subset(values, otherValues)
+				}
+				if !implied || (i > j && subset(values, otherValues) && subset(otherValues, values)) {
+					continue
+				}
+				redundant[j] = true
+				conditionPath, otherPath := fmt.Sprintf("%s[%d]", path, j), fmt.Sprintf("%s[%d]", path, i)
+				reason := fmt.Sprintf("it holds whenever %s does", otherPath)
+				if key == "any" {
+					reason = fmt.Sprintf("%s holds whenever it does", otherPath)
+				}
+				found = append(found, LintWarning{
+					Check:   LintRedundantCondition,
+					Rule:    rule.Name,
+					Fact:    condition.Fact,
+					Path:    conditionPath,
+					Message: fmt.Sprintf("%s of rule '%s' is redundant: %s", conditionPath, rule.Name, reason),
+				})
+				break
+			}
+		}
+	})
+	return found
+}
+
+// sameFactValues returns the values satisfying two comparisons of the same
+// fact, if both are understood and compare values of the same kind.
+func sameFactValues(a, b rules.Condition) (valueSet, valueSet, bool) {
+	if a.Fact == "" || a.Fact != b.Fact || rules.IsFactPattern(a.Fact) {
+		return nil, nil, false
+	}
+	aValues, ok := conditionValues(a)
+	if !ok {
+		return nil, nil, false
+	}
+	bValues, ok := conditionValues(b)
+	if !ok || aValues.kind() != bValues.kind() {
+		return nil, nil, false
+	}
+	return aValues, bValues, true
+}
+
+// allValues returns the values of a fact satisfying the comparisons of it,
+// of the given kind, in an all block; false if there are none.
+func allValues(all []rules.Condition, fact, kind string) (valueSet, bool) {
+	var values valueSet
+	for _, condition := range all {
+		if condition.Fact != fact {
+			continue
+		}
+		set, ok := conditionValues(condition)
+		if !ok || set.kind() != kind {
+			continue
+		}
+		if values == nil {
+			values = set
+		} else {
+			values = values.intersect(set)
+		}
+	}
+	return values, values != nil
+}
+
+// runsAfter reports whether rule a runs after rule b in a cycle: it has a
+// lower priority, or the same and is declared later.
+func runsAfter(ruleSet []*rules.Rule, a, b int) bool {
+	pa, pb := getRulePriority(ruleSet[a]), getRulePriority(ruleSet[b])
+	return pa < pb || pa == pb && a > b
+}
+
+// shadowedRules reports the rules whose actions all write facts that a rule
+// running after them overwrites whenever they fire, so that they have no
+// effect. The overwriting rule must always fire when the shadowed one does:
+// each of its conditions, which must all be top-level comparisons, has to
+// hold for every value the shadowed rule's all conditions accept, and it
+// can't hold, roll out, split into variants or guard its writes. Rules whose
+// writes other rules read are never reported, since those rules can see the
+// value before it is overwritten. It also returns the pairs of rules found,
+// shadowed rule first.
+func shadowedRules(ruleSet []*rules.Rule) ([]LintWarning, map[[2]int]bool) {
+	reads, writes := ruleFacts(ruleSet)
+	var found []LintWarning
+	pairs := make(map[[2]int]bool)
+	for b, rule := range ruleSet {
+		if rule.Scored() || len(writes[b]) == 0 || !onlyWritesFacts(rule) {
+			continue
+		}
+		read := false
+		for k := range ruleSet {
+			if k != b && feedsRule(writes[b], reads[k]) {
+				read = true
+			}
+		}
+		if read {
+			continue
+		}
+		for a, other := range ruleSet {
+			if a == b || !runsAfter(ruleSet, a, b) || !alwaysWrites(other, writes[b]) || !firesWith(other, rule) {
+				continue
+			}
+			pairs[[2]int{b, a}] = true
+			facts := sortedFacts(writes[b])
+			quoted := make([]string, len(facts))
+			for i, fact := range facts {
+				quoted[i] = "'" + fact + "'"
+			}
+			found = append(found, LintWarning{
+				Check:   LintShadowedRule,
+				Rule:    rule.Name,
+				Fact:    facts[0],
+				Message: fmt.Sprintf("rule '%s' has no effect: whenever it fires, rule '%s' runs after it and overwrites %s", rule.Name, other.Name, strings.Join(quoted, ", ")),
+			})
+			break
+		}
+	}
+	return found, pairs
+}
+
+// onlyWritesFacts reports whether a rule has actions and they all write facts.
+func onlyWritesFacts(rule *rules.Rule) bool {
+	actions := ruleActions(rule)
+	for _, action := range actions {
+		if !rules.IsFactUpdate(action) {
+			return false
+		}
+	}
+	return len(actions) > 0
+}
+
+// alwaysWrites reports whether a rule writes each of the facts every time it
+// fires.
+func alwaysWrites(rule *rules.Rule, facts map[string]bool) bool {
+	if rule.Scored() || rule.Held() || rule.Rollout != nil || len(rule.Variants) > 0 {
+		return false
+	}
+	written := make(map[string]bool)
+	for _, action := range rule.Event.Actions {
+		if rules.IsFactUpdate(action) && action.When == nil {
+			written[action.Target] = true
+		}
+	}
+	for fact := range facts {
+		if !written[fact] {
+			return false
+		}
+	}
+	return true
+}
+
+// firesWith reports whether rule a's conditions, which must be top-level
+// comparisons of an all block, hold whenever rule b's do.
+func firesWith(a, b *rules.Rule) bool {
+	if len(a.Conditions.Any) > 0 || len(a.Conditions.Not) > 0 || b.Scored() {
+		return false
+	}
+	for _, condition := range a.Conditions.All {
+		if condition.Fact == "" || rules.IsFactPattern(condition.Fact) {
+			return false
+		}
+		values, ok := conditionValues(condition)
+		if !ok {
+			return false
+		}
+		accepted, ok := allValues(b.Conditions.All, condition.Fact, values.kind())
+		if !ok || !subset(accepted, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// priorityTies reports the pairs of rules of equal priority writing
+// different values to a fact whose conditions can both hold, except those
+// where one rule shadows the other.
+func priorityTies(ruleSet []*rules.Rule, shadowing map[[2]int]bool) []LintWarning {
+	values := make([]map[string][]interface{}, len(ruleSet))
+	for i, rule := range ruleSet {
+		values[i] = make(map[string][]interface{})
+		for _, action := range ruleActions(rule) {
+			if rules.IsFactUpdate(action) {
+				values[i][action.Target] = append(values[i][action.Target], action.Value)
+			}
+		}
+	}
+
+	var found []LintWarning
+	for i, rule := range ruleSet {
+		for j := i + 1; j < len(ruleSet); j++ {
+			other := ruleSet[j]
+			if getRulePriority(rule) != getRulePriority(other) || shadowing[[2]int{i, j}] || shadowing[[2]int{j, i}] {
+				continue
+			}
+			fact, ok := conflictingWrite(values[i], values[j])
+			if !ok || exclusive(rule, other) {
+				continue
+			}
+			found = append(found, LintWarning{
+				Check: LintPriorityTie,
+				Rule:  rule.Name,
+				Fact:  fact,
+				Message: fmt.Sprintf("rules '%s' and '%s' both have priority %d and can fire together, writing different values to '%s': '%s' wins by being declared later",
+					rule.Name, other.Name, getRulePriority(rule), fact, other.Name),
+			})
+		}
+	}
+	return found
+}
+
+// conflictingWrite returns the first fact, in sorted order, that two rules
+// write other than the same single value.
+func conflictingWrite(a, b map[string][]interface{}) (string, bool) {
+	var facts []string
+	for fact, aValues := range a {
+		bValues, ok := b[fact]
+		if !ok {
+			continue
+		}
+		if len(aValues) == 1 && len(bValues) == 1 && reflect.DeepEqual(aValues[0], bValues[0]) {
+			continue
+		}
+		facts = append(facts, fact)
+	}
+	if len(facts) == 0 {
+		return "", false
+	}
+	sort.Strings(facts)
+	return facts[0], true
+}
+
+// exclusive reports whether two rules can't fire together because their all
+// blocks accept no common value of some fact.
+func exclusive(a, b *rules.Rule) bool {
+	if a.Scored() || b.Scored() {
+		return false
+	}
+	for _, condition := range a.Conditions.All {
+		if condition.Fact == "" || rules.IsFactPattern(condition.Fact) {
+			continue
+		}
+		values, ok := conditionValues(condition)
+		if !ok {
+			continue
+		}
+		aValues, _ := allValues(a.Conditions.All, condition.Fact, values.kind())
+		bValues, ok := allValues(b.Conditions.All, condition.Fact, values.kind())
+		if ok && aValues.intersect(bValues).empty() {
+			return true
+		}
+	}
+	return false
+}
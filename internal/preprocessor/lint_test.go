@@ -0,0 +1,175 @@
+package preprocessor
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lintChecks returns the checks of warnings, in order.
+func lintChecks(warnings []LintWarning) []string {
+	var checks []string
+	for _, warning := range warnings {
+		checks = append(checks, warning.Check)
+	}
+	return checks
+}
+
+func TestLint_RedundantCondition(t *testing.T) {
+	ruleSet := []*rules.Rule{{
+		Name: "cool",
+		Conditions: rules.Conditions{
+			All: []rules.Condition{
+				{Fact: "temperature", Operator: "greaterThan", Value: 30},
+				{Fact: "mode", Operator: "notEqual", Value: "off"},
+				{Fact: "temperature", Operator: "greaterThan", Value: 20.0},
+				{Fact: "mode", Operator: "equal", Value: "auto"},
+			},
+			Any: []rules.Condition{
+				{Fact: "humidity", Operator: "greaterThan", Value: 80},
+				{Fact: "humidity", Operator: "greaterThanOrEqual", Value: 60},
+				{All: []rules.Condition{
+					{Fact: "open", Operator: "equal", Value: true},
+					{Fact: "open", Operator: "notEqual", Value: false},
+				}},
+			},
+		},
+		Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "cooling", Value: true}}},
+	}}
+
+	warnings, err := Lint(ruleSet, LintOptions{Disabled: []string{LintUnusedProduction, LintUndefinedInput}})
+	require.NoError(t, err)
+	assert.Equal(t, []LintWarning{
+		{Check: LintRedundantCondition, Rule: "cool", Fact: "mode", Path: "conditions.all[1]",
+			Message: "conditions.all[1] of rule 'cool' is redundant: it holds whenever conditions.all[3] does"},
+		{Check: LintRedundantCondition, Rule: "cool", Fact: "temperature", Path: "conditions.all[2]",
+			Message: "conditions.all[2] of rule 'cool' is redundant: it holds whenever conditions.all[0] does"},
+		{Check: LintRedundantCondition, Rule: "cool", Fact: "humidity", Path: "conditions.any[0]",
+			Message: "conditions.any[0] of rule 'cool' is redundant: conditions.any[1] holds whenever it does"},
+		// Of two comparisons accepting the same values the later one is reported
+		{Check: LintRedundantCondition, Rule: "cool", Fact: "open", Path: "conditions.any[2].all[1]",
+			Message: "conditions.any[2].all[1] of rule 'cool' is redundant: it holds whenever conditions.any[2].all[0] does"},
+	}, warnings)
+}
+
+func TestLint_ShadowedRule(t *testing.T) {
+	alarm := func(name string, priority int, threshold float64, value bool) *rules.Rule {
+		return &rules.Rule{
+			Name:       name,
+			Priority:   priority,
+			Conditions: rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: threshold}}},
+			Event:      rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "alarm", Value: value}}},
+		}
+	}
+	options := LintOptions{Disabled: []string{LintUnusedProduction, LintUndefinedInput}}
+
+	// override runs after high, and fires whenever it does
+	warnings, err := Lint([]*rules.Rule{alarm("high", 10, 40, true), alarm("override", 0, 30, false)}, options)
+	require.NoError(t, err)
+	assert.Equal(t, []LintWarning{{
+		Check:   LintShadowedRule,
+		Rule:    "high",
+		Fact:    "alarm",
+		Message: "rule 'high' has no effect: whenever it fires, rule 'override' runs after it and overwrites 'alarm'",
+	}}, warnings)
+
+	// Running first, override is overwritten by high, which doesn't always
+	// fire with it
+	warnings, err = Lint([]*rules.Rule{alarm("high", 0, 40, true), alarm("override", 10, 30, false)}, options)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	// A rule reading the fact sees the value before it is overwritten
+	reader := dependentRule("siren", 5, []string{"alarm"}, "siren")
+	warnings, err = Lint([]*rules.Rule{alarm("high", 10, 40, true), alarm("override", 0, 30, false), reader}, options)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	// A guarded write may not happen
+	guarded := alarm("override", 0, 30, false)
+	guarded.Event.Actions[0].When = &rules.Conditions{All: []rules.Condition{{Fact: "armed", Operator: "equal", Value: true}}}
+	warnings, err = Lint([]*rules.Rule{alarm("high", 10, 40, true), guarded}, options)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestLint_PriorityTie(t *testing.T) {
+	mode := func(name, fact string, operator string, threshold float64, value string) *rules.Rule {
+		return &rules.Rule{
+			Name:       name,
+			Conditions: rules.Conditions{All: []rules.Condition{{Fact: fact, Operator: operator, Value: threshold}}},
+			Event:      rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "mode", Value: value}}},
+		}
+	}
+	options := LintOptions{Disabled: []string{LintUnusedProduction, LintUndefinedInput}}
+
+	warnings, err := Lint([]*rules.Rule{
+		mode("heat", "temperature", "lessThan", 18, "heat"),
+		mode("dry", "humidity", "greaterThan", 70, "dry"),
+		mode("cool", "temperature", "greaterThan", 26, "cool"),   // Exclusive with heat
+		mode("dehumidify", "humidity", "greaterThan", 80, "dry"), // Same value as dry
+	}, options)
+	require.NoError(t, err)
+	assert.Equal(t, []LintWarning{
+		{Check: LintPriorityTie, Rule: "heat", Fact: "mode",
+			Message: "rules 'heat' and 'dry' both have priority 0 and can fire together, writing different values to 'mode': 'dry' wins by being declared later"},
+		{Check: LintPriorityTie, Rule: "heat", Fact: "mode",
+			Message: "rules 'heat' and 'dehumidify' both have priority 0 and can fire together, writing different values to 'mode': 'dehumidify' wins by being declared later"},
+		{Check: LintPriorityTie, Rule: "dry", Fact: "mode",
+			Message: "rules 'dry' and 'cool' both have priority 0 and can fire together, writing different values to 'mode': 'cool' wins by being declared later"},
+		{Check: LintPriorityTie, Rule: "cool", Fact: "mode",
+			Message: "rules 'cool' and 'dehumidify' both have priority 0 and can fire together, writing different values to 'mode': 'dehumidify' wins by being declared later"},
+	}, warnings)
+
+	// A priority decides between them
+	dry := mode("dry", "humidity", "greaterThan", 70, "dry")
+	dry.Priority = 1
+	warnings, err = Lint([]*rules.Rule{mode("heat", "temperature", "lessThan", 18, "heat"), dry}, options)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestLint_BroadAny(t *testing.T) {
+	rule := &rules.Rule{Name: "any"}
+	for i := 0; i < 4; i++ {
+		rule.Conditions.Any = append(rule.Conditions.Any, rules.Condition{Fact: fmt.Sprintf("sensor%d", i), Operator: "equal", Value: true})
+	}
+	options := LintOptions{Disabled: []string{LintUnusedProduction, LintUndefinedInput}, MaxAnyConditions: 3}
+
+	warnings, err := Lint([]*rules.Rule{rule}, options)
+	require.NoError(t, err)
+	assert.Equal(t, []LintWarning{{
+		Check:   LintBroadAny,
+		Rule:    "any",
+		Path:    "conditions.any",
+		Message: "conditions.any of rule 'any' has 4 conditions, more than 3, any of which makes it hold",
+	}}, warnings)
+
+	options.MaxAnyConditions = 0
+	warnings, err = Lint([]*rules.Rule{rule}, options)
+	require.NoError(t, err)
+	assert.Empty(t, warnings, "Up to DefaultMaxAnyConditions conditions are allowed")
+}
+
+func TestLint_Options(t *testing.T) {
+	ruleSet := []*rules.Rule{
+		dependentRule("cool", 0, []string{"hot"}, "cooling"),
+		dependentRule("heat", 0, []string{"cooling"}, "hot"),
+		dependentRule("fan", 0, []string{"temperature"}, "fan_on"),
+	}
+
+	warnings, err := Lint(ruleSet, LintOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{LintUnusedProduction, LintUndefinedInput, LintDependencyCycle}, lintChecks(warnings))
+	assert.Equal(t, "fact 'temperature' is consumed but not produced by any rule or declared as an input", warnings[1].Message)
+
+	warnings, err = Lint(ruleSet, LintOptions{Inputs: []string{"temperature"}, Disabled: []string{LintDependencyCycle}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{LintUnusedProduction}, lintChecks(warnings))
+
+	_, err = Lint(ruleSet, LintOptions{Disabled: []string{"shadowed-rules"}})
+	assert.ErrorContains(t, err, "unknown lint check 'shadowed-rules'")
+}
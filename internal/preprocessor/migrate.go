@@ -0,0 +1,268 @@
+// pkg/preprocessor/migrate.go
+
+package preprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"slices"
+)
+
+// MigrationChange is a construct of a ruleset written for an earlier version
+// of the engine that MigrateRuleset rewrote, or that needs rewriting by hand.
+type MigrationChange struct {
+	Rule    string `json:"rule,omitempty"` // Rule, state machine or escalation the construct is in
+	Path    string `json:"path"`           // Location within it, e.g. conditions.all[0].operator
+	Message string `json:"message"`
+	Manual  bool   `json:"manual,omitempty"` // Left as it was, needs manual attention
+}
+
+func (c MigrationChange) String() string {
+	location := c.Path
+	if c.Rule != "" {
+		location = fmt.Sprintf("'%s' %s", c.Rule, c.Path)
+	}
+	return fmt.Sprintf("%s: %s", location, c.Message)
+}
+
+// renamedOperators maps the operator names of earlier rule formats, including
+// the symbolic aliases and the names of json-rules-engine rulesets, to the
+// current ones.
+var renamedOperators = map[string]string{
+	"=":                    rules.OperatorEqual,
+	"!=":                   rules.OperatorNotEqual,
+	"<":                    rules.OperatorLessThan,
+	"<=":                   rules.OperatorLessThanOrEqual,
+	">":                    rules.OperatorGreaterThan,
+	">=":                   rules.OperatorGreaterThanOrEqual,
+	"lessThanInclusive":    rules.OperatorLessThanOrEqual,
+	"greaterThanInclusive": rules.OperatorGreaterThanOrEqual,
+	"doesNotContain":       rules.OperatorNotContains,
+}
+
+// unsupportedConditionFields are condition fields of earlier rule formats
+// without an equivalent, with what to do instead.
+var unsupportedConditionFields = map[string]string{
+	"path":      "path selectors aren't supported; write the selected value to a fact of its own",
+	"params":    "condition params aren't supported; write the parameters into the fact or value",
+	"condition": "shared condition references aren't supported; copy the shared condition into the rule",
+}
+
+// MigrateRuleset rewrites a ruleset written for an earlier version of the
+// engine into the current format, and returns it with the changes made and
+// the constructs it couldn't rewrite. Operators are renamed to their current
+// names, updateStore actions become updateFact actions, and events naming the
+// facts to update in parallel facts and values arrays, or written as
+// json-rules-engine type and params, are restructured. The ruleset may be an
+// array of rules or an object with rules, state machines and escalations.
+// Fields MigrateRuleset doesn't know are kept as they are.
+func MigrateRuleset(rulesJSON []byte) ([]byte, []MigrationChange, error) {
+	var ruleset interface{}
+	if err := decodeJSON(rulesJSON, &ruleset); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+	}
+
+	m := &migrator{}
+	switch ruleset := ruleset.(type) {
+	case []interface{}:
+		m.rules(ruleset)
+	case map[string]interface{}:
+		ruleDefs, _ := ruleset["rules"].([]interface{})
+		m.rules(ruleDefs)
+		machines, _ := ruleset["stateMachines"].([]interface{})
+		for _, machine := range objects(machines) {
+			m.stateMachine(machine)
+		}
+		escalations, _ := ruleset["escalations"].([]interface{})
+		for _, escalation := range objects(escalations) {
+			m.escalation(escalation)
+		}
+	default:
+		return nil, nil, fmt.Errorf("a ruleset must be an array of rules or an object")
+	}
+
+	migrated, err := json.MarshalIndent(ruleset, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(migrated, '\n'), m.changes, nil
+}
+
+// migrator collects the changes made while migrating a ruleset.
+type migrator struct {
+	owner   string // Rule, state machine or escalation being migrated
+	changes []MigrationChange
+}
+
+func (m *migrator) rewrote(path, format string, args ...interface{}) {
+	m.changes = append(m.changes, MigrationChange{Rule: m.owner, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (m *migrator) manual(path, format string, args ...interface{}) {
+	m.changes = append(m.changes, MigrationChange{Rule: m.owner, Path: path, Message: fmt.Sprintf(format, args...), Manual: true})
+}
+
+func (m *migrator) rules(ruleDefs []interface{}) {
+	for _, rule := range objects(ruleDefs) {
+		m.owner, _ = rule["name"].(string)
+		m.conditions(rule["conditions"], "conditions")
+		hasActions := false
+		if event, ok := rule["event"].(map[string]interface{}); ok {
+			m.event(event, "event")
+			actions, _ := event["actions"].([]interface{})
+			hasActions = len(actions) > 0
+		}
+		variants, _ := rule["variants"].([]interface{})
+		for i, variant := range objects(variants) {
+			m.actions(variant["actions"], fmt.Sprintf("variants[%d].actions", i))
+			hasActions = true
+		}
+		tests, _ := rule["tests"].([]interface{})
+		for i, test := range objects(tests) {
+			m.actions(test["actions"], fmt.Sprintf("tests[%d].actions", i))
+		}
+		if !hasActions {
+			m.manual("event", "the rule has no actions, so firing it has no effect; add the actions the event stood for")
+		}
+	}
+}
+
+func (m *migrator) stateMachine(machine map[string]interface{}) {
+	m.owner, _ = machine["name"].(string)
+	states, _ := machine["states"].([]interface{})
+	for i, state := range objects(states) {
+		path := fmt.Sprintf("states[%d]", i)
+		m.actions(state["entry"], path+".entry")
+		m.actions(state["exit"], path+".exit")
+		transitions, _ := state["transitions"].([]interface{})
+		for j, transition := range objects(transitions) {
+			transitionPath := fmt.Sprintf("%s.transitions[%d]", path, j)
+			m.conditions(transition["conditions"], transitionPath+".conditions")
+			m.actions(transition["actions"], transitionPath+".actions")
+		}
+	}
+}
+
+func (m *migrator) escalation(escalation map[string]interface{}) {
+	m.owner, _ = escalation["name"].(string)
+	m.conditions(escalation["conditions"], "conditions")
+	steps, _ := escalation["steps"].([]interface{})
+	for i, step := range objects(steps) {
+		m.actions(step["actions"], fmt.Sprintf("steps[%d].actions", i))
+	}
+}
+
+// conditions migrates the all, any and not conditions of a conditions
+// object. A json-rules-engine not negates a single condition, which becomes
+// the only condition of a not block.
+func (m *migrator) conditions(node interface{}, path string) {
+	conditions, ok := node.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if _, ok := conditions["condition"]; ok {
+		m.manual(path+".condition", "%s", unsupportedConditionFields["condition"])
+	}
+	if negated, ok := conditions["not"].(map[string]interface{}); ok {
+		conditions["not"] = []interface{}{negated}
+		m.rewrote(path+".not", "made the negated condition the only condition of a not block")
+	}
+	for _, combinator := range []string{"all", "any", "not"} {
+		nested, _ := conditions[combinator].([]interface{})
+		for i, condition := range objects(nested) {
+			m.condition(condition, fmt.Sprintf("%s.%s[%d]", path, combinator, i))
+		}
+	}
+}
+
+func (m *migrator) condition(condition map[string]interface{}, path string) {
+	if _, ok := condition["all"]; ok {
+		m.conditions(condition, path)
+		return
+	}
+	if _, ok := condition["any"]; ok {
+		m.conditions(condition, path)
+		return
+	}
+	if _, ok := condition["not"]; ok {
+		m.conditions(condition, path)
+		return
+	}
+	for _, field := range []string{"path", "params", "condition"} {
+		if _, ok := condition[field]; ok {
+			m.manual(path+"."+field, "%s", unsupportedConditionFields[field])
+		}
+	}
+	if _, ok := condition["script"]; ok {
+		return
+	}
+
+	operator, _ := condition["operator"].(string)
+	if renamed, ok := renamedOperators[operator]; ok {
+		condition["operator"] = renamed
+		m.rewrote(path+".operator", "renamed operator '%s' to '%s'", operator, renamed)
+		return
+	}
+	if _, custom := rules.CustomOperator(operator); !custom && !slices.Contains(rules.SupportedOperators, operator) {
+		m.manual(path+".operator", "unknown operator '%s'; rewrite the condition or register the operator from a plugin", operator)
+	}
+}
+
+// event restructures the events of earlier rule formats and migrates their
+// actions.
+func (m *migrator) event(event map[string]interface{}, path string) {
+	if eventType, ok := event["type"]; ok {
+		if _, exists := event["eventType"]; !exists {
+			event["eventType"] = eventType
+			delete(event, "type")
+			m.rewrote(path+".type", "moved the event type to eventType")
+		}
+	}
+	if params, ok := event["params"]; ok {
+		if _, exists := event["customProperty"]; !exists {
+			event["customProperty"] = params
+			delete(event, "params")
+			m.rewrote(path+".params", "moved the event params to customProperty")
+		}
+	}
+
+	facts, hasFacts := event["facts"].([]interface{})
+	values, hasValues := event["values"].([]interface{})
+	if hasFacts || hasValues {
+		if len(facts) != len(values) {
+			m.manual(path+".facts", "the event has %d facts but %d values; write an updateFact action for each fact", len(facts), len(values))
+		} else {
+			actions, _ := event["actions"].([]interface{})
+			for i, fact := range facts {
+				actions = append(actions, map[string]interface{}{"type": rules.ActionUpdateFact, "target": fact, "value": values[i]})
+			}
+			event["actions"] = actions
+			delete(event, "facts")
+			delete(event, "values")
+			m.rewrote(path+".facts", "replaced the event's facts and values with %d updateFact actions", len(facts))
+		}
+	}
+	m.actions(event["actions"], path+".actions")
+}
+
+func (m *migrator) actions(node interface{}, path string) {
+	actions, _ := node.([]interface{})
+	for i, action := range objects(actions) {
+		if action["type"] == rules.ActionUpdateStore {
+			action["type"] = rules.ActionUpdateFact
+			m.rewrote(fmt.Sprintf("%s[%d].type", path, i), "renamed action type '%s' to '%s'", rules.ActionUpdateStore, rules.ActionUpdateFact)
+		}
+	}
+}
+
+// objects returns the elements of a JSON array that are objects.
+func objects(values []interface{}) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, value := range values {
+		if object, ok := value.(map[string]interface{}); ok {
+			result = append(result, object)
+		}
+	}
+	return result
+}
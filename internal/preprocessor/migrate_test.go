@@ -0,0 +1,104 @@
+package preprocessor
+
+import (
+	"encoding/json"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateRuleset(t *testing.T) {
+	legacy := `[
+        {
+            "name": "coolDown",
+            "conditions": {"all": [
+                {"fact": "temperature", "operator": ">=", "value": 30},
+                {"any": [{"fact": "mode", "operator": "doesNotContain", "value": "eco"}]}
+            ]},
+            "event": {
+                "type": "cooling",
+                "params": {"level": 2},
+                "facts": ["fan_status"],
+                "values": [true],
+                "actions": [{"type": "updateStore", "target": "ac_status", "value": true}]
+            },
+            "owner": "facilities"
+        }
+    ]`
+
+	migrated, changes, err := MigrateRuleset([]byte(legacy))
+	require.NoError(t, err)
+	for _, change := range changes {
+		assert.False(t, change.Manual, change.String())
+	}
+	assert.Contains(t, changes, MigrationChange{Rule: "coolDown", Path: "conditions.all[0].operator", Message: "renamed operator '>=' to 'greaterThanOrEqual'"})
+	assert.Len(t, changes, 6)
+
+	ruleSet, err := ParseAndValidateRules(migrated, rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	rule := ruleSet[0]
+	assert.Equal(t, rules.OperatorGreaterThanOrEqual, rule.Conditions.All[0].Operator)
+	assert.Equal(t, rules.OperatorNotContains, rule.Conditions.All[1].Any[0].Operator)
+	assert.Equal(t, "cooling", rule.Event.EventType)
+	assert.Equal(t, map[string]interface{}{"level": int64(2)}, rule.Event.CustomProperty)
+	assert.Equal(t, []rules.Action{
+		{Type: rules.ActionUpdateFact, Target: "ac_status", Value: true},
+		{Type: rules.ActionUpdateFact, Target: "fan_status", Value: true},
+	}, rule.Event.Actions)
+	assert.Equal(t, "facilities", rule.Metadata["owner"], "unknown fields are kept")
+
+	// A current ruleset is left unchanged
+	again, changes, err := MigrateRuleset(migrated)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	assert.JSONEq(t, string(migrated), string(again))
+}
+
+func TestMigrateRuleset_Manual(t *testing.T) {
+	legacy := `{
+        "rules": [
+            {
+                "name": "nested",
+                "conditions": {"all": [{"fact": "order", "path": "$.total", "operator": "between", "value": [1, 5]}]},
+                "event": {"type": "big-order"}
+            }
+        ],
+        "escalations": [
+            {
+                "name": "overheat",
+                "conditions": {"condition": "overheated", "not": {"fact": "temperature", "operator": "<", "value": 30}},
+                "steps": [{"actions": [{"type": "updateStore", "target": "alarm", "value": true}]}]
+            }
+        ]
+    }`
+
+	migrated, changes, err := MigrateRuleset([]byte(legacy))
+	require.NoError(t, err)
+	var manual []string
+	for _, change := range changes {
+		if change.Manual {
+			manual = append(manual, change.String())
+		}
+	}
+	assert.Equal(t, []string{
+		"'nested' conditions.all[0].path: path selectors aren't supported; write the selected value to a fact of its own",
+		"'nested' conditions.all[0].operator: unknown operator 'between'; rewrite the condition or register the operator from a plugin",
+		"'nested' event: the rule has no actions, so firing it has no effect; add the actions the event stood for",
+		"'overheat' conditions.condition: shared condition references aren't supported; copy the shared condition into the rule",
+	}, manual)
+	assert.Contains(t, changes, MigrationChange{Rule: "overheat", Path: "conditions.not", Message: "made the negated condition the only condition of a not block"})
+	assert.Contains(t, changes, MigrationChange{Rule: "overheat", Path: "conditions.not[0].operator", Message: "renamed operator '<' to 'lessThan'"})
+	var ruleset struct {
+		Escalations []struct {
+			Conditions map[string]json.RawMessage `json:"conditions"`
+		} `json:"escalations"`
+	}
+	require.NoError(t, json.Unmarshal(migrated, &ruleset))
+	assert.JSONEq(t, `[{"fact": "temperature", "operator": "lessThan", "value": 30}]`, string(ruleset.Escalations[0].Conditions["not"]))
+	assert.Contains(t, changes, MigrationChange{Rule: "overheat", Path: "steps[0].actions[0].type", Message: "renamed action type 'updateStore' to 'updateFact'"})
+
+	_, _, err = MigrateRuleset([]byte(`"rules"`))
+	assert.ErrorContains(t, err, "must be an array of rules or an object")
+}
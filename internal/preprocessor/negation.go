@@ -0,0 +1,141 @@
+// pkg/preprocessor/negation.go
+
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+
+	"github.com/rs/zerolog/log"
+)
+
+// complementOperators maps operators to the operator that holds exactly when
+// they don't. The ordering operators have no complement: NaN is neither less
+// than nor greater than or equal to a number.
+var complementOperators = map[string]string{
+	rules.OperatorEqual:       rules.OperatorNotEqual,
+	rules.OperatorNotEqual:    rules.OperatorEqual,
+	rules.OperatorContains:    rules.OperatorNotContains,
+	rules.OperatorNotContains: rules.OperatorContains,
+	rules.OperatorIn:          rules.OperatorNotIn,
+	rules.OperatorNotIn:       rules.OperatorIn,
+	rules.OperatorExists:      rules.OperatorNotExists,
+	rules.OperatorNotExists:   rules.OperatorExists,
+}
+
+// pushDownNegations rewrites the not blocks of rules with De Morgan's laws,
+// so that the compiler can evaluate them without negating them:
+//
+//   - not [a, b] becomes a and b if the not block holds a single nested
+//     block of not conditions [a, b]
+//   - not [a, b] becomes any [a', b'] where a' is the complement of a, such
+//     as x notEqual 1 for x equal 1, if the block has no any conditions of
+//     its own; otherwise the any block of complements is nested in all
+//   - not [any [a, b]] becomes a' and b'
+//
+// A not block is only rewritten if every condition in it has a complement.
+// Scripts, fact patterns, orderings and custom operators have none.
+func pushDownNegations(ruleSet []*rules.Rule) []*rules.Rule {
+	result := make([]*rules.Rule, len(ruleSet))
+	for i, rule := range ruleSet {
+		all, any, not, changed := pushDownBlockNegations(rule.Conditions.All, rule.Conditions.Any, rule.Conditions.Not)
+		if !changed {
+			result[i] = rule
+			continue
+		}
+		rewritten := *rule
+		rewritten.Conditions = rules.Conditions{All: all, Any: any, Not: not}
+		result[i] = &rewritten
+		log.Debug().Str("rule", rule.Name).Msg("Negated conditions pushed down")
+	}
+	return result
+}
+
+// pushDownBlockNegations rewrites the not conditions of a block and of the
+// blocks nested in it, returning the block's conditions and whether any were
+// rewritten. The conditions passed in are left unchanged.
+func pushDownBlockNegations(all, any, not []rules.Condition) ([]rules.Condition, []rules.Condition, []rules.Condition, bool) {
+	all, allChanged := pushDownNestedNegations(all)
+	any, anyChanged := pushDownNestedNegations(any)
+	not, notChanged := pushDownNestedNegations(not)
+	changed := allChanged || anyChanged || notChanged
+
+	switch {
+	case len(not) == 0:
+		return all, any, not, changed
+	case len(not) == 1 && isBlockOf(not[0], "not"):
+		return append(all[:len(all):len(all)], not[0].Not...), any, nil, true
+	}
+
+	if complements, ok := complementConditions(not); ok {
+		switch {
+		case len(complements) == 1:
+			return append(all[:len(all):len(all)], complements[0]), any, nil, true
+		case len(any) == 0:
+			return all, complements, nil, true
+		default:
+			return append(all[:len(all):len(all)], rules.Condition{Any: complements}), any, nil, true
+		}
+	}
+	if len(not) == 1 && isBlockOf(not[0], "any") {
+		if complements, ok := complementConditions(not[0].Any); ok {
+			return append(all[:len(all):len(all)], complements...), any, nil, true
+		}
+	}
+	return all, any, not, changed
+}
+
+// pushDownNestedNegations rewrites the not conditions of the blocks nested
+// in a list of conditions, returning a copy of the list if any changed.
+func pushDownNestedNegations(conditions []rules.Condition) ([]rules.Condition, bool) {
+	var rewritten []rules.Condition
+	for i, condition := range conditions {
+		if !condition.IsBlock() {
+			continue
+		}
+		all, any, not, changed := pushDownBlockNegations(condition.All, condition.Any, condition.Not)
+		if !changed {
+			continue
+		}
+		if rewritten == nil {
+			rewritten = append([]rules.Condition{}, conditions...)
+		}
+		rewritten[i].All, rewritten[i].Any, rewritten[i].Not = all, any, not
+	}
+	if rewritten == nil {
+		return conditions, false
+	}
+	return rewritten, true
+}
+
+// isBlockOf reports whether a condition is a nested block of only all, any
+// or not conditions.
+func isBlockOf(condition rules.Condition, key string) bool {
+	if condition.Fact != "" || condition.Script != "" {
+		return false
+	}
+	lengths := map[string]int{"all": len(condition.All), "any": len(condition.Any), "not": len(condition.Not)}
+	for block, length := range lengths {
+		if (length > 0) != (block == key) {
+			return false
+		}
+	}
+	return true
+}
+
+// complementConditions returns the complement of each condition, if they all
+// have one.
+func complementConditions(conditions []rules.Condition) ([]rules.Condition, bool) {
+	complements := make([]rules.Condition, len(conditions))
+	for i, condition := range conditions {
+		if condition.IsBlock() || condition.Script != "" || rules.IsFactPattern(condition.Fact) {
+			return nil, false
+		}
+		complement, ok := complementOperators[NormalizeOperator(condition.Operator)]
+		if !ok {
+			return nil, false
+		}
+		complements[i] = condition
+		complements[i].Operator = complement
+	}
+	return complements, true
+}
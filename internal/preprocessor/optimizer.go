@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"reflect"
 	"rgehrsitz/rex/internal/rules"
+	"slices"
 	"sort"
 
 	"github.com/rs/zerolog/log"
@@ -13,6 +14,8 @@ import (
 
 // OptimizeRules optimizes a slice of validated rules.
 // OptimizeRules now also accepts a pointer to RuleEngineContext
+// The rules are returned in execution order: by descending priority, with rules
+// of equal priority in the order they were declared.
 func OptimizeRules(validatedRules []*rules.Rule, context *rules.RuleEngineContext) ([]*rules.Rule, error) {
 	// Optimization logic remains mostly unchanged
 	// You can now utilize 'context' for optimizations
@@ -29,8 +32,12 @@ func OptimizeRules(validatedRules []*rules.Rule, context *rules.RuleEngineContex
 	}
 	optimizedRules = prioritizeRules(optimizedRules)
 	optimizedRules = simplifyConditions(optimizedRules)
+	optimizedRules = pushDownNegations(optimizedRules)
 	optimizedRules = precomputeExpressions(optimizedRules)
-	optimizedRules = analyzeDependencies(optimizedRules)
+	optimizedRules, err = runOptimizerPasses(optimizedRules, context)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Info().Msg("Rule optimization completed successfully")
 	log.Debug().Int("originalCount", len(validatedRules)).Int("optimizedCount", len(optimizedRules)).Msg("Rules merged")
@@ -38,7 +45,9 @@ func OptimizeRules(validatedRules []*rules.Rule, context *rules.RuleEngineContex
 	return optimizedRules, nil
 }
 
-// Placeholder functions for various optimization strategies:
+// prioritizeRules orders rules by descending priority. Rules of equal priority
+// keep their relative order, which mergeRules leaves as declared, so they
+// execute in declaration order.
 func prioritizeRules(rulesToPrioritize []*rules.Rule) []*rules.Rule {
 	// Create a copy of the rules slice to avoid modifying the original
 	prioritizedRules := make([]*rules.Rule, len(rulesToPrioritize))
@@ -68,16 +77,16 @@ func getRulePriority(r *rules.Rule) int {
 func simplifyConditions(rulesToSimplify []*rules.Rule) []*rules.Rule {
 	simplifiedRules := make([]*rules.Rule, 0, len(rulesToSimplify))
 	for _, rule := range rulesToSimplify {
+		if rule.Scored() {
+			// Every condition of a scoring rule counts, duplicates included
+			simplifiedRules = append(simplifiedRules, rule)
+			continue
+		}
 		simplifiedConditions := simplifyRuleConditions(rule.Conditions)
 		if !equalConditions(simplifiedConditions, rule.Conditions) {
-			simplifiedRule := &rules.Rule{
-				Name:          rule.Name,
-				Priority:      rule.Priority,
-				Conditions:    simplifiedConditions,
-				Event:         rule.Event,
-				ProducedFacts: rule.ProducedFacts,
-				ConsumedFacts: rule.ConsumedFacts,
-			}
+			simplifiedRule := new(rules.Rule)
+			*simplifiedRule = *rule
+			simplifiedRule.Conditions = simplifiedConditions
 			simplifiedRules = append(simplifiedRules, simplifiedRule)
 			log.Debug().Str("rule", simplifiedRule.Name).Msg("Condition simplified")
 
@@ -92,6 +101,7 @@ func simplifyRuleConditions(conditions rules.Conditions) rules.Conditions {
 	simplified := rules.Conditions{
 		All: simplifyAndDedupConditions(conditions.All),
 		Any: simplifyAndDedupConditions(conditions.Any),
+		Not: simplifyAndDedupConditions(conditions.Not),
 	}
 	return simplified
 }
@@ -114,8 +124,14 @@ func simplifyCondition(condition rules.Condition) rules.Condition {
 		Operator:  condition.Operator,
 		Value:     condition.Value,
 		ValueType: condition.ValueType,
+		Match:     condition.Match,
+		Epsilon:   condition.Epsilon,
+		Script:    condition.Script,
+		Facts:     condition.Facts,
 		All:       simplifyAndDedupConditions(condition.All),
 		Any:       simplifyAndDedupConditions(condition.Any),
+		Not:       simplifyAndDedupConditions(condition.Not),
+		Metadata:  condition.Metadata,
 	}
 
 	// Example logical simplification: Identify redundant or overlapping conditions.
@@ -153,7 +169,10 @@ func performLogicalSimplification(condition rules.Condition) rules.Condition {
 	var newAll []rules.Condition
 	seenFacts := make(map[string]bool)
 	for _, cond := range condition.All {
-		if _, seen := seenFacts[cond.Fact]; !seen {
+		if cond.Script != "" {
+			// A script condition has no fact of its own
+			newAll = append(newAll, cond)
+		} else if _, seen := seenFacts[cond.Fact]; !seen {
 			newAll = append(newAll, cond)
 			seenFacts[cond.Fact] = true
 		} // Else, it's a redundant condition and can be omitted.
@@ -167,15 +186,24 @@ func performLogicalSimplification(condition rules.Condition) rules.Condition {
 
 func containsCondition(conditions []rules.Condition, condition rules.Condition) bool {
 	for _, c := range conditions {
-		if equalCondition(c, condition) {
+		if sameCondition(c, condition) {
 			return true
 		}
 	}
 	return false
 }
 
+// sameCondition reports whether two conditions are equal, comparing the
+// blocks nested in them too, which equalCondition leaves out.
+func sameCondition(c1, c2 rules.Condition) bool {
+	return equalCondition(c1, c2) &&
+		slices.EqualFunc(c1.All, c2.All, sameCondition) &&
+		slices.EqualFunc(c1.Any, c2.Any, sameCondition) &&
+		slices.EqualFunc(c1.Not, c2.Not, sameCondition)
+}
+
 func equalConditions(c1, c2 rules.Conditions) bool {
-	if len(c1.All) != len(c2.All) || len(c1.Any) != len(c2.Any) {
+	if len(c1.All) != len(c2.All) || len(c1.Any) != len(c2.Any) || len(c1.Not) != len(c2.Not) {
 		return false
 	}
 	for i := range c1.All {
@@ -188,6 +216,11 @@ func equalConditions(c1, c2 rules.Conditions) bool {
 			return false
 		}
 	}
+	for i := range c1.Not {
+		if !equalCondition(c1.Not[i], c2.Not[i]) {
+			return false
+		}
+	}
 	return true
 }
 
@@ -195,6 +228,10 @@ func equalCondition(c1, c2 rules.Condition) bool {
 	return c1.Fact == c2.Fact &&
 		c1.Operator == c2.Operator &&
 		c1.ValueType == c2.ValueType &&
+		c1.Match == c2.Match &&
+		reflect.DeepEqual(c1.Epsilon, c2.Epsilon) &&
+		c1.Script == c2.Script &&
+		slices.Equal(c1.Facts, c2.Facts) &&
 		reflect.DeepEqual(c1.Value, c2.Value)
 }
 
@@ -211,17 +248,35 @@ func precomputeExpressions(rules []*rules.Rule) []*rules.Rule {
 	return rules
 }
 
-func analyzeDependencies(rules []*rules.Rule) []*rules.Rule {
-	return rules
-}
-
-// mergeRules combines rules with identical conditions.
+// mergeRules combines rules with identical conditions and priority that would
+// run one after the other. Rules are only merged when no other rule of the same
+// priority was declared between them, so merging never changes the order in
+// which actions execute, and the remaining rules keep their declared order.
 func mergeRules(rulesToMerge []*rules.Rule) ([]*rules.Rule, error) {
 	// A map to identify and combine rules with identical conditions
 	mergedRules := make(map[string]*rules.Rule)
+	// The key of the last rule kept at each priority
+	lastKeys := make(map[int]string)
+	var optimizedRules []*rules.Rule
 	for _, rule := range rulesToMerge {
 		key, _ := conditionsKey(rule.Conditions)
-		if existingRule, found := mergedRules[key]; found {
+		// Merging rules of different priorities would move the actions of one
+		// of them to the other's place in the execution order
+		key += fmt.Sprintf("|priority:%d", getRulePriority(rule))
+		// The entities a rolled out or A/B tested rule applies to depend on
+		// its name, so it can't be merged with another rule
+		if rule.Rollout != nil || len(rule.Variants) > 0 {
+			key += "|entities:" + rule.Name
+		}
+		// Each rule with a duration times its conditions on its own
+		if rule.Held() {
+			key += "|hold:" + rule.Name
+		}
+		// Each scoring rule writes a score of its own
+		if rule.Scored() {
+			key += "|score:" + rule.Name
+		}
+		if existingRule, found := mergedRules[key]; found && lastKeys[getRulePriority(rule)] == key {
 			// Merge actions from the current rule into the existing rule
 			existingRule.Event.Actions = append(existingRule.Event.Actions, rule.Event.Actions...)
 			existingRule.ProducedFacts = append(existingRule.ProducedFacts, rule.ProducedFacts...)
@@ -229,16 +284,13 @@ func mergeRules(rulesToMerge []*rules.Rule) ([]*rules.Rule, error) {
 			log.Debug().Str("rule", rule.Name).Msg("Rule merged")
 
 		} else {
-			// If this set of conditions hasn't been seen before, add the rule to the map
+			// Otherwise keep the rule at its declared position
 			mergedRules[key] = rule
+			lastKeys[getRulePriority(rule)] = key
+			optimizedRules = append(optimizedRules, rule)
 		}
 	}
 
-	// Convert the map back to a slice
-	var optimizedRules []*rules.Rule
-	for _, rule := range mergedRules {
-		optimizedRules = append(optimizedRules, rule)
-	}
 	return optimizedRules, nil
 }
 
@@ -277,7 +329,13 @@ func normalizeConditions(conds rules.Conditions) (rules.Conditions, error) {
 		return rules.Conditions{}, err
 	}
 
-	return rules.Conditions{All: sortedAll, Any: sortedAny}, nil
+	// Normalize 'Not' conditions
+	sortedNot, err := sortConditions(conds.Not)
+	if err != nil {
+		return rules.Conditions{}, err
+	}
+
+	return rules.Conditions{All: sortedAll, Any: sortedAny, Not: sortedNot}, nil
 }
 
 // sortConditions sorts conditions and their nested conditions.
@@ -294,6 +352,12 @@ func sortConditions(conditions []rules.Condition) ([]rules.Condition, error) {
 		if conditions[i].ValueType != conditions[j].ValueType {
 			return conditions[i].ValueType < conditions[j].ValueType
 		}
+		if conditions[i].Match != conditions[j].Match {
+			return conditions[i].Match < conditions[j].Match
+		}
+		if conditions[i].Script != conditions[j].Script {
+			return conditions[i].Script < conditions[j].Script
+		}
 
 		// Custom comparison for Value based on ValueType
 		return compareValues(conditions[i].Value, conditions[j].Value, conditions[i].ValueType)
@@ -301,13 +365,14 @@ func sortConditions(conditions []rules.Condition) ([]rules.Condition, error) {
 
 	// Recursively sort nested conditions
 	for i, cond := range conditions {
-		if len(cond.All) > 0 || len(cond.Any) > 0 {
-			sortedNestedConds, err := normalizeConditions(rules.Conditions{All: cond.All, Any: cond.Any})
+		if cond.IsBlock() {
+			sortedNestedConds, err := normalizeConditions(rules.Conditions{All: cond.All, Any: cond.Any, Not: cond.Not})
 			if err != nil {
 				log.Error().Err(err).Msg("Error sorting conditions")
 			}
 			conditions[i].All = sortedNestedConds.All
 			conditions[i].Any = sortedNestedConds.Any
+			conditions[i].Not = sortedNestedConds.Not
 		}
 	}
 
@@ -319,12 +384,11 @@ func compareValues(v1, v2 interface{}, valueType string) bool {
 	// Perform a type switch to determine how to compare the values
 	switch valueType {
 	case "int":
-		val1, ok1 := v1.(int)
-		val2, ok2 := v2.(int)
-		if !ok1 || !ok2 {
+		less, ok := integerLess(v1, v2)
+		if !ok {
 			return false // Default to false if types do not match expectations
 		}
-		return val1 < val2
+		return less
 	case "float":
 		val1, ok1 := v1.(float64)
 		val2, ok2 := v2.(float64)
@@ -352,3 +416,35 @@ func compareValues(v1, v2 interface{}, valueType string) bool {
 		return false
 	}
 }
+
+// integerLess reports whether v1 < v2 for integers decoded as int, int64 or
+// uint64, comparing exactly even when the values don't fit in the same type.
+func integerLess(v1, v2 interface{}) (bool, bool) {
+	signed := func(v interface{}) (int64, bool) {
+		switch i := v.(type) {
+		case int:
+			return int64(i), true
+		case int64:
+			return i, true
+		}
+		return 0, false
+	}
+
+	u1, unsigned1 := v1.(uint64)
+	u2, unsigned2 := v2.(uint64)
+	i1, signed1 := signed(v1)
+	i2, signed2 := signed(v2)
+
+	switch {
+	case signed1 && signed2:
+		return i1 < i2, true
+	case unsigned1 && unsigned2:
+		return u1 < u2, true
+	case signed1 && unsigned2:
+		return i1 < 0 || uint64(i1) < u2, true
+	case unsigned1 && signed2:
+		return i2 >= 0 && u1 < uint64(i2), true
+	default:
+		return false, false
+	}
+}
@@ -1,6 +1,8 @@
 package preprocessor
 
 import (
+	"fmt"
+	"math/rand"
 	"rgehrsitz/rex/internal/rules"
 	"testing"
 
@@ -308,3 +310,216 @@ func TestGetRulePriority(t *testing.T) {
 		})
 	}
 }
+
+func TestMergeRules_KeepsDeclarationOrder(t *testing.T) {
+	hot := rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30, ValueType: "int"}}}
+	cold := rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "lessThan", Value: 10, ValueType: "int"}}}
+	action := func(target string) rules.Event {
+		return rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: target, Value: true}}}
+	}
+	ruleSet := []*rules.Rule{
+		{Name: "A", Conditions: hot, Event: action("a")},
+		{Name: "B", Conditions: hot, Event: action("b")},
+		{Name: "C", Conditions: cold, Event: action("c")},
+		{Name: "D", Conditions: hot, Event: action("d")},
+		{Name: "E", Conditions: hot, Priority: 1, Event: action("e")},
+	}
+
+	merged, err := mergeRules(ruleSet)
+	assert.NoError(t, err)
+
+	var names []string
+	for _, rule := range merged {
+		names = append(names, rule.Name)
+	}
+	// B directly follows A and is merged into it. D isn't, as that would run
+	// its actions before C's, and E has a different priority.
+	assert.Equal(t, []string{"A", "C", "D", "E"}, names)
+	assert.Len(t, merged[0].Event.Actions, 2)
+	assert.Equal(t, "b", merged[0].Event.Actions[1].Target)
+}
+
+// TestOptimizeRules_OrderIsStable checks on random rulesets that optimized
+// rules come out by descending priority, with rules of equal priority in
+// declaration order, and that optimizing the same ruleset twice gives the same
+// result.
+func TestOptimizeRules_OrderIsStable(t *testing.T) {
+	generate := func(seed int64) []*rules.Rule {
+		random := rand.New(rand.NewSource(seed))
+		var ruleSet []*rules.Rule
+		for i := random.Intn(12); i >= 0; i-- {
+			// Conditions are drawn from a few thresholds so that rules merge
+			ruleSet = append(ruleSet, &rules.Rule{
+				Name:     fmt.Sprintf("rule%d", len(ruleSet)),
+				Priority: random.Intn(3),
+				Conditions: rules.Conditions{All: []rules.Condition{
+					{Fact: "temperature", Operator: "greaterThan", Value: random.Intn(2), ValueType: "int"},
+				}},
+				Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: fmt.Sprintf("fact%d", len(ruleSet)), Value: true}}},
+			})
+		}
+		return ruleSet
+	}
+
+	for seed := int64(0); seed < 500; seed++ {
+		optimized, err := OptimizeRules(generate(seed), rules.NewRuleEngineContext())
+		assert.NoError(t, err)
+
+		var targets []string
+		for i, rule := range optimized {
+			if i > 0 {
+				previous := optimized[i-1]
+				assert.True(t, previous.Priority > rule.Priority ||
+					previous.Priority == rule.Priority && declarationIndex(previous) < declarationIndex(rule),
+					"seed %d: %s runs before %s", seed, previous.Name, rule.Name)
+			}
+			for _, action := range rule.Event.Actions {
+				targets = append(targets, action.Target)
+			}
+		}
+
+		// Every action runs exactly once, in the order of its declaring rule
+		declared := prioritizeRules(generate(seed))
+		var expected []string
+		for _, rule := range declared {
+			expected = append(expected, rule.Event.Actions[0].Target)
+		}
+		assert.Equal(t, expected, targets, "seed %d", seed)
+
+		again, err := OptimizeRules(generate(seed), rules.NewRuleEngineContext())
+		assert.NoError(t, err)
+		assert.Equal(t, optimized, again, "seed %d", seed)
+	}
+}
+
+func declarationIndex(rule *rules.Rule) int {
+	var index int
+	fmt.Sscanf(rule.Name, "rule%d", &index)
+	return index
+}
+
+func TestOptimizeRules_KeepsEpsilon(t *testing.T) {
+	epsilon := 0.1
+	ruleSet := []*rules.Rule{{
+		Name: "comfortable",
+		Conditions: rules.Conditions{All: []rules.Condition{
+			{Fact: "temperature", Operator: "equal", Value: 21.5, Epsilon: &epsilon},
+		}},
+		Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "comfortable", Value: true}}},
+	}}
+
+	optimized, err := OptimizeRules(ruleSet, rules.NewRuleEngineContext())
+	assert.NoError(t, err)
+	assert.Equal(t, &epsilon, optimized[0].Conditions.All[0].Epsilon)
+}
+
+func TestOptimizeRules_KeepsScoringConditions(t *testing.T) {
+	weight := 2.0
+	conditions := rules.Conditions{All: []rules.Condition{
+		{Fact: "amount", Operator: "greaterThan", Value: 1000},
+		{Fact: "amount", Operator: "greaterThan", Value: 1000, Weight: &weight},
+	}}
+	actions := []rules.Action{{Type: "updateFact", Target: "review", Value: true}}
+	ruleSet := []*rules.Rule{
+		{Name: "risk", Score: &rules.Score{Fact: "risk", Threshold: 3}, Conditions: conditions, Event: rules.Event{Actions: actions}},
+		{Name: "risk2", Score: &rules.Score{Fact: "risk2", Threshold: 3}, Conditions: conditions, Event: rules.Event{Actions: actions}},
+	}
+
+	optimized, err := OptimizeRules(ruleSet, rules.NewRuleEngineContext())
+	assert.NoError(t, err)
+	assert.Len(t, optimized, 2, "scoring rules aren't merged")
+	assert.Equal(t, conditions, optimized[0].Conditions, "duplicate conditions add to the score")
+}
+
+func TestPushDownNegations(t *testing.T) {
+	weekend := rules.Condition{Fact: "weekend", Operator: "equal", Value: true}
+	notWeekend := rules.Condition{Fact: "weekend", Operator: "notEqual", Value: true}
+	holiday := rules.Condition{Fact: "holiday", Operator: "equal", Value: true}
+	notHoliday := rules.Condition{Fact: "holiday", Operator: "notEqual", Value: true}
+	hot := rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 30}
+	occupied := rules.Condition{Fact: "occupied", Operator: "exists"}
+
+	testCases := []struct {
+		name       string
+		conditions rules.Conditions
+		expected   rules.Conditions
+	}{
+		{
+			"single condition",
+			rules.Conditions{All: []rules.Condition{hot}, Not: []rules.Condition{weekend}},
+			rules.Conditions{All: []rules.Condition{hot, notWeekend}},
+		},
+		{
+			"conjunction becomes a disjunction",
+			rules.Conditions{All: []rules.Condition{hot}, Not: []rules.Condition{weekend, holiday}},
+			rules.Conditions{All: []rules.Condition{hot}, Any: []rules.Condition{notWeekend, notHoliday}},
+		},
+		{
+			"disjunction nested next to any conditions",
+			rules.Conditions{Any: []rules.Condition{hot, occupied}, Not: []rules.Condition{weekend, holiday}},
+			rules.Conditions{All: []rules.Condition{{Any: []rules.Condition{notWeekend, notHoliday}}}, Any: []rules.Condition{hot, occupied}},
+		},
+		{
+			"negated disjunction",
+			rules.Conditions{Not: []rules.Condition{{Any: []rules.Condition{weekend, holiday}}}},
+			rules.Conditions{All: []rules.Condition{notWeekend, notHoliday}},
+		},
+		{
+			"double negation",
+			rules.Conditions{All: []rules.Condition{hot}, Not: []rules.Condition{{Not: []rules.Condition{weekend, holiday}}}},
+			rules.Conditions{All: []rules.Condition{hot, weekend, holiday}},
+		},
+		{
+			"nested block",
+			rules.Conditions{Any: []rules.Condition{hot, {Not: []rules.Condition{weekend}}}},
+			rules.Conditions{Any: []rules.Condition{hot, {All: []rules.Condition{notWeekend}}}},
+		},
+		{
+			"numeric ordering has no complement",
+			rules.Conditions{All: []rules.Condition{weekend}, Not: []rules.Condition{hot}},
+			rules.Conditions{All: []rules.Condition{weekend}, Not: []rules.Condition{hot}},
+		},
+	}
+	for _, tc := range testCases {
+		rule := &rules.Rule{Name: "workday", Conditions: tc.conditions}
+		pushed := pushDownNegations([]*rules.Rule{rule})
+		assert.Equal(t, tc.expected, pushed[0].Conditions, tc.name)
+		assert.Equal(t, tc.conditions, rule.Conditions, "%s: the rule passed in is unchanged", tc.name)
+	}
+}
+
+func TestOptimizeRules_KeepsDistinctNestedBlocks(t *testing.T) {
+	ruleSet := []*rules.Rule{{
+		Name: "workday",
+		Conditions: rules.Conditions{All: []rules.Condition{
+			{Fact: "temperature", Operator: "greaterThan", Value: 30},
+			{Fact: "temperature", Operator: "greaterThan", Value: 30},
+			{Any: []rules.Condition{{Fact: "occupied", Operator: "exists"}, {Fact: "mode", Operator: "equal", Value: "eco"}}},
+			{Any: []rules.Condition{{Fact: "weekend", Operator: "equal", Value: false}, {Fact: "mode", Operator: "equal", Value: "away"}}},
+		}},
+		Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "cooling", Value: true}}},
+	}}
+
+	optimized, err := OptimizeRules(ruleSet, rules.NewRuleEngineContext())
+	assert.NoError(t, err)
+	assert.Len(t, optimized[0].Conditions.All, 3, "only the duplicate comparison is dropped")
+}
+
+func TestMergeRules_DistinguishesNotConditions(t *testing.T) {
+	rule := func(name string, negated interface{}) *rules.Rule {
+		return &rules.Rule{
+			Name: name,
+			Conditions: rules.Conditions{
+				All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30}},
+				Not: []rules.Condition{{Fact: "mode", Operator: "equal", Value: negated}},
+			},
+			Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: name, Value: true}}},
+		}
+	}
+
+	merged, err := mergeRules([]*rules.Rule{rule("eco", "eco"), rule("eco2", "eco"), rule("away", "away")})
+	assert.NoError(t, err)
+	assert.Len(t, merged, 2, "rules with different not conditions aren't merged")
+	assert.Len(t, merged[0].Event.Actions, 2)
+	assert.Equal(t, "away", merged[1].Name)
+}
@@ -0,0 +1,185 @@
+// pkg/preprocessor/overlay.go
+
+package preprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Overlay is a named set of patches applied to a base ruleset, typically
+// loaded from a per-environment file such as rules.prod.json.
+//
+// An overlay file is a JSON array of rule patches. Each patch identifies the
+// rule it applies to by name and is merged into it: objects are merged key by
+// key, arrays are merged element by element (extra elements are appended),
+// null removes a key, and any other value replaces the base value. A patch
+// containing "disabled": true removes the rule from the ruleset.
+type Overlay struct {
+	Name string // Used in conflict reports, usually the file path
+	JSON []byte
+}
+
+// OverlayPath returns the path of the overlay for env next to the base rules
+// file, e.g. rules.json and "prod" give rules.prod.json.
+func OverlayPath(rulesPath, env string) string {
+	ext := filepath.Ext(rulesPath)
+	return strings.TrimSuffix(rulesPath, ext) + "." + env + ext
+}
+
+// overlayValue records which overlay set a value at a path.
+type overlayValue struct {
+	overlay string
+	value   interface{}
+}
+
+// ApplyOverlays merges the overlays into the JSON array of rules in rulesJSON
+// and returns the merged array. It fails if a patch names a rule that doesn't
+// exist, or if two patches set the same field of a rule to different values.
+// All conflicts are reported together. In a ruleset written as an object,
+// the overlays apply to its "rules"; the rest of the object is left as it is.
+func ApplyOverlays(rulesJSON []byte, overlays ...Overlay) ([]byte, error) {
+	if isRulesetObject(rulesJSON) {
+		var ruleset map[string]interface{}
+		if err := decodeJSON(rulesJSON, &ruleset); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+		}
+		ruleDefs, err := json.Marshal(ruleset["rules"])
+		if err != nil {
+			return nil, err
+		}
+		merged, err := ApplyOverlays(ruleDefs, overlays...)
+		if err != nil {
+			return nil, err
+		}
+		ruleset["rules"] = json.RawMessage(merged)
+		return json.Marshal(ruleset)
+	}
+
+	var ruleDefs []interface{}
+	if err := decodeJSON(rulesJSON, &ruleDefs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+	}
+
+	ruleIndex := make(map[string]int)
+	for i, def := range ruleDefs {
+		if rule, ok := def.(map[string]interface{}); ok {
+			if name, ok := rule["name"].(string); ok && name != "" {
+				ruleIndex[name] = i
+			}
+		}
+	}
+
+	setValues := make(map[string]overlayValue)
+	var conflicts []string
+	disabled := make(map[int]bool)
+
+	for _, overlay := range overlays {
+		var patches []map[string]interface{}
+		if err := decodeJSON(overlay.JSON, &patches); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal overlay %s: %w", overlay.Name, err)
+		}
+
+		for _, patch := range patches {
+			name, _ := patch["name"].(string)
+			index, ok := ruleIndex[name]
+			if !ok {
+				return nil, fmt.Errorf("overlay %s patches unknown rule '%s'", overlay.Name, name)
+			}
+
+			for _, leaf := range patchLeaves(name, patch) {
+				previous, seen := setValues[leaf.path]
+				if seen && !reflect.DeepEqual(previous.value, leaf.value) {
+					conflicts = append(conflicts, fmt.Sprintf("%s is set to %v by %s and to %v by %s",
+						leaf.path, previous.value, previous.overlay, leaf.value, overlay.Name))
+					continue
+				}
+				setValues[leaf.path] = overlayValue{overlay: overlay.Name, value: leaf.value}
+			}
+
+			if isDisabled, _ := patch["disabled"].(bool); isDisabled {
+				disabled[index] = true
+			}
+			delete(patch, "disabled")
+			ruleDefs[index] = mergePatch(ruleDefs[index], patch)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, fmt.Errorf("conflicting overlays: %s", strings.Join(conflicts, "; "))
+	}
+
+	var merged []interface{}
+	for i, def := range ruleDefs {
+		if !disabled[i] {
+			merged = append(merged, def)
+		}
+	}
+	if merged == nil {
+		merged = []interface{}{}
+	}
+	return json.Marshal(merged)
+}
+
+// mergePatch merges patch into base and returns the result.
+func mergePatch(base, patch interface{}) interface{} {
+	switch p := patch.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			b = make(map[string]interface{})
+		}
+		for key, value := range p {
+			if value == nil {
+				delete(b, key)
+				continue
+			}
+			b[key] = mergePatch(b[key], value)
+		}
+		return b
+	case []interface{}:
+		b, _ := base.([]interface{})
+		for i, value := range p {
+			if i < len(b) {
+				b[i] = mergePatch(b[i], value)
+			} else {
+				b = append(b, value)
+			}
+		}
+		return b
+	default:
+		return patch
+	}
+}
+
+// patchLeaf is a single value set by a patch.
+type patchLeaf struct {
+	path  string
+	value interface{}
+}
+
+// patchLeaves lists the values a patch sets, keyed by their path within the
+// named rule, e.g. coolDown.conditions.all[0].value.
+func patchLeaves(path string, patch interface{}) []patchLeaf {
+	switch p := patch.(type) {
+	case map[string]interface{}:
+		var leaves []patchLeaf
+		for key, value := range p {
+			leaves = append(leaves, patchLeaves(path+"."+key, value)...)
+		}
+		return leaves
+	case []interface{}:
+		var leaves []patchLeaf
+		for i, value := range p {
+			leaves = append(leaves, patchLeaves(fmt.Sprintf("%s[%d]", path, i), value)...)
+		}
+		return leaves
+	default:
+		return []patchLeaf{{path: path, value: patch}}
+	}
+}
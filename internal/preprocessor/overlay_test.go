@@ -0,0 +1,71 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const overlayBaseRules = `[
+    {
+        "name": "coolDown",
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    },
+    {
+        "name": "debugDump",
+        "conditions": {"all": [{"fact": "debug", "operator": "equal", "value": true}]},
+        "event": {"actions": [{"type": "updateFact", "target": "dump", "value": true}]}
+    }
+]`
+
+func TestApplyOverlays(t *testing.T) {
+	prod := Overlay{Name: "rules.prod.json", JSON: []byte(`[
+        {"name": "coolDown", "priority": 5, "conditions": {"all": [{"value": 35}]}, "event": {"actions": [{"target": "ac_status"}]}},
+        {"name": "debugDump", "disabled": true}
+    ]`)}
+
+	merged, err := ApplyOverlays([]byte(overlayBaseRules), prod)
+	require.NoError(t, err)
+
+	ruleSet, err := ParseAndValidateRules(merged, rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	require.Len(t, ruleSet, 1)
+
+	rule := ruleSet[0]
+	assert.Equal(t, "coolDown", rule.Name)
+	assert.Equal(t, 5, rule.Priority)
+	assert.Equal(t, "temperature", rule.Conditions.All[0].Fact)
+	assert.Equal(t, int64(35), rule.Conditions.All[0].Value)
+	assert.Equal(t, "ac_status", rule.Event.Actions[0].Target)
+	assert.Equal(t, true, rule.Event.Actions[0].Value)
+}
+
+func TestApplyOverlays_UnknownRule(t *testing.T) {
+	overlay := Overlay{Name: "rules.prod.json", JSON: []byte(`[{"name": "heatUp", "priority": 1}]`)}
+
+	_, err := ApplyOverlays([]byte(overlayBaseRules), overlay)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "heatUp")
+}
+
+func TestApplyOverlays_Conflicts(t *testing.T) {
+	first := Overlay{Name: "a.json", JSON: []byte(`[{"name": "coolDown", "conditions": {"all": [{"value": 35}]}}]`)}
+	second := Overlay{Name: "b.json", JSON: []byte(`[{"name": "coolDown", "conditions": {"all": [{"value": 40}]}}]`)}
+
+	_, err := ApplyOverlays([]byte(overlayBaseRules), first, second)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "coolDown.conditions.all[0].value")
+	assert.Contains(t, err.Error(), "a.json")
+	assert.Contains(t, err.Error(), "b.json")
+
+	// Setting the same value twice is not a conflict
+	_, err = ApplyOverlays([]byte(overlayBaseRules), first, first)
+	assert.NoError(t, err)
+}
+
+func TestOverlayPath(t *testing.T) {
+	assert.Equal(t, "config/rules.prod.json", OverlayPath("config/rules.json", "prod"))
+}
@@ -3,11 +3,17 @@
 package preprocessor
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
 	"rgehrsitz/rex/internal/rules"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
@@ -15,57 +21,411 @@ import (
 // parseAndValidateRules parses a JSON array of rules and validates each rule.
 // ParseAndValidateRules now accepts a RuleEngineContext parameter.
 func ParseAndValidateRules(rulesJSON []byte, context *rules.RuleEngineContext) ([]*rules.Rule, error) {
-	// Function implementation remains mostly unchanged
+	return ParseAndValidateRulesWithOptions(rulesJSON, context, ParseOptions{})
+}
+
+// ParseAndValidateRulesWithOptions parses and validates a JSON array of rules using the given options.
+// A ruleset with state machines or escalations is an object holding the
+// rules, the machines and the escalations, which are lowered into rules
+// following the others; the initial states of the machines are recorded in
+// the context's InitialFacts. The facts it declares read-only are recorded in
+// the context's ReadOnlyFacts, and no rule may write them.
+func ParseAndValidateRulesWithOptions(rulesJSON []byte, context *rules.RuleEngineContext, options ParseOptions) ([]*rules.Rule, error) {
 	log.Info().Msg("Starting the parser")
-	var ruleDefs []json.RawMessage
-	if err := json.Unmarshal(rulesJSON, &ruleDefs); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+	locator := &errorLocator{data: rulesJSON}
+	if !isRulesetObject(rulesJSON) {
+		locator.root = "rules"
+	}
+	ruleset, err := splitRuleset(rulesJSON, options)
+	if err != nil {
+		return nil, &RulesetError{Errors: []*RuleError{locator.locate(err, "", "", false)}}
 	}
 
-	var validatedRules []*rules.Rule
-	for _, rJSON := range ruleDefs {
-		// Pass context to ParseRule
-		rule, err := ParseRule(rJSON, context)
+	// Each rule definition is located at the rule, state machine or
+	// escalation it was written as
+	var problems []*RuleError
+	ruleDefs := ruleset.Rules
+	sources := make([]string, len(ruleDefs))
+	for i := range sources {
+		sources[i] = fmt.Sprintf("rules[%d]", i)
+	}
+	authored := len(ruleDefs)
+	for i := range ruleset.StateMachines {
+		machine := &ruleset.StateMachines[i]
+		lowered, err := LowerStateMachine(machine)
 		if err != nil {
-			return nil, err
+			problems = append(problems, locator.locate(err, "", fmt.Sprintf("stateMachines[%d]", i), false))
+			continue
+		}
+		ruleDefs = append(ruleDefs, lowered...)
+		for range lowered {
+			sources = append(sources, fmt.Sprintf("stateMachines[%d]", i))
+		}
+		context.InitialFacts[machine.StateFact()] = machine.Initial
+	}
+	for i := range ruleset.Escalations {
+		lowered, err := LowerEscalation(&ruleset.Escalations[i])
+		if err != nil {
+			problems = append(problems, locator.locate(err, "", fmt.Sprintf("escalations[%d]", i), false))
+			continue
+		}
+		ruleDefs = append(ruleDefs, lowered...)
+		for range lowered {
+			sources = append(sources, fmt.Sprintf("escalations[%d]", i))
+		}
+	}
+
+	var validatedRules []*rules.Rule
+	for i, rJSON := range ruleDefs {
+		rule, errs := parseRule(rJSON, context, options)
+		for _, err := range errs {
+			name := ""
+			if rule != nil {
+				name = rule.Name
+			}
+			problems = append(problems, locator.locate(err, name, sources[i], i >= authored))
+		}
+		if len(errs) > 0 {
+			continue
+		}
+		if i >= authored {
+			declareFacts(rule)
 		}
 		validatedRules = append(validatedRules, rule)
 	}
+	if len(problems) > 0 {
+		return nil, &RulesetError{Errors: problems}
+	}
+
+	// Check the rules against each other
+	err = validateReadOnlyFacts(validatedRules, ruleset.ReadOnlyFacts)
+	if err == nil && options.Strictness != StrictnessBasic {
+		// Check that actions write values other rules can compare
+		err = validateActionValueTypes(validatedRules)
+	}
+	if err != nil {
+		var ruleErr *ruleNameError
+		if errors.As(err, &ruleErr) {
+			for i, rule := range validatedRules {
+				if rule.Name == ruleErr.rule {
+					return nil, &RulesetError{Errors: []*RuleError{locator.locate(ruleErr.err, rule.Name, sources[i], i >= authored)}}
+				}
+			}
+		}
+		return nil, &RulesetError{Errors: []*RuleError{locator.locate(err, "", "", false)}}
+	}
+	context.ReadOnlyFacts = ruleset.ReadOnlyFacts
 
 	return validatedRules, nil
 }
 
+// validateReadOnlyFacts checks that the read-only facts are well formed and
+// that no rule writes one of them.
+func validateReadOnlyFacts(ruleSet []*rules.Rule, readOnly []string) error {
+	for i, fact := range readOnly {
+		path := fmt.Sprintf("readOnlyFacts[%d]", i)
+		if fact == "" {
+			return atPath(path, fmt.Errorf("read-only facts can't include an empty name"))
+		}
+		if err := validateFactPattern(&rules.Condition{Fact: fact}); err != nil {
+			return atPath(path, err)
+		}
+	}
+	for _, rule := range ruleSet {
+		for _, write := range ruleFactWrites(rule) {
+			if rules.MatchAnyFact(readOnly, write.fact) {
+				return &ruleNameError{rule: rule.Name, err: fmt.Errorf("rule '%s' writes read-only fact '%s'", rule.Name, write.fact)}
+			}
+		}
+	}
+	return nil
+}
+
+// declareFacts fills in the facts a rule consumes and produces from its
+// conditions and actions, for rules generated rather than written by hand.
+// Fact patterns aren't declared.
+func declareFacts(rule *rules.Rule) {
+	reads, writes := ruleFacts([]*rules.Rule{rule})
+	for _, fact := range sortedFacts(reads[0]) {
+		if !rules.IsFactPattern(fact) {
+			rule.ConsumedFacts = append(rule.ConsumedFacts, fact)
+		}
+	}
+	rule.ProducedFacts = sortedFacts(writes[0])
+}
+
+// rulesetObject is a ruleset written as an object, holding the rules written
+// by hand and the constructs lowered into rules.
+type rulesetObject struct {
+	Rules         []json.RawMessage `json:"rules"`
+	StateMachines []StateMachine    `json:"stateMachines"`
+	Escalations   []Escalation      `json:"escalations"`
+	ReadOnlyFacts []string          `json:"readOnlyFacts"` // Facts, or fact patterns, only the host writes
+}
+
+// splitRuleset returns the rules, state machines, escalations and read-only
+// facts of a ruleset, which is either a JSON array of rules or an object with
+// "rules", "stateMachines", "escalations" and "readOnlyFacts".
+func splitRuleset(rulesJSON []byte, options ParseOptions) (*rulesetObject, error) {
+	ruleset := &rulesetObject{}
+	if !isRulesetObject(rulesJSON) {
+		if err := json.Unmarshal(rulesJSON, &ruleset.Rules); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+		}
+		return ruleset, nil
+	}
+
+	var err error
+	if options.rejectUnknownFields() {
+		err = decodeJSONStrict(rulesJSON, ruleset)
+	} else {
+		err = decodeJSON(rulesJSON, ruleset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+	}
+	names := make(map[string]bool)
+	for i, machine := range ruleset.StateMachines {
+		if names[machine.Name] {
+			return nil, atPath(fmt.Sprintf("stateMachines[%d].name", i), fmt.Errorf("two state machines are named '%s'", machine.Name))
+		}
+		names[machine.Name] = true
+	}
+	names = make(map[string]bool)
+	for i, escalation := range ruleset.Escalations {
+		if names[escalation.Name] {
+			return nil, atPath(fmt.Sprintf("escalations[%d].name", i), fmt.Errorf("two escalations are named '%s'", escalation.Name))
+		}
+		names[escalation.Name] = true
+	}
+	return ruleset, nil
+}
+
+// RuleNames returns the names of the rules written in a ruleset, by their
+// position in it, without validating them, so that problems found at a
+// rules[i] path can be attributed to a rule even when the ruleset doesn't
+// parse. A rule without a name, or that isn't an object, has an empty name.
+// A ruleset that isn't valid JSON has none.
+func RuleNames(rulesJSON []byte) []string {
+	ruleset, err := splitRuleset(rulesJSON, ParseOptions{Mode: ParseModePermissive})
+	if err != nil {
+		return nil
+	}
+	names := make([]string, len(ruleset.Rules))
+	for i, ruleJSON := range ruleset.Rules {
+		var rule struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(ruleJSON, &rule) == nil {
+			names[i] = rule.Name
+		}
+	}
+	return names
+}
+
+// isRulesetObject reports whether a ruleset is written as an object rather
+// than as an array of rules.
+func isRulesetObject(rulesJSON []byte) bool {
+	trimmed := bytes.TrimSpace(rulesJSON)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
 // ParseRule now accepts a RuleEngineContext parameter to update consumed facts.
 func ParseRule(ruleJSON []byte, context *rules.RuleEngineContext) (*rules.Rule, error) {
+	return ParseRuleWithOptions(ruleJSON, context, ParseOptions{})
+}
+
+// ParseRuleWithOptions parses and validates a single rule using the given options.
+func ParseRuleWithOptions(ruleJSON []byte, context *rules.RuleEngineContext, options ParseOptions) (*rules.Rule, error) {
+	rule, errs := parseRule(ruleJSON, context, options)
+	if len(errs) == 0 {
+		return rule, nil
+	}
+	locator := &errorLocator{data: ruleJSON}
+	ruleErr := &RulesetError{}
+	for _, err := range errs {
+		name := ""
+		if rule != nil {
+			name = rule.Name
+		}
+		ruleErr.Errors = append(ruleErr.Errors, locator.locate(err, name, "", false))
+	}
+	return nil, ruleErr
+}
+
+// parseRule parses and validates a single rule, returning every problem
+// found. The rule is returned, if it could be decoded, even if invalid, so
+// that the problems can be attributed to it.
+func parseRule(ruleJSON []byte, context *rules.RuleEngineContext, options ParseOptions) (*rules.Rule, []error) {
 	var rule rules.Rule
-	err := json.Unmarshal(ruleJSON, &rule)
+	var err error
+	if options.rejectUnknownFields() {
+		err = decodeJSONStrict(ruleJSON, &rule)
+	} else {
+		err = decodeJSON(ruleJSON, &rule)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse rule JSON: %w", err)
+		return nil, []error{fmt.Errorf("failed to parse rule JSON: %w", err)}
+	}
+	if !options.rejectUnknownFields() {
+		if err = collectUnknownFields(ruleJSON, &rule); err != nil {
+			return nil, []error{fmt.Errorf("failed to parse rule JSON: %w", err)}
+		}
+	}
+	if err = normalizeRuleNumbers(&rule); err != nil {
+		return &rule, []error{err}
+	}
+	if rule.ForEachDevice != nil {
+		return &rule, []error{atPath("forEachDevice", fmt.Errorf("rule '%s' is a template for the devices of an inventory; expand it with an inventory first", rule.Name))}
 	}
 
 	log.Debug().Interface("rule", rule).Msg("Parsed rule JSON")
 
 	// Validate that the rule has conditions
-	if len(rule.Conditions.All) == 0 && len(rule.Conditions.Any) == 0 {
-		return nil, fmt.Errorf("a rule must have at least one condition")
+	var errs []error
+	if len(rule.Conditions.All) == 0 && len(rule.Conditions.Any) == 0 && len(rule.Conditions.Not) == 0 {
+		errs = append(errs, atPath("conditions", fmt.Errorf("a rule must have at least one condition")))
+	}
+
+	// Validate the conditions of the rule. The conditions of a scoring rule
+	// add to its score rather than all having to hold, so they may overlap
+	// or contradict each other.
+	strictness := options.Strictness
+	if rule.Scored() {
+		strictness = StrictnessBasic
 	}
+	errs = append(errs, validateConditions("conditions", &rule.Conditions, strictness)...)
+	errs = append(errs, validateActionGuards(&rule, options.Strictness)...)
 
-	// Validate the conditions of the rule
-	if err = validateConditions(&rule.Conditions); err != nil {
-		return nil, err
+	if err = validateRollout(&rule); err != nil {
+		errs = append(errs, atPath("rollout", err))
+	}
+	if err = validateVariants(&rule); err != nil {
+		errs = append(errs, atPath("variants", err))
+	}
+	if err = validateHold(&rule); err != nil {
+		errs = append(errs, atPath("for", err))
+	}
+	if err = validateScore(&rule); err != nil {
+		errs = append(errs, atPath("score", err))
+	}
+	if err = validateTests(&rule); err != nil {
+		errs = append(errs, atPath("tests", err))
+	}
+	if err = validateScripts(&rule, options.Scripts); err != nil {
+		errs = append(errs, err)
+	}
+	if err = validateWebhooks(&rule); err != nil {
+		errs = append(errs, err)
+	}
+	if err = validateActionDelays(&rule); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return &rule, errs
 	}
 
 	// New logic to update context with consumed facts
 	updateConsumedFacts(&rule, context)
-	log.Debug().Msg("Successfully updated consumed facts in context")
+	updateProducedFacts(&rule, context)
+	log.Debug().Msg("Successfully updated consumed and produced facts in context")
 
 	return &rule, nil
 }
 
 // updateConsumedFacts traverses rule conditions and updates the context with consumed facts.
 func updateConsumedFacts(rule *rules.Rule, context *rules.RuleEngineContext) {
-	traverseConditions(rule.Conditions.All, context)
-	traverseConditions(rule.Conditions.Any, context)
+	for _, conditions := range ruleConditionBlocks(rule) {
+		traverseConditions(conditions.All, context)
+		traverseConditions(conditions.Any, context)
+		traverseConditions(conditions.Not, context)
+	}
+	if rule.Rollout != nil && rule.RolloutKey != "" {
+		context.ConsumedFacts[rule.RolloutKey] = true
+	}
+	if len(rule.Variants) > 0 && rule.VariantKey != "" {
+		context.ConsumedFacts[rule.VariantKey] = true
+	}
+	for _, action := range ruleActions(rule) {
+		for _, fact := range action.Facts {
+			context.ConsumedFacts[fact] = true
+		}
+		for _, fact := range webhookFacts(action) {
+			context.ConsumedFacts[fact] = true
+		}
+	}
+}
+
+// validateRollout checks the rollout settings of a rule.
+func validateRollout(rule *rules.Rule) error {
+	if rule.Rollout == nil {
+		return nil
+	}
+	if *rule.Rollout < 0 || *rule.Rollout > 100 {
+		return fmt.Errorf("rule '%s' has rollout %d, must be between 0 and 100", rule.Name, *rule.Rollout)
+	}
+	if rule.RolloutKey == "" {
+		return fmt.Errorf("rule '%s' has a rollout but no rolloutKey", rule.Name)
+	}
+	return nil
+}
+
+// validateHold checks the duration a rule's conditions must hold for.
+func validateHold(rule *rules.Rule) error {
+	duration, err := rule.HoldDuration()
+	if err != nil {
+		return fmt.Errorf("rule '%s' has an invalid duration '%s': %w", rule.Name, rule.For, err)
+	}
+	if duration < 0 || duration > bytecode.MaxHoldDuration {
+		return fmt.Errorf("rule '%s' has duration %s, must be between 0 and %s", rule.Name, rule.For, bytecode.MaxHoldDuration)
+	}
+	return nil
+}
+
+// validateVariants checks the A/B variants of a rule.
+func validateVariants(rule *rules.Rule) error {
+	if len(rule.Variants) == 0 {
+		return nil
+	}
+	if rule.VariantKey == "" {
+		return fmt.Errorf("rule '%s' has variants but no variantKey", rule.Name)
+	}
+	if len(rule.Event.Actions) > 0 {
+		return fmt.Errorf("rule '%s' has both event actions and variants", rule.Name)
+	}
+
+	names := make(map[string]bool)
+	for _, variant := range rule.Variants {
+		if variant.Name == "" {
+			return fmt.Errorf("rule '%s' has a variant without a name", rule.Name)
+		}
+		if names[variant.Name] {
+			return fmt.Errorf("rule '%s' has more than one variant named '%s'", rule.Name, variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.Weight < 0 {
+			return fmt.Errorf("variant '%s' of rule '%s' has a negative weight", variant.Name, rule.Name)
+		}
+	}
+	return nil
+}
+
+// validateTests checks the tests of a rule. Tests of a rule with variants
+// that expect actions must name the variant they assume.
+func validateTests(rule *rules.Rule) error {
+	for i, test := range rule.Tests {
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if test.Variant != "" && !slices.ContainsFunc(rule.Variants, func(v rules.Variant) bool { return v.Name == test.Variant }) {
+			return fmt.Errorf("test %s of rule '%s' assumes unknown variant '%s'", name, rule.Name, test.Variant)
+		}
+		if test.Variant == "" && len(rule.Variants) > 0 && len(test.Actions) > 0 {
+			return fmt.Errorf("test %s of rule '%s' expects actions but doesn't name a variant", name, rule.Name)
+		}
+	}
+	return nil
 }
 
 // traverseConditions recursively traverses a slice of conditions,
@@ -76,64 +436,119 @@ func traverseConditions(conditions []rules.Condition, context *rules.RuleEngineC
 		if cond.Fact != "" {
 			context.ConsumedFacts[cond.Fact] = true
 		}
-		// Recursively process nested 'All' and 'Any' conditions.
+		for _, fact := range cond.Facts {
+			context.ConsumedFacts[fact] = true
+		}
+		// Recursively process nested 'All', 'Any' and 'Not' conditions.
 		traverseConditions(cond.All, context)
 		traverseConditions(cond.Any, context)
+		traverseConditions(cond.Not, context)
 	}
 }
 
-// validateConditions recursively validates all conditions in a Conditions struct.
-func validateConditions(conditions *rules.Conditions) error {
-	for _, cond := range conditions.All {
-		if err := validateCondition(&cond); err != nil {
-			return err
+// validateConditions recursively validates all conditions in a Conditions
+// struct, found at path in the rule, returning an error for each invalid
+// condition.
+func validateConditions(path string, conditions *rules.Conditions, strictness Strictness) []error {
+	var errs []error
+	check := func(block string, conds []rules.Condition) {
+		for i, cond := range conds {
+			if err := validateCondition(&cond); err != nil {
+				errs = append(errs, atPath(fmt.Sprintf("%s.%s[%d]", path, block, i), err))
+			}
 		}
 	}
-	for _, cond := range conditions.Any {
-		if err := validateCondition(&cond); err != nil {
-			return err
-		}
+	check("all", conditions.All)
+	check("any", conditions.Any)
+	check("not", conditions.Not)
+	if len(errs) > 0 {
+		return errs
 	}
 
+	if strictness == StrictnessBasic {
+		return nil
+	}
+	if err := checkConditionBlock(conditions.All, conditions.Any, conditions.Not, strictness == StrictnessParanoid); err != nil {
+		return []error{atPath(path, err)}
+	}
+	return nil
+}
+
+// checkConditionBlock rejects redundant, contradictory and ambiguous
+// conditions in a block and, if nested is set, in the blocks nested in it.
+func checkConditionBlock(all, any, not []rules.Condition, nested bool) error {
 	// Check for redundant conditions
-	if hasRedundantConditions(conditions.All) {
+	if hasRedundantConditions(all) {
 		return errors.New("redundant conditions found in 'All' block")
 	}
-	if hasRedundantConditions(conditions.Any) {
+	if hasRedundantConditions(any) {
 		return errors.New("redundant conditions found in 'Any' block")
 	}
+	if hasRedundantConditions(not) {
+		return errors.New("redundant conditions found in 'Not' block")
+	}
 
 	// Check for contradictory conditions
-	if hasContradictoryConditions(conditions.All) {
+	if hasContradictoryConditions(all) {
 		return errors.New("contradictory conditions found in 'All' block")
 	}
-	if hasContradictoryConditions(conditions.Any) {
+	if hasContradictoryConditions(any) {
 		return errors.New("contradictory conditions found in 'Any' block")
 	}
+	// The conditions of a not block are negated together, so ones that can't
+	// all hold make it always hold
+	if hasContradictoryConditions(not) {
+		return errors.New("contradictory conditions found in 'Not' block")
+	}
 
-	if hasAmbiguousConditions(conditions.Any) {
+	if hasAmbiguousConditions(any) {
 		return errors.New("ambiguous conditions found in 'Any' block")
 	}
 
+	if nested {
+		for _, cond := range append(append(append([]rules.Condition{}, all...), any...), not...) {
+			if cond.IsBlock() {
+				if err := checkConditionBlock(cond.All, cond.Any, cond.Not, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	return nil
 }
 
 // validateCondition validates a single Condition struct.
 func validateCondition(condition *rules.Condition) error {
+	// Script conditions are checked by validateScripts
+	if condition.Script != "" {
+		return nil
+	}
 
 	// Skip type inference and typecasting for nested conditions without Fact and Value
 	if condition.Fact == "" && condition.Value == nil {
 		// Validate nested 'All' conditions
-		if err := validateNestedConditions(condition.All); err != nil {
+		if err := validateNestedConditions("all", condition.All); err != nil {
 			return err
 		}
 		// Validate nested 'Any' conditions
-		if err := validateNestedConditions(condition.Any); err != nil {
+		if err := validateNestedConditions("any", condition.Any); err != nil {
+			return err
+		}
+		// Validate nested 'Not' conditions
+		if err := validateNestedConditions("not", condition.Not); err != nil {
 			return err
 		}
 		return nil
 	}
 
+	if rules.IsExistenceOperator(NormalizeOperator(condition.Operator)) {
+		return validateExistence(condition)
+	}
+
+	if err := validateList(condition); err != nil {
+		return err
+	}
+
 	// Infer and assign ValueType if not explicitly provided
 	if condition.ValueType == "" {
 		inferredType := getTypeString(condition.Value)
@@ -142,11 +557,16 @@ func validateCondition(condition *rules.Condition) error {
 		// Typecast the value based on the inferred type
 		switch inferredType {
 		case "int":
-			floatValue, ok := condition.Value.(float64)
-			if !ok {
+			switch v := condition.Value.(type) {
+			case float64:
+				condition.Value = int64(v)
+			case int64, uint64:
+				// Already decoded as an exact integer
+			case []interface{}:
+				// Lists keep their elements as decoded
+			default:
 				return fmt.Errorf("invalid value for int type: %v", condition.Value)
 			}
-			condition.Value = int64(floatValue)
 		case "float":
 			// No need to typecast, JSON numbers are already unmarshalled as float64
 		case "string", "bool":
@@ -157,13 +577,17 @@ func validateCondition(condition *rules.Condition) error {
 	}
 
 	// Skip direct type and operator validation if this condition is just for nesting other conditions
-	if condition.Fact == "" && (len(condition.All) > 0 || len(condition.Any) > 0) {
+	if condition.Fact == "" && condition.IsBlock() {
 		// Validate nested 'All' conditions
-		if err := validateNestedConditions(condition.All); err != nil {
+		if err := validateNestedConditions("all", condition.All); err != nil {
 			return err
 		}
 		// Validate nested 'Any' conditions
-		if err := validateNestedConditions(condition.Any); err != nil {
+		if err := validateNestedConditions("any", condition.Any); err != nil {
+			return err
+		}
+		// Validate nested 'Not' conditions
+		if err := validateNestedConditions("not", condition.Not); err != nil {
 			return err
 		}
 		// If there are only nested conditions and they are valid, no further checks are needed
@@ -184,23 +608,31 @@ func validateCondition(condition *rules.Condition) error {
 	}
 
 	// Check for required 'fact' field
-	if condition.Fact == "" && len(condition.All) == 0 && len(condition.Any) == 0 {
+	if condition.Fact == "" && !condition.IsBlock() {
 		return errors.New("missing 'fact' in condition")
 	}
 
+	if err := validateFactPattern(condition); err != nil {
+		return err
+	}
+
 	// Normalize the operator to its canonical form.
 	canonicalOperator := NormalizeOperator(condition.Operator)
 
+	if err := validateEpsilon(condition, canonicalOperator); err != nil {
+		return err
+	}
+
 	// Validate the operation based on the ValueType
 	if !isOperatorValidForType(canonicalOperator, condition.ValueType) {
 		return fmt.Errorf("unsupported operation '%s' for type '%s'", canonicalOperator, condition.ValueType)
 	}
 
 	// // Recursively validate nested conditions
-	// if err := validateNestedConditions(condition.All); err != nil {
+	// if err := validateNestedConditions("all", condition.All); err != nil {
 	// 	return err
 	// }
-	// if err := validateNestedConditions(condition.Any); err != nil {
+	// if err := validateNestedConditions("any", condition.Any); err != nil {
 	// 	return err
 	// }
 
@@ -218,20 +650,132 @@ func validateCondition(condition *rules.Condition) error {
 	// }
 
 	// Recursively validate nested conditions
-	if err := validateNestedConditions(condition.All); err != nil {
+	if err := validateNestedConditions("all", condition.All); err != nil {
+		return err
+	}
+	if err := validateNestedConditions("any", condition.Any); err != nil {
 		return err
 	}
-	if err := validateNestedConditions(condition.Any); err != nil {
+	if err := validateNestedConditions("not", condition.Not); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// getTypeString returns the type of the value as a string.
+// validateFactPattern checks the fact pattern of a condition and its match
+// setting, which only applies to patterns.
+func validateFactPattern(condition *rules.Condition) error {
+	if !rules.IsFactPattern(condition.Fact) {
+		if condition.Match != "" {
+			return fmt.Errorf("condition on fact '%s' has match '%s', but its fact is not a pattern", condition.Fact, condition.Match)
+		}
+		return nil
+	}
+	for _, segment := range strings.Split(condition.Fact, ".") {
+		if segment == "" || (segment != "*" && strings.Contains(segment, "*")) {
+			return fmt.Errorf("invalid fact pattern '%s': * must stand for a whole segment of the fact name", condition.Fact)
+		}
+	}
+	switch condition.Match {
+	case "", rules.MatchAny, rules.MatchAll:
+		return nil
+	default:
+		return fmt.Errorf("invalid match '%s' for fact pattern '%s', must be any or all", condition.Match, condition.Fact)
+	}
+}
+
+// validateEpsilon checks the tolerance of a condition, which only applies to
+// numeric equal and notEqual conditions on a single fact.
+func validateEpsilon(condition *rules.Condition, operator string) error {
+	if condition.Epsilon == nil {
+		return nil
+	}
+	epsilon := *condition.Epsilon
+	if epsilon < 0 || math.IsNaN(epsilon) || math.IsInf(epsilon, 0) {
+		return fmt.Errorf("condition on fact '%s' has epsilon %v, must be a finite number of at least 0", condition.Fact, epsilon)
+	}
+	if operator != rules.OperatorEqual && operator != rules.OperatorNotEqual {
+		return fmt.Errorf("condition on fact '%s' has an epsilon, which only applies to equal and notEqual", condition.Fact)
+	}
+	if condition.ValueType != "int" && condition.ValueType != "float" {
+		return fmt.Errorf("condition on fact '%s' has an epsilon, which only applies to numbers, not %s", condition.Fact, condition.ValueType)
+	}
+	if rules.IsFactPattern(condition.Fact) {
+		return fmt.Errorf("condition on fact pattern '%s' has an epsilon, which fact patterns don't support", condition.Fact)
+	}
+	return nil
+}
+
+// validateList checks the list value of an in or notIn condition, which
+// must be a non-empty list of values of one type, and that no other operator
+// is given a list.
+func validateList(condition *rules.Condition) error {
+	operator := NormalizeOperator(condition.Operator)
+	list, isList := condition.Value.([]interface{})
+	isListOperator := operator == rules.OperatorIn || operator == rules.OperatorNotIn
+	switch {
+	case isList && !isListOperator:
+		return fmt.Errorf("condition on fact '%s' has a list value, which only operators in and notIn take", condition.Fact)
+	case !isList && isListOperator:
+		return fmt.Errorf("condition on fact '%s' has operator '%s', which needs a list value", condition.Fact, operator)
+	case !isList:
+		return nil
+	}
+
+	if rules.IsFactPattern(condition.Fact) {
+		return fmt.Errorf("condition on fact pattern '%s' has operator '%s', which fact patterns don't support", condition.Fact, operator)
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("condition on fact '%s' has an empty list", condition.Fact)
+	}
+	if getTypeString(list) == "unknown" {
+		return fmt.Errorf("condition on fact '%s' has a list mixing values of different types", condition.Fact)
+	}
+	return nil
+}
+
+// validateExistence checks an exists or notExists condition, which tests
+// whether a single fact is set and so takes no value.
+func validateExistence(condition *rules.Condition) error {
+	operator := NormalizeOperator(condition.Operator)
+	switch {
+	case condition.Fact == "":
+		return errors.New("missing 'fact' in condition")
+	case rules.IsFactPattern(condition.Fact):
+		return fmt.Errorf("condition on fact pattern '%s' has operator '%s', which fact patterns don't support", condition.Fact, operator)
+	case condition.Value != nil || condition.ValueType != "":
+		return fmt.Errorf("condition on fact '%s' has operator '%s', which takes no value", condition.Fact, operator)
+	case condition.Epsilon != nil:
+		return fmt.Errorf("condition on fact '%s' has an epsilon, which only applies to equal and notEqual", condition.Fact)
+	case condition.IsBlock():
+		return fmt.Errorf("condition on fact '%s' has nested conditions", condition.Fact)
+	}
+	return nil
+}
+
+// getTypeString returns the type of the value as a string. The type of a
+// list is the type of its elements, float if it mixes ints and floats, and
+// unknown if it is empty, holds lists or mixes other types.
 func getTypeString(value interface{}) string {
 	switch v := value.(type) {
-	case int, int32, int64:
+	case []interface{}:
+		listType := "unknown"
+		for i, element := range v {
+			elementType := getTypeString(element)
+			switch _, nested := element.([]interface{}); {
+			case nested:
+				return "unknown"
+			case i == 0 || elementType == listType:
+				listType = elementType
+			case listType == "int" && elementType == "float", listType == "float" && elementType == "int":
+				listType = "float"
+			default:
+				return "unknown"
+			}
+		}
+		return listType
+	case int, int32, int64, uint64:
 		return "int"
 	case float64:
 		// Check if the float64 value is an integer
@@ -252,10 +796,10 @@ func getTypeString(value interface{}) string {
 // isOperatorValidForType checks if the operator is valid for the given ValueType.
 func isOperatorValidForType(operator, valueType string) bool {
 	validOperators := map[string][]string{
-		"int":    {"equal", "notEqual", "lessThan", "lessThanOrEqual", "greaterThan", "greaterThanOrEqual"},
-		"float":  {"equal", "notEqual", "lessThan", "lessThanOrEqual", "greaterThan", "greaterThanOrEqual"},
-		"string": {"equal", "notEqual", "contains", "notContains"},
-		"bool":   {"equal", "notEqual"},
+		"int":    {"equal", "notEqual", "lessThan", "lessThanOrEqual", "greaterThan", "greaterThanOrEqual", "in", "notIn"},
+		"float":  {"equal", "notEqual", "lessThan", "lessThanOrEqual", "greaterThan", "greaterThanOrEqual", "in", "notIn"},
+		"string": {"equal", "notEqual", "contains", "notContains", "in", "notIn"},
+		"bool":   {"equal", "notEqual", "in", "notIn"},
 	}
 
 	for _, validOp := range validOperators[valueType] {
@@ -263,14 +807,18 @@ func isOperatorValidForType(operator, valueType string) bool {
 			return true
 		}
 	}
+	if valueTypes, ok := rules.CustomOperator(operator); ok {
+		return slices.Contains(valueTypes, valueType)
+	}
 	return false
 }
 
-// validateNestedConditions recursively validates a slice of nested conditions.
-func validateNestedConditions(conditions []rules.Condition) error {
-	for _, cond := range conditions {
+// validateNestedConditions recursively validates a slice of nested conditions,
+// the named block of the condition they are nested in.
+func validateNestedConditions(block string, conditions []rules.Condition) error {
+	for i, cond := range conditions {
 		if err := validateCondition(&cond); err != nil {
-			return err
+			return atPath(fmt.Sprintf("%s[%d]", block, i), err)
 		}
 	}
 	return nil
@@ -325,8 +873,9 @@ func hasContradictoryConditions(conditions []rules.Condition) bool {
 }
 
 func isContradictory(cond1, cond2 rules.Condition) bool {
-	// Check if the two conditions have the same fact
-	if cond1.Fact != cond2.Fact {
+	// Check if the two conditions have the same fact. A pattern covers several
+	// facts, which can satisfy opposite conditions.
+	if cond1.Fact != cond2.Fact || rules.IsFactPattern(cond1.Fact) {
 		return false
 	}
 
@@ -337,13 +886,15 @@ func isContradictory(cond1, cond2 rules.Condition) bool {
 	}
 
 	// Check if the two conditions have contradictory operators or values
+	// Equality conditions only contradict each other with the same tolerance
+	sameEpsilon := reflect.DeepEqual(cond1.Epsilon, cond2.Epsilon)
 	switch cond1.Operator {
 	case "equal":
-		if cond2.Operator == "notEqual" && reflect.DeepEqual(cond1.Value, cond2.Value) {
+		if cond2.Operator == "notEqual" && reflect.DeepEqual(cond1.Value, cond2.Value) && sameEpsilon {
 			return true
 		}
 	case "notEqual":
-		if cond2.Operator == "equal" && reflect.DeepEqual(cond1.Value, cond2.Value) {
+		if cond2.Operator == "equal" && reflect.DeepEqual(cond1.Value, cond2.Value) && sameEpsilon {
 			return true
 		}
 	case "lessThan":
@@ -362,6 +913,10 @@ func isContradictory(cond1, cond2 rules.Condition) bool {
 		if cond2.Operator == "lessThan" && compareValuesForEquality(cond2.Value, cond1.Value, valueType) {
 			return true
 		}
+	case rules.OperatorExists:
+		return cond2.Operator == rules.OperatorNotExists
+	case rules.OperatorNotExists:
+		return cond2.Operator == rules.OperatorExists
 	}
 
 	return false
@@ -407,14 +962,15 @@ func isAmbiguous(cond1, cond2 rules.Condition) bool {
 func compareValuesForEquality(v1, v2 interface{}, valueType string) bool {
 	switch valueType {
 	case "int":
-		// Assuming all numbers are treated as float64 due to JSON unmarshalling.
-		// Convert both to float64 for comparison to handle JSON's default behavior.
-		val1, ok1 := v1.(float64)
-		val2, ok2 := v2.(float64)
-		if !ok1 || !ok2 {
-			return false
+		// Integers are decoded as int64 or uint64, but may also arrive as
+		// float64 from rules built outside the parser.
+		if i1, ok := v1.(float64); ok {
+			v1 = int64(i1)
 		}
-		return val1 == val2
+		if i2, ok := v2.(float64); ok {
+			v2 = int64(i2)
+		}
+		return reflect.DeepEqual(v1, v2)
 	case "float":
 		val1, ok1 := v1.(float64)
 		val2, ok2 := v2.(float64)
@@ -440,3 +996,138 @@ func compareValuesForEquality(v1, v2 interface{}, valueType string) bool {
 		return false
 	}
 }
+
+// decodeJSON decodes JSON into v, keeping numbers as json.Number so that
+// integers are not rounded through float64.
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// decodeJSONStrict decodes JSON like decodeJSON, but fails on fields that
+// don't correspond to any field of v.
+func decodeJSONStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// normalizeRuleNumbers converts the json.Number values in a rule's conditions
+// and event into exact Go numeric types.
+func normalizeRuleNumbers(rule *rules.Rule) error {
+	for _, conditions := range ruleConditionBlocks(rule) {
+		if err := normalizeConditionNumbers(conditions.All); err != nil {
+			return err
+		}
+		if err := normalizeConditionNumbers(conditions.Any); err != nil {
+			return err
+		}
+		if err := normalizeConditionNumbers(conditions.Not); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if rule.Event.CustomProperty, err = NormalizeNumbers(rule.Event.CustomProperty); err != nil {
+		return err
+	}
+	for i := range rule.Event.Values {
+		if rule.Event.Values[i], err = NormalizeNumbers(rule.Event.Values[i]); err != nil {
+			return err
+		}
+	}
+	for i := range rule.Event.Actions {
+		if rule.Event.Actions[i].Value, err = NormalizeNumbers(rule.Event.Actions[i].Value); err != nil {
+			return err
+		}
+	}
+	for _, variant := range rule.Variants {
+		for i := range variant.Actions {
+			if variant.Actions[i].Value, err = NormalizeNumbers(variant.Actions[i].Value); err != nil {
+				return err
+			}
+		}
+	}
+	for _, test := range rule.Tests {
+		for fact, value := range test.Facts {
+			if test.Facts[fact], err = NormalizeNumbers(value); err != nil {
+				return err
+			}
+		}
+		for i := range test.Actions {
+			if test.Actions[i].Value, err = NormalizeNumbers(test.Actions[i].Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeConditionNumbers recursively normalizes condition values.
+func normalizeConditionNumbers(conditions []rules.Condition) error {
+	for i := range conditions {
+		value, err := NormalizeNumbers(conditions[i].Value)
+		if err != nil {
+			return err
+		}
+		conditions[i].Value = value
+		if err := normalizeConditionNumbers(conditions[i].All); err != nil {
+			return err
+		}
+		if err := normalizeConditionNumbers(conditions[i].Any); err != nil {
+			return err
+		}
+		if err := normalizeConditionNumbers(conditions[i].Not); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NormalizeNumbers replaces json.Number values, including those nested in
+// arrays and objects, with int64 when the number is an integer that fits,
+// uint64 for larger non-negative integers, and float64 otherwise. Hosts
+// decoding fact values with UseNumber use it to read them as rules are read.
+func NormalizeNumbers(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return normalizeNumber(v)
+	case []interface{}:
+		for i := range v {
+			normalized, err := NormalizeNumbers(v[i])
+			if err != nil {
+				return nil, err
+			}
+			v[i] = normalized
+		}
+		return v, nil
+	case map[string]interface{}:
+		for key, item := range v {
+			normalized, err := NormalizeNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = normalized
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
+
+// normalizeNumber converts a single json.Number to the narrowest exact Go type.
+func normalizeNumber(number json.Number) (interface{}, error) {
+	if i, err := number.Int64(); err == nil {
+		return i, nil
+	}
+	if u, err := strconv.ParseUint(number.String(), 10, 64); err == nil {
+		return u, nil
+	}
+	f, err := number.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %s: %w", number, err)
+	}
+	return f, nil
+}
@@ -1,8 +1,11 @@
 package preprocessor
 
 import (
+	"encoding/json"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
 	"rgehrsitz/rex/internal/rules"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -234,6 +237,199 @@ func TestParseRule_InvalidRuleWithUnsupportedOperator(t *testing.T) {
 	assert.Error(t, err, "Expected an error due to unsupported operator")
 }
 
+func TestParseRule_BoolOperators(t *testing.T) {
+	boolRule := func(operator string) string {
+		return `{
+            "name": "lightsOff",
+            "conditions": {"all": [{"fact": "room_occupied", "operator": "` + operator + `", "value": false}]},
+            "event": {"actions": [{"type": "updateFact", "target": "lights", "value": false}]}
+        }`
+	}
+	for _, operator := range []string{"equal", "notEqual"} {
+		_, err := ParseRule([]byte(boolRule(operator)), rules.NewRuleEngineContext())
+		assert.NoError(t, err, "Expected %s to compare booleans", operator)
+	}
+	for _, operator := range []string{"greaterThan", "lessThanOrEqual", "contains"} {
+		_, err := ParseRule([]byte(boolRule(operator)), rules.NewRuleEngineContext())
+		assert.Error(t, err, "Expected %s to be rejected for booleans", operator)
+	}
+}
+
+func TestParseRule_ListOperators(t *testing.T) {
+	listRule := func(operator, value string) string {
+		return `{
+            "name": "coastalOffice",
+            "conditions": {"all": [{"fact": "city", "operator": "` + operator + `", "value": ` + value + `}]},
+            "event": {"actions": [{"type": "updateFact", "target": "coastal", "value": true}]}
+        }`
+	}
+
+	parsed, err := ParseRule([]byte(listRule("in", `["NYC", "LA", "SF"]`)), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"NYC", "LA", "SF"}, parsed.Conditions.All[0].Value)
+
+	_, err = ParseRule([]byte(listRule("notIn", `[1, 2.5]`)), rules.NewRuleEngineContext())
+	assert.NoError(t, err, "Expected ints and floats to mix in a list")
+
+	testCases := []struct {
+		operator string
+		value    string
+		err      string
+	}{
+		{"in", `"NYC"`, "needs a list value"},
+		{"equal", `["NYC"]`, "only operators in and notIn take"},
+		{"in", `[]`, "empty list"},
+		{"in", `["NYC", 1]`, "mixing values of different types"},
+		{"in", `[["NYC"]]`, "mixing values of different types"},
+	}
+	for _, tc := range testCases {
+		_, err := ParseRule([]byte(listRule(tc.operator, tc.value)), rules.NewRuleEngineContext())
+		assert.ErrorContains(t, err, tc.err, "%s %s", tc.operator, tc.value)
+	}
+}
+
+func TestParseRule_ExistenceOperators(t *testing.T) {
+	existenceRule := func(condition string) string {
+		return `{
+            "name": "firstReading",
+            "conditions": {"all": [` + condition + `]},
+            "event": {"actions": [{"type": "updateFact", "target": "calibrated", "value": true}]}
+        }`
+	}
+
+	parsed, err := ParseRule([]byte(existenceRule(`{"fact": "baseline", "operator": "notExists"}`)), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	assert.Equal(t, rules.OperatorNotExists, parsed.Conditions.All[0].Operator)
+	assert.Nil(t, parsed.Conditions.All[0].Value)
+
+	testCases := []struct {
+		condition string
+		err       string
+	}{
+		{`{"fact": "baseline", "operator": "exists", "value": true}`, "takes no value"},
+		{`{"fact": "baseline", "operator": "exists", "valueType": "int"}`, "takes no value"},
+		{`{"fact": "sensors.*", "operator": "exists"}`, "fact patterns don't support"},
+		{`{"fact": "baseline", "operator": "exists"}, {"fact": "baseline", "operator": "notExists"}`, "contradictory conditions"},
+	}
+	for _, tc := range testCases {
+		_, err := ParseRule([]byte(existenceRule(tc.condition)), rules.NewRuleEngineContext())
+		assert.ErrorContains(t, err, tc.err, tc.condition)
+	}
+}
+
+func TestParseRule_Score(t *testing.T) {
+	scoringRule := func(score, conditions string) string {
+		return `{
+            "name": "fraudRisk",
+            "score": ` + score + `,
+            "conditions": ` + conditions + `,
+            "event": {"actions": [{"type": "updateFact", "target": "review", "value": true}]}
+        }`
+	}
+	conditions := `{"all": [
+        {"fact": "amount", "operator": "greaterThan", "value": 1000, "weight": 2.5},
+        {"fact": "country", "operator": "notEqual", "value": "home"},
+        {"fact": "country", "operator": "equal", "value": "home", "weight": -1}
+    ]}`
+
+	context := rules.NewRuleEngineContext()
+	parsed, err := ParseRule([]byte(scoringRule(`{"fact": "risk", "threshold": 3}`, conditions)), context)
+	require.NoError(t, err, "contradictory conditions are alternatives of a score")
+	assert.Equal(t, &rules.Score{Fact: "risk", Threshold: 3}, parsed.Score)
+	assert.Equal(t, 2.5, parsed.Conditions.All[0].ScoreWeight())
+	assert.Equal(t, 1.0, parsed.Conditions.All[1].ScoreWeight())
+	assert.True(t, context.ProducedFacts["risk"])
+
+	testCases := []struct {
+		score      string
+		conditions string
+		err        string
+	}{
+		{`{"threshold": 3}`, conditions, "no score fact"},
+		{`{"fact": "risk.*", "threshold": 3}`, conditions, "must be a single fact"},
+		{`{"fact": "risk", "threshold": 3}`, `{"any": [{"fact": "amount", "operator": "greaterThan", "value": 1000}]}`, "has any conditions"},
+		{`{"fact": "risk", "threshold": 3}`, `{"all": [{"all": [{"fact": "amount", "operator": "greaterThan", "value": 1000, "weight": 2}]}]}`, "weight at conditions.all[0].all[0]; only its all conditions are scored"},
+		{`null`, `{"all": [{"fact": "amount", "operator": "greaterThan", "value": 1000, "weight": 2}]}`, "weight at conditions.all[0] but no score"},
+	}
+	for _, tc := range testCases {
+		_, err := ParseRule([]byte(scoringRule(tc.score, tc.conditions)), rules.NewRuleEngineContext())
+		assert.ErrorContains(t, err, tc.err, tc.score+" "+tc.conditions)
+	}
+}
+
+func TestParseAndValidateRules_ScoreFact(t *testing.T) {
+	ruleset := `{
+        "readOnlyFacts": ["risk"],
+        "rules": [{
+            "name": "fraudRisk",
+            "score": {"fact": "risk", "threshold": 3},
+            "conditions": {"all": [{"fact": "amount", "operator": "greaterThan", "value": 1000}]},
+            "event": {"actions": [{"type": "updateFact", "target": "review", "value": true}]}
+        }]
+    }`
+	_, err := ParseAndValidateRules([]byte(ruleset), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "rule 'fraudRisk' writes read-only fact 'risk'")
+
+	typed := `[
+        {
+            "name": "fraudRisk",
+            "score": {"fact": "risk", "threshold": 3},
+            "conditions": {"all": [{"fact": "amount", "operator": "greaterThan", "value": 1000}]},
+            "event": {"actions": [{"type": "updateFact", "target": "review", "value": true}]}
+        },
+        {
+            "name": "riskLabel",
+            "conditions": {"all": [{"fact": "risk", "operator": "equal", "value": "high"}]},
+            "event": {"actions": [{"type": "updateFact", "target": "alert", "value": true}]}
+        }
+    ]`
+	_, err = ParseAndValidateRules([]byte(typed), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "rule 'fraudRisk' writes a float value to fact 'risk', which rule 'riskLabel' compares as string")
+}
+
+func TestParseRule_Not(t *testing.T) {
+	notRule := func(conditions string) string {
+		return `{
+            "name": "workday",
+            "conditions": ` + conditions + `,
+            "event": {"actions": [{"type": "updateFact", "target": "alarm_armed", "value": false}]}
+        }`
+	}
+
+	context := rules.NewRuleEngineContext()
+	parsed, err := ParseRule([]byte(notRule(`{"not": [
+        {"fact": "weekend", "operator": "equal", "value": true},
+        {"all": [{"fact": "holiday", "operator": "equal", "value": true}], "not": [{"fact": "region", "operator": "equal", "value": "north"}]}
+    ]}`)), context)
+	require.NoError(t, err, "a rule may have only not conditions")
+	require.Len(t, parsed.Conditions.Not, 2)
+	assert.Equal(t, "region", parsed.Conditions.Not[1].Not[0].Fact)
+	assert.True(t, context.ConsumedFacts["weekend"])
+	assert.True(t, context.ConsumedFacts["region"])
+
+	testCases := []struct {
+		conditions string
+		err        string
+	}{
+		{`{"not": [{"fact": "weekend", "operator": "greaterThan", "value": true}]}`, "unsupported operation 'greaterThan' for type 'bool'"},
+		{`{"not": [{"fact": "weekend", "operator": "equal", "value": true}, {"fact": "weekend", "operator": "equal", "value": true}]}`, "redundant conditions found in 'Not' block"},
+		{`{"not": [{"fact": "mode", "operator": "equal", "value": "eco"}, {"fact": "mode", "operator": "notEqual", "value": "eco"}]}`, "contradictory conditions found in 'Not' block"},
+		{`{"all": [{"not": [{"fact": "holiday", "operator": "equal", "value": true, "script": "return true"}]}]}`, "script condition of rule 'workday' can't also have a fact"},
+	}
+	for _, tc := range testCases {
+		_, err := ParseRuleWithOptions([]byte(notRule(tc.conditions)), rules.NewRuleEngineContext(), ParseOptions{Scripts: true})
+		assert.ErrorContains(t, err, tc.err, tc.conditions)
+	}
+
+	_, err = ParseRule([]byte(`{
+        "name": "fraudRisk",
+        "score": {"fact": "risk", "threshold": 3},
+        "conditions": {"all": [{"fact": "amount", "operator": "greaterThan", "value": 1000}], "not": [{"fact": "trusted", "operator": "equal", "value": true}]},
+        "event": {"actions": [{"type": "updateFact", "target": "review", "value": true}]}
+    }`), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "scoring rule 'fraudRisk' has not conditions")
+}
+
 func TestParseRule_InvalidRuleMissingFact(t *testing.T) {
 	missingFactRuleJSON := `{
         "conditions": {
@@ -527,3 +723,558 @@ func TestParseRule_AmbiguousConditionsInAnyBlock(t *testing.T) {
 	_, err := ParseRule([]byte(ambiguousConditionsRuleJSON), context)
 	assert.Error(t, err, "Expected an error due to ambiguous conditions in 'Any' block")
 }
+
+func TestParseRule_LargeIntegersKeepPrecision(t *testing.T) {
+	largeIntegerRuleJSON := `{
+        "conditions": {
+            "all": [
+                {
+                    "fact": "deviceId",
+                    "value": 9007199254740993,
+                    "operator": "equal"
+                },
+                {
+                    "fact": "counter",
+                    "value": 18446744073709551615,
+                    "operator": "lessThan"
+                },
+                {
+                    "fact": "offset",
+                    "value": -5,
+                    "operator": "greaterThan"
+                },
+                {
+                    "fact": "ratio",
+                    "value": 0.25,
+                    "operator": "lessThan"
+                }
+            ]
+        },
+        "event": {
+            "actions": [
+                {
+                    "type": "updateFact",
+                    "target": "lastDeviceId",
+                    "value": 9007199254740995
+                }
+            ]
+        }
+    }`
+	context := rules.NewRuleEngineContext()
+	rule, err := ParseRule([]byte(largeIntegerRuleJSON), context)
+	require.NoError(t, err, "Unexpected error parsing rule with large integers")
+
+	// 2^53 + 1 cannot be represented exactly as a float64
+	assert.Equal(t, int64(9007199254740993), rule.Conditions.All[0].Value)
+	assert.Equal(t, uint64(18446744073709551615), rule.Conditions.All[1].Value)
+	assert.Equal(t, int64(-5), rule.Conditions.All[2].Value)
+	assert.Equal(t, 0.25, rule.Conditions.All[3].Value)
+	assert.Equal(t, int64(9007199254740995), rule.Event.Actions[0].Value)
+}
+
+func TestParseRule_UnknownFieldsKeptAsMetadata(t *testing.T) {
+	ruleJSON := `{
+        "name": "coolDown",
+        "owner": "hvac-team",
+        "conditions": {
+            "all": [
+                {
+                    "fact": "temperature",
+                    "operater": "greaterThan",
+                    "operator": "greaterThan",
+                    "value": 30,
+                    "any": [
+                        {"fact": "humidity", "operator": "lessThan", "value": 80, "note": "dry air"}
+                    ]
+                }
+            ],
+            "none": []
+        },
+        "event": {
+            "eventType": "alert",
+            "severity": 2,
+            "actions": [
+                {"type": "updateFact", "target": "fan_status", "value": true, "retries": 3}
+            ]
+        }
+    }`
+	context := rules.NewRuleEngineContext()
+	rule, err := ParseRule([]byte(ruleJSON), context)
+	require.NoError(t, err, "Unknown fields should be accepted in permissive mode")
+
+	assert.Equal(t, map[string]interface{}{"owner": "hvac-team", "conditions.none": []interface{}{}}, rule.Metadata)
+	assert.Equal(t, map[string]interface{}{"operater": "greaterThan"}, rule.Conditions.All[0].Metadata)
+	assert.Equal(t, map[string]interface{}{"note": "dry air"}, rule.Conditions.All[0].Any[0].Metadata)
+	assert.Equal(t, map[string]interface{}{"severity": int64(2)}, rule.Event.Metadata)
+	assert.Equal(t, map[string]interface{}{"retries": int64(3)}, rule.Event.Actions[0].Metadata)
+}
+
+func TestParseRule_StrictModeRejectsUnknownFields(t *testing.T) {
+	ruleJSON := `{
+        "name": "coolDown",
+        "conditions": {
+            "all": [
+                {"fact": "temperature", "operater": "greaterThan", "value": 30}
+            ]
+        },
+        "event": {
+            "actions": [
+                {"type": "updateFact", "target": "fan_status", "value": true}
+            ]
+        }
+    }`
+	context := rules.NewRuleEngineContext()
+	_, err := ParseRuleWithOptions([]byte(ruleJSON), context, ParseOptions{Mode: ParseModeStrict})
+	require.Error(t, err, "Expected strict mode to reject the misspelled field")
+	assert.Contains(t, err.Error(), "operater")
+
+	validJSON := `{
+        "name": "coolDown",
+        "conditions": {
+            "all": [
+                {"fact": "temperature", "operator": "greaterThan", "value": 30}
+            ]
+        },
+        "event": {
+            "actions": [
+                {"type": "updateFact", "target": "fan_status", "value": true}
+            ]
+        }
+    }`
+	rule, err := ParseRuleWithOptions([]byte(validJSON), context, ParseOptions{Mode: ParseModeStrict})
+	require.NoError(t, err, "Strict mode should accept rules without unknown fields")
+	assert.Nil(t, rule.Metadata)
+}
+
+func TestParseAndValidateRules_ActionValueMustMatchConsumedType(t *testing.T) {
+	rulesJSON := `[
+        {
+            "name": "setMode",
+            "conditions": {"all": [{"fact": "occupied", "operator": "equal", "value": true}]},
+            "event": {"actions": [{"type": "updateFact", "target": "setpoint", "value": "comfort"}]}
+        },
+        {
+            "name": "heat",
+            "conditions": {"all": [{"fact": "setpoint", "operator": "greaterThan", "value": 20}]},
+            "event": {"actions": [{"type": "updateFact", "target": "heater", "value": true}]}
+        }
+    ]`
+	context := rules.NewRuleEngineContext()
+	_, err := ParseAndValidateRules([]byte(rulesJSON), context)
+	require.Error(t, err, "Expected a string written to a numerically compared fact to be rejected")
+	assert.Contains(t, err.Error(), "setMode")
+	assert.Contains(t, err.Error(), "heat")
+}
+
+func TestParseAndValidateRules_ActionValueNumericTypesCompatible(t *testing.T) {
+	rulesJSON := `[
+        {
+            "name": "setMode",
+            "conditions": {"all": [{"fact": "occupied", "operator": "equal", "value": true}]},
+            "event": {"actions": [{"type": "updateFact", "target": "setpoint", "value": 21}]}
+        },
+        {
+            "name": "heat",
+            "conditions": {"all": [{"fact": "setpoint", "operator": "greaterThan", "value": 20.5}]},
+            "event": {"actions": [{"type": "updateFact", "target": "heater", "value": true}]}
+        }
+    ]`
+	context := rules.NewRuleEngineContext()
+	_, err := ParseAndValidateRules([]byte(rulesJSON), context)
+	require.NoError(t, err, "An int written to a fact compared as float should be accepted")
+	assert.True(t, context.ProducedFacts["setpoint"])
+	assert.True(t, context.ProducedFacts["heater"])
+}
+
+func TestParseRule_Rollout(t *testing.T) {
+	ruleJSON := `{
+        "name": "newCooling",
+        "rollout": 20,
+        "rolloutKey": "deviceId",
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }`
+	context := rules.NewRuleEngineContext()
+	rule, err := ParseRule([]byte(ruleJSON), context)
+	require.NoError(t, err)
+	require.NotNil(t, rule.Rollout)
+	assert.Equal(t, 20, *rule.Rollout)
+	assert.True(t, context.ConsumedFacts["deviceId"], "The rollout key should be recorded as consumed")
+
+	invalidRollouts := []string{
+		`"rollout": 120, "rolloutKey": "deviceId"`,
+		`"rollout": -1, "rolloutKey": "deviceId"`,
+		`"rollout": 50`,
+	}
+	for _, rollout := range invalidRollouts {
+		ruleJSON := `{
+            "name": "newCooling",
+            ` + rollout + `,
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]}
+        }`
+		_, err := ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+		assert.Error(t, err, "Expected rollout settings %s to be rejected", rollout)
+	}
+}
+
+func TestParseRule_Hold(t *testing.T) {
+	ruleJSON := `{
+        "name": "overheating",
+        "for": "5m",
+        "once": true,
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "notify", "target": "ops", "value": "overheating"}]}
+    }`
+	rule, err := ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	duration, err := rule.HoldDuration()
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, duration)
+	assert.True(t, rule.Once)
+
+	for _, hold := range []string{`"for": "soon"`, `"for": "-5m"`, `"for": "1200h"`} {
+		ruleJSON := `{
+            "name": "overheating",
+            ` + hold + `,
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]}
+        }`
+		_, err := ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+		assert.Error(t, err, "Expected duration %s to be rejected", hold)
+	}
+}
+
+func TestParseRule_Variants(t *testing.T) {
+	ruleJSON := `{
+        "name": "setpointTest",
+        "variantKey": "deviceId",
+        "conditions": {"all": [{"fact": "occupied", "operator": "equal", "value": true}]},
+        "variants": [
+            {"name": "A", "weight": 70, "actions": [{"type": "updateFact", "target": "setpoint", "value": 20}]},
+            {"name": "B", "weight": 30, "actions": [{"type": "updateFact", "target": "setpoint", "value": 22}]}
+        ]
+    }`
+	context := rules.NewRuleEngineContext()
+	rule, err := ParseRule([]byte(ruleJSON), context)
+	require.NoError(t, err)
+	require.Len(t, rule.Variants, 2)
+	assert.Equal(t, int64(22), rule.Variants[1].Actions[0].Value)
+	assert.True(t, context.ConsumedFacts["deviceId"], "The variant key should be recorded as consumed")
+	assert.True(t, context.ProducedFacts["setpoint"], "Variant actions should be recorded as produced")
+
+	invalidVariants := []string{
+		// No variant key
+		`"variants": [{"name": "A", "actions": []}]`,
+		// Duplicate names
+		`"variantKey": "deviceId", "variants": [{"name": "A", "actions": []}, {"name": "A", "actions": []}]`,
+		// Mixed with event actions
+		`"variantKey": "deviceId", "variants": [{"name": "A", "actions": []}], "event": {"actions": [{"type": "updateFact", "target": "x", "value": true}]}`,
+	}
+	for _, variants := range invalidVariants {
+		ruleJSON := `{
+            "name": "setpointTest",
+            ` + variants + `,
+            "conditions": {"all": [{"fact": "occupied", "operator": "equal", "value": true}]}
+        }`
+		_, err := ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+		assert.Error(t, err, "Expected variants %s to be rejected", variants)
+	}
+}
+
+func TestParseRule_FactPatterns(t *testing.T) {
+	ruleJSON := `{
+        "name": "anyHot",
+        "conditions": {"all": [{"fact": "sensor.*.temperature", "operator": "greaterThan", "value": 30, "match": "all"}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }`
+	rule, err := ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	assert.Equal(t, rules.MatchAll, rule.Conditions.All[0].Match)
+
+	// A pattern can take opposite conditions, as they may hold for different facts
+	ruleJSON = `{
+        "name": "spread",
+        "conditions": {"all": [
+            {"fact": "sensor.*.temperature", "operator": "greaterThan", "value": 30},
+            {"fact": "sensor.*.temperature", "operator": "lessThanOrEqual", "value": 30}
+        ]}
+    }`
+	_, err = ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+	assert.NoError(t, err)
+
+	invalidConditions := []string{
+		// Match on a plain fact
+		`{"fact": "temperature", "operator": "greaterThan", "value": 30, "match": "all"}`,
+		// Unknown match
+		`{"fact": "sensor.*.temperature", "operator": "greaterThan", "value": 30, "match": "most"}`,
+		// Partial segment wildcard
+		`{"fact": "sensor.b*.temperature", "operator": "greaterThan", "value": 30}`,
+		// Empty segment
+		`{"fact": "sensor..*", "operator": "greaterThan", "value": 30}`,
+	}
+	for _, condition := range invalidConditions {
+		ruleJSON := `{"name": "invalid", "conditions": {"all": [` + condition + `]}}`
+		_, err := ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+		assert.Error(t, err, "Expected condition %s to be rejected", condition)
+	}
+}
+
+func TestParseAndValidateRules_ActionValueMustMatchPatternType(t *testing.T) {
+	rulesJSON := `[
+        {"name": "hot", "conditions": {"all": [{"fact": "sensor.*.temperature", "operator": "greaterThan", "value": 30}]}},
+        {"name": "reset", "conditions": {"all": [{"fact": "reset", "operator": "equal", "value": true}]},
+         "event": {"actions": [{"type": "updateFact", "target": "sensor.kitchen.temperature", "value": "cold"}]}}
+    ]`
+	_, err := ParseAndValidateRules([]byte(rulesJSON), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "compares as int")
+}
+
+func TestParseRule_Epsilon(t *testing.T) {
+	ruleJSON := `{
+        "name": "setpoint",
+        "conditions": {"all": [{"fact": "temperature", "operator": "equal", "value": 21.5, "epsilon": 0.1}]}
+    }`
+	rule, err := ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	require.NotNil(t, rule.Conditions.All[0].Epsilon)
+	assert.Equal(t, 0.1, *rule.Conditions.All[0].Epsilon)
+
+	// Equal and not equal with different tolerances can both hold
+	ruleJSON = `{
+        "name": "near",
+        "conditions": {"all": [
+            {"fact": "temperature", "operator": "equal", "value": 21.5, "epsilon": 1},
+            {"fact": "temperature", "operator": "notEqual", "value": 21.5, "epsilon": 0.1}
+        ]}
+    }`
+	_, err = ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+	assert.NoError(t, err)
+
+	invalidConditions := []string{
+		`{"fact": "temperature", "operator": "equal", "value": 21.5, "epsilon": -0.1}`,
+		`{"fact": "temperature", "operator": "greaterThan", "value": 21.5, "epsilon": 0.1}`,
+		`{"fact": "mode", "operator": "equal", "value": "auto", "epsilon": 0.1}`,
+		`{"fact": "sensor.*", "operator": "equal", "value": 21.5, "epsilon": 0.1}`,
+	}
+	for _, condition := range invalidConditions {
+		ruleJSON := `{"name": "invalid", "conditions": {"all": [` + condition + `]}}`
+		_, err := ParseRule([]byte(ruleJSON), rules.NewRuleEngineContext())
+		assert.ErrorContains(t, err, "epsilon", "Expected condition %s to be rejected", condition)
+	}
+}
+
+func TestParseRule_Scripts(t *testing.T) {
+	rule := func(condition, action string) string {
+		return `{
+            "name": "comfort",
+            "conditions": {"all": [` + condition + `]},
+            "event": {"actions": [` + action + `]}
+        }`
+	}
+	scriptCondition := `{"script": "facts.temperature + facts.humidity / 10 > 30", "facts": ["temperature", "humidity"]}`
+	scriptAction := `{"type": "script", "target": "setpoint", "value": "facts.temperature - 2", "facts": ["temperature"]}`
+	options := ParseOptions{Scripts: true}
+
+	context := rules.NewRuleEngineContext()
+	_, err := ParseRuleWithOptions([]byte(rule(scriptCondition, scriptAction)), context, options)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"temperature": true, "humidity": true}, context.ConsumedFacts)
+	assert.True(t, context.ProducedFacts["setpoint"])
+
+	_, err = ParseRuleWithOptions([]byte(rule(scriptCondition, scriptAction)), rules.NewRuleEngineContext(), ParseOptions{})
+	assert.ErrorContains(t, err, "scripts aren't enabled")
+
+	testCases := []struct {
+		name      string
+		condition string
+		action    string
+		expected  string
+	}{
+		{"Invalid script", `{"script": "facts.temperature >"}`, scriptAction, "invalid script"},
+		{"Script with a fact", `{"script": "true", "fact": "temperature"}`, scriptAction, "can't also have a fact"},
+		{"Fact pattern", `{"script": "true", "facts": ["sensor.*"]}`, scriptAction, "must list plain fact names"},
+		{"Facts on a comparison", `{"fact": "temperature", "operator": "greaterThan", "value": 30, "facts": ["humidity"]}`, scriptAction, "only script conditions read"},
+		{"Action without target", scriptCondition, `{"type": "script", "value": "1"}`, "no target fact"},
+		{"Action without script", scriptCondition, `{"type": "script", "target": "setpoint", "value": 1}`, "must have its script as value"},
+		{"Facts on an update", scriptCondition, `{"type": "updateFact", "target": "setpoint", "value": 1, "facts": ["temperature"]}`, "only script actions read"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseRuleWithOptions([]byte(rule(tc.condition, tc.action)), rules.NewRuleEngineContext(), options)
+			assert.ErrorContains(t, err, tc.expected)
+		})
+	}
+}
+
+func TestParseRule_Webhooks(t *testing.T) {
+	rule := func(action string) string {
+		return `{
+            "name": "overheat",
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+            "event": {"actions": [` + action + `]}
+        }`
+	}
+	webhook := `{"type": "webhook", "target": "https://hooks.example.com/rex",
+        "webhook": {"method": "PUT", "headers": {"Authorization": "Bearer secret"}, "body": "{\"site\": \"{{facts.site}}\", \"temperature\": {{ facts.temperature }}}", "timeout": "5s", "retries": 2}}`
+
+	context := rules.NewRuleEngineContext()
+	parsed, err := ParseRule([]byte(rule(webhook)), context)
+	require.NoError(t, err)
+	assert.Equal(t, &rules.WebhookRequest{
+		Method:  "PUT",
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Body:    `{"site": "{{facts.site}}", "temperature": {{ facts.temperature }}}`,
+		Timeout: "5s",
+		Retries: 2,
+	}, parsed.Event.Actions[0].Webhook)
+	assert.Equal(t, map[string]bool{"temperature": true, "site": true}, context.ConsumedFacts)
+
+	testCases := []struct {
+		name     string
+		action   string
+		expected string
+	}{
+		{"Not a URL", `{"type": "webhook", "target": "ops"}`, "target must be an http or https URL"},
+		{"Value", `{"type": "webhook", "target": "https://example.com", "value": 1}`, "has a value"},
+		{"Method", `{"type": "webhook", "target": "https://example.com", "webhook": {"method": "TRACE"}}`, "unsupported method 'TRACE'"},
+		{"Timeout", `{"type": "webhook", "target": "https://example.com", "webhook": {"timeout": "-1s"}}`, "invalid timeout '-1s'"},
+		{"Retries", `{"type": "webhook", "target": "https://example.com", "webhook": {"retries": 11}}`, "retries must be between 0 and 10"},
+		{"Unterminated reference", `{"type": "webhook", "target": "https://example.com", "webhook": {"body": "{{facts.temperature"}}`, "unterminated reference"},
+		{"Invalid reference", `{"type": "webhook", "target": "https://example.com", "webhook": {"body": "{{temperature}}"}}`, "invalid reference {{temperature}}"},
+		{"Request on another action", `{"type": "updateFact", "target": "fan", "value": true, "webhook": {"method": "POST"}}`, "only webhook actions send"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseRule([]byte(rule(tc.action)), rules.NewRuleEngineContext())
+			assert.ErrorContains(t, err, tc.expected)
+		})
+	}
+}
+
+func TestParseRule_ActionGuards(t *testing.T) {
+	rule := func(actions string) string {
+		return `{
+            "name": "overheat",
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+            "event": {"actions": [` + actions + `]}
+        }`
+	}
+
+	context := rules.NewRuleEngineContext()
+	parsed, err := ParseRule([]byte(rule(`
+        {"type": "updateFact", "target": "fan", "value": true},
+        {"type": "notify", "target": "ops", "value": "too hot", "order": 1,
+         "when": {"all": [{"fact": "quiet_hours", "operator": "equal", "value": false}]}}`)), context)
+	require.NoError(t, err)
+	action := parsed.Event.Actions[1]
+	assert.Equal(t, 1, action.Order)
+	require.NotNil(t, action.When)
+	assert.Equal(t, "quiet_hours", action.When.All[0].Fact)
+	assert.Nil(t, action.Metadata)
+	assert.Equal(t, map[string]bool{"temperature": true, "quiet_hours": true}, context.ConsumedFacts)
+
+	_, err = ParseRule([]byte(rule(`{"type": "notify", "target": "ops", "when": {}}`)), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "event.actions[0].when")
+	assert.ErrorContains(t, err, "the guard of a notify action must have at least one condition")
+
+	_, err = ParseRule([]byte(rule(`{"type": "notify", "target": "ops", "when": {"all": [{"fact": "mode", "operator": "like", "value": "auto"}]}}`)), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "event.actions[0].when.all[0]")
+
+	_, err = ParseRule([]byte(rule(`{"type": "notify", "target": "ops", "when": {"all": [
+        {"fact": "mode", "operator": "equal", "value": "auto"},
+        {"fact": "mode", "operator": "equal", "value": "auto"}
+    ]}}`)), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "redundant conditions")
+}
+
+func TestParseRule_ActionDelays(t *testing.T) {
+	rule := func(action string) string {
+		return `{
+            "name": "lightsOff",
+            "conditions": {"all": [{"fact": "motion", "operator": "equal", "value": false}]},
+            "event": {"actions": [` + action + `]}
+        }`
+	}
+
+	parsed, err := ParseRule([]byte(rule(`{"type": "switchLights", "target": "hall", "value": "off", "delay": "10m"}`)), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	assert.Equal(t, "10m", parsed.Event.Actions[0].Delay)
+
+	_, err = ParseRule([]byte(rule(`{"type": "switchLights", "target": "hall", "delay": "soon"}`)), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "invalid delay 'soon'")
+	_, err = ParseRule([]byte(rule(`{"type": "updateFact", "target": "lights", "value": "off", "delay": "10m"}`)), rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "fact writes can't be delayed")
+}
+
+func TestFactSchema(t *testing.T) {
+	rulesJSON := `[
+        {
+            "name": "cooling",
+            "conditions": {"all": [
+                {"fact": "temperature", "operator": "greaterThan", "value": 30},
+                {"fact": "mode", "operator": "equal", "value": "auto"},
+                {"fact": "sensor.*.humidity", "operator": "lessThan", "value": 60.5}
+            ]},
+            "event": {"actions": [{"type": "updateFact", "target": "fan", "value": true}]}
+        },
+        {
+            "name": "precise",
+            "conditions": {"all": [{"fact": "temperature", "operator": "lessThan", "value": 35.5}]},
+            "event": {"actions": [{"type": "updateFact", "target": "level", "value": 2}]}
+        }
+    ]`
+	ruleSet, err := ParseAndValidateRules([]byte(rulesJSON), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	assert.Equal(t, bytecode.FactSchema{
+		"temperature":       "float", // Compared as both int and float
+		"mode":              "string",
+		"sensor.*.humidity": "float",
+		"fan":               "bool",
+		"level":             "int",
+	}, FactSchema(ruleSet))
+
+	// Facts used as different kinds of values are left out
+	ruleSet[1].Event.Actions[0].Target = "mode"
+	assert.NotContains(t, FactSchema(ruleSet), "mode")
+}
+
+func TestParseRuleset_ReadOnlyFacts(t *testing.T) {
+	rule := func(target string) string {
+		return `{
+            "name": "coolDown",
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+            "event": {"actions": [{"type": "updateFact", "target": "` + target + `", "value": true}]}
+        }`
+	}
+
+	context := rules.NewRuleEngineContext()
+	ruleset := `{"readOnlyFacts": ["temperature", "sensor.*.humidity"], "rules": [` + rule("fan_status") + `]}`
+	_, err := ParseAndValidateRules([]byte(ruleset), context)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"temperature", "sensor.*.humidity"}, context.ReadOnlyFacts)
+
+	invalid := map[string]string{
+		"write":         `{"readOnlyFacts": ["temperature"], "rules": [` + rule("temperature") + `]}`,
+		"pattern write": `{"readOnlyFacts": ["sensor.*.humidity"], "rules": [` + rule("sensor.kitchen.humidity") + `]}`,
+		"empty name":    `{"readOnlyFacts": [""], "rules": [` + rule("fan_status") + `]}`,
+		"bad pattern":   `{"readOnlyFacts": ["sensor.kitch*"], "rules": [` + rule("fan_status") + `]}`,
+	}
+	for name, ruleset := range invalid {
+		_, err := ParseAndValidateRules([]byte(ruleset), rules.NewRuleEngineContext())
+		assert.Error(t, err, name)
+	}
+
+	// The state fact of a machine is written by its transitions
+	var machines map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(stateMachineRuleset), &machines))
+	machines["readOnlyFacts"] = []string{"door.state"}
+	withReadOnlyState, err := json.Marshal(machines)
+	require.NoError(t, err)
+	_, err = ParseAndValidateRules(withReadOnlyState, rules.NewRuleEngineContext())
+	assert.ErrorContains(t, err, "rule 'door: closed -> open' writes read-only fact 'door.state'")
+}
+
+func TestRuleNames(t *testing.T) {
+	assert.Equal(t, []string{"a", "", ""}, RuleNames([]byte(`[{"name": "a", "conditions": {}}, {"priority": 1}, 3]`)))
+	assert.Equal(t, []string{"b"}, RuleNames([]byte(`{"rules": [{"name": "b"}], "readOnlyFacts": ["x"]}`)))
+	assert.Nil(t, RuleNames([]byte(`[{"name": "a"`)))
+}
@@ -0,0 +1,54 @@
+// internal/preprocessor/passes.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// OptimizerPass transforms a ruleset. Registered passes run after the
+// built-in optimizations, in the order they were registered.
+type OptimizerPass func(ruleSet []*rules.Rule, context *rules.RuleEngineContext) ([]*rules.Rule, error)
+
+type namedPass struct {
+	name string
+	pass OptimizerPass
+}
+
+var (
+	optimizerPassesMu sync.RWMutex
+	optimizerPasses   []namedPass
+)
+
+// RegisterOptimizerPass adds a pass to the optimizer. It panics if a pass
+// with the same name is already registered.
+func RegisterOptimizerPass(name string, pass OptimizerPass) {
+	optimizerPassesMu.Lock()
+	defer optimizerPassesMu.Unlock()
+	for _, registered := range optimizerPasses {
+		if registered.name == name {
+			panic(fmt.Sprintf("preprocessor: optimizer pass %q registered twice", name))
+		}
+	}
+	optimizerPasses = append(optimizerPasses, namedPass{name: name, pass: pass})
+}
+
+// runOptimizerPasses applies the registered passes to a ruleset.
+func runOptimizerPasses(ruleSet []*rules.Rule, context *rules.RuleEngineContext) ([]*rules.Rule, error) {
+	optimizerPassesMu.RLock()
+	passes := optimizerPasses
+	optimizerPassesMu.RUnlock()
+
+	for _, registered := range passes {
+		var err error
+		if ruleSet, err = registered.pass(ruleSet, context); err != nil {
+			return nil, fmt.Errorf("optimizer pass %s: %w", registered.name, err)
+		}
+		log.Debug().Str("Pass", registered.name).Int("Rules", len(ruleSet)).Msg("Applied optimizer pass")
+	}
+	return ruleSet, nil
+}
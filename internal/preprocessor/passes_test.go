@@ -0,0 +1,54 @@
+package preprocessor
+
+import (
+	"errors"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterOptimizerPass(t *testing.T) {
+	defer restoreOptimizerPasses(optimizerPasses)
+
+	// Drops the rules marked as drafts
+	RegisterOptimizerPass("dropDraftsTest", func(ruleSet []*rules.Rule, context *rules.RuleEngineContext) ([]*rules.Rule, error) {
+		var kept []*rules.Rule
+		for _, rule := range ruleSet {
+			if !strings.HasPrefix(rule.Name, "draft_") {
+				kept = append(kept, rule)
+			}
+		}
+		return kept, nil
+	})
+
+	ruleSet := []*rules.Rule{
+		{Name: "cooling", Conditions: rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30}}}},
+		{Name: "draft_heating", Conditions: rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "lessThan", Value: 10}}}},
+	}
+	optimized, err := OptimizeRules(ruleSet, rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	require.Len(t, optimized, 1)
+	assert.Equal(t, "cooling", optimized[0].Name)
+
+	assert.Panics(t, func() { RegisterOptimizerPass("dropDraftsTest", nil) })
+}
+
+func TestRunOptimizerPasses_Error(t *testing.T) {
+	defer restoreOptimizerPasses(optimizerPasses)
+	RegisterOptimizerPass("failing", func([]*rules.Rule, *rules.RuleEngineContext) ([]*rules.Rule, error) {
+		return nil, errors.New("boom")
+	})
+
+	_, err := OptimizeRules([]*rules.Rule{{Name: "cooling"}}, rules.NewRuleEngineContext())
+	assert.EqualError(t, err, "optimizer pass failing: boom")
+}
+
+// restoreOptimizerPasses undoes the registrations made by a test.
+func restoreOptimizerPasses(passes []namedPass) {
+	optimizerPassesMu.Lock()
+	defer optimizerPassesMu.Unlock()
+	optimizerPasses = passes
+}
@@ -0,0 +1,147 @@
+// pkg/preprocessor/plan.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+)
+
+// MergedRule is a rule the optimizer merged into an earlier rule with the same
+// conditions and priority, which performs its actions in its place.
+type MergedRule struct {
+	Rule string `json:"rule"`
+	Into string `json:"into"`
+}
+
+// DroppedCondition is a condition the optimizer removed from a rule as
+// redundant with another one.
+type DroppedCondition struct {
+	Rule      string `json:"rule"`
+	Path      string `json:"path"`      // Position in the rule as written, e.g. conditions.all[2]
+	Condition string `json:"condition"` // e.g. temperature greaterThan 30
+}
+
+// CloneRules returns copies of rules whose conditions can be changed without
+// affecting the originals. OptimizeRules reorders the conditions of the rules
+// it is given, so CompareOptimized needs a copy taken beforehand.
+func CloneRules(ruleSet []*rules.Rule) []*rules.Rule {
+	clones := make([]*rules.Rule, len(ruleSet))
+	for i, rule := range ruleSet {
+		clone := *rule
+		clone.Conditions = rules.Conditions{
+			All: cloneConditions(rule.Conditions.All),
+			Any: cloneConditions(rule.Conditions.Any),
+			Not: cloneConditions(rule.Conditions.Not),
+		}
+		clones[i] = &clone
+	}
+	return clones
+}
+
+func cloneConditions(conditions []rules.Condition) []rules.Condition {
+	if conditions == nil {
+		return nil
+	}
+	clones := make([]rules.Condition, len(conditions))
+	for i, condition := range conditions {
+		clones[i] = condition
+		clones[i].All = cloneConditions(condition.All)
+		clones[i].Any = cloneConditions(condition.Any)
+		clones[i].Not = cloneConditions(condition.Not)
+	}
+	return clones
+}
+
+// CompareOptimized reports what the optimizer removed from a ruleset, given
+// the rules as written, cloned with CloneRules before being passed to
+// OptimizeRules, and the rules it returned: the rules merged into others, in
+// declaration order, and the conditions dropped from the rules kept.
+func CompareOptimized(validated, optimized []*rules.Rule) ([]MergedRule, []DroppedCondition) {
+	kept := make(map[string]*rules.Rule, len(optimized))
+	for _, rule := range optimized {
+		kept[rule.Name] = rule
+	}
+	declared := make(map[string]*rules.Rule, len(validated))
+	for _, rule := range validated {
+		declared[rule.Name] = rule
+	}
+
+	var merged []MergedRule
+	var dropped []DroppedCondition
+	for _, rule := range validated {
+		optimizedRule, ok := kept[rule.Name]
+		if !ok {
+			merged = append(merged, MergedRule{Rule: rule.Name, Into: mergedInto(rule, optimized, declared)})
+			continue
+		}
+		dropped = append(dropped, droppedConditions(rule.Name, "conditions.all", rule.Conditions.All, optimizedRule.Conditions.All)...)
+		dropped = append(dropped, droppedConditions(rule.Name, "conditions.any", rule.Conditions.Any, optimizedRule.Conditions.Any)...)
+		if len(optimizedRule.Conditions.Not) > 0 {
+			// A not block pushed down by pushDownNegations is rewritten, not dropped
+			dropped = append(dropped, droppedConditions(rule.Name, "conditions.not", rule.Conditions.Not, optimizedRule.Conditions.Not)...)
+		}
+	}
+	return merged, dropped
+}
+
+// mergedInto returns the name of the rule kept by the optimizer that has the
+// conditions and priority of a merged rule.
+func mergedInto(rule *rules.Rule, optimized []*rules.Rule, declared map[string]*rules.Rule) string {
+	key, _ := conditionsKey(rule.Conditions)
+	for _, candidate := range optimized {
+		original, ok := declared[candidate.Name]
+		if !ok || getRulePriority(original) != getRulePriority(rule) {
+			continue
+		}
+		if candidateKey, _ := conditionsKey(original.Conditions); candidateKey == key {
+			return candidate.Name
+		}
+	}
+	return ""
+}
+
+// droppedConditions returns the conditions of a block as written that are
+// missing from the block after optimization. The optimizer removes
+// conditions and reorders the rest, so each condition is matched with the
+// first equal condition left unmatched; nested blocks, which keep their
+// relative order, are matched in turn.
+func droppedConditions(rule, path string, before, after []rules.Condition) []DroppedCondition {
+	var dropped []DroppedCondition
+	matched := make([]bool, len(after))
+	for i, condition := range before {
+		conditionPath := fmt.Sprintf("%s[%d]", path, i)
+		j := -1
+		for k, candidate := range after {
+			if !matched[k] && equalCondition(condition, candidate) {
+				j = k
+				break
+			}
+		}
+		if j < 0 {
+			dropped = append(dropped, DroppedCondition{Rule: rule, Path: conditionPath, Condition: describeCondition(condition)})
+			continue
+		}
+		matched[j] = true
+		dropped = append(dropped, droppedConditions(rule, conditionPath+".all", condition.All, after[j].All)...)
+		dropped = append(dropped, droppedConditions(rule, conditionPath+".any", condition.Any, after[j].Any)...)
+		if len(after[j].Not) > 0 {
+			dropped = append(dropped, droppedConditions(rule, conditionPath+".not", condition.Not, after[j].Not)...)
+		}
+	}
+	return dropped
+}
+
+// describeCondition returns a one-line description of a condition.
+func describeCondition(condition rules.Condition) string {
+	switch {
+	case condition.Script != "":
+		return "script condition"
+	case condition.Fact == "":
+		return fmt.Sprintf("nested block of %d all, %d any and %d not conditions", len(condition.All), len(condition.Any), len(condition.Not))
+	case rules.IsExistenceOperator(condition.Operator):
+		return fmt.Sprintf("%s %s", condition.Fact, condition.Operator)
+	default:
+		return fmt.Sprintf("%s %s %v", condition.Fact, condition.Operator, condition.Value)
+	}
+}
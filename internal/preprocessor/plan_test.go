@@ -0,0 +1,38 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareOptimized(t *testing.T) {
+	hot := rules.Condition{Fact: "temperature", Operator: "greaterThan", Value: 30}
+	humid := rules.Condition{Fact: "humidity", Operator: "greaterThan", Value: 80}
+	validated := []*rules.Rule{
+		{Name: "coolDown", Conditions: rules.Conditions{All: []rules.Condition{hot}}, Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "ac_status", Value: true}}}},
+		{Name: "alertHot", Conditions: rules.Conditions{All: []rules.Condition{hot}}, Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "alert", Value: true}}}},
+		{Name: "dehumidify", Conditions: rules.Conditions{Any: []rules.Condition{
+			humid,
+			{All: []rules.Condition{hot, humid, hot}},
+			humid,
+		}}, Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan", Value: true}}}},
+	}
+
+	written := CloneRules(validated)
+	optimized, err := OptimizeRules(validated, rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	merged, dropped := CompareOptimized(written, optimized)
+
+	assert.Equal(t, []MergedRule{{Rule: "alertHot", Into: "coolDown"}}, merged)
+	assert.Equal(t, []DroppedCondition{
+		{Rule: "dehumidify", Path: "conditions.any[1].all[2]", Condition: "temperature greaterThan 30"},
+		{Rule: "dehumidify", Path: "conditions.any[2]", Condition: "humidity greaterThan 80"},
+	}, dropped)
+
+	merged, dropped = CompareOptimized(CloneRules(optimized), optimized)
+	assert.Empty(t, merged)
+	assert.Empty(t, dropped)
+}
@@ -0,0 +1,134 @@
+// pkg/preprocessor/position.go
+
+package preprocessor
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonIndex records where each value of a JSON document starts and ends, by
+// path, so that errors found in decoded values can be located in the source.
+type jsonIndex struct {
+	data  []byte
+	spans []jsonSpan // Innermost values first
+	paths map[string]jsonSpan
+}
+
+// jsonSpan is the byte range of a value of a JSON document.
+type jsonSpan struct {
+	path       string
+	start, end int
+}
+
+// indexJSON indexes a JSON document, naming the paths of its values below
+// root as the ruleset schema does: root.field for fields and root[i] for
+// elements. Returns nil if the document isn't valid JSON.
+func indexJSON(data []byte, root string) *jsonIndex {
+	index := &jsonIndex{data: data, paths: make(map[string]jsonSpan)}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := index.walk(decoder, root); err != nil {
+		return nil
+	}
+	return index
+}
+
+// walk records the span of the value the decoder is at and of the values
+// nested in it.
+func (x *jsonIndex) walk(decoder *json.Decoder, path string) error {
+	start := x.valueStart(int(decoder.InputOffset()))
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('{'):
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			if err := x.walk(decoder, joinPath(path, key.(string))); err != nil {
+				return err
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+	case json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			if err := x.walk(decoder, path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+	}
+	span := jsonSpan{path: path, start: start, end: int(decoder.InputOffset())}
+	x.spans = append(x.spans, span)
+	x.paths[path] = span
+	return nil
+}
+
+// valueStart returns the offset of the value following offset, past the
+// separators between values.
+func (x *jsonIndex) valueStart(offset int) int {
+	for offset < len(x.data) && strings.IndexByte(" \t\r\n,:", x.data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// find returns the span of the value at path.
+func (x *jsonIndex) find(path string) (jsonSpan, bool) {
+	span, ok := x.paths[path]
+	return span, ok
+}
+
+// enclosing returns the span of the innermost value containing offset.
+func (x *jsonIndex) enclosing(offset int) (jsonSpan, bool) {
+	for _, span := range x.spans {
+		if span.start <= offset && offset < span.end {
+			return span, true
+		}
+	}
+	return jsonSpan{}, false
+}
+
+// field returns the span of the first value below path, in document order,
+// that is the field named key of an object.
+func (x *jsonIndex) field(path, key string) (jsonSpan, bool) {
+	var found jsonSpan
+	ok := false
+	for _, span := range x.spans {
+		parent, isField := strings.CutSuffix(span.path, "."+key)
+		if !isField && span.path == key {
+			parent, isField = "", true
+		}
+		if isField && isBelow(parent, path) && (!ok || span.start < found.start) {
+			found, ok = span, true
+		}
+	}
+	return found, ok
+}
+
+// isBelow reports whether path is ancestor or one of the paths below it.
+func isBelow(path, ancestor string) bool {
+	return ancestor == "" || path == ancestor || strings.HasPrefix(path, ancestor+".") || strings.HasPrefix(path, ancestor+"[")
+}
+
+// lineColumn returns the line and column, counting from 1, of a byte offset
+// of a document. Columns count characters rather than bytes.
+func lineColumn(data []byte, offset int) (int, int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return line, utf8.RuneCount(before[lineStart:]) + 1
+}
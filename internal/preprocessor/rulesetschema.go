@@ -0,0 +1,421 @@
+// pkg/preprocessor/rulesetschema.go
+
+package preprocessor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/rules"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) the ruleset schema
+// is written in, which is also the subset ValidateAgainstSchema implements.
+type jsonSchema struct {
+	Schema      string `json:"$schema,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Ref         string `json:"$ref,omitempty"`
+
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"` // Allowed if nil
+	DependentRequired    map[string][]string    `json:"dependentRequired,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+
+	OneOf []*jsonSchema          `json:"oneOf,omitempty"` // Only at the root, which ValidateAgainstSchema dispatches on itself
+	Defs  map[string]*jsonSchema `json:"$defs,omitempty"`
+}
+
+// schemaRef returns a reference to a definition of the ruleset schema.
+func schemaRef(name string) *jsonSchema {
+	return &jsonSchema{Ref: "#/$defs/" + name}
+}
+
+// schemaOf returns a schema allowing any value of a type.
+func schemaOf(typ string) *jsonSchema {
+	return &jsonSchema{Type: typ}
+}
+
+// schemaArray returns an array schema.
+func schemaArray(items *jsonSchema) *jsonSchema {
+	return &jsonSchema{Type: "array", Items: items}
+}
+
+// schemaNonEmptyArray returns an array schema requiring at least one item.
+func schemaNonEmptyArray(items *jsonSchema) *jsonSchema {
+	one := 1
+	return &jsonSchema{Type: "array", Items: items, MinItems: &one}
+}
+
+// schemaNonEmptyString returns a schema allowing any string but "".
+func schemaNonEmptyString() *jsonSchema {
+	one := 1
+	return &jsonSchema{Type: "string", MinLength: &one}
+}
+
+// schemaRange returns a schema allowing numbers of a type within bounds,
+// either of which may be nil.
+func schemaRange(typ string, minimum, maximum *float64) *jsonSchema {
+	return &jsonSchema{Type: typ, Minimum: minimum, Maximum: maximum}
+}
+
+// schemaObject returns an object schema. Objects whose unknown fields the
+// parser keeps as metadata are open; the others are closed, since the parser
+// would silently ignore a misspelled field.
+func schemaObject(open bool, required []string, properties map[string]*jsonSchema) *jsonSchema {
+	schema := &jsonSchema{Type: "object", Properties: properties, Required: required}
+	if !open {
+		schema.AdditionalProperties = new(bool)
+	}
+	return schema
+}
+
+// schemaOperators returns the operators a condition may use: the built-in
+// ones, their aliases and the registered custom operators.
+func schemaOperators() []string {
+	operators := slices.Clone(rules.SupportedOperators)
+	for alias := range operatorAliases {
+		operators = append(operators, alias)
+	}
+	sort.Strings(operators[len(rules.SupportedOperators):])
+	return append(operators, rules.CustomOperators()...)
+}
+
+// rulesetSchema builds the schema of a ruleset.
+func rulesetSchema() *jsonSchema {
+	zero, hundred, maxRetries := 0.0, 100.0, float64(maxWebhookRetries)
+	names := schemaArray(schemaOf("string"))
+	actions := schemaArray(schemaRef("action"))
+	conditions := schemaArray(schemaRef("condition"))
+
+	condition := schemaObject(true, nil, map[string]*jsonSchema{
+		"fact":      schemaNonEmptyString(),
+		"operator":  {Enum: schemaOperators()},
+		"value":     {},
+		"valueType": {Enum: []string{"int", "float", "string", "bool"}},
+		"match":     {Enum: []string{"any", "all"}},
+		"epsilon":   schemaRange("number", &zero, nil),
+		"script":    schemaNonEmptyString(),
+		"facts":     names,
+		"weight":    schemaOf("number"),
+		"all":       conditions,
+		"any":       conditions,
+		"not":       conditions,
+	})
+	condition.DependentRequired = map[string][]string{"fact": {"operator"}}
+
+	return &jsonSchema{
+		Schema:      "https://json-schema.org/draft/2020-12/schema",
+		Title:       "rex ruleset",
+		Description: "A JSON array of rules, or an object holding the rules, state machines, escalations and read-only facts of a ruleset.",
+		OneOf:       []*jsonSchema{schemaRef("rules"), schemaRef("ruleset")},
+		Defs: map[string]*jsonSchema{
+			"rules": schemaArray(schemaRef("rule")),
+			"ruleset": schemaObject(false, nil, map[string]*jsonSchema{
+				"$schema":       schemaOf("string"),
+				"rules":         schemaRef("rules"),
+				"stateMachines": schemaArray(schemaRef("stateMachine")),
+				"escalations":   schemaArray(schemaRef("escalation")),
+				"readOnlyFacts": schemaArray(schemaNonEmptyString()),
+			}),
+			"rule": schemaObject(true, []string{"name", "conditions"}, map[string]*jsonSchema{
+				"name":          schemaNonEmptyString(),
+				"priority":      schemaOf("integer"),
+				"conditions":    schemaRef("conditions"),
+				"event":         schemaRef("event"),
+				"producedFacts": names,
+				"consumedFacts": names,
+				"rollout":       schemaRange("integer", &zero, &hundred),
+				"rolloutKey":    schemaOf("string"),
+				"variants":      schemaArray(schemaRef("variant")),
+				"variantKey":    schemaOf("string"),
+				"tests":         schemaArray(schemaRef("test")),
+				"for":           schemaOf("string"),
+				"once":          schemaOf("boolean"),
+				"score":         schemaRef("score"),
+				"forEachDevice": schemaOf("object"),
+			}),
+			"conditions": schemaObject(false, nil, map[string]*jsonSchema{
+				"all": conditions,
+				"any": conditions,
+				"not": conditions,
+			}),
+			"condition": condition,
+			"event": schemaObject(true, nil, map[string]*jsonSchema{
+				"eventType":      schemaOf("string"),
+				"customProperty": {},
+				"facts":          names,
+				"values":         schemaOf("array"),
+				"actions":        actions,
+			}),
+			"action": schemaObject(true, []string{"type"}, map[string]*jsonSchema{
+				"type":    schemaNonEmptyString(),
+				"target":  schemaOf("string"),
+				"value":   {},
+				"facts":   names,
+				"webhook": schemaRef("webhook"),
+				"order":   schemaOf("integer"),
+				"when":    schemaRef("conditions"),
+				"delay":   schemaOf("string"),
+			}),
+			"webhook": schemaObject(false, nil, map[string]*jsonSchema{
+				"method":  {Enum: webhookMethods},
+				"headers": schemaOf("object"),
+				"body":    schemaOf("string"),
+				"timeout": schemaOf("string"),
+				"retries": schemaRange("integer", &zero, &maxRetries),
+			}),
+			"variant": schemaObject(false, []string{"name"}, map[string]*jsonSchema{
+				"name":    schemaNonEmptyString(),
+				"weight":  schemaRange("integer", &zero, nil),
+				"actions": actions,
+			}),
+			"test": schemaObject(false, nil, map[string]*jsonSchema{
+				"name":    schemaOf("string"),
+				"facts":   schemaOf("object"),
+				"fires":   schemaOf("boolean"),
+				"actions": actions,
+				"variant": schemaOf("string"),
+			}),
+			"score": schemaObject(false, []string{"fact", "threshold"}, map[string]*jsonSchema{
+				"fact":      schemaNonEmptyString(),
+				"threshold": schemaOf("number"),
+			}),
+			"stateMachine": schemaObject(false, []string{"name", "initial", "states"}, map[string]*jsonSchema{
+				"name":     schemaNonEmptyString(),
+				"fact":     schemaOf("string"),
+				"initial":  schemaNonEmptyString(),
+				"priority": schemaOf("integer"),
+				"states":   schemaArray(schemaRef("state")),
+			}),
+			"state": schemaObject(false, []string{"name"}, map[string]*jsonSchema{
+				"name":        schemaNonEmptyString(),
+				"entry":       actions,
+				"exit":        actions,
+				"transitions": schemaArray(schemaRef("transition")),
+			}),
+			"transition": schemaObject(false, []string{"to"}, map[string]*jsonSchema{
+				"to":         schemaNonEmptyString(),
+				"conditions": schemaRef("conditions"),
+				"actions":    actions,
+			}),
+			"escalation": schemaObject(false, []string{"name", "conditions", "steps"}, map[string]*jsonSchema{
+				"name":       schemaNonEmptyString(),
+				"priority":   schemaOf("integer"),
+				"conditions": schemaRef("conditions"),
+				"steps":      schemaNonEmptyArray(schemaRef("escalationStep")),
+			}),
+			"escalationStep": schemaObject(false, []string{"actions"}, map[string]*jsonSchema{
+				"after":   schemaOf("string"),
+				"actions": actions,
+			}),
+		},
+	}
+}
+
+// RulesetSchema returns the JSON Schema describing the ruleset format, for
+// editors and for validating rulesets before they reach the preprocessor.
+// The operators it allows include the custom operators registered so far.
+func RulesetSchema() ([]byte, error) {
+	return json.MarshalIndent(rulesetSchema(), "", "  ")
+}
+
+// SchemaViolation is a place where a ruleset doesn't match the schema.
+type SchemaViolation struct {
+	Path    string `json:"path"` // JSON path of the offending value, e.g. rules[3].conditions.all[1].operator
+	Message string `json:"message"`
+}
+
+func (v SchemaViolation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// SchemaError reports every place a ruleset doesn't match the schema.
+type SchemaError struct {
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = violation.String()
+	}
+	return "ruleset doesn't match the schema: " + strings.Join(messages, "; ")
+}
+
+// ValidateAgainstSchema checks a ruleset against the ruleset schema before it
+// is parsed, returning a *SchemaError listing every violation with its path,
+// or nil. Unlike the parser, which stops at the first problem and reports
+// the rule it was in, it locates problems down to the offending field, such
+// as rules[3].conditions.all[1].operator. The rules of a ruleset written as
+// an array are located as rules[i] too.
+func ValidateAgainstSchema(rulesJSON []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(rulesJSON))
+	decoder.UseNumber()
+	var ruleset interface{}
+	if err := decoder.Decode(&ruleset); err != nil {
+		return fmt.Errorf("failed to unmarshal rules JSON: %w", err)
+	}
+
+	root := rulesetSchema()
+	v := schemaValidator{defs: root.Defs}
+	if _, ok := ruleset.(map[string]interface{}); ok {
+		v.validate(ruleset, root.Defs["ruleset"], "")
+	} else {
+		v.validate(ruleset, root.Defs["rules"], "rules")
+	}
+	if len(v.violations) > 0 {
+		return &SchemaError{Violations: v.violations}
+	}
+	return nil
+}
+
+// schemaValidator validates decoded JSON against a schema, collecting the
+// violations.
+type schemaValidator struct {
+	defs       map[string]*jsonSchema
+	violations []SchemaViolation
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	v.violations = append(v.violations, SchemaViolation{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *schemaValidator) validate(value interface{}, schema *jsonSchema, path string) {
+	for schema.Ref != "" {
+		schema = v.defs[strings.TrimPrefix(schema.Ref, "#/$defs/")]
+	}
+	if schema.Type != "" && !hasSchemaType(value, schema.Type) {
+		v.fail(path, "must be %s %s, not %s", article(schema.Type), schema.Type, schemaType(value))
+		return
+	}
+	if len(schema.Enum) > 0 {
+		if s, ok := value.(string); !ok || !slices.Contains(schema.Enum, s) {
+			v.fail(path, "%s isn't one of %s", describeJSON(value), strings.Join(schema.Enum, ", "))
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		if schema.MinLength != nil && len([]rune(value)) < *schema.MinLength {
+			v.fail(path, "must be at least %d characters long", *schema.MinLength)
+		}
+	case json.Number:
+		number, _ := value.Float64()
+		if schema.Minimum != nil && number < *schema.Minimum {
+			v.fail(path, "must be at least %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			v.fail(path, "must be at most %v", *schema.Maximum)
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(value) < *schema.MinItems {
+			v.fail(path, "must have at least %d items", *schema.MinItems)
+		}
+		if schema.Items != nil {
+			for i, item := range value {
+				v.validate(item, schema.Items, path+"["+strconv.Itoa(i)+"]")
+			}
+		}
+	case map[string]interface{}:
+		v.validateObject(value, schema, path)
+	}
+}
+
+func (v *schemaValidator) validateObject(object map[string]interface{}, schema *jsonSchema, path string) {
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			v.fail(joinPath(path, name), "is required")
+		}
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, dependent := range schema.DependentRequired[key] {
+			if _, ok := object[dependent]; !ok {
+				v.fail(joinPath(path, dependent), "is required with %s", key)
+			}
+		}
+		if property, ok := schema.Properties[key]; ok {
+			v.validate(object[key], property, joinPath(path, key))
+		} else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+			v.fail(joinPath(path, key), "is not a known field")
+		}
+	}
+}
+
+// joinPath returns the path of a field of the object at path.
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// hasSchemaType reports whether a decoded JSON value has a JSON Schema type.
+// Integers are numbers without a fractional part.
+func hasSchemaType(value interface{}, typ string) bool {
+	if typ == "integer" {
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := number.Float64()
+		return err == nil && f == math.Trunc(f)
+	}
+	actual := schemaType(value)
+	return actual == typ || (typ == "number" && actual == "integer")
+}
+
+// schemaType returns the JSON Schema type of a decoded JSON value, reporting
+// integers as such.
+func schemaType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if hasSchemaType(value, "integer") {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// article returns the indefinite article of a JSON Schema type.
+func article(typ string) string {
+	if typ == "integer" || typ == "object" || typ == "array" {
+		return "an"
+	}
+	return "a"
+}
+
+// describeJSON formats a decoded JSON value for a violation message.
+func describeJSON(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return schemaType(value)
+}
@@ -0,0 +1,103 @@
+package preprocessor
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRulesetSchema(t *testing.T) {
+	schemaJSON, err := RulesetSchema()
+	require.NoError(t, err)
+
+	var schema struct {
+		Schema string `json:"$schema"`
+		Defs   map[string]struct {
+			Properties map[string]struct {
+				Enum []string `json:"enum"`
+			} `json:"properties"`
+		} `json:"$defs"`
+	}
+	require.NoError(t, json.Unmarshal(schemaJSON, &schema))
+	assert.Equal(t, "https://json-schema.org/draft/2020-12/schema", schema.Schema)
+	operators := schema.Defs["condition"].Properties["operator"].Enum
+	assert.Contains(t, operators, "greaterThan")
+	assert.Contains(t, operators, ">=", "aliases are allowed")
+	assert.Contains(t, schema.Defs, "stateMachine")
+	assert.Contains(t, schema.Defs, "escalation")
+}
+
+func TestValidateAgainstSchema(t *testing.T) {
+	for name, ruleset := range map[string]string{
+		"state machines": stateMachineRuleset,
+		"escalations":    escalationRuleset,
+		"array": `[{
+			"name": "cooling",
+			"priority": 2,
+			"description": "kept as metadata",
+			"conditions": {"all": [
+				{"fact": "temperature", "operator": ">", "value": 30.5},
+				{"any": [{"fact": "mode", "operator": "in", "value": ["auto", "eco"]}, {"script": "facts.x > 1", "facts": ["x"]}]}
+			]},
+			"event": {"eventType": "cool", "actions": [{"type": "updateFact", "target": "fan", "value": true}]},
+			"tests": [{"facts": {"temperature": 31, "mode": "auto"}, "fires": true}]
+		}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, ValidateAgainstSchema([]byte(ruleset)))
+		})
+	}
+}
+
+func TestValidateAgainstSchema_Violations(t *testing.T) {
+	ruleset := `{
+		"rules": [
+			{"name": "ok", "conditions": {"all": [{"fact": "a", "operator": "equal", "value": 1}]}},
+			{"name": "bad", "priority": 1.5, "rollout": 120,
+			 "conditions": {"al": [], "all": [{"fact": "a", "operator": "equal", "value": 1}, {"fact": "b", "operator": "gt", "value": 2}, {"fact": "c"}]},
+			 "event": {"actions": [{"target": "x"}]}}
+		],
+		"escalations": [{"name": "e", "conditions": {}, "steps": []}],
+		"stateMachine": []
+	}`
+
+	err := ValidateAgainstSchema([]byte(ruleset))
+	var schemaErr *SchemaError
+	require.ErrorAs(t, err, &schemaErr)
+	var paths []string
+	for _, violation := range schemaErr.Violations {
+		paths = append(paths, violation.Path)
+	}
+	assert.Equal(t, []string{
+		"escalations[0].steps",
+		"rules[1].conditions.al",
+		"rules[1].conditions.all[1].operator",
+		"rules[1].conditions.all[2].operator",
+		"rules[1].event.actions[0].type",
+		"rules[1].priority",
+		"rules[1].rollout",
+		"stateMachine",
+	}, paths)
+	assert.Equal(t, "rules[1].priority: must be an integer, not number", schemaErr.Violations[5].String())
+	assert.Contains(t, schemaErr.Violations[2].Message, `"gt" isn't one of equal, notEqual`)
+	assert.Equal(t, "is required with fact", schemaErr.Violations[3].Message)
+	assert.Equal(t, "is not a known field", schemaErr.Violations[1].Message)
+	assert.Contains(t, err.Error(), "rules[1].rollout: must be at most 100")
+}
+
+func TestValidateAgainstSchema_ArrayPaths(t *testing.T) {
+	err := ValidateAgainstSchema([]byte(`[{"name": "a", "conditions": {"any": [{"fact": "x", "operator": "equal", "value": 1, "match": "some"}]}}, {"conditions": {}}]`))
+	var schemaErr *SchemaError
+	require.ErrorAs(t, err, &schemaErr)
+	require.Len(t, schemaErr.Violations, 2)
+	assert.Equal(t, "rules[0].conditions.any[0].match", schemaErr.Violations[0].Path)
+	assert.Equal(t, SchemaViolation{Path: "rules[1].name", Message: "is required"}, schemaErr.Violations[1])
+
+	err = ValidateAgainstSchema([]byte(`"rules"`))
+	require.ErrorAs(t, err, &schemaErr)
+	assert.Equal(t, "rules: must be an array, not string", schemaErr.Violations[0].String())
+
+	assert.Error(t, ValidateAgainstSchema([]byte(`[{`)))
+}
@@ -0,0 +1,94 @@
+// pkg/preprocessor/score.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/rules"
+)
+
+// validateScore checks the score settings of a rule. A scoring rule scores
+// its all conditions, so it can't also have any conditions, and only those
+// conditions have weights.
+func validateScore(rule *rules.Rule) error {
+	if !rule.Scored() {
+		if path, ok := weightedCondition("conditions", rule.Conditions.All, rule.Conditions.Any, rule.Conditions.Not); ok {
+			return fmt.Errorf("rule '%s' has a weight at %s but no score", rule.Name, path)
+		}
+		return nil
+	}
+
+	score := rule.Score
+	switch {
+	case score.Fact == "":
+		return fmt.Errorf("rule '%s' has a score but no score fact", rule.Name)
+	case rules.IsFactPattern(score.Fact):
+		return fmt.Errorf("rule '%s' writes its score to fact pattern '%s', which must be a single fact", rule.Name, score.Fact)
+	case math.IsNaN(score.Threshold) || math.IsInf(score.Threshold, 0):
+		return fmt.Errorf("rule '%s' has score threshold %v, must be a finite number", rule.Name, score.Threshold)
+	case len(rule.Conditions.Any) > 0:
+		return fmt.Errorf("scoring rule '%s' has any conditions; nest them in a block of its all conditions", rule.Name)
+	case len(rule.Conditions.Not) > 0:
+		return fmt.Errorf("scoring rule '%s' has not conditions; nest them in a block of its all conditions", rule.Name)
+	case len(rule.Conditions.All) == 0:
+		return fmt.Errorf("scoring rule '%s' has no all conditions to score", rule.Name)
+	}
+
+	for i, condition := range rule.Conditions.All {
+		weight := condition.ScoreWeight()
+		if math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("condition conditions.all[%d] of rule '%s' has weight %v, must be a finite number", i, rule.Name, weight)
+		}
+		if path, ok := weightedCondition(fmt.Sprintf("conditions.all[%d]", i), condition.All, condition.Any, condition.Not); ok {
+			return fmt.Errorf("rule '%s' has a weight at %s; only its all conditions are scored", rule.Name, path)
+		}
+	}
+	return nil
+}
+
+// weightedCondition returns the path of the first condition with a weight in
+// a block, or in the blocks nested in it.
+func weightedCondition(path string, all, any, not []rules.Condition) (string, bool) {
+	for _, block := range []struct {
+		key        string
+		conditions []rules.Condition
+	}{{"all", all}, {"any", any}, {"not", not}} {
+		for i, condition := range block.conditions {
+			conditionPath := fmt.Sprintf("%s.%s[%d]", path, block.key, i)
+			if condition.Weight != nil {
+				return conditionPath, true
+			}
+			if nested, ok := weightedCondition(conditionPath, condition.All, condition.Any, condition.Not); ok {
+				return nested, true
+			}
+		}
+	}
+	return "", false
+}
+
+// factWrite is a fact a rule writes, with the type of the value written, or
+// no type if a script computes it.
+type factWrite struct {
+	fact      string
+	valueType string
+}
+
+// ruleFactWrites returns the facts written by the fact update actions of a
+// rule, including those of its variants, followed by its score fact, a float,
+// if it is a scoring rule.
+func ruleFactWrites(rule *rules.Rule) []factWrite {
+	var writes []factWrite
+	for _, action := range ruleActions(rule) {
+		switch {
+		case action.Type == rules.ActionScript:
+			writes = append(writes, factWrite{fact: action.Target})
+		case rules.IsFactUpdate(action):
+			writes = append(writes, factWrite{fact: action.Target, valueType: getTypeString(action.Value)})
+		}
+	}
+	if rule.Scored() {
+		writes = append(writes, factWrite{fact: rule.Score.Fact, valueType: "float"})
+	}
+	return writes
+}
@@ -0,0 +1,89 @@
+// pkg/preprocessor/script.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"rgehrsitz/rex/internal/script"
+)
+
+// validateScripts checks the script conditions and actions of a rule, which
+// are only allowed when scripts are enabled: a script condition has no fact,
+// operator or value of its own, a script action has a target fact, and every
+// script must compile and list the plain facts it reads.
+func validateScripts(rule *rules.Rule, allowed bool) error {
+	check := func(kind, source string, facts []string) error {
+		if !allowed {
+			return fmt.Errorf("rule '%s' has a script %s, but scripts aren't enabled", rule.Name, kind)
+		}
+		for _, fact := range facts {
+			if fact == "" || rules.IsFactPattern(fact) {
+				return fmt.Errorf("script %s of rule '%s' reads '%s', must list plain fact names", kind, rule.Name, fact)
+			}
+		}
+		if _, err := script.Compile(source); err != nil {
+			return fmt.Errorf("script %s of rule '%s': %w", kind, rule.Name, err)
+		}
+		return nil
+	}
+
+	var checkConditions func(conditions []rules.Condition) error
+	checkConditions = func(conditions []rules.Condition) error {
+		for _, condition := range conditions {
+			if condition.Script == "" {
+				if len(condition.Facts) > 0 {
+					return fmt.Errorf("rule '%s' has a condition listing facts, which only script conditions read", rule.Name)
+				}
+			} else {
+				if condition.Fact != "" || condition.Operator != "" || condition.Value != nil || condition.IsBlock() {
+					return fmt.Errorf("script condition of rule '%s' can't also have a fact, operator, value or nested conditions", rule.Name)
+				}
+				if err := check("condition", condition.Script, condition.Facts); err != nil {
+					return err
+				}
+			}
+			if err := checkConditions(condition.All); err != nil {
+				return err
+			}
+			if err := checkConditions(condition.Any); err != nil {
+				return err
+			}
+			if err := checkConditions(condition.Not); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, conditions := range ruleConditionBlocks(rule) {
+		if err := checkConditions(conditions.All); err != nil {
+			return err
+		}
+		if err := checkConditions(conditions.Any); err != nil {
+			return err
+		}
+		if err := checkConditions(conditions.Not); err != nil {
+			return err
+		}
+	}
+
+	for _, action := range ruleActions(rule) {
+		if action.Type != rules.ActionScript {
+			if len(action.Facts) > 0 {
+				return fmt.Errorf("rule '%s' has a %s action listing facts, which only script actions read", rule.Name, action.Type)
+			}
+			continue
+		}
+		source, ok := action.Value.(string)
+		if !ok {
+			return fmt.Errorf("script action of rule '%s' must have its script as value", rule.Name)
+		}
+		if action.Target == "" {
+			return fmt.Errorf("script action of rule '%s' has no target fact to write", rule.Name)
+		}
+		if err := check("action", source, action.Facts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
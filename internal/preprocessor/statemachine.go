@@ -0,0 +1,161 @@
+// pkg/preprocessor/statemachine.go
+
+package preprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+)
+
+// StateMachine models a lifecycle, such as a device's, as states and the
+// transitions between them. The preprocessor lowers it into ordinary rules
+// reading and writing a state fact it manages: each transition becomes a
+// rule that fires when the machine is in the transition's source state and
+// its conditions hold, and moves the machine to its target state.
+//
+// A ruleset with state machines is a JSON object with the rules under
+// "rules" and the machines under "stateMachines".
+type StateMachine struct {
+	Name     string  `json:"name"`
+	Fact     string  `json:"fact,omitempty"` // Fact holding the current state; <name>.state by default
+	Initial  string  `json:"initial"`        // State the machine starts in
+	Priority int     `json:"priority,omitempty"`
+	States   []State `json:"states"`
+}
+
+// State is a state of a state machine. The entry actions run when a
+// transition enters the state and the exit actions when one leaves it; the
+// initial state isn't entered, so its entry actions only run when a
+// transition comes back to it.
+type State struct {
+	Name        string            `json:"name"`
+	Entry       []json.RawMessage `json:"entry,omitempty"`
+	Exit        []json.RawMessage `json:"exit,omitempty"`
+	Transitions []Transition      `json:"transitions,omitempty"`
+}
+
+// Transition moves a state machine to another state when its conditions
+// hold, in the same form as a rule's. A transition without conditions is
+// taken as soon as the machine is in the source state.
+type Transition struct {
+	To         string            `json:"to"`
+	Conditions json.RawMessage   `json:"conditions,omitempty"`
+	Actions    []json.RawMessage `json:"actions,omitempty"`
+}
+
+// StateFact returns the name of the fact holding the machine's state.
+func (m *StateMachine) StateFact() string {
+	if m.Fact != "" {
+		return m.Fact
+	}
+	return m.Name + ".state"
+}
+
+// TransitionRuleName returns the name of the rule a transition is lowered
+// into. The nth transition between the same two states, from the second on,
+// gets the suffix #n.
+func TransitionRuleName(machine, from, to string, n int) string {
+	name := fmt.Sprintf("%s: %s -> %s", machine, from, to)
+	if n > 1 {
+		name += fmt.Sprintf(" #%d", n)
+	}
+	return name
+}
+
+// validate checks that the machine's states are named uniquely and that its
+// initial state and transition targets exist.
+func (m *StateMachine) validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("a state machine must have a name")
+	}
+	states := make(map[string]bool)
+	for _, state := range m.States {
+		if state.Name == "" {
+			return fmt.Errorf("state machine '%s' has a state without a name", m.Name)
+		}
+		if states[state.Name] {
+			return fmt.Errorf("state machine '%s' has two states named '%s'", m.Name, state.Name)
+		}
+		states[state.Name] = true
+	}
+	if !states[m.Initial] {
+		return fmt.Errorf("initial state '%s' of state machine '%s' is not one of its states", m.Initial, m.Name)
+	}
+	for _, state := range m.States {
+		for _, transition := range state.Transitions {
+			if !states[transition.To] {
+				return fmt.Errorf("state machine '%s' has a transition from '%s' to unknown state '%s'", m.Name, state.Name, transition.To)
+			}
+		}
+	}
+	return nil
+}
+
+// LowerStateMachine returns the JSON of the rules a state machine is lowered
+// into, one per transition in the order the states and their transitions are
+// declared. The conditions of a transition rule are the transition's, with a
+// condition on the state fact being the source state added to its "all"
+// conditions. Its actions are the exit actions of the source state, the
+// transition's actions, the write of the target state and the entry actions
+// of the target state.
+//
+// A transition sees the state written by the transitions before it in the
+// same cycle, so a machine can move through several transitions in one
+// cycle; each transition rule is still evaluated once per cycle, as any rule.
+func LowerStateMachine(machine *StateMachine) ([]json.RawMessage, error) {
+	if err := machine.validate(); err != nil {
+		return nil, err
+	}
+	stateFact := machine.StateFact()
+
+	entry := make(map[string][]json.RawMessage)
+	for _, state := range machine.States {
+		entry[state.Name] = state.Entry
+	}
+
+	var lowered []json.RawMessage
+	for _, state := range machine.States {
+		taken := make(map[string]int)
+		for _, transition := range state.Transitions {
+			var conditions struct {
+				All []json.RawMessage `json:"all,omitempty"`
+				Any []json.RawMessage `json:"any,omitempty"`
+			}
+			if len(transition.Conditions) > 0 {
+				if err := decodeJSONStrict(transition.Conditions, &conditions); err != nil {
+					return nil, fmt.Errorf("state machine '%s': invalid conditions of the transition from '%s' to '%s': %w",
+						machine.Name, state.Name, transition.To, err)
+				}
+			}
+			guard, err := json.Marshal(rules.Condition{Fact: stateFact, Operator: rules.OperatorEqual, Value: state.Name, ValueType: "string"})
+			if err != nil {
+				return nil, err
+			}
+			conditions.All = append([]json.RawMessage{guard}, conditions.All...)
+
+			update, err := json.Marshal(rules.Action{Type: rules.ActionUpdateFact, Target: stateFact, Value: transition.To})
+			if err != nil {
+				return nil, err
+			}
+			var actions []json.RawMessage
+			actions = append(actions, state.Exit...)
+			actions = append(actions, transition.Actions...)
+			actions = append(actions, update)
+			actions = append(actions, entry[transition.To]...)
+
+			taken[transition.To]++
+			rule, err := json.Marshal(map[string]interface{}{
+				"name":       TransitionRuleName(machine.Name, state.Name, transition.To, taken[transition.To]),
+				"priority":   machine.Priority,
+				"conditions": conditions,
+				"event":      map[string]interface{}{"actions": actions},
+			})
+			if err != nil {
+				return nil, err
+			}
+			lowered = append(lowered, rule)
+		}
+	}
+	return lowered, nil
+}
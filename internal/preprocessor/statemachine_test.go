@@ -0,0 +1,121 @@
+package preprocessor
+
+import (
+	"encoding/json"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const stateMachineRuleset = `{
+    "rules": [
+        {
+            "name": "coolDown",
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+            "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+        }
+    ],
+    "stateMachines": [
+        {
+            "name": "door",
+            "initial": "closed",
+            "priority": 5,
+            "states": [
+                {
+                    "name": "closed",
+                    "transitions": [
+                        {"to": "open", "conditions": {"all": [{"fact": "contact", "operator": "equal", "value": false}]}}
+                    ]
+                },
+                {
+                    "name": "open",
+                    "entry": [{"type": "notify", "target": "ops", "value": "door opened"}],
+                    "exit": [{"type": "logEvent", "target": "audit", "value": "door closing"}],
+                    "transitions": [
+                        {"to": "closed", "conditions": {"any": [{"fact": "contact", "operator": "equal", "value": true}]},
+                         "actions": [{"type": "updateFact", "target": "closed_count_pending", "value": true}]}
+                    ]
+                }
+            ]
+        }
+    ]
+}`
+
+func TestParseRuleset_StateMachines(t *testing.T) {
+	context := rules.NewRuleEngineContext()
+	ruleSet, err := ParseAndValidateRules([]byte(stateMachineRuleset), context)
+	require.NoError(t, err)
+	require.Len(t, ruleSet, 3)
+	assert.Equal(t, map[string]interface{}{"door.state": "closed"}, context.InitialFacts)
+
+	// Transition rules follow the rules written by hand
+	opening := ruleSet[1]
+	assert.Equal(t, "door: closed -> open", opening.Name)
+	assert.Equal(t, 5, opening.Priority)
+	assert.Equal(t, []rules.Condition{
+		{Fact: "door.state", Operator: "equal", Value: "closed", ValueType: "string"},
+		{Fact: "contact", Operator: "equal", Value: false},
+	}, opening.Conditions.All)
+	assert.Equal(t, []rules.Action{
+		{Type: "updateFact", Target: "door.state", Value: "open"},
+		{Type: "notify", Target: "ops", Value: "door opened"},
+	}, opening.Event.Actions)
+	assert.Equal(t, []string{"contact", "door.state"}, opening.ConsumedFacts)
+	assert.Equal(t, []string{"door.state"}, opening.ProducedFacts)
+
+	// Exit actions come first, then the transition's, the state change and
+	// the entry actions
+	closing := ruleSet[2]
+	assert.Equal(t, "door: open -> closed", closing.Name)
+	assert.Len(t, closing.Conditions.All, 1)
+	assert.Len(t, closing.Conditions.Any, 1)
+	var actions []string
+	for _, action := range closing.Event.Actions {
+		actions = append(actions, action.Type+" "+action.Target)
+	}
+	assert.Equal(t, []string{"logEvent audit", "updateFact closed_count_pending", "updateFact door.state"}, actions)
+	assert.Equal(t, []string{"closed_count_pending", "door.state"}, closing.ProducedFacts)
+}
+
+func TestParseRuleset_InvalidStateMachines(t *testing.T) {
+	for name, machines := range map[string]string{
+		"unknown initial state": `[{"name": "door", "initial": "ajar", "states": [{"name": "closed"}]}]`,
+		"unknown target":        `[{"name": "door", "initial": "closed", "states": [{"name": "closed", "transitions": [{"to": "ajar"}]}]}]`,
+		"duplicate state":       `[{"name": "door", "initial": "closed", "states": [{"name": "closed"}, {"name": "closed"}]}]`,
+		"duplicate machine":     `[{"name": "door", "initial": "closed", "states": [{"name": "closed"}]}, {"name": "door", "initial": "closed", "states": [{"name": "closed"}]}]`,
+		"unnamed machine":       `[{"initial": "closed", "states": [{"name": "closed"}]}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseAndValidateRules([]byte(`{"rules": [], "stateMachines": `+machines+`}`), rules.NewRuleEngineContext())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLowerStateMachine_RepeatedTransitions(t *testing.T) {
+	machine := StateMachine{Name: "pump", Initial: "off", States: []State{
+		{Name: "off", Transitions: []Transition{{To: "on"}, {To: "on"}}},
+		{Name: "on"},
+	}}
+	lowered, err := LowerStateMachine(&machine)
+	require.NoError(t, err)
+	require.Len(t, lowered, 2)
+	var rule rules.Rule
+	require.NoError(t, json.Unmarshal(lowered[1], &rule))
+	assert.Equal(t, "pump: off -> on #2", rule.Name)
+}
+
+func TestApplyOverlays_RulesetObject(t *testing.T) {
+	overlay := Overlay{Name: "rules.prod.json", JSON: []byte(`[{"name": "coolDown", "priority": 7}]`)}
+
+	merged, err := ApplyOverlays([]byte(stateMachineRuleset), overlay)
+	require.NoError(t, err)
+
+	ruleSet, err := ParseAndValidateRules(merged, rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	require.Len(t, ruleSet, 3)
+	assert.Equal(t, 7, ruleSet[0].Priority)
+	assert.Equal(t, "door: closed -> open", ruleSet[1].Name)
+}
@@ -0,0 +1,52 @@
+// pkg/preprocessor/strictness.go
+
+package preprocessor
+
+import "fmt"
+
+// Strictness groups the validation checks applied to a ruleset into levels,
+// so that small rulesets can be compiled with few checks and production
+// rulesets with all of them.
+type Strictness int
+
+const (
+	// StrictnessStandard checks that rules are well formed and that the
+	// conditions of a block aren't redundant, contradictory or ambiguous, and
+	// that actions write values of the types other rules compare facts as.
+	StrictnessStandard Strictness = iota
+	// StrictnessBasic only checks that rules are well formed.
+	StrictnessBasic
+	// StrictnessParanoid adds to the standard checks: conditions in nested
+	// blocks are checked like top-level ones and rules with unknown fields
+	// are rejected. The preprocessor also rejects mixed int and float
+	// comparisons and requires budgets to be declared.
+	StrictnessParanoid
+)
+
+// ParseStrictness returns the strictness level with the given name: basic,
+// standard or paranoid.
+func ParseStrictness(name string) (Strictness, error) {
+	switch name {
+	case "basic":
+		return StrictnessBasic, nil
+	case "standard":
+		return StrictnessStandard, nil
+	case "paranoid":
+		return StrictnessParanoid, nil
+	default:
+		return 0, fmt.Errorf("unknown strictness %q, must be basic, standard or paranoid", name)
+	}
+}
+
+func (s Strictness) String() string {
+	switch s {
+	case StrictnessBasic:
+		return "basic"
+	case StrictnessStandard:
+		return "standard"
+	case StrictnessParanoid:
+		return "paranoid"
+	default:
+		return fmt.Sprintf("Strictness(%d)", int(s))
+	}
+}
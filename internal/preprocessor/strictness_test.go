@@ -0,0 +1,84 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStrictness(t *testing.T) {
+	for _, level := range []Strictness{StrictnessBasic, StrictnessStandard, StrictnessParanoid} {
+		parsed, err := ParseStrictness(level.String())
+		require.NoError(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	_, err := ParseStrictness("lenient")
+	assert.ErrorContains(t, err, "unknown strictness")
+}
+
+func TestStrictnessLevels(t *testing.T) {
+	redundant := `[{
+        "name": "coolDown",
+        "conditions": {"all": [
+            {"fact": "temperature", "operator": "greaterThan", "value": 30},
+            {"fact": "temperature", "operator": "greaterThan", "value": 30}
+        ]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }]`
+	nestedContradiction := `[{
+        "name": "coolDown",
+        "conditions": {"all": [
+            {"any": [
+                {"all": [
+                    {"fact": "mode", "operator": "equal", "value": "eco"},
+                    {"fact": "mode", "operator": "notEqual", "value": "eco"}
+                ]},
+                {"fact": "temperature", "operator": "greaterThan", "value": 30}
+            ]}
+        ]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }]`
+	unknownField := `[{
+        "name": "coolDown",
+        "owner": "facilities",
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+    }]`
+	actionType := `[
+        {
+            "name": "setMode",
+            "conditions": {"all": [{"fact": "occupied", "operator": "equal", "value": true}]},
+            "event": {"actions": [{"type": "updateFact", "target": "setpoint", "value": "comfort"}]}
+        },
+        {
+            "name": "heat",
+            "conditions": {"all": [{"fact": "setpoint", "operator": "greaterThan", "value": 20}]},
+            "event": {"actions": [{"type": "updateFact", "target": "heater", "value": true}]}
+        }
+    ]`
+
+	testCases := []struct {
+		name     string
+		ruleJSON string
+		accepted map[Strictness]bool
+	}{
+		{"redundant conditions", redundant, map[Strictness]bool{StrictnessBasic: true}},
+		{"nested contradiction", nestedContradiction, map[Strictness]bool{StrictnessBasic: true, StrictnessStandard: true}},
+		{"unknown field", unknownField, map[Strictness]bool{StrictnessBasic: true, StrictnessStandard: true}},
+		{"action value type", actionType, map[Strictness]bool{StrictnessBasic: true}},
+	}
+
+	for _, tc := range testCases {
+		for _, level := range []Strictness{StrictnessBasic, StrictnessStandard, StrictnessParanoid} {
+			_, err := ParseAndValidateRulesWithOptions([]byte(tc.ruleJSON), rules.NewRuleEngineContext(), ParseOptions{Strictness: level})
+			if tc.accepted[level] {
+				assert.NoError(t, err, "%s should be accepted at %s strictness", tc.name, level)
+			} else {
+				assert.Error(t, err, "%s should be rejected at %s strictness", tc.name, level)
+			}
+		}
+	}
+}
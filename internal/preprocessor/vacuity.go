@@ -0,0 +1,347 @@
+// pkg/preprocessor/vacuity.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/rules"
+	"sort"
+)
+
+// VacuousCondition is a block of conditions that holds whatever the value of
+// a fact, or for no value at all, such as temperature > 30 and temperature <
+// 20. Such a block usually means the rule was written wrong.
+type VacuousCondition struct {
+	Rule   string `json:"rule"`
+	Path   string `json:"path"`   // Block of the rule, e.g. conditions.all or conditions.any[1].all
+	Fact   string `json:"fact"`   // Fact whose conditions decide the block
+	Always bool   `json:"always"` // Whether the block always holds; otherwise it never does
+}
+
+func (v VacuousCondition) String() string {
+	if v.Always {
+		return fmt.Sprintf("%s of rule '%s' always holds: its conditions on '%s' cover every value", v.Path, v.Rule, v.Fact)
+	}
+	return fmt.Sprintf("%s of rule '%s' never holds: no value of '%s' satisfies its conditions", v.Path, v.Rule, v.Fact)
+}
+
+// FindVacuousConditions reports the blocks of conditions in a ruleset that
+// always or never hold because of the conditions on a single fact. The values
+// satisfying the conditions on each fact are worked out as intervals of
+// numbers or sets of strings and bools: in an all block they must overlap, and
+// in an any block they must not cover every value. A not block whose
+// conditions can't all hold always holds. Conditions using other
+// operators, and fact patterns, are left out of the analysis.
+func FindVacuousConditions(ruleSet []*rules.Rule) []VacuousCondition {
+	var found []VacuousCondition
+	for _, rule := range ruleSet {
+		if rule.Scored() {
+			// The conditions of a scoring rule add to its score rather than
+			// all having to hold, so only the blocks nested in them are checked
+			for i, condition := range rule.Conditions.All {
+				if condition.Fact == "" {
+					path := fmt.Sprintf("conditions.all[%d]", i)
+					found = append(found, vacuousBlocks(rule.Name, path, condition.All, condition.Any, condition.Not)...)
+				}
+			}
+			continue
+		}
+		found = append(found, vacuousBlocks(rule.Name, "conditions", rule.Conditions.All, rule.Conditions.Any, rule.Conditions.Not)...)
+	}
+	return found
+}
+
+// vacuousBlocks checks the all, any and not blocks at path and the blocks
+// nested in them.
+func vacuousBlocks(ruleName, path string, all, any, not []rules.Condition) []VacuousCondition {
+	var found []VacuousCondition
+	for _, block := range []struct {
+		key        string
+		conditions []rules.Condition
+	}{{"all", all}, {"any", any}, {"not", not}} {
+		blockPath := path + "." + block.key
+		if fact, ok := vacuousFact(block.conditions, block.key == "any"); ok {
+			found = append(found, VacuousCondition{Rule: ruleName, Path: blockPath, Fact: fact, Always: block.key != "all"})
+		}
+		for i, condition := range block.conditions {
+			if condition.Fact == "" {
+				found = append(found, vacuousBlocks(ruleName, fmt.Sprintf("%s[%d]", blockPath, i), condition.All, condition.Any, condition.Not)...)
+			}
+		}
+	}
+	return found
+}
+
+// vacuousFact returns a fact whose conditions in a block leave no value
+// satisfying all of them or, for an any block, no value satisfying none of
+// them.
+func vacuousFact(conditions []rules.Condition, any bool) (string, bool) {
+	sets := make(map[string]valueSet)
+	var facts []string
+	for _, condition := range conditions {
+		if condition.Fact == "" || rules.IsFactPattern(condition.Fact) {
+			continue
+		}
+		set, ok := conditionValues(condition)
+		if !ok {
+			continue
+		}
+		previous, seen := sets[condition.Fact]
+		switch {
+		case !seen:
+			facts = append(facts, condition.Fact)
+		case previous == nil || previous.kind() != set.kind():
+			// The fact is compared as values of different kinds
+			set = nil
+		case any:
+			set = previous.union(set)
+		default:
+			set = previous.intersect(set)
+		}
+		sets[condition.Fact] = set
+	}
+
+	for _, fact := range facts {
+		set := sets[fact]
+		if set != nil && (any && set.full() || !any && set.empty()) {
+			return fact, true
+		}
+	}
+	return "", false
+}
+
+// valueSet is the set of values of a fact that satisfy some conditions.
+type valueSet interface {
+	kind() string
+	intersect(other valueSet) valueSet
+	union(other valueSet) valueSet
+	complement() valueSet
+	empty() bool
+	full() bool
+}
+
+// subset reports whether every value of a is in b.
+func subset(a, b valueSet) bool {
+	return a.intersect(b.complement()).empty()
+}
+
+// conditionValues returns the values satisfying a comparison, if its
+// operator and value are understood.
+func conditionValues(condition rules.Condition) (valueSet, bool) {
+	operator := NormalizeOperator(condition.Operator)
+	switch value := condition.Value.(type) {
+	case string, bool:
+		switch operator {
+		case "equal":
+			return discreteSet{of: fmt.Sprintf("%T", value), values: map[interface{}]bool{value: true}}, true
+		case "notEqual":
+			return discreteSet{of: fmt.Sprintf("%T", value), values: map[interface{}]bool{value: true}, excluded: true}, true
+		}
+		return nil, false
+	}
+
+	v, ok := numberValue(condition.Value)
+	if !ok || math.IsNaN(v) {
+		return nil, false
+	}
+	epsilon := 0.0
+	if condition.Epsilon != nil {
+		epsilon = *condition.Epsilon
+	}
+	inf := math.Inf(1)
+	switch operator {
+	case "equal":
+		return intervalSet{{lo: v - epsilon, hi: v + epsilon, loIn: true, hiIn: true}}, true
+	case "notEqual":
+		return intervalSet{{lo: -inf, hi: v - epsilon}, {lo: v + epsilon, hi: inf}}.normalize(), true
+	case "lessThan":
+		return intervalSet{{lo: -inf, hi: v}}, true
+	case "lessThanOrEqual":
+		return intervalSet{{lo: -inf, hi: v, hiIn: true}}, true
+	case "greaterThan":
+		return intervalSet{{lo: v, hi: inf}}, true
+	case "greaterThanOrEqual":
+		return intervalSet{{lo: v, hi: inf, loIn: true}}, true
+	}
+	return nil, false
+}
+
+// numberValue converts a numeric condition value to float64.
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// interval is a range of numbers, including its bounds if loIn and hiIn are
+// set. Infinite bounds stand for unbounded ranges.
+type interval struct {
+	lo, hi     float64
+	loIn, hiIn bool
+}
+
+func (i interval) empty() bool {
+	return i.lo > i.hi || i.lo == i.hi && !(i.loIn && i.hiIn)
+}
+
+// intervalSet is a set of numbers as a sorted list of disjoint intervals.
+type intervalSet []interval
+
+func (s intervalSet) kind() string { return "number" }
+
+func (s intervalSet) intersect(other valueSet) valueSet {
+	var result intervalSet
+	for _, a := range s {
+		for _, b := range other.(intervalSet) {
+			i := a
+			if b.lo > i.lo || b.lo == i.lo && !b.loIn {
+				i.lo, i.loIn = b.lo, b.loIn
+			}
+			if b.hi < i.hi || b.hi == i.hi && !b.hiIn {
+				i.hi, i.hiIn = b.hi, b.hiIn
+			}
+			result = append(result, i)
+		}
+	}
+	return result.normalize()
+}
+
+func (s intervalSet) union(other valueSet) valueSet {
+	return append(append(intervalSet{}, s...), other.(intervalSet)...).normalize()
+}
+
+func (s intervalSet) complement() valueSet {
+	result := intervalSet{}
+	lo, loIn := math.Inf(-1), false
+	for _, i := range s {
+		result = append(result, interval{lo: lo, hi: i.lo, loIn: loIn, hiIn: !i.loIn})
+		lo, loIn = i.hi, !i.hiIn
+	}
+	return append(result, interval{lo: lo, hi: math.Inf(1), loIn: loIn}).normalize()
+}
+
+func (s intervalSet) empty() bool {
+	return len(s) == 0
+}
+
+func (s intervalSet) full() bool {
+	return len(s) == 1 && math.IsInf(s[0].lo, -1) && math.IsInf(s[0].hi, 1)
+}
+
+// normalize drops empty intervals and merges those that overlap or touch.
+func (s intervalSet) normalize() intervalSet {
+	var sorted intervalSet
+	for _, i := range s {
+		if !i.empty() {
+			sorted = append(sorted, i)
+		}
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].lo < sorted[b].lo || sorted[a].lo == sorted[b].lo && sorted[a].loIn && !sorted[b].loIn
+	})
+
+	var merged intervalSet
+	for _, i := range sorted {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if i.lo < last.hi || i.lo == last.hi && (i.loIn || last.hiIn) {
+				if i.hi > last.hi || i.hi == last.hi && i.hiIn {
+					last.hi, last.hiIn = i.hi, i.hiIn
+				}
+				continue
+			}
+		}
+		merged = append(merged, i)
+	}
+	return merged
+}
+
+// discreteSet is a set of strings or bools: the values listed, or all values
+// but those if excluded is set.
+type discreteSet struct {
+	of       string // Type of the values, string or bool
+	values   map[interface{}]bool
+	excluded bool
+}
+
+func (s discreteSet) kind() string { return s.of }
+
+func (s discreteSet) intersect(other valueSet) valueSet {
+	o := other.(discreteSet)
+	switch {
+	case !s.excluded && !o.excluded:
+		return discreteSet{of: s.of, values: filterValues(s.values, func(v interface{}) bool { return o.values[v] })}
+	case !s.excluded:
+		return discreteSet{of: s.of, values: filterValues(s.values, func(v interface{}) bool { return !o.values[v] })}
+	case !o.excluded:
+		return o.intersect(s)
+	default:
+		return discreteSet{of: s.of, values: unionValues(s.values, o.values), excluded: true}
+	}
+}
+
+func (s discreteSet) union(other valueSet) valueSet {
+	o := other.(discreteSet)
+	switch {
+	case !s.excluded && !o.excluded:
+		return discreteSet{of: s.of, values: unionValues(s.values, o.values)}
+	case s.excluded && !o.excluded:
+		return discreteSet{of: s.of, values: filterValues(s.values, func(v interface{}) bool { return !o.values[v] }), excluded: true}
+	case !s.excluded:
+		return o.union(s)
+	default:
+		return discreteSet{of: s.of, values: filterValues(s.values, func(v interface{}) bool { return o.values[v] }), excluded: true}
+	}
+}
+
+func (s discreteSet) complement() valueSet {
+	return discreteSet{of: s.of, values: s.values, excluded: !s.excluded}
+}
+
+// empty and full take into account that there are only two bools.
+func (s discreteSet) empty() bool {
+	if s.excluded {
+		return s.kind() == "bool" && len(s.values) == 2
+	}
+	return len(s.values) == 0
+}
+
+func (s discreteSet) full() bool {
+	if s.excluded {
+		return len(s.values) == 0
+	}
+	return s.kind() == "bool" && len(s.values) == 2
+}
+
+func filterValues(values map[interface{}]bool, keep func(v interface{}) bool) map[interface{}]bool {
+	filtered := make(map[interface{}]bool)
+	for value := range values {
+		if keep(value) {
+			filtered[value] = true
+		}
+	}
+	return filtered
+}
+
+func unionValues(a, b map[interface{}]bool) map[interface{}]bool {
+	union := make(map[interface{}]bool, len(a)+len(b))
+	for value := range a {
+		union[value] = true
+	}
+	for value := range b {
+		union[value] = true
+	}
+	return union
+}
@@ -0,0 +1,120 @@
+package preprocessor
+
+import (
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func vacuityRule(conditions rules.Conditions) []*rules.Rule {
+	return []*rules.Rule{{Name: "r", Conditions: conditions}}
+}
+
+func TestFindVacuousConditions_Never(t *testing.T) {
+	found := FindVacuousConditions(vacuityRule(rules.Conditions{All: []rules.Condition{
+		{Fact: "temperature", Operator: "greaterThan", Value: 30},
+		{Fact: "humidity", Operator: "lessThan", Value: 50},
+		{Fact: "temperature", Operator: "lessThan", Value: 20.0},
+	}}))
+	assert.Equal(t, []VacuousCondition{{Rule: "r", Path: "conditions.all", Fact: "temperature"}}, found)
+	assert.Equal(t, "conditions.all of rule 'r' never holds: no value of 'temperature' satisfies its conditions", found[0].String())
+
+	found = FindVacuousConditions(vacuityRule(rules.Conditions{All: []rules.Condition{
+		{Fact: "mode", Operator: "equal", Value: "auto"},
+		{Fact: "mode", Operator: "equal", Value: "manual"},
+	}}))
+	assert.Equal(t, []VacuousCondition{{Rule: "r", Path: "conditions.all", Fact: "mode"}}, found)
+}
+
+func TestFindVacuousConditions_Always(t *testing.T) {
+	epsilon := 0.5
+	for name, any := range map[string][]rules.Condition{
+		"aliases": {
+			{Fact: "temperature", Operator: "<", Value: 5},
+			{Fact: "temperature", Operator: ">=", Value: 5},
+		},
+		"bools": {
+			{Fact: "open", Operator: "equal", Value: true},
+			{Fact: "open", Operator: "equal", Value: false},
+		},
+		"epsilon": {
+			{Fact: "level", Operator: "notEqual", Value: 10.0, Epsilon: &epsilon},
+			{Fact: "level", Operator: "greaterThan", Value: 9.0},
+		},
+	} {
+		found := FindVacuousConditions(vacuityRule(rules.Conditions{Any: any}))
+		if assert.Len(t, found, 1, name) {
+			assert.Equal(t, "conditions.any", found[0].Path, name)
+			assert.True(t, found[0].Always, name)
+		}
+	}
+}
+
+func TestFindVacuousConditions_Nested(t *testing.T) {
+	found := FindVacuousConditions(vacuityRule(rules.Conditions{All: []rules.Condition{
+		{Fact: "mode", Operator: "equal", Value: "auto"},
+		{Any: []rules.Condition{
+			{Fact: "mode", Operator: "notEqual", Value: "auto"},
+			{Fact: "mode", Operator: "equal", Value: "auto"},
+		}},
+	}}))
+	assert.Equal(t, []VacuousCondition{{Rule: "r", Path: "conditions.all[1].any", Fact: "mode", Always: true}}, found)
+}
+
+func TestFindVacuousConditions_Not(t *testing.T) {
+	found := FindVacuousConditions(vacuityRule(rules.Conditions{
+		All: []rules.Condition{{Fact: "occupied", Operator: "equal", Value: true}},
+		Not: []rules.Condition{
+			{Fact: "temperature", Operator: "greaterThan", Value: 30},
+			{Fact: "temperature", Operator: "lessThan", Value: 20},
+		},
+	}))
+	assert.Equal(t, []VacuousCondition{{Rule: "r", Path: "conditions.not", Fact: "temperature", Always: true}}, found)
+}
+
+func TestFindVacuousConditions_Scored(t *testing.T) {
+	ruleSet := vacuityRule(rules.Conditions{All: []rules.Condition{
+		{Fact: "mode", Operator: "equal", Value: "auto"},
+		{Fact: "mode", Operator: "equal", Value: "manual"},
+		{All: []rules.Condition{
+			{Fact: "temperature", Operator: "greaterThan", Value: 30},
+			{Fact: "temperature", Operator: "lessThan", Value: 20},
+		}},
+	}})
+	ruleSet[0].Score = &rules.Score{Fact: "risk", Threshold: 1}
+
+	found := FindVacuousConditions(ruleSet)
+	assert.Equal(t, []VacuousCondition{{Rule: "r", Path: "conditions.all[2].all", Fact: "temperature"}}, found)
+}
+
+func TestFindVacuousConditions_NotVacuous(t *testing.T) {
+	for name, conditions := range map[string]rules.Conditions{
+		"overlapping": {All: []rules.Condition{
+			{Fact: "temperature", Operator: "greaterThan", Value: 20},
+			{Fact: "temperature", Operator: "lessThanOrEqual", Value: 30},
+		}},
+		"gap": {Any: []rules.Condition{
+			{Fact: "temperature", Operator: "lessThan", Value: 5},
+			{Fact: "temperature", Operator: "greaterThan", Value: 5},
+		}},
+		"strings": {Any: []rules.Condition{
+			{Fact: "mode", Operator: "equal", Value: "auto"},
+			{Fact: "mode", Operator: "equal", Value: "manual"},
+		}},
+		"mixed kinds": {All: []rules.Condition{
+			{Fact: "level", Operator: "equal", Value: "high"},
+			{Fact: "level", Operator: "equal", Value: 3},
+		}},
+		"pattern": {All: []rules.Condition{
+			{Fact: "sensor.*.temperature", Operator: "greaterThan", Value: 30},
+			{Fact: "sensor.*.temperature", Operator: "lessThan", Value: 20},
+		}},
+		"other operators": {All: []rules.Condition{
+			{Fact: "name", Operator: "contains", Value: "a"},
+			{Fact: "name", Operator: "equal", Value: "b"},
+		}},
+	} {
+		assert.Empty(t, FindVacuousConditions(vacuityRule(conditions)), name)
+	}
+}
@@ -0,0 +1,78 @@
+// pkg/preprocessor/webhook.go
+
+package preprocessor
+
+import (
+	"fmt"
+	"net/url"
+	"rgehrsitz/rex/internal/rules"
+	"slices"
+	"time"
+)
+
+// maxWebhookRetries bounds the retries of a webhook action, so that a failing
+// endpoint can't hold up the actions after it for long.
+const maxWebhookRetries = 10
+
+// webhookMethods are the HTTP methods a webhook action may use.
+var webhookMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// validateWebhooks checks the webhook actions of a rule: the target is an
+// http or https URL, the method, timeout and retries of the request are
+// valid, and its body template parses. Other actions may not have a request.
+func validateWebhooks(rule *rules.Rule) error {
+	for _, action := range ruleActions(rule) {
+		if action.Type != rules.ActionWebhook {
+			if action.Webhook != nil {
+				return fmt.Errorf("%s action of rule '%s' has a webhook request, which only webhook actions send", action.Type, rule.Name)
+			}
+			continue
+		}
+		if err := validateWebhook(action); err != nil {
+			return fmt.Errorf("webhook action of rule '%s': %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func validateWebhook(action rules.Action) error {
+	u, err := url.Parse(action.Target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("target must be an http or https URL, not '%s'", action.Target)
+	}
+	if action.Value != nil {
+		return fmt.Errorf("has a value; the request body is given by webhook.body")
+	}
+	request := action.Webhook
+	if request == nil {
+		request = &rules.WebhookRequest{}
+	}
+	if request.Method != "" && !slices.Contains(webhookMethods, request.Method) {
+		return fmt.Errorf("unsupported method '%s', must be one of %v", request.Method, webhookMethods)
+	}
+	if request.Timeout != "" {
+		timeout, err := time.ParseDuration(request.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout '%s', must be a positive duration such as 5s", request.Timeout)
+		}
+	}
+	if request.Retries < 0 || request.Retries > maxWebhookRetries {
+		return fmt.Errorf("retries must be between 0 and %d", maxWebhookRetries)
+	}
+	if _, err := rules.ParseTemplate(request.Body); err != nil {
+		return fmt.Errorf("body: %w", err)
+	}
+	return nil
+}
+
+// webhookFacts returns the facts the body of a webhook action references.
+func webhookFacts(action rules.Action) []string {
+	if action.Type != rules.ActionWebhook || action.Webhook == nil {
+		return nil
+	}
+	parts, err := rules.ParseTemplate(action.Webhook.Body)
+	if err != nil {
+		return nil
+	}
+	return rules.TemplateFacts(parts)
+}
@@ -0,0 +1,412 @@
+// rpcserver/server.go
+
+// Package rpcserver implements the Rex gRPC service, which compiles rulesets
+// and evaluates the loaded bytecode against the facts clients send.
+package rpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/runtime"
+	"rgehrsitz/rex/rexpb"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// subscriberBuffer is the number of actions a StreamActions client may fall
+// behind by before actions are dropped for it.
+const subscriberBuffer = 100
+
+// Server implements rexpb.RexServer. The loaded bytecode is evaluated by a
+// VM streaming the fact updates clients send, as the runtime's -stream mode
+// does.
+type Server struct {
+	rexpb.UnimplementedRexServer
+	configure func(vm *runtime.VM)
+
+	mu      sync.Mutex // Serializes loads and updates
+	vm      *runtime.VM
+	names   []string // Names of the rules of the VM's bytecode
+	updates chan runtime.FactUpdate
+	stopped chan struct{} // Closed once the VM has stopped streaming
+
+	factsMu sync.Mutex
+	facts   map[string]interface{} // The VM's facts as of its last cycle; never changed, only replaced
+
+	subsMu sync.Mutex
+	subs   map[*subscriber]bool
+}
+
+// subscriber is a StreamActions call.
+type subscriber struct {
+	types   map[string]bool // Types of the actions sent; every type if empty
+	actions chan *rexpb.Action
+}
+
+// New creates a server with no bytecode loaded. configure, if not nil, is
+// called with the VM of each bytecode loaded before it starts evaluating.
+func New(configure func(vm *runtime.VM)) *Server {
+	return &Server{configure: configure, subs: make(map[*subscriber]bool)}
+}
+
+// Register registers the service with a gRPC server.
+func (s *Server) Register(server *grpc.Server) {
+	rexpb.RegisterRexServer(server, s)
+}
+
+// Load replaces the bytecode evaluated, as LoadBytecode does, and returns
+// the VM evaluating it. The image may be in the encoding the compiler writes,
+// as CompileRules returns it, or already converted for the VM.
+func (s *Server) Load(image []byte) (*runtime.VM, error) {
+	vm := runtime.NewVM(image)
+	if err := vm.DecodeError(); err != nil {
+		return nil, fmt.Errorf("invalid bytecode: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vm != nil {
+		s.stop()
+		vm.SetFacts(s.vm.Facts())
+	}
+	// The VM's facts can't be read while it streams, so GetFacts answers
+	// with a copy taken after each cycle
+	vm.OnAfterCycle(func(error) {
+		facts := vm.Facts()
+		s.factsMu.Lock()
+		s.facts = facts
+		s.factsMu.Unlock()
+	})
+	if s.configure != nil {
+		s.configure(vm)
+	}
+	var names []string
+	for _, info := range vm.Rules() {
+		names = append(names, info.Name)
+	}
+	updates, stopped := make(chan runtime.FactUpdate, 1000), make(chan struct{})
+	s.vm, s.names, s.updates, s.stopped = vm, names, updates, stopped
+
+	actions := make(chan runtime.Action, subscriberBuffer)
+	go func() {
+		defer close(actions)
+		vm.Stream(context.Background(), updates, actions) // Only ends once updates is closed
+	}()
+	go func() {
+		defer close(stopped)
+		for action := range actions {
+			s.broadcast(toAction(action, names))
+		}
+	}()
+	return vm, nil
+}
+
+// Close stops evaluating, once the updates received are evaluated.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vm != nil {
+		s.stop()
+		s.vm, s.names = nil, nil
+	}
+	s.factsMu.Lock()
+	s.facts = nil
+	s.factsMu.Unlock()
+}
+
+// stop closes the updates of the VM and waits for it to evaluate them.
+func (s *Server) stop() {
+	close(s.updates)
+	<-s.stopped
+}
+
+// broadcast sends an action to the StreamActions clients watching its type.
+func (s *Server) broadcast(action *rexpb.Action) {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	for sub := range s.subs {
+		if len(sub.types) > 0 && !sub.types[action.Type] {
+			continue
+		}
+		select {
+		case sub.actions <- action:
+		default:
+			log.Warn().Str("Type", action.Type).Int32("Rule", action.Rule).Msg("Dropping action for StreamActions client falling behind")
+		}
+	}
+}
+
+// CompileRules implements rexpb.RexServer.
+func (s *Server) CompileRules(ctx context.Context, req *rexpb.CompileRulesRequest) (*rexpb.CompileRulesResponse, error) {
+	options := compiler.Options{StrictFields: req.StrictFields, Scripts: req.Scripts, EmbedSource: req.EmbedSource}
+	if req.Strictness != "" {
+		strictness, err := preprocessor.ParseStrictness(req.Strictness)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		options.Strictness = strictness
+	}
+
+	compiled, err := compile(req.Rules, options)
+	if err != nil {
+		return &rexpb.CompileRulesResponse{Errors: toRuleErrors(err)}, nil
+	}
+	if req.Load {
+		if _, err := s.Load(compiled.Image); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to load compiled bytecode: %v", err)
+		}
+	}
+	return &rexpb.CompileRulesResponse{Bytecode: compiled.Image, RulesetHash: compiled.Provenance.RulesetHash}, nil
+}
+
+// compile parses, optimizes and compiles a ruleset.
+func compile(rulesJSON []byte, options compiler.Options) (*compiler.Bytecode, error) {
+	ruleset, err := compiler.ParseRules(rulesJSON, options)
+	if err != nil {
+		return nil, err
+	}
+	if ruleset, err = compiler.Optimize(ruleset); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(ruleset, options)
+}
+
+// toRuleErrors lists the problems of a ruleset.
+func toRuleErrors(err error) []*rexpb.RuleError {
+	var rulesetErr *compiler.RulesetError
+	if !errors.As(err, &rulesetErr) {
+		return []*rexpb.RuleError{{Message: err.Error()}}
+	}
+	ruleErrors := make([]*rexpb.RuleError, len(rulesetErr.Errors))
+	for i, e := range rulesetErr.Errors {
+		ruleErrors[i] = &rexpb.RuleError{Rule: e.Rule, Path: e.Path, Line: int32(e.Line), Column: int32(e.Column), Message: e.Err.Error()}
+	}
+	return ruleErrors
+}
+
+// LoadBytecode implements rexpb.RexServer.
+func (s *Server) LoadBytecode(ctx context.Context, req *rexpb.LoadBytecodeRequest) (*rexpb.LoadBytecodeResponse, error) {
+	vm, err := s.Load(req.Bytecode)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	resp := &rexpb.LoadBytecodeResponse{}
+	for _, info := range vm.Rules() {
+		resp.Rules = append(resp.Rules, info.Name)
+	}
+	if provenance, ok := vm.Provenance(); ok {
+		resp.RulesetHash = provenance.RulesetHash
+	}
+	return resp, nil
+}
+
+// UpdateFacts implements rexpb.RexServer.
+func (s *Server) UpdateFacts(ctx context.Context, req *rexpb.UpdateFactsRequest) (*rexpb.UpdateFactsResponse, error) {
+	updates, correlationID, err := toUpdates(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.send(ctx, updates); err != nil {
+		return nil, err
+	}
+	return &rexpb.UpdateFactsResponse{CorrelationId: correlationID}, nil
+}
+
+// Evaluate implements rexpb.RexServer. The updates are sent as one batch,
+// the last of which reports when the batch has been evaluated.
+func (s *Server) Evaluate(ctx context.Context, req *rexpb.UpdateFactsRequest) (*rexpb.EvaluateResponse, error) {
+	updates, correlationID, err := toUpdates(req)
+	if err != nil {
+		return nil, err
+	}
+	evaluated := make(chan []runtime.Action, 1)
+	if len(updates) > 0 {
+		for i := range updates[:len(updates)-1] {
+			updates[i].More = true
+		}
+		updates[len(updates)-1].Evaluated = evaluated
+	}
+	names, err := s.send(ctx, updates)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &rexpb.EvaluateResponse{CorrelationId: correlationID}
+	if len(updates) == 0 {
+		return resp, nil
+	}
+	select {
+	case actions := <-evaluated:
+		for _, action := range actions {
+			resp.Actions = append(resp.Actions, toAction(action, names))
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// toUpdates converts the updates of a request to those of the VM, labelled
+// with the request's correlation ID or a random one, which it returns.
+func toUpdates(req *rexpb.UpdateFactsRequest) ([]runtime.FactUpdate, string, error) {
+	correlationID := req.CorrelationId
+	if correlationID == "" {
+		correlationID = runtime.NewCorrelationID()
+	}
+	var updates []runtime.FactUpdate
+	for name, value := range req.Set {
+		v, err := fromValue(value)
+		if err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "fact %s: %v", name, err)
+		}
+		updates = append(updates, runtime.FactUpdate{Fact: name, Value: v, CorrelationID: correlationID})
+	}
+	for _, name := range req.Delete {
+		updates = append(updates, runtime.FactUpdate{Fact: name, Deleted: true, CorrelationID: correlationID})
+	}
+	return updates, correlationID, nil
+}
+
+// send queues updates for the VM and returns the names of its rules. Once
+// an update marked More is queued, the VM waits for the next one, which is
+// queued even if ctx ends.
+func (s *Server) send(ctx context.Context, updates []runtime.FactUpdate) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vm == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no bytecode loaded")
+	}
+	for i, update := range updates {
+		if i > 0 && updates[i-1].More {
+			s.updates <- update
+			continue
+		}
+		select {
+		case s.updates <- update:
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	return s.names, nil
+}
+
+// GetFacts implements rexpb.RexServer.
+func (s *Server) GetFacts(ctx context.Context, req *rexpb.GetFactsRequest) (*rexpb.GetFactsResponse, error) {
+	s.mu.Lock()
+	loaded := s.vm != nil
+	s.mu.Unlock()
+	if !loaded {
+		return nil, status.Error(codes.FailedPrecondition, "no bytecode loaded")
+	}
+	s.factsMu.Lock()
+	facts := s.facts
+	s.factsMu.Unlock()
+
+	resp := &rexpb.GetFactsResponse{Facts: make(map[string]*rexpb.Value)}
+	if len(req.Names) == 0 {
+		for name, value := range facts {
+			resp.Facts[name] = toValue(value)
+		}
+		return resp, nil
+	}
+	for _, name := range req.Names {
+		if value, ok := facts[name]; ok {
+			resp.Facts[name] = toValue(value)
+		}
+	}
+	return resp, nil
+}
+
+// StreamActions implements rexpb.RexServer.
+func (s *Server) StreamActions(req *rexpb.StreamActionsRequest, stream rexpb.Rex_StreamActionsServer) error {
+	sub := &subscriber{types: make(map[string]bool), actions: make(chan *rexpb.Action, subscriberBuffer)}
+	for _, actionType := range req.Types {
+		sub.types[actionType] = true
+	}
+	s.subsMu.Lock()
+	s.subs[sub] = true
+	s.subsMu.Unlock()
+	defer func() {
+		s.subsMu.Lock()
+		delete(s.subs, sub)
+		s.subsMu.Unlock()
+	}()
+
+	// Tell the client it won't miss the actions of the updates it sends next
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case action := <-sub.actions:
+			if err := stream.Send(action); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// toAction converts an action of the VM, naming its rule.
+func toAction(action runtime.Action, names []string) *rexpb.Action {
+	converted := &rexpb.Action{
+		Rule:          int32(action.Rule),
+		Type:          action.Type,
+		Target:        action.Target,
+		Value:         toValue(action.Value),
+		CorrelationId: action.CorrelationID,
+		RulesetHash:   action.RulesetHash,
+	}
+	if action.Rule >= 0 && action.Rule < len(names) {
+		converted.RuleName = names[action.Rule]
+	}
+	return converted
+}
+
+// toValue converts a fact value. Values of other kinds than ints, floats,
+// strings and bools are sent as text.
+func toValue(value interface{}) *rexpb.Value {
+	switch v := value.(type) {
+	case int:
+		return &rexpb.Value{Kind: &rexpb.Value_IntValue{IntValue: int64(v)}}
+	case int64:
+		return &rexpb.Value{Kind: &rexpb.Value_IntValue{IntValue: v}}
+	case float64:
+		return &rexpb.Value{Kind: &rexpb.Value_FloatValue{FloatValue: v}}
+	case float32:
+		return &rexpb.Value{Kind: &rexpb.Value_FloatValue{FloatValue: float64(v)}}
+	case string:
+		return &rexpb.Value{Kind: &rexpb.Value_StringValue{StringValue: v}}
+	case bool:
+		return &rexpb.Value{Kind: &rexpb.Value_BoolValue{BoolValue: v}}
+	case nil:
+		return nil
+	default:
+		return &rexpb.Value{Kind: &rexpb.Value_StringValue{StringValue: fmt.Sprint(v)}}
+	}
+}
+
+// fromValue converts a fact value sent by a client.
+func fromValue(value *rexpb.Value) (interface{}, error) {
+	switch v := value.GetKind().(type) {
+	case *rexpb.Value_IntValue:
+		return int(v.IntValue), nil
+	case *rexpb.Value_FloatValue:
+		return v.FloatValue, nil
+	case *rexpb.Value_StringValue:
+		return v.StringValue, nil
+	case *rexpb.Value_BoolValue:
+		return v.BoolValue, nil
+	default:
+		return nil, errors.New("value has no kind")
+	}
+}
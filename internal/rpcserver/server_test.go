@@ -0,0 +1,202 @@
+package rpcserver
+
+import (
+	"context"
+	"net"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/rexpb"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const alertRules = `[
+    {
+        "name": "overheating",
+        "consumedFacts": ["temperature"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "sendAlert", "target": "ops", "value": "too hot"}]}
+    }
+]`
+
+// newTestClient serves a Server over an in-memory connection.
+func newTestClient(t *testing.T) (*Server, rexpb.RexClient) {
+	listener := bufconn.Listen(1 << 20)
+	server := New(nil)
+	grpcServer := grpc.NewServer()
+	server.Register(grpcServer)
+	go grpcServer.Serve(listener)
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		server.Close()
+	})
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return server, rexpb.NewRexClient(conn)
+}
+
+// streamActions starts watching actions, returning once the server watches
+// them.
+func streamActions(t *testing.T, client rexpb.RexClient, types ...string) rexpb.Rex_StreamActionsClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	stream, err := client.StreamActions(ctx, &rexpb.StreamActionsRequest{Types: types})
+	require.NoError(t, err)
+	_, err = stream.Header()
+	require.NoError(t, err)
+	return stream
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+
+	_, err := client.UpdateFacts(ctx, &rexpb.UpdateFactsRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	compiled, err := client.CompileRules(ctx, &rexpb.CompileRulesRequest{Rules: []byte(alertRules), Load: true})
+	require.NoError(t, err)
+	assert.Empty(t, compiled.Errors)
+	assert.NotEmpty(t, compiled.Bytecode)
+	assert.Len(t, compiled.RulesetHash, 64)
+
+	stream := streamActions(t, client, "sendAlert")
+	updated, err := client.UpdateFacts(ctx, &rexpb.UpdateFactsRequest{
+		Set:           map[string]*rexpb.Value{"temperature": {Kind: &rexpb.Value_IntValue{IntValue: 35}}},
+		CorrelationId: "c1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "c1", updated.CorrelationId)
+
+	action, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "overheating", action.RuleName)
+	assert.Equal(t, "sendAlert", action.Type)
+	assert.Equal(t, "ops", action.Target)
+	assert.Equal(t, "too hot", action.Value.GetStringValue())
+	assert.Equal(t, "c1", action.CorrelationId)
+	assert.Equal(t, compiled.RulesetHash, action.RulesetHash)
+
+	// Reloading the compiled bytecode keeps the facts and evaluates every
+	// rule
+	loaded, err := client.LoadBytecode(ctx, &rexpb.LoadBytecodeRequest{Bytecode: compiled.Bytecode})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"overheating"}, loaded.Rules)
+	assert.Equal(t, compiled.RulesetHash, loaded.RulesetHash)
+	action, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "overheating", action.RuleName)
+}
+
+func TestServer_CompileThenLoad(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+
+	// Bytecode compiled without loading it is loaded as it is returned
+	compiled, err := client.CompileRules(ctx, &rexpb.CompileRulesRequest{Rules: []byte(alertRules)})
+	require.NoError(t, err)
+	loaded, err := client.LoadBytecode(ctx, &rexpb.LoadBytecodeRequest{Bytecode: compiled.Bytecode})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"overheating"}, loaded.Rules)
+
+	stream := streamActions(t, client)
+	_, err = client.UpdateFacts(ctx, &rexpb.UpdateFactsRequest{
+		Set: map[string]*rexpb.Value{"temperature": {Kind: &rexpb.Value_IntValue{IntValue: 35}}},
+	})
+	require.NoError(t, err)
+	action, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "overheating", action.RuleName)
+	assert.Equal(t, "too hot", action.Value.GetStringValue())
+}
+
+func TestServer_CompileStringTooLong(t *testing.T) {
+	_, client := newTestClient(t)
+
+	rulesJSON := `[{"name": "a", "consumedFacts": ["message"], "producedFacts": ["b"], "conditions": {"all": [{"fact": "message", "operator": "equal", "value": "` +
+		strings.Repeat("x", 256) + `"}]}, "event": {"actions": [{"type": "updateFact", "target": "b", "value": true}]}}]`
+	compiled, err := client.CompileRules(context.Background(), &rexpb.CompileRulesRequest{Rules: []byte(rulesJSON)})
+	require.NoError(t, err)
+	require.Len(t, compiled.Errors, 1)
+	assert.Contains(t, compiled.Errors[0].Message, "rule 'a': string constant of 256 bytes")
+}
+
+func TestServer_EvaluateAndGetFacts(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+
+	_, err := client.GetFacts(ctx, &rexpb.GetFactsRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.CompileRules(ctx, &rexpb.CompileRulesRequest{Rules: []byte(alertRules), Load: true})
+	require.NoError(t, err)
+
+	evaluated, err := client.Evaluate(ctx, &rexpb.UpdateFactsRequest{
+		Set: map[string]*rexpb.Value{
+			"temperature": {Kind: &rexpb.Value_IntValue{IntValue: 35}},
+			"site":        {Kind: &rexpb.Value_StringValue{StringValue: "north"}},
+		},
+		CorrelationId: "c1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "c1", evaluated.CorrelationId)
+	require.Len(t, evaluated.Actions, 1)
+	assert.Equal(t, "overheating", evaluated.Actions[0].RuleName)
+	assert.Equal(t, "c1", evaluated.Actions[0].CorrelationId)
+
+	// The facts evaluated are read back once Evaluate returns
+	facts, err := client.GetFacts(ctx, &rexpb.GetFactsRequest{Names: []string{"temperature", "humidity"}})
+	require.NoError(t, err)
+	assert.Len(t, facts.Facts, 1)
+	assert.Equal(t, int64(35), facts.Facts["temperature"].GetIntValue())
+
+	evaluated, err = client.Evaluate(ctx, &rexpb.UpdateFactsRequest{Delete: []string{"temperature"}})
+	require.NoError(t, err)
+	assert.Empty(t, evaluated.Actions)
+	facts, err = client.GetFacts(ctx, &rexpb.GetFactsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, facts.Facts, 1)
+	assert.Equal(t, "north", facts.Facts["site"].GetStringValue())
+}
+
+func TestServer_Errors(t *testing.T) {
+	ctx := context.Background()
+	_, client := newTestClient(t)
+
+	compiled, err := client.CompileRules(ctx, &rexpb.CompileRulesRequest{Rules: []byte(`[{"name": "a", "conditions": {}}]`)})
+	require.NoError(t, err)
+	assert.Empty(t, compiled.Bytecode)
+	require.Len(t, compiled.Errors, 1)
+	assert.Equal(t, &rexpb.RuleError{Rule: "a", Path: "rules[0].conditions", Line: 1, Column: 30, Message: "a rule must have at least one condition"}, compiled.Errors[0])
+
+	_, err = client.CompileRules(ctx, &rexpb.CompileRulesRequest{Rules: []byte(alertRules), Strictness: "lax"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.LoadBytecode(ctx, &rexpb.LoadBytecodeRequest{Bytecode: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(bytecode.LOAD_CONST_INT64)}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.CompileRules(ctx, &rexpb.CompileRulesRequest{Rules: []byte(alertRules), Load: true})
+	require.NoError(t, err)
+	_, err = client.UpdateFacts(ctx, &rexpb.UpdateFactsRequest{Set: map[string]*rexpb.Value{"temperature": {}}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestValues(t *testing.T) {
+	for _, value := range []interface{}{42, 21.5, "eco", true} {
+		converted, err := fromValue(toValue(value))
+		require.NoError(t, err)
+		assert.Equal(t, value, converted)
+	}
+	assert.Equal(t, "[1 2]", toValue([]int{1, 2}).GetStringValue())
+	assert.Nil(t, toValue(nil))
+}
@@ -0,0 +1,331 @@
+// ruledoc/ruledoc.go
+
+// Package ruledoc renders a ruleset as human-readable documentation. Every
+// rule and fact gets its own section, and the rules link to the facts they
+// read and write and to the rules they depend on and feed, so the document
+// can be regenerated from the ruleset whenever it changes instead of being
+// maintained by hand.
+package ruledoc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Format is the markup language of the documentation.
+type Format string
+
+const (
+	FormatMarkdown Format = "markdown"
+	FormatHTML     Format = "html"
+)
+
+// ParseFormat returns the format with the given name.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FormatMarkdown, FormatHTML:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown documentation format %q, expected markdown or html", name)
+	}
+}
+
+// Write renders the documentation of a ruleset to w.
+func Write(w io.Writer, ruleSet []*rules.Rule, format Format, title string) error {
+	doc := newDocument(ruleSet, title)
+	switch format {
+	case FormatMarkdown:
+		return markdownTemplate.Execute(w, doc)
+	case FormatHTML:
+		return htmlTemplate.Execute(w, doc)
+	default:
+		return fmt.Errorf("unknown documentation format %q", format)
+	}
+}
+
+// document is the data rendered by the templates.
+type document struct {
+	Title string
+	Rules []ruleDoc
+	Facts []factDoc
+}
+
+// link refers to the section documenting a rule or fact. Anchor is empty if
+// there is no such section.
+type link struct {
+	Name   string
+	Anchor string
+}
+
+type ruleDoc struct {
+	link
+	Description string
+	Priority    int
+	Rollout     string
+	Score       *scoreDoc
+	Metadata    []property
+	Conditions  []conditionDoc
+	Actions     []actionDoc
+	Variants    []variantDoc
+	Tests       int
+	Reads       []link
+	Writes      []link
+	DependsOn   []link
+	Feeds       []link
+}
+
+// scoreDoc describes the score of a scoring rule.
+type scoreDoc struct {
+	Fact      link
+	Threshold string
+}
+
+type property struct {
+	Key   string
+	Value string
+}
+
+// conditionDoc is either a group of conditions or a comparison of a fact.
+type conditionDoc struct {
+	Depth      int    // Nesting level, for indenting Markdown lists
+	Group      string // "all", "any" or "not all" for a group
+	Weight     string // What the condition adds to the score of a scoring rule
+	Conditions []conditionDoc
+
+	Fact     link
+	Match    string // "any" or "all" for a fact pattern
+	Operator string
+	Value    string
+	Epsilon  string
+
+	Script string // Source of a script condition, as a JSON string
+	Reads  []link // Facts read by the script
+}
+
+type actionDoc struct {
+	Type   string
+	Target string
+	Fact   *link // Fact written by an updateFact or script action
+	Value  string
+}
+
+type variantDoc struct {
+	Name    string
+	Weight  int
+	Actions []actionDoc
+}
+
+type factDoc struct {
+	link
+	ReadBy    []link
+	WrittenBy []link
+}
+
+// newDocument collects what the templates render about a ruleset.
+func newDocument(ruleSet []*rules.Rule, title string) document {
+	graph := preprocessor.AnalyzeDependencyGraph(ruleSet)
+	anchors := newAnchors()
+	ruleLinks := make(map[string]link)
+	for _, rule := range ruleSet {
+		ruleLinks[rule.Name] = link{Name: rule.Name, Anchor: anchors.add("rule-" + rule.Name)}
+	}
+	factLinks := make(map[string]link)
+	for _, fact := range graph.Facts {
+		factLinks[fact.Fact] = link{Name: fact.Fact, Anchor: anchors.add("fact-" + fact.Fact)}
+	}
+	links := func(names []string, targets map[string]link) []link {
+		var result []link
+		for _, name := range names {
+			result = append(result, linkTo(name, targets))
+		}
+		return result
+	}
+
+	doc := document{Title: title}
+	for i, rule := range ruleSet {
+		dependencies := graph.Rules[i]
+		rd := ruleDoc{
+			link:      ruleLinks[rule.Name],
+			Priority:  rule.Priority,
+			Tests:     len(rule.Tests),
+			Reads:     links(dependencies.Reads, factLinks),
+			Writes:    links(dependencies.Writes, factLinks),
+			DependsOn: links(dependencies.DependsOn, ruleLinks),
+			Feeds:     links(dependencies.Feeds, ruleLinks),
+		}
+		if rule.Rollout != nil {
+			rd.Rollout = fmt.Sprintf("%d%% of %s", *rule.Rollout, rule.RolloutKey)
+		}
+		rd.Description, rd.Metadata = describe(rule.Metadata)
+		if len(rule.Conditions.All) > 0 {
+			group := conditionGroup("all", rule.Conditions.All, 0, factLinks)
+			if rule.Scored() {
+				rd.Score = &scoreDoc{Fact: linkTo(rule.Score.Fact, factLinks), Threshold: formatValue(rule.Score.Threshold)}
+				for j := range group.Conditions {
+					group.Conditions[j].Weight = formatValue(rule.Conditions.All[j].ScoreWeight())
+				}
+			}
+			rd.Conditions = append(rd.Conditions, group)
+		}
+		if len(rule.Conditions.Any) > 0 {
+			rd.Conditions = append(rd.Conditions, conditionGroup("any", rule.Conditions.Any, 0, factLinks))
+		}
+		if len(rule.Conditions.Not) > 0 {
+			rd.Conditions = append(rd.Conditions, conditionGroup("not all", rule.Conditions.Not, 0, factLinks))
+		}
+		rd.Actions = actionDocs(rule.Event.Actions, factLinks)
+		for _, variant := range rule.Variants {
+			rd.Variants = append(rd.Variants, variantDoc{Name: variant.Name, Weight: variant.Weight, Actions: actionDocs(variant.Actions, factLinks)})
+		}
+		doc.Rules = append(doc.Rules, rd)
+	}
+
+	for _, fact := range graph.Facts {
+		doc.Facts = append(doc.Facts, factDoc{
+			link:      factLinks[fact.Fact],
+			ReadBy:    links(fact.ReadBy, ruleLinks),
+			WrittenBy: links(fact.WrittenBy, ruleLinks),
+		})
+	}
+	return doc
+}
+
+// describe splits the metadata of a rule into its description and the other
+// properties, sorted by key.
+func describe(metadata map[string]interface{}) (string, []property) {
+	var description string
+	var properties []property
+	for key, value := range metadata {
+		if text, ok := value.(string); ok && key == "description" {
+			description = text
+			continue
+		}
+		properties = append(properties, property{Key: key, Value: formatValue(value)})
+	}
+	sort.Slice(properties, func(i, j int) bool { return properties[i].Key < properties[j].Key })
+	return description, properties
+}
+
+func conditionGroup(group string, conditions []rules.Condition, depth int, facts map[string]link) conditionDoc {
+	doc := conditionDoc{Depth: depth, Group: group}
+	for _, condition := range conditions {
+		doc.Conditions = append(doc.Conditions, conditionDocOf(condition, depth+1, facts))
+	}
+	return doc
+}
+
+func conditionDocOf(condition rules.Condition, depth int, facts map[string]link) conditionDoc {
+	if condition.Script != "" {
+		doc := conditionDoc{Depth: depth, Script: formatValue(condition.Script)}
+		for _, fact := range condition.Facts {
+			doc.Reads = append(doc.Reads, linkTo(fact, facts))
+		}
+		return doc
+	}
+	if condition.Fact == "" {
+		// A block mixing all, any and not conditions is the conjunction of
+		// its groups
+		type block struct {
+			group      string
+			conditions []rules.Condition
+		}
+		var blocks []block
+		for _, b := range []block{{"all", condition.All}, {"any", condition.Any}, {"not all", condition.Not}} {
+			if len(b.conditions) > 0 {
+				blocks = append(blocks, b)
+			}
+		}
+		if len(blocks) == 1 {
+			return conditionGroup(blocks[0].group, blocks[0].conditions, depth, facts)
+		}
+		doc := conditionDoc{Depth: depth, Group: "all"}
+		for _, b := range blocks {
+			doc.Conditions = append(doc.Conditions, conditionGroup(b.group, b.conditions, depth+1, facts))
+		}
+		return doc
+	}
+
+	doc := conditionDoc{
+		Depth:    depth,
+		Fact:     linkTo(condition.Fact, facts),
+		Operator: condition.Operator,
+	}
+	if !rules.IsExistenceOperator(condition.Operator) {
+		doc.Value = formatValue(condition.Value)
+	}
+	if rules.IsFactPattern(condition.Fact) {
+		doc.Match = rules.MatchAny
+		if condition.Match != "" {
+			doc.Match = condition.Match
+		}
+	}
+	if condition.Epsilon != nil {
+		doc.Epsilon = formatValue(*condition.Epsilon)
+	}
+	return doc
+}
+
+func actionDocs(actions []rules.Action, facts map[string]link) []actionDoc {
+	var docs []actionDoc
+	for _, action := range actions {
+		doc := actionDoc{Type: action.Type, Target: action.Target, Value: formatValue(action.Value)}
+		if rules.IsFactUpdate(action) {
+			fact := linkTo(action.Target, facts)
+			doc.Fact = &fact
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// formatValue formats a value as JSON, so that strings are told apart from
+// numbers and booleans.
+func formatValue(value interface{}) string {
+	formatted, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(formatted)
+}
+
+func linkTo(name string, targets map[string]link) link {
+	if target, ok := targets[name]; ok {
+		return target
+	}
+	return link{Name: name}
+}
+
+// anchors generates unique anchors that are valid HTML ids and Markdown
+// fragments.
+type anchors map[string]bool
+
+func newAnchors() anchors {
+	return make(anchors)
+}
+
+func (a anchors) add(name string) string {
+	var anchor strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			anchor.WriteRune(r)
+			dash = false
+		} else if !dash {
+			anchor.WriteByte('-')
+			dash = true
+		}
+	}
+	base := strings.TrimRight(anchor.String(), "-")
+	unique := base
+	for i := 2; a[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", base, i)
+	}
+	a[unique] = true
+	return unique
+}
@@ -0,0 +1,91 @@
+package ruledoc
+
+import (
+	"bytes"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func docRuleSet() []*rules.Rule {
+	epsilon := 0.5
+	return []*rules.Rule{
+		{
+			Name:     "hot_room",
+			Priority: 2,
+			Metadata: map[string]interface{}{"description": "Flags rooms that are too warm.", "owner": "facilities"},
+			Conditions: rules.Conditions{All: []rules.Condition{
+				{Fact: "sensor.*.temperature", Operator: "greaterThan", Value: 30.0},
+				{Any: []rules.Condition{
+					{Fact: "mode", Operator: "equal", Value: "auto"},
+					{Fact: "setpoint", Operator: "equal", Value: 21.5, Epsilon: &epsilon},
+				}},
+			}},
+			Event: rules.Event{Actions: []rules.Action{
+				{Type: "updateFact", Target: "hot", Value: true},
+				{Type: "notify", Target: "ops", Value: "Room too warm"},
+			}},
+			Tests: []rules.RuleTest{{Facts: map[string]interface{}{"mode": "auto"}, Fires: true}},
+		},
+		{
+			Name:       "fan <on>",
+			Conditions: rules.Conditions{All: []rules.Condition{{Fact: "hot", Operator: "equal", Value: true}}},
+			Event:      rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan", Value: true}}},
+		},
+	}
+}
+
+func TestWrite_Markdown(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, Write(&out, docRuleSet(), FormatMarkdown, "Building rules"))
+	doc := out.String()
+
+	assert.Contains(t, doc, "# Building rules\n\n## Rules\n\n- [hot\\_room](#rule-hot-room)\n- [fan \\<on\\>](#rule-fan-on)\n")
+	assert.Contains(t, doc, "### <a id=\"rule-hot-room\"></a>hot\\_room\n\nFlags rooms that are too warm.\n")
+	assert.Contains(t, doc, "- owner: `\"facilities\"`\n")
+	assert.Contains(t, doc, "- Tests: 1\n")
+
+	// Conditions are nested as in the rule and link to their facts
+	assert.Contains(t, doc, "- all of:\n"+
+		"  - any facts matching [`sensor.*.temperature`](#fact-sensor-temperature) greaterThan `30`\n"+
+		"  - any of:\n"+
+		"    - [`mode`](#fact-mode) equal `\"auto\"`\n"+
+		"    - [`setpoint`](#fact-setpoint) equal `21.5` within 0.5\n")
+	assert.Contains(t, doc, "- updateFact [`hot`](#fact-hot) = `true`\n- notify `ops`: `\"Room too warm\"`\n")
+
+	// Rules link to each other through the facts they share
+	assert.Contains(t, doc, "- Feeds: [fan \\<on\\>](#rule-fan-on)\n")
+	assert.Contains(t, doc, "- Depends on: [hot\\_room](#rule-hot-room)\n")
+	assert.Contains(t, doc, "### <a id=\"fact-hot\"></a>`hot`\n\n- Read by: [fan \\<on\\>](#rule-fan-on)\n- Written by: [hot\\_room](#rule-hot-room)\n")
+}
+
+func TestWrite_HTML(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, Write(&out, docRuleSet(), FormatHTML, "Building rules"))
+	doc := out.String()
+
+	assert.Contains(t, doc, "<h1>Building rules</h1>")
+	assert.Contains(t, doc, `<h3 id="rule-fan-on">fan &lt;on&gt;</h3>`)
+	assert.Contains(t, doc, `<li>Feeds: <a href="#rule-fan-on">fan &lt;on&gt;</a></li>`)
+	assert.Contains(t, doc, `<li>Read by: <a href="#rule-fan-on">fan &lt;on&gt;</a></li>`)
+	assert.Contains(t, doc, `<a href="#fact-setpoint"><code>setpoint</code></a> equal <code>21.5</code> within 0.5`)
+	assert.NotContains(t, doc, "<on>")
+}
+
+func TestAnchors_Unique(t *testing.T) {
+	anchors := newAnchors()
+	assert.Equal(t, "rule-door-open", anchors.add("rule-door open"))
+	assert.Equal(t, "rule-door-open-2", anchors.add("rule-door_open"))
+	assert.Equal(t, "fact-température", anchors.add("fact-Température"))
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("html")
+	require.NoError(t, err)
+	assert.Equal(t, FormatHTML, format)
+
+	_, err = ParseFormat("pdf")
+	assert.ErrorContains(t, err, "unknown documentation format")
+}
@@ -0,0 +1,149 @@
+// ruledoc/templates.go
+
+package ruledoc
+
+import (
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+)
+
+var markdownTemplate = template.Must(template.New("markdown").Funcs(template.FuncMap{
+	"md":     escapeMarkdown,
+	"indent": func(depth int) string { return strings.Repeat("  ", depth) },
+}).Parse(`
+{{- define "rule"}}{{if .Anchor}}[{{md .Name}}](#{{.Anchor}}){{else}}{{md .Name}}{{end}}{{end}}
+{{- define "fact"}}{{if .Anchor}}[` + "`{{.Name}}`" + `](#{{.Anchor}}){{else}}` + "`{{.Name}}`" + `{{end}}{{end}}
+{{- define "rules"}}{{range $i, $link := .}}{{if $i}}, {{end}}{{template "rule" $link}}{{else}}none{{end}}{{end}}
+{{- define "facts"}}{{range $i, $link := .}}{{if $i}}, {{end}}{{template "fact" $link}}{{else}}none{{end}}{{end}}
+{{- define "condition"}}{{indent .Depth}}- {{if .Weight}}(weight {{.Weight}}) {{end}}{{if .Group}}{{.Group}} of:
+{{range .Conditions}}{{template "condition" .}}{{end}}
+{{- else if .Script}}script ` + "`{{.Script}}`" + ` reading {{template "facts" .Reads}}
+{{else}}{{if .Match}}{{.Match}} facts matching {{end}}{{template "fact" .Fact}} {{.Operator}}{{if .Value}} ` + "`{{.Value}}`" + `{{end}}{{if .Epsilon}} within {{.Epsilon}}{{end}}
+{{end}}{{end}}
+{{- define "action"}}- {{.Type}} {{if .Fact}}{{template "fact" .Fact}} = {{else}}` + "`{{.Target}}`" + `: {{end}}` + "`{{.Value}}`" + `
+{{end}}
+{{- define "actions"}}{{range .}}{{template "action" .}}{{else}}None.
+{{end}}{{end -}}
+
+# {{md .Title}}
+
+## Rules
+{{range .Rules}}
+- {{template "rule" .}}
+{{- end}}
+{{range .Rules}}
+### <a id="{{.Anchor}}"></a>{{md .Name}}
+{{if .Description}}
+{{.Description}}
+{{end}}
+- Priority: {{.Priority}}
+{{- if .Rollout}}
+- Rollout: {{.Rollout}}
+{{- end}}
+{{- with .Score}}
+- Score: {{template "fact" .Fact}}, fires at {{.Threshold}}
+{{- end}}
+{{- range .Metadata}}
+- {{md .Key}}: ` + "`{{.Value}}`" + `
+{{- end}}
+- Tests: {{.Tests}}
+- Reads: {{template "facts" .Reads}}
+- Writes: {{template "facts" .Writes}}
+- Depends on: {{template "rules" .DependsOn}}
+- Feeds: {{template "rules" .Feeds}}
+
+#### Conditions
+
+{{range .Conditions}}{{template "condition" .}}{{else}}None, the rule always fires.
+{{end}}
+#### Actions
+
+{{template "actions" .Actions}}
+{{- range .Variants}}
+#### Variant {{md .Name}}{{if .Weight}} (weight {{.Weight}}){{end}}
+
+{{template "actions" .Actions}}
+{{- end}}
+{{- end}}
+## Facts
+{{range .Facts}}
+### <a id="{{.Anchor}}"></a>` + "`{{.Name}}`" + `
+
+- Read by: {{template "rules" .ReadBy}}
+- Written by: {{template "rules" .WrittenBy}}
+{{end}}`))
+
+var htmlTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`
+{{- define "rule"}}{{if .Anchor}}<a href="#{{.Anchor}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}{{end}}
+{{- define "fact"}}{{if .Anchor}}<a href="#{{.Anchor}}"><code>{{.Name}}</code></a>{{else}}<code>{{.Name}}</code>{{end}}{{end}}
+{{- define "rules"}}{{range $i, $link := .}}{{if $i}}, {{end}}{{template "rule" $link}}{{else}}none{{end}}{{end}}
+{{- define "facts"}}{{range $i, $link := .}}{{if $i}}, {{end}}{{template "fact" $link}}{{else}}none{{end}}{{end}}
+{{- define "condition"}}<li>{{if .Weight}}(weight {{.Weight}}) {{end}}{{if .Group}}{{.Group}} of:<ul>{{range .Conditions}}{{template "condition" .}}{{end}}</ul>
+{{- else if .Script}}script <code>{{.Script}}</code> reading {{template "facts" .Reads}}
+{{- else}}{{if .Match}}{{.Match}} facts matching {{end}}{{template "fact" .Fact}} {{.Operator}}{{if .Value}} <code>{{.Value}}</code>{{end}}{{if .Epsilon}} within {{.Epsilon}}{{end}}{{end}}</li>
+{{end}}
+{{- define "actions"}}<ul>
+{{range .}}<li>{{.Type}} {{if .Fact}}{{template "fact" .Fact}} = {{else}}<code>{{.Target}}</code>: {{end}}<code>{{.Value}}</code></li>
+{{else}}<li>None.</li>
+{{end}}</ul>
+{{end -}}
+
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<h2>Rules</h2>
+<ul>
+{{range .Rules}}<li>{{template "rule" .}}</li>
+{{end}}</ul>
+{{range .Rules}}
+<h3 id="{{.Anchor}}">{{.Name}}</h3>
+{{if .Description}}<p>{{.Description}}</p>
+{{end}}<ul>
+<li>Priority: {{.Priority}}</li>
+{{if .Rollout}}<li>Rollout: {{.Rollout}}</li>
+{{end}}{{with .Score}}<li>Score: {{template "fact" .Fact}}, fires at {{.Threshold}}</li>
+{{end}}{{range .Metadata}}<li>{{.Key}}: <code>{{.Value}}</code></li>
+{{end}}<li>Tests: {{.Tests}}</li>
+<li>Reads: {{template "facts" .Reads}}</li>
+<li>Writes: {{template "facts" .Writes}}</li>
+<li>Depends on: {{template "rules" .DependsOn}}</li>
+<li>Feeds: {{template "rules" .Feeds}}</li>
+</ul>
+<h4>Conditions</h4>
+<ul>
+{{range .Conditions}}{{template "condition" .}}{{else}}<li>None, the rule always fires.</li>
+{{end}}</ul>
+<h4>Actions</h4>
+{{template "actions" .Actions}}
+{{- range .Variants}}<h4>Variant {{.Name}}{{if .Weight}} (weight {{.Weight}}){{end}}</h4>
+{{template "actions" .Actions}}
+{{- end}}
+{{- end}}
+<h2>Facts</h2>
+{{range .Facts}}<h3 id="{{.Anchor}}"><code>{{.Name}}</code></h3>
+<ul>
+<li>Read by: {{template "rules" .ReadBy}}</li>
+<li>Written by: {{template "rules" .WrittenBy}}</li>
+</ul>
+{{end}}</body>
+</html>
+`))
+
+// escapeMarkdown escapes the characters that Markdown would otherwise treat
+// as formatting.
+func escapeMarkdown(text string) string {
+	var escaped strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune("\\`*_[]<>|", r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,46 @@
+// internal/rules/action.go
+
+package rules
+
+// Built-in action types. updateFact writes a fact, which other rules can then
+// compare; updateStore is an alias of it. script writes the result of a Lua
+// script to a fact. The others are side effects the runtime performs once the
+// cycle that triggered them has succeeded; sendMessage delivers its value to
+// the message sink configured for its target, and webhook sends an HTTP
+// request, whose body is rendered from the facts, to its target URL.
+const (
+	ActionUpdateFact  = "updateFact"
+	ActionUpdateStore = "updateStore"
+	ActionScript      = "script"
+	ActionNotify      = "notify"
+	ActionSendAlert   = "sendAlert"
+	ActionLogEvent    = "logEvent"
+	ActionSendMessage = "sendMessage"
+	ActionWebhook     = "webhook"
+)
+
+// CanonicalActionType returns the built-in action type an alias stands for, or
+// the type itself.
+func CanonicalActionType(actionType string) string {
+	if actionType == ActionUpdateStore {
+		return ActionUpdateFact
+	}
+	return actionType
+}
+
+// IsFactUpdate reports whether an action writes a fact.
+func IsFactUpdate(action Action) bool {
+	actionType := CanonicalActionType(action.Type)
+	return actionType == ActionUpdateFact || actionType == ActionScript
+}
+
+// IsBuiltinActionType reports whether an action type is one of the built-in
+// action types.
+func IsBuiltinActionType(actionType string) bool {
+	switch CanonicalActionType(actionType) {
+	case ActionUpdateFact, ActionScript, ActionNotify, ActionSendAlert, ActionLogEvent, ActionSendMessage, ActionWebhook:
+		return true
+	default:
+		return false
+	}
+}
@@ -11,6 +11,10 @@ const (
 	OperatorLessThanOrEqual    = "lessThanOrEqual"
 	OperatorContains           = "contains"
 	OperatorNotContains        = "notContains"
+	OperatorIn                 = "in"        // The value is a list the fact must be one of
+	OperatorNotIn              = "notIn"     // The value is a list the fact must not be one of
+	OperatorExists             = "exists"    // The fact must be set; the condition has no value
+	OperatorNotExists          = "notExists" // The fact must not be set; the condition has no value
 )
 
 var SupportedOperators = []string{
@@ -22,4 +26,29 @@ var SupportedOperators = []string{
 	OperatorLessThanOrEqual,
 	OperatorContains,
 	OperatorNotContains,
+	OperatorIn,
+	OperatorNotIn,
+	OperatorExists,
+	OperatorNotExists,
+}
+
+// IsExistenceOperator reports whether an operator tests whether a fact is
+// set, rather than comparing its value.
+func IsExistenceOperator(operator string) bool {
+	return operator == OperatorExists || operator == OperatorNotExists
+}
+
+// IsBlock reports whether a condition is a nested block of all, any and not
+// conditions rather than a condition of its own.
+func (c *Condition) IsBlock() bool {
+	return len(c.All) > 0 || len(c.Any) > 0 || len(c.Not) > 0
+}
+
+// ScoreWeight returns what a condition of a scoring rule adds to the score
+// when it holds.
+func (c *Condition) ScoreWeight() float64 {
+	if c.Weight == nil {
+		return 1
+	}
+	return *c.Weight
 }
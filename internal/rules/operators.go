@@ -0,0 +1,52 @@
+// internal/rules/operators.go
+
+package rules
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+var (
+	customOperatorsMu sync.RWMutex
+	customOperators   = make(map[string][]string) // Operator name to the value types it accepts
+)
+
+// RegisterOperator declares a custom condition operator accepting values of
+// the given types, so that rules using it validate and compile. The runtime
+// must be given an implementation of the operator under the same name. It
+// panics if the name is a built-in operator or already registered.
+func RegisterOperator(name string, valueTypes ...string) {
+	customOperatorsMu.Lock()
+	defer customOperatorsMu.Unlock()
+	if slices.Contains(SupportedOperators, name) {
+		panic(fmt.Sprintf("rules: operator %q is built in", name))
+	}
+	if _, exists := customOperators[name]; exists {
+		panic(fmt.Sprintf("rules: operator %q registered twice", name))
+	}
+	customOperators[name] = valueTypes
+}
+
+// CustomOperator returns the value types accepted by a registered custom
+// operator.
+func CustomOperator(name string) ([]string, bool) {
+	customOperatorsMu.RLock()
+	defer customOperatorsMu.RUnlock()
+	valueTypes, ok := customOperators[name]
+	return valueTypes, ok
+}
+
+// CustomOperators returns the names of the registered custom operators,
+// sorted.
+func CustomOperators() []string {
+	customOperatorsMu.RLock()
+	defer customOperatorsMu.RUnlock()
+	names := make([]string, 0, len(customOperators))
+	for name := range customOperators {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
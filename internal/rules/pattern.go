@@ -0,0 +1,50 @@
+// internal/rules/pattern.go
+
+package rules
+
+import "strings"
+
+// A condition's fact can be a pattern such as sensor.*.temperature, where *
+// stands for any single segment of a dot-separated fact name. The condition
+// then applies to every matching fact, and Match selects whether it holds
+// when any or all of them satisfy it.
+const (
+	MatchAny = "any"
+	MatchAll = "all"
+)
+
+// IsFactPattern reports whether a fact name in a condition is a pattern.
+func IsFactPattern(fact string) bool {
+	return strings.Contains(fact, "*")
+}
+
+// MatchAnyFact reports whether a fact name is one of the names, or matches
+// one of the patterns, in facts.
+func MatchAnyFact(facts []string, fact string) bool {
+	for _, pattern := range facts {
+		if MatchFact(pattern, fact) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchFact reports whether a fact name matches a pattern: both have the same
+// number of dot-separated segments, and every segment of the pattern is * or
+// equal to the name's segment.
+func MatchFact(pattern, fact string) bool {
+	for {
+		patternSegment, patternRest, patternMore := strings.Cut(pattern, ".")
+		factSegment, factRest, factMore := strings.Cut(fact, ".")
+		if patternSegment != "*" && patternSegment != factSegment {
+			return false
+		}
+		if patternSegment == "*" && factSegment == "" {
+			return false
+		}
+		if !patternMore || !factMore {
+			return patternMore == factMore
+		}
+		pattern, fact = patternRest, factRest
+	}
+}
@@ -2,6 +2,8 @@
 
 package rules
 
+import "time"
+
 type Rule struct {
 	Name          string     `json:"name"`
 	Priority      int        `json:"priority"`
@@ -9,6 +11,49 @@ type Rule struct {
 	Event         Event      `json:"event"`
 	ProducedFacts []string   `json:"producedFacts,omitempty"` // Facts produced by this rule
 	ConsumedFacts []string   `json:"consumedFacts,omitempty"` // Facts consumed by this rule
+	Rollout       *int       `json:"rollout,omitempty"`       // Percentage of entities the rule applies to; nil means all
+	RolloutKey    string     `json:"rolloutKey,omitempty"`    // Fact identifying the entity, e.g. deviceId
+	Variants      []Variant  `json:"variants,omitempty"`      // A/B variants replacing the event actions
+	VariantKey    string     `json:"variantKey,omitempty"`    // Fact identifying the entity assigned to a variant
+	Tests         []RuleTest `json:"tests,omitempty"`         // Examples of the rule's behaviour, run by rex test
+	For           string     `json:"for,omitempty"`           // How long the conditions must hold before the actions run, e.g. "5m"
+	Once          bool       `json:"once,omitempty"`          // Run the actions once each time the conditions start holding, not every cycle
+	Score         *Score     `json:"score,omitempty"`         // Makes the rule a scoring rule, firing when the weights of its holding conditions add up to a threshold
+
+	// ForEachDevice makes the rule a template, expanded once per device of an
+	// inventory having these attributes before the ruleset is parsed
+	ForEachDevice map[string]interface{} `json:"forEachDevice,omitempty"`
+
+	Metadata map[string]interface{} `json:"-"` // Unrecognized fields kept by permissive parsing
+}
+
+// HoldDuration returns how long the rule's conditions must hold before its
+// actions run, zero if the rule has no For.
+func (r *Rule) HoldDuration() (time.Duration, error) {
+	if r.For == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(r.For)
+}
+
+// Held reports whether the rule only runs its actions once its conditions
+// have held for a while or only once while they hold.
+func (r *Rule) Held() bool {
+	return r.For != "" || r.Once
+}
+
+// Score sets up a scoring rule. Instead of requiring all its conditions, a
+// scoring rule adds up the weights of those of its all conditions that hold,
+// writes the sum to a fact every cycle, and fires when the sum reaches the
+// threshold.
+type Score struct {
+	Fact      string  `json:"fact"`      // Fact the score is written to
+	Threshold float64 `json:"threshold"` // Score at or above which the rule fires
+}
+
+// Scored reports whether the rule is a scoring rule.
+func (r *Rule) Scored() bool {
+	return r.Score != nil
 }
 
 type Event struct {
@@ -17,17 +62,54 @@ type Event struct {
 	Facts          []string      `json:"facts,omitempty"`
 	Values         []interface{} `json:"values,omitempty"`
 	Actions        []Action      `json:"actions,omitempty"`
+
+	Metadata map[string]interface{} `json:"-"` // Unrecognized fields kept by permissive parsing
 }
 
 type Action struct {
-	Type   string      `json:"type"`   // "updateStore" or "sendMessage"
-	Target string      `json:"target"` // Key for store update or address for message
-	Value  interface{} `json:"value"`  // Value for store update or message content
+	Type    string          `json:"type"`              // One of the built-in action types, e.g. "updateFact" or "notify"
+	Target  string          `json:"target"`            // Key for store update or address for message
+	Value   interface{}     `json:"value"`             // Value for store update or message content, or the script of a script action
+	Facts   []string        `json:"facts,omitempty"`   // Facts a script action reads
+	Webhook *WebhookRequest `json:"webhook,omitempty"` // Request of a webhook action, sent to its target URL
+	Order   int             `json:"order,omitempty"`   // Position among the actions of its event or variant, lowest first
+	When    *Conditions     `json:"when,omitempty"`    // Guard checked when the rule fires; the action is skipped unless it holds
+	Delay   string          `json:"delay,omitempty"`   // Time to wait before performing the action, e.g. 10m; cancelled if the rule stops firing
+
+	Metadata map[string]interface{} `json:"-"` // Unrecognized fields kept by permissive parsing
+}
+
+// WebhookRequest describes the HTTP request of a webhook action.
+type WebhookRequest struct {
+	Method  string            `json:"method,omitempty"` // POST unless set
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`    // Template of the body, e.g. {"temperature": {{facts.temperature}}}
+	Timeout string            `json:"timeout,omitempty"` // Time each attempt may take, e.g. 5s
+	Retries int               `json:"retries,omitempty"` // Attempts repeated after a failure
+}
+
+// Variant is one arm of an A/B test. Each entity is assigned to a single
+// variant of a rule, and only that variant's actions fire for it.
+type Variant struct {
+	Name    string   `json:"name"`
+	Weight  int      `json:"weight,omitempty"` // Relative share of entities; all variants share equally if unset
+	Actions []Action `json:"actions"`
+}
+
+// RuleTest is an executable example of a rule's behaviour: given facts, the
+// rule is expected to fire or not, and optionally to perform given actions.
+type RuleTest struct {
+	Name    string                 `json:"name,omitempty"`
+	Facts   map[string]interface{} `json:"facts"`
+	Fires   bool                   `json:"fires"`
+	Actions []Action               `json:"actions,omitempty"` // Expected actions when the rule fires; unchecked if empty
+	Variant string                 `json:"variant,omitempty"` // Variant the entity is assumed to be assigned to
 }
 
 type Conditions struct {
 	All []Condition `json:"all,omitempty"`
 	Any []Condition `json:"any,omitempty"` // `omitempty` will omit this if nil or empty
+	Not []Condition `json:"not,omitempty"` // Conditions that must not all hold
 }
 
 // Condition represents a condition used in a rule.
@@ -36,15 +118,25 @@ type Condition struct {
 	Operator  string      `json:"operator"`
 	Value     interface{} `json:"value"`
 	ValueType string      `json:"valueType,omitempty"`
+	Match     string      `json:"match,omitempty"`   // For a fact pattern, whether any (the default) or all matching facts must satisfy the condition
+	Epsilon   *float64    `json:"epsilon,omitempty"` // For numeric equal and notEqual, how far apart values may be and still be equal
+	Script    string      `json:"script,omitempty"`  // Lua script deciding the condition in place of a fact, operator and value
+	Facts     []string    `json:"facts,omitempty"`   // Facts the script reads
+	Weight    *float64    `json:"weight,omitempty"`  // For a condition of a scoring rule, what it adds to the score when it holds; 1 if unset
 	All       []Condition `json:"all,omitempty"`
 	Any       []Condition `json:"any,omitempty"`
+	Not       []Condition `json:"not,omitempty"` // For a nested block, conditions that must not all hold
+
+	Metadata map[string]interface{} `json:"-"` // Unrecognized fields kept by permissive parsing
 }
 
 // RuleEngineContext holds global or shared data useful across the rules engine.
 type RuleEngineContext struct {
 	FactIndex     map[string]int
-	ConsumedFacts map[string]bool // Tracks which facts are consumed by rules
-	ProducedFacts map[string]bool // Tracks which facts are produced by rules
+	ConsumedFacts map[string]bool        // Tracks which facts are consumed by rules
+	ProducedFacts map[string]bool        // Tracks which facts are produced by rules
+	InitialFacts  map[string]interface{} // Facts set before the first cycle, such as the initial states of state machines
+	ReadOnlyFacts []string               // Facts, or fact patterns, only the host writes, such as raw sensor inputs
 }
 
 // NewRuleEngineContext initializes and returns a new RuleEngineContext.
@@ -53,5 +145,6 @@ func NewRuleEngineContext() *RuleEngineContext {
 		FactIndex:     make(map[string]int),
 		ConsumedFacts: make(map[string]bool),
 		ProducedFacts: make(map[string]bool),
+		InitialFacts:  make(map[string]interface{}),
 	}
 }
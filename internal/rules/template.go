@@ -0,0 +1,58 @@
+// internal/rules/template.go
+
+package rules
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TemplatePart is a piece of a template: literal text, or a reference to a
+// fact whose value is substituted when the template is rendered.
+type TemplatePart struct {
+	Text string `json:"text,omitempty"`
+	Fact string `json:"fact,omitempty"`
+}
+
+// ParseTemplate splits a template such as {"temperature": {{facts.temperature}}}
+// into its text and fact references. A reference is written {{facts.name}},
+// with optional spaces inside the braces.
+func ParseTemplate(template string) ([]TemplatePart, error) {
+	var parts []TemplatePart
+	for template != "" {
+		start := strings.Index(template, "{{")
+		if start < 0 {
+			parts = append(parts, TemplatePart{Text: template})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, TemplatePart{Text: template[:start]})
+		}
+		end := strings.Index(template[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated reference in template at offset %d", start)
+		}
+		reference := strings.TrimSpace(template[start+2 : start+end])
+		fact, ok := strings.CutPrefix(reference, "facts.")
+		if !ok || fact == "" || IsFactPattern(fact) || strings.ContainsAny(fact, " \t\r\n") {
+			return nil, fmt.Errorf("invalid reference {{%s}} in template, must be {{facts.<name>}}", reference)
+		}
+		parts = append(parts, TemplatePart{Fact: fact})
+		template = template[start+end+2:]
+	}
+	return parts, nil
+}
+
+// TemplateFacts returns the facts a parsed template references, once each in
+// order of first reference.
+func TemplateFacts(parts []TemplatePart) []string {
+	var facts []string
+	seen := make(map[string]bool)
+	for _, part := range parts {
+		if part.Fact != "" && !seen[part.Fact] {
+			seen[part.Fact] = true
+			facts = append(facts, part.Fact)
+		}
+	}
+	return facts
+}
@@ -0,0 +1,251 @@
+// ruletest/mutate.go
+
+package ruletest
+
+import (
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+)
+
+// Mutant is a small change to a condition of a rule, such as an off-by-one
+// threshold or a flipped comparison. A good test suite kills every mutant:
+// at least one test of the rule fails when the mutant replaces the original.
+type Mutant struct {
+	Rule        string `json:"rule"`
+	Condition   string `json:"condition"` // Path of the mutated condition in the rule, e.g. all[1].any[0]
+	Description string `json:"description"`
+	Killed      bool   `json:"killed"`
+}
+
+// MutationReport is the outcome of mutation testing a ruleset.
+type MutationReport struct {
+	Mutants       []Mutant `json:"mutants"`
+	UntestedRules []string `json:"untestedRules"` // Rules without tests, which weren't mutated
+	FailingRules  []string `json:"failingRules"`  // Rules whose tests already fail, which weren't mutated
+}
+
+// Killed returns the number of killed mutants.
+func (r MutationReport) Killed() int {
+	killed := 0
+	for _, mutant := range r.Mutants {
+		if mutant.Killed {
+			killed++
+		}
+	}
+	return killed
+}
+
+// Score returns the percentage of mutants killed, 100 if there are none.
+func (r MutationReport) Score() float64 {
+	if len(r.Mutants) == 0 {
+		return 100
+	}
+	return 100 * float64(r.Killed()) / float64(len(r.Mutants))
+}
+
+// Mutate runs the tests of every rule against mutants of its conditions.
+// Each mutant is compiled and its tests run on the runtime's VM, like Check
+// runs them. A mutation the compiler rejects doesn't change what the rule
+// does at runtime, so it isn't a mutant the tests could kill and is left out.
+func Mutate(ruleSet []*rules.Rule) MutationReport {
+	report := MutationReport{Mutants: []Mutant{}, UntestedRules: []string{}, FailingRules: []string{}}
+	for _, rule := range ruleSet {
+		if len(rule.Tests) == 0 {
+			report.UntestedRules = append(report.UntestedRules, rule.Name)
+			continue
+		}
+		if fails, err := failsTests(rule); fails || err != nil {
+			report.FailingRules = append(report.FailingRules, rule.Name)
+			continue
+		}
+		for _, path := range conditionPaths(rule.Conditions, nil) {
+			for _, mutation := range mutations(*path.locate(&rule.Conditions)) {
+				mutant := *rule
+				mutant.Conditions = cloneConditions(rule.Conditions)
+				description := mutation(path.locate(&mutant.Conditions))
+				killed, err := failsTests(&mutant)
+				if err != nil {
+					continue
+				}
+				report.Mutants = append(report.Mutants, Mutant{
+					Rule:        rule.Name,
+					Condition:   path.String(),
+					Description: description,
+					Killed:      killed,
+				})
+			}
+		}
+	}
+	return report
+}
+
+// failsTests reports whether any test of a rule fails, compiling the rule
+// once for each variant its tests assume. It returns an error if the rule
+// doesn't compile.
+func failsTests(rule *rules.Rule) (bool, error) {
+	images := make(map[string][]byte)
+	for _, test := range rule.Tests {
+		image, ok := images[test.Variant]
+		if !ok {
+			var err error
+			if image, err = compile(isolate(rule, test.Variant)); err != nil {
+				return false, err
+			}
+			images[test.Variant] = image
+		}
+		if check(image, test) != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pathStep selects a condition of the all, any or not block it is in.
+type pathStep struct {
+	block string
+	index int
+}
+
+// conditionPath leads from a rule's conditions to a single comparison.
+type conditionPath []pathStep
+
+// locate returns the condition the path leads to.
+func (p conditionPath) locate(conditions *rules.Conditions) *rules.Condition {
+	block := *conditions
+	var condition *rules.Condition
+	for _, step := range p {
+		switch step.block {
+		case "any":
+			condition = &block.Any[step.index]
+		case "not":
+			condition = &block.Not[step.index]
+		default:
+			condition = &block.All[step.index]
+		}
+		block = rules.Conditions{All: condition.All, Any: condition.Any, Not: condition.Not}
+	}
+	return condition
+}
+
+func (p conditionPath) String() string {
+	s := ""
+	for i, step := range p {
+		if i > 0 {
+			s += "."
+		}
+		s += fmt.Sprintf("%s[%d]", step.block, step.index)
+	}
+	return s
+}
+
+// conditionPaths returns the paths to the comparisons in a block of
+// conditions, below prefix.
+func conditionPaths(conditions rules.Conditions, prefix conditionPath) []conditionPath {
+	var paths []conditionPath
+	for _, block := range []struct {
+		key        string
+		conditions []rules.Condition
+	}{{"all", conditions.All}, {"any", conditions.Any}, {"not", conditions.Not}} {
+		for i, condition := range block.conditions {
+			path := append(append(conditionPath{}, prefix...), pathStep{block: block.key, index: i})
+			if condition.IsBlock() {
+				paths = append(paths, conditionPaths(rules.Conditions{All: condition.All, Any: condition.Any, Not: condition.Not}, path)...)
+			} else {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// cloneConditions returns a deep copy of a block of conditions.
+func cloneConditions(conditions rules.Conditions) rules.Conditions {
+	return rules.Conditions{
+		All: cloneConditionList(conditions.All),
+		Any: cloneConditionList(conditions.Any),
+		Not: cloneConditionList(conditions.Not),
+	}
+}
+
+func cloneConditionList(conditions []rules.Condition) []rules.Condition {
+	if conditions == nil {
+		return nil
+	}
+	clone := make([]rules.Condition, len(conditions))
+	for i, condition := range conditions {
+		clone[i] = condition
+		clone[i].All = cloneConditionList(condition.All)
+		clone[i].Any = cloneConditionList(condition.Any)
+		clone[i].Not = cloneConditionList(condition.Not)
+	}
+	return clone
+}
+
+// operatorMutations lists, for each operator, the operators it is mutated to:
+// the boundary variant and the negation.
+var operatorMutations = map[string][]string{
+	"greaterThan":        {"greaterThanOrEqual", "lessThanOrEqual"},
+	"greaterThanOrEqual": {"greaterThan", "lessThan"},
+	"lessThan":           {"lessThanOrEqual", "greaterThanOrEqual"},
+	"lessThanOrEqual":    {"lessThan", "greaterThan"},
+	"equal":              {"notEqual"},
+	"notEqual":           {"equal"},
+	"contains":           {"notContains"},
+	"notContains":        {"contains"},
+	"in":                 {"notIn"},
+	"notIn":              {"in"},
+	"exists":             {"notExists"},
+	"notExists":          {"exists"},
+}
+
+// mutation changes a condition and describes the change.
+type mutation func(condition *rules.Condition) string
+
+// mutations returns the mutations of a comparison.
+func mutations(condition rules.Condition) []mutation {
+	var result []mutation
+	operator := preprocessor.NormalizeOperator(condition.Operator)
+	for _, replacement := range operatorMutations[operator] {
+		result = append(result, func(c *rules.Condition) string {
+			c.Operator = replacement
+			if rules.IsExistenceOperator(operator) {
+				return fmt.Sprintf("%s %s -> %s", c.Fact, operator, replacement)
+			}
+			return fmt.Sprintf("%s %s %v -> %s %v", c.Fact, operator, c.Value, replacement, c.Value)
+		})
+	}
+	for _, value := range shiftedValues(condition.Value) {
+		result = append(result, func(c *rules.Condition) string {
+			original := c.Value
+			c.Value = value
+			return fmt.Sprintf("%s %s %v -> %s %v", c.Fact, operator, original, operator, value)
+		})
+	}
+	return result
+}
+
+// shiftedValues returns thresholds just above and below a numeric value: one
+// apart for integers, 10% apart for floats.
+func shiftedValues(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case int:
+		return []interface{}{v + 1, v - 1}
+	case int64:
+		return []interface{}{v + 1, v - 1}
+	case uint64:
+		if v == math.MaxUint64 {
+			return []interface{}{v - 1}
+		}
+		return []interface{}{v + 1, v - 1}
+	case float64:
+		delta := math.Abs(v) * 0.1
+		if delta == 0 {
+			delta = 1
+		}
+		return []interface{}{v + delta, v - delta}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,63 @@
+package ruletest
+
+import (
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutate(t *testing.T) {
+	ruleSet, err := preprocessor.ParseAndValidateRules([]byte(`[
+		{
+			"name": "cooling",
+			"consumedFacts": ["temperature"],
+			"producedFacts": ["ac_status"],
+			"conditions": {"all": [{"any": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]}]},
+			"event": {"actions": [{"type": "updateFact", "target": "ac_status", "value": true}]},
+			"tests": [
+				{"facts": {"temperature": 35}, "fires": true},
+				{"facts": {"temperature": 30}, "fires": false}
+			]
+		},
+		{
+			"name": "heating",
+			"consumedFacts": ["temperature"],
+			"producedFacts": ["heater"],
+			"conditions": {"all": [{"fact": "temperature", "operator": "lessThan", "value": 10}]},
+			"event": {"actions": [{"type": "updateFact", "target": "heater", "value": true}]}
+		},
+		{
+			"name": "broken",
+			"consumedFacts": ["temperature"],
+			"producedFacts": ["frost"],
+			"conditions": {"all": [{"fact": "temperature", "operator": "lessThan", "value": 0}]},
+			"event": {"actions": [{"type": "updateFact", "target": "frost", "value": true}]},
+			"tests": [{"facts": {"temperature": 5}, "fires": true}]
+		},
+		{
+			"name": "undeclared",
+			"conditions": {"all": [{"fact": "humidity", "operator": "greaterThan", "value": 80}]},
+			"event": {"actions": [{"type": "updateFact", "target": "dehumidifier", "value": true}]},
+			"tests": [{"facts": {"humidity": 90}, "fires": true}]
+		}
+	]`), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+
+	report := Mutate(ruleSet)
+	assert.Equal(t, []string{"heating"}, report.UntestedRules)
+	assert.Equal(t, []string{"broken", "undeclared"}, report.FailingRules, "rules that don't compile fail their tests")
+	assert.Equal(t, []Mutant{
+		{Rule: "cooling", Condition: "all[0].any[0]", Description: "temperature greaterThan 30 -> greaterThanOrEqual 30", Killed: true},
+		{Rule: "cooling", Condition: "all[0].any[0]", Description: "temperature greaterThan 30 -> lessThanOrEqual 30", Killed: true},
+		{Rule: "cooling", Condition: "all[0].any[0]", Description: "temperature greaterThan 30 -> greaterThan 31", Killed: false},
+		{Rule: "cooling", Condition: "all[0].any[0]", Description: "temperature greaterThan 30 -> greaterThan 29", Killed: true},
+	}, report.Mutants)
+	assert.Equal(t, 75.0, report.Score())
+
+	// The original rule is left untouched
+	assert.Equal(t, "greaterThan", ruleSet[0].Conditions.All[0].Any[0].Operator)
+	assert.Equal(t, int64(30), ruleSet[0].Conditions.All[0].Any[0].Value)
+}
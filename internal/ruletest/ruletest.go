@@ -0,0 +1,361 @@
+// ruletest/ruletest.go
+
+// Package ruletest runs the tests embedded in rules. Each rule is compiled on
+// its own by the compiler package and evaluated by the runtime's VM, as
+// rextest evaluates rulesets, so a test exercises the bytecode the rule
+// compiles to independently of the rest of the ruleset. Rollouts are
+// ignored: the entity is assumed to be in the rollout. So are durations: a
+// test's facts are assumed to have held long enough, and delayed actions to
+// be due.
+package ruletest
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+	"rgehrsitz/rex/internal/runtime"
+	"rgehrsitz/rex/internal/script"
+	"slices"
+	"time"
+)
+
+// Result is the outcome of a rule test.
+type Result struct {
+	Rule    string `json:"rule"`
+	Test    string `json:"test"` // Name of the test, or its position in the rule as #1, #2, ...
+	Passed  bool   `json:"passed"`
+	Failure string `json:"failure,omitempty"`
+}
+
+// Run runs the tests of every rule, in order.
+func Run(ruleSet []*rules.Rule) []Result {
+	results := []Result{}
+	for _, rule := range ruleSet {
+		for i, test := range rule.Tests {
+			result := Result{Rule: rule.Name, Test: test.Name}
+			if result.Test == "" {
+				result.Test = fmt.Sprintf("#%d", i+1)
+			}
+			if err := Check(rule, test); err != nil {
+				result.Failure = err.Error()
+			} else {
+				result.Passed = true
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// Check runs a single test of a rule, returning why it failed.
+func Check(rule *rules.Rule, test rules.RuleTest) error {
+	image, err := compile(isolate(rule, test.Variant))
+	if err != nil {
+		return err
+	}
+	return check(image, test)
+}
+
+// check runs a test of a rule on the rule's compiled image.
+func check(image []byte, test rules.RuleTest) error {
+	outcome, err := run(image, test.Facts)
+	if err != nil {
+		return err
+	}
+	if outcome.fired != test.Fires {
+		if test.Fires {
+			return fmt.Errorf("expected the rule to fire, but its conditions don't hold")
+		}
+		return fmt.Errorf("expected the rule not to fire, but its conditions hold")
+	}
+	if !outcome.fired || len(test.Actions) == 0 {
+		return nil
+	}
+	if !sameActions(outcome.actions, test.Actions) {
+		return fmt.Errorf("expected actions %s, got %s", formatActions(test.Actions), formatActions(outcome.actions))
+	}
+	return nil
+}
+
+// Fires reports whether a rule fires for the given facts. The rule is
+// compiled on its own and evaluated by the runtime's VM, so comparing a fact
+// missing from facts is an error only if the compiled rule reaches it. A
+// scoring rule fires when its score reaches its threshold.
+func Fires(rule *rules.Rule, facts map[string]interface{}) (bool, error) {
+	image, err := compile(isolate(rule, ""))
+	if err != nil {
+		return false, err
+	}
+	outcome, err := run(image, facts)
+	return outcome.fired, err
+}
+
+// outcome is what a rule did in an evaluation cycle.
+type outcome struct {
+	fired   bool
+	actions []rules.Action // Fact updates in the order they were written, then the other actions in the order they were triggered
+}
+
+// run runs a cycle of the runtime's VM on a rule compiled on its own with
+// the given facts. The actions the rule triggers are recorded, not
+// performed.
+func run(image []byte, facts map[string]interface{}) (outcome, error) {
+	vm := runtime.NewVM(image)
+	vm.SetFacts(facts)
+
+	var result outcome
+	var triggered []rules.Action
+	vm.OnAfterRule(func(rule int, fired bool) {
+		result.fired = result.fired || fired
+	})
+	vm.OnFactUpdated(func(rule int, fact string, value interface{}) {
+		result.actions = append(result.actions, rules.Action{Type: rules.ActionUpdateFact, Target: fact, Value: value})
+	})
+	// A window covering the cycle withholds every action, and hands it over
+	vm.OnActionSuppressed(func(action runtime.Action, window string) {
+		triggered = append(triggered, rules.Action{Type: action.Type, Target: action.Target, Value: action.Value})
+	})
+	if err := vm.Suppress(runtime.SuppressionWindow{Name: "ruletest", End: vm.Clock().Now().Add(time.Hour)}); err != nil {
+		return outcome{}, err
+	}
+	if err := vm.Run(); err != nil {
+		return outcome{}, err
+	}
+	result.actions = append(result.actions, triggered...)
+	return result, nil
+}
+
+// isolate returns a copy of a rule as a test evaluates it: without its
+// rollout, hold and action delays, and with the actions of the named variant
+// in place of its event's.
+func isolate(rule *rules.Rule, variant string) *rules.Rule {
+	isolated := *rule
+	isolated.Rollout, isolated.RolloutKey = nil, ""
+	isolated.For, isolated.Once = "", false
+	isolated.Tests = nil
+	for _, v := range rule.Variants {
+		if v.Name == variant {
+			isolated.Event.Actions = v.Actions
+		}
+	}
+	isolated.Variants, isolated.VariantKey = nil, ""
+	isolated.Event.Actions = slices.Clone(isolated.Event.Actions)
+	for i := range isolated.Event.Actions {
+		isolated.Event.Actions[i].Delay = ""
+	}
+	return &isolated
+}
+
+// compile compiles a single rule with the compiler package, the way the
+// preprocessor compiles it. The rule was validated when its ruleset was
+// parsed, so it is only checked to be well formed again.
+func compile(rule *rules.Rule) ([]byte, error) {
+	ruleJSON, err := json.Marshal([]*rules.Rule{rule})
+	if err != nil {
+		return nil, err
+	}
+	options := compiler.Options{Strictness: compiler.StrictnessBasic, Scripts: true}
+	ruleset, err := compiler.ParseRules(ruleJSON, options)
+	if err != nil {
+		return nil, err
+	}
+	if ruleset, err = compiler.Optimize(ruleset); err != nil {
+		return nil, err
+	}
+	compiled, err := compiler.Compile(ruleset, options)
+	if err != nil {
+		return nil, err
+	}
+	return compiled.Image, nil
+}
+
+// Score returns the score of a scoring rule for the given facts: the sum of
+// the weights of its all conditions that hold. Like the evaluate functions
+// below, which WhyNot explains each condition with, it walks the rule's
+// definition rather than running its bytecode.
+func Score(rule *rules.Rule, facts map[string]interface{}) (float64, error) {
+	var score float64
+	for i := range rule.Conditions.All {
+		holds, err := evaluateCondition(&rule.Conditions.All[i], facts)
+		if err != nil {
+			return 0, err
+		}
+		if holds {
+			score += rule.Conditions.All[i].ScoreWeight()
+		}
+	}
+	return score, nil
+}
+
+// evaluateBlock evaluates a block of conditions: all of the all conditions
+// and, if there are any conditions, at least one of them must hold, and, if
+// there are not conditions, they must not all hold.
+func evaluateBlock(all, any, not []rules.Condition, facts map[string]interface{}) (bool, error) {
+	for i := range all {
+		holds, err := evaluateCondition(&all[i], facts)
+		if err != nil || !holds {
+			return false, err
+		}
+	}
+	if len(any) > 0 {
+		var anyHolds bool
+		for i := range any {
+			holds, err := evaluateCondition(&any[i], facts)
+			if err != nil {
+				return false, err
+			}
+			if holds {
+				anyHolds = true
+				break
+			}
+		}
+		if !anyHolds {
+			return false, nil
+		}
+	}
+	for i := range not {
+		holds, err := evaluateCondition(&not[i], facts)
+		if err != nil || !holds {
+			return err == nil, err
+		}
+	}
+	return len(not) == 0, nil
+}
+
+// evaluateCondition evaluates a single condition or nested block.
+func evaluateCondition(condition *rules.Condition, facts map[string]interface{}) (bool, error) {
+	if condition.IsBlock() {
+		return evaluateBlock(condition.All, condition.Any, condition.Not, facts)
+	}
+	if condition.Script != "" {
+		return evaluateScript(condition, facts)
+	}
+	if rules.IsFactPattern(condition.Fact) {
+		return evaluatePattern(condition, facts)
+	}
+	value, ok := facts[condition.Fact]
+	operator := preprocessor.NormalizeOperator(condition.Operator)
+	if rules.IsExistenceOperator(operator) {
+		return ok == (operator == rules.OperatorExists), nil
+	}
+	if !ok {
+		return false, fmt.Errorf("undefined fact: %s", condition.Fact)
+	}
+	holds, err := compare(condition, value)
+	if err != nil {
+		return false, fmt.Errorf("condition on fact '%s': %w", condition.Fact, err)
+	}
+	return holds, nil
+}
+
+// compare compares a fact's value with the value of a condition, within the
+// condition's epsilon if it has one.
+func compare(condition *rules.Condition, value interface{}) (bool, error) {
+	operator := preprocessor.NormalizeOperator(condition.Operator)
+	if condition.Epsilon != nil {
+		return runtime.CompareWithin(operator, value, condition.Value, *condition.Epsilon)
+	}
+	return runtime.Compare(operator, value, condition.Value)
+}
+
+// evaluateScript runs the script of a condition with the facts it reads and
+// the runtime's default limits.
+func evaluateScript(condition *rules.Condition, facts map[string]interface{}) (bool, error) {
+	program, err := script.Compile(condition.Script)
+	if err != nil {
+		return false, err
+	}
+	read := make(map[string]interface{}, len(condition.Facts))
+	for _, name := range condition.Facts {
+		if value, ok := facts[name]; ok {
+			read[name] = value
+		}
+	}
+	result, err := program.Run(read, script.DefaultLimits)
+	if err != nil {
+		return false, fmt.Errorf("script condition: %w", err)
+	}
+	holds, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("script condition returned %v, must return a boolean", result)
+	}
+	return holds, nil
+}
+
+// evaluatePattern evaluates a condition on a fact pattern over the matching
+// facts, like the runtime: a pattern matching no fact never holds.
+func evaluatePattern(condition *rules.Condition, facts map[string]interface{}) (bool, error) {
+	var names []string
+	for name := range facts {
+		if rules.MatchFact(condition.Fact, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	all := condition.Match == rules.MatchAll
+	holds := false
+	for _, name := range names {
+		var err error
+		if holds, err = compare(condition, facts[name]); err != nil {
+			return false, fmt.Errorf("condition on fact '%s': %w", name, err)
+		}
+		if holds != all {
+			break
+		}
+	}
+	return holds, nil
+}
+
+// sameActions reports whether the actions a rule performed have the types,
+// targets and values expected. The runtime commits the fact updates of a
+// cycle before it performs the other actions, so the order between the two
+// isn't observable: the fact updates and the other actions are each compared
+// in order.
+func sameActions(performed, expected []rules.Action) bool {
+	isUpdate := func(action rules.Action) bool {
+		return rules.CanonicalActionType(action.Type) == rules.ActionUpdateFact
+	}
+	isOther := func(action rules.Action) bool { return !isUpdate(action) }
+	return slices.EqualFunc(filterActions(performed, isUpdate), filterActions(expected, isUpdate), sameAction) &&
+		slices.EqualFunc(filterActions(performed, isOther), filterActions(expected, isOther), sameAction)
+}
+
+// filterActions returns the actions keep selects, in order.
+func filterActions(actions []rules.Action, keep func(rules.Action) bool) []rules.Action {
+	var kept []rules.Action
+	for _, action := range actions {
+		if keep(action) {
+			kept = append(kept, action)
+		}
+	}
+	return kept
+}
+
+// sameAction reports whether two actions have the same type, target and
+// value. Numbers are compared by value, like the rules compare them, so 2
+// equals 2.0.
+func sameAction(a, b rules.Action) bool {
+	if rules.CanonicalActionType(a.Type) != rules.CanonicalActionType(b.Type) || a.Target != b.Target {
+		return false
+	}
+	if equal, err := runtime.Compare(rules.OperatorEqual, a.Value, b.Value); err == nil && equal {
+		return true
+	}
+	return reflect.DeepEqual(a.Value, b.Value)
+}
+
+// formatActions formats a list of actions for a failure message.
+func formatActions(actions []rules.Action) string {
+	formatted := "["
+	for i, action := range actions {
+		if i > 0 {
+			formatted += ", "
+		}
+		formatted += fmt.Sprintf("%s %s=%v", action.Type, action.Target, action.Value)
+	}
+	return formatted + "]"
+}
@@ -0,0 +1,243 @@
+package ruletest
+
+import (
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const ruleJSON = `[
+	{
+		"name": "cooling",
+		"consumedFacts": ["temperature", "mode", "override"],
+		"producedFacts": ["ac_level"],
+		"conditions": {
+			"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}],
+			"any": [
+				{"fact": "mode", "operator": "equal", "value": "auto"},
+				{"fact": "override", "operator": "equal", "value": true}
+			]
+		},
+		"event": {"actions": [{"type": "updateFact", "target": "ac_level", "value": 2}]},
+		"tests": [
+			{"name": "hot in auto mode", "facts": {"temperature": 35, "mode": "auto"}, "fires": true,
+			 "actions": [{"type": "updateFact", "target": "ac_level", "value": 2}]},
+			{"name": "cool", "facts": {"temperature": 20.5}, "fires": false},
+			{"name": "wrong level", "facts": {"temperature": 35, "mode": "auto"}, "fires": true,
+			 "actions": [{"type": "updateFact", "target": "ac_level", "value": 3}]},
+			{"name": "missing fact", "facts": {"temperature": 35, "mode": "manual"}, "fires": false}
+		]
+	},
+	{
+		"name": "greeting",
+		"consumedFacts": ["visitor"],
+		"producedFacts": ["greeting"],
+		"conditions": {"all": [{"fact": "visitor", "operator": "equal", "value": "new"}]},
+		"variantKey": "visitor_id",
+		"variants": [
+			{"name": "short", "actions": [{"type": "updateFact", "target": "greeting", "value": "hi"}]},
+			{"name": "long", "actions": [{"type": "updateFact", "target": "greeting", "value": "welcome"}]}
+		],
+		"tests": [
+			{"facts": {"visitor": "new"}, "fires": true, "variant": "long",
+			 "actions": [{"type": "updateFact", "target": "greeting", "value": "welcome"}]}
+		]
+	}
+]`
+
+// alertRule returns a rule reading the given facts that raises an alert when
+// its conditions hold.
+func alertRule(facts []string, conditions rules.Conditions) *rules.Rule {
+	return &rules.Rule{
+		Name:          "alert",
+		ConsumedFacts: facts,
+		ProducedFacts: []string{"alert"},
+		Conditions:    conditions,
+		Event:         rules.Event{Actions: []rules.Action{{Type: rules.ActionUpdateFact, Target: "alert", Value: true}}},
+	}
+}
+
+func TestRun(t *testing.T) {
+	ruleSet, err := preprocessor.ParseAndValidateRules([]byte(ruleJSON), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+
+	results := Run(ruleSet)
+	require.Len(t, results, 5)
+	assert.Equal(t, Result{Rule: "cooling", Test: "hot in auto mode", Passed: true}, results[0])
+	assert.Equal(t, Result{Rule: "cooling", Test: "cool", Passed: true}, results[1])
+	assert.False(t, results[2].Passed)
+	assert.Equal(t, "expected actions [updateFact ac_level=3], got [updateFact ac_level=2]", results[2].Failure)
+	assert.False(t, results[3].Passed)
+	assert.Equal(t, "undefined fact: override", results[3].Failure)
+	assert.Equal(t, Result{Rule: "greeting", Test: "#1", Passed: true}, results[4])
+}
+
+func TestCheck_Guards(t *testing.T) {
+	rule := &rules.Rule{
+		Name:          "overheat",
+		ConsumedFacts: []string{"temperature", "quiet_hours", "fan"},
+		ProducedFacts: []string{"fan"},
+		Conditions:    rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30}}},
+		Event: rules.Event{Actions: []rules.Action{
+			{Type: rules.ActionNotify, Target: "ops", Value: "too hot", Order: 2, When: &rules.Conditions{
+				All: []rules.Condition{{Fact: "quiet_hours", Operator: "equal", Value: false}},
+			}},
+			{Type: rules.ActionUpdateFact, Target: "fan", Value: true, Order: 1},
+			{Type: rules.ActionLogEvent, Target: "system", Value: "fan on", Order: 2, When: &rules.Conditions{
+				All: []rules.Condition{{Fact: "fan", Operator: "equal", Value: true}},
+			}},
+		}},
+	}
+
+	err := Check(rule, rules.RuleTest{Facts: map[string]interface{}{"temperature": 35, "quiet_hours": false}, Fires: true, Actions: []rules.Action{
+		{Type: rules.ActionUpdateFact, Target: "fan", Value: true},
+		{Type: rules.ActionNotify, Target: "ops", Value: "too hot"},
+		{Type: rules.ActionLogEvent, Target: "system", Value: "fan on"},
+	}})
+	assert.NoError(t, err)
+
+	// Guards see the facts the actions before them write
+	err = Check(rule, rules.RuleTest{Facts: map[string]interface{}{"temperature": 35, "quiet_hours": true}, Fires: true, Actions: []rules.Action{
+		{Type: rules.ActionNotify, Target: "ops", Value: "too hot"},
+	}})
+	assert.EqualError(t, err, "expected actions [notify ops=too hot], got [updateFact fan=true, logEvent system=fan on]")
+}
+
+func TestFires_ShortCircuits(t *testing.T) {
+	rule := alertRule([]string{"temperature", "mode"}, rules.Conditions{
+		All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30}},
+		Any: []rules.Condition{{Fact: "mode", Operator: "equal", Value: "auto"}},
+	})
+
+	// The any block isn't reached, so the missing mode fact doesn't matter
+	fires, err := Fires(rule, map[string]interface{}{"temperature": 25})
+	require.NoError(t, err)
+	assert.False(t, fires)
+
+	_, err = Fires(rule, map[string]interface{}{"temperature": "hot"})
+	assert.ErrorContains(t, err, "cannot compare string with int as numbers")
+}
+
+func TestFires_FactPatterns(t *testing.T) {
+	facts := map[string]interface{}{"sensor.a.temperature": 35, "sensor.b.temperature": 20, "temperature": 40}
+	for match, expected := range map[string]bool{"": true, rules.MatchAny: true, rules.MatchAll: false} {
+		rule := alertRule(nil, rules.Conditions{
+			All: []rules.Condition{{Fact: "sensor.*.temperature", Operator: "greaterThan", Value: 30, Match: match}},
+		})
+		fires, err := Fires(rule, facts)
+		require.NoError(t, err)
+		assert.Equal(t, expected, fires, "match %q", match)
+	}
+
+	// A pattern matching no fact never holds
+	rule := alertRule(nil, rules.Conditions{
+		All: []rules.Condition{{Fact: "valve.*.open", Operator: "equal", Value: true, Match: rules.MatchAll}},
+	})
+	fires, err := Fires(rule, facts)
+	require.NoError(t, err)
+	assert.False(t, fires)
+}
+
+func TestFires_Epsilon(t *testing.T) {
+	epsilon := 0.05
+	rule := alertRule([]string{"temperature"}, rules.Conditions{
+		All: []rules.Condition{{Fact: "temperature", Operator: "equal", Value: 21.5, Epsilon: &epsilon}},
+	})
+	for temperature, expected := range map[float64]bool{21.46: true, 21.5: true, 21.6: false} {
+		fires, err := Fires(rule, map[string]interface{}{"temperature": temperature})
+		require.NoError(t, err)
+		assert.Equal(t, expected, fires, "temperature %v", temperature)
+	}
+}
+
+func TestFires_Existence(t *testing.T) {
+	rule := alertRule([]string{"reading", "baseline"}, rules.Conditions{
+		All: []rules.Condition{{Fact: "reading", Operator: "exists"}, {Fact: "baseline", Operator: "notExists"}},
+	})
+	for _, tc := range []struct {
+		facts    map[string]interface{}
+		expected bool
+	}{
+		{map[string]interface{}{"reading": 12}, true},
+		{map[string]interface{}{"reading": 12, "baseline": 0}, false},
+		{map[string]interface{}{}, false},
+	} {
+		fires, err := Fires(rule, tc.facts)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, fires, "facts %v", tc.facts)
+	}
+}
+
+func TestFires_Score(t *testing.T) {
+	weight := 2.5
+	rule := alertRule([]string{"amount", "country"}, rules.Conditions{All: []rules.Condition{
+		{Fact: "amount", Operator: "greaterThan", Value: 1000, Weight: &weight},
+		{Fact: "country", Operator: "notEqual", Value: "home"},
+	}})
+	rule.Score = &rules.Score{Fact: "risk", Threshold: 3}
+	rule.ProducedFacts = append(rule.ProducedFacts, "risk")
+	for _, tc := range []struct {
+		facts    map[string]interface{}
+		score    float64
+		expected bool
+	}{
+		{map[string]interface{}{"amount": 5000, "country": "abroad"}, 3.5, true},
+		{map[string]interface{}{"amount": 5000, "country": "home"}, 2.5, false},
+		{map[string]interface{}{"amount": 10, "country": "abroad"}, 1, false},
+	} {
+		score, err := Score(rule, tc.facts)
+		require.NoError(t, err)
+		assert.Equal(t, tc.score, score, "facts %v", tc.facts)
+		fires, err := Fires(rule, tc.facts)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, fires, "facts %v", tc.facts)
+	}
+}
+
+func TestFires_Scripts(t *testing.T) {
+	rule := alertRule([]string{"temperature", "humidity"}, rules.Conditions{
+		All: []rules.Condition{{Script: "facts.temperature + facts.humidity / 10 > 30", Facts: []string{"temperature", "humidity"}}},
+	})
+	for humidity, expected := range map[float64]bool{40: false, 60: true} {
+		fires, err := Fires(rule, map[string]interface{}{"temperature": 25, "humidity": humidity})
+		require.NoError(t, err)
+		assert.Equal(t, expected, fires, "humidity %v", humidity)
+	}
+
+	rule.Conditions.All[0].Script = "facts.temperature"
+	_, err := Fires(rule, map[string]interface{}{"temperature": 25})
+	assert.ErrorContains(t, err, "must return a boolean")
+}
+
+func TestParse_InvalidTests(t *testing.T) {
+	_, err := preprocessor.ParseAndValidateRules([]byte(`[{
+		"name": "greeting",
+		"conditions": {"all": [{"fact": "visitor", "operator": "equal", "value": "new"}]},
+		"variantKey": "visitor_id",
+		"variants": [{"name": "short", "actions": [{"type": "updateFact", "target": "greeting", "value": "hi"}]}],
+		"tests": [{"facts": {"visitor": "new"}, "fires": true, "variant": "medium"}]
+	}]`), rules.NewRuleEngineContext())
+	assert.EqualError(t, err, "rules[0].tests (rule 'greeting', line 6, column 12): test #1 of rule 'greeting' assumes unknown variant 'medium'")
+}
+
+func TestCheck_HeldRolledOutAndDelayed(t *testing.T) {
+	rollout := 10
+	rule := alertRule([]string{"temperature", "device"}, rules.Conditions{
+		All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30}},
+	})
+	rule.For, rule.Rollout, rule.RolloutKey = "5m", &rollout, "device"
+	rule.Event.Actions = append(rule.Event.Actions, rules.Action{Type: rules.ActionNotify, Target: "ops", Value: "too hot", Delay: "10m"})
+
+	// The facts are assumed to have held for 5m, the device to be in the
+	// rollout and the notification to be due
+	for _, device := range []string{"a", "b", "c", "d"} {
+		err := Check(rule, rules.RuleTest{Facts: map[string]interface{}{"temperature": 35, "device": device}, Fires: true, Actions: []rules.Action{
+			{Type: rules.ActionUpdateFact, Target: "alert", Value: true},
+			{Type: rules.ActionNotify, Target: "ops", Value: "too hot"},
+		}})
+		assert.NoError(t, err, "device %s", device)
+	}
+}
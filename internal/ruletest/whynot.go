@@ -0,0 +1,204 @@
+// ruletest/whynot.go
+
+package ruletest
+
+import (
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+)
+
+// Explanation tells why a rule doesn't fire for given facts.
+type Explanation struct {
+	Rule      string    `json:"rule"`
+	Fires     bool      `json:"fires"`
+	Score     *float64  `json:"score,omitempty"`     // Score of a scoring rule
+	Threshold *float64  `json:"threshold,omitempty"` // Score at which a scoring rule fires
+	Failures  []Failure `json:"failures"`            // Conditions keeping the rule from firing; empty if it fires
+	Closest   *Failure  `json:"closest,omitempty"`   // Failing numeric comparison nearest to holding
+}
+
+// Failure is a condition keeping a rule from firing.
+type Failure struct {
+	Condition string      `json:"condition"` // Path of the condition in the rule, e.g. all[1].any[0]
+	Fact      string      `json:"fact,omitempty"`
+	Operator  string      `json:"operator,omitempty"`
+	Expected  interface{} `json:"expected,omitempty"` // Value the fact is compared with
+	Actual    interface{} `json:"actual,omitempty"`   // Value of the fact, if set
+	Delta     *float64    `json:"delta,omitempty"`    // Expected minus actual, for numeric comparisons
+	Reason    string      `json:"reason"`
+}
+
+// WhyNot explains why a rule doesn't fire for the given facts. Whether it
+// fires is decided by Fires, running the compiled rule; the conditions are
+// then walked one by one to list every one that doesn't hold, not only the
+// first one the compiled rule stops at: all the failing all conditions, every
+// condition of an any block none of which holds, and the conditions of a
+// not block that all hold. A scoring rule lists its all conditions that
+// don't hold, which would each raise its score by their weight.
+//
+// Of the failing comparisons of a number with a number, Closest is the one
+// whose delta is smallest relative to the value the fact is compared with.
+func WhyNot(rule *rules.Rule, facts map[string]interface{}) Explanation {
+	explanation := Explanation{Rule: rule.Name, Failures: []Failure{}}
+	fires, err := Fires(rule, facts)
+	explanation.Fires = err == nil && fires
+
+	if rule.Scored() {
+		score, _ := Score(rule, facts)
+		explanation.Score, explanation.Threshold = &score, &rule.Score.Threshold
+		for i := range rule.Conditions.All {
+			_, failures := explainCondition(&rule.Conditions.All[i], conditionPath{{block: "all", index: i}}, facts)
+			for _, failure := range failures {
+				failure.Reason += fmt.Sprintf(" (weight %v)", rule.Conditions.All[i].ScoreWeight())
+				explanation.Failures = append(explanation.Failures, failure)
+			}
+		}
+	} else {
+		_, explanation.Failures = explainBlock(rule.Conditions.All, rule.Conditions.Any, rule.Conditions.Not, nil, facts)
+	}
+	if explanation.Fires {
+		explanation.Failures = []Failure{}
+		return explanation
+	}
+	if len(explanation.Failures) == 0 && err != nil {
+		explanation.Failures = append(explanation.Failures, Failure{Reason: err.Error()})
+	}
+
+	closest := math.Inf(1)
+	for i, failure := range explanation.Failures {
+		if failure.Delta == nil {
+			continue
+		}
+		scale, _ := number(failure.Expected)
+		if scale = math.Abs(scale); scale == 0 {
+			scale = 1
+		}
+		if distance := math.Abs(*failure.Delta) / scale; distance < closest {
+			closest = distance
+			explanation.Closest = &explanation.Failures[i]
+		}
+	}
+	return explanation
+}
+
+// explainBlock evaluates a block of conditions below prefix, returning
+// whether it holds and the conditions keeping it from holding.
+func explainBlock(all, any, not []rules.Condition, prefix conditionPath, facts map[string]interface{}) (bool, []Failure) {
+	failures := []Failure{}
+	for i := range all {
+		_, conditionFailures := explainCondition(&all[i], prefix.step("all", i), facts)
+		failures = append(failures, conditionFailures...)
+	}
+
+	var anyFailures []Failure
+	for i := range any {
+		holds, conditionFailures := explainCondition(&any[i], prefix.step("any", i), facts)
+		if holds {
+			anyFailures = nil
+			break
+		}
+		anyFailures = append(anyFailures, conditionFailures...)
+	}
+	failures = append(failures, anyFailures...)
+
+	var notFailures []Failure
+	for i := range not {
+		holds, _ := explainCondition(&not[i], prefix.step("not", i), facts)
+		if !holds {
+			notFailures = nil
+			break
+		}
+		notFailures = append(notFailures, Failure{
+			Condition: prefix.step("not", i).String(),
+			Fact:      not[i].Fact,
+			Operator:  preprocessor.NormalizeOperator(not[i].Operator),
+			Expected:  not[i].Value,
+			Actual:    facts[not[i].Fact],
+			Reason:    "holds, as do all the conditions of its not block",
+		})
+	}
+	failures = append(failures, notFailures...)
+	return len(failures) == 0, failures
+}
+
+// explainCondition evaluates a single condition or nested block, returning
+// whether it holds and, if it doesn't, why.
+func explainCondition(condition *rules.Condition, path conditionPath, facts map[string]interface{}) (bool, []Failure) {
+	if condition.IsBlock() {
+		return explainBlock(condition.All, condition.Any, condition.Not, path, facts)
+	}
+
+	holds, err := evaluateCondition(condition, facts)
+	if err == nil && holds {
+		return true, nil
+	}
+	operator := preprocessor.NormalizeOperator(condition.Operator)
+	failure := Failure{Condition: path.String(), Fact: condition.Fact, Operator: operator, Expected: condition.Value}
+	actual, set := facts[condition.Fact]
+	switch {
+	case condition.Script != "":
+		failure.Reason = "the script returned false"
+		if err != nil {
+			failure.Reason = err.Error()
+		}
+	case rules.IsFactPattern(condition.Fact):
+		failure.Reason = fmt.Sprintf("no fact matching %s satisfies it", condition.Fact)
+		if err != nil {
+			failure.Reason = err.Error()
+		}
+	case !set:
+		failure.Reason = fmt.Sprintf("%s isn't set", condition.Fact)
+	case err != nil:
+		failure.Actual = actual
+		failure.Reason = err.Error()
+	default:
+		failure.Actual = actual
+		failure.Reason = fmt.Sprintf("%s is %v", condition.Fact, actual)
+		failure.Delta = delta(operator, actual, condition.Value)
+	}
+	return false, []Failure{failure}
+}
+
+// step returns the path to the condition at index of a block below the path.
+func (p conditionPath) step(block string, index int) conditionPath {
+	return append(append(conditionPath{}, p...), pathStep{block: block, index: index})
+}
+
+// delta returns how far a numeric fact is from the value an ordering or
+// equality compares it with, or nil for other comparisons.
+func delta(operator string, actual, expected interface{}) *float64 {
+	switch operator {
+	case rules.OperatorEqual, rules.OperatorGreaterThan, rules.OperatorGreaterThanOrEqual,
+		rules.OperatorLessThan, rules.OperatorLessThanOrEqual:
+	default:
+		return nil
+	}
+	a, ok := number(actual)
+	if !ok {
+		return nil
+	}
+	e, ok := number(expected)
+	if !ok {
+		return nil
+	}
+	d := e - a
+	return &d
+}
+
+// number converts a numeric value to a float64.
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
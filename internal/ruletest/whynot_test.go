@@ -0,0 +1,90 @@
+package ruletest
+
+import (
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWhyNot(t *testing.T) {
+	ruleSet, err := preprocessor.ParseAndValidateRules([]byte(ruleJSON), rules.NewRuleEngineContext())
+	require.NoError(t, err)
+	cooling := ruleSet[0]
+
+	explanation := WhyNot(cooling, map[string]interface{}{"temperature": 28.5, "mode": "manual"})
+	assert.False(t, explanation.Fires)
+	require.Len(t, explanation.Failures, 3)
+	assert.Equal(t, "all[0]", explanation.Failures[0].Condition)
+	assert.Equal(t, "greaterThan", explanation.Failures[0].Operator)
+	assert.Equal(t, 28.5, explanation.Failures[0].Actual)
+	require.NotNil(t, explanation.Failures[0].Delta)
+	assert.Equal(t, 1.5, *explanation.Failures[0].Delta)
+	assert.Equal(t, "temperature is 28.5", explanation.Failures[0].Reason)
+	assert.Equal(t, "any[0]", explanation.Failures[1].Condition)
+	assert.Nil(t, explanation.Failures[1].Delta, "strings have no delta")
+	assert.Equal(t, "any[1]", explanation.Failures[2].Condition)
+	assert.Equal(t, "override isn't set", explanation.Failures[2].Reason)
+	require.NotNil(t, explanation.Closest)
+	assert.Equal(t, "all[0]", explanation.Closest.Condition)
+
+	explanation = WhyNot(cooling, map[string]interface{}{"temperature": 35, "mode": "auto"})
+	assert.True(t, explanation.Fires)
+	assert.Empty(t, explanation.Failures)
+	assert.Nil(t, explanation.Closest)
+
+	explanation = WhyNot(cooling, map[string]interface{}{"temperature": 35, "mode": "manual", "override": true})
+	assert.True(t, explanation.Fires, "an any block holds if one of its conditions does")
+}
+
+func TestWhyNot_Closest(t *testing.T) {
+	rule := alertRule([]string{"pressure", "temperature", "level"}, rules.Conditions{All: []rules.Condition{
+		{Fact: "pressure", Operator: "greaterThan", Value: int64(1000)},
+		{Fact: "temperature", Operator: "lessThanOrEqual", Value: int64(20)},
+		{Fact: "level", Operator: "equal", Value: int64(3)},
+	}})
+
+	explanation := WhyNot(rule, map[string]interface{}{"pressure": 900, "temperature": 25, "level": 3})
+	require.Len(t, explanation.Failures, 2)
+	assert.Equal(t, -5.0, *explanation.Failures[1].Delta)
+	require.NotNil(t, explanation.Closest)
+	assert.Equal(t, "all[0]", explanation.Closest.Condition, "100 below 1000 is closer than 5 above 20")
+}
+
+func TestWhyNot_Not(t *testing.T) {
+	rule := alertRule([]string{"weekend", "holiday"}, rules.Conditions{Not: []rules.Condition{
+		{Fact: "weekend", Operator: "equal", Value: true},
+		{Any: []rules.Condition{{Fact: "holiday", Operator: "equal", Value: true}}},
+	}})
+
+	explanation := WhyNot(rule, map[string]interface{}{"weekend": true, "holiday": true})
+	assert.False(t, explanation.Fires)
+	require.Len(t, explanation.Failures, 2)
+	assert.Equal(t, "not[0]", explanation.Failures[0].Condition)
+	assert.Equal(t, "not[1]", explanation.Failures[1].Condition)
+	assert.Contains(t, explanation.Failures[0].Reason, "holds")
+
+	explanation = WhyNot(rule, map[string]interface{}{"weekend": true, "holiday": false})
+	assert.True(t, explanation.Fires)
+}
+
+func TestWhyNot_Scored(t *testing.T) {
+	weight := 2.0
+	rule := alertRule([]string{"amount", "country", "newDevice"}, rules.Conditions{All: []rules.Condition{
+		{Fact: "amount", Operator: "greaterThan", Value: int64(1000), Weight: &weight},
+		{Fact: "country", Operator: "notEqual", Value: "home"},
+		{Fact: "newDevice", Operator: "equal", Value: true},
+	}})
+	rule.Score = &rules.Score{Fact: "fraud.risk", Threshold: 3}
+	rule.ProducedFacts = append(rule.ProducedFacts, "fraud.risk")
+
+	explanation := WhyNot(rule, map[string]interface{}{"amount": 500, "country": "abroad", "newDevice": true})
+	assert.False(t, explanation.Fires)
+	require.NotNil(t, explanation.Score)
+	assert.Equal(t, 2.0, *explanation.Score)
+	assert.Equal(t, 3.0, *explanation.Threshold)
+	require.Len(t, explanation.Failures, 1)
+	assert.Equal(t, "amount is 500 (weight 2)", explanation.Failures[0].Reason)
+}
@@ -0,0 +1,135 @@
+// runtime/actions.go
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultActionHandlers perform the built-in action types for which the host
+// hasn't registered a handler of its own. They write the action to the log,
+// except for webhook actions, which are sent; hosts deliver sendMessage
+// actions with a MessageRouter.
+var defaultActionHandlers = map[string]ActionHandler{
+	rules.ActionNotify:      logAction(zerolog.InfoLevel, "Notification"),
+	rules.ActionSendAlert:   logAction(zerolog.WarnLevel, "Alert"),
+	rules.ActionLogEvent:    logAction(zerolog.InfoLevel, "Event"),
+	rules.ActionSendMessage: logAction(zerolog.InfoLevel, "Message"),
+	rules.ActionWebhook:     sendWebhook,
+}
+
+// logAction returns a handler logging actions at the given level.
+func logAction(level zerolog.Level, message string) ActionHandler {
+	return func(ctx context.Context, action Action) error {
+		log.WithLevel(level).
+			Int("Rule", action.Rule).
+			Str("Target", action.Target).
+			Interface("Value", action.Value).
+			Msg(message)
+		return nil
+	}
+}
+
+// RegisterAction registers the handler performing the actions of a type the
+// VM's rules trigger, in place of one registered for all VMs with
+// RegisterActionHandler or the default handler of a built-in type. Actions of
+// types no handler is registered for fail. Registering a type again replaces
+// its handler, and a nil handler removes it. RegisterAction must not be
+// called during a cycle.
+func (vm *VM) RegisterAction(actionType string, handler ActionHandler) {
+	if handler == nil {
+		delete(vm.handlers, actionType)
+		return
+	}
+	if vm.handlers == nil {
+		vm.handlers = make(map[string]ActionHandler)
+	}
+	vm.handlers[actionType] = handler
+}
+
+// actionHandler returns the handler performing actions of a type: the one
+// registered with RegisterAction, the one registered with
+// RegisterActionHandler, or else the default handler of a built-in action
+// type.
+func (vm *VM) actionHandler(actionType string) (ActionHandler, bool) {
+	if handler, ok := vm.handlers[actionType]; ok {
+		return handler, true
+	}
+	if handler, ok := LookupActionHandler(actionType); ok {
+		return handler, true
+	}
+	handler, ok := defaultActionHandlers[actionType]
+	return handler, ok
+}
+
+// triggerAction pops the value of an action and records the action as pending
+// until the cycle's writes are committed.
+func (vm *VM) triggerAction(actionType, target string) error {
+	action, err := vm.newAction(actionType, target)
+	if err != nil {
+		return err
+	}
+	vm.tx.actions = append(vm.tx.actions, action)
+	vm.ruleFired = true
+	vm.logger.Debug().Str("Type", actionType).Str("Target", target).Interface("Value", action.Value).Msg("Action triggered")
+	return nil
+}
+
+// newAction pops the value of an action the current rule triggers. The value
+// of a webhook action is rendered into its request now, with the facts the
+// action was triggered on.
+func (vm *VM) newAction(actionType, target string) (Action, error) {
+	value, err := vm.pop()
+	if err != nil {
+		return Action{}, err
+	}
+	if actionType == rules.ActionWebhook {
+		if value, err = vm.webhookValue(value); err != nil {
+			return Action{}, err
+		}
+	}
+	action := Action{Rule: vm.rule, Type: actionType, Target: target, Value: value, CorrelationID: vm.correlationID}
+	if vm.provenance != nil {
+		action.RulesetHash = vm.provenance.RulesetHash
+	}
+	return action, nil
+}
+
+// performActions invokes the handlers of the actions triggered by a cycle,
+// through the VM's ActionGuard and in the order they were triggered, after
+// those the degradation policy held back. A failed action is passed to the
+// ActionError hooks; the errors they don't swallow are returned together.
+func (vm *VM) performActions(actions []Action) error {
+	var errs []error
+	for _, action := range append(vm.queuedActions(), actions...) {
+		err := vm.performAction(action)
+		if err != nil && vm.queueAction(action, err) {
+			continue
+		}
+		vm.hooks.runActionPerformed(action, err)
+		if err != nil {
+			err = vm.hooks.runActionError(action.Rule, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	vm.releaseQueues()
+	return errors.Join(errs...)
+}
+
+func (vm *VM) performAction(action Action) error {
+	handler, ok := vm.actionHandler(action.Type)
+	if !ok {
+		return fmt.Errorf("no handler for action type %s", action.Type)
+	}
+	return vm.actions.Invoke(action.Rule, action.Type, func(ctx context.Context) error {
+		return handler(ctx, action)
+	})
+}
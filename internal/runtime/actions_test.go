@@ -0,0 +1,158 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var triggeredActions []Action
+
+func init() {
+	RegisterActionHandler("actionsTest", func(ctx context.Context, action Action) error {
+		if action.Target == "broken" {
+			return errors.New("downstream unavailable")
+		}
+		triggeredActions = append(triggeredActions, action)
+		return nil
+	})
+}
+
+func TestVM_TriggerAction(t *testing.T) {
+	triggeredActions = nil
+	code := newProgram().
+		ruleStart(0).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		loadString("too hot").triggerAction("actionsTest", "ops").
+		loadString("logged").triggerAction(rules.ActionLogEvent, "system").
+		label("end").op(bytecode.RULE_END).
+		bytes()
+
+	vm := NewVM(code)
+	var fired bool
+	vm.OnAfterRule(func(rule int, ruleFired bool) { fired = ruleFired })
+	vm.SetFact("temperature", 35)
+	vm.SetCorrelationID("reading-7")
+	require.NoError(t, vm.Run())
+
+	assert.True(t, fired)
+	assert.Equal(t, []Action{{Rule: 0, Type: "actionsTest", Target: "ops", Value: "too hot", CorrelationID: "reading-7"}}, triggeredActions)
+}
+
+func TestVM_FailedCycleTriggersNoActions(t *testing.T) {
+	triggeredActions = nil
+	code := newProgram().
+		ruleStart(0).
+		loadBool(true).triggerAction("actionsTest", "ops").
+		loadFact("missing").op(bytecode.RULE_END).
+		bytes()
+
+	assert.Error(t, NewVM(code).Run())
+	assert.Empty(t, triggeredActions)
+}
+
+func TestVM_ActionErrors(t *testing.T) {
+	code := newProgram().
+		ruleStart(0).
+		loadBool(true).triggerAction("actionsTest", "broken").
+		loadBool(true).triggerAction("unknownAction", "ops").
+		loadBool(true).updateFact("handled").
+		op(bytecode.RULE_END).
+		bytes()
+
+	vm := NewVM(code)
+	err := vm.Run()
+	assert.ErrorContains(t, err, "downstream unavailable")
+	assert.ErrorContains(t, err, "no handler for action type unknownAction")
+	assert.Equal(t, true, vm.Facts()["handled"], "Fact writes are committed before actions are performed")
+
+	var hooked []error
+	vm.OnActionError(func(rule int, err error) error {
+		hooked = append(hooked, err)
+		return nil
+	})
+	require.NoError(t, vm.Run())
+	assert.Len(t, hooked, 2)
+}
+
+func TestVM_ActionPerformedHook(t *testing.T) {
+	code := newProgram().
+		ruleStart(0).
+		loadString("too hot").triggerAction("actionsTest", "ops").
+		loadBool(true).triggerAction("actionsTest", "broken").
+		op(bytecode.RULE_END).
+		bytes()
+
+	vm := NewVM(code)
+	var performed []string
+	vm.OnActionPerformed(func(action Action, err error) {
+		performed = append(performed, fmt.Sprintf("%s: %v", action.Target, err))
+	})
+	vm.OnActionError(func(rule int, err error) error { return nil })
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []string{"ops: <nil>", "broken: downstream unavailable"}, performed)
+}
+
+func TestCompiledBuiltinActions(t *testing.T) {
+	rule := &rules.Rule{
+		Name: "Alert",
+		Conditions: rules.Conditions{
+			All: []rules.Condition{{Fact: "temperature", Operator: rules.OperatorGreaterThan, Value: 3, ValueType: "int"}},
+		},
+		Event: rules.Event{Actions: []rules.Action{
+			{Type: rules.ActionUpdateStore, Target: "fired", Value: true},
+			{Type: rules.ActionNotify, Target: "ops", Value: "too hot"},
+			{Type: rules.ActionSendAlert, Target: "pager", Value: int64(2)},
+			{Type: rules.ActionLogEvent, Target: "system"},
+		}},
+	}
+
+	vm := NewVM(compileForVM(t, []*rules.Rule{rule}, bytecode.ConditionModeJump))
+	vm.SetFact("temperature", 4)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.Facts()["fired"])
+}
+
+func TestVM_RegisterAction(t *testing.T) {
+	rule := &rules.Rule{
+		Name: "Slack",
+		Conditions: rules.Conditions{
+			All: []rules.Condition{{Fact: "temperature", Operator: rules.OperatorGreaterThan, Value: 3, ValueType: "int"}},
+		},
+		Event: rules.Event{Actions: []rules.Action{
+			{Type: "notifySlack", Target: "#ops", Value: "too hot"},
+			{Type: "actionsTest", Target: "ops", Value: "registered"},
+		}},
+	}
+	vm := NewVM(compileForVM(t, []*rules.Rule{rule}, bytecode.ConditionModeJump))
+	vm.SetFact("temperature", 4)
+	assert.ErrorContains(t, vm.Run(), "no handler for action type notifySlack")
+
+	// Handlers of the VM take precedence over those registered for all VMs
+	var handled []Action
+	record := func(ctx context.Context, action Action) error {
+		handled = append(handled, action)
+		return nil
+	}
+	vm.RegisterAction("notifySlack", record)
+	vm.RegisterAction("actionsTest", record)
+	triggeredActions = nil
+	vm.SetCorrelationID("c1")
+	require.NoError(t, vm.Run())
+	require.Len(t, handled, 2)
+	assert.Equal(t, Action{Type: "notifySlack", Target: "#ops", Value: "too hot", CorrelationID: "c1"}, handled[0])
+	assert.Empty(t, triggeredActions)
+
+	vm.RegisterAction("actionsTest", nil)
+	handled = nil
+	require.NoError(t, vm.Run())
+	assert.Len(t, handled, 1)
+	assert.Len(t, triggeredActions, 1)
+}
@@ -0,0 +1,146 @@
+// runtime/chaining.go
+
+package runtime
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ChainDepthError is returned when forward chaining re-evaluates rules deeper
+// than the configured maximum, which usually means the ruleset is recursive.
+type ChainDepthError struct {
+	MaxDepth int
+	Path     []string // Alternating rule names, or "rule N" for unnamed rules, and the facts that triggered the next rule
+}
+
+func (e *ChainDepthError) Error() string {
+	return fmt.Sprintf("rule chain exceeded max depth %d: %s", e.MaxDepth, strings.Join(e.Path, " -> "))
+}
+
+// ChainIterationsError is returned when forward chaining re-evaluates more
+// rules in a cycle than the configured maximum, which catches rulesets whose
+// chains fan out too widely for the depth limit to stop them in time.
+type ChainIterationsError struct {
+	MaxIterations int
+	Rule          int // Rule whose re-evaluation went over the maximum
+}
+
+func (e *ChainIterationsError) Error() string {
+	return fmt.Sprintf("rule chain exceeded max %d re-evaluations per cycle at %s", e.MaxIterations, ruleLabel(e.Rule))
+}
+
+// chainLink is a pending re-evaluation of a rule triggered by a fact change.
+type chainLink struct {
+	entry ruleEntry
+	depth int
+	path  []string
+}
+
+// SetMaxChainDepth enables forward chaining: when a rule changes a fact, the
+// rules that consume it are re-evaluated in the same cycle, up to maxDepth
+// re-evaluations deep. A maxDepth of 0 disables chaining.
+func (vm *VM) SetMaxChainDepth(maxDepth int) {
+	vm.maxChainDepth = maxDepth
+}
+
+// SetMaxChainIterations limits the number of rule re-evaluations forward
+// chaining may run in a cycle, across all chains. A maxIterations of 0 only
+// limits their depth.
+func (vm *VM) SetMaxChainIterations(maxIterations int) {
+	vm.maxChainIterations = maxIterations
+}
+
+// chain re-evaluates rules triggered by fact changes until no further facts
+// change, failing if any chain grows deeper, or all of them run more
+// re-evaluations, than the configured maximum.
+func (vm *VM) chain(schedule []ruleEntry, queue []chainLink) error {
+	iterations := 0
+	for len(queue) > 0 {
+		link := queue[0]
+		queue = queue[1:]
+
+		if link.depth > vm.maxChainDepth {
+			err := &ChainDepthError{MaxDepth: vm.maxChainDepth, Path: link.path}
+			vm.logger.Error().
+				Int("MaxDepth", vm.maxChainDepth).
+				Strs("ChainPath", link.path).
+				Msg("Rule chain exceeded max depth")
+			return err
+		}
+		if vm.maxChainIterations > 0 && iterations >= vm.maxChainIterations {
+			vm.logger.Error().
+				Int("MaxIterations", vm.maxChainIterations).
+				Int("Rule", link.entry.index).
+				Msg("Rule chain exceeded max re-evaluations")
+			return &ChainIterationsError{MaxIterations: vm.maxChainIterations, Rule: link.entry.index}
+		}
+
+		if vm.rulePaused(link.entry) || vm.ruleDisabled(link.entry) {
+			continue
+		}
+
+		iterations++
+		vm.logger.Debug().
+			Int("Rule", link.entry.index).
+			Int("Depth", link.depth).
+			Strs("ChainPath", link.path).
+			Msg("Re-evaluating chained rule")
+
+		changed, err := vm.evaluateRule(link.entry)
+		if err != nil {
+			return err
+		}
+		if vm.halted {
+			return nil
+		}
+		queue = append(queue, vm.dependentRules(schedule, link.entry, changed, link, nil)...)
+	}
+
+	return nil
+}
+
+// dependentRules returns links for the rules that consume any of the facts
+// changed by a rule, in schedule order, leaving out those at the positions
+// of the schedule pending reports, if not nil, as still to be evaluated.
+func (vm *VM) dependentRules(schedule []ruleEntry, producer ruleEntry, changed []string, from chainLink, pending func(position int) bool) []chainLink {
+	path := from.path
+	if len(path) == 0 {
+		path = []string{vm.chainLabel(producer.index)}
+	}
+
+	var links []chainLink
+	for position, entry := range schedule {
+		if pending != nil && pending(position) {
+			continue
+		}
+		for _, factName := range changed {
+			if !entry.reads(factName) {
+				continue
+			}
+			linkPath := make([]string, len(path), len(path)+2)
+			copy(linkPath, path)
+			links = append(links, chainLink{
+				entry: entry,
+				depth: from.depth + 1,
+				path:  append(linkPath, factName, vm.chainLabel(entry.index)),
+			})
+			break
+		}
+	}
+	return links
+}
+
+// ruleLabel returns the name used for a rule in diagnostics.
+func ruleLabel(index int) string {
+	return fmt.Sprintf("rule %d", index)
+}
+
+// chainLabel returns the name used for a rule in chain paths: its name, if
+// the bytecode names its rules, and its ruleLabel otherwise.
+func (vm *VM) chainLabel(index int) string {
+	if name := vm.ruleName(index); name != "" {
+		return name
+	}
+	return ruleLabel(index)
+}
@@ -0,0 +1,167 @@
+package runtime
+
+import (
+	"errors"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chainedProgram builds a program where the first rule depends on a fact
+// produced by the second, lower priority rule.
+func chainedProgram() []byte {
+	return newProgram().
+		ruleStart(20).
+		loadFact("ac_status").loadBool(true).op(bytecode.AND).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadBool(true).updateFact("fan_status").
+		label("rule0_end").op(bytecode.RULE_END).
+		ruleStart(10).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule1_end").
+		loadBool(true).updateFact("ac_status").
+		label("rule1_end").op(bytecode.RULE_END).
+		bytes()
+}
+
+func TestChaining_Disabled(t *testing.T) {
+	vm := NewVM(chainedProgram())
+	vm.facts["temperature"] = 35
+	vm.facts["ac_status"] = false
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["ac_status"])
+	assert.NotContains(t, vm.facts, "fan_status", "Dependent rule should not be re-evaluated without chaining")
+}
+
+func TestChaining_ReevaluatesDependentRules(t *testing.T) {
+	vm := NewVM(chainedProgram())
+	vm.SetMaxChainDepth(5)
+	vm.facts["temperature"] = 35
+	vm.facts["ac_status"] = false
+
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) {
+		evaluated = append(evaluated, rule)
+	})
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["fan_status"])
+	assert.Equal(t, []int{0, 1, 0}, evaluated)
+}
+
+func TestChaining_LaterReadersRunOnce(t *testing.T) {
+	// The alert rule runs after the rule producing the fact it reads, so it
+	// sees the change in the same pass and isn't chained
+	code := newProgram().
+		ruleStart(20).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadBool(true).updateFact("overheating").
+		label("rule0_end").op(bytecode.RULE_END).
+		ruleStart(10).
+		loadFact("overheating").loadBool(true).op(bytecode.EQ_BOOL).
+		jump(bytecode.JUMP_IF_FALSE, "rule1_end").
+		loadString("too hot").triggerAction("actionsTest", "ops").
+		label("rule1_end").op(bytecode.RULE_END).
+		bytes()
+	triggeredActions = nil
+	vm := NewVM(code)
+	vm.SetMaxChainDepth(3)
+	vm.facts["temperature"] = 35
+	vm.facts["overheating"] = false
+
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) { evaluated = append(evaluated, rule) })
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []int{0, 1}, evaluated)
+	assert.Len(t, triggeredActions, 1)
+}
+
+func TestChaining_UnchangedFactsDoNotChain(t *testing.T) {
+	vm := NewVM(chainedProgram())
+	vm.SetMaxChainDepth(5)
+	vm.facts["temperature"] = 35
+	vm.facts["ac_status"] = true
+	vm.facts["fan_status"] = false
+
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) {
+		evaluated = append(evaluated, rule)
+	})
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []int{0, 1}, evaluated)
+}
+
+func TestChaining_MaxDepthExceeded(t *testing.T) {
+	// A rule that toggles the fact it consumes chains forever
+	code := newProgram().
+		ruleStart(0).
+		loadFact("toggle").op(bytecode.NOT).updateFact("toggle").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+	vm.SetMaxChainDepth(3)
+	vm.facts["toggle"] = false
+
+	err := vm.Run()
+	require.Error(t, err)
+
+	var chainErr *ChainDepthError
+	require.True(t, errors.As(err, &chainErr), "Expected a ChainDepthError, got %v", err)
+	assert.Equal(t, 3, chainErr.MaxDepth)
+	assert.Equal(t, []string{
+		"rule 0", "toggle", "rule 0", "toggle", "rule 0", "toggle", "rule 0", "toggle", "rule 0",
+	}, chainErr.Path)
+	assert.Contains(t, err.Error(), "rule 0 -> toggle -> rule 0")
+
+	// The failed cycle must not leak partial writes
+	assert.Equal(t, false, vm.facts["toggle"])
+
+	// The path names the rules, if the bytecode does
+	section, err := bytecode.NewRulesSection([]bytecode.RuleSymbol{{Name: "flip"}})
+	require.NoError(t, err)
+	vm = NewVM(bytecode.AppendSections(code, section))
+	vm.SetMaxChainDepth(1)
+	vm.facts["toggle"] = false
+	require.ErrorAs(t, vm.Run(), &chainErr)
+	assert.Equal(t, []string{"flip", "toggle", "flip", "toggle", "flip"}, chainErr.Path)
+}
+
+func TestChaining_MaxIterationsExceeded(t *testing.T) {
+	// Two rules toggling a fact they both consume chain in two branches
+	code := newProgram().
+		ruleStart(0).
+		loadFact("toggle").op(bytecode.NOT).updateFact("toggle").
+		op(bytecode.RULE_END).
+		ruleStart(0).
+		loadFact("toggle").op(bytecode.NOT).updateFact("toggle").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+	vm.SetMaxChainDepth(100)
+	vm.SetMaxChainIterations(5)
+	vm.facts["toggle"] = false
+
+	var evaluated int
+	vm.OnAfterRule(func(rule int, fired bool) { evaluated++ })
+
+	err := vm.Run()
+	var iterationsErr *ChainIterationsError
+	require.True(t, errors.As(err, &iterationsErr), "Expected a ChainIterationsError, got %v", err)
+	assert.Equal(t, 5, iterationsErr.MaxIterations)
+	assert.EqualError(t, err, "rule chain exceeded max 5 re-evaluations per cycle at rule 0")
+	assert.Equal(t, 2+5, evaluated)
+	assert.Equal(t, false, vm.facts["toggle"])
+
+	// Without a limit on iterations, only the depth limit ends the chains,
+	// after a number of re-evaluations growing exponentially with it
+	vm.SetMaxChainDepth(3)
+	vm.SetMaxChainIterations(0)
+	var depthErr *ChainDepthError
+	assert.ErrorAs(t, vm.Run(), &depthErr)
+}
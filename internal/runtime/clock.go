@@ -0,0 +1,118 @@
+// runtime/clock.go
+
+package runtime
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the VM's temporal features: action
+// timeouts, circuit breaker cooldowns, retry backoffs and the timestamps of
+// audit records. Tests inject a TestClock to control time deterministically.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel receiving the current time once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock reading the system time.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+func (SystemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock sets the clock used by the VM and its ActionGuard.
+func (vm *VM) SetClock(clock Clock) {
+	vm.clock = clock
+	vm.actions.SetClock(clock)
+}
+
+// Clock returns the clock used by the VM, so that hooks can timestamp what
+// they record with the same time source.
+func (vm *VM) Clock() Clock {
+	return vm.clock
+}
+
+// TestClock is a Clock that only moves when told to. It is safe for
+// concurrent use.
+type TestClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+// clockWaiter is a pending After call of a TestClock.
+type clockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewTestClock creates a TestClock set to now.
+func NewTestClock(now time.Time) *TestClock {
+	return &TestClock{now: now}
+}
+
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the clock's time once it has been
+// advanced by at least d.
+func (c *TestClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, clockWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the After channels that are
+// due, earliest first.
+func (c *TestClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(c.now.Add(d))
+}
+
+// Set moves the clock to now, firing the After channels that are due.
+func (c *TestClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(now)
+}
+
+// Waiters returns the number of After channels that haven't fired yet, so
+// tests can wait for a goroutine to start waiting before advancing the clock.
+func (c *TestClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// set moves the clock. The caller must hold c.mu.
+func (c *TestClock) set(now time.Time) {
+	c.now = now
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		return c.waiters[i].at.Before(c.waiters[j].at)
+	})
+
+	pending := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		waiter.ch <- now
+	}
+	c.waiters = pending
+}
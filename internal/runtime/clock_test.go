@@ -0,0 +1,106 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestClock_After(t *testing.T) {
+	start := time.Unix(100, 0)
+	clock := NewTestClock(start)
+
+	late := clock.After(2 * time.Second)
+	early := clock.After(time.Second)
+	assert.Equal(t, 2, clock.Waiters())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-early)
+	select {
+	case <-late:
+		t.Fatal("fired before its time")
+	default:
+	}
+
+	clock.Set(start.Add(time.Minute))
+	assert.Equal(t, start.Add(time.Minute), <-late)
+	assert.Zero(t, clock.Waiters())
+
+	assert.Equal(t, start.Add(time.Minute), <-clock.After(0))
+}
+
+func TestActionGuard_TimeoutFollowsClock(t *testing.T) {
+	clock := NewTestClock(time.Unix(0, 0))
+	guard := NewActionGuard(ActionPolicy{Timeout: time.Second})
+	guard.SetClock(clock)
+
+	cancelled := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- guard.Invoke(0, "webhook", func(ctx context.Context) error {
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		})
+	}()
+
+	require.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case err := <-result:
+		t.Fatalf("timed out early: %v", err)
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	assert.ErrorIs(t, <-result, ErrActionTimeout)
+	<-cancelled
+}
+
+func TestActionPipeline_BackoffFollowsClock(t *testing.T) {
+	clock := NewTestClock(time.Unix(0, 0))
+	guard := NewActionGuard(ActionPolicy{})
+	guard.SetClock(clock)
+
+	attempts := make(chan struct{}, 3)
+	pipeline, err := NewActionPipeline(PipelineConfig{Workers: 1, MaxRetries: 2, RetryBackoff: time.Minute}, guard,
+		func(ctx context.Context, action Action) error {
+			attempts <- struct{}{}
+			return errors.New("unavailable")
+		})
+	require.NoError(t, err)
+	require.NoError(t, pipeline.Submit(Action{Type: "webhook", Target: "ops"}))
+
+	<-attempts
+	require.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	<-attempts
+
+	// The second retry waits twice as long
+	require.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	assert.Equal(t, 1, clock.Waiters())
+	clock.Advance(time.Minute)
+	<-attempts
+
+	require.NoError(t, pipeline.Close())
+	assert.Equal(t, 1, pipeline.Stats().DeadLettered)
+}
+
+func TestVM_SetClock(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	assert.Equal(t, SystemClock{}, vm.Clock())
+
+	clock := NewTestClock(time.Unix(0, 0))
+	vm.SetClock(clock)
+	assert.Same(t, clock, vm.Clock())
+	assert.Same(t, clock, vm.ActionGuard().Clock())
+
+	// A new action policy keeps the VM's clock
+	vm.SetActionPolicy(ActionPolicy{Timeout: time.Second})
+	assert.Same(t, clock, vm.ActionGuard().Clock())
+}
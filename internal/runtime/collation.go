@@ -0,0 +1,120 @@
+// runtime/collation.go
+
+package runtime
+
+import (
+	"fmt"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// Collation configures how the VM compares strings. By default strings are
+// equal only if they are the same bytes; with a locale they are compared with
+// the Unicode collation rules of that locale, so that for instance the
+// composed and decomposed forms of "é" are equal, and the strength decides
+// which other differences are ignored.
+type Collation struct {
+	Locale   string            // BCP 47 tag, e.g. "fr" or "de-CH", or "und" for the root collation; empty compares bytes
+	Strength CollationStrength // Differences between strings that make them unequal
+}
+
+// CollationStrength is the level of differences that a collation takes into
+// account, as in the Unicode Collation Algorithm.
+type CollationStrength int
+
+const (
+	// StrengthTertiary distinguishes letters, diacritics, case and width.
+	StrengthTertiary CollationStrength = iota
+	// StrengthSecondary ignores case and width: "OPEN" equals "open" and
+	// the full-width "１２" equals "12".
+	StrengthSecondary
+	// StrengthPrimary also ignores diacritics: "Équal" equals "equal".
+	StrengthPrimary
+)
+
+var strengthNames = map[CollationStrength]string{
+	StrengthTertiary:  "tertiary",
+	StrengthSecondary: "secondary",
+	StrengthPrimary:   "primary",
+}
+
+func (s CollationStrength) String() string {
+	if name, ok := strengthNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("CollationStrength(%d)", int(s))
+}
+
+// ParseCollationStrength returns the strength with the given name: primary,
+// secondary or tertiary.
+func ParseCollationStrength(name string) (CollationStrength, error) {
+	for strength, strengthName := range strengthNames {
+		if name == strengthName {
+			return strength, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown collation strength %q, expected primary, secondary or tertiary", name)
+}
+
+// Validate checks that the locale is a well-formed language tag and the
+// strength is known.
+func (c Collation) Validate() error {
+	_, err := c.newCollator()
+	return err
+}
+
+// newCollator returns the collator comparing strings as configured, nil if
+// strings are compared byte by byte.
+func (c Collation) newCollator() (*collate.Collator, error) {
+	if _, ok := strengthNames[c.Strength]; !ok {
+		return nil, fmt.Errorf("invalid collation strength %d", int(c.Strength))
+	}
+	if c.Locale == "" {
+		if c.Strength != StrengthTertiary {
+			return nil, fmt.Errorf("collation strength %s needs a locale", c.Strength)
+		}
+		return nil, nil
+	}
+	tag, err := language.Parse(c.Locale)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collation locale %q: %w", c.Locale, err)
+	}
+
+	// The collator ignores a level of differences together with all the
+	// levels after it
+	var options []collate.Option
+	switch c.Strength {
+	case StrengthSecondary:
+		options = append(options, collate.IgnoreCase, collate.IgnoreWidth)
+	case StrengthPrimary:
+		options = append(options, collate.Loose)
+	}
+	return collate.New(tag, options...), nil
+}
+
+// SetCollation sets how EQ_STRING and NEQ_STRING compare strings; CONTAINS_STRING
+// and NOT_CONTAINS_STRING always look for the bytes of the substring. The zero
+// Collation restores byte by byte comparison.
+func (vm *VM) SetCollation(c Collation) error {
+	collator, err := c.newCollator()
+	if err != nil {
+		return err
+	}
+	vm.collation = c
+	vm.collator = collator
+	return nil
+}
+
+// Collation returns how the VM compares strings.
+func (vm *VM) Collation() Collation {
+	return vm.collation
+}
+
+// equalStrings compares two strings with the VM's collation.
+func (vm *VM) equalStrings(a, b string) bool {
+	if vm.collator == nil {
+		return a == b
+	}
+	return vm.collator.CompareString(a, b) == 0
+}
@@ -0,0 +1,80 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringComparison_Collation(t *testing.T) {
+	compare := func(opcode bytecode.Opcode, value string) []byte {
+		return newProgram().loadFact("status").loadString(value).op(opcode).bytes()
+	}
+
+	testCases := []struct {
+		name      string
+		collation Collation
+		fact      string
+		code      []byte
+		expected  bool
+	}{
+		{"Bytes by default", Collation{}, "\u00e9quipe", compare(bytecode.EQ_STRING, "e\u0301quipe"), false},
+		{"Composed and decomposed forms", Collation{Locale: "fr"}, "\u00e9quipe", compare(bytecode.EQ_STRING, "e\u0301quipe"), true},
+		{"Case matters", Collation{Locale: "und"}, "OPEN", compare(bytecode.EQ_STRING, "open"), false},
+		{"Case ignored", Collation{Locale: "und", Strength: StrengthSecondary}, "OPEN", compare(bytecode.EQ_STRING, "open"), true},
+		{"Width ignored", Collation{Locale: "ja", Strength: StrengthSecondary}, "ｌｉｎｅ１２", compare(bytecode.EQ_STRING, "line12"), true},
+		{"Diacritics matter", Collation{Locale: "fr", Strength: StrengthSecondary}, "équal", compare(bytecode.EQ_STRING, "equal"), false},
+		{"Diacritics ignored", Collation{Locale: "fr", Strength: StrengthPrimary}, "Équal", compare(bytecode.EQ_STRING, "equal"), true},
+		{"Letters matter", Collation{Locale: "fr", Strength: StrengthPrimary}, "equal", compare(bytecode.EQ_STRING, "equals"), false},
+		{"Not equal", Collation{Locale: "und", Strength: StrengthSecondary}, "OPEN", compare(bytecode.NEQ_STRING, "closed"), true},
+		{"Not equal ignoring case", Collation{Locale: "und", Strength: StrengthSecondary}, "OPEN", compare(bytecode.NEQ_STRING, "open"), false},
+		{"Contains", Collation{}, "line12 fault", compare(bytecode.CONTAINS_STRING, "fault"), true},
+		{"Contains bytes whatever the collation", Collation{Locale: "und", Strength: StrengthSecondary}, "LINE12 FAULT", compare(bytecode.CONTAINS_STRING, "fault"), false},
+		{"Not contains", Collation{}, "line12 ok", compare(bytecode.NOT_CONTAINS_STRING, "fault"), true},
+		{"Not contains substring", Collation{}, "line12 fault", compare(bytecode.NOT_CONTAINS_STRING, "12"), false},
+		{"In", Collation{}, "LA", newProgram().loadFact("status").inStrings(bytecode.IN_LIST, "NYC", "LA", "SF").bytes(), true},
+		{"In ignoring case", Collation{Locale: "und", Strength: StrengthSecondary}, "la", newProgram().loadFact("status").inStrings(bytecode.IN_LIST, "NYC", "LA").bytes(), true},
+		{"Not in", Collation{}, "la", newProgram().loadFact("status").inStrings(bytecode.NOT_IN_LIST, "NYC", "LA").bytes(), true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := NewVM(tc.code)
+			require.NoError(t, vm.SetCollation(tc.collation))
+			vm.facts["status"] = tc.fact
+			require.NoError(t, vm.Run())
+			require.Len(t, vm.stack, 1)
+			assert.Equal(t, tc.expected, vm.stack[0])
+		})
+	}
+}
+
+func TestVM_SetCollation(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	assert.Equal(t, Collation{}, vm.Collation())
+
+	collation := Collation{Locale: "de-CH", Strength: StrengthPrimary}
+	require.NoError(t, vm.SetCollation(collation))
+	assert.Equal(t, collation, vm.Collation())
+
+	// An invalid collation leaves the current one in place
+	assert.ErrorContains(t, vm.SetCollation(Collation{Locale: "not a locale"}), "invalid collation locale")
+	assert.ErrorContains(t, vm.SetCollation(Collation{Strength: StrengthSecondary}), "needs a locale")
+	assert.Equal(t, collation, vm.Collation())
+
+	require.NoError(t, vm.SetCollation(Collation{}))
+	assert.Equal(t, Collation{}, vm.Collation())
+}
+
+func TestParseCollationStrength(t *testing.T) {
+	for _, strength := range []CollationStrength{StrengthPrimary, StrengthSecondary, StrengthTertiary} {
+		parsed, err := ParseCollationStrength(strength.String())
+		require.NoError(t, err)
+		assert.Equal(t, strength, parsed)
+	}
+
+	_, err := ParseCollationStrength("quaternary")
+	assert.ErrorContains(t, err, "unknown collation strength")
+}
@@ -0,0 +1,129 @@
+// runtime/compare.go
+
+package runtime
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+)
+
+// Compare evaluates a condition operator on a fact value and the value given
+// in the rule, with the semantics of the VM's comparison instructions. It
+// lets tools evaluate rules without compiling them.
+func Compare(operator string, fact, value interface{}) (bool, error) {
+	if fn, ok := lookupOperator(operator); ok {
+		return fn(fact, value)
+	}
+
+	switch operator {
+	case "equal", "notEqual":
+		equal := operator == "equal"
+		if a, ok := fact.(bool); ok {
+			if b, ok := value.(bool); ok {
+				return (a == b) == equal, nil
+			}
+		}
+		if a, ok := fact.(string); ok {
+			if b, ok := value.(string); ok {
+				return (a == b) == equal, nil
+			}
+		}
+		c, err := compareNumbers(fact, value)
+		return (c == 0) == equal, err
+
+	case "lessThan", "lessThanOrEqual", "greaterThan", "greaterThanOrEqual":
+		c, err := compareNumbers(fact, value)
+		switch operator {
+		case "lessThan":
+			return c < 0, err
+		case "lessThanOrEqual":
+			return c <= 0, err
+		case "greaterThan":
+			return c > 0, err
+		default:
+			return c >= 0, err
+		}
+
+	case "contains", "notContains":
+		a, okA := fact.(string)
+		b, okB := value.(string)
+		if !okA || !okB {
+			return false, fmt.Errorf("cannot compare %T with %T as strings", fact, value)
+		}
+		return strings.Contains(a, b) == (operator == "contains"), nil
+
+	case "in", "notIn":
+		list, ok := value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("operator %s needs a list value, got %T", operator, value)
+		}
+		member, err := memberOf(fact, list, func(a, b string) bool { return a == b })
+		return member == (operator == "in"), err
+
+	default:
+		return false, fmt.Errorf("unknown operator: %s", operator)
+	}
+}
+
+// memberOf reports whether a value equals an element of a list, comparing
+// strings with equalStrings, bools as bools and other values as numbers.
+func memberOf(value interface{}, list []interface{}, equalStrings func(a, b string) bool) (bool, error) {
+	for _, element := range list {
+		switch e := element.(type) {
+		case string:
+			s, ok := value.(string)
+			if !ok {
+				return false, fmt.Errorf("cannot compare %T with a list of strings", value)
+			}
+			if equalStrings(s, e) {
+				return true, nil
+			}
+		case bool:
+			b, ok := value.(bool)
+			if !ok {
+				return false, fmt.Errorf("cannot compare %T with a list of bools", value)
+			}
+			if b == e {
+				return true, nil
+			}
+		default:
+			c, err := compareNumbers(value, element)
+			if err != nil {
+				return false, err
+			}
+			if c == 0 {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// CompareWithin evaluates an equal or notEqual condition on numbers that are
+// equal when they are at most epsilon apart, like the VM does for conditions
+// with a tolerance.
+func CompareWithin(operator string, fact, value interface{}, epsilon float64) (bool, error) {
+	if operator != "equal" && operator != "notEqual" {
+		return false, fmt.Errorf("operator %s doesn't take an epsilon", operator)
+	}
+	a, okA := toFloat64(fact)
+	b, okB := toFloat64(value)
+	if !okA || !okB {
+		return false, fmt.Errorf("cannot compare %T with %T as numbers", fact, value)
+	}
+	return withinEpsilon(a, b, epsilon) == (operator == "equal"), nil
+}
+
+// compareNumbers compares two numbers like numericOp, returning -1, 0 or 1.
+func compareNumbers(a, b interface{}) (int, error) {
+	if c, ok := compareIntegers(a, b); ok {
+		return c, nil
+	}
+	floatA, okA := toFloat64(a)
+	floatB, okB := toFloat64(b)
+	if !okA || !okB {
+		return 0, fmt.Errorf("cannot compare %T with %T as numbers", a, b)
+	}
+	return cmp.Compare(floatA, floatB), nil
+}
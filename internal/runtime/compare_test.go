@@ -0,0 +1,43 @@
+package runtime
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	testCases := []struct {
+		operator string
+		fact     interface{}
+		value    interface{}
+		expected bool
+	}{
+		{"greaterThan", 31, 30, true},
+		{"greaterThan", 30.5, 30, true},
+		{"lessThanOrEqual", uint64(18446744073709551615), int64(-1), false},
+		{"equal", 30, 30.0, true},
+		{"notEqual", "auto", "manual", true},
+		{"equal", true, false, false},
+		{"contains", "heat pump", "pump", true},
+		{"notContains", "heat pump", "fan", true},
+		{"in", "LA", []interface{}{"NYC", "LA", "SF"}, true},
+		{"in", 2, []interface{}{int64(1), 2.0}, true},
+		{"notIn", uint64(3), []interface{}{int64(1), int64(2)}, true},
+		{"notIn", false, []interface{}{false}, false},
+	}
+	for _, tc := range testCases {
+		result, err := Compare(tc.operator, tc.fact, tc.value)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, result, "%v %s %v", tc.fact, tc.operator, tc.value)
+	}
+
+	_, err := Compare("lessThan", "a", "b")
+	assert.Error(t, err)
+	_, err = Compare("matches", 1, 1)
+	assert.EqualError(t, err, "unknown operator: matches")
+	_, err = Compare("in", "LA", "LA")
+	assert.EqualError(t, err, "operator in needs a list value, got string")
+	_, err = Compare("in", 1, []interface{}{"a"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,199 @@
+// runtime/compose.go
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RulesetStats holds the counters of a ruleset in a Composition.
+type RulesetStats struct {
+	Name         string  `json:"name"`
+	Rules        int     `json:"rules"`
+	Cycles       int     `json:"cycles"`
+	CycleErrors  int     `json:"cycleErrors"`
+	Evaluations  int     `json:"evaluations"`
+	Firings      int     `json:"firings"`
+	TotalSeconds float64 `json:"totalSeconds"` // Time spent in the ruleset's cycles
+	LastError    string  `json:"lastError,omitempty"`
+	RulesetHash  string  `json:"rulesetHash,omitempty"` // Revision of the ruleset, if its bytecode names it
+}
+
+// Composition evaluates several rulesets, such as fleet-wide base rules and
+// the rules of a site, against one shared fact store without compiling them
+// into a single bytecode image. Each ruleset has its own VM, with its own
+// hooks and settings. A cycle runs the rulesets one after the other in the
+// order they were added, each in a cycle of its own: a ruleset sees the facts
+// committed by the rulesets before it, and the earlier rulesets see its
+// writes in the next cycle. Forward chaining stays within a ruleset.
+type Composition struct {
+	names []string
+	vms   []*VM
+	facts map[string]interface{}
+
+	correlationID     string // Correlation ID of the current or last cycle
+	nextCorrelationID string // Correlation ID set for the next cycle
+
+	mu    sync.Mutex // Guards stats, which are read concurrently
+	stats []RulesetStats
+}
+
+// NewComposition creates a composition without rulesets.
+func NewComposition() *Composition {
+	return &Composition{facts: make(map[string]interface{})}
+}
+
+// Add loads image as the next ruleset to evaluate and returns its VM, which
+// shares the composition's fact store. Names must be unique.
+func (c *Composition) Add(name string, image []byte) (*VM, error) {
+	if name == "" {
+		return nil, errors.New("ruleset name must not be empty")
+	}
+	if slices.Contains(c.names, name) {
+		return nil, fmt.Errorf("duplicate ruleset %s", name)
+	}
+	vm := NewVM(image)
+	if vm.codeErr != nil {
+		return nil, fmt.Errorf("ruleset %s: %w", name, vm.codeErr)
+	}
+	// The initial facts of the ruleset don't override facts already set
+	for name, value := range vm.facts {
+		if _, exists := c.facts[name]; !exists {
+			c.facts[name] = value
+		}
+	}
+	vm.facts = c.facts
+
+	index := len(c.vms)
+	vm.OnAfterRule(func(rule int, fired bool) {
+		c.count(index, func(stats *RulesetStats) {
+			stats.Evaluations++
+			if fired {
+				stats.Firings++
+			}
+		})
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = append(c.names, name)
+	c.vms = append(c.vms, vm)
+	stats := RulesetStats{Name: name, Rules: len(vm.schedule)}
+	if provenance, ok := vm.Provenance(); ok {
+		stats.RulesetHash = provenance.RulesetHash
+	}
+	c.stats = append(c.stats, stats)
+	return vm, nil
+}
+
+// Rulesets returns the names of the rulesets in evaluation order.
+func (c *Composition) Rulesets() []string {
+	return slices.Clone(c.names)
+}
+
+// VM returns the VM of a ruleset, or nil if there is no such ruleset.
+func (c *Composition) VM(name string) *VM {
+	if i := slices.Index(c.names, name); i >= 0 {
+		return c.vms[i]
+	}
+	return nil
+}
+
+// SetFact sets a fact in the shared fact store. It must not be called while a
+// cycle is running.
+func (c *Composition) SetFact(name string, value interface{}) {
+	c.facts[name] = value
+}
+
+// IngestFact sets a fact received from outside the rules in the shared fact
+// store, once the VM of every ruleset has checked it against its fact schema
+// as its schema mode says, coercing it in turn. It must not be called while a
+// cycle is running.
+func (c *Composition) IngestFact(name string, value interface{}) error {
+	for i, vm := range c.vms {
+		var err error
+		if value, err = vm.checkFact(name, value); err != nil {
+			return fmt.Errorf("ruleset %s: %w", c.names[i], err)
+		}
+	}
+	c.facts[name] = value
+	return nil
+}
+
+// DeleteFact removes a fact from the shared fact store. It must not be called
+// while a cycle is running.
+func (c *Composition) DeleteFact(name string) {
+	delete(c.facts, name)
+}
+
+// Facts returns a copy of the shared fact store.
+func (c *Composition) Facts() map[string]interface{} {
+	facts := make(map[string]interface{}, len(c.facts))
+	for name, value := range c.facts {
+		facts[name] = value
+	}
+	return facts
+}
+
+// SetCorrelationID sets the correlation ID of the next cycle, which the cycles
+// of all rulesets share. Without one, Run generates a random ID.
+func (c *Composition) SetCorrelationID(id string) {
+	c.nextCorrelationID = id
+}
+
+// CorrelationID returns the correlation ID of the cycle running, or of the
+// last cycle run.
+func (c *Composition) CorrelationID() string {
+	return c.correlationID
+}
+
+// Run runs a cycle of every ruleset in order. A failing ruleset doesn't keep
+// the others from being evaluated; its writes are discarded, and the errors
+// of all failed rulesets are returned together.
+func (c *Composition) Run() error {
+	c.correlationID = c.nextCorrelationID
+	if c.correlationID == "" {
+		c.correlationID = NewCorrelationID()
+	}
+	c.nextCorrelationID = ""
+
+	var errs []error
+	for i, vm := range c.vms {
+		vm.SetCorrelationID(c.correlationID)
+		start := time.Now()
+		err := vm.Run()
+		elapsed := time.Since(start).Seconds()
+
+		c.count(i, func(stats *RulesetStats) {
+			stats.Cycles++
+			stats.TotalSeconds += elapsed
+			if err != nil {
+				stats.CycleErrors++
+				stats.LastError = err.Error()
+			}
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ruleset %s: %w", c.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the counters of every ruleset in evaluation order. It can be
+// called concurrently with Run.
+func (c *Composition) Stats() []RulesetStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.stats)
+}
+
+// count updates the counters of a ruleset.
+func (c *Composition) count(index int, update func(stats *RulesetStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update(&c.stats[index])
+}
@@ -0,0 +1,141 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// composedRulesets returns a base ruleset setting fired when it's hot and a
+// site ruleset opening the window once fired is set.
+func composedRulesets(t *testing.T) (base, site []byte) {
+	base = compileForVM(t, []*rules.Rule{{
+		Name:       "Hot",
+		Conditions: rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: rules.OperatorGreaterThan, Value: 30, ValueType: "int"}}},
+		Event:      rules.Event{Actions: []rules.Action{{Type: rules.ActionUpdateFact, Target: "fired", Value: true}}},
+	}}, bytecode.ConditionModeJump)
+	site = compileForVM(t, []*rules.Rule{{
+		Name:       "Vent",
+		Conditions: rules.Conditions{All: []rules.Condition{{Fact: "fired", Operator: rules.OperatorEqual, Value: true, ValueType: "bool"}}},
+		Event:      rules.Event{Actions: []rules.Action{{Type: rules.ActionUpdateFact, Target: "window_open", Value: true}}},
+	}}, bytecode.ConditionModeJump)
+	return base, site
+}
+
+func TestComposition_Run(t *testing.T) {
+	base, site := composedRulesets(t)
+	c := NewComposition()
+	_, err := c.Add("base", base)
+	require.NoError(t, err)
+	siteVM, err := c.Add("site", site)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"base", "site"}, c.Rulesets())
+	assert.Same(t, siteVM, c.VM("site"))
+	assert.Nil(t, c.VM("other"))
+
+	// The site ruleset sees what the base ruleset wrote in the same cycle
+	c.SetFact("temperature", 35)
+	c.SetFact("fired", false)
+	c.SetCorrelationID("reading-7")
+	require.NoError(t, c.Run())
+	assert.Equal(t, map[string]interface{}{"temperature": 35, "fired": true, "window_open": true}, c.Facts())
+	assert.Equal(t, c.Facts(), siteVM.Facts())
+	assert.Equal(t, "reading-7", c.VM("base").CorrelationID())
+	assert.Equal(t, "reading-7", siteVM.CorrelationID())
+	assert.Equal(t, "reading-7", c.CorrelationID())
+
+	stats := c.Stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "base", stats[0].Name)
+	assert.Equal(t, 1, stats[0].Rules)
+	assert.Equal(t, 1, stats[0].Cycles)
+	assert.Equal(t, 1, stats[0].Evaluations)
+	assert.Equal(t, 1, stats[0].Firings)
+	assert.Equal(t, 1, stats[1].Firings)
+}
+
+func TestComposition_Order(t *testing.T) {
+	base, site := composedRulesets(t)
+	c := NewComposition()
+	_, err := c.Add("site", site)
+	require.NoError(t, err)
+	_, err = c.Add("base", base)
+	require.NoError(t, err)
+
+	// Evaluated first, the site ruleset only sees the base ruleset's write in
+	// the next cycle
+	c.SetFact("temperature", 35)
+	c.SetFact("fired", false)
+	require.NoError(t, c.Run())
+	assert.NotContains(t, c.Facts(), "window_open")
+	assert.Equal(t, c.VM("site").CorrelationID(), c.VM("base").CorrelationID(), "the rulesets share the generated ID")
+	require.NoError(t, c.Run())
+	assert.Equal(t, true, c.Facts()["window_open"])
+}
+
+func TestComposition_Errors(t *testing.T) {
+	base, site := composedRulesets(t)
+	c := NewComposition()
+	_, err := c.Add("base", base)
+	require.NoError(t, err)
+	_, err = c.Add("base", site)
+	assert.ErrorContains(t, err, "duplicate ruleset base")
+	_, err = c.Add("", site)
+	assert.ErrorContains(t, err, "must not be empty")
+	_, err = c.Add("broken", []byte{byte(bytecode.RULE_START)})
+	assert.ErrorContains(t, err, "ruleset broken")
+
+	// A failing ruleset doesn't stop the ones after it
+	_, err = c.Add("site", site)
+	require.NoError(t, err)
+	c.SetFact("fired", true)
+	err = c.Run()
+	assert.ErrorContains(t, err, "ruleset base: undefined fact: temperature")
+	assert.Equal(t, true, c.Facts()["window_open"])
+	stats := c.Stats()
+	assert.Equal(t, 1, stats[0].CycleErrors)
+	assert.Equal(t, "undefined fact: temperature", stats[0].LastError)
+	assert.Equal(t, 0, stats[1].CycleErrors)
+}
+
+func TestComposition_IngestFact(t *testing.T) {
+	base, site := composedRulesets(t)
+	schema := func(valueType string) bytecode.Section {
+		section, err := bytecode.NewSchemaSection(bytecode.FactSchema{"temperature": valueType})
+		require.NoError(t, err)
+		return section
+	}
+	c := NewComposition()
+	baseVM, err := c.Add("base", bytecode.AppendSections(base, schema("int")))
+	require.NoError(t, err)
+	siteVM, err := c.Add("site", bytecode.AppendSections(site, schema("string")))
+	require.NoError(t, err)
+	require.NoError(t, baseVM.SetSchemaMode(SchemaCoerce))
+
+	// Each ruleset checks the value in turn
+	require.NoError(t, c.IngestFact("temperature", "31"))
+	assert.Equal(t, 31, c.Facts()["temperature"])
+	require.NoError(t, siteVM.SetSchemaMode(SchemaReject))
+	assert.ErrorContains(t, c.IngestFact("temperature", "32"), "ruleset site: fact value doesn't match the schema")
+	assert.Equal(t, 31, c.Facts()["temperature"])
+}
+
+func TestComposition_InitialFacts(t *testing.T) {
+	base, site := composedRulesets(t)
+	initial := func(state string) bytecode.Section {
+		section, err := bytecode.NewInitialFactsSection(map[string]interface{}{"door.state": state})
+		require.NoError(t, err)
+		return section
+	}
+	c := NewComposition()
+	_, err := c.Add("base", bytecode.AppendSections(base, initial("closed")))
+	require.NoError(t, err)
+	_, err = c.Add("site", bytecode.AppendSections(site, initial("open")))
+	require.NoError(t, err)
+
+	// A ruleset added later doesn't override the facts already set
+	assert.Equal(t, "closed", c.Facts()["door.state"])
+}
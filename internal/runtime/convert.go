@@ -0,0 +1,160 @@
+// runtime/convert.go
+
+package runtime
+
+import (
+	"encoding/binary"
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"slices"
+	"unsafe"
+)
+
+// jumpOperandSize is the size of the jump targets ConvertCompiled writes: a
+// varint padded to a fixed size, so targets can be patched once known.
+const jumpOperandSize = 3
+
+// ConvertCompiled converts code in the encoding of the preprocessor's
+// compiler to the one the VM executes: the header is added, integer constants
+// and jump targets become varints, string constants are NUL-terminated rather
+// than length-prefixed, and UPDATE_FACT follows the value it stores instead
+// of preceding it. The other instructions are encoded alike. Facts keep their
+// indices, so the sections appended to the result must include the fact table
+// the code was compiled with.
+func ConvertCompiled(code []byte) ([]byte, error) {
+	converted, _, err := convertCode(code)
+	return converted, err
+}
+
+// ConvertCompiledImage converts the code of a bytecode image as the
+// preprocessor writes it, with ConvertCompiled, and keeps its sections,
+// relocating the rule directory to the converted code and dropping the
+// section marking the code as compiled. NewVM converts the images marked so
+// itself.
+func ConvertCompiledImage(image []byte) ([]byte, error) {
+	code, sections, err := bytecode.SplitSections(image)
+	if err != nil {
+		return nil, err
+	}
+	sections = slices.DeleteFunc(slices.Clone(sections), func(section bytecode.Section) bool {
+		return section.ID == bytecode.SectionCompiledCode
+	})
+	converted, offsets, err := convertCode(code)
+	if err != nil {
+		return nil, err
+	}
+	directory, ok, err := bytecode.ReadRuleDirectory(sections)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if directory, err = directory.Relocate(offsets); err != nil {
+			return nil, fmt.Errorf("rule directory: %w", err)
+		}
+		section, err := bytecode.NewRuleDirectorySection(directory)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sections {
+			if sections[i].ID == bytecode.SectionRuleDirectory {
+				sections[i] = section
+			}
+		}
+	}
+	return bytecode.AppendSections(converted, sections...), nil
+}
+
+// convertCode converts code as ConvertCompiled does and also returns where
+// each instruction of code starts in the converted code, and where the
+// converted code ends by the length of code.
+func convertCode(code []byte) ([]byte, map[int]int, error) {
+	converted := make([]byte, unsafe.Sizeof(Header{}))
+	offsets := make(map[int]int, len(code)/2) // Offset in converted of each instruction of code
+	fixups := make(map[int]int)               // Jump target in code, by operand offset in converted
+	pendingUpdate := -1
+
+	for ip := 0; ip < len(code); {
+		offsets[ip] = len(converted)
+		opcode := bytecode.Opcode(code[ip])
+		operands := code[ip+1:]
+		truncated := &VMError{Message: fmt.Sprintf("truncated %s instruction", opcode), IP: ip}
+		size := 1
+
+		switch opcode {
+		case bytecode.UPDATE_FACT:
+			if len(operands) < 1 {
+				return nil, nil, truncated
+			}
+			pendingUpdate = int(operands[0])
+			ip += 2
+			continue
+		case bytecode.LOAD_FACT, bytecode.FACT_EXISTS, bytecode.STORE_FACT:
+			if len(operands) < 1 {
+				return nil, nil, truncated
+			}
+			converted = append(converted, byte(opcode), operands[0])
+			size++
+		case bytecode.LOAD_CONST_INT:
+			if len(operands) < 4 {
+				return nil, nil, truncated
+			}
+			converted = append(converted, byte(opcode))
+			converted = binary.AppendVarint(converted, int64(int32(binary.LittleEndian.Uint32(operands))))
+			size += 4
+		case bytecode.LOAD_CONST_STRING:
+			if len(operands) < 1 || len(operands) < 1+int(operands[0]) {
+				return nil, nil, truncated
+			}
+			converted = append(converted, byte(opcode))
+			converted = append(append(converted, operands[1:1+operands[0]]...), 0)
+			size += 1 + int(operands[0])
+		case bytecode.JUMP, bytecode.JUMP_IF_TRUE, bytecode.JUMP_IF_FALSE:
+			if len(operands) < 2 {
+				return nil, nil, truncated
+			}
+			converted = append(converted, byte(opcode))
+			fixups[len(converted)] = ip + 2 + int(binary.LittleEndian.Uint16(operands))
+			converted = append(converted, make([]byte, jumpOperandSize)...)
+			size += 2
+		default:
+			n, err := instructionLength(code, ip, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ip+n > len(code) {
+				return nil, nil, truncated
+			}
+			converted = append(converted, code[ip:ip+n]...)
+			size = n
+		}
+
+		// The value of an update is the instruction that follows it
+		if pendingUpdate >= 0 {
+			converted = append(converted, byte(bytecode.UPDATE_FACT), byte(pendingUpdate))
+			pendingUpdate = -1
+		}
+		ip += size
+	}
+	if pendingUpdate >= 0 {
+		return nil, nil, &VMError{Message: "UPDATE_FACT without a value", IP: len(code)}
+	}
+	offsets[len(code)] = len(converted)
+
+	for pos, target := range fixups {
+		offset, ok := offsets[target]
+		if !ok {
+			return nil, nil, &VMError{Message: fmt.Sprintf("jump to offset %d, where no instruction starts", target), IP: pos}
+		}
+		// Zig-zag encode the target, then spread it over the operand's bytes
+		value := uint64(offset) << 1
+		if value>>(7*jumpOperandSize) != 0 {
+			return nil, nil, &VMError{Message: fmt.Sprintf("jump target %d is out of range", offset), IP: pos}
+		}
+		for i := 0; i < jumpOperandSize-1; i++ {
+			converted[pos+i] = byte(value&0x7f) | 0x80
+			value >>= 7
+		}
+		converted[pos+jumpOperandSize-1] = byte(value)
+	}
+	return converted, offsets, nil
+}
@@ -0,0 +1,75 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertCompiled(t *testing.T) {
+	// UPDATE_FACT fan_status (index 1), "on"; JUMP to the HALT after it
+	code := []byte{
+		byte(bytecode.UPDATE_FACT), 1,
+		byte(bytecode.LOAD_CONST_STRING), 2, 'o', 'n',
+		byte(bytecode.JUMP), 1, 0,
+		byte(bytecode.HALT),
+	}
+	converted, err := ConvertCompiled(code)
+	require.NoError(t, err)
+
+	want := newProgram().
+		loadString("on").op(bytecode.UPDATE_FACT).bytes()
+	want = append(want, 1, byte(bytecode.JUMP))
+	halt := len(want) + jumpOperandSize
+	want = append(want, byte(halt<<1&0x7f)|0x80, byte(halt<<1>>7)|0x80, 0, byte(bytecode.HALT))
+	assert.Equal(t, want, converted)
+
+	for name, code := range map[string][]byte{
+		"truncated string":     {byte(bytecode.LOAD_CONST_STRING), 5, 'o'},
+		"update without value": {byte(bytecode.UPDATE_FACT), 1},
+		"jump into operands":   {byte(bytecode.JUMP), 2, 0, byte(bytecode.LOAD_CONST_BOOL), 1},
+	} {
+		_, err := ConvertCompiled(code)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestNewVM_ConvertsCompiledImage(t *testing.T) {
+	context := rules.NewRuleEngineContext()
+	context.FactIndex["temperature"] = 0
+	context.FactIndex["fan_status"] = 1
+	compiler := bytecode.NewCompiler(context)
+	code, err := compiler.Compile([]*rules.Rule{{
+		Name:       "fan",
+		Conditions: rules.Conditions{All: []rules.Condition{{Fact: "temperature", Operator: "greaterThan", Value: 30}}},
+		Event:      rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fan_status", Value: "on"}}},
+	}})
+	require.NoError(t, err)
+	facts, err := bytecode.NewFactTableSection(bytecode.NewFactTable(context.FactIndex))
+	require.NoError(t, err)
+	directory, err := bytecode.NewRuleDirectorySection(compiler.RuleDirectory())
+	require.NoError(t, err)
+
+	// The image as the preprocessor writes it runs as is
+	vm := NewVM(bytecode.AppendSections(code, bytecode.NewCompiledCodeSection(), facts, directory))
+	require.NoError(t, vm.DecodeError())
+	vm.SetFact("temperature", 35)
+	require.NoError(t, vm.Run())
+	status, _ := vm.GetFact("fan_status")
+	assert.Equal(t, "on", status)
+
+	// Converting it again would fail, so the converted image isn't marked
+	image, err := ConvertCompiledImage(bytecode.AppendSections(code, bytecode.NewCompiledCodeSection(), facts, directory))
+	require.NoError(t, err)
+	_, sections, err := bytecode.SplitSections(image)
+	require.NoError(t, err)
+	assert.False(t, bytecode.IsCompiledCode(sections))
+	assert.NoError(t, NewVM(image).DecodeError())
+
+	vm = NewVM(bytecode.AppendSections([]byte{byte(bytecode.UPDATE_FACT), 1}, bytecode.NewCompiledCodeSection()))
+	assert.ErrorContains(t, vm.DecodeError(), "failed to convert compiled bytecode")
+	assert.Error(t, vm.Run())
+}
@@ -0,0 +1,41 @@
+// runtime/correlation.go
+
+package runtime
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/rs/zerolog/log"
+)
+
+// NewCorrelationID returns a random identifier for an evaluation cycle.
+func NewCorrelationID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// SetCorrelationID sets the correlation ID of the next cycle, typically one
+// carried by the fact update that triggers it, so that downstream systems can
+// tie the cycle's actions back to it. Without one, Run generates a random ID.
+func (vm *VM) SetCorrelationID(id string) {
+	vm.nextCorrelationID = id
+}
+
+// CorrelationID returns the correlation ID of the cycle running, or of the
+// last cycle run. Hooks use it to label what they record.
+func (vm *VM) CorrelationID() string {
+	return vm.correlationID
+}
+
+// beginCorrelation assigns the correlation ID of the cycle about to run and
+// labels the VM's log lines with it.
+func (vm *VM) beginCorrelation() {
+	vm.correlationID = vm.nextCorrelationID
+	if vm.correlationID == "" {
+		vm.correlationID = NewCorrelationID()
+	}
+	vm.nextCorrelationID = ""
+	vm.logger = log.With().Str("CorrelationID", vm.correlationID).Logger()
+}
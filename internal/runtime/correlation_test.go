@@ -0,0 +1,54 @@
+package runtime
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_CorrelationID(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	vm.SetFact("temperature", 35)
+	assert.Empty(t, vm.CorrelationID())
+
+	// Without an ID set, every cycle gets a new one
+	require.NoError(t, vm.Run())
+	first := vm.CorrelationID()
+	assert.Len(t, first, 16)
+	require.NoError(t, vm.Run())
+	assert.NotEqual(t, first, vm.CorrelationID())
+
+	// An ID set by the host is used for the next cycle only, and hooks see it
+	var hooked string
+	vm.OnBeforeCycle(func() error {
+		hooked = vm.CorrelationID()
+		return nil
+	})
+	vm.SetCorrelationID("reading-7")
+	require.NoError(t, vm.Run())
+	assert.Equal(t, "reading-7", hooked)
+	assert.Equal(t, "reading-7", vm.CorrelationID())
+	require.NoError(t, vm.Run())
+	assert.NotEqual(t, "reading-7", hooked)
+}
+
+func TestVM_CorrelationIDLogs(t *testing.T) {
+	var logs bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&logs).Level(zerolog.DebugLevel)
+	defer func() { log.Logger = logger }()
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	vm := NewVM(twoRuleProgram())
+	vm.SetFact("temperature", 35)
+	vm.SetCorrelationID("reading-7")
+	require.NoError(t, vm.Run())
+	assert.Contains(t, logs.String(), `"CorrelationID":"reading-7","Fact":"ac_status"`)
+	assert.Contains(t, logs.String(), `"CorrelationID":"reading-7","Writes":2`)
+}
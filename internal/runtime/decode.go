@@ -0,0 +1,254 @@
+// runtime/decode.go
+
+package runtime
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"time"
+)
+
+// instruction is a VM instruction with its operands decoded. The VM decodes
+// its bytecode once when it is created, so evaluation cycles don't decode
+// varints and strings again.
+type instruction struct {
+	opcode bytecode.Opcode
+	offset int // Offset of the instruction in the bytecode
+	next   int // Offset of the instruction that follows it
+
+	value   interface{}   // Constant pushed by the LOAD_CONST instructions, or list of IN_LIST and NOT_IN_LIST
+	arg     int           // Jump target, variable slot, rule priority, rollout percent, low variant bound, script kind or message index
+	arg2    int           // High variant bound
+	salt    uint32        // Salt of ROLLOUT and VARIANT
+	epsilon float64       // Tolerance of EQ_FLOAT_EPSILON and NEQ_FLOAT_EPSILON
+	name    string        // Fact, operator, pattern, action type, key fact or script
+	name2   string        // Action target, MATCH_FACTS operator or variant name
+	all     bool          // Whether MATCH_FACTS requires all matching facts to pass
+	facts   []string      // Facts read by the script of CALL_SCRIPT
+	hold    time.Duration // How long the conditions must hold for HOLD
+	once    bool          // Whether HOLD lets the actions run once each time the conditions start holding
+}
+
+// decodedCode holds the instructions of the bytecode in the order they appear.
+type decodedCode struct {
+	instructions []instruction
+	positions    []int32 // Index in instructions of the instruction at each offset, -1 if none starts there
+}
+
+// decodeCode decodes the instructions of the bytecode from start onwards.
+// With a fact table, LOAD_FACT, UPDATE_FACT and FACT_EXISTS refer to facts by
+// their index in it rather than by name; their names are looked up once here,
+// so the cycles, actions and logs still deal in fact names.
+func decodeCode(code []byte, start int, facts bytecode.FactTable) (decodedCode, error) {
+	decoded := decodedCode{positions: make([]int32, len(code))}
+	for i := range decoded.positions {
+		decoded.positions[i] = -1
+	}
+
+	for ip := start; ip < len(code); {
+		n, err := instructionLength(code, ip, facts)
+		if err != nil {
+			return decodedCode{}, err
+		}
+		if ip+n > len(code) {
+			return decodedCode{}, &VMError{Message: fmt.Sprintf("truncated %s instruction", bytecode.Opcode(code[ip])), IP: ip}
+		}
+		decoded.positions[ip] = int32(len(decoded.instructions))
+		decoded.instructions = append(decoded.instructions, decodeInstruction(code, ip, ip+n, facts))
+		ip += n
+	}
+	return decoded, nil
+}
+
+// decodeInstruction decodes the operands of the instruction at ip, which
+// instructionLength has checked end at next.
+func decodeInstruction(code []byte, ip, next int, facts bytecode.FactTable) instruction {
+	in := instruction{opcode: bytecode.Opcode(code[ip]), offset: ip, next: next}
+	operands := code[ip+1 : next]
+
+	switch in.opcode {
+	case bytecode.LOAD_CONST_INT:
+		value, _ := decodeInt(operands)
+		in.value = value
+	case bytecode.LOAD_CONST_INT64:
+		in.value = int64(binary.LittleEndian.Uint64(operands))
+	case bytecode.LOAD_CONST_UINT64:
+		in.value = binary.LittleEndian.Uint64(operands)
+	case bytecode.LOAD_CONST_FLOAT:
+		value, _ := decodeFloat(operands)
+		in.value = value
+	case bytecode.LOAD_CONST_INT16:
+		in.value = int(int16(binary.LittleEndian.Uint16(operands)))
+	case bytecode.LOAD_CONST_FLOAT32:
+		in.value = float64(math.Float32frombits(binary.LittleEndian.Uint32(operands)))
+	case bytecode.EQ_FLOAT_EPSILON, bytecode.NEQ_FLOAT_EPSILON:
+		in.epsilon, _ = decodeFloat(operands)
+	case bytecode.IN_LIST, bytecode.NOT_IN_LIST:
+		in.value, _, _ = bytecode.DecodeList(operands)
+	case bytecode.LOAD_CONST_STRING:
+		value, _ := decodeString(operands)
+		in.value = value
+	case bytecode.LOAD_CONST_BOOL:
+		in.value = operands[0] == 1
+	case bytecode.LOAD_FACT, bytecode.UPDATE_FACT, bytecode.FACT_EXISTS, bytecode.STORE_FACT:
+		if facts != nil {
+			in.name = facts[operands[0]]
+		} else {
+			in.name, _ = decodeString(operands)
+		}
+	case bytecode.CALL_OPERATOR:
+		in.name, _ = decodeString(operands)
+	case bytecode.LOAD_VAR, bytecode.STORE_VAR:
+		in.arg = int(operands[0])
+	case bytecode.JUMP, bytecode.JUMP_IF_TRUE, bytecode.JUMP_IF_FALSE:
+		in.arg, _ = decodeInt(operands)
+	case bytecode.TRIGGER_ACTION:
+		actionType, n := decodeString(operands)
+		in.name = actionType
+		in.name2, _ = decodeString(operands[n:])
+	case bytecode.RULE_START:
+		in.arg = decodePriority(operands)
+	case bytecode.ROLLOUT:
+		in.arg = int(operands[0])
+		in.salt = binary.LittleEndian.Uint32(operands[1:])
+		in.name, _ = decodeString(operands[5:])
+	case bytecode.VARIANT:
+		in.arg, in.arg2 = int(operands[0]), int(operands[1])
+		in.salt = binary.LittleEndian.Uint32(operands[2:])
+		keyFact, n := decodeString(operands[6:])
+		in.name = keyFact
+		in.name2, _ = decodeString(operands[6+n:])
+	case bytecode.MATCH_FACTS:
+		in.all = operands[0] == bytecode.MatchAllQuantifier
+		pattern, n := decodeString(operands[1:])
+		in.name = pattern
+		in.name2, _ = decodeString(operands[1+n:])
+	case bytecode.ERROR:
+		in.arg = int(binary.LittleEndian.Uint16(operands))
+	case bytecode.HOLD:
+		in.hold = time.Duration(binary.LittleEndian.Uint32(operands)) * time.Millisecond
+		in.once = operands[4]&bytecode.HoldOnce != 0
+	case bytecode.CALL_SCRIPT:
+		in.arg = int(operands[0])
+		pos := 2
+		for i := 0; i < int(operands[1]); i++ {
+			fact, n := decodeString(operands[pos:])
+			in.facts = append(in.facts, fact)
+			pos += n
+		}
+		in.name, _ = decodeString(operands[pos:])
+	}
+	return in
+}
+
+// instructionAt returns the decoded instruction starting at offset.
+func (vm *VM) instructionAt(offset int) (*instruction, error) {
+	if offset < 0 || offset >= len(vm.code.positions) || vm.code.positions[offset] < 0 {
+		return nil, &VMError{Message: fmt.Sprintf("no instruction starts at offset %d", offset), IP: offset}
+	}
+	return &vm.code.instructions[vm.code.positions[offset]], nil
+}
+
+// instructionLength returns the size in bytes of the instruction at ip,
+// including its operands. With a fact table, it also checks that the fact
+// index of LOAD_FACT, UPDATE_FACT, FACT_EXISTS and STORE_FACT is in it.
+func instructionLength(code []byte, ip int, facts bytecode.FactTable) (int, error) {
+	operands := code[ip+1:]
+	opcode := bytecode.Opcode(code[ip])
+	if facts != nil && (opcode == bytecode.LOAD_FACT || opcode == bytecode.UPDATE_FACT || opcode == bytecode.FACT_EXISTS || opcode == bytecode.STORE_FACT) {
+		if len(operands) < 1 {
+			return 0, &VMError{Message: fmt.Sprintf("truncated %s instruction", opcode), IP: ip}
+		}
+		if int(operands[0]) >= len(facts) {
+			return 0, &VMError{Message: fmt.Sprintf("fact index %d of %s is not in the fact table", operands[0], opcode), IP: ip}
+		}
+		return 2, nil
+	}
+	switch opcode {
+	case bytecode.LOAD_CONST_INT, bytecode.JUMP, bytecode.JUMP_IF_TRUE, bytecode.JUMP_IF_FALSE:
+		_, n := binary.Varint(operands)
+		if n <= 0 {
+			return 0, &VMError{Message: "invalid varint operand", IP: ip}
+		}
+		return 1 + n, nil
+	case bytecode.LOAD_CONST_FLOAT, bytecode.LOAD_CONST_INT64, bytecode.LOAD_CONST_UINT64,
+		bytecode.EQ_FLOAT_EPSILON, bytecode.NEQ_FLOAT_EPSILON:
+		return 9, nil
+	case bytecode.LOAD_CONST_BOOL, bytecode.LOAD_VAR, bytecode.STORE_VAR:
+		return 2, nil
+	case bytecode.LOAD_CONST_INT16, bytecode.ERROR:
+		return 3, nil
+	case bytecode.LOAD_CONST_FLOAT32:
+		return 5, nil
+	case bytecode.HOLD:
+		return 6, nil
+	case bytecode.IN_LIST, bytecode.NOT_IN_LIST:
+		_, n, err := bytecode.DecodeList(operands)
+		if err != nil {
+			return 0, &VMError{Message: fmt.Sprintf("invalid %s instruction: %v", opcode, err), IP: ip}
+		}
+		return 1 + n, nil
+	case bytecode.LOAD_FACT, bytecode.LOAD_CONST_STRING, bytecode.UPDATE_FACT, bytecode.CALL_OPERATOR, bytecode.FACT_EXISTS, bytecode.STORE_FACT:
+		_, n := decodeString(operands)
+		if n == 0 {
+			return 0, &VMError{Message: fmt.Sprintf("unterminated string operand for %s", bytecode.Opcode(code[ip])), IP: ip}
+		}
+		return 1 + n, nil
+	case bytecode.TRIGGER_ACTION:
+		_, n := decodeString(operands)
+		_, m := decodeString(operands[n:])
+		if n == 0 || m == 0 {
+			return 0, &VMError{Message: "unterminated string operand for TRIGGER_ACTION", IP: ip}
+		}
+		return 1 + n + m, nil
+	case bytecode.MATCH_FACTS:
+		if len(operands) < 1 {
+			return 0, &VMError{Message: "truncated MATCH_FACTS instruction", IP: ip}
+		}
+		_, n := decodeString(operands[1:])
+		_, m := decodeString(operands[1+n:])
+		if n == 0 || m == 0 {
+			return 0, &VMError{Message: "unterminated string operand for MATCH_FACTS", IP: ip}
+		}
+		return 2 + n + m, nil
+	case bytecode.CALL_SCRIPT:
+		if len(operands) < 2 {
+			return 0, &VMError{Message: "truncated CALL_SCRIPT instruction", IP: ip}
+		}
+		// The names of the facts read, then the script
+		pos := 2
+		for i := 0; i <= int(operands[1]); i++ {
+			_, n := decodeString(operands[pos:])
+			if n == 0 {
+				return 0, &VMError{Message: "unterminated string operand for CALL_SCRIPT", IP: ip}
+			}
+			pos += n
+		}
+		return 1 + pos, nil
+	case bytecode.RULE_START:
+		return 5, nil
+	case bytecode.VARIANT:
+		if len(operands) < 6 {
+			return 0, &VMError{Message: "truncated VARIANT instruction", IP: ip}
+		}
+		_, n := decodeString(operands[6:])
+		_, m := decodeString(operands[6+n:])
+		if n == 0 || m == 0 {
+			return 0, &VMError{Message: "unterminated string operand for VARIANT", IP: ip}
+		}
+		return 7 + n + m, nil
+	case bytecode.ROLLOUT:
+		if len(operands) < 5 {
+			return 0, &VMError{Message: "truncated ROLLOUT instruction", IP: ip}
+		}
+		_, n := decodeString(operands[5:])
+		if n == 0 {
+			return 0, &VMError{Message: "unterminated string operand for ROLLOUT", IP: ip}
+		}
+		return 6 + n, nil
+	default:
+		return 1, nil
+	}
+}
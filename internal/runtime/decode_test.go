@@ -0,0 +1,153 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeCode_DecodesOperands(t *testing.T) {
+	code := newProgram().
+		ruleStart(-3).
+		loadFact("temperature").loadInt(-30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		loadString("on").updateFact("fan").
+		variant(10, 50, 7, "user_id", "treatment").
+		matchFacts(bytecode.MatchAllQuantifier, "sensor.*", ">").
+		triggerAction("notify", "ops").
+		label("end").op(bytecode.RULE_END).
+		bytes()
+
+	decoded, err := decodeCode(code, 12, nil)
+	require.NoError(t, err)
+
+	var opcodes []bytecode.Opcode
+	for _, in := range decoded.instructions {
+		opcodes = append(opcodes, in.opcode)
+		assert.Equal(t, len(opcodes)-1, int(decoded.positions[in.offset]))
+	}
+	assert.Equal(t, []bytecode.Opcode{
+		bytecode.RULE_START, bytecode.LOAD_FACT, bytecode.LOAD_CONST_INT, bytecode.GT_INT,
+		bytecode.JUMP_IF_FALSE, bytecode.LOAD_CONST_STRING, bytecode.UPDATE_FACT,
+		bytecode.VARIANT, bytecode.MATCH_FACTS, bytecode.TRIGGER_ACTION, bytecode.RULE_END,
+	}, opcodes)
+
+	in := decoded.instructions
+	assert.Equal(t, -3, in[0].arg)
+	assert.Equal(t, "temperature", in[1].name)
+	assert.Equal(t, -30, in[2].value)
+	assert.Equal(t, in[10].offset, in[4].arg)
+	assert.Equal(t, "on", in[5].value)
+	assert.Equal(t, "fan", in[6].name)
+	assert.Equal(t, instruction{
+		opcode: bytecode.VARIANT, offset: in[7].offset, next: in[8].offset,
+		arg: 10, arg2: 50, salt: 7, name: "user_id", name2: "treatment",
+	}, in[7])
+	assert.True(t, in[8].all)
+	assert.Equal(t, "sensor.*", in[8].name)
+	assert.Equal(t, ">", in[8].name2)
+	assert.Equal(t, "notify", in[9].name)
+	assert.Equal(t, "ops", in[9].name2)
+	assert.Equal(t, len(code), in[10].next)
+	assert.Equal(t, int32(-1), decoded.positions[in[1].offset+1], "no instruction starts inside operands")
+}
+
+func TestDecodeCode_NarrowConstants(t *testing.T) {
+	code := newProgram().
+		loadFact("temperature").loadInt16(-300).op(bytecode.GT_INT).
+		loadFact("humidity").loadFloat32(40.5).op(bytecode.LT_FLOAT).
+		op(bytecode.AND).
+		bytes()
+
+	decoded, err := decodeCode(code, 12, nil)
+	require.NoError(t, err)
+	assert.Equal(t, -300, decoded.instructions[1].value)
+	assert.Equal(t, 40.5, decoded.instructions[4].value)
+
+	vm := NewVM(code)
+	vm.SetFact("temperature", -250)
+	vm.SetFact("humidity", 35.0)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []interface{}{true}, vm.stack)
+}
+
+func TestDecodeCode_FactTable(t *testing.T) {
+	code := newProgram().op(bytecode.LOAD_FACT).bytes()
+	code = append(code, 1)
+	code = append(code, byte(bytecode.UPDATE_FACT), 0)
+
+	decoded, err := decodeCode(code, 12, bytecode.FactTable{"ac_status", "temperature"})
+	require.NoError(t, err)
+	assert.Equal(t, "temperature", decoded.instructions[0].name)
+	assert.Equal(t, "ac_status", decoded.instructions[1].name)
+
+	_, err = decodeCode(code, 12, bytecode.FactTable{"ac_status"})
+	var vmErr *VMError
+	require.ErrorAs(t, err, &vmErr)
+	assert.Equal(t, "fact index 1 of LOAD_FACT is not in the fact table", vmErr.Message)
+}
+
+func TestVM_FactTable(t *testing.T) {
+	p := newProgram().op(bytecode.LOAD_FACT)
+	p.code = append(p.code, 0)
+	p.loadInt(30).op(bytecode.GT_INT).op(bytecode.UPDATE_FACT)
+	p.code = append(p.code, 1)
+	facts, err := bytecode.NewFactTableSection(bytecode.FactTable{"temperature", "ac_status"})
+	require.NoError(t, err)
+
+	vm := NewVM(bytecode.AppendSections(p.bytes(), facts))
+	vm.SetFact("temperature", 35)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.Facts()["ac_status"])
+}
+
+func TestDecodeCode_TruncatedInstruction(t *testing.T) {
+	code := newProgram().loadInt64(1).bytes()
+
+	_, err := decodeCode(code[:len(code)-1], 12, nil)
+	var vmErr *VMError
+	require.ErrorAs(t, err, &vmErr)
+	assert.Equal(t, 12, vmErr.IP)
+	assert.Contains(t, vmErr.Message, "truncated LOAD_CONST_INT64 instruction")
+}
+
+func TestRun_ReportsDecodingErrorEveryCycle(t *testing.T) {
+	code := newProgram().loadFact("name").bytes()
+	vm := NewVM(code[:len(code)-1])
+	assert.ErrorContains(t, vm.DecodeError(), "unterminated string operand for LOAD_FACT")
+
+	for cycle := 0; cycle < 2; cycle++ {
+		err := vm.Run()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unterminated string operand for LOAD_FACT")
+	}
+}
+
+func TestRun_RejectsJumpIntoOperands(t *testing.T) {
+	code := newProgram().
+		jump(bytecode.JUMP, "inside").
+		op(bytecode.LOAD_CONST_STRING).label("inside").
+		bytes()
+	code = append(code, "x"...)
+	code = append(code, 0)
+
+	err := NewVM(code).Run()
+	var vmErr *VMError
+	require.ErrorAs(t, err, &vmErr)
+	assert.Equal(t, "no instruction starts at offset 16", vmErr.Message)
+}
+
+func TestRun_DecodedProgramIsReused(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	decoded := vm.code.instructions
+
+	for _, temperature := range []int{35, 20} {
+		vm.SetFact("temperature", temperature)
+		require.NoError(t, vm.Run())
+		assert.Equal(t, temperature > 30, vm.facts["ac_status"] == true)
+		delete(vm.facts, "ac_status")
+	}
+	assert.Same(t, &decoded[0], &vm.code.instructions[0])
+}
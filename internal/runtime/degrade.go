@@ -0,0 +1,326 @@
+// runtime/degrade.go
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DegradationPolicy says how a VM keeps evaluating while the systems it is
+// integrated with are partly down: the fact sources feeding it and the
+// downstream systems its action handlers talk to.
+type DegradationPolicy struct {
+	// Sources lists the facts provided by each fact source, by source name.
+	// Fact patterns are allowed; a source without facts provides every fact.
+	Sources map[string][]string
+
+	// MaxStaleness is how long rules keep using the last-known values of the
+	// facts of a source that went down. Once it has passed, the rules reading
+	// those facts are paused until the source is back up.
+	MaxStaleness time.Duration
+
+	// QueueSize is the number of actions held per handler type while the
+	// handler's circuit breaker is open, to be performed once the breaker
+	// admits invocations again; 0 fails them instead. When a queue is full
+	// its oldest action is dropped.
+	QueueSize int
+}
+
+// Validate checks that the policy's durations and sizes aren't negative and
+// that its sources are named.
+func (p DegradationPolicy) Validate() error {
+	if p.MaxStaleness < 0 {
+		return errors.New("max staleness must not be negative")
+	}
+	if p.QueueSize < 0 {
+		return errors.New("action queue size must not be negative")
+	}
+	for name := range p.Sources {
+		if name == "" {
+			return errors.New("fact source name must not be empty")
+		}
+	}
+	return nil
+}
+
+// SourceState is the state of a fact source under a DegradationPolicy.
+type SourceState string
+
+const (
+	SourceUp     SourceState = "up"     // Facts are current
+	SourceStale  SourceState = "stale"  // Down, its last-known facts are still used
+	SourcePaused SourceState = "paused" // Down too long, the rules reading its facts are paused
+)
+
+// SourceStatus describes a fact source under a DegradationPolicy.
+type SourceStatus struct {
+	Name      string      `json:"name"`
+	State     SourceState `json:"state"`
+	Since     time.Time   `json:"since"` // When the source entered its state
+	LastError string      `json:"lastError,omitempty"`
+}
+
+// DegradationStatus describes how far a VM is running degraded.
+type DegradationStatus struct {
+	Sources        []SourceStatus `json:"sources"`
+	PausedRules    []int          `json:"pausedRules"`              // Rules skipped by the latest cycle
+	QueuedActions  map[string]int `json:"queuedActions"`            // Actions held, by handler type
+	DroppedActions int            `json:"droppedActions,omitempty"` // Actions dropped from full queues
+}
+
+// Degraded reports whether a source is down or actions are held back.
+func (s DegradationStatus) Degraded() bool {
+	for _, source := range s.Sources {
+		if source.State != SourceUp {
+			return true
+		}
+	}
+	return len(s.QueuedActions) > 0
+}
+
+// degradation is the state kept by a VM for its DegradationPolicy. Sources go
+// down and up from the goroutines reading them, and the status is read by
+// monitors, hence the mutex.
+type degradation struct {
+	mu      sync.Mutex
+	policy  DegradationPolicy
+	sources map[string]*SourceStatus
+	paused  map[int]bool // Rules paused for the current cycle, by index
+	queues  map[string][]Action
+	holding map[string]bool // Handler types whose actions are being queued
+	dropped int
+}
+
+// SetDegradationPolicy sets how the VM copes with fact sources and action
+// handlers that are down. The state of the previous policy is discarded and
+// every source starts out up.
+func (vm *VM) SetDegradationPolicy(policy DegradationPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	sources := make(map[string]*SourceStatus, len(policy.Sources))
+	now := vm.clock.Now()
+	for name := range policy.Sources {
+		sources[name] = &SourceStatus{Name: name, State: SourceUp, Since: now}
+	}
+
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	vm.degrade.policy = policy
+	vm.degrade.sources = sources
+	vm.degrade.paused = nil
+	vm.degrade.queues = nil
+	vm.degrade.holding = nil
+	vm.degrade.dropped = 0
+	return nil
+}
+
+// SourceDown marks a fact source of the degradation policy as down because of
+// err. Its facts keep their last-known values until the policy's maximum
+// staleness has passed. It can be called concurrently with Run.
+func (vm *VM) SourceDown(name string, err error) error {
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	source, ok := vm.degrade.sources[name]
+	if !ok {
+		return fmt.Errorf("unknown fact source %s", name)
+	}
+	if err != nil {
+		source.LastError = err.Error()
+	}
+	if source.State == SourceUp {
+		source.State = SourceStale
+		source.Since = vm.clock.Now()
+		log.Warn().Err(err).Str("Source", name).Dur("MaxStaleness", vm.degrade.policy.MaxStaleness).Msg("Fact source down, using last-known facts")
+	}
+	return nil
+}
+
+// SourceUp marks a fact source of the degradation policy as up again, resuming
+// the rules paused because of it from the next cycle. It can be called
+// concurrently with Run.
+func (vm *VM) SourceUp(name string) error {
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	source, ok := vm.degrade.sources[name]
+	if !ok {
+		return fmt.Errorf("unknown fact source %s", name)
+	}
+	if source.State != SourceUp {
+		log.Info().Str("Source", name).Dur("Downtime", vm.clock.Now().Sub(source.Since)).Str("Previous", string(source.State)).Msg("Fact source back up")
+		source.State = SourceUp
+		source.Since = vm.clock.Now()
+	}
+	return nil
+}
+
+// Degradation returns the state of the fact sources of the degradation policy,
+// in name order, along with the rules and actions held back because of them.
+// It can be called concurrently with Run.
+func (vm *VM) Degradation() DegradationStatus {
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	status := DegradationStatus{
+		Sources:        make([]SourceStatus, 0, len(vm.degrade.sources)),
+		PausedRules:    make([]int, 0, len(vm.degrade.paused)),
+		QueuedActions:  make(map[string]int),
+		DroppedActions: vm.degrade.dropped,
+	}
+	for _, source := range vm.degrade.sources {
+		status.Sources = append(status.Sources, *source)
+	}
+	sort.Slice(status.Sources, func(i, j int) bool { return status.Sources[i].Name < status.Sources[j].Name })
+	for rule := range vm.degrade.paused {
+		status.PausedRules = append(status.PausedRules, rule)
+	}
+	sort.Ints(status.PausedRules)
+	for handlerType, queue := range vm.degrade.queues {
+		if len(queue) > 0 {
+			status.QueuedActions[handlerType] = len(queue)
+		}
+	}
+	return status
+}
+
+// pauseRules moves the sources that have been down longer than the maximum
+// staleness to the paused state and works out which rules the cycle about to
+// run skips: those reading a fact of a paused source.
+func (vm *VM) pauseRules() {
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	if len(vm.degrade.sources) == 0 {
+		return
+	}
+
+	now := vm.clock.Now()
+	var paused []string
+	for name, source := range vm.degrade.sources {
+		if source.State == SourceStale && now.Sub(source.Since) >= vm.degrade.policy.MaxStaleness {
+			source.State = SourcePaused
+			source.Since = now
+			vm.logger.Warn().Str("Source", name).Msg("Fact source down past the maximum staleness, pausing the rules reading its facts")
+		}
+		if source.State == SourcePaused {
+			paused = append(paused, name)
+		}
+	}
+
+	vm.degrade.paused = nil
+	for _, entry := range vm.schedule {
+		for _, name := range paused {
+			if readsSource(entry, vm.degrade.policy.Sources[name]) {
+				if vm.degrade.paused == nil {
+					vm.degrade.paused = make(map[int]bool)
+				}
+				vm.degrade.paused[entry.index] = true
+				break
+			}
+		}
+	}
+}
+
+// rulePaused reports whether the current cycle skips a rule.
+func (vm *VM) rulePaused(entry ruleEntry) bool {
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	return vm.degrade.paused[entry.index]
+}
+
+// readsSource reports whether a rule reads any of the facts of a source, given
+// as names or patterns. Every rule reading facts reads those of a source
+// providing every fact.
+func readsSource(entry ruleEntry, facts []string) bool {
+	if len(facts) == 0 {
+		return len(entry.consumes) > 0 || len(entry.patterns) > 0
+	}
+	for _, fact := range facts {
+		if !rules.IsFactPattern(fact) {
+			if entry.reads(fact) {
+				return true
+			}
+			continue
+		}
+		for consumed := range entry.consumes {
+			if rules.MatchFact(fact, consumed) {
+				return true
+			}
+		}
+		for _, pattern := range entry.patterns {
+			if pattern == fact {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queueAction holds an action rejected by an open circuit breaker, if the
+// degradation policy queues actions, and reports whether it did.
+func (vm *VM) queueAction(action Action, err error) bool {
+	if !errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	size := vm.degrade.policy.QueueSize
+	if size == 0 {
+		return false
+	}
+
+	if vm.degrade.queues == nil {
+		vm.degrade.queues = make(map[string][]Action)
+		vm.degrade.holding = make(map[string]bool)
+	}
+	if !vm.degrade.holding[action.Type] {
+		vm.degrade.holding[action.Type] = true
+		vm.logger.Warn().Str("HandlerType", action.Type).Msg("Circuit breaker open, queueing actions")
+	}
+	queue := vm.degrade.queues[action.Type]
+	if len(queue) == size {
+		vm.degrade.dropped++
+		vm.logger.Warn().Str("HandlerType", action.Type).Int("Rule", queue[0].Rule).Str("DroppedCorrelationID", queue[0].CorrelationID).Msg("Action queue full, dropping the oldest action")
+		queue = queue[1:]
+	}
+	vm.degrade.queues[action.Type] = append(queue, action)
+	return true
+}
+
+// queuedActions takes the actions held for every handler type, in handler
+// type order, to be performed before the actions of the current cycle.
+// Those rejected again are queued anew.
+func (vm *VM) queuedActions() []Action {
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	types := make([]string, 0, len(vm.degrade.queues))
+	for handlerType := range vm.degrade.queues {
+		types = append(types, handlerType)
+	}
+	sort.Strings(types)
+
+	var actions []Action
+	for _, handlerType := range types {
+		actions = append(actions, vm.degrade.queues[handlerType]...)
+		delete(vm.degrade.queues, handlerType)
+	}
+	return actions
+}
+
+// releaseQueues logs the handler types whose queued actions have all been
+// performed.
+func (vm *VM) releaseQueues() {
+	vm.degrade.mu.Lock()
+	defer vm.degrade.mu.Unlock()
+	for handlerType := range vm.degrade.holding {
+		if len(vm.degrade.queues[handlerType]) == 0 {
+			delete(vm.degrade.holding, handlerType)
+			vm.logger.Info().Str("HandlerType", handlerType).Msg("Circuit breaker admitting actions again, queue drained")
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	degradeDelivered []interface{}
+	degradeFailing   bool
+)
+
+func init() {
+	RegisterActionHandler("degradeTest", func(ctx context.Context, action Action) error {
+		if degradeFailing {
+			return errors.New("downstream unavailable")
+		}
+		degradeDelivered = append(degradeDelivered, action.Value)
+		return nil
+	})
+}
+
+// degradeProgram cools when it's hot, lights up when occupied and beats
+// without reading any fact.
+func degradeProgram() []byte {
+	return newProgram().
+		ruleStart(0).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadBool(true).updateFact("ac_status").
+		label("rule0_end").op(bytecode.RULE_END).
+		ruleStart(0).
+		loadFact("occupied").loadBool(true).op(bytecode.EQ_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule1_end").
+		loadBool(true).updateFact("lights").
+		label("rule1_end").op(bytecode.RULE_END).
+		ruleStart(0).
+		loadBool(true).updateFact("heartbeat").
+		op(bytecode.RULE_END).
+		bytes()
+}
+
+func TestDegradation_Sources(t *testing.T) {
+	clock := NewTestClock(time.Unix(0, 0))
+	vm := NewVM(degradeProgram())
+	vm.SetClock(clock)
+	require.NoError(t, vm.SetDegradationPolicy(DegradationPolicy{
+		Sources:      map[string][]string{"sensors": {"temperature"}, "presence": {"occupied"}},
+		MaxStaleness: time.Minute,
+	}))
+	vm.SetFact("temperature", 35)
+	vm.SetFact("occupied", true)
+	require.NoError(t, vm.Run())
+	assert.False(t, vm.Degradation().Degraded())
+
+	// Within the maximum staleness the last-known temperature is used
+	require.NoError(t, vm.SourceDown("sensors", errors.New("connection refused")))
+	vm.SetFact("ac_status", false)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.Facts()["ac_status"])
+	status := vm.Degradation()
+	assert.True(t, status.Degraded())
+	assert.Equal(t, []SourceStatus{
+		{Name: "presence", State: SourceUp, Since: time.Unix(0, 0)},
+		{Name: "sensors", State: SourceStale, Since: time.Unix(0, 0), LastError: "connection refused"},
+	}, status.Sources)
+	assert.Empty(t, status.PausedRules)
+
+	// Past it, only the rule reading the temperature is paused
+	clock.Advance(time.Minute)
+	vm.SetFact("ac_status", false)
+	vm.SetFact("lights", false)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, false, vm.Facts()["ac_status"])
+	assert.Equal(t, true, vm.Facts()["lights"])
+	assert.Equal(t, true, vm.Facts()["heartbeat"])
+	status = vm.Degradation()
+	assert.Equal(t, SourcePaused, status.Sources[1].State)
+	assert.Equal(t, []int{0}, status.PausedRules)
+
+	require.NoError(t, vm.SourceUp("sensors"))
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.Facts()["ac_status"])
+	assert.False(t, vm.Degradation().Degraded())
+	assert.Empty(t, vm.Degradation().PausedRules)
+
+	assert.ErrorContains(t, vm.SourceDown("weather", nil), "unknown fact source weather")
+	assert.ErrorContains(t, vm.SourceUp("weather"), "unknown fact source weather")
+}
+
+func TestDegradation_QueueActions(t *testing.T) {
+	degradeDelivered, degradeFailing = nil, true
+	defer func() { degradeFailing = false }()
+
+	code := newProgram().
+		ruleStart(0).
+		loadFact("n").triggerAction("degradeTest", "ops").
+		op(bytecode.RULE_END).
+		bytes()
+	clock := NewTestClock(time.Unix(0, 0))
+	vm := NewVM(code)
+	vm.SetClock(clock)
+	vm.SetActionPolicy(ActionPolicy{FailureThreshold: 1, Cooldown: time.Minute})
+	require.NoError(t, vm.SetDegradationPolicy(DegradationPolicy{QueueSize: 2}))
+
+	// The failure tripping the breaker is reported as usual
+	vm.SetFact("n", 1)
+	assert.ErrorContains(t, vm.Run(), "downstream unavailable")
+
+	// While it's open the actions are queued, dropping the oldest once full
+	for n := 2; n <= 4; n++ {
+		vm.SetFact("n", n)
+		require.NoError(t, vm.Run())
+	}
+	status := vm.Degradation()
+	assert.True(t, status.Degraded())
+	assert.Equal(t, map[string]int{"degradeTest": 2}, status.QueuedActions)
+	assert.Equal(t, 1, status.DroppedActions)
+
+	// Once the breaker admits a trial the queue is drained in order, before
+	// the cycle's own action
+	degradeFailing = false
+	clock.Advance(time.Minute)
+	vm.SetFact("n", 5)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []interface{}{3, 4, 5}, degradeDelivered)
+	assert.Empty(t, vm.Degradation().QueuedActions)
+	assert.False(t, vm.Degradation().Degraded())
+}
+
+func TestDegradation_NoQueue(t *testing.T) {
+	degradeFailing = true
+	defer func() { degradeFailing = false }()
+
+	code := newProgram().
+		ruleStart(0).
+		loadBool(true).triggerAction("degradeTest", "ops").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+	vm.SetActionPolicy(ActionPolicy{FailureThreshold: 1, Cooldown: time.Hour})
+	assert.Error(t, vm.Run())
+	assert.ErrorIs(t, vm.Run(), ErrCircuitOpen)
+	assert.Empty(t, vm.Degradation().QueuedActions)
+}
+
+func TestSetDegradationPolicy(t *testing.T) {
+	vm := NewVM(degradeProgram())
+	assert.ErrorContains(t, vm.SetDegradationPolicy(DegradationPolicy{MaxStaleness: -time.Second}), "max staleness must not be negative")
+	assert.ErrorContains(t, vm.SetDegradationPolicy(DegradationPolicy{QueueSize: -1}), "queue size must not be negative")
+	assert.ErrorContains(t, vm.SetDegradationPolicy(DegradationPolicy{Sources: map[string][]string{"": nil}}), "must not be empty")
+
+	status := vm.Degradation()
+	assert.Equal(t, DegradationStatus{Sources: []SourceStatus{}, PausedRules: []int{}, QueuedActions: map[string]int{}}, status)
+}
+
+func TestReadsSource(t *testing.T) {
+	entry := ruleEntry{consumes: map[string]bool{"sensor.kitchen.temperature": true}, patterns: []string{"door.*.open"}}
+	testCases := []struct {
+		name     string
+		entry    ruleEntry
+		facts    []string
+		expected bool
+	}{
+		{"Fact", entry, []string{"sensor.kitchen.temperature"}, true},
+		{"Other fact", entry, []string{"humidity"}, false},
+		{"Pattern of the source", entry, []string{"sensor.*.temperature"}, true},
+		{"Pattern of the rule", entry, []string{"door.front.open"}, true},
+		{"Same pattern", entry, []string{"door.*.open"}, true},
+		{"Every fact", entry, nil, true},
+		{"Rule reading no fact", ruleEntry{}, nil, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, readsSource(tc.entry, tc.facts))
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// runtime/delay.go
+
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"sort"
+	"time"
+)
+
+// delayedAction is an action a rule scheduled for later. It stays pending
+// while every evaluation of the rule triggers it again, and is cancelled by
+// the first evaluation that doesn't, so a rule must keep firing for the
+// whole delay for its action to be performed. Once performed, the action
+// isn't scheduled again until the rule has stopped triggering it.
+type delayedAction struct {
+	action    Action
+	offset    int       // Offset of the TRIGGER_ACTION instruction
+	due       time.Time // When the action is performed
+	performed bool      // Whether the action has been performed
+}
+
+// actionDelays returns the delays of the delayed actions of the decoded code,
+// by the offset of their TRIGGER_ACTION instruction.
+func actionDelays(instructions []instruction, delays []bytecode.ActionDelay) map[int]time.Duration {
+	if len(delays) == 0 {
+		return nil
+	}
+	type key struct{ rule, action int }
+	byAction := make(map[key]time.Duration, len(delays))
+	for _, delay := range delays {
+		byAction[key{delay.Rule, delay.Action}] = time.Duration(delay.DelayMillis) * time.Millisecond
+	}
+
+	offsets := make(map[int]time.Duration, len(delays))
+	rule, action := -1, 0
+	for _, in := range instructions {
+		switch in.opcode {
+		case bytecode.RULE_START:
+			rule, action = rule+1, 0
+		case bytecode.TRIGGER_ACTION:
+			if delay, ok := byAction[key{rule, action}]; ok {
+				offsets[in.offset] = delay
+			}
+			action++
+		}
+	}
+	return offsets
+}
+
+// delayAction pops the value of a delayed action and records that the
+// current rule triggered it; the action is scheduled once the cycle's writes
+// are committed.
+func (vm *VM) delayAction(offset int, actionType, target string) error {
+	action, err := vm.newAction(actionType, target)
+	if err != nil {
+		return err
+	}
+	if _, ok := vm.tx.delayed[offset]; !ok {
+		vm.tx.delayed[offset] = action
+	}
+	vm.ruleFired = true
+	vm.logger.Debug().Str("Type", actionType).Str("Target", target).Dur("Delay", vm.delays[offset]).Msg("Delayed action triggered")
+	return nil
+}
+
+// settleDelayedActions updates the delayed actions once a cycle has
+// committed its writes: the actions of the rules the cycle evaluated without
+// triggering them are cancelled, those triggered for the first time are
+// scheduled, and those that have come due are returned, earliest first, to
+// be performed with the cycle's actions.
+func (vm *VM) settleDelayedActions() []Action {
+	if len(vm.pending) == 0 && len(vm.tx.delayed) == 0 {
+		return nil
+	}
+	now := vm.clock.Now()
+	for offset, pending := range vm.pending {
+		if _, triggered := vm.tx.delayed[offset]; !triggered && vm.tx.evaluated[pending.action.Rule] {
+			delete(vm.pending, offset)
+			if !pending.performed {
+				vm.logger.Debug().Int("Rule", pending.action.Rule).Str("Type", pending.action.Type).Str("Target", pending.action.Target).Msg("Delayed action cancelled")
+			}
+		}
+	}
+	for offset, action := range vm.tx.delayed {
+		if _, ok := vm.pending[offset]; !ok {
+			vm.pending[offset] = &delayedAction{action: action, offset: offset, due: now.Add(vm.delays[offset])}
+		}
+	}
+
+	var due []*delayedAction
+	for _, pending := range vm.pending {
+		if !pending.performed && !now.Before(pending.due) {
+			pending.performed = true
+			due = append(due, pending)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].due.Equal(due[j].due) {
+			return due[i].due.Before(due[j].due)
+		}
+		return due[i].offset < due[j].offset
+	})
+	actions := make([]Action, len(due))
+	for i, pending := range due {
+		actions[i] = pending.action
+	}
+	return actions
+}
+
+// nextDelayedAction returns the earliest time a pending delayed action is
+// due, and false if none is pending.
+func (vm *VM) nextDelayedAction() (time.Time, bool) {
+	var next time.Time
+	waiting := false
+	for _, pending := range vm.pending {
+		if pending.performed {
+			continue
+		}
+		if !waiting || pending.due.Before(next) {
+			next, waiting = pending.due, true
+		}
+	}
+	return next, waiting
+}
@@ -0,0 +1,98 @@
+package runtime
+
+import (
+	"context"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// delayedProgram builds a program with a rule turning the lights off 10
+// minutes after motion stops, and logging that it did right away.
+func delayedProgram(t *testing.T) []byte {
+	code := newProgram().
+		ruleStart(0).
+		loadFact("motion").loadBool(false).op(bytecode.EQ_BOOL).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadString("logged").triggerAction("actionsTest", "log").
+		loadString("off").triggerAction("actionsTest", "lights").
+		label("rule0_end").op(bytecode.RULE_END).
+		bytes()
+	section, err := bytecode.NewActionDelaysSection([]bytecode.ActionDelay{{Rule: 0, Action: 1, DelayMillis: (10 * time.Minute).Milliseconds()}})
+	require.NoError(t, err)
+	return bytecode.AppendSections(code, section)
+}
+
+func triggeredTargets() []string {
+	var targets []string
+	for _, action := range triggeredActions {
+		targets = append(targets, action.Target)
+	}
+	return targets
+}
+
+func TestVM_DelayedAction(t *testing.T) {
+	triggeredActions = nil
+	clock := NewTestClock(time.Unix(0, 0))
+	vm := NewVM(delayedProgram(t))
+	vm.SetClock(clock)
+
+	vm.SetFact("motion", false)
+	vm.SetCorrelationID("no-motion")
+	require.NoError(t, vm.Run())
+	clock.Advance(9 * time.Minute)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []string{"log", "log"}, triggeredTargets(), "the lights go off after 10 minutes")
+
+	clock.Advance(time.Minute)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []string{"log", "log", "log", "lights"}, triggeredTargets())
+	assert.Equal(t, "no-motion", triggeredActions[3].CorrelationID, "the action belongs to the cycle that triggered it")
+
+	clock.Advance(10 * time.Minute)
+	require.NoError(t, vm.Run())
+	assert.Len(t, triggeredActions, 5, "the action isn't repeated while the rule keeps firing")
+
+	// Motion cancels the pending action, and the delay starts over once it stops
+	vm.SetFact("motion", true)
+	require.NoError(t, vm.Run())
+	vm.SetFact("motion", false)
+	require.NoError(t, vm.Run())
+	clock.Advance(5 * time.Minute)
+	vm.SetFact("motion", true)
+	require.NoError(t, vm.Run())
+	clock.Advance(5 * time.Minute)
+	vm.SetFact("motion", false)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []string{"log", "log", "log", "lights", "log", "log", "log"}, triggeredTargets())
+
+	// A failed cycle doesn't cancel pending actions
+	vm.DeleteFact("motion")
+	assert.Error(t, vm.Run())
+	clock.Advance(10 * time.Minute)
+	vm.SetFact("motion", false)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, "lights", triggeredActions[len(triggeredActions)-1].Target)
+}
+
+func TestVM_StreamDelayedAction(t *testing.T) {
+	clock := NewTestClock(time.Unix(0, 0))
+	vm := NewVM(delayedProgram(t))
+	vm.SetClock(clock)
+	vm.SetFact("motion", false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	actions := make(chan Action)
+	go vm.Stream(ctx, make(chan FactUpdate), actions)
+	assert.Equal(t, "log", (<-actions).Target)
+
+	// The stream performs the action when it is due, without any update
+	// coming
+	require.Eventually(t, func() bool { return clock.Waiters() > 0 }, time.Second, time.Millisecond)
+	clock.Advance(10 * time.Minute)
+	assert.Equal(t, "lights", (<-actions).Target)
+}
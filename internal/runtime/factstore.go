@@ -0,0 +1,158 @@
+// runtime/factstore.go
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// FactStore keeps the facts of a VM outside it, so that several runtimes can
+// share them and they survive restarts. Without one, the facts live only in
+// the VM's memory.
+//
+// The VM loads every fact from its store at the start of each cycle and
+// evaluates the rules against its copy; it then saves the facts the cycle
+// changed. Facts set and deleted by the host between cycles are saved before
+// the next load. Writes that fail to save are kept and saved again at the
+// start of the next cycle.
+type FactStore interface {
+	// Load returns every fact of the store.
+	Load(ctx context.Context) (map[string]interface{}, error)
+	// Save sets the facts of set and deletes those of deleted.
+	Save(ctx context.Context, set map[string]interface{}, deleted []string) error
+}
+
+// MemoryFactStore is a FactStore held in memory, which lets VMs in the same
+// process share facts. It is safe for concurrent use.
+type MemoryFactStore struct {
+	mu    sync.Mutex
+	facts map[string]interface{}
+}
+
+// NewMemoryFactStore creates an empty MemoryFactStore.
+func NewMemoryFactStore() *MemoryFactStore {
+	return &MemoryFactStore{facts: make(map[string]interface{})}
+}
+
+// Load implements FactStore.
+func (s *MemoryFactStore) Load(ctx context.Context) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	facts := make(map[string]interface{}, len(s.facts))
+	for name, value := range s.facts {
+		facts[name] = value
+	}
+	return facts, nil
+}
+
+// Save implements FactStore.
+func (s *MemoryFactStore) Save(ctx context.Context, set map[string]interface{}, deleted []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range deleted {
+		delete(s.facts, name)
+	}
+	for name, value := range set {
+		s.facts[name] = value
+	}
+	return nil
+}
+
+// storeSync holds the writes a VM hasn't saved to its fact store yet.
+type storeSync struct {
+	store   FactStore
+	set     map[string]interface{}
+	deleted map[string]bool
+}
+
+// SetFactStore makes the VM keep its facts in store. Facts already in the VM,
+// such as the initial facts of the bytecode, are saved to the store unless it
+// holds them already. The VMs of a Composition share their facts already and
+// can't have a store. It must not be called while a cycle is running.
+func (vm *VM) SetFactStore(store FactStore) error {
+	stored, err := store.Load(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load facts: %w", err)
+	}
+	vm.factStore = storeSync{store: store, set: make(map[string]interface{}), deleted: make(map[string]bool)}
+	for name, value := range vm.facts {
+		if _, ok := stored[name]; !ok {
+			vm.factStore.set[name] = value
+			stored[name] = value
+		}
+	}
+	vm.facts = stored
+	return nil
+}
+
+// FactStore returns the store the VM keeps its facts in, nil if they live
+// only in its memory.
+func (vm *VM) FactStore() FactStore {
+	return vm.factStore.store
+}
+
+// recordSet notes a fact the host set, to be saved to the store.
+func (s *storeSync) recordSet(name string, value interface{}) {
+	if s.store != nil {
+		delete(s.deleted, name)
+		s.set[name] = value
+	}
+}
+
+// recordDelete notes a fact the host deleted, to be deleted from the store.
+func (s *storeSync) recordDelete(name string) {
+	if s.store != nil {
+		delete(s.set, name)
+		s.deleted[name] = true
+	}
+}
+
+// loadFacts saves the pending writes and reloads the facts from the store,
+// at the start of a cycle.
+func (vm *VM) loadFacts() error {
+	s := &vm.factStore
+	if s.store == nil {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	facts, err := s.store.Load(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load facts: %w", err)
+	}
+	vm.facts = facts
+	return nil
+}
+
+// saveChanges saves the facts a cycle changed. They stay pending if the save
+// fails.
+func (vm *VM) saveChanges(changes []factChange) error {
+	s := &vm.factStore
+	if s.store == nil {
+		return nil
+	}
+	for _, change := range changes {
+		s.recordSet(change.fact, change.new)
+	}
+	return s.flush()
+}
+
+// flush saves the pending writes.
+func (s *storeSync) flush() error {
+	if len(s.set) == 0 && len(s.deleted) == 0 {
+		return nil
+	}
+	deleted := make([]string, 0, len(s.deleted))
+	for name := range s.deleted {
+		deleted = append(deleted, name)
+	}
+	if err := s.store.Save(context.Background(), s.set, deleted); err != nil {
+		return fmt.Errorf("failed to save facts: %w", err)
+	}
+	s.set = make(map[string]interface{})
+	s.deleted = make(map[string]bool)
+	return nil
+}
@@ -0,0 +1,122 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFactStore_SharedBetweenVMs(t *testing.T) {
+	store := NewMemoryFactStore()
+	writer := NewVM(twoRuleProgram())
+	require.NoError(t, writer.SetFactStore(store))
+	writer.SetFact("temperature", 35)
+	require.NoError(t, writer.Run())
+
+	stored, err := store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"temperature": 35, "ac_status": true, "fan_status": true}, stored)
+
+	// Another VM picks up the facts, and the first sees its writes
+	reader := NewVM(twoRuleProgram())
+	require.NoError(t, reader.SetFactStore(store))
+	value, ok := reader.GetFact("ac_status")
+	assert.True(t, ok)
+	assert.Equal(t, true, value)
+	reader.SetFact("ac_status", false)
+	reader.DeleteFact("fan_status")
+	require.NoError(t, reader.Run())
+	require.NoError(t, store.Save(context.Background(), map[string]interface{}{"temperature": 20}, nil))
+	require.NoError(t, writer.Run())
+	assert.Equal(t, map[string]interface{}{"temperature": 20, "ac_status": true, "fan_status": true}, writer.Facts())
+}
+
+func TestFactStore_InitialFactsSeedStore(t *testing.T) {
+	store := NewMemoryFactStore()
+	require.NoError(t, store.Save(context.Background(), map[string]interface{}{"mode": "eco"}, nil))
+	vm := NewVM(twoRuleProgram())
+	vm.facts["mode"] = "initial"
+	vm.facts["state"] = "idle"
+	require.NoError(t, vm.SetFactStore(store))
+	assert.Equal(t, map[string]interface{}{"mode": "eco", "state": "idle"}, vm.Facts(), "the store's facts win")
+
+	vm.SetFact("temperature", 25)
+	require.NoError(t, vm.Run())
+	stored, _ := store.Load(context.Background())
+	assert.Equal(t, "idle", stored["state"])
+}
+
+// flakyStore fails its saves while failing is set.
+type flakyStore struct {
+	*MemoryFactStore
+	failing bool
+}
+
+func (s *flakyStore) Save(ctx context.Context, set map[string]interface{}, deleted []string) error {
+	if s.failing {
+		return errors.New("store unavailable")
+	}
+	return s.MemoryFactStore.Save(ctx, set, deleted)
+}
+
+func TestFactStore_RetriesFailedSaves(t *testing.T) {
+	store := &flakyStore{MemoryFactStore: NewMemoryFactStore()}
+	vm := NewVM(twoRuleProgram())
+	require.NoError(t, vm.SetFactStore(store))
+	vm.SetFact("temperature", 35)
+
+	store.failing = true
+	assert.ErrorContains(t, vm.Run(), "failed to save facts: store unavailable")
+	store.failing = false
+	require.NoError(t, vm.Run())
+	stored, _ := store.Load(context.Background())
+	assert.Equal(t, map[string]interface{}{"temperature": 35, "ac_status": true, "fan_status": true}, stored)
+}
+
+func TestRedisFactStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	server.Set("facts:temperature", "35")
+	server.Set("facts:ratio", "0.5")
+	server.Set("other:temperature", "10")
+
+	store := NewRedisFactStore(client, "facts:")
+	vm := NewVM(twoRuleProgram())
+	require.NoError(t, vm.SetFactStore(store))
+	vm.SetFact("setpoint", 21.0)
+	require.NoError(t, vm.Run())
+
+	for key, want := range map[string]string{"facts:ac_status": "true", "facts:fan_status": "true", "facts:setpoint": "21.0"} {
+		got, err := server.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, key)
+	}
+	loaded, err := store.Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"temperature": 35, "ratio": 0.5, "setpoint": 21.0, "ac_status": true, "fan_status": true,
+	}, loaded)
+
+	// Facts survive a restart
+	restarted := NewVM(twoRuleProgram())
+	require.NoError(t, restarted.SetFactStore(NewRedisFactStore(client, "facts:")))
+	assert.Equal(t, loaded, restarted.Facts())
+	restarted.DeleteFact("ratio")
+	require.NoError(t, restarted.Run())
+	assert.False(t, server.Exists("facts:ratio"))
+}
+
+func TestFormatRedisValue(t *testing.T) {
+	assert.Equal(t, "3.0", formatRedisValue(3.0))
+	assert.Equal(t, "2.5", formatRedisValue(2.5))
+	assert.Equal(t, "1e+21", formatRedisValue(1e21))
+	assert.Equal(t, "3", formatRedisValue(3))
+	assert.Equal(t, "false", formatRedisValue(false))
+	assert.Equal(t, `a\*b\?`, escapeRedisPattern("a*b?"))
+}
@@ -0,0 +1,252 @@
+// runtime/guard.go
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrActionTimeout is returned when an action handler doesn't finish within
+// its timeout.
+var ErrActionTimeout = errors.New("action handler timed out")
+
+// ErrCircuitOpen is returned instead of invoking a handler whose circuit
+// breaker has tripped.
+var ErrCircuitOpen = errors.New("action handler circuit breaker is open")
+
+// ActionPolicy limits how long action handlers may run and when a failing
+// handler type is taken out of service.
+type ActionPolicy struct {
+	// Timeout bounds each handler invocation; 0 means no timeout.
+	Timeout time.Duration
+
+	// RuleTimeouts overrides Timeout for individual rules, identified by
+	// their position in the bytecode.
+	RuleTimeouts map[int]time.Duration
+
+	// FailureThreshold is the number of consecutive failures of a handler
+	// type that trips its circuit breaker; 0 disables the breakers.
+	FailureThreshold int
+
+	// Cooldown is how long a tripped breaker rejects invocations before
+	// letting a single trial invocation through.
+	Cooldown time.Duration
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // Invocations go through
+	BreakerOpen     BreakerState = "open"      // Invocations are rejected
+	BreakerHalfOpen BreakerState = "half-open" // A trial invocation is in progress
+)
+
+// BreakerStatus describes the circuit breaker of a handler type.
+type BreakerStatus struct {
+	HandlerType         string       `json:"handlerType"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutiveFailures"`
+	Trips               int          `json:"trips"`      // Number of times the breaker has opened
+	Timeouts            int          `json:"timeouts"`   // Number of invocations that timed out
+	Rejections          int          `json:"rejections"` // Number of invocations rejected while open
+	OpenedAt            time.Time    `json:"openedAt,omitempty"`
+}
+
+// ActionGuard invokes action handlers with a timeout and a circuit breaker per
+// handler type, so that a hanging or failing downstream system cannot stall
+// the evaluation loop. It is safe for concurrent use.
+type ActionGuard struct {
+	mu       sync.Mutex
+	policy   ActionPolicy
+	breakers map[string]*BreakerStatus
+	clock    Clock
+	inject   func(handlerType string) error // Fails invocations on purpose, for robustness testing
+}
+
+// SetActionPolicy replaces the guard used for the VM's action handlers with one
+// enforcing policy. The state of the previous circuit breakers is discarded.
+func (vm *VM) SetActionPolicy(policy ActionPolicy) {
+	inject := vm.actions.faultInjector()
+	vm.actions = NewActionGuard(policy)
+	vm.actions.SetClock(vm.clock)
+	vm.actions.SetFaultInjector(inject)
+}
+
+// ActionGuard returns the guard used for the VM's action handlers. Embedders
+// performing side effects from hooks can invoke them through it to share the
+// VM's timeouts and circuit breakers.
+func (vm *VM) ActionGuard() *ActionGuard {
+	return vm.actions
+}
+
+// NewActionGuard creates an ActionGuard enforcing policy.
+func NewActionGuard(policy ActionPolicy) *ActionGuard {
+	return &ActionGuard{
+		policy:   policy,
+		breakers: make(map[string]*BreakerStatus),
+		clock:    SystemClock{},
+	}
+}
+
+// SetClock sets the clock timing handler invocations and breaker cooldowns.
+func (g *ActionGuard) SetClock(clock Clock) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.clock = clock
+}
+
+// Clock returns the clock used by the guard.
+func (g *ActionGuard) Clock() Clock {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.clock
+}
+
+// SetFaultInjector makes the guard call inject before every handler
+// invocation. When inject returns an error the handler isn't called and the
+// invocation fails with that error, counting towards the circuit breaker like
+// a failure of the handler. A nil inject removes the injector.
+func (g *ActionGuard) SetFaultInjector(inject func(handlerType string) error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inject = inject
+}
+
+func (g *ActionGuard) faultInjector() func(handlerType string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.inject
+}
+
+// Invoke calls handler on behalf of a rule, unless the circuit breaker of
+// handlerType is open. If the handler doesn't return within the rule's
+// timeout, Invoke returns ErrActionTimeout without waiting for it; the
+// handler's context is cancelled so it can give up its work.
+func (g *ActionGuard) Invoke(rule int, handlerType string, handler func(ctx context.Context) error) error {
+	if err := g.admit(handlerType); err != nil {
+		return err
+	}
+	if inject := g.faultInjector(); inject != nil {
+		if err := inject(handlerType); err != nil {
+			g.record(handlerType, err)
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var expired <-chan time.Time
+	if timeout := g.timeout(rule); timeout > 0 {
+		expired = g.Clock().After(timeout)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- handler(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-expired:
+		err = fmt.Errorf("%s: %w", handlerType, ErrActionTimeout)
+	}
+	g.record(handlerType, err)
+	return err
+}
+
+// Breakers returns the status of the circuit breaker of every handler type
+// invoked so far, sorted by handler type.
+func (g *ActionGuard) Breakers() []BreakerStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	breakers := make([]BreakerStatus, 0, len(g.breakers))
+	for _, breaker := range g.breakers {
+		breakers = append(breakers, *breaker)
+	}
+	sort.Slice(breakers, func(i, j int) bool {
+		return breakers[i].HandlerType < breakers[j].HandlerType
+	})
+	return breakers
+}
+
+// timeout returns the timeout applying to a rule's handlers.
+func (g *ActionGuard) timeout(rule int) time.Duration {
+	if timeout, ok := g.policy.RuleTimeouts[rule]; ok {
+		return timeout
+	}
+	return g.policy.Timeout
+}
+
+// breaker returns the breaker of a handler type, creating it if needed. The
+// caller must hold g.mu.
+func (g *ActionGuard) breaker(handlerType string) *BreakerStatus {
+	breaker, ok := g.breakers[handlerType]
+	if !ok {
+		breaker = &BreakerStatus{HandlerType: handlerType, State: BreakerClosed}
+		g.breakers[handlerType] = breaker
+	}
+	return breaker
+}
+
+// admit decides whether a handler of the given type may be invoked. Once the
+// cooldown of an open breaker has passed, one trial invocation is admitted.
+func (g *ActionGuard) admit(handlerType string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	breaker := g.breaker(handlerType)
+	switch breaker.State {
+	case BreakerOpen:
+		if g.clock.Now().Sub(breaker.OpenedAt) >= g.policy.Cooldown {
+			breaker.State = BreakerHalfOpen
+			return nil
+		}
+	case BreakerHalfOpen:
+		// The trial invocation hasn't finished yet
+	default:
+		return nil
+	}
+
+	breaker.Rejections++
+	return fmt.Errorf("%s: %w", handlerType, ErrCircuitOpen)
+}
+
+// record updates the breaker of a handler type with the outcome of an
+// invocation.
+func (g *ActionGuard) record(handlerType string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	breaker := g.breaker(handlerType)
+	if err == nil {
+		breaker.State = BreakerClosed
+		breaker.ConsecutiveFailures = 0
+		return
+	}
+
+	if errors.Is(err, ErrActionTimeout) {
+		breaker.Timeouts++
+	}
+	breaker.ConsecutiveFailures++
+	if g.policy.FailureThreshold <= 0 {
+		return
+	}
+	if breaker.State == BreakerHalfOpen || breaker.ConsecutiveFailures >= g.policy.FailureThreshold {
+		if breaker.State != BreakerOpen {
+			breaker.Trips++
+			log.Warn().Str("HandlerType", handlerType).Int("Failures", breaker.ConsecutiveFailures).Msg("Action handler circuit breaker tripped")
+		}
+		breaker.State = BreakerOpen
+		breaker.OpenedAt = g.clock.Now()
+	}
+}
@@ -0,0 +1,117 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActionGuard_Timeout(t *testing.T) {
+	guard := NewActionGuard(ActionPolicy{
+		Timeout:      time.Hour,
+		RuleTimeouts: map[int]time.Duration{1: 10 * time.Millisecond},
+	})
+
+	release := make(chan struct{})
+	defer close(release)
+	hang := func(ctx context.Context) error {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	}
+
+	start := time.Now()
+	err := guard.Invoke(1, "webhook", hang)
+	assert.ErrorIs(t, err, ErrActionTimeout)
+	assert.Less(t, time.Since(start), time.Second, "the guard must not wait for a hanging handler")
+
+	require.NoError(t, guard.Invoke(0, "webhook", func(ctx context.Context) error { return nil }))
+
+	breakers := guard.Breakers()
+	require.Len(t, breakers, 1)
+	assert.Equal(t, 1, breakers[0].Timeouts)
+	assert.Equal(t, BreakerClosed, breakers[0].State)
+}
+
+func TestActionGuard_CircuitBreaker(t *testing.T) {
+	clock := NewTestClock(time.Unix(0, 0))
+	guard := NewActionGuard(ActionPolicy{FailureThreshold: 2, Cooldown: time.Minute})
+	guard.SetClock(clock)
+
+	calls := 0
+	failing := func(ctx context.Context) error {
+		calls++
+		return errors.New("connection refused")
+	}
+	succeeding := func(ctx context.Context) error {
+		calls++
+		return nil
+	}
+
+	assert.Error(t, guard.Invoke(0, "webhook", failing))
+	assert.Error(t, guard.Invoke(0, "webhook", failing))
+	assert.Equal(t, 2, calls)
+
+	// The breaker has tripped, so the handler is no longer invoked
+	assert.ErrorIs(t, guard.Invoke(0, "webhook", succeeding), ErrCircuitOpen)
+	assert.Equal(t, 2, calls)
+
+	// Other handler types are unaffected
+	require.NoError(t, guard.Invoke(0, "notify", succeeding))
+
+	// After the cooldown a failing trial reopens the breaker
+	clock.Advance(time.Minute)
+	assert.NotErrorIs(t, guard.Invoke(0, "webhook", failing), ErrCircuitOpen)
+	assert.ErrorIs(t, guard.Invoke(0, "webhook", succeeding), ErrCircuitOpen)
+
+	// A successful trial closes it
+	clock.Advance(time.Minute)
+	require.NoError(t, guard.Invoke(0, "webhook", succeeding))
+	require.NoError(t, guard.Invoke(0, "webhook", succeeding))
+
+	breakers := guard.Breakers()
+	require.Len(t, breakers, 2)
+	assert.Equal(t, "notify", breakers[0].HandlerType)
+	assert.Equal(t, BreakerStatus{
+		HandlerType: "webhook",
+		State:       BreakerClosed,
+		Trips:       2,
+		Rejections:  2,
+		OpenedAt:    time.Unix(0, 0).Add(time.Minute),
+	}, breakers[1])
+}
+
+func TestActionGuard_FaultInjector(t *testing.T) {
+	guard := NewActionGuard(ActionPolicy{})
+	injected := errors.New("injected")
+	guard.SetFaultInjector(func(handlerType string) error {
+		if handlerType == "webhook" {
+			return injected
+		}
+		return nil
+	})
+
+	calls := 0
+	handler := func(ctx context.Context) error {
+		calls++
+		return nil
+	}
+	assert.ErrorIs(t, guard.Invoke(0, "webhook", handler), injected)
+	require.NoError(t, guard.Invoke(0, "email", handler))
+	assert.Equal(t, 1, calls)
+
+	breakers := guard.Breakers()
+	require.Len(t, breakers, 2)
+	assert.Equal(t, "webhook", breakers[1].HandlerType)
+	assert.Equal(t, 1, breakers[1].ConsecutiveFailures)
+
+	guard.SetFaultInjector(nil)
+	require.NoError(t, guard.Invoke(0, "webhook", handler))
+	assert.Equal(t, 2, calls)
+}
@@ -0,0 +1,53 @@
+// runtime/hold.go
+
+package runtime
+
+import "time"
+
+// holdTimer times how long the conditions of a rule with a HOLD instruction
+// have held. It starts the first time the rule reaches its HOLD and is
+// dropped the first time the rule is evaluated without reaching it.
+type holdTimer struct {
+	since time.Time // When the conditions started holding
+	due   time.Time // When the actions may first run
+	fired bool      // Whether the actions have run since the conditions started holding
+}
+
+// hold runs the HOLD instruction of the current rule, whose conditions hold,
+// and reports whether its actions run: once the conditions have held for d,
+// every cycle or, with once, only the first time.
+func (vm *VM) hold(d time.Duration, once bool) bool {
+	vm.reached = true
+	now := vm.clock.Now()
+	timer, ok := vm.holds[vm.rule]
+	if !ok {
+		timer = &holdTimer{since: now, due: now.Add(d)}
+		vm.holds[vm.rule] = timer
+	}
+	if now.Before(timer.due) || (once && timer.fired) {
+		return false
+	}
+	timer.fired = true
+	return true
+}
+
+// nextHold returns the earliest time a rule whose conditions hold may run
+// its actions for the first time, and false if no rule is waiting.
+func (vm *VM) nextHold() (time.Time, bool) {
+	var next time.Time
+	waiting := false
+	for _, timer := range vm.holds {
+		if timer.fired {
+			continue
+		}
+		if !waiting || timer.due.Before(next) {
+			next, waiting = timer.due, true
+		}
+	}
+	return next, waiting
+}
+
+// heldRules selects the rules with a HOLD instruction.
+func heldRules(entry ruleEntry) bool {
+	return entry.held
+}
@@ -0,0 +1,87 @@
+package runtime
+
+import (
+	"context"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// heldProgram builds a program with a rule notifying when the temperature
+// has been above 30 for d.
+func heldProgram(d time.Duration, once bool) []byte {
+	return newProgram().
+		ruleStart(0).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		hold(d, once).
+		loadString("too hot").triggerAction("actionsTest", "ops").
+		label("rule0_end").op(bytecode.RULE_END).
+		bytes()
+}
+
+func TestVM_Hold(t *testing.T) {
+	triggeredActions = nil
+	clock := NewTestClock(time.Unix(0, 0))
+	vm := NewVM(heldProgram(5*time.Minute, false))
+	vm.SetClock(clock)
+
+	vm.SetFacts(map[string]interface{}{"temperature": 35})
+	require.NoError(t, vm.Run())
+	clock.Advance(4 * time.Minute)
+	require.NoError(t, vm.Run())
+	assert.Empty(t, triggeredActions, "the conditions haven't held for 5 minutes yet")
+
+	clock.Advance(time.Minute)
+	require.NoError(t, vm.Run())
+	require.NoError(t, vm.Run())
+	assert.Len(t, triggeredActions, 2, "the actions run every cycle once the conditions have held")
+
+	// The timer starts over once the conditions stop holding
+	vm.SetFacts(map[string]interface{}{"temperature": 20})
+	require.NoError(t, vm.Run())
+	vm.SetFacts(map[string]interface{}{"temperature": 35})
+	clock.Advance(time.Minute)
+	require.NoError(t, vm.Run())
+	assert.Len(t, triggeredActions, 2)
+}
+
+func TestVM_HoldOnce(t *testing.T) {
+	triggeredActions = nil
+	clock := NewTestClock(time.Unix(0, 0))
+	vm := NewVM(heldProgram(0, true))
+	vm.SetClock(clock)
+
+	vm.SetFacts(map[string]interface{}{"temperature": 35})
+	require.NoError(t, vm.Run())
+	require.NoError(t, vm.Run())
+	assert.Len(t, triggeredActions, 1, "the actions run once while the conditions hold")
+
+	vm.SetFacts(map[string]interface{}{"temperature": 20})
+	require.NoError(t, vm.Run())
+	vm.SetFacts(map[string]interface{}{"temperature": 35})
+	require.NoError(t, vm.Run())
+	assert.Len(t, triggeredActions, 2, "and again when they start holding again")
+}
+
+func TestVM_StreamHold(t *testing.T) {
+	clock := NewTestClock(time.Unix(0, 0))
+	vm := NewVM(heldProgram(5*time.Minute, true))
+	vm.SetClock(clock)
+	vm.SetFacts(map[string]interface{}{"temperature": 35})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	actions := make(chan Action)
+	go vm.Stream(ctx, make(chan FactUpdate), actions)
+
+	// The stream waits for the conditions to have held for 5 minutes,
+	// without any update coming
+	require.Eventually(t, func() bool { return clock.Waiters() > 0 }, time.Second, time.Millisecond)
+	clock.Advance(5 * time.Minute)
+	action := <-actions
+	assert.Equal(t, "ops", action.Target)
+}
@@ -0,0 +1,170 @@
+// runtime/hooks.go
+
+package runtime
+
+// BeforeCycleHook is called before the VM starts evaluating the bytecode.
+// Returning an error aborts the cycle before any rule is evaluated.
+type BeforeCycleHook func() error
+
+// AfterRuleHook is called when the VM reaches the end of a rule. The rule is
+// identified by its position in the bytecode, and fired reports whether any of
+// the rule's actions were executed.
+type AfterRuleHook func(rule int, fired bool)
+
+// FactUpdatedHook is called when an updateFact action of a rule writes a
+// fact, with the value written, as the cycle runs. The write is committed
+// with the rest of the cycle's, or not at all if the cycle fails.
+type FactUpdatedHook func(rule int, fact string, value interface{})
+
+// ActionErrorHook is called when an action fails. Returning nil swallows the
+// error and lets the cycle continue; returning a different error aborts the
+// cycle with it. Returning err unchanged leaves the decision to the hooks
+// registered after it, which lets hooks observe errors without handling them.
+type ActionErrorHook func(rule int, err error) error
+
+// RuleErrorHook is called when evaluating a rule fails, including with action
+// errors not handled by an ActionErrorHook. Returning nil swallows the error:
+// the VM resynchronizes at the rule's RULE_END marker and goes on with the
+// next rule. Returning err unchanged passes it on to the hooks registered
+// after it, like ActionErrorHook. Bytecode compiled without rule markers
+// can't be resynchronized, so there errors always abort the cycle.
+type RuleErrorHook func(rule int, err error) error
+
+// ActionSuppressedHook is called when a suppression window withholds an
+// action triggered by a cycle, with the name of the window.
+type ActionSuppressedHook func(action Action, window string)
+
+// ActionPerformedHook is called once the handler of an action triggered by a
+// cycle has run, with the error it failed with (nil on success), before the
+// ActionError hooks see the error. Actions withheld by a suppression window or
+// queued by the degradation policy aren't reported until they are performed.
+type ActionPerformedHook func(action Action, err error)
+
+// AfterCycleHook is called once the cycle has finished, with the error that
+// ended it (nil on success).
+type AfterCycleHook func(err error)
+
+// hooks holds the callbacks registered on a VM.
+type hooks struct {
+	beforeCycle   []BeforeCycleHook
+	afterRule     []AfterRuleHook
+	factUpdated   []FactUpdatedHook
+	onActionError []ActionErrorHook
+	onRuleError   []RuleErrorHook
+	onSuppressed  []ActionSuppressedHook
+	onPerformed   []ActionPerformedHook
+	afterCycle    []AfterCycleHook
+}
+
+// OnBeforeCycle registers a hook that runs before each evaluation cycle.
+func (vm *VM) OnBeforeCycle(hook BeforeCycleHook) {
+	vm.hooks.beforeCycle = append(vm.hooks.beforeCycle, hook)
+}
+
+// OnAfterRule registers a hook that runs after each rule has been evaluated.
+func (vm *VM) OnAfterRule(hook AfterRuleHook) {
+	vm.hooks.afterRule = append(vm.hooks.afterRule, hook)
+}
+
+// OnFactUpdated registers a hook that runs when a rule updates a fact.
+func (vm *VM) OnFactUpdated(hook FactUpdatedHook) {
+	vm.hooks.factUpdated = append(vm.hooks.factUpdated, hook)
+}
+
+// OnActionError registers a hook that runs when an action fails.
+func (vm *VM) OnActionError(hook ActionErrorHook) {
+	vm.hooks.onActionError = append(vm.hooks.onActionError, hook)
+}
+
+// OnRuleError registers a hook that runs when a rule fails.
+func (vm *VM) OnRuleError(hook RuleErrorHook) {
+	vm.hooks.onRuleError = append(vm.hooks.onRuleError, hook)
+}
+
+// OnActionSuppressed registers a hook that runs when a suppression window
+// withholds an action.
+func (vm *VM) OnActionSuppressed(hook ActionSuppressedHook) {
+	vm.hooks.onSuppressed = append(vm.hooks.onSuppressed, hook)
+}
+
+// OnActionPerformed registers a hook that runs when an action has been
+// performed.
+func (vm *VM) OnActionPerformed(hook ActionPerformedHook) {
+	vm.hooks.onPerformed = append(vm.hooks.onPerformed, hook)
+}
+
+// OnAfterCycle registers a hook that runs after each evaluation cycle.
+func (vm *VM) OnAfterCycle(hook AfterCycleHook) {
+	vm.hooks.afterCycle = append(vm.hooks.afterCycle, hook)
+}
+
+// runBeforeCycle calls the BeforeCycle hooks in registration order, stopping at
+// the first error.
+func (h *hooks) runBeforeCycle() error {
+	for _, hook := range h.beforeCycle {
+		if err := hook(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAfterRule calls the AfterRule hooks in registration order.
+func (h *hooks) runAfterRule(rule int, fired bool) {
+	for _, hook := range h.afterRule {
+		hook(rule, fired)
+	}
+}
+
+// runFactUpdated calls the FactUpdated hooks in registration order.
+func (h *hooks) runFactUpdated(rule int, fact string, value interface{}) {
+	for _, hook := range h.factUpdated {
+		hook(rule, fact, value)
+	}
+}
+
+// runActionError passes an action error through the OnActionError hooks until
+// one of them swallows or replaces it. If no hook handles the error it is
+// returned unchanged, so failures abort the cycle by default.
+func (h *hooks) runActionError(rule int, err error) error {
+	for _, hook := range h.onActionError {
+		hookErr := hook(rule, err)
+		if hookErr == nil || hookErr != err {
+			return hookErr
+		}
+	}
+	return err
+}
+
+// runRuleError passes a rule error through the OnRuleError hooks like
+// runActionError.
+func (h *hooks) runRuleError(rule int, err error) error {
+	for _, hook := range h.onRuleError {
+		hookErr := hook(rule, err)
+		if hookErr == nil || hookErr != err {
+			return hookErr
+		}
+	}
+	return err
+}
+
+// runActionSuppressed calls the ActionSuppressed hooks in registration order.
+func (h *hooks) runActionSuppressed(action Action, window string) {
+	for _, hook := range h.onSuppressed {
+		hook(action, window)
+	}
+}
+
+// runActionPerformed calls the ActionPerformed hooks in registration order.
+func (h *hooks) runActionPerformed(action Action, err error) {
+	for _, hook := range h.onPerformed {
+		hook(action, err)
+	}
+}
+
+// runAfterCycle calls the AfterCycle hooks in registration order.
+func (h *hooks) runAfterCycle(err error) {
+	for _, hook := range h.afterCycle {
+		hook(err)
+	}
+}
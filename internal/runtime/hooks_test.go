@@ -0,0 +1,193 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks_CalledInOrder(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	vm.facts["temperature"] = 25
+
+	var calls []string
+	vm.OnBeforeCycle(func() error {
+		calls = append(calls, "before")
+		return nil
+	})
+	vm.OnAfterRule(func(rule int, fired bool) {
+		if fired {
+			calls = append(calls, "fired")
+		} else {
+			calls = append(calls, "skipped")
+		}
+	})
+	vm.OnAfterCycle(func(err error) {
+		assert.NoError(t, err)
+		calls = append(calls, "after")
+	})
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []string{"before", "skipped", "fired", "after"}, calls)
+	assert.Equal(t, true, vm.facts["fan_status"])
+	assert.NotContains(t, vm.facts, "ac_status")
+}
+
+func TestHooks_FactUpdated(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	vm.facts["temperature"] = 35
+
+	var updates []string
+	vm.OnFactUpdated(func(rule int, fact string, value interface{}) {
+		_, committed := vm.facts[fact]
+		assert.False(t, committed, "the update is reported before the cycle commits")
+		updates = append(updates, fmt.Sprintf("%d %s=%v", rule, fact, value))
+	})
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []string{"0 ac_status=true", "1 fan_status=true"}, updates)
+}
+
+func TestHooks_BeforeCycleErrorAbortsCycle(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	vm.facts["temperature"] = 35
+
+	breakerOpen := errors.New("circuit open")
+	var cycleErr error
+	vm.OnBeforeCycle(func() error { return breakerOpen })
+	vm.OnAfterRule(func(rule int, fired bool) {
+		t.Fatalf("rule %d evaluated despite aborted cycle", rule)
+	})
+	vm.OnAfterCycle(func(err error) { cycleErr = err })
+
+	err := vm.Run()
+	assert.ErrorIs(t, err, breakerOpen)
+	assert.ErrorIs(t, cycleErr, breakerOpen)
+	assert.Empty(t, vm.facts["ac_status"])
+}
+
+func TestHooks_ActionErrorSwallowed(t *testing.T) {
+	// The first rule's action has no value on the stack, so it fails
+	code := newProgram().
+		updateFact("ac_status").
+		op(bytecode.RULE_END).
+		loadBool(true).updateFact("fan_status").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+
+	var failedRules []int
+	vm.OnActionError(func(rule int, err error) error {
+		failedRules = append(failedRules, rule)
+		return nil
+	})
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []int{0}, failedRules)
+	assert.Equal(t, true, vm.facts["fan_status"])
+}
+
+func TestHooks_ActionErrorAbortsCycle(t *testing.T) {
+	code := newProgram().
+		updateFact("ac_status").
+		op(bytecode.RULE_END).
+		loadBool(true).updateFact("fan_status").
+		op(bytecode.RULE_END).
+		bytes()
+
+	// Without a hook, action errors abort the cycle
+	vm := NewVM(code)
+	assert.Error(t, vm.Run())
+	assert.NotContains(t, vm.facts, "fan_status")
+
+	// A hook can also escalate the error
+	vm = NewVM(code)
+	escalated := errors.New("escalated")
+	vm.OnActionError(func(rule int, err error) error { return escalated })
+	assert.ErrorIs(t, vm.Run(), escalated)
+	assert.NotContains(t, vm.facts, "fan_status")
+}
+
+func TestHooks_ActionErrorPassThrough(t *testing.T) {
+	code := newProgram().
+		updateFact("ac_status").
+		op(bytecode.RULE_END).
+		loadBool(true).updateFact("fan_status").
+		op(bytecode.RULE_END).
+		bytes()
+
+	// An observing hook that returns the error unchanged defers to later hooks
+	vm := NewVM(code)
+	var observed int
+	vm.OnActionError(func(rule int, err error) error {
+		observed++
+		return err
+	})
+	vm.OnActionError(func(rule int, err error) error { return nil })
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, 1, observed)
+	assert.Equal(t, true, vm.facts["fan_status"])
+
+	// If no hook handles it, the error aborts the cycle
+	vm = NewVM(code)
+	vm.OnActionError(func(rule int, err error) error { return err })
+	assert.Error(t, vm.Run())
+}
+
+func TestHooks_RuleErrorResyncsAtRuleEnd(t *testing.T) {
+	// The first rule compares an undefined fact, the second always fires
+	code := newProgram().
+		ruleStart(0).
+		op(bytecode.COND_START).
+		loadFact("humidity").loadInt(80).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		op(bytecode.COND_END).
+		loadBool(true).updateFact("dehumidifier").
+		label("end").
+		op(bytecode.RULE_END).
+		ruleStart(0).
+		loadBool(true).updateFact("fan_status").
+		op(bytecode.RULE_END).
+		bytes()
+
+	// Without a hook, the error aborts the cycle
+	vm := NewVM(code)
+	assert.ErrorContains(t, vm.Run(), "undefined fact: humidity")
+	assert.NotContains(t, vm.facts, "fan_status")
+
+	vm = NewVM(code)
+	var failedRules []int
+	var firings []bool
+	vm.OnRuleError(func(rule int, err error) error {
+		failedRules = append(failedRules, rule)
+		return nil
+	})
+	vm.OnAfterRule(func(rule int, fired bool) { firings = append(firings, fired) })
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []int{0}, failedRules)
+	assert.Equal(t, []bool{false, true}, firings)
+	assert.NotContains(t, vm.facts, "dehumidifier")
+	assert.Equal(t, true, vm.facts["fan_status"])
+	assert.Empty(t, vm.stack)
+}
+
+func TestHooks_RuleErrorPassThrough(t *testing.T) {
+	code := newProgram().
+		ruleStart(0).
+		loadFact("humidity").jump(bytecode.JUMP_IF_FALSE, "end").
+		label("end").
+		op(bytecode.RULE_END).
+		bytes()
+
+	escalated := errors.New("escalated")
+	vm := NewVM(code)
+	vm.OnRuleError(func(rule int, err error) error { return err })
+	vm.OnRuleError(func(rule int, err error) error { return escalated })
+	assert.ErrorIs(t, vm.Run(), escalated)
+}
@@ -0,0 +1,185 @@
+// runtime/introspect.go
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// ErrUnknownRule is returned for a rule name the bytecode doesn't have.
+var ErrUnknownRule = errors.New("no such rule")
+
+// RuleInfo describes a rule of the bytecode, as decoded from its
+// instructions and from the rules section the preprocessor embeds.
+type RuleInfo struct {
+	Index    int                    `json:"index"`              // Position of the rule in the bytecode, as passed to the hooks
+	Name     string                 `json:"name,omitempty"`     // Empty if the bytecode doesn't name its rules
+	Merged   []string               `json:"merged,omitempty"`   // Rules the optimizer merged into this one
+	Metadata map[string]interface{} `json:"metadata,omitempty"` // Fields of the rule the engine doesn't interpret
+	Priority int                    `json:"priority"`
+	Enabled  bool                   `json:"enabled"`
+	Reads    []string               `json:"reads"`  // Facts and fact patterns the conditions read
+	Writes   []string               `json:"writes"` // Facts the actions write
+}
+
+// ruleSwitches holds the rules disabled by the host. Rules are enabled and
+// disabled from any goroutine, hence the mutex.
+type ruleSwitches struct {
+	mu       sync.Mutex
+	disabled map[int]bool // By rule index
+}
+
+// Rules describes the rules of the bytecode, in bytecode order. Bytecode
+// without rule markers has no rules to describe. It can be called
+// concurrently with Run.
+func (vm *VM) Rules() []RuleInfo {
+	vm.switches.mu.Lock()
+	defer vm.switches.mu.Unlock()
+
+	infos := make([]RuleInfo, len(vm.schedule))
+	for _, entry := range vm.schedule {
+		info := RuleInfo{
+			Index:    entry.index,
+			Priority: entry.priority,
+			Enabled:  !vm.switches.disabled[entry.index],
+			Reads:    append(sortedNames(entry.consumes), entry.patterns...),
+			Writes:   sortedNames(entry.writes),
+		}
+		if entry.index < len(vm.symbols) {
+			symbol := vm.symbols[entry.index]
+			info.Name, info.Merged, info.Metadata = symbol.Name, symbol.Merged, symbol.Metadata
+		}
+		infos[entry.index] = info
+	}
+	return infos
+}
+
+// ruleName returns the name of a rule, from the rules section or the rule
+// directory, or "" if the bytecode doesn't name its rules.
+func (vm *VM) ruleName(rule int) string {
+	if rule < len(vm.symbols) {
+		return vm.symbols[rule].Name
+	}
+	if rule < len(vm.directory) {
+		return vm.directory[rule].Name
+	}
+	return ""
+}
+
+// checkDirectory checks that a rule directory locates the scheduled rules,
+// in bytecode order, where their code is.
+func checkDirectory(directory bytecode.RuleDirectory, schedule []ruleEntry) error {
+	if len(directory) != len(schedule) {
+		return fmt.Errorf("rule directory lists %d rules, the code has %d", len(directory), len(schedule))
+	}
+	for _, entry := range schedule {
+		located := directory[entry.index]
+		if located.Offset != entry.start || located.Offset+located.Length != entry.end || located.Priority != entry.priority {
+			return fmt.Errorf("rule directory locates rule %d ('%s') at offset %d, length %d, priority %d; the code has it at offset %d, length %d, priority %d",
+				entry.index, located.Name, located.Offset, located.Length, located.Priority, entry.start, entry.end-entry.start, entry.priority)
+		}
+	}
+	return nil
+}
+
+// RuleIndex returns the index of the rule with the given name, if the
+// bytecode names its rules. It can be called concurrently with Run and
+// Reload.
+func (vm *VM) RuleIndex(name string) (int, bool) {
+	vm.switches.mu.Lock()
+	defer vm.switches.mu.Unlock()
+	return vm.ruleIndex(name)
+}
+
+func (vm *VM) ruleIndex(name string) (int, bool) {
+	for i := range vm.schedule {
+		if vm.ruleName(i) == name && name != "" {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// SetRuleEnabled enables or disables a rule from the next cycle on. A
+// disabled rule is skipped, even when chained to, and the time its
+// conditions have held starts over once it is enabled again. Rules start
+// out enabled. It can be called concurrently with Run.
+func (vm *VM) SetRuleEnabled(rule int, enabled bool) error {
+	vm.switches.mu.Lock()
+	defer vm.switches.mu.Unlock()
+	return vm.setRuleEnabled(rule, enabled)
+}
+
+// setRuleEnabled enables or disables a rule, with the switches locked.
+func (vm *VM) setRuleEnabled(rule int, enabled bool) error {
+	if rule < 0 || rule >= len(vm.schedule) {
+		return fmt.Errorf("no rule %d in the bytecode", rule)
+	}
+	if enabled {
+		delete(vm.switches.disabled, rule)
+		return nil
+	}
+	if vm.switches.disabled == nil {
+		vm.switches.disabled = make(map[int]bool)
+	}
+	vm.switches.disabled[rule] = true
+	return nil
+}
+
+// EnableRule enables the named rule from the next cycle on, like
+// SetRuleEnabled. The rule is looked up by the names the rules section or the
+// rule directory of the bytecode gives. It can be called concurrently with
+// Run.
+func (vm *VM) EnableRule(name string) error {
+	return vm.setNamedRuleEnabled(name, true)
+}
+
+// DisableRule disables the named rule from the next cycle on, like
+// SetRuleEnabled, as a kill switch for a misbehaving rule. A rule the
+// optimizer merged into another can't be disabled on its own. It can be
+// called concurrently with Run.
+func (vm *VM) DisableRule(name string) error {
+	return vm.setNamedRuleEnabled(name, false)
+}
+
+func (vm *VM) setNamedRuleEnabled(name string, enabled bool) error {
+	vm.switches.mu.Lock()
+	defer vm.switches.mu.Unlock()
+	rule, ok := vm.ruleIndex(name)
+	if !ok {
+		for _, symbol := range vm.symbols {
+			if slices.Contains(symbol.Merged, name) {
+				return fmt.Errorf("rule '%s' was merged into rule '%s' and can't be switched on its own", name, symbol.Name)
+			}
+		}
+		return fmt.Errorf("%w: '%s'", ErrUnknownRule, name)
+	}
+	return vm.setRuleEnabled(rule, enabled)
+}
+
+// ruleDisabled reports whether a rule is disabled. A disabled rule's HOLD
+// timer is discarded.
+func (vm *VM) ruleDisabled(entry ruleEntry) bool {
+	vm.switches.mu.Lock()
+	disabled := vm.switches.disabled[entry.index]
+	vm.switches.mu.Unlock()
+	if disabled {
+		delete(vm.holds, entry.index)
+	}
+	return disabled
+}
+
+// sortedNames returns the names in a set, sorted.
+func sortedNames(set map[string]bool) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
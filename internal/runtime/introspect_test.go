@@ -0,0 +1,115 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_Rules(t *testing.T) {
+	section, err := bytecode.NewRulesSection([]bytecode.RuleSymbol{
+		{Name: "fan", Metadata: map[string]interface{}{"owner": "facilities"}},
+		{Name: "cooling", Merged: []string{"alsoCooling"}},
+	})
+	require.NoError(t, err)
+	vm := NewVM(bytecode.AppendSections(chainedProgram(), section))
+
+	assert.Equal(t, []RuleInfo{
+		{Index: 0, Name: "fan", Metadata: map[string]interface{}{"owner": "facilities"}, Priority: 20, Enabled: true,
+			Reads: []string{"ac_status"}, Writes: []string{"fan_status"}},
+		{Index: 1, Name: "cooling", Merged: []string{"alsoCooling"}, Priority: 10, Enabled: true,
+			Reads: []string{"temperature"}, Writes: []string{"ac_status"}},
+	}, vm.Rules())
+
+	index, ok := vm.RuleIndex("cooling")
+	assert.True(t, ok)
+	assert.Equal(t, 1, index)
+	_, ok = vm.RuleIndex("alsoCooling")
+	assert.False(t, ok)
+
+	unnamed := NewVM(chainedProgram()).Rules()
+	require.Len(t, unnamed, 2)
+	assert.Empty(t, unnamed[0].Name)
+	assert.Equal(t, []string{"fan_status"}, unnamed[0].Writes)
+}
+
+func TestVM_SetRuleEnabled(t *testing.T) {
+	vm := NewVM(chainedProgram())
+	vm.SetMaxChainDepth(5)
+	vm.SetFacts(map[string]interface{}{"temperature": 35, "ac_status": false})
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) {
+		evaluated = append(evaluated, rule)
+	})
+
+	require.NoError(t, vm.SetRuleEnabled(0, false))
+	assert.False(t, vm.Rules()[0].Enabled)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []int{1}, evaluated, "a disabled rule isn't evaluated, even when chained to")
+	assert.Equal(t, true, vm.facts["ac_status"])
+	assert.NotContains(t, vm.facts, "fan_status")
+
+	evaluated = nil
+	require.NoError(t, vm.SetRuleEnabled(0, true))
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []int{0, 1}, evaluated)
+	assert.Equal(t, true, vm.facts["fan_status"])
+
+	assert.Error(t, vm.SetRuleEnabled(2, false))
+}
+
+func TestVM_DisableRule(t *testing.T) {
+	section, err := bytecode.NewRulesSection([]bytecode.RuleSymbol{{Name: "fan"}, {Name: "cooling", Merged: []string{"alsoCooling"}}})
+	require.NoError(t, err)
+	vm := NewVM(bytecode.AppendSections(chainedProgram(), section))
+	vm.SetFacts(map[string]interface{}{"temperature": 35, "ac_status": false})
+
+	require.NoError(t, vm.DisableRule("cooling"))
+	assert.False(t, vm.Rules()[1].Enabled)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, false, vm.facts["ac_status"])
+
+	require.NoError(t, vm.EnableRule("cooling"))
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["ac_status"])
+
+	assert.ErrorIs(t, vm.DisableRule("heating"), ErrUnknownRule)
+	assert.EqualError(t, vm.DisableRule("alsoCooling"), "rule 'alsoCooling' was merged into rule 'cooling' and can't be switched on its own")
+	assert.ErrorIs(t, NewVM(chainedProgram()).DisableRule("fan"), ErrUnknownRule, "rules without names can't be switched by name")
+}
+
+func TestVM_RuleDirectory(t *testing.T) {
+	code := newProgram().
+		ruleStart(20).
+		loadBool(true).updateFact("fan_status").
+		op(bytecode.RULE_END).
+		ruleStart(10).
+		raise(0).
+		op(bytecode.RULE_END).
+		bytes()
+	schedule := NewVM(code).schedule
+	directory := bytecode.RuleDirectory{
+		{Name: "fan", Priority: 20, Offset: schedule[0].start, Length: schedule[0].end - schedule[0].start, Facts: []int{}},
+		{Name: "broken", Priority: 10, Offset: schedule[1].start, Length: schedule[1].end - schedule[1].start, Facts: []int{}},
+	}
+	section, err := bytecode.NewRuleDirectorySection(directory)
+	require.NoError(t, err)
+	messages, err := bytecode.NewMessagesSection([]string{"cannot compare"})
+	require.NoError(t, err)
+
+	vm := NewVM(bytecode.AppendSections(code, section, messages))
+	assert.Equal(t, directory, vm.directory)
+	var vmErr *VMError
+	require.ErrorAs(t, vm.Run(), &vmErr)
+	assert.Equal(t, "broken", vmErr.Rule, "the directory names the failing rule")
+	assert.ErrorContains(t, vmErr, "in rule 'broken': cannot compare")
+
+	// A directory not matching the code is ignored
+	directory[1].Offset++
+	section, err = bytecode.NewRuleDirectorySection(directory)
+	require.NoError(t, err)
+	vm = NewVM(bytecode.AppendSections(code, section))
+	assert.Nil(t, vm.directory)
+}
@@ -0,0 +1,42 @@
+// runtime/limits.go
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+)
+
+// ErrLimitExceeded is returned when the estimated cost of a program exceeds
+// the runtime's limits.
+var ErrLimitExceeded = errors.New("program exceeds runtime limits")
+
+// Limits bounds the worst-case cost of the programs a runtime accepts. Zero
+// fields are unlimited.
+type Limits struct {
+	MaxInstructions int // Instructions executed by one pass over the rules
+	MaxStackDepth   int
+}
+
+// Cost returns the worst-case evaluation cost the compiler embedded in the
+// bytecode, if any.
+func (vm *VM) Cost() (bytecode.Cost, bool, error) {
+	return bytecode.ReadCost(vm.sections)
+}
+
+// CheckLimits checks the cost embedded in the bytecode against limits.
+// Bytecode compiled without a cost estimate passes the check.
+func (vm *VM) CheckLimits(limits Limits) error {
+	cost, ok, err := vm.Cost()
+	if err != nil || !ok {
+		return err
+	}
+	if limits.MaxInstructions > 0 && cost.Instructions > limits.MaxInstructions {
+		return fmt.Errorf("%w: up to %d instructions per cycle, limit is %d", ErrLimitExceeded, cost.Instructions, limits.MaxInstructions)
+	}
+	if limits.MaxStackDepth > 0 && cost.MaxStackDepth > limits.MaxStackDepth {
+		return fmt.Errorf("%w: stack depth up to %d, limit is %d", ErrLimitExceeded, cost.MaxStackDepth, limits.MaxStackDepth)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_CheckLimits(t *testing.T) {
+	section, err := bytecode.NewCostSection(bytecode.Cost{Instructions: 120, MaxStackDepth: 3})
+	require.NoError(t, err)
+	code := newProgram().loadBool(true).updateFact("fan_status").op(bytecode.RULE_END).bytes()
+	vm := NewVM(bytecode.AppendSections(code, section))
+
+	assert.NoError(t, vm.CheckLimits(Limits{}))
+	assert.NoError(t, vm.CheckLimits(Limits{MaxInstructions: 120, MaxStackDepth: 3}))
+	assert.ErrorIs(t, vm.CheckLimits(Limits{MaxInstructions: 100}), ErrLimitExceeded)
+	assert.ErrorIs(t, vm.CheckLimits(Limits{MaxStackDepth: 2}), ErrLimitExceeded)
+
+	// Bytecode without a cost estimate can't be checked
+	assert.NoError(t, NewVM(code).CheckLimits(Limits{MaxInstructions: 1, MaxStackDepth: 1}))
+}
@@ -0,0 +1,204 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expressionProgram builds a rule in the form emitted by the compiler's
+// boolean expression mode for (temperature > 30 AND NOT window_open) OR override.
+func expressionProgram() []byte {
+	return newProgram().
+		ruleStart(0).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		loadFact("window_open").op(bytecode.NOT).
+		op(bytecode.AND).
+		loadFact("override").
+		op(bytecode.OR).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		loadBool(true).updateFact("ac_status").
+		label("end").op(bytecode.RULE_END).
+		bytes()
+}
+
+func TestLogicalOpcodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		temperature int
+		windowOpen  bool
+		override    bool
+		fires       bool
+	}{
+		{"hot and closed", 35, false, false, true},
+		{"hot and open", 35, true, false, false},
+		{"cool and closed", 20, false, false, false},
+		{"override", 20, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVM(expressionProgram())
+			vm.facts["temperature"] = tt.temperature
+			vm.facts["window_open"] = tt.windowOpen
+			vm.facts["override"] = tt.override
+
+			require.NoError(t, vm.Run())
+			if tt.fires {
+				assert.Equal(t, true, vm.facts["ac_status"])
+			} else {
+				assert.NotContains(t, vm.facts, "ac_status")
+			}
+		})
+	}
+}
+
+func TestFactExists(t *testing.T) {
+	// Record a baseline from the first reading, when there is none yet
+	program := newProgram().
+		ruleStart(0).
+		factExists("reading").
+		factExists("baseline").op(bytecode.NOT).
+		op(bytecode.AND).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		loadBool(true).updateFact("baseline").
+		label("end").op(bytecode.RULE_END).
+		bytes()
+
+	vm := NewVM(program)
+	require.NoError(t, vm.Run(), "testing an unset fact doesn't fail the rule")
+	assert.NotContains(t, vm.Facts(), "baseline")
+
+	vm.SetFact("reading", 12)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.Facts()["baseline"])
+
+	// A fact set to a false or zero value exists
+	vm.SetFact("baseline", false)
+	vm.SetFact("reading", 0)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, false, vm.Facts()["baseline"])
+}
+
+func TestScore(t *testing.T) {
+	// Score 2.5 for a large amount and 1 for a foreign country, firing at 3
+	program := newProgram().
+		ruleStart(0).
+		loadFloat(0).
+		loadFact("amount").loadInt(1000).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "foreign").
+		loadFloat(2.5).op(bytecode.ADD_FLOAT).
+		label("foreign").
+		loadFact("country").loadString("home").op(bytecode.NEQ_STRING).
+		jump(bytecode.JUMP_IF_FALSE, "total").
+		loadInt(1).op(bytecode.ADD_FLOAT).
+		label("total").
+		storeFact("risk").
+		loadFloat(3).op(bytecode.GTE_FLOAT).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		loadBool(true).updateFact("review").
+		label("end").op(bytecode.RULE_END).
+		bytes()
+
+	vm := NewVM(program)
+	var fired bool
+	vm.OnAfterRule(func(rule int, ruleFired bool) { fired = ruleFired })
+
+	vm.SetFacts(map[string]interface{}{"amount": 5000, "country": "home"})
+	require.NoError(t, vm.Run())
+	assert.Equal(t, 2.5, vm.Facts()["risk"])
+	assert.False(t, fired, "storing the score doesn't fire the rule")
+	assert.NotContains(t, vm.Facts(), "review")
+
+	vm.SetFact("country", "abroad")
+	require.NoError(t, vm.Run())
+	assert.Equal(t, 3.5, vm.Facts()["risk"])
+	assert.True(t, fired)
+	assert.Equal(t, true, vm.Facts()["review"])
+
+	vm = NewVM(newProgram().loadFloat(0).loadString("high").op(bytecode.ADD_FLOAT).bytes())
+	assert.ErrorContains(t, vm.Run(), "cannot add float64 and string as numbers")
+}
+
+func TestLogicalOpcodes_NonBoolOperand(t *testing.T) {
+	vm := NewVM(expressionProgram())
+	vm.facts["temperature"] = 35
+	vm.facts["window_open"] = "no"
+	vm.facts["override"] = false
+
+	err := vm.Run()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected a bool operand")
+}
+
+func TestBoolEqualityOpcodes(t *testing.T) {
+	compare := func(opcode bytecode.Opcode, value bool) []byte {
+		return newProgram().loadFact("room_occupied").loadBool(value).op(opcode).bytes()
+	}
+
+	tests := []struct {
+		name     string
+		occupied interface{}
+		code     []byte
+		expected bool
+	}{
+		{"equal", true, compare(bytecode.EQ_BOOL, true), true},
+		{"not equal", true, compare(bytecode.EQ_BOOL, false), false},
+		{"notEqual", false, compare(bytecode.NEQ_BOOL, true), true},
+		{"notEqual same", false, compare(bytecode.NEQ_BOOL, false), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := NewVM(tt.code)
+			vm.facts["room_occupied"] = tt.occupied
+			require.NoError(t, vm.Run())
+			require.Len(t, vm.stack, 1)
+			assert.Equal(t, tt.expected, vm.stack[0])
+		})
+	}
+
+	vm := NewVM(compare(bytecode.EQ_BOOL, true))
+	vm.facts["room_occupied"] = 1
+	assert.ErrorContains(t, vm.Run(), "expected a bool operand")
+}
+
+func TestStringAndJumpOpcodes_WrongTypeOperand(t *testing.T) {
+	for _, opcode := range []bytecode.Opcode{bytecode.EQ_STRING, bytecode.NEQ_STRING, bytecode.CONTAINS_STRING, bytecode.NOT_CONTAINS_STRING} {
+		vm := NewVM(newProgram().loadFact("mode").loadString("eco").op(opcode).bytes())
+		vm.facts["mode"] = 3
+
+		var err error
+		assert.NotPanics(t, func() { err = vm.Run() })
+		var vmErr *VMError
+		require.ErrorAs(t, err, &vmErr, opcode.String())
+		assert.Equal(t, "expected a string operand, got int", vmErr.Message)
+	}
+
+	for _, opcode := range []bytecode.Opcode{bytecode.JUMP_IF_TRUE, bytecode.JUMP_IF_FALSE} {
+		vm := NewVM(newProgram().loadFact("open").jump(opcode, "end").label("end").bytes())
+		vm.facts["open"] = "yes"
+
+		var err error
+		assert.NotPanics(t, func() { err = vm.Run() })
+		var vmErr *VMError
+		require.ErrorAs(t, err, &vmErr, opcode.String())
+		assert.Equal(t, "expected a bool operand, got string", vmErr.Message)
+	}
+}
+
+func TestVM_PanicIsVMError(t *testing.T) {
+	RegisterOperator("panicTest", func(fact, value interface{}) (bool, error) {
+		panic("operator bug")
+	})
+
+	vm := NewVM(newProgram().loadFact("host").loadString("web-").callOperator("panicTest").bytes())
+	vm.facts["host"] = "web-01"
+	var err error
+	assert.NotPanics(t, func() { err = vm.Run() })
+	var vmErr *VMError
+	require.ErrorAs(t, err, &vmErr)
+	assert.Equal(t, "operator bug", vmErr.Message)
+}
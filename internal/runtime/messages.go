@@ -0,0 +1,130 @@
+// runtime/messages.go
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Message is the message of a sendMessage action, as delivered to a
+// MessageSink.
+type Message struct {
+	Target        string      `json:"target"`
+	Content       interface{} `json:"content"`
+	Rule          int         `json:"rule"`
+	CorrelationID string      `json:"correlationId,omitempty"`
+	RulesetHash   string      `json:"rulesetHash,omitempty"`
+}
+
+// MessageSink delivers the messages of sendMessage actions somewhere: to a
+// file, an HTTP endpoint, a message broker or the host itself. Send should
+// give up when ctx is done. A MessageSink may be used concurrently.
+type MessageSink interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// MessageRouter delivers the messages of sendMessage actions to the sink of
+// their target, or to the default sink for the targets without one of their
+// own. Register its Handle method as the handler of sendMessage actions:
+//
+//	runtime.RegisterActionHandler(rules.ActionSendMessage, router.Handle)
+type MessageRouter struct {
+	Targets map[string]MessageSink
+	Default MessageSink // nil fails the messages of unrouted targets
+}
+
+// Handle performs a sendMessage action through the sink of its target.
+func (r *MessageRouter) Handle(ctx context.Context, action Action) error {
+	sink, ok := r.Targets[action.Target]
+	if !ok {
+		sink = r.Default
+	}
+	if sink == nil {
+		return fmt.Errorf("no message sink for target %s", action.Target)
+	}
+	return sink.Send(ctx, Message{
+		Target:        action.Target,
+		Content:       action.Value,
+		Rule:          action.Rule,
+		CorrelationID: action.CorrelationID,
+		RulesetHash:   action.RulesetHash,
+	})
+}
+
+// WriterSink writes each message to W as a line of JSON, e.g. to os.Stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+// Send implements MessageSink.
+func (s *WriterSink) Send(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.W.Write(append(line, '\n'))
+	return err
+}
+
+// WebhookSink POSTs each message as JSON to URL, failing on a non-2xx
+// response.
+type WebhookSink struct {
+	URL     string
+	Headers map[string]string // Added to each request, e.g. an Authorization header
+	Client  *http.Client      // Defaults to a client with a 10 second timeout
+}
+
+// Send implements MessageSink.
+func (s *WebhookSink) Send(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.Headers {
+		req.Header.Set(name, value)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("message webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ChannelSink sends each message on a channel, for hosts consuming the
+// messages themselves. Send blocks until the message is received or ctx is
+// done.
+type ChannelSink chan<- Message
+
+// Send implements MessageSink.
+func (s ChannelSink) Send(ctx context.Context, msg Message) error {
+	select {
+	case s <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,75 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageRouter(t *testing.T) {
+	ops, other := make(chan Message, 1), make(chan Message, 1)
+	router := &MessageRouter{Targets: map[string]MessageSink{"ops": ChannelSink(ops)}, Default: ChannelSink(other)}
+
+	action := Action{Rule: 3, Type: rules.ActionSendMessage, Target: "ops", Value: "too hot", CorrelationID: "c1", RulesetHash: "abc"}
+	require.NoError(t, router.Handle(context.Background(), action))
+	assert.Equal(t, Message{Target: "ops", Content: "too hot", Rule: 3, CorrelationID: "c1", RulesetHash: "abc"}, <-ops)
+
+	action.Target = "facilities"
+	require.NoError(t, router.Handle(context.Background(), action))
+	assert.Equal(t, "facilities", (<-other).Target)
+
+	router.Default = nil
+	assert.EqualError(t, router.Handle(context.Background(), action), "no message sink for target facilities")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, ChannelSink(make(chan Message)).Send(ctx, Message{}), context.Canceled)
+}
+
+func TestWriterSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := &WriterSink{W: &out}
+	require.NoError(t, sink.Send(context.Background(), Message{Target: "ops", Content: 42, Rule: 1}))
+	assert.Equal(t, `{"target":"ops","content":42,"rule":1}`+"\n", out.String())
+}
+
+func TestWebhookSink(t *testing.T) {
+	var received Message
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{URL: server.URL + "/messages", Headers: map[string]string{"Authorization": "Bearer secret"}}
+	require.NoError(t, sink.Send(context.Background(), Message{Target: "ops", Content: "too hot", CorrelationID: "c1"}))
+	assert.Equal(t, Message{Target: "ops", Content: "too hot", CorrelationID: "c1"}, received)
+	assert.Equal(t, "Bearer secret", authorization)
+
+	sink.URL = server.URL + "/down"
+	assert.EqualError(t, sink.Send(context.Background(), Message{}), "message webhook returned 503 Service Unavailable")
+}
+
+func TestVM_SendMessage(t *testing.T) {
+	code := newProgram().
+		ruleStart(0).
+		loadString("too hot").triggerAction(rules.ActionSendMessage, "ops").
+		op(bytecode.RULE_END).
+		bytes()
+
+	// Without a registered handler, messages are logged
+	require.NoError(t, NewVM(code).Run())
+}
@@ -0,0 +1,171 @@
+// runtime/numeric.go
+
+package runtime
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+)
+
+// numericOp pops two numbers and pushes the result of comparing them.
+//
+// Integers and floats may be mixed: if both operands are integers and intCmp
+// is given they are compared exactly (including int64 against uint64) and
+// intCmp receives -1, 0 or 1; otherwise both are promoted to float64 and
+// compared with floatCmp. This matches the coercion policy the compiler
+// applies to constants. Non-numeric operands are reported as an error rather
+// than causing a panic.
+func (vm *VM) numericOp(intCmp func(c int) bool, floatCmp func(a, b float64) bool) error {
+	b, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	a, err := vm.pop()
+	if err != nil {
+		return err
+	}
+
+	if intCmp != nil {
+		if c, ok := compareIntegers(a, b); ok {
+			vm.stack = append(vm.stack, intCmp(c))
+			return nil
+		}
+	}
+
+	floatA, okA := toFloat64(a)
+	floatB, okB := toFloat64(b)
+	if !okA || !okB {
+		return &VMError{Message: fmt.Sprintf("cannot compare %T with %T as numbers", a, b), IP: vm.ip}
+	}
+	vm.stack = append(vm.stack, floatCmp(floatA, floatB))
+	return nil
+}
+
+// addFloat pops two numbers and pushes their sum as a float64.
+func (vm *VM) addFloat() error {
+	b, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	a, err := vm.pop()
+	if err != nil {
+		return err
+	}
+
+	floatA, okA := toFloat64(a)
+	floatB, okB := toFloat64(b)
+	if !okA || !okB {
+		return &VMError{Message: fmt.Sprintf("cannot add %T and %T as numbers", a, b), IP: vm.ip}
+	}
+	vm.stack = append(vm.stack, floatA+floatB)
+	return nil
+}
+
+// withinEpsilon reports whether two numbers are at most epsilon apart. NaN is
+// never within any distance of a number.
+func withinEpsilon(a, b, epsilon float64) bool {
+	return math.Abs(a-b) <= epsilon
+}
+
+// equalityOp implements EQ_INT and NEQ_INT. The compiler also uses them for
+// bool conditions, so two bools are compared directly; anything else is
+// compared as numbers.
+func (vm *VM) equalityOp(equal bool) error {
+	if len(vm.stack) >= 2 {
+		a, okA := vm.stack[len(vm.stack)-2].(bool)
+		b, okB := vm.stack[len(vm.stack)-1].(bool)
+		if okA && okB {
+			vm.stack = append(vm.stack[:len(vm.stack)-2], (a == b) == equal)
+			return nil
+		}
+	}
+
+	return vm.numericOp(
+		func(c int) bool { return (c == 0) == equal },
+		func(a, b float64) bool { return (a == b) == equal },
+	)
+}
+
+// compareIntegers compares two integer values of any width and signedness
+// without loss of precision, returning -1, 0 or 1.
+func compareIntegers(a, b interface{}) (int, bool) {
+	intA, signedA := toInt64(a)
+	intB, signedB := toInt64(b)
+	uintA, unsignedA := toUint64(a)
+	uintB, unsignedB := toUint64(b)
+
+	switch {
+	case signedA && signedB:
+		return cmp.Compare(intA, intB), true
+	case unsignedA && unsignedB:
+		return cmp.Compare(uintA, uintB), true
+	case signedA && unsignedB:
+		if intA < 0 {
+			return -1, true
+		}
+		return cmp.Compare(uint64(intA), uintB), true
+	case unsignedA && signedB:
+		if intB < 0 {
+			return 1, true
+		}
+		return cmp.Compare(uintA, uint64(intB)), true
+	default:
+		return 0, false
+	}
+}
+
+// toInt64 converts an integer value of any width to int64.
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// toUint64 converts the unsigned integer types that don't always fit in an
+// int64 to uint64.
+func toUint64(value interface{}) (uint64, bool) {
+	switch v := value.(type) {
+	case uint:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// toFloat64 converts any integer or float value to float64.
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	if i, ok := toInt64(value); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
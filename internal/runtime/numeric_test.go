@@ -0,0 +1,157 @@
+package runtime
+
+import (
+	"encoding/binary"
+	"math"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNumericComparison_Coercion(t *testing.T) {
+	testCases := []struct {
+		name     string
+		factName string
+		fact     interface{}
+		code     []byte
+		expected bool
+	}{
+		{
+			name:     "Int fact against float constant",
+			factName: "temperature",
+			fact:     30,
+			code:     newProgram().loadFact("temperature").loadFloat(29.5).op(bytecode.GT_INT).bytes(),
+			expected: true,
+		},
+		{
+			name:     "Float fact against int constant",
+			factName: "temperature",
+			fact:     29.9,
+			code:     newProgram().loadFact("temperature").loadInt(30).op(bytecode.GTE_INT).bytes(),
+			expected: false,
+		},
+		{
+			name:     "Int fact with float opcode",
+			factName: "temperature",
+			fact:     30,
+			code:     newProgram().loadFact("temperature").loadFloat(30).op(bytecode.EQ_FLOAT).bytes(),
+			expected: true,
+		},
+		{
+			name:     "Int64 fact against int constant",
+			factName: "temperature",
+			fact:     int64(30),
+			code:     newProgram().loadFact("temperature").loadInt(30).op(bytecode.EQ_INT).bytes(),
+			expected: true,
+		},
+		{
+			name:     "Int64 fact differing beyond float64 precision",
+			factName: "deviceId",
+			fact:     int64(9007199254740993),
+			code:     newProgram().loadFact("deviceId").loadInt64(9007199254740992).op(bytecode.EQ_INT).bytes(),
+			expected: false,
+		},
+		{
+			name:     "Uint64 fact against uint64 constant",
+			factName: "counter",
+			fact:     uint64(18446744073709551615),
+			code:     newProgram().loadFact("counter").loadUint64(18446744073709551614).op(bytecode.GT_INT).bytes(),
+			expected: true,
+		},
+		{
+			name:     "Negative int fact against uint64 constant",
+			factName: "counter",
+			fact:     -1,
+			code:     newProgram().loadFact("counter").loadUint64(18446744073709551615).op(bytecode.LT_INT).bytes(),
+			expected: true,
+		},
+		{
+			name:     "Float32 fact against float constant",
+			factName: "temperature",
+			fact:     float32(12.5),
+			code:     newProgram().loadFact("temperature").loadFloat(12.5).op(bytecode.LTE_FLOAT).bytes(),
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := NewVM(tc.code)
+			vm.facts[tc.factName] = tc.fact
+			require.NoError(t, vm.Run())
+			require.Len(t, vm.stack, 1)
+			assert.Equal(t, tc.expected, vm.stack[0])
+		})
+	}
+}
+
+func TestNumericComparison_NonNumericOperand(t *testing.T) {
+	code := newProgram().loadFact("temperature").loadInt(30).op(bytecode.GT_INT).bytes()
+	vm := NewVM(code)
+	vm.facts["temperature"] = "hot"
+
+	var err error
+	assert.NotPanics(t, func() { err = vm.Run() })
+	var vmErr *VMError
+	require.ErrorAs(t, err, &vmErr)
+	assert.Contains(t, vmErr.Message, "cannot compare string with int")
+}
+
+func TestNumericComparison_Epsilon(t *testing.T) {
+	compareWithin := func(opcode bytecode.Opcode, value interface{}, epsilon float64) []byte {
+		p := newProgram().loadFact("temperature")
+		switch v := value.(type) {
+		case int:
+			p.loadInt(v)
+		case float64:
+			p.loadFloat(v)
+		}
+		p.op(opcode)
+		p.code = binary.LittleEndian.AppendUint64(p.code, math.Float64bits(epsilon))
+		return p.bytes()
+	}
+
+	testCases := []struct {
+		name     string
+		fact     interface{}
+		code     []byte
+		expected bool
+	}{
+		{"Within epsilon", 21.49, compareWithin(bytecode.EQ_FLOAT_EPSILON, 21.5, 0.05), true},
+		{"At epsilon", 22.5, compareWithin(bytecode.EQ_FLOAT_EPSILON, 21.5, 1), true},
+		{"Beyond epsilon", 21.6, compareWithin(bytecode.EQ_FLOAT_EPSILON, 21.5, 0.05), false},
+		{"Int fact against float", 21, compareWithin(bytecode.EQ_FLOAT_EPSILON, 21.0001, 0.001), true},
+		{"Int constant", 39.5, compareWithin(bytecode.EQ_FLOAT_EPSILON, 40, 1), true},
+		{"Not equal beyond epsilon", 21.6, compareWithin(bytecode.NEQ_FLOAT_EPSILON, 21.5, 0.05), true},
+		{"Not equal within epsilon", 21.49, compareWithin(bytecode.NEQ_FLOAT_EPSILON, 21.5, 0.05), false},
+		{"NaN is never equal", math.NaN(), compareWithin(bytecode.EQ_FLOAT_EPSILON, 21.5, 1), false},
+		{"NaN is always not equal", math.NaN(), compareWithin(bytecode.NEQ_FLOAT_EPSILON, 21.5, 1), true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := NewVM(tc.code)
+			vm.facts["temperature"] = tc.fact
+			require.NoError(t, vm.Run())
+			require.Len(t, vm.stack, 1)
+			assert.Equal(t, tc.expected, vm.stack[0])
+		})
+	}
+}
+
+func TestCompareWithin(t *testing.T) {
+	holds, err := CompareWithin("equal", 20.004, 20, 0.01)
+	require.NoError(t, err)
+	assert.True(t, holds)
+
+	holds, err = CompareWithin("notEqual", 20.004, 20, 0.01)
+	require.NoError(t, err)
+	assert.False(t, holds)
+
+	_, err = CompareWithin("lessThan", 20.004, 20, 0.01)
+	assert.Error(t, err)
+	_, err = CompareWithin("equal", "20", 20, 0.01)
+	assert.ErrorContains(t, err, "cannot compare string with int")
+}
@@ -0,0 +1,85 @@
+// runtime/partition.go
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Partitions evaluates the same bytecode separately for every entity, such
+// as every device behind a gateway. Each entity has its own VM and so its own
+// fact store, in which the partition key fact (e.g. deviceId) holds the
+// entity's identifier; rules only ever see the facts of the entity they are
+// evaluated for.
+type Partitions struct {
+	image []byte
+	key   string
+	setup func(entity string, vm *VM)
+
+	mu  sync.Mutex
+	vms map[string]*VM
+}
+
+// NewPartitions creates partitions evaluating image, identifying entities by
+// the fact named key. setup, if not nil, is called with the VM of every new
+// entity before its first cycle, to register hooks or set initial facts.
+func NewPartitions(image []byte, key string, setup func(entity string, vm *VM)) *Partitions {
+	return &Partitions{image: image, key: key, setup: setup, vms: make(map[string]*VM)}
+}
+
+// Key returns the name of the partition key fact.
+func (p *Partitions) Key() string {
+	return p.key
+}
+
+// VM returns the VM of an entity, creating it on first use.
+func (p *Partitions) VM(entity string) *VM {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	vm, ok := p.vms[entity]
+	if !ok {
+		vm = NewVM(p.image)
+		vm.SetFact(p.key, entity)
+		if p.setup != nil {
+			p.setup(entity, vm)
+		}
+		p.vms[entity] = vm
+	}
+	return vm
+}
+
+// Entities returns the entities that have a VM, in sorted order.
+func (p *Partitions) Entities() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entities := make([]string, 0, len(p.vms))
+	for entity := range p.vms {
+		entities = append(entities, entity)
+	}
+	slices.Sort(entities)
+	return entities
+}
+
+// Remove discards an entity's VM along with its facts.
+func (p *Partitions) Remove(entity string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.vms, entity)
+}
+
+// Run runs an evaluation cycle for each of the given entities, typically
+// those whose facts just changed. A failing entity doesn't keep the others
+// from being evaluated; the errors of all failed entities are returned
+// together.
+func (p *Partitions) Run(entities ...string) error {
+	var errs []error
+	for _, entity := range entities {
+		if err := p.VM(entity).Run(); err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", p.key, entity, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,43 @@
+package runtime
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitions_EvaluateEntitiesSeparately(t *testing.T) {
+	var setUp []string
+	partitions := NewPartitions(twoRuleProgram(), "deviceId", func(entity string, vm *VM) {
+		setUp = append(setUp, entity)
+		vm.SetFact("temperature", 0)
+	})
+
+	partitions.VM("d1").SetFact("temperature", 35)
+	partitions.VM("d2").SetFact("temperature", 20)
+	require.NoError(t, partitions.Run("d1", "d2"))
+
+	assert.Equal(t, []string{"d1", "d2"}, setUp, "Every entity is set up once")
+	assert.Equal(t, []string{"d1", "d2"}, partitions.Entities())
+
+	d1, d2 := partitions.VM("d1").Facts(), partitions.VM("d2").Facts()
+	assert.Equal(t, "d1", d1["deviceId"])
+	assert.Equal(t, true, d1["ac_status"])
+	assert.Equal(t, "d2", d2["deviceId"])
+	assert.NotContains(t, d2, "ac_status")
+
+	partitions.Remove("d1")
+	assert.Equal(t, []string{"d2"}, partitions.Entities())
+}
+
+func TestPartitions_RunErrorsDontStopOtherEntities(t *testing.T) {
+	partitions := NewPartitions(twoRuleProgram(), "deviceId", nil)
+
+	// d1 has no temperature, so its first rule fails
+	partitions.VM("d2").SetFact("temperature", 35)
+	err := partitions.Run("d1", "d2")
+	assert.ErrorContains(t, err, "deviceId d1: undefined fact: temperature")
+	assert.NotContains(t, err.Error(), "d2")
+	assert.Equal(t, true, partitions.VM("d2").Facts()["ac_status"])
+}
@@ -0,0 +1,54 @@
+// runtime/pattern.go
+
+package runtime
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"slices"
+)
+
+// matchFacts pops a value and compares every fact matching pattern with it,
+// pushing whether any, or with all set every, matching fact satisfies the
+// operator. A pattern matching no fact never holds. Facts are compared in
+// name order, stopping once the outcome is known.
+func (vm *VM) matchFacts(pattern, operator string, all bool) error {
+	value, err := vm.pop()
+	if err != nil {
+		return err
+	}
+
+	holds := false
+	for _, name := range vm.matchingFacts(pattern) {
+		fact, _ := vm.getFact(name)
+		if holds, err = Compare(operator, fact, value); err != nil {
+			return fmt.Errorf("fact '%s' matching '%s': %w", name, pattern, err)
+		}
+		// A satisfied fact decides any, an unsatisfied one decides all
+		if holds != all {
+			break
+		}
+	}
+	vm.stack = append(vm.stack, holds)
+	return nil
+}
+
+// matchingFacts returns the names of the facts matching a pattern, including
+// those written earlier in the current cycle, in sorted order.
+func (vm *VM) matchingFacts(pattern string) []string {
+	var names []string
+	for name := range vm.facts {
+		if rules.MatchFact(pattern, name) {
+			names = append(names, name)
+		}
+	}
+	if vm.tx != nil {
+		for _, name := range vm.tx.order {
+			if _, exists := vm.facts[name]; !exists && rules.MatchFact(pattern, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,80 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func patternRule(match string) *rules.Rule {
+	return &rules.Rule{
+		Name: "hot",
+		Conditions: rules.Conditions{
+			All: []rules.Condition{{Fact: "sensor.*.temperature", Operator: "greaterThan", Value: 30, ValueType: "int", Match: match}},
+		},
+		Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fired", Value: true}}},
+	}
+}
+
+func TestMatchFacts(t *testing.T) {
+	tests := []struct {
+		name  string
+		facts map[string]interface{}
+		any   bool
+		all   bool
+	}{
+		{"no matching facts", map[string]interface{}{"temperature": 40, "sensor.a.humidity": 40}, false, false},
+		{"one hot sensor", map[string]interface{}{"sensor.a.temperature": 40, "sensor.b.temperature": 20}, true, false},
+		{"all hot sensors", map[string]interface{}{"sensor.a.temperature": 40, "sensor.b.temperature": 35.5}, true, true},
+		{"deeper names don't match", map[string]interface{}{"sensor.a.b.temperature": 40}, false, false},
+	}
+
+	for _, mode := range []bytecode.ConditionMode{bytecode.ConditionModeJump, bytecode.ConditionModeBoolean} {
+		for _, tt := range tests {
+			for _, match := range []string{rules.MatchAny, rules.MatchAll} {
+				vm := NewVM(compileForVM(t, []*rules.Rule{patternRule(match)}, mode))
+				for name, value := range tt.facts {
+					vm.SetFact(name, value)
+				}
+				require.NoError(t, vm.Run(), tt.name)
+
+				expected := tt.any
+				if match == rules.MatchAll {
+					expected = tt.all
+				}
+				_, fired := vm.Facts()["fired"]
+				assert.Equal(t, expected, fired, "%s with match %s", tt.name, match)
+			}
+		}
+	}
+}
+
+func TestMatchFacts_ComparisonError(t *testing.T) {
+	vm := NewVM(compileForVM(t, []*rules.Rule{patternRule(rules.MatchAny)}, bytecode.ConditionModeJump))
+	vm.SetFact("sensor.a.temperature", "hot")
+	assert.ErrorContains(t, vm.Run(), "fact 'sensor.a.temperature' matching 'sensor.*.temperature'")
+}
+
+func TestMatchFacts_ChainsOnMatchingFacts(t *testing.T) {
+	// The first rule writes a fact matching the second rule's pattern
+	code := newProgram().
+		ruleStart(10).
+		loadFact("reset").jump(bytecode.JUMP_IF_FALSE, "end0").
+		loadInt(40).updateFact("sensor.kitchen.temperature").
+		label("end0").op(bytecode.RULE_END).
+		ruleStart(20).
+		loadInt(30).matchFacts(bytecode.MatchAnyQuantifier, "sensor.*.temperature", "greaterThan").
+		jump(bytecode.JUMP_IF_FALSE, "end1").
+		loadBool(true).updateFact("fan_status").
+		label("end1").op(bytecode.RULE_END).
+		bytes()
+
+	vm := NewVM(code)
+	vm.SetMaxChainDepth(1)
+	vm.SetFact("reset", true)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.Facts()["fan_status"])
+}
@@ -0,0 +1,229 @@
+// runtime/pipeline.go
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrQueueFull is returned when an action is submitted to a pipeline whose
+// queue for the action's target is full.
+var ErrQueueFull = errors.New("action queue is full")
+
+// ErrPipelineClosed is returned when an action is submitted to a closed
+// pipeline.
+var ErrPipelineClosed = errors.New("action pipeline is closed")
+
+// Action is a side effect requested by a rule.
+type Action struct {
+	Rule          int         `json:"rule"`
+	Type          string      `json:"type"` // Handler type, e.g. "webhook"
+	Target        string      `json:"target"`
+	Value         interface{} `json:"value"`
+	CorrelationID string      `json:"correlationId,omitempty"` // Correlation ID of the cycle that triggered the action
+	RulesetHash   string      `json:"rulesetHash,omitempty"`   // Hash of the ruleset revision whose rule triggered the action
+}
+
+// ActionHandler performs an action. It should give up when ctx is done.
+type ActionHandler func(ctx context.Context, action Action) error
+
+// PipelineConfig configures an ActionPipeline.
+type PipelineConfig struct {
+	Workers        int           // Number of workers; defaults to 4
+	QueueSize      int           // Capacity of each worker's queue; defaults to 100
+	MaxRetries     int           // Retries after a failed attempt before giving up
+	RetryBackoff   time.Duration // Delay before the first retry, doubled for each further retry
+	DeadLetterPath string        // File failed actions are appended to as JSON lines; empty discards them
+}
+
+// PipelineStats holds the counters of an ActionPipeline.
+type PipelineStats struct {
+	Submitted    int `json:"submitted"`
+	Delivered    int `json:"delivered"`
+	Retries      int `json:"retries"`
+	DeadLettered int `json:"deadLettered"` // Actions that failed or found their queue full
+}
+
+// deadLetter is the record written to the dead-letter file for an action that
+// couldn't be delivered.
+type deadLetter struct {
+	Time     time.Time `json:"time"`
+	Action   Action    `json:"action"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+}
+
+// ActionPipeline executes actions on a pool of workers, decoupled from the
+// evaluation loop. Actions for the same target are always handled by the same
+// worker, so they are delivered in the order they were submitted. Each
+// attempt goes through an ActionGuard, and actions that still fail after the
+// configured retries are written to a dead-letter file.
+type ActionPipeline struct {
+	config  PipelineConfig
+	guard   *ActionGuard
+	handler ActionHandler
+	queues  []chan Action
+	workers sync.WaitGroup
+
+	mu         sync.RWMutex // Guards closed against concurrent submissions
+	closed     bool
+	statsMu    sync.Mutex
+	stats      PipelineStats
+	fileMu     sync.Mutex // Serializes the workers' dead-letter writes
+	deadLetter *os.File
+}
+
+// NewActionPipeline starts a pipeline delivering actions to handler through
+// guard.
+func NewActionPipeline(config PipelineConfig, guard *ActionGuard, handler ActionHandler) (*ActionPipeline, error) {
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+
+	p := &ActionPipeline{
+		config:  config,
+		guard:   guard,
+		handler: handler,
+		queues:  make([]chan Action, config.Workers),
+	}
+	if config.DeadLetterPath != "" {
+		file, err := os.OpenFile(config.DeadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open dead-letter file: %w", err)
+		}
+		p.deadLetter = file
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan Action, config.QueueSize)
+		p.workers.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p, nil
+}
+
+// Submit queues an action without waiting for it to be delivered. If the
+// queue for the action's target is full, the action is dead-lettered and
+// ErrQueueFull is returned.
+func (p *ActionPipeline) Submit(action Action) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrPipelineClosed
+	}
+
+	p.count(func(stats *PipelineStats) { stats.Submitted++ })
+	select {
+	case p.queues[p.worker(action.Target)] <- action:
+		return nil
+	default:
+		err := fmt.Errorf("%s %s: %w", action.Type, action.Target, ErrQueueFull)
+		p.fail(action, 0, err)
+		return err
+	}
+}
+
+// Close stops accepting actions and waits for the queued ones to be handled.
+func (p *ActionPipeline) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.mu.Unlock()
+
+	p.workers.Wait()
+	if p.deadLetter != nil {
+		return p.deadLetter.Close()
+	}
+	return nil
+}
+
+// Stats returns the counters of the pipeline.
+func (p *ActionPipeline) Stats() PipelineStats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	return p.stats
+}
+
+// worker returns the index of the worker handling a target.
+func (p *ActionPipeline) worker(target string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(target))
+	return int(hash.Sum32() % uint32(len(p.queues)))
+}
+
+// work delivers the actions of a queue one at a time until it is closed.
+func (p *ActionPipeline) work(queue <-chan Action) {
+	defer p.workers.Done()
+	for action := range queue {
+		p.deliver(action)
+	}
+}
+
+// deliver attempts an action until it succeeds or runs out of retries.
+func (p *ActionPipeline) deliver(action Action) {
+	backoff := p.config.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := p.guard.Invoke(action.Rule, action.Type, func(ctx context.Context) error {
+			return p.handler(ctx, action)
+		})
+		if err == nil {
+			p.count(func(stats *PipelineStats) { stats.Delivered++ })
+			return
+		}
+		if attempt > p.config.MaxRetries {
+			p.fail(action, attempt, err)
+			return
+		}
+
+		log.Debug().Err(err).Str("Type", action.Type).Str("Target", action.Target).Str("CorrelationID", action.CorrelationID).Int("Attempt", attempt).Msg("Retrying action")
+		p.count(func(stats *PipelineStats) { stats.Retries++ })
+		<-p.guard.Clock().After(backoff)
+		backoff *= 2
+	}
+}
+
+// fail records an action that couldn't be delivered.
+func (p *ActionPipeline) fail(action Action, attempts int, err error) {
+	p.count(func(stats *PipelineStats) { stats.DeadLettered++ })
+	log.Error().Err(err).Str("Type", action.Type).Str("Target", action.Target).Str("CorrelationID", action.CorrelationID).Int("Attempts", attempts).Msg("Action failed")
+	if p.deadLetter == nil {
+		return
+	}
+
+	record, marshalErr := json.Marshal(deadLetter{Time: p.guard.Clock().Now(), Action: action, Attempts: attempts, Error: err.Error()})
+	if marshalErr != nil {
+		log.Error().Err(marshalErr).Msg("Failed to encode dead-letter record")
+		return
+	}
+
+	p.fileMu.Lock()
+	defer p.fileMu.Unlock()
+	if _, writeErr := p.deadLetter.Write(append(record, '\n')); writeErr != nil {
+		log.Error().Err(writeErr).Msg("Failed to write dead-letter record")
+	}
+}
+
+// count updates the pipeline's counters.
+func (p *ActionPipeline) count(update func(stats *PipelineStats)) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	update(&p.stats)
+}
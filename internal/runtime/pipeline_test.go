@@ -0,0 +1,114 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActionPipeline_OrderedPerTarget(t *testing.T) {
+	var mu sync.Mutex
+	delivered := make(map[string][]interface{})
+	handler := func(ctx context.Context, action Action) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[action.Target] = append(delivered[action.Target], action.Value)
+		return nil
+	}
+
+	pipeline, err := NewActionPipeline(PipelineConfig{Workers: 3, QueueSize: 1000}, NewActionGuard(ActionPolicy{}), handler)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		for _, target := range []string{"hvac", "lights", "alarm", "pump"} {
+			require.NoError(t, pipeline.Submit(Action{Type: "notify", Target: target, Value: i}))
+		}
+	}
+	require.NoError(t, pipeline.Close())
+
+	for target, values := range delivered {
+		require.Len(t, values, 100, target)
+		for i, value := range values {
+			assert.Equal(t, i, value, "actions for %s were delivered out of order", target)
+		}
+	}
+	assert.Equal(t, PipelineStats{Submitted: 400, Delivered: 400}, pipeline.Stats())
+	assert.ErrorIs(t, pipeline.Submit(Action{Target: "hvac"}), ErrPipelineClosed)
+}
+
+func TestActionPipeline_RetriesAndDeadLetters(t *testing.T) {
+	deadLetterPath := filepath.Join(t.TempDir(), "dead.jsonl")
+	attempts := make(map[string]int)
+	handler := func(ctx context.Context, action Action) error {
+		attempts[action.Target]++
+		if action.Target == "flaky" && attempts[action.Target] < 3 {
+			return errors.New("temporarily unavailable")
+		}
+		if action.Target == "down" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	pipeline, err := NewActionPipeline(PipelineConfig{Workers: 1, MaxRetries: 2, DeadLetterPath: deadLetterPath}, NewActionGuard(ActionPolicy{}), handler)
+	require.NoError(t, err)
+	require.NoError(t, pipeline.Submit(Action{Rule: 1, Type: "webhook", Target: "flaky", Value: true}))
+	require.NoError(t, pipeline.Submit(Action{Rule: 2, Type: "webhook", Target: "down", Value: 42.5}))
+	require.NoError(t, pipeline.Close())
+
+	assert.Equal(t, 3, attempts["flaky"])
+	assert.Equal(t, 3, attempts["down"])
+	assert.Equal(t, PipelineStats{Submitted: 2, Delivered: 1, Retries: 4, DeadLettered: 1}, pipeline.Stats())
+
+	file, err := os.Open(deadLetterPath)
+	require.NoError(t, err)
+	defer file.Close()
+	var records []deadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record deadLetter
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.Len(t, records, 1)
+	assert.Equal(t, Action{Rule: 2, Type: "webhook", Target: "down", Value: 42.5}, records[0].Action)
+	assert.Equal(t, 3, records[0].Attempts)
+	assert.Equal(t, "connection refused", records[0].Error)
+}
+
+func TestActionPipeline_QueueFull(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(ctx context.Context, action Action) error {
+		<-release
+		return nil
+	}
+
+	pipeline, err := NewActionPipeline(PipelineConfig{Workers: 1, QueueSize: 2}, NewActionGuard(ActionPolicy{}), handler)
+	require.NoError(t, err)
+
+	// One action is being handled and two are queued, so at least the fourth
+	// must be rejected
+	var rejected int
+	for i := 0; i < 4; i++ {
+		if err := pipeline.Submit(Action{Type: "notify", Target: fmt.Sprint("t", i)}); err != nil {
+			assert.ErrorIs(t, err, ErrQueueFull)
+			rejected++
+		}
+	}
+	close(release)
+	require.NoError(t, pipeline.Close())
+
+	assert.GreaterOrEqual(t, rejected, 1)
+	stats := pipeline.Stats()
+	assert.Equal(t, 4, stats.Submitted)
+	assert.Equal(t, rejected, stats.DeadLettered)
+	assert.Equal(t, 4-rejected, stats.Delivered)
+}
@@ -0,0 +1,217 @@
+package runtime
+
+import (
+	"encoding/binary"
+	"math"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"time"
+)
+
+// program is a small assembler used to build VM bytecode in tests.
+type program struct {
+	code   []byte
+	labels map[string]int
+	fixups map[int]string
+}
+
+func newProgram() *program {
+	// Leave room for the header the VM skips over
+	return &program{
+		code:   make([]byte, 12),
+		labels: make(map[string]int),
+		fixups: make(map[int]string),
+	}
+}
+
+func (p *program) op(opcode bytecode.Opcode) *program {
+	p.code = append(p.code, byte(opcode))
+	return p
+}
+
+func (p *program) loadFact(name string) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_FACT))
+	p.code = append(append(p.code, name...), 0)
+	return p
+}
+
+func (p *program) factExists(name string) *program {
+	p.code = append(p.code, byte(bytecode.FACT_EXISTS))
+	p.code = append(append(p.code, name...), 0)
+	return p
+}
+
+func (p *program) storeFact(name string) *program {
+	p.code = append(p.code, byte(bytecode.STORE_FACT))
+	p.code = append(append(p.code, name...), 0)
+	return p
+}
+
+func (p *program) loadInt(value int) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_CONST_INT))
+	p.code = binary.AppendVarint(p.code, int64(value))
+	return p
+}
+
+func (p *program) loadInt64(value int64) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_CONST_INT64))
+	p.code = binary.LittleEndian.AppendUint64(p.code, uint64(value))
+	return p
+}
+
+func (p *program) loadUint64(value uint64) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_CONST_UINT64))
+	p.code = binary.LittleEndian.AppendUint64(p.code, value)
+	return p
+}
+
+func (p *program) loadFloat(value float64) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_CONST_FLOAT))
+	p.code = binary.LittleEndian.AppendUint64(p.code, math.Float64bits(value))
+	return p
+}
+
+func (p *program) loadInt16(value int16) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_CONST_INT16))
+	p.code = binary.LittleEndian.AppendUint16(p.code, uint16(value))
+	return p
+}
+
+func (p *program) loadFloat32(value float32) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_CONST_FLOAT32))
+	p.code = binary.LittleEndian.AppendUint32(p.code, math.Float32bits(value))
+	return p
+}
+
+func (p *program) loadString(value string) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_CONST_STRING))
+	p.code = append(append(p.code, value...), 0)
+	return p
+}
+
+func (p *program) loadBool(value bool) *program {
+	var b byte
+	if value {
+		b = 1
+	}
+	p.code = append(p.code, byte(bytecode.LOAD_CONST_BOOL), b)
+	return p
+}
+
+func (p *program) loadVar(slot byte) *program {
+	p.code = append(p.code, byte(bytecode.LOAD_VAR), slot)
+	return p
+}
+
+func (p *program) storeVar(slot byte) *program {
+	p.code = append(p.code, byte(bytecode.STORE_VAR), slot)
+	return p
+}
+
+func (p *program) ruleStart(priority int) *program {
+	p.code = append(p.code, byte(bytecode.RULE_START))
+	p.code = binary.LittleEndian.AppendUint32(p.code, uint32(int32(priority)))
+	return p
+}
+
+func (p *program) rollout(percent int, salt uint32, keyFact string) *program {
+	p.code = append(p.code, byte(bytecode.ROLLOUT), byte(percent))
+	p.code = binary.LittleEndian.AppendUint32(p.code, salt)
+	p.code = append(append(p.code, keyFact...), 0)
+	return p
+}
+
+func (p *program) hold(d time.Duration, once bool) *program {
+	var flags byte
+	if once {
+		flags = bytecode.HoldOnce
+	}
+	p.code = append(p.code, byte(bytecode.HOLD))
+	p.code = binary.LittleEndian.AppendUint32(p.code, uint32(d.Milliseconds()))
+	p.code = append(p.code, flags)
+	return p
+}
+
+func (p *program) inStrings(opcode bytecode.Opcode, values ...string) *program {
+	p.code = append(p.code, byte(opcode), bytecode.ListString)
+	p.code = binary.LittleEndian.AppendUint16(p.code, uint16(len(values)))
+	for _, value := range values {
+		p.code = append(append(p.code, value...), 0)
+	}
+	return p
+}
+
+func (p *program) raise(message uint16) *program {
+	p.code = append(p.code, byte(bytecode.ERROR))
+	p.code = binary.LittleEndian.AppendUint16(p.code, message)
+	return p
+}
+
+func (p *program) variant(low, high int, salt uint32, keyFact, name string) *program {
+	p.code = append(p.code, byte(bytecode.VARIANT), byte(low), byte(high))
+	p.code = binary.LittleEndian.AppendUint32(p.code, salt)
+	p.code = append(append(p.code, keyFact...), 0)
+	p.code = append(append(p.code, name...), 0)
+	return p
+}
+
+func (p *program) callOperator(name string) *program {
+	p.code = append(p.code, byte(bytecode.CALL_OPERATOR))
+	p.code = append(append(p.code, name...), 0)
+	return p
+}
+
+func (p *program) triggerAction(actionType, target string) *program {
+	p.code = append(p.code, byte(bytecode.TRIGGER_ACTION))
+	p.code = append(append(p.code, actionType...), 0)
+	p.code = append(append(p.code, target...), 0)
+	return p
+}
+
+func (p *program) matchFacts(quantifier byte, pattern, operator string) *program {
+	p.code = append(p.code, byte(bytecode.MATCH_FACTS), quantifier)
+	p.code = append(append(p.code, pattern...), 0)
+	p.code = append(append(p.code, operator...), 0)
+	return p
+}
+
+func (p *program) updateFact(name string) *program {
+	p.code = append(p.code, byte(bytecode.UPDATE_FACT))
+	p.code = append(append(p.code, name...), 0)
+	return p
+}
+
+// jump emits a jump to a label. The target is encoded as a two-byte varint so
+// it can be patched once the label is known.
+func (p *program) jump(opcode bytecode.Opcode, label string) *program {
+	p.code = append(p.code, byte(opcode), 0, 0)
+	p.fixups[len(p.code)-2] = label
+	return p
+}
+
+func (p *program) label(name string) *program {
+	p.labels[name] = len(p.code)
+	return p
+}
+
+func (p *program) bytes() []byte {
+	for pos, label := range p.fixups {
+		// Zig-zag encode the target, then split it over two varint bytes
+		target := uint64(p.labels[label]) << 1
+		p.code[pos] = byte(target&0x7f) | 0x80
+		p.code[pos+1] = byte(target >> 7)
+	}
+	return p.code
+}
+
+// twoRuleProgram builds a program with a rule that fires when temperature > 30
+// and a rule that always fires.
+func twoRuleProgram() []byte {
+	return newProgram().
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadBool(true).updateFact("ac_status").
+		label("rule0_end").op(bytecode.RULE_END).
+		loadBool(true).updateFact("fan_status").
+		op(bytecode.RULE_END).
+		bytes()
+}
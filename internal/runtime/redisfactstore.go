@@ -0,0 +1,108 @@
+// runtime/redisfactstore.go
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/factsource"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisLoadBatch is the number of keys read by each MGET loading facts.
+const redisLoadBatch = 500
+
+// RedisFactStore is a FactStore keeping each fact in a Redis string key, named
+// after the fact with a prefix. Values are stored as text, as the keyspace
+// mode of factsource.RedisSource reads them: numbers and bools in their usual
+// notation, floats always with a decimal point or exponent so they load as
+// floats again. Keys of other types under the prefix are ignored.
+type RedisFactStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisFactStore creates a FactStore keeping the facts in the keys of
+// client starting with prefix, e.g. "facts:".
+func NewRedisFactStore(client *redis.Client, prefix string) *RedisFactStore {
+	return &RedisFactStore{client: client, prefix: prefix}
+}
+
+// Load implements FactStore.
+func (s *RedisFactStore) Load(ctx context.Context) (map[string]interface{}, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, escapeRedisPattern(s.prefix)+"*", redisLoadBatch).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	facts := make(map[string]interface{}, len(keys))
+	for start := 0; start < len(keys); start += redisLoadBatch {
+		batch := keys[start:min(start+redisLoadBatch, len(keys))]
+		values, err := s.client.MGet(ctx, batch...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			if text, ok := value.(string); ok {
+				facts[strings.TrimPrefix(batch[i], s.prefix)] = factsource.ParseValue(text)
+			}
+		}
+	}
+	return facts, nil
+}
+
+// Save implements FactStore. The writes are applied in a single
+// transaction.
+func (s *RedisFactStore) Save(ctx context.Context, set map[string]interface{}, deleted []string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for name, value := range set {
+			pipe.Set(ctx, s.prefix+name, formatRedisValue(value), 0)
+		}
+		if len(deleted) > 0 {
+			keys := make([]string, len(deleted))
+			for i, name := range deleted {
+				keys[i] = s.prefix + name
+			}
+			pipe.Del(ctx, keys...)
+		}
+		return nil
+	})
+	return err
+}
+
+// formatRedisValue formats a fact value as text that factsource.ParseValue
+// reads back as the same value.
+func formatRedisValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		text := strconv.FormatFloat(v, 'g', -1, 64)
+		if !math.IsInf(v, 0) && !math.IsNaN(v) && !strings.ContainsAny(text, ".e") {
+			text += ".0"
+		}
+		return text
+	case float32:
+		return formatRedisValue(float64(v))
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// escapeRedisPattern escapes the glob characters of a key prefix for SCAN.
+func escapeRedisPattern(prefix string) string {
+	var b strings.Builder
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,383 @@
+package runtime
+
+import (
+	"encoding/json"
+	"math/rand"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// referenceFires reports whether a rule applies to a set of facts by walking
+// its condition tree directly. It is deliberately naive so that it can serve
+// as the specification the compiled bytecode is checked against.
+func referenceFires(rule *rules.Rule, facts map[string]interface{}) bool {
+	if rule.Scored() {
+		var score float64
+		for i := range rule.Conditions.All {
+			if referenceCondition(&rule.Conditions.All[i], facts) {
+				score += rule.Conditions.All[i].ScoreWeight()
+			}
+		}
+		return score >= rule.Score.Threshold
+	}
+	return referenceBlock(rule.Conditions.All, rule.Conditions.Any, rule.Conditions.Not, facts)
+}
+
+func referenceBlock(all, any, not []rules.Condition, facts map[string]interface{}) bool {
+	for i := range all {
+		if !referenceCondition(&all[i], facts) {
+			return false
+		}
+	}
+	if len(not) > 0 && referenceBlock(not, nil, nil, facts) {
+		return false
+	}
+	if len(any) == 0 {
+		return true
+	}
+	for i := range any {
+		if referenceCondition(&any[i], facts) {
+			return true
+		}
+	}
+	return false
+}
+
+func referenceCondition(condition *rules.Condition, facts map[string]interface{}) bool {
+	if condition.IsBlock() {
+		return referenceBlock(condition.All, condition.Any, condition.Not, facts)
+	}
+	if rules.IsExistenceOperator(condition.Operator) {
+		_, set := facts[condition.Fact]
+		return set == (condition.Operator == rules.OperatorExists)
+	}
+	if condition.Operator == rules.OperatorIn || condition.Operator == rules.OperatorNotIn {
+		found := false
+		for _, value := range condition.Value.([]interface{}) {
+			found = found || referenceCondition(&rules.Condition{Fact: condition.Fact, Operator: rules.OperatorEqual, Value: value}, facts)
+		}
+		return found == (condition.Operator == rules.OperatorIn)
+	}
+
+	var c int
+	switch fact := facts[condition.Fact].(type) {
+	case int:
+		c = compare(float64(fact), float64(condition.Value.(int)))
+	case float64:
+		c = compare(fact, condition.Value.(float64))
+	case string:
+		c = compare(fact, condition.Value.(string))
+	case bool:
+		if fact != condition.Value.(bool) {
+			c = 1
+		}
+	}
+
+	switch condition.Operator {
+	case rules.OperatorContains:
+		return strings.Contains(facts[condition.Fact].(string), condition.Value.(string))
+	case rules.OperatorNotContains:
+		return !strings.Contains(facts[condition.Fact].(string), condition.Value.(string))
+	case rules.OperatorEqual:
+		return c == 0
+	case rules.OperatorNotEqual:
+		return c != 0
+	case rules.OperatorLessThan:
+		return c < 0
+	case rules.OperatorLessThanOrEqual:
+		return c <= 0
+	case rules.OperatorGreaterThan:
+		return c > 0
+	case rules.OperatorGreaterThanOrEqual:
+		return c >= 0
+	}
+	panic("unsupported operator " + condition.Operator)
+}
+
+func compare[T int | float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ruleGenerator builds random rules over a fixed set of typed facts.
+type ruleGenerator struct {
+	rand *rand.Rand
+}
+
+var generatorFacts = []struct {
+	name      string
+	valueType string
+}{
+	{"temperature", "int"},
+	{"pressure", "int"},
+	{"humidity", "float"},
+	{"mode", "string"},
+	{"occupied", "bool"},
+	{"window_open", "bool"},
+}
+
+// unsetFact is in the fact table of the generated rules, but never set.
+const unsetFact = "maintenance"
+
+// scoreFact is the fact generated scoring rules write their score to.
+const scoreFact = "risk"
+
+var orderedOperators = []string{
+	rules.OperatorEqual, rules.OperatorNotEqual,
+	rules.OperatorLessThan, rules.OperatorLessThanOrEqual,
+	rules.OperatorGreaterThan, rules.OperatorGreaterThanOrEqual,
+}
+
+var stringOperators = []string{
+	rules.OperatorEqual, rules.OperatorNotEqual,
+	rules.OperatorContains, rules.OperatorNotContains,
+}
+
+func (g *ruleGenerator) value(valueType string) interface{} {
+	// Values are drawn from small ranges so that equality holds often
+	switch valueType {
+	case "int":
+		return g.rand.Intn(5)
+	case "float":
+		return float64(g.rand.Intn(5)) / 2
+	case "string":
+		return []string{"eco", "comfort", "away", "o"}[g.rand.Intn(4)]
+	default:
+		return g.rand.Intn(2) == 1
+	}
+}
+
+func (g *ruleGenerator) facts() map[string]interface{} {
+	facts := make(map[string]interface{})
+	for _, fact := range generatorFacts {
+		facts[fact.name] = g.value(fact.valueType)
+	}
+	return facts
+}
+
+func (g *ruleGenerator) condition(depth int) rules.Condition {
+	if depth > 0 && g.rand.Intn(3) == 0 {
+		var condition rules.Condition
+		for !condition.IsBlock() {
+			condition.All = g.conditions(depth - 1)
+			condition.Any = g.conditions(depth - 1)
+			if g.rand.Intn(3) == 0 {
+				condition.Not = g.conditions(depth - 1)
+			}
+		}
+		return condition
+	}
+
+	fact := generatorFacts[g.rand.Intn(len(generatorFacts))]
+	operator := orderedOperators[g.rand.Intn(len(orderedOperators))]
+	switch fact.valueType {
+	case "string":
+		operator = stringOperators[g.rand.Intn(len(stringOperators))]
+	case "bool":
+		operator = orderedOperators[g.rand.Intn(2)]
+	}
+	if g.rand.Intn(8) == 0 {
+		name := fact.name
+		if g.rand.Intn(2) == 0 {
+			name = unsetFact
+		}
+		return rules.Condition{
+			Fact:     name,
+			Operator: []string{rules.OperatorExists, rules.OperatorNotExists}[g.rand.Intn(2)],
+		}
+	}
+	if g.rand.Intn(5) == 0 {
+		list := make([]interface{}, 1+g.rand.Intn(3))
+		for i := range list {
+			list[i] = g.value(fact.valueType)
+		}
+		return rules.Condition{
+			Fact:      fact.name,
+			Operator:  []string{rules.OperatorIn, rules.OperatorNotIn}[g.rand.Intn(2)],
+			Value:     list,
+			ValueType: fact.valueType,
+		}
+	}
+	return rules.Condition{
+		Fact:      fact.name,
+		Operator:  operator,
+		Value:     g.value(fact.valueType),
+		ValueType: fact.valueType,
+	}
+}
+
+func (g *ruleGenerator) conditions(depth int) []rules.Condition {
+	var conditions []rules.Condition
+	for i := g.rand.Intn(4); i > 0; i-- {
+		conditions = append(conditions, g.condition(depth))
+	}
+	return conditions
+}
+
+func (g *ruleGenerator) rule() *rules.Rule {
+	rule := &rules.Rule{
+		Name: "generated",
+		Conditions: rules.Conditions{
+			All: g.conditions(3),
+			Any: g.conditions(3),
+		},
+		Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fired", Value: true}}},
+	}
+	if g.rand.Intn(3) == 0 {
+		rule.Conditions.Not = g.conditions(3)
+	}
+	if g.rand.Intn(4) == 0 && len(rule.Conditions.All) > 0 {
+		// Score the all conditions with weights from -1 to 2 instead
+		rule.Score = &rules.Score{Fact: scoreFact, Threshold: float64(g.rand.Intn(7)-1) / 2}
+		rule.Conditions.Any = nil
+		rule.Conditions.Not = nil
+		for i := range rule.Conditions.All {
+			weight := float64(g.rand.Intn(7)-1) / 2
+			rule.Conditions.All[i].Weight = &weight
+		}
+	}
+	return rule
+}
+
+// compileForVM compiles rules and converts them to the encoding the VM
+// executes. Facts keep their indices, resolved through the fact table
+// embedded in the image.
+func compileForVM(t *testing.T, ruleset []*rules.Rule, mode bytecode.ConditionMode) []byte {
+	t.Helper()
+
+	context := rules.NewRuleEngineContext()
+	for _, fact := range append(factNames(), "fired", unsetFact, scoreFact) {
+		context.FactIndex[fact] = len(context.FactIndex)
+	}
+	code, err := bytecode.NewCompilerWithOptions(context, bytecode.Options{ConditionMode: mode}).Compile(ruleset)
+	require.NoError(t, err)
+	code, err = ConvertCompiled(code)
+	require.NoError(t, err)
+
+	facts, err := bytecode.NewFactTableSection(bytecode.NewFactTable(context.FactIndex))
+	require.NoError(t, err)
+	return bytecode.AppendSections(code, facts)
+}
+
+func factNames() []string {
+	names := make([]string, len(generatorFacts))
+	for i, fact := range generatorFacts {
+		names[i] = fact.name
+	}
+	return names
+}
+
+func TestVM_MatchesReferenceInterpreter(t *testing.T) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	const seed = 2217
+	generator := &ruleGenerator{rand: rand.New(rand.NewSource(seed))}
+	modes := map[string]bytecode.ConditionMode{
+		"jump":    bytecode.ConditionModeJump,
+		"boolean": bytecode.ConditionModeBoolean,
+	}
+
+	for i := 0; i < 2000; i++ {
+		rule := generator.rule()
+		// Optimizing the rule, which rewrites its not blocks among others,
+		// mustn't change when it fires
+		optimized, err := preprocessor.OptimizeRules(preprocessor.CloneRules([]*rules.Rule{rule}), rules.NewRuleEngineContext())
+		require.NoError(t, err)
+		codes := map[string][]byte{"optimized jump": compileForVM(t, optimized, bytecode.ConditionModeJump)}
+		for name, mode := range modes {
+			codes[name] = compileForVM(t, []*rules.Rule{rule}, mode)
+		}
+		for name, code := range codes {
+			for j := 0; j < 5; j++ {
+				facts := generator.facts()
+
+				vm := NewVM(code)
+				for fact, value := range facts {
+					vm.SetFact(fact, value)
+				}
+				require.NoError(t, vm.Run())
+
+				_, fired := vm.Facts()["fired"]
+				if want := referenceFires(rule, facts); fired != want {
+					ruleJSON, _ := json.Marshal(rule.Conditions)
+					t.Fatalf("%s mode, rule %d: VM fired=%v, reference fired=%v\nconditions: %s\nfacts: %v",
+						name, i, fired, want, ruleJSON, facts)
+				}
+			}
+		}
+	}
+}
+
+func TestVM_DeeplyNestedConditions(t *testing.T) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	// temperature > 2 and (occupied or (mode is eco and (humidity < 1 or
+	// window_open))), and any of pressure > 3 or not (mode is away)
+	rule := &rules.Rule{
+		Name: "nested",
+		Conditions: rules.Conditions{
+			All: []rules.Condition{
+				{Fact: "temperature", Operator: rules.OperatorGreaterThan, Value: 2, ValueType: "int"},
+				{Any: []rules.Condition{
+					{Fact: "occupied", Operator: rules.OperatorEqual, Value: true, ValueType: "bool"},
+					{All: []rules.Condition{
+						{Fact: "mode", Operator: rules.OperatorEqual, Value: "eco", ValueType: "string"},
+						{Any: []rules.Condition{
+							{Fact: "humidity", Operator: rules.OperatorLessThan, Value: 1.0, ValueType: "float"},
+							{Fact: "window_open", Operator: rules.OperatorEqual, Value: true, ValueType: "bool"},
+						}},
+					}},
+				}},
+			},
+			Any: []rules.Condition{
+				{Fact: "pressure", Operator: rules.OperatorGreaterThan, Value: 3, ValueType: "int"},
+				{Fact: "mode", Operator: rules.OperatorNotEqual, Value: "away", ValueType: "string"},
+			},
+		},
+		Event: rules.Event{Actions: []rules.Action{{Type: "updateFact", Target: "fired", Value: true}}},
+	}
+
+	tests := []struct {
+		name  string
+		facts map[string]interface{}
+		fires bool
+	}{
+		{"occupied", map[string]interface{}{"temperature": 3, "occupied": true, "mode": "comfort", "humidity": 2.0, "window_open": false, "pressure": 0}, true},
+		{"too cold", map[string]interface{}{"temperature": 2, "occupied": true, "mode": "comfort", "humidity": 2.0, "window_open": false, "pressure": 0}, false},
+		{"eco and dry", map[string]interface{}{"temperature": 3, "occupied": false, "mode": "eco", "humidity": 0.5, "window_open": false, "pressure": 0}, true},
+		{"eco and window open", map[string]interface{}{"temperature": 3, "occupied": false, "mode": "eco", "humidity": 2.0, "window_open": true, "pressure": 0}, true},
+		{"eco but humid and closed", map[string]interface{}{"temperature": 3, "occupied": false, "mode": "eco", "humidity": 2.0, "window_open": false, "pressure": 0}, false},
+		{"not eco", map[string]interface{}{"temperature": 3, "occupied": false, "mode": "comfort", "humidity": 0.5, "window_open": true, "pressure": 0}, false},
+		{"away at low pressure", map[string]interface{}{"temperature": 3, "occupied": true, "mode": "away", "humidity": 2.0, "window_open": false, "pressure": 3}, false},
+		{"away at high pressure", map[string]interface{}{"temperature": 3, "occupied": true, "mode": "away", "humidity": 2.0, "window_open": false, "pressure": 4}, true},
+	}
+
+	for name, mode := range map[string]bytecode.ConditionMode{"jump": bytecode.ConditionModeJump, "boolean": bytecode.ConditionModeBoolean} {
+		code := compileForVM(t, []*rules.Rule{rule}, mode)
+		for _, tt := range tests {
+			vm := NewVM(code)
+			vm.SetFacts(tt.facts)
+			require.NoError(t, vm.Run())
+
+			_, fired := vm.Facts()["fired"]
+			require.Equal(t, tt.fires, referenceFires(rule, tt.facts), "%s: reference", tt.name)
+			require.Equal(t, tt.fires, fired, "%s mode, %s", name, tt.name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// runtime/registry.go
+
+package runtime
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// OperatorFunc implements a custom condition operator, comparing the value of
+// a fact with the value given in the rule.
+type OperatorFunc func(fact, value interface{}) (bool, error)
+
+var (
+	registryMu     sync.RWMutex
+	operators      = make(map[string]OperatorFunc)
+	actionHandlers = make(map[string]ActionHandler)
+)
+
+// RegisterOperator registers the implementation of a custom operator executed
+// by CALL_OPERATOR instructions. It panics if the name is already registered.
+func RegisterOperator(name string, fn OperatorFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := operators[name]; exists {
+		panic(fmt.Sprintf("runtime: operator %q registered twice", name))
+	}
+	operators[name] = fn
+}
+
+// RegisterActionHandler registers the handler performing actions of a type.
+// The VM uses it for the actions rules trigger, in place of the default
+// handler of a built-in action type, and it is available to the host's own
+// action dispatch, e.g. through an ActionPipeline. It panics if the type is
+// already registered.
+func RegisterActionHandler(actionType string, handler ActionHandler) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, exists := actionHandlers[actionType]; exists {
+		panic(fmt.Sprintf("runtime: action handler %q registered twice", actionType))
+	}
+	actionHandlers[actionType] = handler
+}
+
+// LookupActionHandler returns the handler registered for an action type.
+func LookupActionHandler(actionType string) (ActionHandler, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	handler, ok := actionHandlers[actionType]
+	return handler, ok
+}
+
+// ActionHandlerTypes returns the registered action types, sorted.
+func ActionHandlerTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	types := make([]string, 0, len(actionHandlers))
+	for actionType := range actionHandlers {
+		types = append(types, actionType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// lookupOperator returns the implementation of a custom operator.
+func lookupOperator(name string) (OperatorFunc, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	fn, ok := operators[name]
+	return fn, ok
+}
+
+// callOperator pops a value and a fact and pushes the result of comparing
+// them with a custom operator.
+func (vm *VM) callOperator(name string) error {
+	fn, ok := lookupOperator(name)
+	if !ok {
+		return fmt.Errorf("unknown operator: %s", name)
+	}
+	value, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	fact, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	result, err := fn(fact, value)
+	if err != nil {
+		return fmt.Errorf("operator %s: %w", name, err)
+	}
+	vm.stack = append(vm.stack, result)
+	return nil
+}
@@ -0,0 +1,68 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_CallOperator(t *testing.T) {
+	RegisterOperator("hasPrefixTest", func(fact, value interface{}) (bool, error) {
+		s, ok := fact.(string)
+		if !ok {
+			return false, errors.New("not a string")
+		}
+		return strings.HasPrefix(s, value.(string)), nil
+	})
+
+	code := newProgram().loadFact("host").loadString("web-").callOperator("hasPrefixTest").bytes()
+	vm := NewVM(code)
+	vm.facts["host"] = "web-01"
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []interface{}{true}, vm.stack)
+
+	vm = NewVM(code)
+	vm.facts["host"] = 42
+	assert.ErrorContains(t, vm.Run(), "operator hasPrefixTest: not a string")
+
+	vm = NewVM(newProgram().loadFact("host").loadString("web-").callOperator("missingTest").bytes())
+	vm.facts["host"] = "web-01"
+	assert.ErrorContains(t, vm.Run(), "unknown operator: missingTest")
+
+	// Operator names aren't mistaken for instructions when scheduling rules,
+	// even if they contain opcode bytes ('&' is RULE_START)
+	RegisterOperator("prefix&Test", func(fact, value interface{}) (bool, error) {
+		return strings.HasPrefix(fact.(string), value.(string)), nil
+	})
+	vm = NewVM(newProgram().
+		ruleStart(0).loadFact("host").loadString("web-").callOperator("prefix&Test").jump(bytecode.JUMP_IF_FALSE, "end").
+		loadBool(true).updateFact("web").label("end").op(bytecode.RULE_END).bytes())
+	vm.facts["host"] = "web-01"
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["web"])
+
+	assert.Panics(t, func() { RegisterOperator("hasPrefixTest", nil) })
+}
+
+func TestRegisterActionHandler(t *testing.T) {
+	var handled Action
+	RegisterActionHandler("recordTest", func(ctx context.Context, action Action) error {
+		handled = action
+		return nil
+	})
+
+	handler, ok := LookupActionHandler("recordTest")
+	require.True(t, ok)
+	require.NoError(t, handler(context.Background(), Action{Type: "recordTest", Target: "log"}))
+	assert.Equal(t, "log", handled.Target)
+	assert.Contains(t, ActionHandlerTypes(), "recordTest")
+
+	_, ok = LookupActionHandler("missingTest")
+	assert.False(t, ok)
+	assert.Panics(t, func() { RegisterActionHandler("recordTest", nil) })
+}
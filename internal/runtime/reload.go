@@ -0,0 +1,73 @@
+// runtime/reload.go
+
+package runtime
+
+import (
+	"fmt"
+)
+
+// Reload replaces the VM's program with the bytecode of image, keeping its
+// fact store, hooks, action handlers and settings, so that a host can roll
+// out new rules without losing the facts it has gathered. The new bytecode,
+// which may be a bytecode.bin as the preprocessor writes it, is converted as
+// NewVM converts it, and must decode and pass every check given, which can
+// look at it as loaded in a VM of its own; otherwise Reload returns the error
+// and the VM keeps running its current program.
+//
+// The initial facts of the new bytecode are only set where the fact isn't
+// already. Rules disabled by the host stay disabled if the new bytecode has a
+// rule of the same name. Hold timers restart, and delayed actions still
+// waiting are dropped, since the rules and instructions they belong to may
+// have changed. Reload must not be called while a cycle is running.
+func (vm *VM) Reload(image []byte, checks ...func(*VM) error) error {
+	next := NewVM(image)
+	if err := next.DecodeError(); err != nil {
+		return fmt.Errorf("invalid bytecode: %w", err)
+	}
+	for _, check := range checks {
+		if err := check(next); err != nil {
+			return err
+		}
+	}
+
+	vm.switches.mu.Lock()
+	var disabled []string
+	for rule := range vm.switches.disabled {
+		if name := vm.ruleName(rule); name != "" {
+			disabled = append(disabled, name)
+		}
+	}
+	vm.bytecode, vm.code, vm.codeErr = next.bytecode, next.code, nil
+	vm.schedule, vm.readers = next.schedule, next.readers
+	vm.symbols, vm.directory = next.symbols, next.directory
+	vm.factTable, vm.readOnly = next.factTable, next.readOnly
+	vm.messages, vm.webhooks = next.messages, next.webhooks
+	vm.actionDelays, vm.delays = next.actionDelays, next.delays
+	vm.sections, vm.schema, vm.provenance = next.sections, next.schema, next.provenance
+	vm.switches.disabled = nil
+	for _, name := range disabled {
+		if rule, ok := next.ruleIndex(name); ok {
+			if vm.switches.disabled == nil {
+				vm.switches.disabled = make(map[int]bool)
+			}
+			vm.switches.disabled[rule] = true
+		}
+	}
+	vm.switches.mu.Unlock()
+
+	if len(vm.holds) > 0 || len(vm.pending) > 0 {
+		vm.logger.Warn().
+			Int("Holds", len(vm.holds)).
+			Int("DelayedActions", len(vm.pending)).
+			Msg("Reloaded bytecode, restarting hold timers and dropping delayed actions")
+	}
+	vm.holds = make(map[int]*holdTimer)
+	vm.pending = make(map[int]*delayedAction)
+
+	for name, value := range next.facts {
+		if _, ok := vm.facts[name]; !ok {
+			vm.SetFact(name, value)
+		}
+	}
+	return nil
+}
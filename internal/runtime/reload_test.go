@@ -0,0 +1,98 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_Reload(t *testing.T) {
+	names, err := bytecode.NewRulesSection([]bytecode.RuleSymbol{{Name: "fan"}, {Name: "cooling"}})
+	require.NoError(t, err)
+	vm := NewVM(bytecode.AppendSections(chainedProgram(), names))
+	vm.SetFacts(map[string]interface{}{"temperature": 25, "ac_status": false})
+	require.NoError(t, vm.DisableRule("fan"))
+	require.NoError(t, vm.Run())
+	assert.Equal(t, false, vm.facts["ac_status"])
+
+	// The new rules cool from 20 on, with the fan rule now first
+	code := newProgram().
+		ruleStart(20).
+		loadFact("temperature").loadInt(20).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadBool(true).updateFact("ac_status").
+		label("rule0_end").op(bytecode.RULE_END).
+		ruleStart(10).
+		loadFact("ac_status").loadBool(true).op(bytecode.AND).
+		jump(bytecode.JUMP_IF_FALSE, "rule1_end").
+		loadBool(true).updateFact("fan_status").
+		label("rule1_end").op(bytecode.RULE_END).
+		bytes()
+	names, err = bytecode.NewRulesSection([]bytecode.RuleSymbol{{Name: "cooling"}, {Name: "fan"}})
+	require.NoError(t, err)
+	initial, err := bytecode.NewInitialFactsSection(map[string]interface{}{"temperature": 0, "mode": "auto"})
+	require.NoError(t, err)
+	require.NoError(t, vm.Reload(bytecode.AppendSections(code, names, initial)))
+
+	assert.Equal(t, 25, vm.facts["temperature"], "facts already set are kept")
+	assert.Equal(t, "auto", vm.facts["mode"], "initial facts not set yet are set")
+	rules := vm.Rules()
+	assert.True(t, rules[0].Enabled)
+	assert.False(t, rules[1].Enabled, "the fan rule stays disabled at its new index")
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["ac_status"])
+	assert.NotContains(t, vm.facts, "fan_status")
+}
+
+func TestVM_Reload_RollsBack(t *testing.T) {
+	vm := NewVM(chainedProgram())
+	vm.SetFacts(map[string]interface{}{"temperature": 35, "ac_status": false})
+
+	truncated := append(make([]byte, 12), byte(bytecode.LOAD_CONST_INT64))
+	assert.ErrorContains(t, vm.Reload(truncated), "invalid bytecode")
+	tooSmall := errors.New("too small")
+	assert.ErrorIs(t, vm.Reload(chainedProgram(), func(next *VM) error { return tooSmall }), tooSmall)
+
+	require.NoError(t, vm.Run(), "the VM keeps its program")
+	assert.Equal(t, true, vm.facts["ac_status"])
+}
+
+func TestVM_Reload_CompiledFile(t *testing.T) {
+	compile := func(threshold int) []byte {
+		ruleset, err := compiler.ParseRules([]byte(fmt.Sprintf(`[{
+            "name": "fan",
+            "consumedFacts": ["temperature"],
+            "producedFacts": ["fan_status"],
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": %d}]},
+            "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+        }]`, threshold)), compiler.Options{})
+		require.NoError(t, err)
+		compiled, err := compiler.Compile(ruleset, compiler.Options{})
+		require.NoError(t, err)
+		return compiled.Image
+	}
+	path := filepath.Join(t.TempDir(), "bytecode.bin")
+	require.NoError(t, os.WriteFile(path, compile(30), 0644))
+	image, err := os.ReadFile(path)
+	require.NoError(t, err)
+	vm := NewVM(image)
+	vm.SetFact("temperature", 25)
+	require.NoError(t, vm.Run())
+	assert.NotContains(t, vm.facts, "fan_status")
+
+	// The file is rewritten by the preprocessor with a lower threshold
+	require.NoError(t, os.WriteFile(path, compile(20), 0644))
+	image, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, vm.Reload(image))
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["fan_status"])
+	assert.Equal(t, "fan", vm.Rules()[0].Name)
+}
@@ -0,0 +1,73 @@
+// runtime/rollout.go
+
+package runtime
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"slices"
+)
+
+// inRollout reports whether the entity identified by the value of keyFact
+// falls within a rule's rollout percentage. The decision is deterministic: the
+// key value and the rule's salt are hashed into one of 100 buckets, and the
+// entity is included if its bucket is below the percentage. Entities without
+// the key fact are excluded.
+func (vm *VM) inRollout(percent int, salt uint32, keyFact string) bool {
+	key, ok := vm.getFact(keyFact)
+	if !ok {
+		return false
+	}
+	return entityBucket(salt, key) < percent
+}
+
+// inVariant reports whether the entity identified by the value of keyFact is
+// assigned to the variant covering buckets [low, high). Entities without the
+// key fact aren't assigned to any variant.
+func (vm *VM) inVariant(low, high int, salt uint32, keyFact string) bool {
+	key, ok := vm.getFact(keyFact)
+	if !ok {
+		return false
+	}
+	bucket := entityBucket(salt, key)
+	return bucket >= low && bucket < high
+}
+
+// Variant returns the A/B variant the entity was assigned to by the rule being
+// evaluated, or "" if the rule has no variants or none applies. It is intended
+// for AfterRule hooks that tag metrics or audit records with the variant.
+func (vm *VM) Variant() string {
+	return vm.variant
+}
+
+// entityBucket maps the key identifying an entity to a bucket in [0, 100).
+func entityBucket(salt uint32, key interface{}) int {
+	hash := fnv.New32a()
+	hash.Write(binary.LittleEndian.AppendUint32(nil, salt))
+	fmt.Fprint(hash, key)
+	return int(hash.Sum32() % 100)
+}
+
+// skipToRuleEnd moves ip to the RULE_END instruction of the current rule
+// without executing the instructions in between.
+func (vm *VM) skipToRuleEnd() error {
+	return vm.skipUntil(bytecode.RULE_END)
+}
+
+// skipUntil moves ip forward to the next instruction with one of the given
+// opcodes without executing the instructions in between.
+func (vm *VM) skipUntil(opcodes ...bytecode.Opcode) error {
+	for vm.ip < len(vm.bytecode) {
+		in, err := vm.instructionAt(vm.ip)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(opcodes, in.opcode) {
+			break
+		}
+		vm.ip = in.next
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package runtime
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rolloutProgram(percent int) []byte {
+	return newProgram().
+		ruleStart(0).rollout(percent, 42, "deviceId").
+		loadBool(true).updateFact("new_logic").
+		op(bytecode.RULE_END).
+		bytes()
+}
+
+func TestRollout_Deterministic(t *testing.T) {
+	included := 0
+	for i := 0; i < 1000; i++ {
+		deviceID := fmt.Sprintf("device-%d", i)
+
+		vm := NewVM(rolloutProgram(25))
+		vm.facts["deviceId"] = deviceID
+		require.NoError(t, vm.Run())
+
+		again := NewVM(rolloutProgram(25))
+		again.facts["deviceId"] = deviceID
+		require.NoError(t, again.Run())
+
+		assert.Equal(t, vm.facts["new_logic"], again.facts["new_logic"], "rollout decision for %s changed between runs", deviceID)
+		if vm.facts["new_logic"] == true {
+			included++
+		}
+	}
+
+	// Roughly a quarter of the devices should be included
+	assert.InDelta(t, 250, included, 50)
+}
+
+func TestRollout_Bounds(t *testing.T) {
+	vm := NewVM(rolloutProgram(0))
+	vm.facts["deviceId"] = "device-1"
+	require.NoError(t, vm.Run())
+	assert.NotContains(t, vm.facts, "new_logic")
+
+	vm = NewVM(rolloutProgram(100))
+	vm.facts["deviceId"] = "device-1"
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["new_logic"])
+}
+
+func TestRollout_MissingKeyExcludes(t *testing.T) {
+	vm := NewVM(rolloutProgram(100))
+
+	var fired []bool
+	vm.OnAfterRule(func(rule int, ruleFired bool) { fired = append(fired, ruleFired) })
+
+	require.NoError(t, vm.Run())
+	assert.NotContains(t, vm.facts, "new_logic")
+	assert.Equal(t, []bool{false}, fired, "a skipped rule should still reach RULE_END")
+}
@@ -5,264 +5,867 @@ package runtime
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
+	"reflect"
 	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"rgehrsitz/rex/internal/script"
+	"strings"
+	"sync"
+	"time"
 	"unsafe"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/text/collate"
 )
 
 // VM represents the virtual machine that executes bytecode.
 type VM struct {
-	bytecode []byte
-	ip       int
-	stack    []interface{}
-	facts    map[string]interface{}
+	bytecode  []byte
+	code      decodedCode            // Instructions decoded from the bytecode by NewVM
+	schedule  []ruleEntry            // Rules in execution order, nil without rule markers
+	readers   bytecode.FactReaders   // Rules reading each fact, by index, nil without rule markers
+	codeErr   error                  // Error decoding the bytecode, returned by every cycle
+	factTable bytecode.FactTable     // Facts LOAD_FACT, UPDATE_FACT, FACT_EXISTS and STORE_FACT refer to by index, nil if they name them inline
+	readOnly  []string               // Facts, or fact patterns, rules may not write
+	messages  []string               // Messages of the ERROR instructions, by index
+	webhooks  []bytecode.Webhook     // Requests of the webhook actions, by index, nil if the bytecode has none
+	symbols   []bytecode.RuleSymbol  // Names and metadata of the rules, by index, nil if the bytecode has none
+	directory bytecode.RuleDirectory // Where the rules start, by index, nil if the bytecode has none matching its code
+	ip        int
+	stack     []interface{}
+	facts     map[string]interface{}
+	hooks     hooks
+	tx        *transaction  // Fact writes pending for the current cycle
+	vars      []interface{} // Local variables of the current rule, by slot
+
+	subscriptions subscriptions // Host callbacks for fact changes
+
+	rule      int    // Index of the rule currently being evaluated
+	priority  int    // Priority of the rule currently being evaluated
+	ruleFired bool   // Whether the current rule has executed an action
+	halted    bool   // Set by HALT to stop the cycle
+	variant   string // A/B variant the current rule assigned the entity to
+
+	changed            []string // Facts whose value the current rule changed
+	maxChainDepth      int      // Maximum forward chaining depth; 0 disables chaining
+	maxChainIterations int      // Maximum chained rule re-evaluations per cycle; 0 for no limit
+
+	holds   map[int]*holdTimer // Timers of the rules with a HOLD whose conditions hold, by rule index
+	reached bool               // Whether the current rule reached its HOLD instruction
+
+	actionDelays []bytecode.ActionDelay // Delays of the delayed actions, as embedded in the bytecode
+	delays       map[int]time.Duration  // Delays of the delayed actions, by TRIGGER_ACTION offset
+	pending      map[int]*delayedAction // Delayed actions waiting to be performed, by TRIGGER_ACTION offset
+
+	sections []bytecode.Section       // Auxiliary data stored after the program code
+	actions  *ActionGuard             // Timeouts and circuit breakers for action handlers
+	handlers map[string]ActionHandler // Handlers registered with RegisterAction, by action type
+	clock    Clock                    // Source of time for temporal features
+
+	collation Collation         // How strings are compared
+	collator  *collate.Collator // Compares strings for collation, nil to compare bytes
+
+	scripts      map[string]*script.Program // Scripts compiled so far, by source
+	scriptLimits script.Limits              // Resources a script run may use
+
+	provenance  *bytecode.Provenance // Ruleset revision the bytecode comes from, nil if unknown
+	schema      bytecode.FactSchema  // Types of the facts, nil if the bytecode has none
+	schemaMode  SchemaMode           // How IngestFact treats values not matching the schema
+	ingestMu    sync.Mutex           // Guards ingestStats, which are read concurrently
+	ingestStats map[string]FactIngestStats
+
+	correlationID     string         // Correlation ID of the current or last cycle
+	nextCorrelationID string         // Correlation ID set for the next cycle
+	logger            zerolog.Logger // Logs the current cycle with its correlation ID
+
+	degrade  degradation  // Fact sources and action queues under the degradation policy
+	suppress suppression  // Maintenance windows withholding actions
+	switches ruleSwitches // Rules disabled by the host
+
+	factStore storeSync // Store the facts are kept in, if not only in memory
 }
 
 type VMError struct {
 	Message string
 	IP      int
+	Rule    string // Name of the rule being evaluated, if the bytecode names its rules
 }
 
 func (e *VMError) Error() string {
+	if e.Rule != "" {
+		return fmt.Sprintf("VM error at IP %d in rule '%s': %s", e.IP, e.Rule, e.Message)
+	}
 	return fmt.Sprintf("VM error at IP %d: %s", e.IP, e.Message)
 }
 
-// NewVM creates a new instance of the virtual machine.
-func NewVM(bytecode []byte) *VM {
-	return &VM{
-		bytecode: bytecode,
+// NewVM creates a new instance of the virtual machine. An image whose code
+// is in the encoding the compiler writes, such as the preprocessor's
+// bytecode.bin, is converted to the one the VM executes first; if that
+// fails, DecodeError returns the error.
+func NewVM(image []byte) *VM {
+	code, sections, err := bytecode.SplitSections(image)
+	if err != nil {
+		log.Error().Err(err).Msg("Ignoring bytecode sections")
+		code, sections = image, nil
+	}
+	var convertErr error
+	if bytecode.IsCompiledCode(sections) {
+		if converted, err := ConvertCompiledImage(image); err != nil {
+			convertErr = fmt.Errorf("failed to convert compiled bytecode: %w", err)
+		} else if code, sections, err = bytecode.SplitSections(converted); err != nil {
+			convertErr = err
+		}
+	}
+	vm := &VM{
+		bytecode: code,
 		ip:       0,
 		stack:    make([]interface{}, 0),
 		facts:    make(map[string]interface{}),
+		sections: sections,
+		actions:  NewActionGuard(ActionPolicy{}),
+		clock:    SystemClock{},
+		holds:    make(map[int]*holdTimer),
+		pending:  make(map[int]*delayedAction),
+
+		scripts:      make(map[string]*script.Program),
+		scriptLimits: script.DefaultLimits,
+	}
+	if vm.schema, _, err = bytecode.ReadSchema(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring fact schema")
+	}
+	if vm.factTable, _, err = bytecode.ReadFactTable(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring fact table")
+	}
+	if vm.readOnly, _, err = bytecode.ReadReadOnlyFacts(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring read-only facts")
+	}
+	if vm.messages, _, err = bytecode.ReadMessages(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring error messages")
+	}
+	if vm.webhooks, _, err = bytecode.ReadWebhooks(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring webhook requests")
+	}
+	if vm.actionDelays, _, err = bytecode.ReadActionDelays(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring action delays")
+	}
+	if vm.symbols, _, err = bytecode.ReadRules(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring rule names")
+	}
+	if vm.readers, _, err = bytecode.ReadFactReaders(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring fact readers")
+	}
+	if vm.directory, _, err = bytecode.ReadRuleDirectory(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring rule directory")
+	}
+	if initial, _, err := bytecode.ReadInitialFacts(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring initial facts")
+	} else {
+		for name, value := range initial {
+			vm.facts[name] = value
+		}
 	}
+	if provenance, ok, err := bytecode.ReadProvenance(sections); err != nil {
+		log.Error().Err(err).Msg("Ignoring bytecode provenance")
+	} else if ok {
+		vm.provenance = &provenance
+	}
+	if convertErr != nil {
+		log.Error().Err(convertErr).Msg("Failed to decode bytecode")
+		vm.codeErr = convertErr
+		return vm
+	}
+	vm.prepare()
+	return vm
+}
+
+// prepare decodes the bytecode and schedules its rules once, so that the
+// cycles run by the VM only execute the decoded instructions. A decoding
+// error is logged and returned by every cycle.
+func (vm *VM) prepare() {
+	vm.code, vm.codeErr = decodeCode(vm.bytecode, readHeader(vm.bytecode), vm.factTable)
+	if vm.codeErr != nil {
+		log.Error().Err(vm.codeErr).Msg("Failed to decode bytecode")
+		return
+	}
+	vm.schedule = scheduleRules(vm.code.instructions)
+	if vm.readers == nil && len(vm.schedule) > 0 {
+		vm.readers = factReaders(vm.schedule)
+	}
+	if vm.directory != nil {
+		if err := checkDirectory(vm.directory, vm.schedule); err != nil {
+			log.Error().Err(err).Msg("Ignoring rule directory")
+			vm.directory = nil
+		}
+	}
+	vm.delays = actionDelays(vm.code.instructions, vm.actionDelays)
+
+	log.Debug().
+		Int("Instructions", len(vm.code.instructions)).
+		Int("Rules", len(vm.schedule)).
+		Msg("Decoded bytecode")
+}
+
+// DecodeError returns the error decoding the bytecode, which every cycle
+// fails with, or nil if it decoded.
+func (vm *VM) DecodeError() error {
+	return vm.codeErr
 }
 
-// Run executes the bytecode in the virtual machine.
+// Source returns the ruleset JSON embedded in the bytecode, if the compiler
+// was asked to include it.
+func (vm *VM) Source() ([]byte, bool, error) {
+	section, ok := bytecode.FindSection(vm.sections, bytecode.SectionSource)
+	if !ok {
+		return nil, false, nil
+	}
+	source, err := section.Contents()
+	if err != nil {
+		return nil, false, err
+	}
+	return source, true, nil
+}
+
+// Provenance returns the hash of the ruleset the bytecode was compiled from,
+// with the compiler version and compilation time, if the compiler embedded
+// them.
+func (vm *VM) Provenance() (bytecode.Provenance, bool) {
+	if vm.provenance == nil {
+		return bytecode.Provenance{}, false
+	}
+	return *vm.provenance, true
+}
+
+// Run executes the bytecode in the virtual machine as one evaluation cycle,
+// invoking the registered hooks around it. Fact writes made by the cycle are
+// only applied to the fact store if the whole cycle succeeds. Along with the
+// actions the cycle triggers, it performs the delayed actions that have come
+// due by the VM's clock.
 func (vm *VM) Run() error {
+	_, err := vm.cycle(nil)
+	return err
+}
+
+// RunAffected runs an evaluation cycle like Run, but only evaluates the rules
+// whose conditions read one of the changed facts, along with the rules they
+// chain to. The rules are looked up in the fact readers index the compiler
+// embeds, or one built from the rules' instructions for bytecode without it.
+// Bytecode without rule markers can't tell its rules apart, so there every
+// rule is evaluated.
+func (vm *VM) RunAffected(changed []string) error {
+	_, err := vm.cycle(vm.affectedBy(changed))
+	return err
+}
+
+// RunRules runs an evaluation cycle like Run, but only evaluates the rules
+// with the given indices, along with the rules they chain to. Bytecode
+// without rule markers can't tell its rules apart, so there every rule is
+// evaluated.
+func (vm *VM) RunRules(rules []int) error {
+	selected := make(map[int]bool, len(rules))
+	for _, rule := range rules {
+		if rule < 0 || rule >= len(vm.schedule) {
+			return fmt.Errorf("no rule %d in the bytecode", rule)
+		}
+		selected[rule] = true
+	}
+	_, err := vm.cycle(func(entry ruleEntry) bool { return selected[entry.index] })
+	return err
+}
+
+// affectedBy selects the rules whose conditions read one of the changed facts.
+func (vm *VM) affectedBy(changed []string) func(ruleEntry) bool {
+	if changed == nil {
+		return nil
+	}
+	affected := make(map[int]bool)
+	for _, rule := range vm.readers.Rules(changed) {
+		affected[rule] = true
+	}
+	return func(entry ruleEntry) bool { return affected[entry.index] }
+}
+
+// cycle runs an evaluation cycle of the selected rules, or of every rule if
+// selected is nil, and returns the actions it triggered.
+func (vm *VM) cycle(selected func(ruleEntry) bool) ([]Action, error) {
+	vm.beginCorrelation()
+	if err := vm.hooks.runBeforeCycle(); err != nil {
+		vm.hooks.runAfterCycle(err)
+		return nil, err
+	}
+
+	if err := vm.loadFacts(); err != nil {
+		vm.hooks.runAfterCycle(err)
+		return nil, err
+	}
+
+	vm.pauseRules()
+	vm.tx = newTransaction(vm.logger)
+	var actions []Action
+	err := vm.execute(selected)
+	if err != nil {
+		vm.tx.rollback()
+	} else {
+		changes := vm.tx.commit(vm.facts)
+		saveErr := vm.saveChanges(changes)
+		vm.subscriptions.notify(changes)
+		actions = vm.withholdActions(append(vm.tx.actions, vm.settleDelayedActions()...))
+		err = errors.Join(saveErr, vm.performActions(actions))
+	}
+	vm.tx = nil
+
+	vm.hooks.runAfterCycle(err)
+	return actions, err
+}
+
+// execute runs the bytecode from the start of the program, evaluating the
+// selected rules, or every rule if selected is nil. A panic while evaluating,
+// such as one of a registered operator, is returned as a VMError.
+func (vm *VM) execute(selected func(ruleEntry) bool) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			if err, ok := r.(error); ok {
-				panic(&VMError{Message: err.Error(), IP: vm.ip})
-			}
-			panic(r)
+			err = &VMError{Message: fmt.Sprint(r), IP: vm.ip}
 		}
 	}()
 
-	// Skip over the header bytes
-	headerSize := readHeader(vm.bytecode)
-	vm.ip = headerSize
-
-	for vm.ip < len(vm.bytecode) {
-		opcode := bytecode.Opcode(vm.bytecode[vm.ip])
-		vm.ip++
-
-		// Print the current instruction
-		log.Debug().Int("IP", vm.ip).Str("Opcode", opcode.String()).Msg("Processing instruction")
-
-		if opcode.HasOperands() {
-			operands, n := decodeOperands(vm.bytecode[vm.ip:])
-			vm.ip += n
-			fmt.Printf(", Operands: %v", operands)
-		}
-		fmt.Println()
-
-		switch opcode {
-		case bytecode.LOAD_CONST_INT:
-			value, n := decodeInt(vm.bytecode[vm.ip:])
-			vm.ip += n
-			log.Debug().Interface("StackBefore", vm.stack).Msg("Before LOAD_CONST_INT")
-			vm.stack = append(vm.stack, value)
-			log.Debug().Interface("StackAfter", vm.stack).Msg("After LOAD_CONST_INT")
-
-		case bytecode.LOAD_CONST_FLOAT:
-			value, n := decodeFloat(vm.bytecode[vm.ip:])
-			vm.ip += n
-			vm.stack = append(vm.stack, value)
-
-		case bytecode.LOAD_CONST_STRING:
-			value, n := decodeString(vm.bytecode[vm.ip:])
-			vm.ip += n
-			vm.stack = append(vm.stack, value)
-
-		case bytecode.LOAD_FACT:
-			factName, n := decodeString(vm.bytecode[vm.ip:])
-			vm.ip += n
-			fmt.Printf("Before LOAD_FACT: Stack = %v\n", vm.stack)
-			value, ok := vm.facts[factName]
-			if !ok {
-				return fmt.Errorf("undefined fact: %s", factName)
-			}
-			vm.stack = append(vm.stack, value)
-			fmt.Printf("After LOAD_FACT: Stack = %v\n", vm.stack)
+	if vm.codeErr != nil {
+		return vm.codeErr
+	}
 
-		case bytecode.EQ_INT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(int) == b.(int)
-			}); err != nil {
+	vm.rule = 0
+	vm.priority = 0
+	vm.ruleFired = false
+	vm.halted = false
+
+	// Bytecode without rule markers is executed straight through, skipping
+	// over the header
+	schedule := vm.schedule
+	if len(schedule) == 0 {
+		if len(vm.code.instructions) > 0 {
+			vm.ip = vm.code.instructions[0].offset
+		} else {
+			vm.ip = len(vm.bytecode)
+		}
+		for vm.ip < len(vm.bytecode) && !vm.halted {
+			if err := vm.step(); err != nil {
 				return err
 			}
+		}
+		return nil
+	}
 
-		case bytecode.NEQ_INT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(int) != b.(int)
-			}); err != nil {
-				return err
-			}
+	skipped := func(entry ruleEntry) bool {
+		return vm.rulePaused(entry) || vm.ruleDisabled(entry) || (selected != nil && !selected(entry))
+	}
+	var queue []chainLink
+	for position, entry := range schedule {
+		if skipped(entry) {
+			continue
+		}
+		changed, err := vm.evaluateRule(entry)
+		if err != nil {
+			return err
+		}
+		if vm.halted {
+			return nil
+		}
+		if vm.maxChainDepth > 0 {
+			// The rules still to be evaluated in this pass see the changes
+			// then, so only those evaluated before the producer are chained
+			pending := func(reader int) bool { return reader > position && !skipped(schedule[reader]) }
+			queue = append(queue, vm.dependentRules(schedule, entry, changed, chainLink{}, pending)...)
+		}
+	}
 
-		case bytecode.LT_INT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(int) < b.(int)
-			}); err != nil {
-				return err
-			}
+	return vm.chain(schedule, queue)
+}
 
-		case bytecode.LTE_INT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(int) <= b.(int)
-			}); err != nil {
-				return err
-			}
+// evaluateRule runs a single scheduled rule and returns the facts whose values
+// it changed.
+func (vm *VM) evaluateRule(entry ruleEntry) ([]string, error) {
+	vm.ip = entry.start
+	vm.rule = entry.index
+	vm.changed = nil
+	vm.reached = false
+	vm.tx.evaluated[entry.index] = true
+	if err := vm.runRule(); err != nil {
+		var vmErr *VMError
+		if errors.As(err, &vmErr) && vmErr.Rule == "" {
+			vmErr.Rule = vm.ruleName(entry.index)
+		}
+		if err = vm.hooks.runRuleError(vm.rule, err); err != nil {
+			return nil, err
+		}
+		if err := vm.recoverRule(entry); err != nil {
+			return nil, err
+		}
+	}
+	if entry.held && !vm.reached {
+		// The conditions no longer hold, the rule's timer starts over
+		delete(vm.holds, entry.index)
+	}
+	return vm.changed, nil
+}
 
-		case bytecode.GT_INT:
-			fmt.Printf("Before GT_INT: Stack = %v\n", vm.stack)
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(int) > b.(int)
-			}); err != nil {
-				return err
-			}
-			fmt.Printf("After GT_INT: Stack = %v\n", vm.stack)
+// recoverRule resynchronizes the VM after a rule failed and the failure was
+// swallowed by an OnRuleError hook: the stack is cleared and execution
+// resumes at the rule's RULE_END, so the rule ends normally. The rule is
+// scanned again from its start, since ip may point into the middle of the
+// instruction that failed.
+func (vm *VM) recoverRule(entry ruleEntry) error {
+	vm.stack = vm.stack[:0]
+	vm.ip = entry.start
+	if err := vm.skipToRuleEnd(); err != nil {
+		return err
+	}
+	if vm.ip >= len(vm.bytecode) {
+		return nil
+	}
+	return vm.step()
+}
 
-		case bytecode.GTE_INT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(int) >= b.(int)
-			}); err != nil {
-				return err
-			}
+// runRule executes instructions from ip up to and including the next RULE_END.
+func (vm *VM) runRule() error {
+	for vm.ip < len(vm.bytecode) && !vm.halted {
+		in, err := vm.instructionAt(vm.ip)
+		if err != nil {
+			return err
+		}
+		if err := vm.exec(in); err != nil {
+			return err
+		}
+		if in.opcode == bytecode.RULE_END {
+			break
+		}
+	}
+	return nil
+}
 
-		case bytecode.EQ_FLOAT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(float64) == b.(float64)
-			}); err != nil {
-				return err
-			}
+// step executes the instruction at ip.
+func (vm *VM) step() error {
+	in, err := vm.instructionAt(vm.ip)
+	if err != nil {
+		return err
+	}
+	return vm.exec(in)
+}
 
-		case bytecode.NEQ_FLOAT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(float64) != b.(float64)
-			}); err != nil {
-				return err
-			}
+// exec executes a decoded instruction, leaving ip at the instruction to run
+// next.
+func (vm *VM) exec(in *instruction) error {
+	opcode := in.opcode
+	vm.ip = in.next
 
-		case bytecode.LT_FLOAT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(float64) < b.(float64)
-			}); err != nil {
-				return err
-			}
+	vm.logger.Debug().Int("IP", in.offset).Str("Opcode", opcode.String()).Msg("Processing instruction")
 
-		case bytecode.LTE_FLOAT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(float64) <= b.(float64)
-			}); err != nil {
-				return err
-			}
+	switch opcode {
+	case bytecode.LOAD_CONST_INT:
+		vm.logger.Debug().Interface("StackBefore", vm.stack).Msg("Before LOAD_CONST_INT")
+		vm.stack = append(vm.stack, in.value)
+		vm.logger.Debug().Interface("StackAfter", vm.stack).Msg("After LOAD_CONST_INT")
 
-		case bytecode.GT_FLOAT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(float64) > b.(float64)
-			}); err != nil {
-				return err
-			}
+	case bytecode.LOAD_CONST_INT64, bytecode.LOAD_CONST_UINT64, bytecode.LOAD_CONST_FLOAT,
+		bytecode.LOAD_CONST_STRING, bytecode.LOAD_CONST_BOOL, bytecode.LOAD_CONST_INT16, bytecode.LOAD_CONST_FLOAT32:
+		vm.stack = append(vm.stack, in.value)
 
-		case bytecode.GTE_FLOAT:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(float64) >= b.(float64)
-			}); err != nil {
-				return err
-			}
+	case bytecode.LOAD_FACT:
+		value, ok := vm.getFact(in.name)
+		if !ok {
+			return fmt.Errorf("undefined fact: %s", in.name)
+		}
+		vm.stack = append(vm.stack, value)
 
-		case bytecode.EQ_STRING:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(string) == b.(string)
-			}); err != nil {
-				return err
-			}
+	case bytecode.FACT_EXISTS:
+		_, ok := vm.getFact(in.name)
+		vm.stack = append(vm.stack, ok)
 
-		case bytecode.NEQ_STRING:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(string) != b.(string)
-			}); err != nil {
-				return err
-			}
+	case bytecode.LOAD_VAR:
+		slot := in.arg
+		if slot >= len(vm.vars) {
+			return &VMError{Message: fmt.Sprintf("load of unset variable %d", slot), IP: vm.ip}
+		}
+		vm.stack = append(vm.stack, vm.vars[slot])
+
+	case bytecode.STORE_VAR:
+		slot := in.arg
+		if len(vm.stack) == 0 {
+			return &VMError{Message: "store from an empty stack", IP: vm.ip}
+		}
+		for len(vm.vars) <= slot {
+			vm.vars = append(vm.vars, nil)
+		}
+		vm.vars[slot] = vm.stack[len(vm.stack)-1]
+
+	case bytecode.EQ_INT:
+		if err := vm.equalityOp(true); err != nil {
+			return err
+		}
+
+	case bytecode.NEQ_INT:
+		if err := vm.equalityOp(false); err != nil {
+			return err
+		}
+
+	case bytecode.LT_INT:
+		if err := vm.numericOp(
+			func(c int) bool { return c < 0 },
+			func(a, b float64) bool { return a < b },
+		); err != nil {
+			return err
+		}
+
+	case bytecode.LTE_INT:
+		if err := vm.numericOp(
+			func(c int) bool { return c <= 0 },
+			func(a, b float64) bool { return a <= b },
+		); err != nil {
+			return err
+		}
+
+	case bytecode.GT_INT:
+		if err := vm.numericOp(
+			func(c int) bool { return c > 0 },
+			func(a, b float64) bool { return a > b },
+		); err != nil {
+			return err
+		}
+
+	case bytecode.GTE_INT:
+		if err := vm.numericOp(
+			func(c int) bool { return c >= 0 },
+			func(a, b float64) bool { return a >= b },
+		); err != nil {
+			return err
+		}
+
+	case bytecode.EQ_FLOAT:
+		if err := vm.numericOp(nil, func(a, b float64) bool { return a == b }); err != nil {
+			return err
+		}
+
+	case bytecode.NEQ_FLOAT:
+		if err := vm.numericOp(nil, func(a, b float64) bool { return a != b }); err != nil {
+			return err
+		}
+
+	case bytecode.EQ_FLOAT_EPSILON:
+		if err := vm.numericOp(nil, func(a, b float64) bool { return withinEpsilon(a, b, in.epsilon) }); err != nil {
+			return err
+		}
+
+	case bytecode.NEQ_FLOAT_EPSILON:
+		if err := vm.numericOp(nil, func(a, b float64) bool { return !withinEpsilon(a, b, in.epsilon) }); err != nil {
+			return err
+		}
+
+	case bytecode.LT_FLOAT:
+		if err := vm.numericOp(nil, func(a, b float64) bool { return a < b }); err != nil {
+			return err
+		}
+
+	case bytecode.LTE_FLOAT:
+		if err := vm.numericOp(nil, func(a, b float64) bool { return a <= b }); err != nil {
+			return err
+		}
+
+	case bytecode.GT_FLOAT:
+		if err := vm.numericOp(nil, func(a, b float64) bool { return a > b }); err != nil {
+			return err
+		}
+
+	case bytecode.GTE_FLOAT:
+		if err := vm.numericOp(nil, func(a, b float64) bool { return a >= b }); err != nil {
+			return err
+		}
+
+	case bytecode.ADD_FLOAT:
+		if err := vm.addFloat(); err != nil {
+			return err
+		}
+
+	case bytecode.EQ_STRING:
+		if err := vm.stringOp(vm.equalStrings); err != nil {
+			return err
+		}
+
+	case bytecode.NEQ_STRING:
+		if err := vm.stringOp(func(a, b string) bool { return !vm.equalStrings(a, b) }); err != nil {
+			return err
+		}
 
-		case bytecode.AND:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(bool) && b.(bool)
-			}); err != nil {
+	case bytecode.EQ_BOOL:
+		if err := vm.logicalOp(func(a, b bool) bool { return a == b }); err != nil {
+			return err
+		}
+
+	case bytecode.NEQ_BOOL:
+		if err := vm.logicalOp(func(a, b bool) bool { return a != b }); err != nil {
+			return err
+		}
+
+	case bytecode.CONTAINS_STRING:
+		if err := vm.stringOp(func(a, b string) bool { return strings.Contains(a, b) }); err != nil {
+			return err
+		}
+
+	case bytecode.NOT_CONTAINS_STRING:
+		if err := vm.stringOp(func(a, b string) bool { return !strings.Contains(a, b) }); err != nil {
+			return err
+		}
+
+	case bytecode.IN_LIST, bytecode.NOT_IN_LIST:
+		value, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		member, err := memberOf(value, in.value.([]interface{}), vm.equalStrings)
+		if err != nil {
+			return &VMError{Message: err.Error(), IP: vm.ip}
+		}
+		vm.stack = append(vm.stack, member == (opcode == bytecode.IN_LIST))
+
+	case bytecode.AND:
+		if err := vm.logicalOp(func(a, b bool) bool { return a && b }); err != nil {
+			return err
+		}
+
+	case bytecode.OR:
+		if err := vm.logicalOp(func(a, b bool) bool { return a || b }); err != nil {
+			return err
+		}
+
+	case bytecode.NOT:
+		a, err := vm.popBool()
+		if err != nil {
+			return err
+		}
+		vm.stack = append(vm.stack, !a)
+
+	case bytecode.JUMP:
+		vm.ip = in.arg
+
+	case bytecode.JUMP_IF_TRUE:
+		a, err := vm.popBool()
+		if err != nil {
+			return err
+		}
+		if a {
+			vm.ip = in.arg
+		}
+
+	case bytecode.JUMP_IF_FALSE:
+		a, err := vm.popBool()
+		if err != nil {
+			return err
+		}
+		if !a {
+			vm.ip = in.arg
+		}
+
+	case bytecode.UPDATE_FACT:
+		if err := vm.updateFact(in.name); err != nil {
+			if err = vm.hooks.runActionError(vm.rule, err); err != nil {
 				return err
 			}
+		}
 
-		case bytecode.OR:
-			if err := vm.binaryOp(func(a, b interface{}) interface{} {
-				return a.(bool) || b.(bool)
-			}); err != nil {
+	case bytecode.STORE_FACT:
+		if len(vm.stack) == 0 {
+			return &VMError{Message: "store from an empty stack", IP: vm.ip}
+		}
+		if err := vm.storeFact(in.name, vm.stack[len(vm.stack)-1]); err != nil {
+			if err = vm.hooks.runActionError(vm.rule, err); err != nil {
 				return err
 			}
+		}
 
-		case bytecode.NOT:
-			if err := vm.unaryOp(func(a interface{}) interface{} {
-				return !a.(bool)
-			}); err != nil {
+	case bytecode.TRIGGER_ACTION:
+		if _, delayed := vm.delays[in.offset]; delayed {
+			if err := vm.delayAction(in.offset, in.name, in.name2); err != nil {
 				return err
 			}
+		} else if err := vm.triggerAction(in.name, in.name2); err != nil {
+			return err
+		}
 
-		case bytecode.JUMP:
-			offset, n := decodeInt(vm.bytecode[vm.ip:])
-			vm.ip += n
-			vm.ip = offset
+	case bytecode.RULE_START:
+		vm.priority = in.arg
+		vm.ruleFired = false
+		vm.variant = ""
+		vm.vars = vm.vars[:0]
 
-		case bytecode.JUMP_IF_TRUE:
-			offset, n := decodeInt(vm.bytecode[vm.ip:])
-			vm.ip += n
-			a, err := vm.pop()
-			if err != nil {
+	case bytecode.ROLLOUT:
+		if !vm.inRollout(in.arg, in.salt, in.name) {
+			if err := vm.skipToRuleEnd(); err != nil {
 				return err
 			}
-			if a.(bool) {
-				vm.ip = offset
-			}
+		}
 
-		case bytecode.JUMP_IF_FALSE:
-			offset, n := decodeInt(vm.bytecode[vm.ip:])
-			vm.ip += n
-			a, err := vm.pop()
-			if err != nil {
+	case bytecode.HOLD:
+		if !vm.hold(in.hold, in.once) {
+			if err := vm.skipToRuleEnd(); err != nil {
 				return err
 			}
-			if !a.(bool) {
-				vm.ip = offset
-			}
+		}
 
-		case bytecode.HALT:
-			return nil
+	case bytecode.VARIANT:
+		if vm.variant == "" && vm.inVariant(in.arg, in.arg2, in.salt, in.name) {
+			vm.variant = in.name2
+			vm.logger.Debug().Int("Rule", vm.rule).Str("Variant", vm.variant).Msg("Assigned variant")
+		} else if err := vm.skipUntil(bytecode.VARIANT, bytecode.VARIANT_END, bytecode.RULE_END); err != nil {
+			return err
+		}
+
+	case bytecode.VARIANT_END:
+		// Marks the end of the variant actions, nothing to do
+
+	case bytecode.MATCH_FACTS:
+		if err := vm.matchFacts(in.name, in.name2, in.all); err != nil {
+			return err
+		}
+
+	case bytecode.CALL_SCRIPT:
+		if err := vm.callScript(in.name, in.facts, in.arg == int(bytecode.ScriptCondition)); err != nil {
+			return err
+		}
+
+	case bytecode.COND_START, bytecode.COND_END:
+		// Mark the condition code of the rule, nothing to do
 
-		default:
-			return &VMError{Message: fmt.Sprintf("unknown opcode: %d", opcode), IP: vm.ip}
+	case bytecode.CALL_OPERATOR:
+		if err := vm.callOperator(in.name); err != nil {
+			return err
 		}
+
+	case bytecode.RULE_END:
+		vm.hooks.runAfterRule(vm.rule, vm.ruleFired)
+		vm.rule++
+		vm.ruleFired = false
+		vm.variant = ""
+
+	case bytecode.HALT:
+		vm.halted = true
+
+	case bytecode.NOP:
+		// Padding between rules, nothing to do
+
+	case bytecode.ERROR:
+		return &VMError{Message: vm.errorMessage(in.arg), IP: in.offset}
+
+	default:
+		return &VMError{Message: fmt.Sprintf("unknown opcode: %d", opcode), IP: vm.ip}
 	}
 
 	return nil
 }
 
-func (vm *VM) binaryOp(op func(a, b interface{}) interface{}) error {
-	b, err := vm.pop()
+// errorMessage returns the message of an ERROR instruction, from the
+// messages embedded in the image.
+func (vm *VM) errorMessage(index int) string {
+	if index < len(vm.messages) {
+		return vm.messages[index]
+	}
+	return fmt.Sprintf("error #%d, the image has no message for it", index)
+}
+
+// SetFact sets the value of a fact in the fact store. It must not be called
+// while a cycle is running.
+func (vm *VM) SetFact(name string, value interface{}) {
+	vm.facts[name] = value
+	vm.factStore.recordSet(name, value)
+}
+
+// SetFacts sets the values of several facts in the fact store, such as an
+// initial fact set, leaving the other facts unchanged. It must not be called
+// while a cycle is running.
+func (vm *VM) SetFacts(facts map[string]interface{}) {
+	for name, value := range facts {
+		vm.SetFact(name, value)
+	}
+}
+
+// GetFact returns the value of a fact in the fact store, and whether it is
+// set. It must not be called while a cycle is running.
+func (vm *VM) GetFact(name string) (interface{}, bool) {
+	value, ok := vm.facts[name]
+	return value, ok
+}
+
+// DeleteFact removes a fact from the fact store. It must not be called while a
+// cycle is running.
+func (vm *VM) DeleteFact(name string) {
+	delete(vm.facts, name)
+	vm.factStore.recordDelete(name)
+}
+
+// Facts returns a copy of the fact store.
+func (vm *VM) Facts() map[string]interface{} {
+	facts := make(map[string]interface{}, len(vm.facts))
+	for name, value := range vm.facts {
+		facts[name] = value
+	}
+	return facts
+}
+
+// ErrReadOnlyFact is returned when a rule writes a fact the ruleset declares
+// read-only. The host still sets such facts with SetFact and IngestFact.
+var ErrReadOnlyFact = errors.New("fact is read-only")
+
+// ReadOnlyFacts returns the facts, or fact patterns, rules may not write.
+func (vm *VM) ReadOnlyFacts() []string {
+	return vm.readOnly
+}
+
+// getFact looks up a fact, preferring a value written earlier in the current cycle.
+func (vm *VM) getFact(factName string) (interface{}, bool) {
+	if vm.tx != nil {
+		if value, ok := vm.tx.get(factName); ok {
+			return value, true
+		}
+	}
+	value, ok := vm.facts[factName]
+	return value, ok
+}
+
+// updateFact pops the value on top of the stack and records it as a pending
+// write to the named fact.
+func (vm *VM) updateFact(factName string) error {
+	value, err := vm.pop()
 	if err != nil {
 		return err
 	}
-	a, err := vm.pop()
+	if err := vm.storeFact(factName, value); err != nil {
+		return err
+	}
+	vm.ruleFired = true
+	vm.hooks.runFactUpdated(vm.rule, factName, value)
+	return nil
+}
+
+// storeFact writes a fact, noting it as changed if its value differs. Unlike
+// updateFact, it doesn't make the rule fire.
+func (vm *VM) storeFact(factName string, value interface{}) error {
+	if rules.MatchAnyFact(vm.readOnly, factName) {
+		return fmt.Errorf("%w: %s", ErrReadOnlyFact, factName)
+	}
+	previous, existed := vm.getFact(factName)
+	if vm.tx.set(factName, value, vm.priority) && (!existed || !reflect.DeepEqual(previous, value)) {
+		vm.changed = append(vm.changed, factName)
+	}
+	vm.logger.Debug().Str("Fact", factName).Interface("Value", value).Msg("Fact updated")
+	return nil
+}
+
+// stringOp pops two strings and pushes the result of op applied to them.
+func (vm *VM) stringOp(op func(a, b string) bool) error {
+	b, err := vm.popString()
+	if err != nil {
+		return err
+	}
+	a, err := vm.popString()
 	if err != nil {
 		return err
 	}
@@ -270,15 +873,46 @@ func (vm *VM) binaryOp(op func(a, b interface{}) interface{}) error {
 	return nil
 }
 
-func (vm *VM) unaryOp(op func(a interface{}) interface{}) error {
-	a, err := vm.pop()
+// logicalOp pops two booleans and pushes the result of op applied to them.
+func (vm *VM) logicalOp(op func(a, b bool) bool) error {
+	b, err := vm.popBool()
+	if err != nil {
+		return err
+	}
+	a, err := vm.popBool()
 	if err != nil {
 		return err
 	}
-	vm.stack = append(vm.stack, op(a))
+	vm.stack = append(vm.stack, op(a, b))
 	return nil
 }
 
+// popBool pops the value on top of the stack, which must be a boolean.
+func (vm *VM) popBool() (bool, error) {
+	value, err := vm.pop()
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, &VMError{Message: fmt.Sprintf("expected a bool operand, got %T", value), IP: vm.ip}
+	}
+	return b, nil
+}
+
+// popString pops the value on top of the stack, which must be a string.
+func (vm *VM) popString() (string, error) {
+	value, err := vm.pop()
+	if err != nil {
+		return "", err
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", &VMError{Message: fmt.Sprintf("expected a string operand, got %T", value), IP: vm.ip}
+	}
+	return s, nil
+}
+
 func (vm *VM) pop() (interface{}, error) {
 	if len(vm.stack) == 0 {
 		return nil, &VMError{Message: "pop from an empty stack", IP: vm.ip}
@@ -0,0 +1,109 @@
+// runtime/schedule.go
+
+package runtime
+
+import (
+	"encoding/binary"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"sort"
+)
+
+// ruleEntry describes where a rule starts in the bytecode and how it should be
+// scheduled relative to the other rules.
+type ruleEntry struct {
+	index    int // Position of the rule in the bytecode
+	start    int // Offset of the rule's RULE_START instruction
+	end      int // Offset of the instruction following the rule's RULE_END
+	priority int
+	consumes map[string]bool // Facts loaded by the rule's conditions
+	patterns []string        // Fact patterns matched by the rule's conditions
+	writes   map[string]bool // Facts written by the rule's actions
+	held     bool            // Whether the rule has a HOLD instruction
+}
+
+// reads reports whether the rule's conditions depend on a fact.
+func (e ruleEntry) reads(factName string) bool {
+	if e.consumes[factName] {
+		return true
+	}
+	for _, pattern := range e.patterns {
+		if rules.MatchFact(pattern, factName) {
+			return true
+		}
+	}
+	return false
+}
+
+// factReaders indexes the scheduled rules by the facts and fact patterns
+// their conditions read.
+func factReaders(schedule []ruleEntry) bytecode.FactReaders {
+	readers := make(bytecode.FactReaders)
+	for _, entry := range schedule {
+		for fact := range entry.consumes {
+			readers[fact] = append(readers[fact], entry.index)
+		}
+		for _, pattern := range entry.patterns {
+			if n := len(readers[pattern]); n == 0 || readers[pattern][n-1] != entry.index {
+				readers[pattern] = append(readers[pattern], entry.index)
+			}
+		}
+	}
+	for _, rules := range readers {
+		sort.Ints(rules)
+	}
+	return readers
+}
+
+// scheduleRules finds the RULE_START markers among the instructions and
+// returns the rules in execution order: highest priority first, with rules of
+// equal priority kept in bytecode order. It returns nil if the bytecode has no
+// rule markers.
+func scheduleRules(instructions []instruction) []ruleEntry {
+	var schedule []ruleEntry
+	for _, in := range instructions {
+		if in.opcode == bytecode.RULE_START {
+			schedule = append(schedule, ruleEntry{
+				index:    len(schedule),
+				start:    in.offset,
+				priority: in.arg,
+				consumes: make(map[string]bool),
+				writes:   make(map[string]bool),
+			})
+		}
+		if len(schedule) == 0 {
+			continue
+		}
+		current := &schedule[len(schedule)-1]
+		switch in.opcode {
+		case bytecode.LOAD_FACT, bytecode.FACT_EXISTS, bytecode.ROLLOUT, bytecode.VARIANT:
+			// The fact loaded or tested, or the key fact assigning entities to buckets
+			current.consumes[in.name] = true
+		case bytecode.UPDATE_FACT, bytecode.STORE_FACT:
+			current.writes[in.name] = true
+		case bytecode.HOLD:
+			current.held = true
+		case bytecode.RULE_END:
+			current.end = in.next
+		case bytecode.MATCH_FACTS:
+			current.patterns = append(current.patterns, in.name)
+		case bytecode.CALL_SCRIPT:
+			if in.arg == int(bytecode.ScriptCondition) {
+				for _, fact := range in.facts {
+					current.consumes[fact] = true
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(schedule, func(i, j int) bool {
+		return schedule[i].priority > schedule[j].priority
+	})
+
+	return schedule
+}
+
+// decodePriority decodes the priority operand of a RULE_START instruction.
+func decodePriority(bytecode []byte) int {
+	return int(int32(binary.LittleEndian.Uint32(bytecode)))
+}
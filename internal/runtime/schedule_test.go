@@ -0,0 +1,137 @@
+package runtime
+
+import (
+	"fmt"
+	"math/rand"
+	"rgehrsitz/rex/internal/preprocessor"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleRules_OrdersByPriority(t *testing.T) {
+	code := newProgram().
+		ruleStart(1).op(bytecode.RULE_END).
+		ruleStart(5).op(bytecode.RULE_END).
+		ruleStart(-2).op(bytecode.RULE_END).
+		ruleStart(5).op(bytecode.RULE_END).
+		bytes()
+
+	decoded, err := decodeCode(code, 12, nil)
+	require.NoError(t, err)
+	schedule := scheduleRules(decoded.instructions)
+
+	var order []int
+	for _, entry := range schedule {
+		order = append(order, entry.index)
+	}
+	// Equal priorities keep their bytecode order
+	assert.Equal(t, []int{1, 3, 0, 2}, order)
+}
+
+func TestScheduleRules_NoMarkers(t *testing.T) {
+	decoded, err := decodeCode(twoRuleProgram(), 12, nil)
+	require.NoError(t, err)
+	schedule := scheduleRules(decoded.instructions)
+	assert.Empty(t, schedule)
+}
+
+func TestRun_HonorsPriority(t *testing.T) {
+	// The low priority rule comes first in the bytecode and jumps within itself
+	code := newProgram().
+		ruleStart(1).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadInt(1).updateFact("fan_speed").
+		label("rule0_end").op(bytecode.RULE_END).
+		ruleStart(10).
+		loadInt(3).updateFact("fan_speed").
+		loadBool(true).updateFact("alarm").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+	vm.facts["temperature"] = 35
+
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) {
+		assert.True(t, fired)
+		evaluated = append(evaluated, rule)
+	})
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []int{1, 0}, evaluated, "Higher priority rule should be evaluated first")
+	assert.Equal(t, 3, vm.facts["fan_speed"], "Higher priority write should win the conflict")
+	assert.Equal(t, true, vm.facts["alarm"])
+}
+
+func TestTransaction_PriorityConflictResolution(t *testing.T) {
+	tx := newTransaction(zerolog.Nop())
+	tx.set("mode", "eco", 1)
+	tx.set("mode", "boost", 5)
+	tx.set("mode", "off", 2)
+	tx.set("level", 1, 0)
+	tx.set("level", 2, 0)
+
+	facts := make(map[string]interface{})
+	tx.commit(facts)
+	assert.Equal(t, "boost", facts["mode"])
+	assert.Equal(t, 2, facts["level"], "Equal priority writes should keep the last write")
+}
+
+// TestRun_EqualPrioritiesRunInDeclarationOrder checks end to end, on random
+// rulesets taken through the optimizer and compiler, that rules run by
+// descending priority and that rules of equal priority run in the order they
+// were declared.
+func TestRun_EqualPrioritiesRunInDeclarationOrder(t *testing.T) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	generate := func(seed int64) []*rules.Rule {
+		generator := &ruleGenerator{rand: rand.New(rand.NewSource(seed))}
+		var ruleSet []*rules.Rule
+		for i := generator.rand.Intn(10); i >= 0; i-- {
+			rule := generator.rule()
+			// Padded so that names sort in declaration order
+			rule.Name = fmt.Sprintf("rule%02d", len(ruleSet))
+			rule.Priority = generator.rand.Intn(3) - 1
+			ruleSet = append(ruleSet, rule)
+		}
+		return ruleSet
+	}
+
+	for seed := int64(0); seed < 300; seed++ {
+		ruleSet := generate(seed)
+		optimized, err := preprocessor.OptimizeRules(ruleSet, rules.NewRuleEngineContext())
+		require.NoError(t, err)
+		code := compileForVM(t, optimized, bytecode.ConditionModeJump)
+
+		// Compiling the same ruleset again gives the same bytecode
+		again, err := preprocessor.OptimizeRules(generate(seed), rules.NewRuleEngineContext())
+		require.NoError(t, err)
+		require.Equal(t, code, compileForVM(t, again, bytecode.ConditionModeJump), "seed %d", seed)
+
+		vm := NewVM(code)
+		for fact, value := range (&ruleGenerator{rand: rand.New(rand.NewSource(seed))}).facts() {
+			vm.SetFact(fact, value)
+		}
+		var evaluated []*rules.Rule
+		vm.OnAfterRule(func(rule int, fired bool) {
+			evaluated = append(evaluated, optimized[rule])
+		})
+		require.NoError(t, vm.Run())
+
+		require.Len(t, evaluated, len(optimized), "seed %d", seed)
+		for i := 1; i < len(evaluated); i++ {
+			previous, rule := evaluated[i-1], evaluated[i]
+			require.True(t, previous.Priority > rule.Priority ||
+				previous.Priority == rule.Priority && previous.Name < rule.Name,
+				"seed %d: %s (priority %d) ran before %s (priority %d)",
+				seed, previous.Name, previous.Priority, rule.Name, rule.Priority)
+		}
+	}
+}
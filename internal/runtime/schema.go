@@ -0,0 +1,219 @@
+// runtime/schema.go
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"strconv"
+)
+
+// ErrFactType is returned for fact values refused because their type doesn't
+// match the fact schema.
+var ErrFactType = errors.New("fact value doesn't match the schema")
+
+// SchemaMode selects what IngestFact does with values whose type doesn't
+// match the fact schema embedded in the bytecode. Ints and floats are both
+// numbers: a fact compared as an int accepts 30.5, since the compiler infers
+// the type of a fact from the values it is compared with.
+type SchemaMode int
+
+const (
+	// SchemaOff accepts every value, leaving mismatches to fail the
+	// comparisons that reach them.
+	SchemaOff SchemaMode = iota
+	// SchemaReject refuses values of the wrong type, keeping the fact's
+	// previous value.
+	SchemaReject
+	// SchemaCoerce converts values to the fact's type where their text
+	// allows it, such as the string "30" for an int fact or 30 for a string
+	// fact, and refuses the others.
+	SchemaCoerce
+)
+
+var schemaModeNames = map[SchemaMode]string{
+	SchemaOff:    "off",
+	SchemaReject: "reject",
+	SchemaCoerce: "coerce",
+}
+
+func (m SchemaMode) String() string {
+	if name, ok := schemaModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("SchemaMode(%d)", int(m))
+}
+
+// ParseSchemaMode returns the schema mode with the given name: off, reject or
+// coerce.
+func ParseSchemaMode(name string) (SchemaMode, error) {
+	for mode, modeName := range schemaModeNames {
+		if name == modeName {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown schema mode %q, expected off, reject or coerce", name)
+}
+
+// FactIngestStats counts the values of a fact that didn't match the schema.
+type FactIngestStats struct {
+	Rejected int `json:"rejected"`
+	Coerced  int `json:"coerced"`
+}
+
+// Schema returns the fact schema the compiler embedded in the bytecode, if
+// any.
+func (vm *VM) Schema() (bytecode.FactSchema, bool) {
+	return vm.schema, vm.schema != nil
+}
+
+// SetSchemaMode sets how IngestFact treats values that don't match the fact
+// schema. Bytecode compiled without a schema accepts every value.
+func (vm *VM) SetSchemaMode(mode SchemaMode) error {
+	if _, ok := schemaModeNames[mode]; !ok {
+		return fmt.Errorf("unknown schema mode %d", int(mode))
+	}
+	vm.schemaMode = mode
+	return nil
+}
+
+// SchemaMode returns how IngestFact treats values that don't match the fact
+// schema.
+func (vm *VM) SchemaMode() SchemaMode {
+	return vm.schemaMode
+}
+
+// IngestFact sets a fact received from outside the rules, such as an update
+// read from Redis, after checking its value against the fact schema as the
+// schema mode says. A refused value leaves the fact unchanged and returns an
+// error wrapping ErrFactType. Refused and coerced values are counted per
+// fact. It must not be called while a cycle is running.
+func (vm *VM) IngestFact(name string, value interface{}) error {
+	value, err := vm.checkFact(name, value)
+	if err != nil {
+		return err
+	}
+	vm.SetFact(name, value)
+	return nil
+}
+
+// IngestStats returns the counters of the facts that received values not
+// matching the schema.
+func (vm *VM) IngestStats() map[string]FactIngestStats {
+	vm.ingestMu.Lock()
+	defer vm.ingestMu.Unlock()
+	stats := make(map[string]FactIngestStats, len(vm.ingestStats))
+	for name, counters := range vm.ingestStats {
+		stats[name] = counters
+	}
+	return stats
+}
+
+// checkFact returns the value to store for a fact, converted to the fact's
+// type when coercing.
+func (vm *VM) checkFact(name string, value interface{}) (interface{}, error) {
+	if vm.schemaMode == SchemaOff {
+		return value, nil
+	}
+	valueType, ok := schemaType(vm.schema, name)
+	if !ok || valueKind(value) == kindOf(valueType) {
+		return value, nil
+	}
+	if vm.schemaMode == SchemaCoerce {
+		if coerced, ok := coerceValue(value, valueType); ok {
+			vm.countIngest(name, func(stats *FactIngestStats) { stats.Coerced++ })
+			return coerced, nil
+		}
+	}
+	vm.countIngest(name, func(stats *FactIngestStats) { stats.Rejected++ })
+	return nil, fmt.Errorf("%w: %s takes %s values, got %v (%T)", ErrFactType, name, valueType, value, value)
+}
+
+// countIngest updates the counters of a fact.
+func (vm *VM) countIngest(name string, update func(stats *FactIngestStats)) {
+	vm.ingestMu.Lock()
+	defer vm.ingestMu.Unlock()
+	if vm.ingestStats == nil {
+		vm.ingestStats = make(map[string]FactIngestStats)
+	}
+	stats := vm.ingestStats[name]
+	update(&stats)
+	vm.ingestStats[name] = stats
+}
+
+// schemaType returns the type of a fact in the schema, matching it against
+// the fact patterns of the schema if the fact isn't listed itself.
+func schemaType(schema bytecode.FactSchema, name string) (string, bool) {
+	if valueType, ok := schema[name]; ok {
+		return valueType, true
+	}
+	for pattern, valueType := range schema {
+		if rules.IsFactPattern(pattern) && rules.MatchFact(pattern, name) {
+			return valueType, true
+		}
+	}
+	return "", false
+}
+
+// kindOf returns the kind of value a schema type stands for.
+func kindOf(valueType string) string {
+	if valueType == "int" || valueType == "float" {
+		return "number"
+	}
+	return valueType
+}
+
+// valueKind returns the kind of a fact value: number, string or bool.
+func valueKind(value interface{}) string {
+	switch value.(type) {
+	case int, int32, int64, uint64, float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// coerceValue converts a value to a schema type, if its text represents a
+// value of that type.
+func coerceValue(value interface{}, valueType string) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		switch valueType {
+		case "int":
+			if i, err := strconv.ParseInt(v, 10, 0); err == nil {
+				return int(i), true
+			}
+			if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(f) {
+				return f, true
+			}
+		case "float":
+			if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(f) {
+				return f, true
+			}
+		case "bool":
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, true
+			}
+		}
+	case int, int32, int64, uint64:
+		if valueType == "string" {
+			return fmt.Sprint(v), true
+		}
+	case float64:
+		if valueType == "string" {
+			return strconv.FormatFloat(v, 'g', -1, 64), true
+		}
+	case bool:
+		if valueType == "string" {
+			return strconv.FormatBool(v), true
+		}
+	}
+	return nil, false
+}
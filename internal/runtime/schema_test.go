@@ -0,0 +1,109 @@
+package runtime
+
+import (
+	"errors"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func schemaVM(t *testing.T, mode SchemaMode) *VM {
+	t.Helper()
+	section, err := bytecode.NewSchemaSection(bytecode.FactSchema{
+		"temperature":          "int",
+		"humidity":             "float",
+		"mode":                 "string",
+		"occupied":             "bool",
+		"sensor.*.temperature": "float",
+	})
+	require.NoError(t, err)
+	vm := NewVM(bytecode.AppendSections(twoRuleProgram(), section))
+	require.NoError(t, vm.SetSchemaMode(mode))
+	return vm
+}
+
+func TestIngestFact(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fact     string
+		value    interface{}
+		reject   interface{} // Stored value in reject mode, nil if refused
+		coerce   interface{} // Stored value in coerce mode, nil if refused
+		coercion bool
+	}{
+		{"Matching int", "temperature", 30, 30, 30, false},
+		{"Float for an int fact", "temperature", 30.5, 30.5, 30.5, false},
+		{"Int for a float fact", "humidity", 40, 40, 40, false},
+		{"String number for an int fact", "temperature", "30", nil, 30, true},
+		{"String float for an int fact", "temperature", "30.5", nil, 30.5, true},
+		{"String for a float fact", "humidity", "40.5", nil, 40.5, true},
+		{"Text for an int fact", "temperature", "hot", nil, nil, false},
+		{"Bool for an int fact", "temperature", true, nil, nil, false},
+		{"Number for a string fact", "mode", 7, nil, "7", true},
+		{"Float for a string fact", "mode", 7.5, nil, "7.5", true},
+		{"String bool", "occupied", "true", nil, true, true},
+		{"Number for a bool fact", "occupied", 1, nil, nil, false},
+		{"Pattern", "sensor.kitchen.temperature", "21.5", nil, 21.5, true},
+		{"Fact outside the schema", "other", "anything", "anything", "anything", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for mode, expected := range map[SchemaMode]interface{}{SchemaReject: tc.reject, SchemaCoerce: tc.coerce} {
+				vm := schemaVM(t, mode)
+				err := vm.IngestFact(tc.fact, tc.value)
+				stats := vm.IngestStats()[tc.fact]
+				if expected == nil {
+					assert.True(t, errors.Is(err, ErrFactType), "mode %s: %v", mode, err)
+					assert.NotContains(t, vm.Facts(), tc.fact, "mode %s", mode)
+					assert.Equal(t, FactIngestStats{Rejected: 1}, stats, "mode %s", mode)
+					continue
+				}
+				require.NoError(t, err, "mode %s", mode)
+				assert.Equal(t, expected, vm.Facts()[tc.fact], "mode %s", mode)
+				if tc.coercion && mode == SchemaCoerce {
+					assert.Equal(t, FactIngestStats{Coerced: 1}, stats)
+				} else {
+					assert.Equal(t, FactIngestStats{}, stats, "mode %s", mode)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestFact_Off(t *testing.T) {
+	vm := schemaVM(t, SchemaOff)
+	require.NoError(t, vm.IngestFact("temperature", "hot"))
+	assert.Equal(t, "hot", vm.Facts()["temperature"])
+	assert.Empty(t, vm.IngestStats())
+
+	// Without a schema every value is accepted
+	vm = NewVM(twoRuleProgram())
+	_, ok := vm.Schema()
+	assert.False(t, ok)
+	require.NoError(t, vm.SetSchemaMode(SchemaReject))
+	require.NoError(t, vm.IngestFact("temperature", "hot"))
+
+	assert.Error(t, vm.SetSchemaMode(SchemaMode(7)))
+}
+
+func TestIngestFact_KeepsPreviousValue(t *testing.T) {
+	vm := schemaVM(t, SchemaReject)
+	require.NoError(t, vm.IngestFact("temperature", 30))
+	assert.ErrorContains(t, vm.IngestFact("temperature", "hot"), "temperature takes int values, got hot (string)")
+	assert.ErrorContains(t, vm.IngestFact("temperature", nil), "got <nil>")
+	assert.Equal(t, 30, vm.Facts()["temperature"])
+	assert.Equal(t, map[string]FactIngestStats{"temperature": {Rejected: 2}}, vm.IngestStats())
+}
+
+func TestParseSchemaMode(t *testing.T) {
+	for _, mode := range []SchemaMode{SchemaOff, SchemaReject, SchemaCoerce} {
+		parsed, err := ParseSchemaMode(mode.String())
+		require.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+	_, err := ParseSchemaMode("strict")
+	assert.ErrorContains(t, err, "unknown schema mode")
+}
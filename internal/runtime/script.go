@@ -0,0 +1,58 @@
+// runtime/script.go
+
+package runtime
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/script"
+)
+
+// SetScriptLimits sets the time, stack size and call depth available to each
+// run of a script condition or action.
+func (vm *VM) SetScriptLimits(limits script.Limits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+	vm.scriptLimits = limits
+	return nil
+}
+
+// ScriptLimits returns the limits of script runs.
+func (vm *VM) ScriptLimits() script.Limits {
+	return vm.scriptLimits
+}
+
+// callScript runs a script with the facts it reads, including values written
+// earlier in the current cycle, and pushes its result. The result of a
+// condition script must be a boolean, that of a value script a value to write.
+// Scripts are compiled the first time they run.
+func (vm *VM) callScript(source string, factNames []string, condition bool) error {
+	program, ok := vm.scripts[source]
+	if !ok {
+		var err error
+		if program, err = script.Compile(source); err != nil {
+			return err
+		}
+		vm.scripts[source] = program
+	}
+
+	facts := make(map[string]interface{}, len(factNames))
+	for _, name := range factNames {
+		if value, ok := vm.getFact(name); ok {
+			facts[name] = value
+		}
+	}
+	result, err := program.Run(facts, vm.scriptLimits)
+	if err != nil {
+		return fmt.Errorf("script: %w", err)
+	}
+
+	if _, isBool := result.(bool); condition && !isBool {
+		return fmt.Errorf("script condition returned %v, must return a boolean", result)
+	}
+	if !condition && result == nil {
+		return fmt.Errorf("script action returned nil, must return a value to write")
+	}
+	vm.stack = append(vm.stack, result)
+	return nil
+}
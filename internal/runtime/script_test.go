@@ -0,0 +1,91 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"rgehrsitz/rex/internal/script"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scriptRule(condition string, action string) *rules.Rule {
+	return &rules.Rule{
+		Name: "Comfort",
+		Conditions: rules.Conditions{All: []rules.Condition{
+			{Fact: "occupied", Operator: rules.OperatorEqual, Value: true, ValueType: "bool"},
+			{Script: condition, Facts: []string{"temperature", "humidity"}},
+		}},
+		Event: rules.Event{Actions: []rules.Action{
+			{Type: rules.ActionScript, Target: "pressure", Value: action, Facts: []string{"temperature"}},
+		}},
+	}
+}
+
+func TestScripts(t *testing.T) {
+	rule := scriptRule("facts.temperature + facts.humidity / 10 > 30", "facts.temperature * 2")
+
+	for _, mode := range []bytecode.ConditionMode{bytecode.ConditionModeJump, bytecode.ConditionModeBoolean} {
+		vm := NewVM(compileForVM(t, []*rules.Rule{rule}, mode))
+		vm.SetFact("occupied", true)
+		vm.SetFact("temperature", 25)
+		vm.SetFact("humidity", 40.0)
+		require.NoError(t, vm.Run())
+		assert.Nil(t, vm.Facts()["pressure"], "mode %d", mode)
+
+		vm.SetFact("humidity", 60.0)
+		require.NoError(t, vm.Run())
+		assert.Equal(t, 50.0, vm.Facts()["pressure"], "mode %d", mode)
+	}
+}
+
+func TestScripts_Chaining(t *testing.T) {
+	// The facts a script condition reads trigger its rule
+	vm := NewVM(compileForVM(t, []*rules.Rule{scriptRule("(facts.humidity or 0) > 50", "1")}, bytecode.ConditionModeJump))
+	vm.SetFact("occupied", true)
+	require.NoError(t, vm.Run())
+	assert.Nil(t, vm.Facts()["pressure"])
+
+	vm.SetFact("humidity", 55.0)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, 1.0, vm.Facts()["pressure"])
+}
+
+func TestScripts_Errors(t *testing.T) {
+	testCases := []struct {
+		name      string
+		condition string
+		action    string
+		expected  string
+	}{
+		{"Condition not a boolean", "facts.temperature", "1", "script condition returned 25, must return a boolean"},
+		{"Action returning nil", "true", "nil", "script action returned nil"},
+		{"Runtime error", "facts.mode.x", "1", "script:"},
+		{"Timeout", "true", "while true do end", "script timed out after 5ms"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := NewVM(compileForVM(t, []*rules.Rule{scriptRule(tc.condition, tc.action)}, bytecode.ConditionModeJump))
+			require.NoError(t, vm.SetScriptLimits(script.Limits{Timeout: 5 * time.Millisecond, StackSize: 256, CallDepth: 16}))
+			vm.SetFact("occupied", true)
+			vm.SetFact("temperature", 25)
+			assert.ErrorContains(t, vm.Run(), tc.expected)
+		})
+	}
+}
+
+func TestVM_SetScriptLimits(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	assert.Equal(t, script.DefaultLimits, vm.ScriptLimits())
+
+	limits := script.Limits{Timeout: time.Second, StackSize: 64, CallDepth: 8}
+	require.NoError(t, vm.SetScriptLimits(limits))
+	assert.Equal(t, limits, vm.ScriptLimits())
+
+	// Invalid limits leave the current ones in place
+	assert.ErrorContains(t, vm.SetScriptLimits(script.Limits{Timeout: time.Second}), "stack size must be positive")
+	assert.Equal(t, limits, vm.ScriptLimits())
+}
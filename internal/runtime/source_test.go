@@ -0,0 +1,111 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_SourceSection(t *testing.T) {
+	source := []byte(`[{"name": "fan"}]`)
+	section, err := bytecode.NewSourceSection(source, true)
+	require.NoError(t, err)
+	code := newProgram().loadBool(true).updateFact("fan_status").op(bytecode.RULE_END).bytes()
+
+	vm := NewVM(bytecode.AppendSections(code, section))
+	embedded, ok, err := vm.Source()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, source, embedded)
+
+	// The section isn't executed as code
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["fan_status"])
+
+	_, ok, err = NewVM(code).Source()
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestVM_Provenance(t *testing.T) {
+	triggeredActions = nil
+	provenance := bytecode.Provenance{RulesetHash: "4c6f0e3b9a2d7f18", CompilerVersion: "v1.4.0"}
+	section, err := bytecode.NewProvenanceSection(provenance)
+	require.NoError(t, err)
+	code := newProgram().loadString("on").triggerAction("actionsTest", "ops").op(bytecode.RULE_END).bytes()
+
+	vm := NewVM(bytecode.AppendSections(code, section))
+	embedded, ok := vm.Provenance()
+	require.True(t, ok)
+	assert.Equal(t, provenance, embedded)
+
+	// Actions carry the hash of the ruleset revision that triggered them
+	require.NoError(t, vm.Run())
+	require.Len(t, triggeredActions, 1)
+	assert.Equal(t, provenance.RulesetHash, triggeredActions[0].RulesetHash)
+
+	_, ok = NewVM(code).Provenance()
+	assert.False(t, ok)
+}
+
+func TestVM_InitialFacts(t *testing.T) {
+	section, err := bytecode.NewInitialFactsSection(map[string]interface{}{"door.state": "closed"})
+	require.NoError(t, err)
+
+	vm := NewVM(bytecode.AppendSections(twoRuleProgram(), section))
+	assert.Equal(t, map[string]interface{}{"door.state": "closed"}, vm.Facts())
+}
+
+func TestVM_ReadOnlyFacts(t *testing.T) {
+	section, err := bytecode.NewReadOnlyFactsSection([]string{"sensor.*", "fan_status"})
+	require.NoError(t, err)
+
+	vm := NewVM(bytecode.AppendSections(twoRuleProgram(), section))
+	assert.Equal(t, []string{"sensor.*", "fan_status"}, vm.ReadOnlyFacts())
+	vm.SetFact("temperature", 20)
+	err = vm.Run()
+	assert.ErrorIs(t, err, ErrReadOnlyFact)
+	assert.ErrorContains(t, err, "fan_status")
+	assert.NotContains(t, vm.Facts(), "fan_status", "the cycle's writes are rolled back")
+
+	// The host still sets read-only facts
+	vm.SetFact("fan_status", true)
+	assert.Equal(t, true, vm.Facts()["fan_status"])
+}
+
+func TestVM_ErrorMessages(t *testing.T) {
+	code := newProgram().
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		raise(1).
+		label("end").op(bytecode.RULE_END).
+		bytes()
+	section, err := bytecode.NewMessagesSection([]string{"unused", "unsupported comparison operator 'matches' for type 'int'"})
+	require.NoError(t, err)
+
+	vm := NewVM(bytecode.AppendSections(code, section))
+	vm.SetFact("temperature", 20)
+	require.NoError(t, vm.Run(), "the ERROR instruction only fails the rule when it runs")
+	vm.SetFact("temperature", 35)
+	assert.ErrorContains(t, vm.Run(), "unsupported comparison operator 'matches' for type 'int'")
+
+	vm = NewVM(code)
+	vm.SetFact("temperature", 35)
+	assert.ErrorContains(t, vm.Run(), "error #1")
+}
+
+func TestVM_NopAndHalt(t *testing.T) {
+	code := newProgram().
+		op(bytecode.NOP).op(bytecode.NOP).
+		loadBool(true).updateFact("fan_status").
+		op(bytecode.RULE_END).
+		op(bytecode.HALT).
+		raise(0).
+		bytes()
+
+	vm := NewVM(code)
+	require.NoError(t, vm.Run(), "the code after HALT doesn't run")
+	assert.Equal(t, true, vm.Facts()["fan_status"])
+}
@@ -0,0 +1,165 @@
+// runtime/stream.go
+
+package runtime
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FactUpdate is a change to a fact streamed into a VM.
+type FactUpdate struct {
+	Fact          string
+	Value         interface{}
+	Deleted       bool   // The fact was removed; Value is ignored
+	CorrelationID string // Correlation ID of the cycle the update triggers, empty for a random one
+	More          bool   // Updates of the same batch follow, which Stream waits for before evaluating it
+
+	// Evaluated, if not nil, is sent the actions of the cycle evaluating the
+	// update once the cycle has committed its writes, so the sender can wait
+	// for its update to take effect. It must be buffered, as Stream blocks
+	// until the actions are sent.
+	Evaluated chan<- []Action
+}
+
+// Stream keeps the VM's rules resident and evaluates them as fact updates
+// arrive, until ctx is done or updates is closed. It starts with a cycle of
+// every rule against the current facts. Then, each time updates has values,
+// it applies all those waiting as one batch, through IngestFact so the fact
+// schema applies, and runs a cycle of the rules reading the facts updated,
+// as RunAffected does. A batch also waits for the update following one
+// marked More, and its cycle takes the first correlation ID among its
+// updates. When the conditions of a rule with a duration have held long
+// enough by the VM's clock, or a delayed action is due, Stream also runs a
+// cycle of the rules with a duration, which performs the delayed actions due,
+// so these actions don't wait for the next update.
+//
+// The actions each cycle triggers are performed by their handlers as in Run
+// and, if actions isn't nil, sent to it once the cycle has committed its
+// writes, so a host can consume them as a stream. Stream waits for the host
+// to receive them. Cycle errors are logged and passed to the AfterCycle hooks,
+// and the VM goes on with the next batch. Stream returns ctx's error if ctx
+// ends it and nil if updates is closed. No other method running a cycle or
+// changing facts may be called while the VM streams.
+func (vm *VM) Stream(ctx context.Context, updates <-chan FactUpdate, actions chan<- Action) error {
+	if err := vm.streamCycle(ctx, nil, nil, actions); err != nil {
+		return err
+	}
+	for {
+		// Wake up when the conditions of a rule with a duration have held
+		// long enough, or a delayed action is due, even if no update comes
+		var due <-chan time.Time
+		if next, ok := vm.nextWakeUp(); ok {
+			due = vm.clock.After(next.Sub(vm.clock.Now()))
+		}
+
+		var batch []FactUpdate
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-due:
+			if err := vm.streamCycle(ctx, heldRules, nil, actions); err != nil {
+				return err
+			}
+			continue
+		case update, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			batch = append(batch, update)
+		}
+		batch, open := drainUpdates(updates, batch)
+
+		if err := vm.streamCycle(ctx, vm.affectedBy(vm.applyUpdates(batch)), batch, actions); err != nil {
+			return err
+		}
+		if !open {
+			return nil
+		}
+	}
+}
+
+// nextWakeUp returns the earliest time a rule with a duration may run its
+// actions or a delayed action is due, and false if nothing is waiting.
+func (vm *VM) nextWakeUp() (time.Time, bool) {
+	next, waiting := vm.nextHold()
+	if delayed, ok := vm.nextDelayedAction(); ok && (!waiting || delayed.Before(next)) {
+		next, waiting = delayed, true
+	}
+	return next, waiting
+}
+
+// drainUpdates appends the updates waiting in the channel to batch, and
+// those the last update marked More says follow, and reports whether the
+// channel is still open. It only blocks for updates marked to follow.
+func drainUpdates(updates <-chan FactUpdate, batch []FactUpdate) ([]FactUpdate, bool) {
+	for {
+		if batch[len(batch)-1].More {
+			update, ok := <-updates
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, update)
+			continue
+		}
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, update)
+		default:
+			return batch, true
+		}
+	}
+}
+
+// applyUpdates applies a batch of fact updates and returns the facts updated.
+// Values refused by the fact schema are logged and leave the fact unchanged.
+func (vm *VM) applyUpdates(batch []FactUpdate) []string {
+	changed := make([]string, 0, len(batch))
+	correlated := false
+	for _, update := range batch {
+		if update.CorrelationID != "" && !correlated {
+			correlated = true
+			vm.SetCorrelationID(update.CorrelationID)
+		}
+		if update.Deleted {
+			vm.DeleteFact(update.Fact)
+		} else if err := vm.IngestFact(update.Fact, update.Value); err != nil {
+			log.Warn().Err(err).Str("Fact", update.Fact).Msg("Ignoring fact update")
+			continue
+		}
+		changed = append(changed, update.Fact)
+	}
+	return changed
+}
+
+// streamCycle runs a cycle of the selected rules, or of every rule if selected
+// is nil, tells the updates of the batch it evaluates that they were, and
+// sends the actions it triggered. It only fails if ctx ends while the actions
+// are being sent.
+func (vm *VM) streamCycle(ctx context.Context, selected func(ruleEntry) bool, batch []FactUpdate, actions chan<- Action) error {
+	triggered, err := vm.cycle(selected)
+	if err != nil {
+		vm.logger.Error().Err(err).Msg("Error running bytecode")
+	}
+	for _, update := range batch {
+		if update.Evaluated != nil {
+			update.Evaluated <- triggered
+		}
+	}
+	if actions == nil {
+		return nil
+	}
+	for _, action := range triggered {
+		select {
+		case actions <- action:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package runtime
+
+import (
+	"context"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// climateProgram builds a program with one rule on temperature and one on
+// humidity, each triggering an action.
+func climateProgram() []byte {
+	return newProgram().
+		ruleStart(0).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadString("too hot").triggerAction("actionsTest", "cooling").
+		label("rule0_end").op(bytecode.RULE_END).
+		ruleStart(0).
+		loadFact("humidity").loadInt(60).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule1_end").
+		loadString("too humid").triggerAction("actionsTest", "dehumidifier").
+		label("rule1_end").op(bytecode.RULE_END).
+		bytes()
+}
+
+func TestVM_RunAffected(t *testing.T) {
+	vm := NewVM(climateProgram())
+	vm.SetFacts(map[string]interface{}{"temperature": 35, "humidity": 70})
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) { evaluated = append(evaluated, rule) })
+
+	require.NoError(t, vm.RunAffected([]string{"humidity"}))
+	assert.Equal(t, []int{1}, evaluated)
+
+	evaluated = nil
+	require.NoError(t, vm.RunAffected([]string{"pressure"}))
+	assert.Empty(t, evaluated)
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []int{0, 1}, evaluated)
+}
+
+func TestVM_RunAffected_FactReaders(t *testing.T) {
+	// The embedded index is trusted over the rules' instructions
+	section, err := bytecode.NewFactReadersSection(bytecode.FactReaders{"humidity": {0}, "zone.*.humidity": {1}})
+	require.NoError(t, err)
+	vm := NewVM(bytecode.AppendSections(climateProgram(), section))
+	vm.SetFacts(map[string]interface{}{"temperature": 35, "humidity": 70})
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) { evaluated = append(evaluated, rule) })
+
+	require.NoError(t, vm.RunAffected([]string{"humidity"}))
+	assert.Equal(t, []int{0}, evaluated)
+
+	evaluated = nil
+	require.NoError(t, vm.RunAffected([]string{"zone.north.humidity"}))
+	assert.Equal(t, []int{1}, evaluated)
+}
+
+func TestVM_RunRules(t *testing.T) {
+	vm := NewVM(climateProgram())
+	vm.SetFacts(map[string]interface{}{"temperature": 35, "humidity": 70})
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) { evaluated = append(evaluated, rule) })
+
+	require.NoError(t, vm.RunRules([]int{1}))
+	assert.Equal(t, []int{1}, evaluated)
+	assert.EqualError(t, vm.RunRules([]int{2}), "no rule 2 in the bytecode")
+}
+
+func TestVM_Stream(t *testing.T) {
+	triggeredActions = nil
+	vm := NewVM(climateProgram())
+	vm.SetFacts(map[string]interface{}{"temperature": 20, "humidity": 70})
+	var evaluated []int
+	vm.OnAfterRule(func(rule int, fired bool) { evaluated = append(evaluated, rule) })
+
+	updates := make(chan FactUpdate)
+	actions := make(chan Action)
+	done := make(chan error)
+	go func() { done <- vm.Stream(context.Background(), updates, actions) }()
+
+	// The first cycle evaluates every rule against the current facts
+	action := <-actions
+	assert.Equal(t, "dehumidifier", action.Target)
+
+	// Later cycles only evaluate the rules reading the facts updated
+	updates <- FactUpdate{Fact: "temperature", Value: 35, CorrelationID: "reading-9"}
+	action = <-actions
+	assert.Equal(t, Action{Rule: 0, Type: "actionsTest", Target: "cooling", Value: "too hot", CorrelationID: "reading-9"}, action)
+	assert.Equal(t, []int{0, 1, 0}, evaluated)
+
+	close(updates)
+	require.NoError(t, <-done)
+	assert.Len(t, triggeredActions, 2, "actions are still performed by their handlers")
+	assert.Equal(t, 35, vm.Facts()["temperature"])
+}
+
+func TestVM_StreamEvaluated(t *testing.T) {
+	vm := NewVM(climateProgram())
+	vm.SetFacts(map[string]interface{}{"temperature": 20, "humidity": 40})
+	var cycles int
+	vm.OnAfterCycle(func(err error) { cycles++ })
+
+	updates := make(chan FactUpdate, 2)
+	done := make(chan error)
+	go func() { done <- vm.Stream(context.Background(), updates, nil) }()
+
+	// Updates marked More are evaluated with the one following them, even
+	// if it is sent later
+	evaluated := make(chan []Action, 1)
+	updates <- FactUpdate{Fact: "temperature", Value: 35, More: true}
+	time.Sleep(10 * time.Millisecond)
+	updates <- FactUpdate{Fact: "humidity", Value: 70, Evaluated: evaluated}
+	var targets []string
+	for _, action := range <-evaluated {
+		targets = append(targets, action.Target)
+	}
+	assert.Equal(t, []string{"cooling", "dehumidifier"}, targets)
+
+	close(updates)
+	require.NoError(t, <-done)
+	assert.Equal(t, 2, cycles, "the first cycle and one for both updates")
+}
+
+func TestVM_StreamStops(t *testing.T) {
+	vm := NewVM(climateProgram())
+	vm.SetFacts(map[string]interface{}{"temperature": 20, "humidity": 40})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, vm.Stream(ctx, make(chan FactUpdate), nil), context.Canceled)
+}
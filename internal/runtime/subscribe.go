@@ -0,0 +1,78 @@
+// runtime/subscribe.go
+
+package runtime
+
+import (
+	"slices"
+	"sync"
+)
+
+// FactSubscriber is called when an evaluation cycle changes the value of a
+// subscribed fact. old is nil if the fact didn't exist before the cycle.
+type FactSubscriber func(old, new interface{})
+
+// subscriptions holds the fact subscribers registered on a VM. Unlike hooks,
+// subscriptions may be added and removed from any goroutine, including from
+// a subscriber.
+type subscriptions struct {
+	mu     sync.Mutex
+	nextID int
+	byFact map[string]map[int]FactSubscriber
+}
+
+// Subscribe registers fn to be called whenever a cycle changes the value of
+// the named fact, so hosts can react to rule-produced changes without polling
+// the fact store. Subscribers run after the cycle's writes are committed and
+// before the AfterCycle hooks, in the order the facts were written; writes
+// that leave a value unchanged, and facts set by the host with SetFact, are
+// not reported. Subscribe returns a function that cancels the subscription.
+func (vm *VM) Subscribe(fact string, fn FactSubscriber) (unsubscribe func()) {
+	s := &vm.subscriptions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byFact == nil {
+		s.byFact = make(map[string]map[int]FactSubscriber)
+	}
+	if s.byFact[fact] == nil {
+		s.byFact[fact] = make(map[int]FactSubscriber)
+	}
+	id := s.nextID
+	s.nextID++
+	s.byFact[fact][id] = fn
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.byFact[fact], id)
+		if len(s.byFact[fact]) == 0 {
+			delete(s.byFact, fact)
+		}
+	}
+}
+
+// notify calls the subscribers of the changed facts. Subscribers of a fact
+// are called in subscription order, outside the lock so they can subscribe
+// and unsubscribe.
+func (s *subscriptions) notify(changes []factChange) {
+	for _, change := range changes {
+		for _, fn := range s.subscribers(change.fact) {
+			fn(change.old, change.new)
+		}
+	}
+}
+
+// subscribers returns the current subscribers of a fact in subscription order.
+func (s *subscriptions) subscribers(fact string) []FactSubscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int, 0, len(s.byFact[fact]))
+	for id := range s.byFact[fact] {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	fns := make([]FactSubscriber, len(ids))
+	for i, id := range ids {
+		fns[i] = s.byFact[fact][id]
+	}
+	return fns
+}
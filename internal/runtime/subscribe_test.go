@@ -0,0 +1,74 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe_NotifiedOfChanges(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	vm.facts["temperature"] = 35
+
+	type change struct{ old, new interface{} }
+	var fan, ac []change
+	var calls []string
+	vm.Subscribe("fan_status", func(old, new interface{}) {
+		fan = append(fan, change{old, new})
+		calls = append(calls, "fan")
+	})
+	vm.Subscribe("ac_status", func(old, new interface{}) {
+		ac = append(ac, change{old, new})
+		calls = append(calls, "ac")
+	})
+	vm.OnAfterCycle(func(err error) { calls = append(calls, "after") })
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []change{{nil, true}}, fan)
+	assert.Equal(t, []change{{nil, true}}, ac)
+	assert.Equal(t, []string{"ac", "fan", "after"}, calls, "subscribers run in write order, before AfterCycle hooks")
+
+	// Writing the same values again changes nothing
+	require.NoError(t, vm.Run())
+	assert.Len(t, fan, 1)
+	assert.Len(t, ac, 1)
+
+	// Neither do facts set by the host
+	vm.SetFact("fan_status", false)
+	assert.Len(t, fan, 1)
+	require.NoError(t, vm.Run())
+	assert.Equal(t, []change{{nil, true}, {false, true}}, fan)
+}
+
+func TestSubscribe_Unsubscribe(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	vm.facts["temperature"] = 25
+
+	var first, second int
+	unsubscribe := vm.Subscribe("fan_status", func(old, new interface{}) { first++ })
+	vm.Subscribe("fan_status", func(old, new interface{}) { second++ })
+	unsubscribe()
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, 0, first)
+	assert.Equal(t, 1, second)
+}
+
+func TestSubscribe_NotNotifiedOnFailedCycle(t *testing.T) {
+	// The second rule fails after the first has written fan_status
+	code := newProgram().
+		loadBool(true).updateFact("fan_status").
+		op(bytecode.RULE_END).
+		updateFact("ac_status").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+
+	notified := false
+	vm.Subscribe("fan_status", func(old, new interface{}) { notified = true })
+
+	assert.Error(t, vm.Run())
+	assert.False(t, notified)
+}
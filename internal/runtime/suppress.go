@@ -0,0 +1,277 @@
+// runtime/suppress.go
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"rgehrsitz/rex/internal/rules"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SuppressionWindow is a period of planned maintenance on monitored equipment,
+// during which rules are still evaluated, and their firings audited, but the
+// actions they trigger are withheld instead of performed. A window covers
+// every action, the actions on the targets of a group, or those on a target.
+type SuppressionWindow struct {
+	Name   string    `json:"name"`
+	Start  time.Time `json:"start,omitempty"` // Zero to start right away
+	End    time.Time `json:"end"`
+	Group  string    `json:"group,omitempty"`  // Group of the targets whose actions are withheld
+	Target string    `json:"target,omitempty"` // Target, or target pattern, whose actions are withheld
+
+	// Summary is the action type, e.g. notify, of the action summarizing the
+	// actions withheld, performed once the window has ended. The action's
+	// target is the window's name and its rule is -1. Empty doesn't
+	// summarize the window.
+	Summary string `json:"summary,omitempty"`
+}
+
+// SuppressionConfig lists the suppression windows of a VM, and the groups of
+// targets they may suppress.
+type SuppressionConfig struct {
+	// Groups lists the targets of each group, by group name. Target patterns
+	// such as hvac.* are allowed.
+	Groups  map[string][]string `json:"groups,omitempty"`
+	Windows []SuppressionWindow `json:"windows"`
+}
+
+// Validate checks that every window is named once, ends after it starts and
+// suppresses a group of the configuration, a target or everything.
+func (c SuppressionConfig) Validate() error {
+	for name := range c.Groups {
+		if name == "" {
+			return errors.New("suppression group name must not be empty")
+		}
+	}
+	names := make(map[string]bool, len(c.Windows))
+	for _, window := range c.Windows {
+		if err := window.validate(c.Groups); err != nil {
+			return err
+		}
+		if names[window.Name] {
+			return fmt.Errorf("duplicate suppression window %s", window.Name)
+		}
+		names[window.Name] = true
+	}
+	return nil
+}
+
+func (w SuppressionWindow) validate(groups map[string][]string) error {
+	if w.Name == "" {
+		return errors.New("suppression window name must not be empty")
+	}
+	if w.End.IsZero() {
+		return fmt.Errorf("suppression window %s has no end", w.Name)
+	}
+	if !w.Start.IsZero() && !w.End.After(w.Start) {
+		return fmt.Errorf("suppression window %s ends before it starts", w.Name)
+	}
+	if w.Group != "" && w.Target != "" {
+		return fmt.Errorf("suppression window %s has both a group and a target", w.Name)
+	}
+	if _, ok := groups[w.Group]; w.Group != "" && !ok {
+		return fmt.Errorf("suppression window %s has unknown group %s", w.Name, w.Group)
+	}
+	return nil
+}
+
+// SuppressionStatus describes a suppression window that hasn't been summarized
+// yet.
+type SuppressionStatus struct {
+	SuppressionWindow
+	Active   bool `json:"active"`   // Whether actions are being withheld
+	Withheld int  `json:"withheld"` // Actions withheld so far
+}
+
+// suppressedWindow is a window with the actions it has withheld, counted by
+// target.
+type suppressedWindow struct {
+	SuppressionWindow
+	withheld int
+	targets  map[string]int
+}
+
+// active reports whether the window withholds actions at a time.
+func (w *suppressedWindow) active(now time.Time) bool {
+	return !now.Before(w.Start) && now.Before(w.End)
+}
+
+// suppression is the state kept by a VM for its suppression windows. Windows
+// are added and ended by the host while the VM runs, hence the mutex.
+type suppression struct {
+	mu      sync.Mutex
+	groups  map[string][]string
+	windows []*suppressedWindow
+}
+
+// SetSuppressions replaces the VM's suppression windows and groups. The
+// actions withheld by the previous windows are forgotten without being
+// summarized.
+func (vm *VM) SetSuppressions(config SuppressionConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	windows := make([]*suppressedWindow, len(config.Windows))
+	for i, window := range config.Windows {
+		windows[i] = &suppressedWindow{SuppressionWindow: window}
+	}
+
+	vm.suppress.mu.Lock()
+	defer vm.suppress.mu.Unlock()
+	vm.suppress.groups = config.Groups
+	vm.suppress.windows = windows
+	return nil
+}
+
+// Suppress adds a suppression window, e.g. when maintenance starts
+// unplanned. Its group must be one of those given to SetSuppressions. It can
+// be called concurrently with Run.
+func (vm *VM) Suppress(window SuppressionWindow) error {
+	vm.suppress.mu.Lock()
+	defer vm.suppress.mu.Unlock()
+	if err := window.validate(vm.suppress.groups); err != nil {
+		return err
+	}
+	for _, existing := range vm.suppress.windows {
+		if existing.Name == window.Name {
+			return fmt.Errorf("duplicate suppression window %s", window.Name)
+		}
+	}
+	vm.suppress.windows = append(vm.suppress.windows, &suppressedWindow{SuppressionWindow: window})
+	return nil
+}
+
+// EndSuppression ends a suppression window now, e.g. when maintenance
+// finishes early. The window is summarized by the next cycle. It can be
+// called concurrently with Run.
+func (vm *VM) EndSuppression(name string) error {
+	now := vm.clock.Now()
+	vm.suppress.mu.Lock()
+	defer vm.suppress.mu.Unlock()
+	for _, window := range vm.suppress.windows {
+		if window.Name == name {
+			if window.End.After(now) {
+				window.End = now
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown suppression window %s", name)
+}
+
+// Suppressions returns the suppression windows that haven't ended, or whose
+// actions haven't been summarized yet, in start order. It can be called
+// concurrently with Run.
+func (vm *VM) Suppressions() []SuppressionStatus {
+	now := vm.clock.Now()
+	vm.suppress.mu.Lock()
+	defer vm.suppress.mu.Unlock()
+	statuses := make([]SuppressionStatus, len(vm.suppress.windows))
+	for i, window := range vm.suppress.windows {
+		statuses[i] = SuppressionStatus{SuppressionWindow: window.SuppressionWindow, Active: window.active(now), Withheld: window.withheld}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Start.Before(statuses[j].Start) })
+	return statuses
+}
+
+// withholdActions removes from the actions of a cycle those an active window
+// suppresses, passing each to the ActionSuppressed hooks, and returns the
+// others, followed by the summaries of the windows that have ended.
+func (vm *VM) withholdActions(actions []Action) []Action {
+	now := vm.clock.Now()
+	vm.suppress.mu.Lock()
+	if len(vm.suppress.windows) == 0 {
+		vm.suppress.mu.Unlock()
+		return actions
+	}
+
+	performed := make([]Action, 0, len(actions))
+	type withheld struct {
+		action Action
+		window string
+	}
+	var suppressed []withheld
+	for _, action := range actions {
+		if window := vm.suppress.window(action.Target, now); window != nil {
+			window.withheld++
+			if window.targets == nil {
+				window.targets = make(map[string]int)
+			}
+			window.targets[action.Target]++
+			suppressed = append(suppressed, withheld{action, window.Name})
+			continue
+		}
+		performed = append(performed, action)
+	}
+
+	remaining := vm.suppress.windows[:0]
+	for _, window := range vm.suppress.windows {
+		if now.Before(window.End) {
+			remaining = append(remaining, window)
+			continue
+		}
+		vm.logger.Info().Str("Window", window.Name).Int("Withheld", window.withheld).Msg("Suppression window ended")
+		if window.Summary != "" {
+			performed = append(performed, vm.suppressionSummary(window))
+		}
+	}
+	vm.suppress.windows = remaining
+	vm.suppress.mu.Unlock()
+
+	for _, s := range suppressed {
+		vm.logger.Debug().Str("Window", s.window).Str("Type", s.action.Type).Str("Target", s.action.Target).Msg("Action withheld")
+		vm.hooks.runActionSuppressed(s.action, s.window)
+	}
+	return performed
+}
+
+// window returns the first active window suppressing the actions on a
+// target, nil if there is none. The caller must hold s.mu.
+func (s *suppression) window(target string, now time.Time) *suppressedWindow {
+	for _, window := range s.windows {
+		if !window.active(now) {
+			continue
+		}
+		switch {
+		case window.Target != "":
+			if rules.MatchFact(window.Target, target) {
+				return window
+			}
+		case window.Group != "":
+			if rules.MatchAnyFact(s.groups[window.Group], target) {
+				return window
+			}
+		default:
+			return window
+		}
+	}
+	return nil
+}
+
+// suppressionSummary returns the action summarizing the actions a window has
+// withheld.
+func (vm *VM) suppressionSummary(window *suppressedWindow) Action {
+	targets := window.targets
+	if targets == nil {
+		targets = map[string]int{}
+	}
+	action := Action{
+		Rule:   -1,
+		Type:   window.Summary,
+		Target: window.Name,
+		Value: map[string]interface{}{
+			"start":    window.Start,
+			"end":      window.End,
+			"withheld": window.withheld,
+			"targets":  targets,
+		},
+		CorrelationID: vm.correlationID,
+	}
+	if vm.provenance != nil {
+		action.RulesetHash = vm.provenance.RulesetHash
+	}
+	return action
+}
@@ -0,0 +1,123 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// suppressProgram builds a program alerting ops and starting the fan of
+// hvac.unit3 when the temperature is above 30.
+func suppressProgram() []byte {
+	return newProgram().
+		ruleStart(0).
+		loadFact("temperature").loadInt(30).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "rule0_end").
+		loadString("too hot").triggerAction("actionsTest", "ops").
+		loadString("on").triggerAction("actionsTest", "hvac.unit3").
+		loadBool(true).updateFact("alarm").
+		label("rule0_end").op(bytecode.RULE_END).
+		bytes()
+}
+
+func TestSuppressions(t *testing.T) {
+	triggeredActions = nil
+	start := time.Unix(1000, 0)
+	clock := NewTestClock(start)
+	vm := NewVM(suppressProgram())
+	vm.SetClock(clock)
+	require.NoError(t, vm.SetSuppressions(SuppressionConfig{
+		Groups: map[string][]string{"hvac": {"hvac.*"}},
+		Windows: []SuppressionWindow{
+			{Name: "hvac service", Start: start.Add(time.Hour), End: start.Add(2 * time.Hour), Group: "hvac", Summary: "actionsTest"},
+		},
+	}))
+	var withheld []string
+	vm.OnActionSuppressed(func(action Action, window string) {
+		withheld = append(withheld, window+": "+action.Target)
+	})
+	vm.SetFact("temperature", 35)
+
+	// Before the window starts every action is performed
+	require.NoError(t, vm.Run())
+	assert.Len(t, triggeredActions, 2)
+
+	// During the window the rule is still evaluated, but the actions on the
+	// group's targets are withheld
+	triggeredActions = nil
+	clock.Advance(time.Hour)
+	vm.SetFact("alarm", false)
+	require.NoError(t, vm.Run())
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.Facts()["alarm"])
+	require.Len(t, triggeredActions, 2)
+	assert.Equal(t, "ops", triggeredActions[0].Target)
+	assert.Equal(t, []string{"hvac service: hvac.unit3", "hvac service: hvac.unit3"}, withheld)
+	statuses := vm.Suppressions()
+	require.Len(t, statuses, 1)
+	assert.True(t, statuses[0].Active)
+	assert.Equal(t, 2, statuses[0].Withheld)
+
+	// The first cycle after the window summarizes it
+	triggeredActions = nil
+	clock.Advance(time.Hour)
+	require.NoError(t, vm.Run())
+	require.Len(t, triggeredActions, 3)
+	summary := triggeredActions[2]
+	assert.Equal(t, -1, summary.Rule)
+	assert.Equal(t, "hvac service", summary.Target)
+	assert.Equal(t, 2, summary.Value.(map[string]interface{})["withheld"])
+	assert.Equal(t, map[string]int{"hvac.unit3": 2}, summary.Value.(map[string]interface{})["targets"])
+	assert.Empty(t, vm.Suppressions())
+}
+
+func TestSuppress(t *testing.T) {
+	triggeredActions = nil
+	clock := NewTestClock(time.Unix(1000, 0))
+	vm := NewVM(suppressProgram())
+	vm.SetClock(clock)
+	vm.SetFact("temperature", 35)
+
+	// A window without a group or target withholds every action
+	require.NoError(t, vm.Suppress(SuppressionWindow{Name: "outage", End: clock.Now().Add(time.Hour)}))
+	assert.ErrorContains(t, vm.Suppress(SuppressionWindow{Name: "outage", End: clock.Now().Add(time.Hour)}), "duplicate")
+	require.NoError(t, vm.Run())
+	assert.Empty(t, triggeredActions)
+
+	// Ending it early lets the actions through from the next cycle, without
+	// a summary
+	require.NoError(t, vm.EndSuppression("outage"))
+	require.NoError(t, vm.Run())
+	assert.Len(t, triggeredActions, 2)
+	assert.Error(t, vm.EndSuppression("outage"))
+
+	// A window on a target only withholds its actions
+	triggeredActions = nil
+	require.NoError(t, vm.Suppress(SuppressionWindow{Name: "paging", End: clock.Now().Add(time.Hour), Target: "ops"}))
+	require.NoError(t, vm.Run())
+	require.Len(t, triggeredActions, 1)
+	assert.Equal(t, "hvac.unit3", triggeredActions[0].Target)
+}
+
+func TestSuppressionConfig_Validate(t *testing.T) {
+	end := time.Unix(1000, 0)
+	for _, tc := range []struct {
+		name   string
+		window SuppressionWindow
+		err    string
+	}{
+		{"Unnamed", SuppressionWindow{End: end}, "name must not be empty"},
+		{"No end", SuppressionWindow{Name: "w"}, "has no end"},
+		{"Ends before it starts", SuppressionWindow{Name: "w", Start: end, End: end.Add(-time.Hour)}, "ends before it starts"},
+		{"Group and target", SuppressionWindow{Name: "w", End: end, Group: "hvac", Target: "ops"}, "both a group and a target"},
+		{"Unknown group", SuppressionWindow{Name: "w", End: end, Group: "pumps"}, "unknown group pumps"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := SuppressionConfig{Groups: map[string][]string{"hvac": {"hvac.*"}}, Windows: []SuppressionWindow{tc.window}}
+			assert.ErrorContains(t, config.Validate(), tc.err)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// runtime/transaction.go
+
+package runtime
+
+import (
+	"reflect"
+
+	"github.com/rs/zerolog"
+)
+
+// transaction buffers the fact writes produced during an evaluation cycle so
+// they can be applied to the fact store all at once, or discarded if the cycle
+// fails part way through.
+type transaction struct {
+	writes    map[string]pendingWrite
+	order     []string       // Fact names in the order they were first written
+	actions   []Action       // Actions triggered, performed once the writes are committed
+	delayed   map[int]Action // Delayed actions triggered, by TRIGGER_ACTION offset, scheduled once the writes are committed
+	evaluated map[int]bool   // Rules evaluated, by index
+	logger    zerolog.Logger
+}
+
+// pendingWrite is a buffered fact value along with the priority of the rule
+// that produced it.
+type pendingWrite struct {
+	value    interface{}
+	priority int
+}
+
+func newTransaction(logger zerolog.Logger) *transaction {
+	return &transaction{writes: make(map[string]pendingWrite), delayed: make(map[int]Action), evaluated: make(map[int]bool), logger: logger}
+}
+
+// set records a pending write to a fact and reports whether it was accepted.
+// When several rules write the same fact in one cycle, the write from the
+// highest priority rule wins; among rules of equal priority the last write wins.
+func (tx *transaction) set(factName string, value interface{}, priority int) bool {
+	existing, exists := tx.writes[factName]
+	if !exists {
+		tx.order = append(tx.order, factName)
+	} else if existing.priority > priority {
+		tx.logger.Debug().
+			Str("Fact", factName).
+			Int("WinningPriority", existing.priority).
+			Int("DiscardedPriority", priority).
+			Msg("Discarded write from lower priority rule")
+		return false
+	}
+	tx.writes[factName] = pendingWrite{value: value, priority: priority}
+	return true
+}
+
+// get returns the pending value of a fact, if it has been written in this cycle.
+func (tx *transaction) get(factName string) (interface{}, bool) {
+	write, ok := tx.writes[factName]
+	return write.value, ok
+}
+
+// factChange is a committed write that changed the value of a fact.
+type factChange struct {
+	fact     string
+	old, new interface{}
+}
+
+// commit applies the pending writes to the given fact store and returns the
+// writes that changed a value, in write order.
+func (tx *transaction) commit(facts map[string]interface{}) []factChange {
+	var changes []factChange
+	for _, factName := range tx.order {
+		value := tx.writes[factName].value
+		old, existed := facts[factName]
+		if !existed || !reflect.DeepEqual(old, value) {
+			changes = append(changes, factChange{fact: factName, old: old, new: value})
+		}
+		facts[factName] = value
+	}
+	tx.logger.Debug().Int("Writes", len(tx.order)).Int("Changes", len(changes)).Msg("Committed cycle transaction")
+	return changes
+}
+
+// rollback discards the pending writes and actions.
+func (tx *transaction) rollback() {
+	tx.logger.Debug().Int("Writes", len(tx.order)).Msg("Rolled back cycle transaction")
+	tx.writes = make(map[string]pendingWrite)
+	tx.order = nil
+	tx.actions = nil
+	tx.delayed = make(map[int]Action)
+}
@@ -0,0 +1,92 @@
+package runtime
+
+import (
+	"errors"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction_CommitsOnSuccess(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	vm.facts["temperature"] = 35
+
+	// Writes stay pending until the cycle completes
+	vm.OnAfterRule(func(rule int, fired bool) {
+		assert.NotContains(t, vm.facts, "ac_status")
+	})
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["ac_status"])
+	assert.Equal(t, true, vm.facts["fan_status"])
+}
+
+func TestTransaction_RollsBackOnError(t *testing.T) {
+	// The first rule succeeds, the second rule's action fails
+	code := newProgram().
+		loadBool(true).updateFact("ac_status").
+		op(bytecode.RULE_END).
+		updateFact("fan_status").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+	vm.facts["ac_status"] = false
+
+	require.Error(t, vm.Run())
+	assert.Equal(t, false, vm.facts["ac_status"], "Earlier writes should be rolled back")
+	assert.NotContains(t, vm.facts, "fan_status")
+}
+
+func TestTransaction_RollsBackWhenHookAborts(t *testing.T) {
+	code := newProgram().
+		loadBool(true).updateFact("ac_status").
+		op(bytecode.RULE_END).
+		updateFact("fan_status").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+
+	aborted := errors.New("aborted")
+	vm.OnActionError(func(rule int, err error) error { return aborted })
+
+	assert.ErrorIs(t, vm.Run(), aborted)
+	assert.NotContains(t, vm.facts, "ac_status")
+}
+
+func TestTransaction_ReadsOwnWrites(t *testing.T) {
+	// The second rule fires only if it sees the first rule's pending write
+	code := newProgram().
+		loadBool(true).updateFact("ac_status").
+		op(bytecode.RULE_END).
+		loadFact("ac_status").loadBool(true).op(bytecode.AND).
+		jump(bytecode.JUMP_IF_FALSE, "rule1_end").
+		loadBool(true).updateFact("fan_status").
+		label("rule1_end").op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(code)
+
+	require.NoError(t, vm.Run())
+	assert.Equal(t, true, vm.facts["fan_status"])
+}
+
+func TestVM_FactStore(t *testing.T) {
+	vm := NewVM(twoRuleProgram())
+	_, ok := vm.GetFact("temperature")
+	assert.False(t, ok)
+	assert.ErrorContains(t, vm.Run(), "undefined fact: temperature")
+
+	vm.SetFacts(map[string]interface{}{"temperature": 35, "mode": "eco"})
+	value, ok := vm.GetFact("temperature")
+	require.True(t, ok)
+	assert.Equal(t, 35, value)
+
+	require.NoError(t, vm.Run())
+	value, _ = vm.GetFact("ac_status")
+	assert.Equal(t, true, value)
+
+	// Setting facts leaves the others in place
+	vm.SetFacts(map[string]interface{}{"temperature": 20})
+	assert.Equal(t, map[string]interface{}{"temperature": 20, "mode": "eco", "ac_status": true, "fan_status": true}, vm.Facts())
+}
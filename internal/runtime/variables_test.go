@@ -0,0 +1,44 @@
+package runtime
+
+import (
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_LocalVariables(t *testing.T) {
+	// 10 < temperature < 30, loading the fact once
+	code := newProgram().
+		ruleStart(0).
+		loadFact("temperature").storeVar(0).loadInt(10).op(bytecode.GT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		loadVar(0).loadInt(30).op(bytecode.LT_INT).
+		jump(bytecode.JUMP_IF_FALSE, "end").
+		loadBool(true).updateFact("comfortable").
+		label("end").op(bytecode.RULE_END).
+		bytes()
+
+	for temperature, want := range map[int]bool{5: false, 20: true, 35: false} {
+		vm := NewVM(code)
+		vm.SetFact("temperature", temperature)
+		require.NoError(t, vm.Run())
+		_, fired := vm.Facts()["comfortable"]
+		assert.Equal(t, want, fired, "temperature %d", temperature)
+	}
+}
+
+func TestVM_LocalVariablesAreRuleScoped(t *testing.T) {
+	// The second rule loads a variable only the first rule stored
+	code := newProgram().
+		ruleStart(0).
+		loadFact("temperature").storeVar(0).op(bytecode.RULE_END).
+		ruleStart(0).
+		loadVar(0).op(bytecode.RULE_END).
+		bytes()
+
+	vm := NewVM(code)
+	vm.SetFact("temperature", 20)
+	assert.ErrorContains(t, vm.Run(), "load of unset variable 0")
+}
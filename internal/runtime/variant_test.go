@@ -0,0 +1,75 @@
+package runtime
+
+import (
+	"fmt"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// variantProgram builds a rule that always fires, splitting entities evenly
+// between variants A and B.
+func variantProgram() []byte {
+	return newProgram().
+		ruleStart(0).
+		variant(0, 50, 7, "deviceId", "A").
+		loadInt(20).updateFact("setpoint").
+		variant(50, 100, 7, "deviceId", "B").
+		loadInt(22).updateFact("setpoint").
+		op(bytecode.VARIANT_END).
+		loadBool(true).updateFact("after_variants").
+		op(bytecode.RULE_END).
+		bytes()
+}
+
+func TestVariants_OnlyAssignedVariantFires(t *testing.T) {
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		vm := NewVM(variantProgram())
+		vm.facts["deviceId"] = fmt.Sprintf("device-%d", i)
+
+		var tagged string
+		vm.OnAfterRule(func(rule int, fired bool) { tagged = vm.Variant() })
+		require.NoError(t, vm.Run())
+
+		switch tagged {
+		case "A":
+			assert.Equal(t, 20, vm.facts["setpoint"])
+		case "B":
+			assert.Equal(t, 22, vm.facts["setpoint"])
+		default:
+			t.Fatalf("device-%d was not assigned a variant", i)
+		}
+		assert.Equal(t, true, vm.facts["after_variants"], "instructions after VARIANT_END should run for every variant")
+		assert.Empty(t, vm.Variant(), "the variant should be cleared after the rule ends")
+		counts[tagged]++
+	}
+
+	assert.InDelta(t, 500, counts["A"], 60)
+	assert.InDelta(t, 500, counts["B"], 60)
+}
+
+func TestVariants_Deterministic(t *testing.T) {
+	assign := func() string {
+		vm := NewVM(variantProgram())
+		vm.facts["deviceId"] = 1234
+		var tagged string
+		vm.OnAfterRule(func(rule int, fired bool) { tagged = vm.Variant() })
+		require.NoError(t, vm.Run())
+		return tagged
+	}
+
+	first := assign()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, assign())
+	}
+}
+
+func TestVariants_MissingKeyAssignsNoVariant(t *testing.T) {
+	vm := NewVM(variantProgram())
+	require.NoError(t, vm.Run())
+	assert.NotContains(t, vm.facts, "setpoint")
+	assert.Equal(t, true, vm.facts["after_variants"])
+}
@@ -0,0 +1,148 @@
+// runtime/webhook.go
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WebhookRequest is the value of a webhook action as passed to its handler:
+// the request compiled from the rule, with its body rendered from the facts
+// of the cycle that triggered the action.
+type WebhookRequest struct {
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Timeout time.Duration     `json:"timeout,omitempty"` // Time each attempt may take; 0 for no limit of its own
+	Retries int               `json:"retries,omitempty"` // Attempts after the first one fails
+}
+
+// webhookBackoff is the delay before the first retry of a webhook request;
+// each further retry waits twice as long.
+var webhookBackoff = 500 * time.Millisecond
+
+// webhookRequest renders the compiled webhook request at an index with the
+// current facts. A fact the body references must be defined; strings are
+// substituted as they are, other values as JSON.
+func (vm *VM) webhookRequest(index int) (WebhookRequest, error) {
+	if index < 0 || index >= len(vm.webhooks) {
+		return WebhookRequest{}, fmt.Errorf("no webhook request %d", index)
+	}
+	webhook := vm.webhooks[index]
+	var body strings.Builder
+	for _, part := range webhook.Body {
+		if part.Fact == "" {
+			body.WriteString(part.Text)
+			continue
+		}
+		value, ok := vm.getFact(part.Fact)
+		if !ok {
+			return WebhookRequest{}, fmt.Errorf("undefined fact: %s", part.Fact)
+		}
+		if err := renderTemplateValue(&body, value); err != nil {
+			return WebhookRequest{}, fmt.Errorf("fact %s: %w", part.Fact, err)
+		}
+	}
+	return WebhookRequest{
+		Method:  webhook.Method,
+		Headers: webhook.Headers,
+		Body:    body.String(),
+		Timeout: time.Duration(webhook.TimeoutMillis) * time.Millisecond,
+		Retries: webhook.Retries,
+	}, nil
+}
+
+func renderTemplateValue(b *strings.Builder, value interface{}) error {
+	if s, ok := value.(string); ok {
+		b.WriteString(s)
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	b.Write(data)
+	return nil
+}
+
+// webhookValue replaces the index a webhook action carries with its rendered
+// request. Webhook actions of bytecode without compiled requests keep their
+// value.
+func (vm *VM) webhookValue(value interface{}) (interface{}, error) {
+	if vm.webhooks == nil {
+		return value, nil
+	}
+	index, ok := value.(int)
+	if !ok {
+		return nil, fmt.Errorf("webhook action has value %v, not the index of its request", value)
+	}
+	return vm.webhookRequest(index)
+}
+
+// sendWebhook is the default handler of webhook actions. It sends the
+// action's request to its target, retrying after network errors and 5xx
+// responses, and fails on any other non-2xx response.
+func sendWebhook(ctx context.Context, action Action) error {
+	request, ok := action.Value.(WebhookRequest)
+	if !ok {
+		return fmt.Errorf("webhook action to %s has no request", action.Target)
+	}
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := request.send(ctx, action.Target)
+		if err == nil || !retry || attempt >= request.Retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return fmt.Errorf("%w (retrying after: %v)", ctx.Err(), err)
+		}
+	}
+}
+
+// send makes one attempt at the request, reporting whether a failure is
+// worth retrying.
+func (r WebhookRequest) send(ctx context.Context, url string) (bool, error) {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	method := r.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	var body io.Reader
+	if r.Body != "" {
+		body = strings.NewReader(r.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range r.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,96 @@
+package runtime
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVM_Webhook(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	section, err := bytecode.NewWebhooksSection([]bytecode.Webhook{{
+		Method:  http.MethodPut,
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Body: []rules.TemplatePart{
+			{Text: `{"site": "`}, {Fact: "site"}, {Text: `", "temperature": `}, {Fact: "temperature"}, {Text: "}"},
+		},
+	}})
+	require.NoError(t, err)
+	code := newProgram().
+		ruleStart(0).
+		loadInt(0).triggerAction(rules.ActionWebhook, server.URL+"/alerts").
+		op(bytecode.RULE_END).
+		bytes()
+	vm := NewVM(bytecode.AppendSections(code, section))
+	vm.SetFacts(map[string]interface{}{"site": "north", "temperature": 31.5})
+
+	var performed Action
+	vm.OnActionPerformed(func(action Action, err error) { performed = action })
+	require.NoError(t, vm.Run())
+	r := <-received
+	assert.Equal(t, http.MethodPut, r.Method)
+	assert.Equal(t, "/alerts", r.URL.Path)
+	assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+	assert.Equal(t, `{"site": "north", "temperature": 31.5}`, <-bodies)
+	assert.Equal(t, `{"site": "north", "temperature": 31.5}`, performed.Value.(WebhookRequest).Body)
+
+	// The facts the body references must be defined
+	vm.DeleteFact("site")
+	assert.ErrorContains(t, vm.Run(), "undefined fact: site")
+}
+
+func TestSendWebhook_Retries(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/slow":
+			time.Sleep(50 * time.Millisecond)
+		case attempts.Add(1) < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	action := Action{Type: rules.ActionWebhook, Target: server.URL, Value: WebhookRequest{Method: http.MethodPost, Retries: 2}}
+	require.NoError(t, sendWebhook(context.Background(), action))
+	assert.Equal(t, int32(3), attempts.Load())
+
+	attempts.Store(0)
+	action.Value = WebhookRequest{Method: http.MethodPost, Retries: 1}
+	assert.EqualError(t, sendWebhook(context.Background(), action), "webhook returned 503 Service Unavailable")
+	assert.Equal(t, int32(2), attempts.Load())
+
+	// Client errors aren't retried
+	action.Target = server.URL + "/missing"
+	action.Value = WebhookRequest{Method: http.MethodPost, Retries: 5}
+	assert.EqualError(t, sendWebhook(context.Background(), action), "webhook returned 404 Not Found")
+
+	action.Target = server.URL + "/slow"
+	action.Value = WebhookRequest{Method: http.MethodGet, Timeout: 10 * time.Millisecond}
+	assert.ErrorIs(t, sendWebhook(context.Background(), action), context.DeadlineExceeded)
+
+	action.Value = "not a request"
+	assert.EqualError(t, sendWebhook(context.Background(), action), "webhook action to "+action.Target+" has no request")
+}
@@ -0,0 +1,201 @@
+// script/script.go
+
+// Package script runs the Lua snippets of script conditions and actions, for
+// the logic the declarative rule language can't express. Scripts run in a
+// sandbox: they only see a copy of the facts they declare, in a global table
+// named facts, and the base, string, table and math libraries without the
+// functions reaching the file system or loading code. Every run gets a fresh
+// interpreter, limited in time, stack size and call depth, so a script can't
+// keep state between runs or hold up the runtime.
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Limits bound the resources a script run may use.
+type Limits struct {
+	// Timeout is how long a run may take before it is stopped.
+	Timeout time.Duration
+	// StackSize is the number of values the interpreter's stack holds, which
+	// bounds the memory the values a script works with take.
+	StackSize int
+	// CallDepth is how deeply function calls may nest.
+	CallDepth int
+}
+
+// DefaultLimits are the limits of scripts run by a VM unless configured
+// otherwise.
+var DefaultLimits = Limits{Timeout: 10 * time.Millisecond, StackSize: 1024, CallDepth: 64}
+
+// Validate checks that every limit is positive.
+func (l Limits) Validate() error {
+	if l.Timeout <= 0 {
+		return fmt.Errorf("script timeout must be positive, got %s", l.Timeout)
+	}
+	if l.StackSize <= 0 {
+		return fmt.Errorf("script stack size must be positive, got %d", l.StackSize)
+	}
+	if l.CallDepth <= 0 {
+		return fmt.Errorf("script call depth must be positive, got %d", l.CallDepth)
+	}
+	return nil
+}
+
+// maxStringLength is the longest string string.rep may build, so that a
+// single call can't exhaust memory before the timeout is noticed.
+const maxStringLength = 1 << 20
+
+// unsafeGlobals are the functions of the base library removed from the
+// sandbox: they load code, reach the file system or the process, or change
+// the environment of functions.
+var unsafeGlobals = []string{
+	"collectgarbage", "dofile", "getfenv", "load", "loadfile", "loadstring",
+	"module", "newproxy", "print", "require", "setfenv", "_printregs",
+}
+
+// Program is a compiled script.
+type Program struct {
+	proto *lua.FunctionProto
+}
+
+// Compile compiles a script. The script is either an expression, such as
+// facts.temperature > 30, or a chunk of statements returning its result.
+func Compile(source string) (*Program, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, errors.New("empty script")
+	}
+	chunk, err := parse.Parse(strings.NewReader("return "+source), "script")
+	if err != nil {
+		if chunk, err = parse.Parse(strings.NewReader(source), "script"); err != nil {
+			return nil, fmt.Errorf("invalid script: %w", err)
+		}
+	}
+	proto, err := lua.Compile(chunk, "script")
+	if err != nil {
+		return nil, fmt.Errorf("invalid script: %w", err)
+	}
+	return &Program{proto: proto}, nil
+}
+
+// Run runs the script with the given facts and returns its result: nil, a
+// bool, a float64 or a string.
+func (p *Program) Run(facts map[string]interface{}, limits Limits) (interface{}, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:  true,
+		RegistrySize:  limits.StackSize,
+		CallStackSize: limits.CallDepth,
+	})
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	if err := openLibraries(L); err != nil {
+		return nil, err
+	}
+	table := L.NewTable()
+	for name, value := range facts {
+		v, err := toLua(value)
+		if err != nil {
+			return nil, fmt.Errorf("fact '%s': %w", name, err)
+		}
+		table.RawSetString(name, v)
+	}
+	L.SetGlobal("facts", table)
+
+	L.Push(L.NewFunctionFromProto(p.proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("script timed out after %s", limits.Timeout)
+		}
+		return nil, err
+	}
+	return fromLua(L.Get(-1))
+}
+
+// openLibraries opens the libraries available to scripts and removes their
+// unsafe functions.
+func openLibraries(L *lua.LState) error {
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		if err := L.PCall(1, 0, nil); err != nil {
+			return fmt.Errorf("failed to open Lua library %s: %w", lib.name, err)
+		}
+	}
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetField(L.GetGlobal(lua.StringLibName), "rep", L.NewFunction(stringRep))
+	return nil
+}
+
+// stringRep replaces string.rep, refusing to build strings longer than
+// maxStringLength.
+func stringRep(L *lua.LState) int {
+	s := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n > 0 && len(s) > maxStringLength/n {
+		L.RaiseError("string.rep result longer than %d bytes", maxStringLength)
+	}
+	L.Push(lua.LString(strings.Repeat(s, max(n, 0))))
+	return 1
+}
+
+// toLua converts the value of a fact to a Lua value.
+func toLua(value interface{}) (lua.LValue, error) {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil, nil
+	case bool:
+		return lua.LBool(v), nil
+	case string:
+		return lua.LString(v), nil
+	case int:
+		return lua.LNumber(v), nil
+	case int32:
+		return lua.LNumber(v), nil
+	case int64:
+		return lua.LNumber(v), nil
+	case uint64:
+		return lua.LNumber(v), nil
+	case float64:
+		return lua.LNumber(v), nil
+	default:
+		return nil, fmt.Errorf("unsupported value of type %T", value)
+	}
+}
+
+// fromLua converts the result of a script to a Go value. Lua numbers are
+// floats.
+func fromLua(value lua.LValue) (interface{}, error) {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	default:
+		return nil, fmt.Errorf("script returned a %s, must return nil, a boolean, a number or a string", value.Type())
+	}
+}
@@ -0,0 +1,82 @@
+package script
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func run(t *testing.T, source string, facts map[string]interface{}) (interface{}, error) {
+	t.Helper()
+	program, err := Compile(source)
+	require.NoError(t, err)
+	return program.Run(facts, DefaultLimits)
+}
+
+func TestRun_ExpressionsAndChunks(t *testing.T) {
+	facts := map[string]interface{}{"temperature": 31, "humidity": 40.5, "mode": "auto", "sensor.a.ok": true}
+
+	result, err := run(t, "facts.temperature > 30 and facts.humidity < 50", facts)
+	require.NoError(t, err)
+	assert.Equal(t, true, result)
+
+	result, err = run(t, `
+		local heat = facts.temperature + 0.1 * facts.humidity
+		if facts["sensor.a.ok"] then return heat end
+		return nil`, facts)
+	require.NoError(t, err)
+	assert.InDelta(t, 35.05, result, 1e-9)
+
+	result, err = run(t, "string.upper(facts.mode)", facts)
+	require.NoError(t, err)
+	assert.Equal(t, "AUTO", result)
+
+	// Undeclared facts are nil
+	result, err = run(t, "facts.pressure == nil", facts)
+	require.NoError(t, err)
+	assert.Equal(t, true, result)
+}
+
+func TestRun_Errors(t *testing.T) {
+	_, err := Compile("facts.temperature >")
+	assert.ErrorContains(t, err, "invalid script")
+	_, err = Compile("  ")
+	assert.ErrorContains(t, err, "empty script")
+
+	_, err = run(t, "{1, 2}", nil)
+	assert.ErrorContains(t, err, "script returned a table")
+
+	_, err = run(t, "error('boom')", nil)
+	assert.ErrorContains(t, err, "boom")
+
+	_, err = run(t, "facts.x", map[string]interface{}{"x": []int{1}})
+	assert.ErrorContains(t, err, "fact 'x': unsupported value of type []int")
+}
+
+func TestRun_Sandbox(t *testing.T) {
+	for _, global := range []string{"dofile", "load", "loadstring", "require", "io", "os", "debug"} {
+		result, err := run(t, global+" == nil", nil)
+		require.NoError(t, err)
+		assert.Equal(t, true, result, global)
+	}
+
+	_, err := run(t, "string.rep('x', 1e9)", nil)
+	assert.ErrorContains(t, err, "string.rep result longer than")
+}
+
+func TestRun_Limits(t *testing.T) {
+	program, err := Compile("while true do end")
+	require.NoError(t, err)
+	limits := DefaultLimits
+	limits.Timeout = 20 * time.Millisecond
+	_, err = program.Run(nil, limits)
+	assert.ErrorContains(t, err, "script timed out after 20ms")
+
+	_, err = run(t, "local function f(n) return f(n + 1) + 1 end return f(1)", nil)
+	assert.ErrorContains(t, err, "stack overflow")
+
+	assert.NoError(t, DefaultLimits.Validate())
+	assert.Error(t, Limits{Timeout: time.Second, StackSize: 10}.Validate())
+}
@@ -0,0 +1,236 @@
+// transport/messages.go
+
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMQTTMessageTopic is the topic messages are published to unless
+// configured otherwise.
+const DefaultMQTTMessageTopic = "rex/messages/{target}"
+
+// Message sink types of a MessageSinkConfig.
+const (
+	SinkStdout  = "stdout"
+	SinkWebhook = "webhook"
+	SinkMQTT    = "mqtt"
+)
+
+// MessageConfig selects the sinks delivering the messages of sendMessage
+// actions, by target. It is read from JSON:
+//
+//	{
+//	    "default": {"type": "stdout"},
+//	    "targets": {
+//	        "ops": {"type": "webhook", "url": "https://hooks.example.com/rex"},
+//	        "panel": {"type": "mqtt", "broker": "mqtt://localhost:1883", "topic": "site/{target}"}
+//	    }
+//	}
+type MessageConfig struct {
+	Default *MessageSinkConfig           `json:"default,omitempty"` // Sink of the targets not listed; without one their messages fail
+	Targets map[string]MessageSinkConfig `json:"targets,omitempty"`
+}
+
+// MessageSinkConfig configures a message sink.
+type MessageSinkConfig struct {
+	Type string `json:"type"` // SinkStdout, SinkWebhook or SinkMQTT
+
+	// Webhook: the endpoint messages are POSTed to, with extra headers
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// MQTT: the broker, and the topic messages are published to, in which
+	// {target} stands for the target of the message
+	Broker string `json:"broker,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	Retain bool   `json:"retain,omitempty"`
+}
+
+// Validate checks that the configured sinks are complete.
+func (c MessageConfig) Validate() error {
+	var errs []error
+	if c.Default != nil {
+		if err := c.Default.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("default: %w", err))
+		}
+	}
+	for target, sink := range c.Targets {
+		if err := sink.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("target %s: %w", target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c MessageSinkConfig) validate() error {
+	switch c.Type {
+	case SinkStdout:
+	case SinkWebhook:
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return fmt.Errorf("webhook sink needs an http or https url, not %q", c.URL)
+		}
+	case SinkMQTT:
+		if c.Broker == "" {
+			return errors.New("mqtt sink needs a broker")
+		}
+		if strings.ContainsAny(c.Topic, "+#") {
+			return fmt.Errorf("invalid MQTT topic %q", c.Topic)
+		}
+	default:
+		return fmt.Errorf("unknown message sink type %q", c.Type)
+	}
+	return nil
+}
+
+// MessageSinks holds the sinks built from a MessageConfig, routing the
+// messages of sendMessage actions to them.
+type MessageSinks struct {
+	Router *runtime.MessageRouter
+	mqtt   []*MQTTSink
+}
+
+// NewMessageSinks builds the sinks of a validated configuration. The MQTT
+// sinks of a broker share a connection, made with options on first use.
+func NewMessageSinks(config MessageConfig, options MQTTOptions) *MessageSinks {
+	sinks := &MessageSinks{Router: &runtime.MessageRouter{Targets: make(map[string]runtime.MessageSink)}}
+	brokers := make(map[string]*mqttBroker)
+	build := func(c MessageSinkConfig) runtime.MessageSink {
+		switch c.Type {
+		case SinkWebhook:
+			return &runtime.WebhookSink{URL: c.URL, Headers: c.Headers}
+		case SinkMQTT:
+			broker, ok := brokers[c.Broker]
+			if !ok {
+				broker = &mqttBroker{address: c.Broker, options: options}
+				brokers[c.Broker] = broker
+			}
+			sink := &MQTTSink{broker: broker, topic: c.Topic, retain: c.Retain}
+			if sink.topic == "" {
+				sink.topic = DefaultMQTTMessageTopic
+			}
+			sinks.mqtt = append(sinks.mqtt, sink)
+			return sink
+		default:
+			return &runtime.WriterSink{W: os.Stdout}
+		}
+	}
+	if config.Default != nil {
+		sinks.Router.Default = build(*config.Default)
+	}
+	for target, c := range config.Targets {
+		sinks.Router.Targets[target] = build(c)
+	}
+	return sinks
+}
+
+// Close closes the connections of the MQTT sinks.
+func (s *MessageSinks) Close() {
+	for _, sink := range s.mqtt {
+		sink.broker.close()
+	}
+}
+
+// mqttBroker is the connection to a broker shared by MQTT sinks. It connects
+// on first use, and again on the next use after the connection is lost. Once
+// dialing fails, it waits before dialing again, a second at first and twice
+// as long after each failure up to 30 seconds, failing the messages sent
+// meanwhile with the reason.
+type mqttBroker struct {
+	address string
+	options MQTTOptions
+
+	mu      sync.Mutex
+	conn    *MQTTConn
+	wait    time.Duration // Delay after the last failed dial; 0 if the last dial succeeded
+	retryAt time.Time     // Time the broker is dialed again after a failure
+	dialErr error         // Reason the last dial failed
+}
+
+// Delays before dialing a broker again after failing to.
+const (
+	minMQTTRedialWait = time.Second
+	maxMQTTRedialWait = 30 * time.Second
+)
+
+// connection returns an open connection to the broker.
+func (b *mqttBroker) connection() (*MQTTConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		select {
+		case <-b.conn.Done():
+			if b.address == "" {
+				return nil, b.conn.Err() // A connection given by the host isn't redialed
+			}
+			b.conn = nil
+		default:
+			return b.conn, nil
+		}
+	}
+	if b.wait > 0 && time.Now().Before(b.retryAt) {
+		return nil, b.dialErr
+	}
+	conn, err := DialMQTT(b.address, b.options)
+	if err != nil {
+		b.wait = min(max(2*b.wait, minMQTTRedialWait), maxMQTTRedialWait)
+		b.retryAt, b.dialErr = time.Now().Add(b.wait), err
+		return nil, err
+	}
+	b.conn, b.wait = conn, 0
+	return conn, nil
+}
+
+func (b *mqttBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// MQTTSink publishes messages to an MQTT broker as JSON.
+type MQTTSink struct {
+	broker *mqttBroker
+	topic  string
+	retain bool
+}
+
+// NewMQTTSink creates a sink publishing through conn to topic, in which
+// {target} stands for the target of the message, e.g. rex/messages/{target}.
+func NewMQTTSink(conn *MQTTConn, topic string, retain bool) (*MQTTSink, error) {
+	if topic == "" {
+		topic = DefaultMQTTMessageTopic
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return nil, fmt.Errorf("invalid MQTT topic %q", topic)
+	}
+	return &MQTTSink{broker: &mqttBroker{conn: conn}, topic: topic, retain: retain}, nil
+}
+
+// Topic returns the topic a message is published to.
+func (s *MQTTSink) Topic(msg runtime.Message) string {
+	return strings.ReplaceAll(s.topic, "{target}", mqttTopicLevel(msg.Target))
+}
+
+// Send implements runtime.MessageSink.
+func (s *MQTTSink) Send(ctx context.Context, msg runtime.Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+	conn, err := s.broker.connection()
+	if err != nil {
+		return err
+	}
+	return conn.Publish(s.Topic(msg), payload, s.retain)
+}
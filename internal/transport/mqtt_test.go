@@ -0,0 +1,234 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"rgehrsitz/rex/internal/runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMQTT is an MQTT broker recording what its clients publish, enough of
+// one to test the client against.
+type fakeMQTT struct {
+	listener  net.Listener
+	password  string // Password clients must authenticate with, if any
+	published chan fakePublish
+	pings     chan struct{}
+}
+
+type fakePublish struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+func startFakeMQTT(t *testing.T, password string) *fakeMQTT {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return serveFakeMQTT(t, listener, password)
+}
+
+// serveFakeMQTT starts a broker accepting the connections of listener.
+func serveFakeMQTT(t *testing.T, listener net.Listener, password string) *fakeMQTT {
+	broker := &fakeMQTT{listener: listener, password: password, published: make(chan fakePublish, 10), pings: make(chan struct{}, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *fakeMQTT) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *fakeMQTT) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		first, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch first >> 4 {
+		case mqttConnect:
+			if b.connectPassword(body) != b.password {
+				conn.Write([]byte{mqttConnAck << 4, 2, 0, 4})
+				return
+			}
+			conn.Write([]byte{mqttConnAck << 4, 2, 0, 0})
+		case mqttPublish:
+			size := int(binary.BigEndian.Uint16(body))
+			b.published <- fakePublish{topic: string(body[2 : 2+size]), payload: body[2+size:], retain: first&0x01 != 0}
+		case mqttPingReq:
+			b.pings <- struct{}{}
+			conn.Write([]byte{mqttPingResp << 4, 0})
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+// connectPassword returns the password of a CONNECT packet's body.
+func (b *fakeMQTT) connectPassword(body []byte) string {
+	flags := body[7]
+	rest := body[10:] // After the protocol name, level, flags and keep alive
+	var fields []string
+	for len(rest) >= 2 {
+		size := int(binary.BigEndian.Uint16(rest))
+		fields = append(fields, string(rest[2:2+size]))
+		rest = rest[2+size:]
+	}
+	if flags&0x40 == 0 || len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+func TestMQTTConn(t *testing.T) {
+	broker := startFakeMQTT(t, "")
+	conn, err := DialMQTT("mqtt://"+broker.addr(), MQTTOptions{ClientID: "test", KeepAlive: 100 * time.Millisecond})
+	require.NoError(t, err)
+
+	require.NoError(t, conn.Publish("site/panel", []byte("on"), true))
+	published := <-broker.published
+	assert.Equal(t, fakePublish{topic: "site/panel", payload: []byte("on"), retain: true}, published)
+	<-broker.pings // Kept alive
+
+	assert.EqualError(t, conn.Publish("site/+", nil, false), `invalid MQTT topic "site/+"`)
+
+	conn.Close()
+	<-conn.Done()
+	assert.ErrorIs(t, conn.Err(), net.ErrClosed)
+	assert.Error(t, conn.Publish("site/panel", nil, false))
+}
+
+func TestDialMQTT_Refused(t *testing.T) {
+	broker := startFakeMQTT(t, "secret")
+	_, err := DialMQTT(broker.addr(), MQTTOptions{Username: "rex", Password: "wrong"})
+	assert.EqualError(t, err, "MQTT broker refused the connection: bad user name or password")
+
+	conn, err := DialMQTT("tcp://rex:secret@"+broker.addr(), MQTTOptions{})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestParseMQTTAddress(t *testing.T) {
+	host, username, password, secure, err := parseMQTTAddress("mqtt://rex:pw@broker:1884")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"broker:1884", "rex", "pw"}, []string{host, username, password})
+	assert.False(t, secure)
+
+	host, _, _, _, err = parseMQTTAddress("broker")
+	require.NoError(t, err)
+	assert.Equal(t, "broker:1883", host)
+
+	host, _, _, secure, err = parseMQTTAddress("ssl://broker")
+	require.NoError(t, err)
+	assert.Equal(t, "broker:8883", host)
+	assert.True(t, secure)
+
+	_, _, _, _, err = parseMQTTAddress("ws://broker")
+	assert.EqualError(t, err, "invalid MQTT address: unsupported scheme ws")
+}
+
+func TestDialMQTT_TLS(t *testing.T) {
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	require.NoError(t, err)
+	broker := serveFakeMQTT(t, listener, "")
+
+	_, err = DialMQTT("mqtts://"+broker.addr(), MQTTOptions{})
+	assert.ErrorContains(t, err, "failed to secure the MQTT connection", "the broker's certificate isn't trusted")
+
+	conn, err := DialMQTT("mqtts://"+broker.addr(), MQTTOptions{TLS: clientTLS})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.Publish("site/panel", []byte("too hot"), false))
+	assert.Equal(t, "too hot", string((<-broker.published).payload))
+}
+
+func TestMessageConfig_Validate(t *testing.T) {
+	valid := MessageConfig{
+		Default: &MessageSinkConfig{Type: SinkStdout},
+		Targets: map[string]MessageSinkConfig{
+			"ops":   {Type: SinkWebhook, URL: "https://hooks.example.com/rex"},
+			"panel": {Type: SinkMQTT, Broker: "localhost"},
+		},
+	}
+	assert.NoError(t, valid.Validate())
+
+	assert.EqualError(t, MessageConfig{Default: &MessageSinkConfig{Type: "email"}}.Validate(), `default: unknown message sink type "email"`)
+	assert.EqualError(t, MessageConfig{Targets: map[string]MessageSinkConfig{"ops": {Type: SinkWebhook}}}.Validate(), `target ops: webhook sink needs an http or https url, not ""`)
+	assert.EqualError(t, MessageConfig{Targets: map[string]MessageSinkConfig{"panel": {Type: SinkMQTT}}}.Validate(), "target panel: mqtt sink needs a broker")
+}
+
+func TestMessageSinks(t *testing.T) {
+	broker := startFakeMQTT(t, "")
+	sinks := NewMessageSinks(MessageConfig{Targets: map[string]MessageSinkConfig{
+		"panel/1": {Type: SinkMQTT, Broker: broker.addr()},
+		"lobby":   {Type: SinkMQTT, Broker: broker.addr(), Topic: "site/{target}/message", Retain: true},
+	}}, MQTTOptions{})
+	defer sinks.Close()
+
+	action := runtime.Action{Rule: 1, Type: "sendMessage", Target: "panel/1", Value: "too hot", CorrelationID: "c1"}
+	require.NoError(t, sinks.Router.Handle(context.Background(), action))
+	published := <-broker.published
+	assert.Equal(t, "rex/messages/panel_1", published.topic)
+	var msg runtime.Message
+	require.NoError(t, json.Unmarshal(published.payload, &msg))
+	assert.Equal(t, runtime.Message{Target: "panel/1", Content: "too hot", Rule: 1, CorrelationID: "c1"}, msg)
+
+	action.Target = "lobby"
+	require.NoError(t, sinks.Router.Handle(context.Background(), action))
+	published = <-broker.published
+	assert.Equal(t, "site/lobby/message", published.topic)
+	assert.True(t, published.retain)
+
+	action.Target = "unrouted"
+	assert.EqualError(t, sinks.Router.Handle(context.Background(), action), "no message sink for target unrouted")
+
+	// Closed sinks connect again on the next message
+	sinks.Close()
+	action.Target = "lobby"
+	require.NoError(t, sinks.Router.Handle(context.Background(), action))
+	assert.Equal(t, "site/lobby/message", (<-broker.published).topic)
+}
+
+func TestMessageSinks_Redial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	sinks := NewMessageSinks(MessageConfig{Default: &MessageSinkConfig{Type: SinkMQTT, Broker: addr}}, MQTTOptions{})
+	defer sinks.Close()
+	action := runtime.Action{Type: "sendMessage", Target: "panel", Value: "too hot"}
+
+	// Once the broker can't be reached, it isn't dialed again for a while
+	dialErr := sinks.Router.Handle(context.Background(), action)
+	assert.ErrorContains(t, dialErr, "failed to connect to MQTT broker")
+	listener, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	broker := serveFakeMQTT(t, listener, "")
+	assert.Equal(t, dialErr, sinks.Router.Handle(context.Background(), action))
+	assert.Empty(t, broker.published)
+
+	sinks.mqtt[0].broker.retryAt = time.Now()
+	require.NoError(t, sinks.Router.Handle(context.Background(), action))
+	assert.Equal(t, "rex/messages/panel", (<-broker.published).topic)
+}
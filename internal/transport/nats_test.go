@@ -0,0 +1,421 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"rgehrsitz/rex/internal/factsource"
+	"rgehrsitz/rex/internal/runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNATS is a NATS server routing messages between its clients, enough of
+// one to test the client against.
+type fakeNATS struct {
+	listener net.Listener
+	token    string      // Token clients must authenticate with, if any
+	tls      *tls.Config // Set for servers requiring TLS
+
+	mu      sync.Mutex
+	subs    []fakeSub
+	clients []*fakeClient
+}
+
+type fakeSub struct {
+	client  *fakeClient
+	sid     string
+	subject string
+}
+
+type fakeClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (c *fakeClient) send(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.conn, format, args...)
+}
+
+func startFakeNATS(t *testing.T, token string) *fakeNATS {
+	return startFakeNATSServer(t, &fakeNATS{token: token})
+}
+
+// startFakeNATSServer starts serving on a new listener.
+func startFakeNATSServer(t *testing.T, server *fakeNATS) *fakeNATS {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server.listener = listener
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go server.serve(&fakeClient{conn: conn})
+		}
+	}()
+	return server
+}
+
+func (s *fakeNATS) addr() string {
+	return s.listener.Addr().String()
+}
+
+// dropClients closes the connections of the clients, as a restarting
+// server does.
+func (s *fakeNATS) dropClients() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, client := range s.clients {
+		client.conn.Close()
+	}
+	s.clients, s.subs = nil, nil
+}
+
+func (s *fakeNATS) serve(client *fakeClient) {
+	if s.tls != nil {
+		client.send("INFO {\"server_id\":\"fake\",\"max_payload\":1024,\"tls_required\":true}\r\n")
+		client.conn = tls.Server(client.conn, s.tls)
+	} else {
+		client.send("INFO {\"server_id\":\"fake\",\"max_payload\":1024}\r\n")
+	}
+	s.mu.Lock()
+	s.clients = append(s.clients, client)
+	s.mu.Unlock()
+	r := bufio.NewReader(client.conn)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(line, " ")
+		fields := strings.Fields(args)
+		switch op {
+		case "CONNECT":
+			var connect struct {
+				Token string `json:"auth_token"`
+			}
+			json.Unmarshal([]byte(args), &connect)
+			if connect.Token != s.token {
+				client.send("-ERR 'Authorization Violation'\r\n")
+				client.conn.Close()
+				return
+			}
+		case "PING":
+			client.send("PONG\r\n")
+		case "SUB":
+			s.mu.Lock()
+			s.subs = append(s.subs, fakeSub{client: client, subject: fields[0], sid: fields[len(fields)-1]})
+			s.mu.Unlock()
+		case "UNSUB":
+			s.mu.Lock()
+			for i, sub := range s.subs {
+				if sub.client == client && sub.sid == fields[0] {
+					s.subs = append(s.subs[:i], s.subs[i+1:]...)
+					break
+				}
+			}
+			s.mu.Unlock()
+		case "PUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.mu.Lock()
+			for _, sub := range s.subs {
+				if subjectMatches(sub.subject, fields[0]) {
+					sub.client.send("MSG %s %s %d\r\n%s\r\n", fields[0], sub.sid, size, payload[:size])
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// subjectMatches reports whether a subject matches a subscription's, which
+// may contain wildcards.
+func subjectMatches(pattern, subject string) bool {
+	patternTokens, subjectTokens := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(subjectTokens) == len(patternTokens)
+}
+
+func dialFakeNATS(t *testing.T, server *fakeNATS) *NATSConn {
+	conn, err := DialNATS(server.addr(), NATSOptions{Name: "test", Token: server.token})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestNATSConn(t *testing.T) {
+	server := startFakeNATS(t, "")
+	subscriber, publisher := dialFakeNATS(t, server), dialFakeNATS(t, server)
+
+	received := make(chan *NATSMsg, 10)
+	unsubscribe, err := subscriber.Subscribe("facts.>", func(msg *NATSMsg) { received <- msg })
+	require.NoError(t, err)
+	require.NoError(t, subscriber.Flush(context.Background()))
+
+	require.NoError(t, publisher.Publish("facts.temperature", []byte("30")))
+	require.NoError(t, publisher.Publish("other.temperature", []byte("31")))
+	require.NoError(t, publisher.Publish("facts.mode", nil))
+	msg := <-received
+	assert.Equal(t, "facts.temperature", msg.Subject)
+	assert.Equal(t, "30", string(msg.Data))
+	msg = <-received
+	assert.Equal(t, "facts.mode", msg.Subject)
+	assert.Empty(t, msg.Data)
+
+	require.NoError(t, unsubscribe())
+	require.NoError(t, subscriber.Flush(context.Background()))
+	require.NoError(t, publisher.Publish("facts.temperature", []byte("32")))
+	require.NoError(t, publisher.Flush(context.Background()))
+	require.NoError(t, subscriber.Flush(context.Background()))
+	assert.Empty(t, received)
+
+	assert.EqualError(t, publisher.Publish("facts.*", nil), `invalid NATS subject "facts.*"`)
+	assert.EqualError(t, publisher.Publish("facts.big", make([]byte, 2000)), "message to facts.big exceeds the server's maximum payload of 1024 bytes")
+
+	subscriber.Close()
+	<-subscriber.Done()
+	assert.ErrorIs(t, subscriber.Err(), net.ErrClosed)
+	assert.Error(t, subscriber.Publish("facts.temperature", []byte("33")))
+}
+
+func TestDialNATS_Refused(t *testing.T) {
+	server := startFakeNATS(t, "secret")
+	_, err := DialNATS(server.addr(), NATSOptions{Token: "wrong"})
+	assert.EqualError(t, err, "NATS server refused the connection: Authorization Violation")
+
+	conn, err := DialNATS("nats://"+server.addr(), NATSOptions{Token: "secret"})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestParseNATSAddress(t *testing.T) {
+	host, username, password, secure, err := parseNATSAddress("nats://rex:pw@broker:4223")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"broker:4223", "rex", "pw"}, []string{host, username, password})
+	assert.False(t, secure)
+
+	host, _, _, _, err = parseNATSAddress("broker")
+	require.NoError(t, err)
+	assert.Equal(t, "broker:4222", host)
+
+	host, _, _, secure, err = parseNATSAddress("tls://broker")
+	require.NoError(t, err)
+	assert.Equal(t, "broker:4222", host)
+	assert.True(t, secure)
+
+	_, _, _, _, err = parseNATSAddress("ws://broker")
+	assert.EqualError(t, err, "invalid NATS address: unsupported scheme ws")
+}
+
+func TestNATSSource(t *testing.T) {
+	server := startFakeNATS(t, "")
+	conn, publisher := dialFakeNATS(t, server), dialFakeNATS(t, server)
+
+	_, err := NewNATSSource(conn, NATSSourceConfig{})
+	assert.Error(t, err)
+	source, err := NewNATSSource(conn, NATSSourceConfig{
+		Subjects: []string{"facts.>", "other.>"},
+		Mapping:  factsource.Mapping{Prefix: "facts.", Facts: map[string]string{"temp": "temperature"}},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan factsource.Update, 10)
+	done := make(chan error, 1)
+	go func() { done <- source.Run(ctx, updates) }()
+
+	// The subscriptions are in place once a message sent afterwards arrives
+	require.Eventually(t, func() bool {
+		publisher.Publish("facts.ready", []byte("true"))
+		select {
+		case update := <-updates:
+			return update.Fact == "ready"
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	require.NoError(t, publisher.Flush(context.Background()))
+	require.NoError(t, conn.Flush(context.Background()))
+	for len(updates) > 0 {
+		<-updates
+	}
+
+	require.NoError(t, publisher.Publish("other.pressure", []byte("2")))
+	require.NoError(t, publisher.Publish("facts.temp", []byte("30")))
+	require.NoError(t, publisher.Publish("facts.setpoint", []byte("21.5")))
+	require.NoError(t, publisher.Publish("facts.mode", []byte("eco")))
+	require.NoError(t, publisher.Publish("facts.mode", nil))
+	assert.Equal(t, factsource.Update{Fact: "temperature", Value: 30}, <-updates)
+	assert.Equal(t, factsource.Update{Fact: "setpoint", Value: 21.5}, <-updates)
+	assert.Equal(t, factsource.Update{Fact: "mode", Value: "eco"}, <-updates)
+	assert.Equal(t, factsource.Update{Fact: "mode", Deleted: true}, <-updates)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestNATSSource_ConnectionLost(t *testing.T) {
+	server := startFakeNATS(t, "")
+	conn := dialFakeNATS(t, server)
+	source, err := NewNATSSource(conn, NATSSourceConfig{Subjects: []string{"facts.>"}})
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() { done <- source.Run(context.Background(), make(chan factsource.Update)) }()
+	conn.Close()
+	assert.ErrorIs(t, <-done, net.ErrClosed)
+}
+
+func TestNATSConn_Reconnect(t *testing.T) {
+	server := startFakeNATS(t, "")
+	disconnected, reconnected := make(chan error, 1), make(chan struct{}, 1)
+	subscriber, err := DialNATS(server.addr(), NATSOptions{
+		MaxReconnects: -1,
+		ReconnectWait: time.Millisecond,
+		Disconnected:  func(err error) { disconnected <- err },
+		Reconnected:   func() { reconnected <- struct{}{} },
+	})
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	received := make(chan *NATSMsg, 10)
+	_, err = subscriber.Subscribe("facts.>", func(msg *NATSMsg) { received <- msg })
+	require.NoError(t, err)
+	require.NoError(t, subscriber.Flush(context.Background()))
+
+	// The subscription is renewed once the client reconnects
+	server.dropClients()
+	assert.Error(t, <-disconnected)
+	<-reconnected
+	assert.Nil(t, subscriber.Err())
+	require.NoError(t, subscriber.Flush(context.Background()))
+	publisher := dialFakeNATS(t, server)
+	require.NoError(t, publisher.Publish("facts.temperature", []byte("30")))
+	msg := <-received
+	assert.Equal(t, "30", string(msg.Data))
+}
+
+func TestNATSConn_GivesUpReconnecting(t *testing.T) {
+	server := startFakeNATS(t, "")
+	conn, err := DialNATS(server.addr(), NATSOptions{MaxReconnects: 2, ReconnectWait: time.Millisecond})
+	require.NoError(t, err)
+
+	server.listener.Close()
+	server.dropClients()
+	<-conn.Done()
+	assert.ErrorContains(t, conn.Err(), "failed to reconnect to NATS")
+
+	// Without reconnecting, the connection is closed once lost
+	server = startFakeNATS(t, "")
+	conn = dialFakeNATS(t, server)
+	server.dropClients()
+	<-conn.Done()
+	assert.Error(t, conn.Err())
+	assert.ErrorContains(t, conn.Publish("facts.temperature", nil), "failed to publish")
+}
+
+func TestNATSConn_TLS(t *testing.T) {
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	server := startFakeNATSServer(t, &fakeNATS{tls: serverTLS})
+
+	_, err := DialNATS(server.addr(), NATSOptions{Timeout: time.Second})
+	assert.ErrorContains(t, err, "failed to secure the NATS connection", "the server's certificate isn't trusted")
+
+	conn, err := DialNATS(server.addr(), NATSOptions{TLS: clientTLS})
+	require.NoError(t, err)
+	defer conn.Close()
+	received := make(chan *NATSMsg, 1)
+	_, err = conn.Subscribe("facts.>", func(msg *NATSMsg) { received <- msg })
+	require.NoError(t, err)
+	require.NoError(t, conn.Flush(context.Background()))
+	require.NoError(t, conn.Publish("facts.temperature", []byte("30")))
+	assert.Equal(t, "30", string((<-received).Data))
+}
+
+// newTestTLSConfigs returns the TLS configuration of a server with a
+// self-signed certificate for 127.0.0.1, and that of a client trusting it.
+func newTestTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rex test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: roots}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	server := startFakeNATS(t, "")
+	conn, subscriber := dialFakeNATS(t, server), dialFakeNATS(t, server)
+
+	received := make(chan *NATSMsg, 10)
+	_, err := subscriber.Subscribe("rex.actions.>", func(msg *NATSMsg) { received <- msg })
+	require.NoError(t, err)
+	require.NoError(t, subscriber.Flush(context.Background()))
+
+	_, err = NewNATSPublisher(conn, "rex.actions.>")
+	assert.Error(t, err)
+	publisher, err := NewNATSPublisher(conn, "rex.actions.{type}.{target}")
+	require.NoError(t, err)
+
+	action := runtime.Action{Rule: 2, Type: "notify", Target: "ops team", Value: "too hot", CorrelationID: "c1"}
+	assert.Equal(t, "rex.actions.notify.ops_team", publisher.Subject(action))
+	require.NoError(t, publisher.Handle(context.Background(), action))
+
+	msg := <-received
+	assert.Equal(t, "rex.actions.notify.ops_team", msg.Subject)
+	var published runtime.Action
+	require.NoError(t, json.Unmarshal(msg.Data, &published))
+	assert.Equal(t, action, published)
+
+	defaultPublisher, err := NewNATSPublisher(conn, "")
+	require.NoError(t, err)
+	assert.Equal(t, "rex.actions.sendAlert", defaultPublisher.Subject(runtime.Action{Type: "sendAlert"}))
+}
@@ -0,0 +1,53 @@
+// transport/natsactions.go
+
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"rgehrsitz/rex/internal/runtime"
+	"strings"
+)
+
+// DefaultNATSActionSubject is the subject actions are published to unless
+// configured otherwise.
+const DefaultNATSActionSubject = "rex.actions.{type}"
+
+// NATSPublisher publishes the actions rules trigger to NATS, as the JSON of
+// the runtime.Action, so that other services perform them. Its Handle method
+// is registered as the handler of the action types to publish.
+type NATSPublisher struct {
+	conn    *NATSConn
+	subject string
+}
+
+// NewNATSPublisher creates a publisher sending actions through conn to
+// subject, in which {type} and {target} stand for the type and target of
+// the action, e.g. rex.actions.{type}.{target}.
+func NewNATSPublisher(conn *NATSConn, subject string) (*NATSPublisher, error) {
+	if subject == "" {
+		subject = DefaultNATSActionSubject
+	}
+	if strings.ContainsAny(subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("invalid NATS action subject %q", subject)
+	}
+	return &NATSPublisher{conn: conn, subject: subject}, nil
+}
+
+// Subject returns the subject an action is published to.
+func (p *NATSPublisher) Subject(action runtime.Action) string {
+	return strings.NewReplacer(
+		"{type}", natsSubjectToken(action.Type),
+		"{target}", natsSubjectToken(action.Target),
+	).Replace(p.subject)
+}
+
+// Handle implements runtime.ActionHandler, publishing the action.
+func (p *NATSPublisher) Handle(ctx context.Context, action runtime.Action) error {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return fmt.Errorf("failed to encode action: %w", err)
+	}
+	return p.conn.Publish(p.Subject(action), data)
+}
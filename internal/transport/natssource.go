@@ -0,0 +1,72 @@
+// transport/natssource.go
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"rgehrsitz/rex/internal/factsource"
+)
+
+// NATSSourceConfig configures a NATSSource.
+type NATSSourceConfig struct {
+	// Subjects lists the subjects read, which may contain the wildcards *
+	// and >, e.g. facts.>.
+	Subjects []string
+
+	// Mapping maps subjects to fact names; with Prefix facts., the subject
+	// facts.temperature sets the fact temperature.
+	Mapping factsource.Mapping
+}
+
+// NATSSource is a fact source reading fact changes from NATS subjects. A
+// message sets the fact its subject maps to to its payload, read as an int,
+// float, true/false or string; an empty payload deletes the fact.
+type NATSSource struct {
+	conn   *NATSConn
+	config NATSSourceConfig
+}
+
+// NewNATSSource creates a fact source reading fact changes through conn.
+func NewNATSSource(conn *NATSConn, config NATSSourceConfig) (*NATSSource, error) {
+	if len(config.Subjects) == 0 {
+		return nil, errors.New("a NATS fact source requires at least one subject")
+	}
+	return &NATSSource{conn: conn, config: config}, nil
+}
+
+// Run implements factsource.Source. It returns the reason the connection was
+// lost if that happens before ctx is done.
+func (s *NATSSource) Run(ctx context.Context, updates chan<- factsource.Update) error {
+	for _, subject := range s.config.Subjects {
+		unsubscribe, err := s.conn.Subscribe(subject, func(msg *NATSMsg) {
+			s.handle(ctx, msg, updates)
+		})
+		if err != nil {
+			return err
+		}
+		defer unsubscribe()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.conn.Done():
+		return s.conn.Err()
+	}
+}
+
+// handle sends the update for a message. It gives up once ctx is done.
+func (s *NATSSource) handle(ctx context.Context, msg *NATSMsg, updates chan<- factsource.Update) {
+	fact, ok := s.config.Mapping.FactName(msg.Subject)
+	if !ok {
+		return
+	}
+	update := factsource.Update{Fact: fact, Deleted: true}
+	if len(msg.Data) > 0 {
+		update = factsource.Update{Fact: fact, Value: factsource.ParseValue(string(msg.Data))}
+	}
+	select {
+	case updates <- update:
+	case <-ctx.Done():
+	}
+}
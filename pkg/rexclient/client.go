@@ -0,0 +1,328 @@
+// pkg/rexclient/client.go
+
+// Package rexclient is a typed client for the rules service started with rex
+// serve, so that Go services push facts, evaluate them and swap the bytecode
+// without handling the generated rexpb types:
+//
+//	c, err := rexclient.New("rex-service:50051", rexclient.Options{Retries: 3})
+//	evaluation, err := c.Evaluate(ctx, rexclient.Update{Set: map[string]interface{}{"temperature": 35}})
+//
+// Fact values are ints, floats, strings or bools, as the service takes them.
+// Only the calls that don't change the service, GetFacts and StreamFirings,
+// are retried: a call failing as unavailable may still have been applied.
+// gRPC itself retries the calls that never reached the service.
+// The client package at the root of the module reads the admin API of a
+// runtime instead.
+package rexclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"rgehrsitz/rex/rexpb"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Options configures a Client.
+type Options struct {
+	Credentials credentials.TransportCredentials // Security of the connection; none if nil
+	Token       string                           // Sent as a bearer token, for services behind a proxy authenticating requests
+	Retries     int                              // Attempts after the first for GetFacts and StreamFirings calls failing because the service is unavailable
+	RetryDelay  time.Duration                    // Delay before the first retry, doubled for each one after it; 100ms if zero
+	DialOptions []grpc.DialOption                // Further options of the connection, such as a dialer
+}
+
+// Client calls the Rex service. It is safe for concurrent use.
+type Client struct {
+	conn    *grpc.ClientConn
+	rex     rexpb.RexClient
+	options Options
+}
+
+// Update sets and deletes facts.
+type Update struct {
+	Set    map[string]interface{}
+	Delete []string
+	// Labels the evaluation of the update and the actions it triggers; the
+	// service generates a random ID if empty.
+	CorrelationID string
+}
+
+// Action is an action a rule triggered when it fired.
+type Action struct {
+	Rule          int    // Index of the rule in the bytecode
+	RuleName      string // Empty if the bytecode doesn't name its rules
+	Type          string
+	Target        string
+	Value         interface{}
+	CorrelationID string
+	RulesetHash   string
+}
+
+// Evaluation is the outcome of an update evaluated with Evaluate.
+type Evaluation struct {
+	CorrelationID string
+	// The actions of the cycle evaluating the update, which also evaluates
+	// the updates queued with it.
+	Actions []Action
+}
+
+// Bytecode describes the bytecode the service evaluates after SwapBytecode.
+type Bytecode struct {
+	Rules       []string // Names of the rules, in bytecode order
+	RulesetHash string   // Empty if the bytecode doesn't record it
+}
+
+// New returns a client for the Rex service at addr, such as
+// localhost:50051. The connection is made on the first call.
+func New(addr string, options Options) (*Client, error) {
+	if options.RetryDelay == 0 {
+		options.RetryDelay = 100 * time.Millisecond
+	}
+	creds := options.Credentials
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	dialOptions := append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, options.DialOptions...)
+	if options.Token != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(bearerToken{token: options.Token, secure: options.Credentials != nil}))
+	}
+	conn, err := grpc.NewClient(addr, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, rex: rexpb.NewRexClient(conn), options: options}, nil
+}
+
+// Close closes the connection to the service.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// PushFacts sends an update, which the service evaluates after the updates
+// queued before it, and returns its correlation ID without waiting for it to
+// be evaluated.
+func (c *Client) PushFacts(ctx context.Context, update Update) (string, error) {
+	req, err := toRequest(update)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.rex.UpdateFacts(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return resp.CorrelationId, nil
+}
+
+// Evaluate sends an update and waits for the rules reading its facts to be
+// evaluated, returning the actions they triggered.
+func (c *Client) Evaluate(ctx context.Context, update Update) (*Evaluation, error) {
+	req, err := toRequest(update)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.rex.Evaluate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	evaluation := &Evaluation{CorrelationID: resp.CorrelationId}
+	for _, action := range resp.Actions {
+		evaluation.Actions = append(evaluation.Actions, fromAction(action))
+	}
+	return evaluation, nil
+}
+
+// GetFacts returns the values of the named facts, or of every fact if no
+// name is given, as of the last cycle the service evaluated. Facts that
+// aren't set are left out. Ints are returned as int64.
+func (c *Client) GetFacts(ctx context.Context, names ...string) (map[string]interface{}, error) {
+	var resp *rexpb.GetFactsResponse
+	err := c.retry(ctx, func() (err error) {
+		resp, err = c.rex.GetFacts(ctx, &rexpb.GetFactsRequest{Names: names})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	facts := make(map[string]interface{}, len(resp.Facts))
+	for name, value := range resp.Facts {
+		facts[name] = fromValue(value)
+	}
+	return facts, nil
+}
+
+// SwapBytecode replaces the bytecode the service evaluates with a bytecode
+// file, as the preprocessor writes it. The service keeps the facts and
+// evaluates every rule of the new bytecode once.
+func (c *Client) SwapBytecode(ctx context.Context, image []byte) (*Bytecode, error) {
+	resp, err := c.rex.LoadBytecode(ctx, &rexpb.LoadBytecodeRequest{Bytecode: image})
+	if err != nil {
+		return nil, err
+	}
+	return &Bytecode{Rules: resp.Rules, RulesetHash: resp.RulesetHash}, nil
+}
+
+// FiringStream receives the actions the rules trigger as they fire.
+type FiringStream struct {
+	stream rexpb.Rex_StreamActionsClient
+	cancel context.CancelFunc
+}
+
+// StreamFirings starts watching the actions the rules trigger, only those of
+// the given types if any, and returns once the service watches them, so the
+// actions of the updates sent next aren't missed. The service drops actions
+// for clients falling behind. Close the stream when done with it.
+func (c *Client) StreamFirings(ctx context.Context, types ...string) (*FiringStream, error) {
+	var firings *FiringStream
+	err := c.retry(ctx, func() error {
+		streamCtx, cancel := context.WithCancel(ctx)
+		stream, err := c.rex.StreamActions(streamCtx, &rexpb.StreamActionsRequest{Types: types})
+		if err == nil {
+			_, err = stream.Header()
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		firings = &FiringStream{stream: stream, cancel: cancel}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return firings, nil
+}
+
+// Recv waits for the next action. It returns an error once the stream is
+// closed, its context ends or the connection fails.
+func (s *FiringStream) Recv() (*Action, error) {
+	action, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	converted := fromAction(action)
+	return &converted, nil
+}
+
+// Close stops watching the actions.
+func (s *FiringStream) Close() {
+	s.cancel()
+}
+
+// retry calls call, and calls it again while it fails because the service
+// is unavailable, up to Options.Retries times. Only calls that don't change
+// the service are retried, since a call may fail after being applied.
+func (c *Client) retry(ctx context.Context, call func() error) error {
+	delay := c.options.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil || status.Code(err) != codes.Unavailable || attempt >= c.options.Retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// bearerToken sends a token in the authorization metadata of each call.
+type bearerToken struct {
+	token  string
+	secure bool
+}
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+// RequireTransportSecurity only requires a secure connection if the client
+// was given credentials, so a token can also reach a proxy over a private
+// network.
+func (t bearerToken) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+// toRequest converts an update to the request sending it.
+func toRequest(update Update) (*rexpb.UpdateFactsRequest, error) {
+	req := &rexpb.UpdateFactsRequest{
+		Set:           make(map[string]*rexpb.Value, len(update.Set)),
+		Delete:        update.Delete,
+		CorrelationId: update.CorrelationID,
+	}
+	for name, value := range update.Set {
+		converted, err := toValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("fact %s: %w", name, err)
+		}
+		req.Set[name] = converted
+	}
+	return req, nil
+}
+
+// toValue converts a fact value to one the service takes.
+func toValue(value interface{}) (*rexpb.Value, error) {
+	switch v := value.(type) {
+	case int:
+		return &rexpb.Value{Kind: &rexpb.Value_IntValue{IntValue: int64(v)}}, nil
+	case int32:
+		return &rexpb.Value{Kind: &rexpb.Value_IntValue{IntValue: int64(v)}}, nil
+	case int64:
+		return &rexpb.Value{Kind: &rexpb.Value_IntValue{IntValue: v}}, nil
+	case uint32:
+		return &rexpb.Value{Kind: &rexpb.Value_IntValue{IntValue: int64(v)}}, nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil, fmt.Errorf("%d is out of range", v)
+		}
+		return &rexpb.Value{Kind: &rexpb.Value_IntValue{IntValue: int64(v)}}, nil
+	case float32:
+		return &rexpb.Value{Kind: &rexpb.Value_FloatValue{FloatValue: float64(v)}}, nil
+	case float64:
+		return &rexpb.Value{Kind: &rexpb.Value_FloatValue{FloatValue: v}}, nil
+	case string:
+		return &rexpb.Value{Kind: &rexpb.Value_StringValue{StringValue: v}}, nil
+	case bool:
+		return &rexpb.Value{Kind: &rexpb.Value_BoolValue{BoolValue: v}}, nil
+	default:
+		return nil, errors.New("values must be ints, floats, strings or bools")
+	}
+}
+
+// fromValue converts a value sent by the service; nil if it has no kind.
+func fromValue(value *rexpb.Value) interface{} {
+	switch v := value.GetKind().(type) {
+	case *rexpb.Value_IntValue:
+		return v.IntValue
+	case *rexpb.Value_FloatValue:
+		return v.FloatValue
+	case *rexpb.Value_StringValue:
+		return v.StringValue
+	case *rexpb.Value_BoolValue:
+		return v.BoolValue
+	default:
+		return nil
+	}
+}
+
+// fromAction converts an action sent by the service.
+func fromAction(action *rexpb.Action) Action {
+	return Action{
+		Rule:          int(action.Rule),
+		RuleName:      action.RuleName,
+		Type:          action.Type,
+		Target:        action.Target,
+		Value:         fromValue(action.Value),
+		CorrelationID: action.CorrelationId,
+		RulesetHash:   action.RulesetHash,
+	}
+}
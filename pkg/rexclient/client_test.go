@@ -0,0 +1,166 @@
+package rexclient
+
+import (
+	"context"
+	"net"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rpcserver"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const alertRules = `[
+    {
+        "name": "overheating",
+        "consumedFacts": ["temperature"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [{"type": "sendAlert", "target": "ops", "value": "too hot"}]}
+    }
+]`
+
+// newTestClient serves the Rex service over an in-memory connection, with
+// the given gRPC server options, and returns a client for it.
+func newTestClient(t *testing.T, options Options, serverOptions ...grpc.ServerOption) *Client {
+	listener := bufconn.Listen(1 << 20)
+	server := rpcserver.New(nil)
+	grpcServer := grpc.NewServer(serverOptions...)
+	server.Register(grpcServer)
+	go grpcServer.Serve(listener)
+	t.Cleanup(func() {
+		grpcServer.Stop()
+		server.Close()
+	})
+
+	options.DialOptions = append(options.DialOptions,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }))
+	c, err := New("passthrough:///bufnet", options)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// invalidBytecode ends in the middle of an instruction.
+var invalidBytecode = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(bytecode.LOAD_CONST_INT64)}
+
+// compileAlertRules compiles alertRules to a bytecode file.
+func compileAlertRules(t *testing.T) []byte {
+	ruleset, err := compiler.ParseRules([]byte(alertRules), compiler.Options{})
+	require.NoError(t, err)
+	compiled, err := compiler.Compile(ruleset, compiler.Options{})
+	require.NoError(t, err)
+	return compiled.Image
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, Options{})
+
+	swapped, err := c.SwapBytecode(ctx, compileAlertRules(t))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"overheating"}, swapped.Rules)
+	assert.Len(t, swapped.RulesetHash, 64)
+
+	firings, err := c.StreamFirings(ctx, "sendAlert")
+	require.NoError(t, err)
+	defer firings.Close()
+
+	correlationID, err := c.PushFacts(ctx, Update{Set: map[string]interface{}{"temperature": 35}, CorrelationID: "c1"})
+	require.NoError(t, err)
+	assert.Equal(t, "c1", correlationID)
+	action, err := firings.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, &Action{Rule: 0, RuleName: "overheating", Type: "sendAlert", Target: "ops", Value: "too hot",
+		CorrelationID: "c1", RulesetHash: swapped.RulesetHash}, action)
+
+	evaluation, err := c.Evaluate(ctx, Update{Set: map[string]interface{}{"temperature": 36.5, "site": "north"}, CorrelationID: "c2"})
+	require.NoError(t, err)
+	assert.Equal(t, "c2", evaluation.CorrelationID)
+	require.Len(t, evaluation.Actions, 1)
+	assert.Equal(t, "overheating", evaluation.Actions[0].RuleName)
+
+	facts, err := c.GetFacts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"temperature": 36.5, "site": "north"}, facts)
+
+	_, err = c.Evaluate(ctx, Update{Set: map[string]interface{}{"count": int64(7)}, Delete: []string{"site"}})
+	require.NoError(t, err)
+	facts, err = c.GetFacts(ctx, "count", "site")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"count": int64(7)}, facts)
+}
+
+func TestClient_Errors(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, Options{})
+
+	_, err := c.GetFacts(ctx)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = c.SwapBytecode(ctx, invalidBytecode)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = c.PushFacts(ctx, Update{Set: map[string]interface{}{"readings": []int{1, 2}}})
+	assert.EqualError(t, err, "fact readings: values must be ints, floats, strings or bools")
+}
+
+func TestClient_RetriesAndToken(t *testing.T) {
+	var calls atomic.Int32
+	var unavailable atomic.Bool
+	var authorization atomic.Value
+	// Fails the next call as if the service was restarting
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		calls.Add(1)
+		md, _ := metadata.FromIncomingContext(ctx)
+		authorization.Store(md.Get("authorization"))
+		if unavailable.Swap(false) {
+			return nil, status.Error(codes.Unavailable, "restarting")
+		}
+		return handler(ctx, req)
+	}
+	c := newTestClient(t, Options{Token: "secret", Retries: 2, RetryDelay: time.Millisecond}, grpc.UnaryInterceptor(interceptor))
+	ctx := context.Background()
+
+	// Calls changing the service aren't retried, since they may have been
+	// applied
+	unavailable.Store(true)
+	_, err := c.SwapBytecode(ctx, compileAlertRules(t))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, []string{"Bearer secret"}, authorization.Load())
+	_, err = c.SwapBytecode(ctx, compileAlertRules(t))
+	require.NoError(t, err)
+	unavailable.Store(true)
+	_, err = c.PushFacts(ctx, Update{Set: map[string]interface{}{"temperature": 35}})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	unavailable.Store(true)
+	_, err = c.Evaluate(ctx, Update{Set: map[string]interface{}{"temperature": 35}})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, int32(4), calls.Load())
+
+	// GetFacts is
+	calls.Store(0)
+	unavailable.Store(true)
+	_, err = c.GetFacts(ctx, "temperature")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// Other failures aren't retried
+	calls.Store(0)
+	_, err = c.SwapBytecode(ctx, invalidBytecode)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// Nor are calls once the retries are used up
+	unavailable.Store(true)
+	c.options.Retries = 0
+	_, err = c.GetFacts(ctx)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
@@ -0,0 +1,8 @@
+// rexpb/doc.go
+
+// Package rexpb holds the messages and gRPC stubs of the Rex service, which
+// rex serve implements. Go clients use NewRexClient; clients in other
+// languages are generated from rex.proto.
+package rexpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative rex.proto
@@ -0,0 +1,351 @@
+// rexpb/rex.proto
+//
+// The Rex service compiles rulesets and evaluates them against the facts its
+// clients send, so that rex can run as a central rules service started with
+// rex serve. Regenerate the Go code with go generate ./rexpb.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: rex.proto
+
+package rexpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Rex_CompileRules_FullMethodName  = "/rex.v1.Rex/CompileRules"
+	Rex_LoadBytecode_FullMethodName  = "/rex.v1.Rex/LoadBytecode"
+	Rex_UpdateFacts_FullMethodName   = "/rex.v1.Rex/UpdateFacts"
+	Rex_Evaluate_FullMethodName      = "/rex.v1.Rex/Evaluate"
+	Rex_GetFacts_FullMethodName      = "/rex.v1.Rex/GetFacts"
+	Rex_StreamActions_FullMethodName = "/rex.v1.Rex/StreamActions"
+)
+
+// RexClient is the client API for Rex service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Rex compiles rulesets and evaluates the loaded bytecode.
+type RexClient interface {
+	// CompileRules compiles a ruleset to bytecode. A ruleset with problems is
+	// answered with every problem found rather than an error.
+	CompileRules(ctx context.Context, in *CompileRulesRequest, opts ...grpc.CallOption) (*CompileRulesResponse, error)
+	// LoadBytecode replaces the bytecode the service evaluates. The facts are
+	// kept, and every rule of the new bytecode is evaluated once.
+	LoadBytecode(ctx context.Context, in *LoadBytecodeRequest, opts ...grpc.CallOption) (*LoadBytecodeResponse, error)
+	// UpdateFacts sets and deletes facts. The rules reading them are then
+	// evaluated, after the updates queued before; the actions they trigger are
+	// sent to StreamActions.
+	UpdateFacts(ctx context.Context, in *UpdateFactsRequest, opts ...grpc.CallOption) (*UpdateFactsResponse, error)
+	// Evaluate sets and deletes facts as UpdateFacts does, but answers once
+	// the rules reading them have been evaluated, with the actions triggered.
+	Evaluate(ctx context.Context, in *UpdateFactsRequest, opts ...grpc.CallOption) (*EvaluateResponse, error)
+	// GetFacts returns the values of facts, as of the last cycle evaluated.
+	GetFacts(ctx context.Context, in *GetFactsRequest, opts ...grpc.CallOption) (*GetFactsResponse, error)
+	// StreamActions sends the actions the rules trigger until the client
+	// cancels the call. The response headers are sent once the actions are
+	// being watched, and actions are dropped for clients falling behind.
+	StreamActions(ctx context.Context, in *StreamActionsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Action], error)
+}
+
+type rexClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRexClient(cc grpc.ClientConnInterface) RexClient {
+	return &rexClient{cc}
+}
+
+func (c *rexClient) CompileRules(ctx context.Context, in *CompileRulesRequest, opts ...grpc.CallOption) (*CompileRulesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CompileRulesResponse)
+	err := c.cc.Invoke(ctx, Rex_CompileRules_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rexClient) LoadBytecode(ctx context.Context, in *LoadBytecodeRequest, opts ...grpc.CallOption) (*LoadBytecodeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LoadBytecodeResponse)
+	err := c.cc.Invoke(ctx, Rex_LoadBytecode_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rexClient) UpdateFacts(ctx context.Context, in *UpdateFactsRequest, opts ...grpc.CallOption) (*UpdateFactsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UpdateFactsResponse)
+	err := c.cc.Invoke(ctx, Rex_UpdateFacts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rexClient) Evaluate(ctx context.Context, in *UpdateFactsRequest, opts ...grpc.CallOption) (*EvaluateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EvaluateResponse)
+	err := c.cc.Invoke(ctx, Rex_Evaluate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rexClient) GetFacts(ctx context.Context, in *GetFactsRequest, opts ...grpc.CallOption) (*GetFactsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetFactsResponse)
+	err := c.cc.Invoke(ctx, Rex_GetFacts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rexClient) StreamActions(ctx context.Context, in *StreamActionsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Action], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Rex_ServiceDesc.Streams[0], Rex_StreamActions_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamActionsRequest, Action]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Rex_StreamActionsClient = grpc.ServerStreamingClient[Action]
+
+// RexServer is the server API for Rex service.
+// All implementations must embed UnimplementedRexServer
+// for forward compatibility.
+//
+// Rex compiles rulesets and evaluates the loaded bytecode.
+type RexServer interface {
+	// CompileRules compiles a ruleset to bytecode. A ruleset with problems is
+	// answered with every problem found rather than an error.
+	CompileRules(context.Context, *CompileRulesRequest) (*CompileRulesResponse, error)
+	// LoadBytecode replaces the bytecode the service evaluates. The facts are
+	// kept, and every rule of the new bytecode is evaluated once.
+	LoadBytecode(context.Context, *LoadBytecodeRequest) (*LoadBytecodeResponse, error)
+	// UpdateFacts sets and deletes facts. The rules reading them are then
+	// evaluated, after the updates queued before; the actions they trigger are
+	// sent to StreamActions.
+	UpdateFacts(context.Context, *UpdateFactsRequest) (*UpdateFactsResponse, error)
+	// Evaluate sets and deletes facts as UpdateFacts does, but answers once
+	// the rules reading them have been evaluated, with the actions triggered.
+	Evaluate(context.Context, *UpdateFactsRequest) (*EvaluateResponse, error)
+	// GetFacts returns the values of facts, as of the last cycle evaluated.
+	GetFacts(context.Context, *GetFactsRequest) (*GetFactsResponse, error)
+	// StreamActions sends the actions the rules trigger until the client
+	// cancels the call. The response headers are sent once the actions are
+	// being watched, and actions are dropped for clients falling behind.
+	StreamActions(*StreamActionsRequest, grpc.ServerStreamingServer[Action]) error
+	mustEmbedUnimplementedRexServer()
+}
+
+// UnimplementedRexServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRexServer struct{}
+
+func (UnimplementedRexServer) CompileRules(context.Context, *CompileRulesRequest) (*CompileRulesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CompileRules not implemented")
+}
+func (UnimplementedRexServer) LoadBytecode(context.Context, *LoadBytecodeRequest) (*LoadBytecodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LoadBytecode not implemented")
+}
+func (UnimplementedRexServer) UpdateFacts(context.Context, *UpdateFactsRequest) (*UpdateFactsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFacts not implemented")
+}
+func (UnimplementedRexServer) Evaluate(context.Context, *UpdateFactsRequest) (*EvaluateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Evaluate not implemented")
+}
+func (UnimplementedRexServer) GetFacts(context.Context, *GetFactsRequest) (*GetFactsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFacts not implemented")
+}
+func (UnimplementedRexServer) StreamActions(*StreamActionsRequest, grpc.ServerStreamingServer[Action]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamActions not implemented")
+}
+func (UnimplementedRexServer) mustEmbedUnimplementedRexServer() {}
+func (UnimplementedRexServer) testEmbeddedByValue()             {}
+
+// UnsafeRexServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RexServer will
+// result in compilation errors.
+type UnsafeRexServer interface {
+	mustEmbedUnimplementedRexServer()
+}
+
+func RegisterRexServer(s grpc.ServiceRegistrar, srv RexServer) {
+	// If the following call pancis, it indicates UnimplementedRexServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Rex_ServiceDesc, srv)
+}
+
+func _Rex_CompileRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompileRulesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RexServer).CompileRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Rex_CompileRules_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RexServer).CompileRules(ctx, req.(*CompileRulesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rex_LoadBytecode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoadBytecodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RexServer).LoadBytecode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Rex_LoadBytecode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RexServer).LoadBytecode(ctx, req.(*LoadBytecodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rex_UpdateFacts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateFactsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RexServer).UpdateFacts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Rex_UpdateFacts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RexServer).UpdateFacts(ctx, req.(*UpdateFactsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rex_Evaluate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateFactsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RexServer).Evaluate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Rex_Evaluate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RexServer).Evaluate(ctx, req.(*UpdateFactsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rex_GetFacts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetFactsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RexServer).GetFacts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Rex_GetFacts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RexServer).GetFacts(ctx, req.(*GetFactsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Rex_StreamActions_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamActionsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RexServer).StreamActions(m, &grpc.GenericServerStream[StreamActionsRequest, Action]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Rex_StreamActionsServer = grpc.ServerStreamingServer[Action]
+
+// Rex_ServiceDesc is the grpc.ServiceDesc for Rex service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Rex_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rex.v1.Rex",
+	HandlerType: (*RexServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CompileRules",
+			Handler:    _Rex_CompileRules_Handler,
+		},
+		{
+			MethodName: "LoadBytecode",
+			Handler:    _Rex_LoadBytecode_Handler,
+		},
+		{
+			MethodName: "UpdateFacts",
+			Handler:    _Rex_UpdateFacts_Handler,
+		},
+		{
+			MethodName: "Evaluate",
+			Handler:    _Rex_Evaluate_Handler,
+		},
+		{
+			MethodName: "GetFacts",
+			Handler:    _Rex_GetFacts_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamActions",
+			Handler:       _Rex_StreamActions_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rex.proto",
+}
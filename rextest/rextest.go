@@ -0,0 +1,213 @@
+// rextest/rextest.go
+
+// Package rextest compiles and evaluates rulesets in memory, so that projects
+// embedding the engine can test their rules in ordinary Go unit tests:
+//
+//	func TestCooling(t *testing.T) {
+//		rules := rextest.MustCompile(t, `[{"name": "cooling", ...}]`)
+//		result := rextest.Eval(t, rules, map[string]interface{}{"temperature": 35})
+//		rextest.AssertFired(t, result, "cooling")
+//		rextest.AssertFact(t, result, "fan_status", true)
+//	}
+//
+// Rulesets are compiled the way the preprocessor compiles them with its
+// default options, and evaluated by the runtime's VM. The actions they
+// trigger are recorded, not performed, so tests never reach the action
+// handlers registered in the process.
+package rextest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"rgehrsitz/rex/compiler"
+	"rgehrsitz/rex/internal/preprocessor/bytecode"
+	"rgehrsitz/rex/internal/rules"
+	"rgehrsitz/rex/internal/runtime"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Action is an action triggered by a rule.
+type Action = runtime.Action
+
+// UpdateEnv is the environment variable that makes AssertGolden write the
+// golden files instead of comparing with them, e.g. REXTEST_UPDATE=1 go test.
+const UpdateEnv = "REXTEST_UPDATE"
+
+// Bytecode is a compiled ruleset.
+type Bytecode struct {
+	Image []byte // As the preprocessor writes it, with the fact table
+
+	// names lists the rules each rule of the image stands for, by position
+	// in the image: the rule itself, then the rules the optimizer merged
+	// into it.
+	names [][]string
+}
+
+// Compile parses, validates, optimizes and compiles a ruleset like the
+// preprocessor does with its default options.
+func Compile(ruleJSON []byte) (*Bytecode, error) {
+	ruleset, err := compiler.ParseRules(ruleJSON, compiler.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse and validate rules: %w", err)
+	}
+	if ruleset, err = compiler.Optimize(ruleset); err != nil {
+		return nil, err
+	}
+	compiled, err := compiler.Compile(ruleset, compiler.Options{})
+	if err != nil {
+		return nil, err
+	}
+	_, sections, err := bytecode.SplitSections(compiled.Image)
+	if err != nil {
+		return nil, err
+	}
+	symbols, _, err := bytecode.ReadRules(sections)
+	if err != nil {
+		return nil, err
+	}
+	names := make([][]string, len(symbols))
+	for i, symbol := range symbols {
+		names[i] = append([]string{symbol.Name}, symbol.Merged...)
+	}
+	return &Bytecode{Image: compiled.Image, names: names}, nil
+}
+
+// MustCompile compiles a ruleset like Compile, failing the test if it doesn't
+// compile.
+func MustCompile(t testing.TB, ruleJSON string) *Bytecode {
+	t.Helper()
+	compiled, err := Compile([]byte(ruleJSON))
+	if err != nil {
+		t.Fatalf("rextest: %v", err)
+	}
+	return compiled
+}
+
+// Result is the outcome of an evaluation cycle.
+type Result struct {
+	Fired   []string               // Rules that fired, in evaluation order
+	Actions []Action               // Actions triggered, other than fact updates, in order
+	Facts   map[string]interface{} // Facts after the cycle
+	Changes map[string]interface{} // Facts the cycle set to a new value, with their values
+}
+
+// Eval runs an evaluation cycle of a compiled ruleset on a fresh fact store
+// holding facts, failing the test if the cycle fails. The actions the cycle
+// triggers are recorded in the result instead of being performed.
+func Eval(t testing.TB, compiled *Bytecode, facts map[string]interface{}) *Result {
+	t.Helper()
+	vm := runtime.NewVM(compiled.Image)
+	vm.SetFacts(facts)
+	before := vm.Facts()
+
+	result := &Result{Fired: []string{}, Actions: []Action{}}
+	vm.OnAfterRule(func(rule int, fired bool) {
+		if fired && rule < len(compiled.names) {
+			result.Fired = append(result.Fired, compiled.names[rule]...)
+		}
+	})
+	// A window covering the cycle withholds every action, and hands it over
+	vm.OnActionSuppressed(func(action Action, window string) {
+		result.Actions = append(result.Actions, action)
+	})
+	if err := vm.Suppress(runtime.SuppressionWindow{Name: "rextest", End: vm.Clock().Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("rextest: %v", err)
+	}
+
+	if err := vm.Run(); err != nil {
+		t.Fatalf("rextest: evaluation failed: %v", err)
+	}
+	result.Facts = vm.Facts()
+	result.Changes = make(map[string]interface{})
+	for name, value := range result.Facts {
+		if previous, ok := before[name]; !ok || !reflect.DeepEqual(previous, value) {
+			result.Changes[name] = value
+		}
+	}
+	return result
+}
+
+// Explain describes a result as text, one line per fired rule, action and
+// changed fact, in a stable order suited to golden files.
+func (r *Result) Explain() string {
+	var b strings.Builder
+	for _, rule := range r.Fired {
+		fmt.Fprintf(&b, "fired %s\n", rule)
+	}
+	for _, action := range r.Actions {
+		fmt.Fprintf(&b, "action %s %s %#v\n", action.Type, action.Target, action.Value)
+	}
+	changed := make([]string, 0, len(r.Changes))
+	for name := range r.Changes {
+		changed = append(changed, name)
+	}
+	sort.Strings(changed)
+	for _, name := range changed {
+		fmt.Fprintf(&b, "set %s = %#v\n", name, r.Changes[name])
+	}
+	return b.String()
+}
+
+// AssertFired checks that the given rules fired.
+func AssertFired(t testing.TB, r *Result, rules ...string) {
+	t.Helper()
+	for _, rule := range rules {
+		if !slices.Contains(r.Fired, rule) {
+			t.Errorf("rextest: rule %s didn't fire; fired: %v", rule, r.Fired)
+		}
+	}
+}
+
+// AssertNotFired checks that none of the given rules fired.
+func AssertNotFired(t testing.TB, r *Result, rules ...string) {
+	t.Helper()
+	for _, rule := range rules {
+		if slices.Contains(r.Fired, rule) {
+			t.Errorf("rextest: rule %s fired", rule)
+		}
+	}
+}
+
+// AssertFact checks the value of a fact after the cycle. Numbers are compared
+// by value, like the rules compare them, so 30 equals 30.0.
+func AssertFact(t testing.TB, r *Result, fact string, want interface{}) {
+	t.Helper()
+	got, ok := r.Facts[fact]
+	if !ok {
+		t.Errorf("rextest: fact %s isn't set, want %v", fact, want)
+		return
+	}
+	if equal, err := runtime.Compare(rules.OperatorEqual, got, want); err == nil && equal {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rextest: fact %s is %#v, want %#v", fact, got, want)
+	}
+}
+
+// AssertGolden checks that the explanation of a result matches the golden
+// file at path, usually under testdata. With REXTEST_UPDATE set, it writes
+// the explanation to the file instead.
+func AssertGolden(t testing.TB, r *Result, path string) {
+	t.Helper()
+	explanation := []byte(r.Explain())
+	if os.Getenv(UpdateEnv) != "" {
+		if err := os.WriteFile(path, explanation, 0644); err != nil {
+			t.Fatalf("rextest: %v", err)
+		}
+		return
+	}
+	golden, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("rextest: %v; run with %s=1 to create it", err, UpdateEnv)
+	}
+	if !bytes.Equal(golden, explanation) {
+		t.Errorf("rextest: result differs from %s; run with %s=1 to update it\n--- want\n%s--- got\n%s", path, UpdateEnv, golden, explanation)
+	}
+}
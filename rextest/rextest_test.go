@@ -0,0 +1,80 @@
+package rextest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const coolingRules = `[
+    {
+        "name": "cooling",
+        "priority": 10,
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["fan_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+        "event": {"actions": [
+            {"type": "updateFact", "target": "fan_status", "value": true},
+            {"type": "notify", "target": "ops", "value": "too hot"}
+        ]}
+    },
+    {
+        "name": "heating",
+        "priority": 5,
+        "consumedFacts": ["temperature"],
+        "producedFacts": ["heater_status"],
+        "conditions": {"all": [{"fact": "temperature", "operator": "lessThan", "value": 10}]},
+        "event": {"actions": [{"type": "updateFact", "target": "heater_status", "value": true}]}
+    }
+]`
+
+func TestEval(t *testing.T) {
+	compiled := MustCompile(t, coolingRules)
+
+	result := Eval(t, compiled, map[string]interface{}{"temperature": 35})
+	AssertFired(t, result, "cooling")
+	AssertNotFired(t, result, "heating")
+	AssertFact(t, result, "fan_status", true)
+	AssertFact(t, result, "temperature", 35.0)
+	assert.Equal(t, map[string]interface{}{"fan_status": true}, result.Changes)
+	require.Len(t, result.Actions, 1, "the action is recorded, not performed")
+	assert.Equal(t, "ops", result.Actions[0].Target)
+	AssertGolden(t, result, filepath.Join("testdata", "cooling.golden"))
+
+	// Every evaluation starts from the facts it is given
+	result = Eval(t, compiled, map[string]interface{}{"temperature": 20})
+	assert.Empty(t, result.Fired)
+	assert.Empty(t, result.Actions)
+	assert.Empty(t, result.Changes)
+}
+
+func TestEval_MergedRules(t *testing.T) {
+	compiled := MustCompile(t, `[
+        {
+            "name": "fan",
+            "consumedFacts": ["temperature"],
+            "producedFacts": ["fan_status"],
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+            "event": {"actions": [{"type": "updateFact", "target": "fan_status", "value": true}]}
+        },
+        {
+            "name": "alarm",
+            "consumedFacts": ["temperature"],
+            "producedFacts": ["alarm"],
+            "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan", "value": 30}]},
+            "event": {"actions": [{"type": "updateFact", "target": "alarm", "value": true}]}
+        }
+    ]`)
+
+	// Rules the optimizer merged are reported by their own names
+	result := Eval(t, compiled, map[string]interface{}{"temperature": 35})
+	AssertFired(t, result, "fan", "alarm")
+	AssertFact(t, result, "alarm", true)
+}
+
+func TestCompile_Invalid(t *testing.T) {
+	_, err := Compile([]byte(`[{"name": "broken", "conditions": {"all": [{"fact": "temperature", "operator": "greaterThan"}]}}]`))
+	assert.Error(t, err)
+}